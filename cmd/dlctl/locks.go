@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"example.com/internal/repository"
+)
+
+// stuckLock is a lock no worker should hold anymore, and why.
+type stuckLock struct {
+	lock   repository.Lock
+	status string // of the download, empty if it does not exist
+	host   string
+	reason string
+}
+
+// locksCommand lists the locks of the download requests and tells the stuck ones, which
+// -release releases.
+func locksCommand(ctx context.Context, env *env, args []string) error {
+	fs := flag.NewFlagSet("locks", flag.ExitOnError)
+	release := fs.Bool("release", false, "release the stuck locks")
+	fs.Parse(args)
+
+	locks, err := env.repo.GetLocks(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DOWNLOAD\tSTATUS\tHOST\tTTL\tSTUCK")
+	var stuck []stuckLock
+	for _, lock := range locks {
+		s, err := checkLock(ctx, env, lock)
+		if err != nil {
+			return err
+		}
+		if s.reason != "" {
+			stuck = append(stuck, s)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", lock.DownloadID, s.status, s.host, formatTTL(lock.TTL), s.reason)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if *release {
+		releaseLocks(ctx, env, stuck)
+	}
+	return nil
+}
+
+// checkLock tells whether the lock is stuck: held for a download that does not exist, is not
+// downloading while it never expires, or runs on a process that is dead.
+func checkLock(ctx context.Context, env *env, lock repository.Lock) (stuckLock, error) {
+	s := stuckLock{lock: lock}
+	download, err := env.repo.GetDownloadRequest(ctx, lock.DownloadID)
+	if errors.Is(err, repository.DownloadRequestNotFoundErr) {
+		s.reason = "the download does not exist"
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	s.status, s.host = download.Status, download.Host
+
+	switch {
+	case lock.TTL == -1:
+		// Background jobs lock finished downloads too, but only for a while.
+		s.reason = "the lock never expires"
+	case download.Status == repository.StatusDownloading && env.cfg.InstanceTTL > 0:
+		alive, err := env.repo.IsInstanceAlive(ctx, download.Host)
+		if err != nil {
+			return s, err
+		}
+		if !alive {
+			s.reason = fmt.Sprintf("its host %q is dead", download.Host)
+		}
+	}
+	return s, nil
+}
+
+// releaseLocks releases the stuck locks, unless they were acquired again meanwhile.
+func releaseLocks(ctx context.Context, env *env, stuck []stuckLock) {
+	for _, s := range stuck {
+		if err := env.repo.ReleaseLock(ctx, s.lock.DownloadID, s.lock.Token); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		fmt.Printf("Released lock of download request %d: %s\n", s.lock.DownloadID, s.reason)
+	}
+}
+
+func formatTTL(ttl time.Duration) string {
+	if ttl == -1 {
+		return "never"
+	}
+	return ttl.Round(time.Second).String()
+}
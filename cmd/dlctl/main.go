@@ -0,0 +1,140 @@
+// Command dlctl inspects and repairs the download queue of a deployment: the depth of the
+// queues, the locks of the download requests, requeuing them by filter, the consistency of
+// Postgres, Redis and the disk, and the database migrations. It also runs a download through
+// the deployment end to end. It reads the environment of the server (DATABASE_URL,
+// REDIS_HOST, REDIS_PASS, REDIS_DB and the rest of the config).
+//
+//	dlctl queue
+//	dlctl locks [-release]
+//	dlctl requeue -status failed [-user 7] [-host node-1] [-error-code html_error_page] [-since 24h] [-until 1h] [-limit 100] [-dry-run]
+//	dlctl verify [-host node-1] [-dir /var/lib/downloader] [-fix]
+//	dlctl migrate [-dry-run]
+//	dlctl smoke [-api http://127.0.0.1:8080] [-listen 127.0.0.1:0] [-size 1048576] [-timeout 2m]
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"example.com/internal/config"
+	"example.com/internal/repository"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+)
+
+const usage = `Usage: dlctl <command> [flags]
+
+Commands:
+  queue     depth of the queues and downloads by status
+  locks     locks of the download requests, and the stuck ones
+  requeue   queue the download requests matching a filter again
+  verify    check that Postgres, Redis and the disk agree
+  migrate   apply the database migrations not applied yet
+  smoke     run a download through the deployment end to end
+
+Run dlctl <command> -h for the flags of a command.
+`
+
+// command runs a subcommand with its arguments.
+type command func(ctx context.Context, env *env, args []string) error
+
+var commands = map[string]command{
+	"queue":   queueCommand,
+	"locks":   locksCommand,
+	"requeue": requeueCommand,
+	"verify":  verifyCommand,
+	"migrate": migrateCommand,
+	"smoke":   smokeCommand,
+}
+
+// env is what the commands work with.
+type env struct {
+	repo repository.Repository
+	cfg  *config.Config
+	_    struct{}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	run, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	repo, closeAll, err := connect(ctx, cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	err = run(ctx, &env{repo: repo, cfg: cfg}, os.Args[2:])
+	closeAll()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// connect opens the database, Redis and the queue like the server does, within
+// cfg.StartupTimeout. Unlike the server, it leaves the statements without a deadline, for the
+// migrations and the commands going through every download.
+func connect(ctx context.Context, cfg *config.Config) (repository.Repository, func(), error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.StartupTimeout)
+	defer cancel()
+
+	redisDB, err := strconv.Atoi(os.Getenv("REDIS_DB"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid redis db: %v", err)
+	}
+	rdb := redis.NewClient(&redis.Options{
+		Addr:     os.Getenv("REDIS_HOST"),
+		Password: os.Getenv("REDIS_PASS"),
+		DB:       redisDB,
+	})
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		rdb.Close()
+		return nil, nil, fmt.Errorf("Unable to connect to cache: %v", err)
+	}
+
+	pool, err := pgxpool.New(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		rdb.Close()
+		return nil, nil, fmt.Errorf("Unable to connect to database: %v", err)
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		rdb.Close()
+		return nil, nil, fmt.Errorf("Unable to connect to database: %v", err)
+	}
+
+	queue := repository.NewRedisQueue(rdb)
+	if cfg.QueueBackend == config.QueueBackendNATS {
+		queue, err = repository.NewNATSQueue(ctx, cfg.NATSURL, cfg.NATSStream, cfg.NATSMaxDeliver)
+		if err != nil {
+			pool.Close()
+			rdb.Close()
+			return nil, nil, fmt.Errorf("Unable to connect to queue: %v", err)
+		}
+	}
+
+	return repository.New(pool, rdb, queue), func() {
+		pool.Close()
+		rdb.Close()
+	}, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+
+	"example.com/sql/migrations"
+)
+
+// migrateCommand applies the migrations embedded from sql/migrations that are not recorded in
+// the schema_migrations table yet, in order and each in a transaction, like sql/migrate.sh.
+func migrateCommand(ctx context.Context, env *env, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "list the migrations without applying them")
+	flags.Parse(args)
+
+	names, err := fs.Glob(migrations.Files, "*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	applied, err := env.repo.GetAppliedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+
+	pending := 0
+	for _, name := range names {
+		prefix, _, _ := strings.Cut(name, "_")
+		version, err := strconv.ParseInt(prefix, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid migration %s: its name must start with its version", name)
+		}
+		if applied[version] {
+			continue
+		}
+		pending++
+		if *dryRun {
+			fmt.Printf("Would apply %s\n", name)
+			continue
+		}
+
+		statements, err := fs.ReadFile(migrations.Files, name)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Applying %s\n", name)
+		if err := env.repo.ApplyMigration(ctx, version, string(statements)); err != nil {
+			return err
+		}
+	}
+	if pending == 0 {
+		fmt.Println("The schema is up to date")
+	}
+	return nil
+}
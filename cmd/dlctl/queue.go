@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// queueCommand prints the depth of the queues and the downloads by status.
+func queueCommand(ctx context.Context, env *env, args []string) error {
+	fs := flag.NewFlagSet("queue", flag.ExitOnError)
+	fs.Parse(args)
+
+	stats, err := env.repo.GetQueueStats(ctx)
+	if err != nil {
+		return err
+	}
+	outbox, err := env.repo.GetOutboxLength(ctx)
+	if err != nil {
+		return err
+	}
+	oldest, err := env.repo.OldestQueuedAge(ctx)
+	if err != nil {
+		return err
+	}
+	version, err := env.repo.GetSchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "queued\t%d\n", stats.Queued)
+	fmt.Fprintf(w, "unacked\t%d\n", stats.Unacked)
+	fmt.Fprintf(w, "outbox\t%d\n", outbox)
+	fmt.Fprintf(w, "oldest queued\t%s\n", oldest.Round(time.Second))
+	fmt.Fprintf(w, "pending\t%d\n", stats.Pending)
+	fmt.Fprintf(w, "completed\t%d\n", stats.Completed)
+	fmt.Fprintf(w, "failed\t%d\n", stats.Failed)
+	fmt.Fprintf(w, "expired\t%d\n", stats.Expired)
+	fmt.Fprintf(w, "schema version\t%d\n", version)
+	return w.Flush()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"example.com/internal/repository"
+)
+
+// requeueCommand queues the download requests matching the flags again: queued and
+// downloading ones that are not locked like the reconciliation does, and failed ones from
+// where their file stopped.
+func requeueCommand(ctx context.Context, env *env, args []string) error {
+	fs := flag.NewFlagSet("requeue", flag.ExitOnError)
+	status := fs.String("status", "", "status of the download requests: queued, downloading or failed (required)")
+	userID := fs.Int64("user", 0, "id of their owner")
+	host := fs.String("host", "", "instance ID of the process with their file")
+	errorCode := fs.String("error-code", "", "class of their error, e.g. html_error_page; malware only matches explicitly")
+	since := fs.String("since", "", "created at or after, RFC 3339 or a duration ago (e.g. 24h)")
+	until := fs.String("until", "", "created before, RFC 3339 or a duration ago")
+	limit := fs.Int64("limit", 0, "most download requests to requeue, 0 for all")
+	dryRun := fs.Bool("dry-run", false, "list them without requeuing them")
+	fs.Parse(args)
+
+	filter := repository.RequeueFilter{Status: *status, UserID: *userID, Host: *host, ErrorCode: *errorCode, Limit: *limit}
+	switch *status {
+	case repository.StatusQueued, repository.StatusDownloading, repository.StatusFailed:
+	default:
+		return errors.New("-status must be queued, downloading or failed")
+	}
+	var err error
+	if filter.Since, err = parseTime(*since); err != nil {
+		return fmt.Errorf("invalid -since: %v", err)
+	}
+	if filter.Until, err = parseTime(*until); err != nil {
+		return fmt.Errorf("invalid -until: %v", err)
+	}
+
+	downloads, err := env.repo.GetRequeueCandidates(ctx, filter)
+	if err != nil {
+		return err
+	}
+	if len(downloads) == 0 {
+		fmt.Println("No download request matches")
+		return nil
+	}
+	downloadIDs := make([]int64, 0, len(downloads))
+	for _, download := range downloads {
+		downloadIDs = append(downloadIDs, download.ID)
+	}
+	locked, err := env.repo.GetLockedDownloadRequests(ctx, downloadIDs)
+	if err != nil {
+		return err
+	}
+
+	requeued := 0
+	for _, download := range downloads {
+		if locked[download.ID] {
+			fmt.Printf("Skipped download request %d: it is locked by a worker\n", download.ID)
+			continue
+		}
+		if *dryRun {
+			fmt.Printf("Would requeue download request %d: %s\n", download.ID, download.Link)
+			continue
+		}
+		if err := requeue(ctx, env.repo, download.ID, download.Status); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		requeued++
+		fmt.Printf("Requeued download request %d: %s\n", download.ID, download.Link)
+	}
+	if !*dryRun {
+		fmt.Printf("Requeued %d of %d download requests\n", requeued, len(downloads))
+	}
+	return nil
+}
+
+func requeue(ctx context.Context, repo repository.Repository, downloadID int64, status string) error {
+	if status != repository.StatusFailed {
+		return repo.RequeueDownloadRequest(ctx, downloadID)
+	}
+	retries, err := repo.RetryDownloadRequest(ctx, downloadID, false)
+	if err != nil {
+		return err
+	}
+	if retries == 0 {
+		return fmt.Errorf("download request %d is no longer failed", downloadID)
+	}
+	return nil
+}
+
+// parseTime parses an RFC 3339 time or a duration before now, the zero time if value is empty.
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if ago, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-ago), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"example.com/internal/repository"
+	"example.com/pkg/client"
+)
+
+// smokeCommand runs a download through a deployment end to end: it serves a file of random
+// bytes, registers a user, requests the file through the API and checks that it is queued,
+// downloaded, completed in Postgres and served back byte for byte. The server must reach
+// -listen, and must run with ALLOW_PRIVATE_NETWORKS=true if it is on a private address. The
+// user, named smoke-<random>, is deleted at the end, which purges the download and its file.
+func smokeCommand(ctx context.Context, env *env, args []string) error {
+	fs := flag.NewFlagSet("smoke", flag.ExitOnError)
+	api := fs.String("api", "http://127.0.0.1:8080", "base URL of the API")
+	listen := fs.String("listen", "127.0.0.1:0", "address the file is served on, reachable by the server")
+	size := fs.Int64("size", 1<<20, "size of the file in bytes")
+	timeout := fs.Duration("timeout", 2*time.Minute, "time allowed for the whole run")
+	fs.Parse(args)
+
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	content := make([]byte, *size)
+	if _, err := rand.Read(content); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(content)
+	name := "smoke-" + hex.EncodeToString(sum[:4])
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return fmt.Errorf("could not serve the file: %v", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, name+".bin", time.Now(), bytes.NewReader(content))
+	})}
+	go server.Serve(ln)
+	defer server.Close()
+	link := fmt.Sprintf("http://%s/%s.bin", ln.Addr(), name)
+
+	start := time.Now()
+	step := func(format string, args ...any) {
+		fmt.Printf("%8s  %s\n", time.Since(start).Round(time.Millisecond), fmt.Sprintf(format, args...))
+	}
+
+	c := client.New(*api, client.Options{})
+	password := hex.EncodeToString(sum[4:16])
+	userID, err := c.Register(ctx, name, password)
+	if err != nil {
+		return fmt.Errorf("could not register %s: %v", name, err)
+	}
+	defer func() {
+		// Even if the run timed out.
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+		defer cancel()
+		if _, err := env.repo.DeleteAccount(ctx, userID); err != nil {
+			fmt.Printf("could not delete user %s: %v\n", name, err)
+			return
+		}
+		step("deleted user %s", name)
+	}()
+	if err := c.Login(ctx, name, password); err != nil {
+		return fmt.Errorf("could not log in as %s: %v", name, err)
+	}
+	step("registered user %s", name)
+
+	created, err := c.CreateDownload(ctx, client.CreateDownloadRequest{Link: link})
+	if err != nil {
+		return fmt.Errorf("could not request %s: %v", link, err)
+	}
+	download, err := env.repo.GetDownloadRequest(ctx, created.DownloadID)
+	if err != nil {
+		return err
+	}
+	step("requested %s: download request %d is %s", link, created.DownloadID, download.Status)
+
+	status := ""
+	err = c.WatchDownload(ctx, created.DownloadID, func(progress client.Progress) error {
+		if progress.Status != status {
+			step("%s, %d/%d bytes", progress.Status, progress.Bytes, progress.TotalBytes)
+			status = progress.Status
+		}
+		if progress.Error != "" {
+			return errors.New(progress.Error)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("download request %d failed: %v", created.DownloadID, err)
+	}
+	if status != client.StatusCompleted {
+		return fmt.Errorf("download request %d is %s", created.DownloadID, status)
+	}
+
+	download, err = env.repo.GetDownloadRequest(ctx, created.DownloadID)
+	if err != nil {
+		return err
+	}
+	if download.Status != repository.StatusCompleted || download.Bytes == nil || *download.Bytes != *size {
+		return fmt.Errorf("download request %d is %s with %v bytes in the database, want completed with %d", created.DownloadID, download.Status, download.Bytes, *size)
+	}
+	step("completed in the database on host %q", download.Host)
+
+	file, err := c.GetFile(ctx, created.DownloadID)
+	if err != nil {
+		return fmt.Errorf("could not get the file of download request %d: %v", created.DownloadID, err)
+	}
+	defer file.Close()
+	hash := sha256.New()
+	n, err := io.Copy(hash, file)
+	if err != nil {
+		return fmt.Errorf("could not read the file of download request %d: %v", created.DownloadID, err)
+	}
+	if !bytes.Equal(hash.Sum(nil), sum[:]) {
+		return fmt.Errorf("the file of download request %d differs from the one served (%d bytes)", created.DownloadID, n)
+	}
+	step("served back %d identical bytes", n)
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"example.com/internal/consumer"
+	"example.com/internal/repository"
+)
+
+// verifyCommand checks that Postgres, Redis and the disk agree, prints what does not and
+// fails if anything does not. -fix requeues the orphaned download requests and releases the
+// stuck locks. The disk is only checked with -dir, the working directory of the process
+// with the instance ID -host.
+func verifyCommand(ctx context.Context, env *env, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	host := fs.String("host", env.cfg.InstanceID, "instance ID of the process whose disk -dir is")
+	dir := fs.String("dir", "", "working directory of the process with the files of its downloads")
+	fix := fs.Bool("fix", false, "requeue the orphaned download requests and release the stuck locks")
+	fs.Parse(args)
+
+	problems := 0
+	report := func(format string, args ...any) {
+		problems++
+		fmt.Printf(format+"\n", args...)
+	}
+
+	// Queued or downloading in Postgres, but neither in a queue nor locked: nothing will
+	// process them until the reconciliation requeues them.
+	unfinished, err := env.repo.GetUnfinishedDownloadRequests(ctx, consumer.LinkProcessingExpTime)
+	if err != nil {
+		return err
+	}
+	queuedIDs, err := env.repo.GetQueuedDownloadRequests(ctx)
+	if err != nil {
+		return err
+	}
+	queued := make(map[int64]bool, len(queuedIDs))
+	for _, downloadID := range queuedIDs {
+		queued[downloadID] = true
+	}
+	unfinishedIDs := make([]int64, 0, len(unfinished))
+	for _, download := range unfinished {
+		unfinishedIDs = append(unfinishedIDs, download.ID)
+	}
+	locked, err := env.repo.GetLockedDownloadRequests(ctx, unfinishedIDs)
+	if err != nil {
+		return err
+	}
+	for _, download := range unfinished {
+		if queued[download.ID] || locked[download.ID] {
+			continue
+		}
+		report("orphaned request %d: %s but in no queue and not locked", download.ID, download.Status)
+		if *fix {
+			if err := env.repo.RequeueDownloadRequest(ctx, download.ID); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+	}
+
+	// In a queue, but finished or deleted in Postgres. Workers drop them, so they are only
+	// worth a look when there are many.
+	summaries, err := env.repo.GetDownloadSummaries(ctx, queuedIDs)
+	if err != nil {
+		return err
+	}
+	statuses := make(map[int64]string, len(summaries))
+	for _, summary := range summaries {
+		statuses[summary.ID] = summary.Status
+	}
+	for _, downloadID := range queuedIDs {
+		switch status, ok := statuses[downloadID]; {
+		case !ok:
+			report("stale queue entry %d: the download does not exist", downloadID)
+		case status != repository.StatusQueued && status != repository.StatusDownloading:
+			report("stale queue entry %d: the download is %s", downloadID, status)
+		}
+	}
+
+	locks, err := env.repo.GetLocks(ctx)
+	if err != nil {
+		return err
+	}
+	var stuck []stuckLock
+	for _, lock := range locks {
+		s, err := checkLock(ctx, env, lock)
+		if err != nil {
+			return err
+		}
+		if s.reason != "" {
+			stuck = append(stuck, s)
+			report("stuck lock %d: %s", lock.DownloadID, s.reason)
+		}
+	}
+	if *fix {
+		releaseLocks(ctx, env, stuck)
+	}
+
+	if *dir != "" {
+		if err := verifyDisk(ctx, env.repo, *host, *dir, env.cfg.DownloadDir, report); err != nil {
+			return err
+		}
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("found %d problems", problems)
+	}
+	fmt.Println("No problem found")
+	return nil
+}
+
+// verifyDisk checks that the completed downloads on the disk of host have their file in dir,
+// and that the files of downloads in downloadDir, relative to dir, belong to a download.
+func verifyDisk(ctx context.Context, repo repository.Repository, host string, dir string, downloadDir string, report func(string, ...any)) error {
+	downloads, err := repo.GetHostedDownloads(ctx, host)
+	if err != nil {
+		return err
+	}
+
+	names := make(map[string]bool, len(downloads))
+	for _, download := range downloads {
+		names[filepath.Base(download.FileName)] = true
+		if download.Status != repository.StatusCompleted {
+			continue
+		}
+		fileName := download.FileName
+		if !filepath.IsAbs(fileName) {
+			fileName = filepath.Join(dir, fileName)
+		}
+		if _, err := os.Stat(fileName); errors.Is(err, os.ErrNotExist) {
+			report("missing file of download %d: %s", download.ID, fileName)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if !filepath.IsAbs(downloadDir) {
+		downloadDir = filepath.Join(dir, downloadDir)
+	}
+	entries, err := os.ReadDir(downloadDir)
+	if err != nil {
+		return err
+	}
+	// The files of the downloads are named after a hash of their link, in decimal, with
+	// PartialFileSuffix until they are complete. The files of other DOWNLOAD_PATH_TEMPLATE
+	// layouts are not told apart from the other files, so they are not checked.
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), consumer.PartialFileSuffix)
+		if !entry.Type().IsRegular() || strings.Trim(name, "0123456789") != "" || names[name] {
+			continue
+		}
+		report("orphaned file %s: no download on %q has it", filepath.Join(downloadDir, entry.Name()), host)
+	}
+	return nil
+}
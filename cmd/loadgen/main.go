@@ -0,0 +1,273 @@
+// Command loadgen puts a deployment under load through its API: it serves files of random bytes,
+// registers synthetic users, submits their download requests from concurrent workers, follows
+// every download until it finishes and reports the throughput and the latency percentiles of
+// the submissions and of the downloads. The server must reach -listen, and must run with
+// ALLOW_PRIVATE_NETWORKS=true if it is on a private address. The rate limits of the server
+// (RATE_LIMIT_DOWNLOADS) throttle the users, raise them for runs with many requests per user.
+// The users and their downloads are left behind, named loadgen-<run>-<n>.
+//
+//	loadgen [-api http://127.0.0.1:8080] [-listen 127.0.0.1:0] [-users 10] [-requests 10] [-concurrency 20] [-size 65536] [-timeout 10m]
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"example.com/pkg/client"
+)
+
+func main() {
+	api := flag.String("api", "http://127.0.0.1:8080", "base URL of the API")
+	listen := flag.String("listen", "127.0.0.1:0", "address the files are served on, reachable by the server")
+	users := flag.Int("users", 10, "synthetic users to register")
+	requests := flag.Int("requests", 10, "download requests per user")
+	concurrency := flag.Int("concurrency", 20, "workers submitting the requests")
+	size := flag.Int64("size", 64<<10, "size of every file in bytes")
+	timeout := flag.Duration("timeout", 10*time.Minute, "time allowed for the whole run")
+	flag.Parse()
+	if *users <= 0 || *requests <= 0 || *concurrency <= 0 || *size < 0 {
+		log.Fatal("-users, -requests and -concurrency must be positive, -size must not be negative")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	g := loadgen{api: *api, users: *users, requests: *requests, concurrency: *concurrency, size: *size}
+	if err := g.run(ctx, *listen); err != nil {
+		log.Fatal(err)
+	}
+}
+
+type loadgen struct {
+	api         string
+	users       int
+	requests    int
+	concurrency int
+	size        int64
+
+	mu          sync.Mutex
+	submissions []time.Duration // of the created requests
+	downloads   []time.Duration // from submission to completion
+	submitErrs  map[string]int  // by error
+	finishErrs  map[string]int  // by status or error, of the downloads that did not complete
+	first, last time.Time       // first submission and last completion
+	_           struct{}
+}
+
+// job is a download request to submit.
+type job struct {
+	client client.Client
+	link   string
+}
+
+func (g *loadgen) run(ctx context.Context, listen string) error {
+	content, run := make([]byte, g.size), make([]byte, 4)
+	if _, err := rand.Read(content); err != nil {
+		return err
+	}
+	if _, err := rand.Read(run); err != nil {
+		return err
+	}
+	prefix := "loadgen-" + hex.EncodeToString(run)
+
+	// Every request has a link of its own, so that none is a duplicate of another.
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return fmt.Errorf("could not serve the files: %v", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	})}
+	go server.Serve(ln)
+	defer server.Close()
+
+	start := time.Now()
+	clients, err := g.register(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("registered %d users in %s\n", len(clients), time.Since(start).Round(time.Millisecond))
+
+	g.submitErrs, g.finishErrs = map[string]int{}, map[string]int{}
+	jobs := make(chan job)
+	go func() {
+		defer close(jobs)
+		for i := 0; i < g.requests; i++ {
+			for u, c := range clients {
+				select {
+				case jobs <- job{client: c, link: fmt.Sprintf("http://%s/%s-%d-%d.bin", ln.Addr(), prefix, u, i)}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	var submitters, watchers sync.WaitGroup
+	for i := 0; i < g.concurrency; i++ {
+		submitters.Add(1)
+		go func() {
+			defer submitters.Done()
+			for j := range jobs {
+				g.submit(ctx, j, &watchers)
+			}
+		}()
+	}
+	submitters.Wait()
+	fmt.Printf("submitted %d requests in %s\n", g.users*g.requests, time.Since(start).Round(time.Millisecond))
+	watchers.Wait()
+
+	g.report(os.Stdout)
+	return ctx.Err()
+}
+
+// register registers and logs in the users concurrently, and returns their clients.
+func (g *loadgen) register(ctx context.Context, prefix string) ([]client.Client, error) {
+	clients := make([]client.Client, g.users)
+	errs := make(chan error, g.users)
+	sem := make(chan struct{}, g.concurrency)
+	for i := range clients {
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() { <-sem }()
+			username, password := fmt.Sprintf("%s-%d", prefix, i), prefix+"-password"
+			c := client.New(g.api, client.Options{})
+			if _, err := c.Register(ctx, username, password); err != nil {
+				errs <- fmt.Errorf("could not register %s: %v", username, err)
+				return
+			}
+			if err := c.Login(ctx, username, password); err != nil {
+				errs <- fmt.Errorf("could not log in as %s: %v", username, err)
+				return
+			}
+			clients[i] = c
+			errs <- nil
+		}(i)
+	}
+	var failed error
+	for range clients {
+		if err := <-errs; err != nil && failed == nil {
+			failed = err
+		}
+	}
+	return clients, failed
+}
+
+// submit requests the download of the job and follows it until it finishes.
+func (g *loadgen) submit(ctx context.Context, j job, watchers *sync.WaitGroup) {
+	submitted := time.Now()
+	created, err := j.client.CreateDownload(ctx, client.CreateDownloadRequest{Link: j.link})
+	elapsed := time.Since(submitted)
+
+	g.mu.Lock()
+	if g.first.IsZero() {
+		g.first = submitted
+	}
+	if err != nil {
+		g.submitErrs[errorKey(err)]++
+	} else {
+		g.submissions = append(g.submissions, elapsed)
+	}
+	g.mu.Unlock()
+	if err != nil {
+		return
+	}
+
+	watchers.Add(1)
+	go func() {
+		defer watchers.Done()
+		status := ""
+		err := j.client.WatchDownload(ctx, created.DownloadID, func(progress client.Progress) error {
+			status = progress.Status
+			return nil
+		})
+		finished := time.Now()
+
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		switch {
+		case err != nil:
+			g.finishErrs[errorKey(err)]++
+		case status != client.StatusCompleted:
+			g.finishErrs[status]++
+		default:
+			g.downloads = append(g.downloads, finished.Sub(submitted))
+			if finished.After(g.last) {
+				g.last = finished
+			}
+		}
+	}()
+}
+
+// errorKey groups the errors by status code, or by message.
+func errorKey(err error) string {
+	var apiErr *client.APIError
+	if errors.As(err, &apiErr) {
+		return fmt.Sprintf("HTTP %d", apiErr.StatusCode)
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return "timed out"
+	}
+	return err.Error()
+}
+
+func (g *loadgen) report(out io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "\nrequests\t%d\n", g.users*g.requests)
+	fmt.Fprintf(w, "created\t%d\n", len(g.submissions))
+	fmt.Fprintf(w, "completed\t%d\n", len(g.downloads))
+	for key, n := range g.submitErrs {
+		fmt.Fprintf(w, "not created: %s\t%d\n", key, n)
+	}
+	for key, n := range g.finishErrs {
+		fmt.Fprintf(w, "not completed: %s\t%d\n", key, n)
+	}
+	if len(g.downloads) > 0 {
+		wall := g.last.Sub(g.first).Seconds()
+		fmt.Fprintf(w, "throughput\t%.1f downloads/s, %.1f MiB/s\n", float64(len(g.downloads))/wall, float64(g.size)*float64(len(g.downloads))/wall/(1<<20))
+	}
+	fmt.Fprintf(w, "\n\tp50\tp90\tp99\tmax\n")
+	for _, latencies := range []struct {
+		name      string
+		durations []time.Duration
+	}{{"submission", g.submissions}, {"download", g.downloads}} {
+		if len(latencies.durations) == 0 {
+			continue
+		}
+		sort.Slice(latencies.durations, func(i, j int) bool { return latencies.durations[i] < latencies.durations[j] })
+		fmt.Fprintf(w, "%s", latencies.name)
+		for _, p := range []float64{0.5, 0.9, 0.99, 1} {
+			fmt.Fprintf(w, "\t%s", percentile(latencies.durations, p).Round(time.Millisecond))
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	w.Flush()
+}
+
+// percentile returns the duration below which the fraction p of the sorted durations are.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return sorted[max(i, 0)]
+}
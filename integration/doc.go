@@ -0,0 +1,5 @@
+// Package integration tests the server end to end against Postgres, Redis and NATS run in
+// Docker containers. Its tests are built only with the integration tag:
+//
+//	go test -tags=integration ./integration
+package integration
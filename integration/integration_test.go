@@ -0,0 +1,331 @@
+//go:build integration
+
+package integration
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/internal/repository"
+	"example.com/pkg/client"
+	"example.com/sql/migrations"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/nats-io/nats.go"
+	"github.com/redis/go-redis/v9"
+)
+
+const fileSize = 1 << 20
+
+// TestDownload requests a file served by the test through the API of a server running on
+// fresh containers, and checks that it is queued, downloaded, completed in Postgres and served
+// back identical. The containers, the server and its files are removed at the end.
+func TestDownload(t *testing.T) {
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("docker is not installed")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	postgresAddr := startContainer(t, "postgres:14.5", "5432", []string{"POSTGRES_PASSWORD=postgres", "POSTGRES_DB=downloadslinks"})
+	redisAddr := startContainer(t, "redis:7", "6379", nil)
+	natsAddr := startContainer(t, "nats:2", "4222", nil, "-js")
+	databaseURL := fmt.Sprintf("postgres://postgres:postgres@%s/downloadslinks", postgresAddr)
+	natsURL := "nats://" + natsAddr
+
+	repo := connect(ctx, t, databaseURL, redisAddr)
+	waitFor(ctx, t, "nats", func(ctx context.Context) error {
+		conn, err := nats.Connect(natsURL)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	})
+	migrate(ctx, t, repo)
+
+	content := make([]byte, fileSize)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Now(), bytes.NewReader(content))
+	}))
+	defer origin.Close()
+
+	api := startServer(ctx, t, []string{
+		"DATABASE_URL=" + databaseURL,
+		"REDIS_HOST=" + redisAddr,
+		"REDIS_DB=0",
+		"QUEUE_BACKEND=nats",
+		"NATS_URL=" + natsURL,
+		"SECRET_KEY=integration-test",
+		"ALLOW_PRIVATE_NETWORKS=true",
+	})
+
+	c := client.New(api, client.Options{})
+	if _, err := c.Register(ctx, "integration", "integration-password"); err != nil {
+		t.Fatalf("could not register: %v", err)
+	}
+	if err := c.Login(ctx, "integration", "integration-password"); err != nil {
+		t.Fatalf("could not log in: %v", err)
+	}
+
+	link := origin.URL + "/file.bin"
+	created, err := c.CreateDownload(ctx, client.CreateDownloadRequest{Link: link})
+	if err != nil {
+		t.Fatalf("could not request %s: %v", link, err)
+	}
+	download, err := repo.GetDownloadRequest(ctx, created.DownloadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if download.Status != repository.StatusQueued && download.Status != repository.StatusDownloading && download.Status != repository.StatusCompleted {
+		t.Fatalf("download request %d is %s after its creation", created.DownloadID, download.Status)
+	}
+
+	var statuses []string
+	err = c.WatchDownload(ctx, created.DownloadID, func(progress client.Progress) error {
+		if len(statuses) == 0 || statuses[len(statuses)-1] != progress.Status {
+			statuses = append(statuses, progress.Status)
+		}
+		if progress.Error != "" {
+			return errors.New(progress.Error)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("download request %d failed: %v", created.DownloadID, err)
+	}
+	if len(statuses) == 0 || statuses[len(statuses)-1] != client.StatusCompleted {
+		t.Fatalf("download request %d went through %v, want it completed", created.DownloadID, statuses)
+	}
+
+	download, err = repo.GetDownloadRequest(ctx, created.DownloadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if download.Status != repository.StatusCompleted || download.Bytes == nil || *download.Bytes != fileSize {
+		t.Fatalf("download request %d is %s with %v bytes in Postgres, want completed with %d", created.DownloadID, download.Status, download.Bytes, fileSize)
+	}
+
+	file, err := c.GetFile(ctx, created.DownloadID)
+	if err != nil {
+		t.Fatalf("could not get the file: %v", err)
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		t.Fatalf("could not read the file: %v", err)
+	}
+	if want := sha256.Sum256(content); !bytes.Equal(hash.Sum(nil), want[:]) {
+		t.Fatal("the file served back differs from the one served by the origin")
+	}
+}
+
+// startContainer runs the image with the environment and the arguments, and returns the
+// address its port is published on. The container is removed at the end of the test.
+func startContainer(t *testing.T, image string, port string, env []string, args ...string) string {
+	t.Helper()
+
+	runArgs := []string{"run", "--detach", "--rm", "--publish", "127.0.0.1::" + port}
+	for _, variable := range env {
+		runArgs = append(runArgs, "--env", variable)
+	}
+	runArgs = append(append(runArgs, image), args...)
+	id, err := docker(runArgs...)
+	if err != nil {
+		t.Fatalf("could not start %s: %v", image, err)
+	}
+	t.Cleanup(func() {
+		if _, err := docker("rm", "--force", id); err != nil {
+			t.Errorf("could not remove the container of %s: %v", image, err)
+		}
+	})
+
+	addr, err := docker("port", id, port+"/tcp")
+	if err != nil {
+		t.Fatalf("could not find the port of %s: %v", image, err)
+	}
+	addr, _, _ = strings.Cut(addr, "\n") // one line per address family
+	return addr
+}
+
+func docker(args ...string) (string, error) {
+	out, err := exec.Command("docker", args...).Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return "", fmt.Errorf("docker %s: %v: %s", args[0], err, bytes.TrimSpace(exitErr.Stderr))
+	}
+	return strings.TrimSpace(string(out)), err
+}
+
+// waitFor calls check until it succeeds, as the containers take a while to accept
+// connections.
+func waitFor(ctx context.Context, t *testing.T, name string, check func(ctx context.Context) error) {
+	t.Helper()
+
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		err := check(checkCtx)
+		cancel()
+		if err == nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("%s is not ready: %v", name, err)
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// connect returns a repository on the containers, once they accept connections. It is used
+// to migrate the database and to check what the server stored.
+func connect(ctx context.Context, t *testing.T, databaseURL string, redisAddr string) repository.Repository {
+	t.Helper()
+
+	rdb := redis.NewClient(&redis.Options{Addr: redisAddr})
+	t.Cleanup(func() { rdb.Close() })
+	waitFor(ctx, t, "redis", func(ctx context.Context) error {
+		return rdb.Ping(ctx).Err()
+	})
+
+	pool, err := pgxpool.New(ctx, databaseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	// Postgres restarts once it initialized the database.
+	waitFor(ctx, t, "postgres", func(ctx context.Context) error {
+		var ready bool
+		return pool.QueryRow(ctx, `SELECT NOT pg_is_in_recovery()`).Scan(&ready)
+	})
+
+	return repository.New(pool, rdb, repository.NewRedisQueue(rdb))
+}
+
+// migrate applies sql/migrations like dlctl migrate does.
+func migrate(ctx context.Context, t *testing.T, repo repository.Repository) {
+	t.Helper()
+
+	names, err := fs.Glob(migrations.Files, "*.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		prefix, _, _ := strings.Cut(name, "_")
+		version, err := strconv.ParseInt(prefix, 10, 64)
+		if err != nil {
+			t.Fatalf("invalid migration %s", name)
+		}
+		statements, err := fs.ReadFile(migrations.Files, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.ApplyMigration(ctx, version, string(statements)); err != nil {
+			t.Fatalf("could not apply %s: %v", name, err)
+		}
+	}
+}
+
+// startServer builds the server and runs it with the environment, in a directory of its own
+// holding the downloaded files, and returns the base URL of its API once it is ready. The
+// server is stopped at the end of the test, and its output logged if the test failed.
+func startServer(ctx context.Context, t *testing.T, env []string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "server")
+	build := exec.CommandContext(ctx, "go", "build", "-o", binary, ".")
+	build.Dir = ".."
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("could not build the server: %v\n%s", err, out)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	var output lockedBuffer
+	server := exec.Command(binary)
+	server.Dir = dir
+	server.Env = append([]string{"PATH=" + os.Getenv("PATH"), "HOME=" + dir, "HTTP_ADDR=" + addr, "DOWNLOAD_DIR=" + filepath.Join(dir, "downloads")}, env...)
+	server.Stdout, server.Stderr = &output, &output
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		server.Process.Signal(os.Interrupt)
+		done := make(chan struct{})
+		go func() {
+			server.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(30 * time.Second):
+			server.Process.Kill()
+			<-done
+		}
+		if t.Failed() {
+			t.Logf("server output:\n%s", output.String())
+		}
+	})
+
+	api := "http://" + addr
+	waitFor(ctx, t, "the server", func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, api+"/readyz", nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return errors.New(resp.Status)
+		}
+		return nil
+	})
+	return api
+}
+
+// lockedBuffer collects the output of the server, written by two goroutines.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
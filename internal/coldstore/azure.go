@@ -0,0 +1,238 @@
+package coldstore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AzureBlockBytes is the size of the blocks the files are uploaded to Azure Blob Storage in.
+const AzureBlockBytes = 16 << 20
+
+// azureVersion is the version of the Blob Storage API of the requests and signed URLs.
+const azureVersion = "2021-08-06"
+
+// azureStore keeps files in a container of Azure Blob Storage, authorized with the shared key of
+// the storage account: COLD_STORAGE_ACCESS_KEY is the name of the account, COLD_STORAGE_SECRET_KEY
+// its key.
+type azureStore struct {
+	client    *http.Client
+	endpoint  *url.URL // https://<account>.blob.core.windows.net
+	container string
+	account   string
+	key       []byte
+	tier      string // access tier of the blobs, empty for the default of the account
+	_         struct{}
+}
+
+func newAzureStore(endpoint *url.URL, container string, account string, key string, tier string) (Store, error) {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cold storage secret key: the key of an Azure storage account is base64")
+	}
+	return &azureStore{
+		client:    &http.Client{},
+		endpoint:  endpoint,
+		container: container,
+		account:   account,
+		key:       decoded,
+		tier:      tier,
+	}, nil
+}
+
+// Put uploads the file in blocks, each sent again if it failed, and commits them in the tier.
+func (s *azureStore) Put(ctx context.Context, key string, file *os.File, size int64) error {
+	var blockList strings.Builder
+	blockList.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	for offset, block := int64(0), 0; offset < size; offset, block = offset+AzureBlockBytes, block+1 {
+		// The IDs of the blocks of a blob must have the same length.
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", block)))
+		length := min(AzureBlockBytes, size-offset)
+		var err error
+		for attempt := 1; attempt <= ChunkAttempts; attempt++ {
+			if err = s.putBlock(ctx, key, id, io.NewSectionReader(file, offset, length), length); err == nil || ctx.Err() != nil {
+				break
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("could not upload %s: %v", key, err)
+		}
+		blockList.WriteString("<Latest>" + id + "</Latest>")
+	}
+	blockList.WriteString("</BlockList>")
+
+	req, err := s.newRequest(ctx, http.MethodPut, key, url.Values{"comp": {"blocklist"}}, io.NopCloser(strings.NewReader(blockList.String())))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(blockList.Len())
+	if s.tier != "" {
+		req.Header.Set("X-Ms-Access-Tier", s.tier)
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return fmt.Errorf("could not upload %s: %v", key, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *azureStore) putBlock(ctx context.Context, key string, id string, block io.Reader, length int64) error {
+	req, err := s.newRequest(ctx, http.MethodPut, key, url.Values{"comp": {"block"}, "blockid": {id}}, io.NopCloser(block))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = length
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *azureStore) Get(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	req, err := s.newRequest(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not get %s: %v", key, err)
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+func (s *azureStore) Delete(ctx context.Context, key string) error {
+	req, err := s.newRequest(ctx, http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return fmt.Errorf("could not delete %s: %v", key, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// SignedURL returns the URL of the blob with a service SAS that allows reading it.
+func (s *azureStore) SignedURL(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	req, err := s.newRequest(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return "", err
+	}
+
+	expiry := time.Now().UTC().Add(ttl).Format(time.RFC3339)
+	resource := "/blob/" + s.account + "/" + s.container + "/" + key
+	// permissions, start, expiry, resource, identifier, IP, protocol, version, resource type,
+	// snapshot time, encryption scope and the 5 overridden response headers.
+	stringToSign := strings.Join([]string{"r", "", expiry, resource, "", "", "", azureVersion, "b", "", "", "", "", "", "", ""}, "\n")
+	query := url.Values{
+		"sv":  {azureVersion},
+		"sr":  {"b"},
+		"sp":  {"r"},
+		"se":  {expiry},
+		"sig": {s.sign(stringToSign)},
+	}
+	req.URL.RawQuery = query.Encode()
+	return req.URL.String(), nil
+}
+
+// newRequest returns a request for the blob of the key.
+func (s *azureStore) newRequest(ctx context.Context, method string, key string, query url.Values, body io.ReadCloser) (*http.Request, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(s.endpoint.Path, "/") + "/" + s.container + "/" + key
+	u.RawPath = strings.TrimSuffix(s.endpoint.EscapedPath(), "/") + "/" + uriEncode(s.container) + "/" + uriEncode(key)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// do authorizes and sends the request, and fails on error status codes.
+func (s *azureStore) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("X-Ms-Version", azureVersion)
+	if req.Method == http.MethodPut && req.URL.Query().Get("comp") == "" {
+		req.Header.Set("X-Ms-Blob-Type", "BlockBlob")
+	}
+	req.Header.Set("Authorization", "SharedKey "+s.account+":"+s.sign(s.stringToSign(req)))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("status code %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return resp, nil
+}
+
+// stringToSign is what the shared key signs of the request: its verb, standard headers,
+// x-ms- headers and resource.
+func (s *azureStore) stringToSign(req *http.Request) string {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+	lines := []string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-Md5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, x-ms-date is signed instead
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	}
+
+	var names []string
+	for name := range req.Header {
+		if name := strings.ToLower(name); strings.HasPrefix(name, "x-ms-") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, name := range names {
+		canonical.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+
+	canonical.WriteString("/" + s.account + req.URL.EscapedPath())
+	query := req.URL.Query()
+	parameters := make([]string, 0, len(query))
+	for name := range query {
+		parameters = append(parameters, name)
+	}
+	sort.Strings(parameters)
+	for _, name := range parameters {
+		values := query[name]
+		sort.Strings(values)
+		canonical.WriteString("\n" + strings.ToLower(name) + ":" + strings.Join(values, ","))
+	}
+	return strings.Join(lines, "\n") + "\n" + canonical.String()
+}
+
+func (s *azureStore) sign(stringToSign string) string {
+	h := hmac.New(sha256.New, s.key)
+	h.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,318 @@
+package coldstore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/internal/config"
+)
+
+// MaxObjectBytes is the largest file uploaded to S3, with a single PUT.
+const MaxObjectBytes = 5 << 30
+
+// ChunkAttempts is how many times a chunk of a resumable upload, or a block, is sent before
+// the upload fails.
+const ChunkAttempts = 3
+
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+var ErrDisabled = errors.New("cold storage is not configured")
+
+// dialect tells apart the XML APIs of S3 and of Google Cloud Storage, which take the same
+// requests with their own names for the signature and its headers.
+type dialect struct {
+	algorithm string // names the signature and prefixes its secret key
+	service   string
+	request   string // ends the scope of the signature
+	prefix    string // of the headers and query parameters of the signature and of the storage class
+}
+
+var (
+	s3Dialect  = dialect{algorithm: "AWS4", service: "s3", request: "aws4_request", prefix: "X-Amz-"}
+	gcsDialect = dialect{algorithm: "GOOG4", service: "storage", request: "goog4_request", prefix: "X-Goog-"}
+)
+
+type store struct {
+	client    *http.Client
+	endpoint  *url.URL // nil when cold storage is disabled
+	dialect   dialect
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	class     string
+	_         struct{}
+}
+
+// Store keeps files in a cheaper storage class of a bucket of S3 or a compatible API, of Google
+// Cloud Storage or of Azure Blob Storage, see COLD_STORAGE_BACKEND.
+type Store interface {
+	// Put uploads size bytes of the file to the key in the cold storage class.
+	Put(ctx context.Context, key string, file *os.File, size int64) error
+	// Get returns the content of the key and its size. Reads are slower than from the disk.
+	Get(ctx context.Context, key string) (io.ReadCloser, int64, error)
+	Delete(ctx context.Context, key string) error
+	// SignedURL returns a URL that downloads the key without credentials until ttl passed.
+	SignedURL(ctx context.Context, key string, ttl time.Duration) (string, error)
+}
+
+func (s *store) Put(ctx context.Context, key string, file *os.File, size int64) error {
+	if s.dialect == gcsDialect {
+		return s.putResumable(ctx, key, file, size)
+	}
+	if size > MaxObjectBytes {
+		return fmt.Errorf("%s is %d bytes, more than the %d bytes of a single upload", key, size, int64(MaxObjectBytes))
+	}
+
+	var body io.ReadCloser = http.NoBody
+	if size > 0 {
+		body = io.NopCloser(io.LimitReader(file, size))
+	}
+	req, err := s.newRequest(ctx, http.MethodPut, key, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if s.class != "" {
+		req.Header.Set(s.dialect.prefix+"Storage-Class", s.class)
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return fmt.Errorf("could not upload %s: %v", key, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *store) Get(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	req, err := s.newRequest(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not get %s: %v", key, err)
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+func (s *store) Delete(ctx context.Context, key string) error {
+	req, err := s.newRequest(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return fmt.Errorf("could not delete %s: %v", key, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// SignedURL signs a GET of the key in its query parameters.
+func (s *store) SignedURL(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	req, err := s.newRequest(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	date := now.Format("20060102T150405Z")
+	query := url.Values{}
+	query.Set(s.dialect.prefix+"Algorithm", s.dialect.algorithm+"-HMAC-SHA256")
+	query.Set(s.dialect.prefix+"Credential", s.accessKey+"/"+s.scope(now.Format("20060102")))
+	query.Set(s.dialect.prefix+"Date", date)
+	query.Set(s.dialect.prefix+"Expires", strconv.FormatInt(int64(ttl.Seconds()), 10))
+	query.Set(s.dialect.prefix+"SignedHeaders", "host")
+	canonicalQuery := canonicalQueryString(query)
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		req.URL.EscapedPath(),
+		canonicalQuery,
+		"host:" + req.URL.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+	req.URL.RawQuery = canonicalQuery + "&" + s.dialect.prefix + "Signature=" + s.signature(date, canonicalRequest)
+	return req.URL.String(), nil
+}
+
+// newRequest returns a path-style request for the key.
+func (s *store) newRequest(ctx context.Context, method string, key string, body io.ReadCloser) (*http.Request, error) {
+	if s.endpoint == nil {
+		return nil, ErrDisabled
+	}
+
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(s.endpoint.Path, "/") + "/" + s.bucket + "/" + key
+	u.RawPath = strings.TrimSuffix(s.endpoint.EscapedPath(), "/") + "/" + uriEncode(s.bucket) + "/" + uriEncode(key)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// do signs and sends the request, and fails on error status codes.
+func (s *store) do(req *http.Request) (*http.Response, error) {
+	s.sign(req, time.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("status code %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return resp, nil
+}
+
+// sign adds an AWS Signature Version 4, or its Google Cloud Storage counterpart, to the
+// request. The payload is not signed, the request relies on TLS for its integrity.
+func (s *store) sign(req *http.Request, now time.Time) {
+	date := now.Format("20060102T150405Z")
+	req.Header.Set(s.dialect.prefix+"Date", date)
+	req.Header.Set(s.dialect.prefix+"Content-Sha256", unsignedPayload)
+
+	prefix := strings.ToLower(s.dialect.prefix)
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if name := strings.ToLower(name); strings.HasPrefix(name, prefix) {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+	signature := s.signature(date, canonicalRequest)
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.dialect.algorithm, s.accessKey, s.scope(now.Format("20060102")), signedHeaders, signature))
+}
+
+func (s *store) scope(day string) string {
+	return day + "/" + s.region + "/" + s.dialect.service + "/" + s.dialect.request
+}
+
+// signature signs the canonical request of a request made at date.
+func (s *store) signature(date string, canonicalRequest string) string {
+	day := date[:len("20060102")]
+	stringToSign := s.dialect.algorithm + "-HMAC-SHA256\n" + date + "\n" + s.scope(day) + "\n" + hashHex(canonicalRequest)
+
+	key := hmacSHA256([]byte(s.dialect.algorithm+s.secretKey), day)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, s.dialect.service)
+	key = hmacSHA256(key, s.dialect.request)
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hashHex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// uriEncode escapes everything but the unreserved characters and the slashes, as the
+// canonical request of a signature expects.
+func uriEncode(path string) string {
+	return escape(path, true)
+}
+
+// canonicalQueryString sorts the query parameters and escapes them, slashes included.
+func canonicalQueryString(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parameters := make([]string, 0, len(names))
+	for _, name := range names {
+		parameters = append(parameters, escape(name, false)+"="+escape(query.Get(name), false))
+	}
+	return strings.Join(parameters, "&")
+}
+
+func escape(value string, keepSlashes bool) string {
+	var b strings.Builder
+	for _, c := range []byte(value) {
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' || c == '/' && keepSlashes {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// New returns the store of COLD_STORAGE_ENDPOINT, of the API of COLD_STORAGE_BACKEND. Without
+// an endpoint every operation fails with ErrDisabled.
+func New(cfg *config.Config) (Store, error) {
+	if cfg.ColdStorageEndpoint != "" && cfg.ColdStorageBucket == "" {
+		return nil, fmt.Errorf("a bucket is required for cold storage")
+	}
+	return NewBucket(cfg, cfg.ColdStorageBucket, cfg.ColdStorageClass)
+}
+
+// NewBucket returns the store of another bucket (container on Azure) of COLD_STORAGE_ENDPOINT,
+// signed with the same credentials, whose files are written in the storage class, or the
+// default class of the bucket if it is empty.
+func NewBucket(cfg *config.Config, bucket string, class string) (Store, error) {
+	if cfg.ColdStorageEndpoint == "" {
+		return &store{}, nil
+	}
+
+	endpoint, err := url.Parse(cfg.ColdStorageEndpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("invalid cold storage endpoint %s", cfg.ColdStorageEndpoint)
+	}
+	if cfg.ColdStorageBackend == config.ColdStorageAzure {
+		return newAzureStore(endpoint, bucket, cfg.ColdStorageAccessKey, cfg.ColdStorageSecretKey, class)
+	}
+	dialect := s3Dialect
+	if cfg.ColdStorageBackend == config.ColdStorageGCS {
+		dialect = gcsDialect
+	}
+	return &store{
+		client:    &http.Client{},
+		endpoint:  endpoint,
+		dialect:   dialect,
+		bucket:    bucket,
+		region:    cfg.ColdStorageRegion,
+		accessKey: cfg.ColdStorageAccessKey,
+		secretKey: cfg.ColdStorageSecretKey,
+		class:     class,
+	}, nil
+}
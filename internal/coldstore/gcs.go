@@ -0,0 +1,103 @@
+package coldstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ResumableChunkBytes is the size of the chunks of the resumable uploads to Google Cloud
+// Storage, a multiple of the 256 KiB it requires.
+const ResumableChunkBytes = 16 << 20
+
+// statusResumeIncomplete answers the chunks of a resumable upload that is not complete yet.
+const statusResumeIncomplete = 308
+
+// putResumable uploads the file in chunks over a resumable upload session. A chunk that failed
+// is sent again from what the session kept of it, so files of any size get through.
+func (s *store) putResumable(ctx context.Context, key string, file *os.File, size int64) error {
+	req, err := s.newRequest(ctx, http.MethodPost, key, http.NoBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Goog-Resumable", "start")
+	if s.class != "" {
+		req.Header.Set(s.dialect.prefix+"Storage-Class", s.class)
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return fmt.Errorf("could not start upload of %s: %v", key, err)
+	}
+	resp.Body.Close()
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return fmt.Errorf("could not start upload of %s: no session", key)
+	}
+
+	var persisted int64
+	failures := 0
+	for {
+		kept, err := s.sendChunk(ctx, session, file, persisted, min(persisted+ResumableChunkBytes, size), size)
+		if err != nil {
+			failures++
+			if failures == ChunkAttempts || ctx.Err() != nil {
+				return fmt.Errorf("could not upload %s: %v", key, err)
+			}
+			// Some of the chunk may have been kept: the session tells.
+			if kept, err = s.sendChunk(ctx, session, file, persisted, persisted, size); err != nil {
+				continue
+			}
+		}
+		if kept >= size {
+			return nil
+		}
+		if kept > persisted {
+			failures = 0
+		}
+		persisted = kept
+	}
+}
+
+// sendChunk sends the bytes offset..end-1 of the file to the upload session, or asks where it
+// stands if there are none. It returns the bytes the session kept, size once the upload is done.
+func (s *store) sendChunk(ctx context.Context, session string, file *os.File, offset int64, end int64, size int64) (int64, error) {
+	var body io.Reader = http.NoBody
+	contentRange := fmt.Sprintf("bytes */%d", size)
+	if end > offset {
+		body = io.NewSectionReader(file, offset, end-offset)
+		contentRange = fmt.Sprintf("bytes %d-%d/%d", offset, end-1, size)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, session, body)
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = end - offset
+	req.Header.Set("Content-Range", contentRange)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return size, nil
+	case statusResumeIncomplete:
+		// Range is bytes=0-<last byte kept>, missing until a byte is kept.
+		_, last, found := strings.Cut(resp.Header.Get("Range"), "-")
+		if !found {
+			return 0, nil
+		}
+		lastByte, err := strconv.ParseInt(last, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid range %q", resp.Header.Get("Range"))
+		}
+		return lastByte + 1, nil
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return 0, fmt.Errorf("status code %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+}
@@ -0,0 +1,1077 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/internal/layout"
+)
+
+// LabelRule applies Limit to the downloads having the label Key=Value.
+type LabelRule struct {
+	Key   string
+	Value string
+	Limit int64
+}
+
+type Config struct {
+	MaxDownloadBytes          int64    // 0 means unlimited
+	AllowedContentTypes       []string // empty means every content type is allowed
+	BlockedContentTypes       []string
+	HTMLGuardMaxBytes         int64  // HTML responses up to this size are taken for error pages, 0 disables the guard
+	CheckpointFile            string // where interrupted downloads are recorded on shutdown, empty disables it
+	UserQuotaBytes            int64  // 0 means unlimited
+	OrgQuotaBytes             int64  // stored by the downloads of an organization, 0 means unlimited
+	HostBandwidth             int64  // bytes per second shared by the downloads of this process, 0 means unlimited
+	FleetBandwidth            int64  // bytes per second shared by the downloads of all the processes, 0 means unlimited
+	FleetMaxConnections       int64  // remote connections of the downloads of all the processes, 0 means unlimited
+	EnableHTTP3               bool   // fetch over HTTP/3 from origins advertising it
+	AuthRateLimit             int64  // requests per IP and window on /register and /login, 0 disables it
+	DownloadsRateLimit        int64  // requests per user and window on /downloads, 0 disables it
+	OrgDownloadsRateLimit     int64  // downloads requested per organization and window, 0 disables it
+	RateLimitWindow           time.Duration
+	DownloadDir               string   // where the files of the downloads are kept, empty for the working directory
+	DownloadPathTemplate      string   // path of the file of a download in DownloadDir, see layout.Render
+	ContentStoreDir           string   // where deduplicated contents are kept, empty disables content deduplication
+	MinFreeDiskBytes          int64    // disk space that downloads must leave free
+	AllowedDomains            []string // empty means every domain is allowed
+	BlockedDomains            []string
+	AllowPrivateNetworks      bool          // allow links to private/loopback addresses, for development only
+	ProxyCacheMaxAge          time.Duration // freshness of proxied responses without a matching cache policy
+	FetchMaxSpeed             int64         // bytes per second a pass-through of GET /fetch is streamed at most, 0 means unlimited
+	HTTPDialTimeout           time.Duration
+	HTTPTLSHandshakeTimeout   time.Duration
+	HTTPResponseHeaderTimeout time.Duration
+	HTTPIdleConnTimeout       time.Duration
+	HTTPMaxIdleConnsPerHost   int64
+	HTTPMaxRedirects          int64
+	HTTPProxy                 string           // proxy for outgoing downloads, defaults to HTTP_PROXY/HTTPS_PROXY
+	DownloadTimeout           time.Duration    // overall deadline of a single download attempt, 0 disables it
+	StartupTimeout            time.Duration    // deadline of connecting to Redis, Postgres and the queue on startup
+	QueryTimeout              time.Duration    // deadline of a Postgres statement and of a Redis command, 0 disables it
+	PrematureEOFResumes       int64            // times a download whose origin cut the transfer is resumed before it fails
+	TuningReadTimeout         [2]time.Duration // bounds of the read timeout a download may set
+	TuningChunkSize           [2]int64         // bounds of the chunk size a download may set
+	TuningFlushThreshold      [2]int64         // bounds of the flush threshold a download may set
+	TuningTCPCongestion       []string         // TCP congestion control algorithms a download may pick, empty disables the choice
+	MetricsInterval           time.Duration    // interval of queue statistics snapshots and metrics pushes
+	StatsDAddr                string           // host:port of a StatsD server to push metrics to, empty disables it
+	StatsDPrefix              string
+	RemoteWriteURL            string // Prometheus remote-write endpoint to push metrics to, empty disables it
+	RemoteWriteUsername       string // basic auth of the endpoint, empty to not authenticate with it
+	RemoteWritePassword       string
+	RemoteWriteBearerToken    string // bearer token of the endpoint, exclusive with RemoteWriteUsername
+	NumWorkers                int64  // workers started with the process, can be changed at runtime by admins
+	MaxWorkers                int64
+	QueueTTL                  time.Duration            // how long a download may wait in the queue before it expires, 0 means forever
+	PlanQueueTTLs             map[string]time.Duration // QueueTTL overrides per user plan
+	RetentionTTL              time.Duration            // finished downloads are deleted with their file this long after they finished, 0 keeps them
+	PlanRetentionTTLs         map[string]time.Duration // RetentionTTL overrides per user plan
+	RetentionInterval         time.Duration            // how often downloads past their retention are deleted
+	TrashRetention            time.Duration            // how long deleted downloads stay in the trash with their file, 0 deletes them at once
+	ReconcileInterval         time.Duration            // how often orphaned download requests are requeued, 0 disables it
+	OutboxInterval            time.Duration            // how often new download requests are relayed from the outbox to the queue
+	RedisMaxMemoryBytes       int64                    // Redis memory above which new download requests are refused and queued ones spilled to the outbox, 0 disables it
+	QueueMaxLength            int64                    // download requests waiting in the queues and the outbox above which new ones are refused, 0 disables it
+	QueuePressureInterval     time.Duration            // how often Redis memory and the queue length are checked against their limits
+	QueueRetryAfter           time.Duration            // Retry-After of the requests refused while the queue is overloaded
+	CredentialsKey            []byte                   // AES-256 key encrypting stored credentials of origins, nil disables storing them
+	SFTPKnownHosts            string                   // known_hosts file to verify SFTP servers against
+	TorrentDataDir            string                   // where the BitTorrent engine keeps payloads while downloading and seeding
+	TorrentSeedRatio          float64                  // keep seeding a completed torrent until uploaded/downloaded reaches it, 0 disables seeding
+	TorrentListenPort         int64                    // port of the BitTorrent engine for incoming peers
+	QueueEventsRetention      time.Duration            // how long queue events are kept for the timeline
+	StreamConcurrency         int64                    // segments of an HLS/DASH playlist fetched at the same time
+	MultipartConnections      int64                    // connections a large http(s) file is downloaded over, 1 disables multi-part downloads
+	MultipartMinBytes         int64                    // files smaller than this are downloaded over one connection
+	PreflightTimeout          time.Duration            // longest the HEAD request before an http(s) download may take, 0 disables it
+	MirrorMinSpeed            int64                    // bytes per second below which a download fails over to its next mirror, 0 only fails over on errors
+	MirrorSlowWindow          time.Duration            // how long the speed of a source is measured over before failing over
+	PartialFileMaxAge         time.Duration            // partial files of failed downloads are collected this long after the failure, 0 disables
+	PartialFileGCInterval     time.Duration            // how often partial files are collected
+	PartialFileArchiveDir     string                   // collected partial files are moved here instead of deleted
+	LinkProbeInterval         time.Duration            // how often the links of downloads waiting in the queue are probed, 0 disables it
+	LinkProbeAttempts         int64                    // probes in a row finding a link dead before its download fails
+	LinkProbeTimeout          time.Duration            // longest a probe may take
+	LabelPriorities           []LabelRule              // default priority of downloads having a label, when the request sets none
+	LabelMaxActive            []LabelRule              // cap on the downloads having a label processed at the same time by this process
+	UserMaxActive             int64                    // downloads of a user in progress at the same time across all processes, 0 means unlimited
+	WorkerLabelSelector       map[string]string        // this process only processes downloads having all these labels, empty means every download
+	GRPCAddr                  string                   // address of the gRPC API, empty disables it
+	HTTPAddr                  string                   // address of the HTTP API
+	MetricsAddr               string                   // address of an unauthenticated /metrics listener for scrapers, empty disables it
+	WorkerHeartbeatInterval   time.Duration            // how often the workers report their state for the admin dashboard, 0 disables it
+	InstanceID                string                   // identifies the process and its disk for the resumes of its downloads, defaults to the hostname
+	InstanceTTL               time.Duration            // a process that sent no heartbeat for this long is dead and its downloads restart elsewhere, 0 disables host affinity
+	ColdStorageAfter          time.Duration            // completed files are moved to cold storage this long after they finished, 0 disables tiering
+	ColdStorageInterval       time.Duration            // how often files are moved to and restored from cold storage
+	ColdStorageBackend        string                   // API of the cold storage: ColdStorageS3, ColdStorageGCS or ColdStorageAzure
+	ColdStorageEndpoint       string                   // endpoint of the cold storage, empty disables it
+	ColdStorageBucket         string
+	ColdStorageRegion         string
+	ColdStorageAccessKey      string
+	ColdStorageSecretKey      string
+	ColdStorageClass          string        // storage class (access tier on Azure) of the files in cold storage
+	ColdStorageURLTTL         time.Duration // cold files are served by redirecting to a signed URL valid this long, 0 streams them through the process
+	WatchDir                  string        // links of the .txt/.url files dropped here are enqueued, empty disables the watcher
+	WatchInterval             time.Duration // how often WatchDir is scanned
+	WatchUser                 string        // owner of the files dropped directly in WatchDir, the others go in a folder named after their owner
+	QueueBackend              string        // transport of the download requests, QueueBackendRedis or QueueBackendNATS
+	Mode                      string        // what the process runs, ModeAPI, ModeWorker or ModeAll
+	NATSURL                   string
+	NATSStream                string        // JetStream stream of the queues, its subjects are prefixed with its name
+	NATSMaxDeliver            int64         // deliveries of a queue entry never acknowledged before it is dropped
+	IdempotencyKeyTTL         time.Duration // how long the response of a request with an Idempotency-Key is replayed to its retries, 0 disables it
+	DownloadListCacheTTL      time.Duration // how long the first page of the list of downloads of a user is cached, 0 disables it
+	MaxBatchDownloads         int64         // links accepted by one POST /downloads/batch
+	MaxScriptTimeout          time.Duration // longest a completion script may run
+	ScriptConcurrency         int64         // completion scripts run at once by this process, besides the workers
+	ScriptMaxProcesses        int64         // processes a completion script may have at once
+	ScriptMaxMemoryBytes      int64         // address space of every process of a completion script
+	PasswordResetTTL          time.Duration // how long a password reset token, issued by an admin or mailed, can be used
+	JWTIssuer                 string        // iss of the tokens
+	JWTAudience               string        // aud of the tokens
+	PreviousSecretKeys        []string      // former SECRET_KEYs whose tokens are accepted until they expire
+	LegacyTokensIssuedBefore  time.Time     // tokens without a kid issued before it are accepted, zero rejects them
+	LegacySecretKey           string        // key of the tokens without a kid, SECRET_KEY if empty
+	SMTPAddr                  string        // host:port of the SMTP server of the account emails, empty disables them
+	SMTPUsername              string        // empty to send without authenticating
+	SMTPPassword              string
+	MailFrom                  string        // sender address of the account emails
+	EmailVerificationTTL      time.Duration // how long an email verification token can be used
+	RequireEmailVerification  bool          // registering takes an email and logging in waits until it is verified
+	PipelineSteps             []string      // processing steps of the downloads that name none of their own
+	PipelineConcurrency       int64         // completed downloads processed at once by this process
+	PipelineStepTimeout       time.Duration // longest a processing step may take
+	ClamdAddr                 string        // clamd address (host:port or unix socket path) of the virus_scan step, empty disables it
+	ClamdScanAll              bool          // every download gets the virus_scan step first, whatever its pipeline
+	QuarantineDir             string        // infected files are moved here, empty leaves them in place
+	PipelineExtractMaxBytes   int64         // bytes the extract step writes at most per archive
+	PipelineTranscodeArgs     []string      // ffmpeg output options of the transcode step, empty disables it
+	PipelineTranscodeFormat   string        // extension of the files written by the transcode step
+	PipelineUploadBucket      string        // bucket of the cold storage endpoint the upload step copies files to, empty disables it
+	PipelineThumbnailSize     int64         // pixels of the longer side of the thumbnails of the thumbnail step, 0 disables it
+	_                         struct{}
+}
+
+const (
+	QueueBackendRedis = "redis"
+	QueueBackendNATS  = "nats"
+)
+
+const (
+	ModeAPI    = "api"    // the HTTP and gRPC APIs, without workers
+	ModeWorker = "worker" // the workers, serving only the health probes, the version and the metrics
+	ModeAll    = "all"
+)
+
+// ParseMode checks the mode of the process given by MODE or --mode, ModeAll if empty.
+func ParseMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return ModeAll, nil
+	case ModeAPI, ModeWorker, ModeAll:
+		return mode, nil
+	}
+	return "", fmt.Errorf("must be %s, %s or %s", ModeAPI, ModeWorker, ModeAll)
+}
+
+const (
+	ColdStorageS3    = "s3"    // S3 and compatible APIs
+	ColdStorageGCS   = "gcs"   // the XML API of Google Cloud Storage, with HMAC keys
+	ColdStorageAzure = "azure" // Azure Blob Storage, with the shared key of the account
+)
+
+// MaxSignedURLTTL is the longest a signed URL of S3 or Google Cloud Storage may be valid.
+const MaxSignedURLTTL = 7 * 24 * time.Hour
+
+func Load() (*Config, error) {
+	maxDownloadBytes, err := getInt64("MAX_DOWNLOAD_BYTES", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	htmlGuardMaxBytes, err := getInt64("HTML_GUARD_MAX_BYTES", 1<<20)
+	if err != nil {
+		return nil, err
+	}
+	if htmlGuardMaxBytes < 0 {
+		return nil, fmt.Errorf("invalid HTML_GUARD_MAX_BYTES: must not be negative")
+	}
+
+	userQuotaBytes, err := getInt64("USER_QUOTA_BYTES", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	orgQuotaBytes, err := getInt64("ORG_QUOTA_BYTES", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	hostBandwidth, err := getInt64("HOST_BANDWIDTH_BYTES_PER_SEC", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	fleetBandwidth, err := getInt64("FLEET_BANDWIDTH_BYTES_PER_SEC", 0)
+	if err != nil {
+		return nil, err
+	}
+	if fleetBandwidth < 0 {
+		return nil, fmt.Errorf("invalid FLEET_BANDWIDTH_BYTES_PER_SEC: must not be negative")
+	}
+
+	fleetMaxConnections, err := getInt64("FLEET_MAX_CONNECTIONS", 0)
+	if err != nil {
+		return nil, err
+	}
+	if fleetMaxConnections < 0 {
+		return nil, fmt.Errorf("invalid FLEET_MAX_CONNECTIONS: must not be negative")
+	}
+
+	authRateLimit, err := getInt64("RATE_LIMIT_AUTH", 10)
+	if err != nil {
+		return nil, err
+	}
+
+	downloadsRateLimit, err := getInt64("RATE_LIMIT_DOWNLOADS", 60)
+	if err != nil {
+		return nil, err
+	}
+
+	orgDownloadsRateLimit, err := getInt64("RATE_LIMIT_ORG_DOWNLOADS", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	rateLimitWindow, err := getDuration("RATE_LIMIT_WINDOW", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	idempotencyKeyTTL, err := getDuration("IDEMPOTENCY_KEY_TTL", 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	downloadListCacheTTL, err := getDuration("DOWNLOAD_LIST_CACHE_TTL", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if downloadListCacheTTL < 0 {
+		return nil, fmt.Errorf("invalid DOWNLOAD_LIST_CACHE_TTL: must not be negative")
+	}
+
+	maxBatchDownloads, err := getInt64("MAX_BATCH_DOWNLOADS", 100)
+	if err != nil {
+		return nil, err
+	}
+	if maxBatchDownloads < 1 {
+		return nil, fmt.Errorf("invalid MAX_BATCH_DOWNLOADS: must be at least 1")
+	}
+
+	maxScriptTimeout, err := getDuration("MAX_SCRIPT_TIMEOUT", 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	if maxScriptTimeout < time.Second {
+		return nil, fmt.Errorf("invalid MAX_SCRIPT_TIMEOUT: must be at least 1s")
+	}
+
+	scriptConcurrency, err := getInt64("SCRIPT_CONCURRENCY", 2)
+	if err != nil {
+		return nil, err
+	}
+	if scriptConcurrency < 1 {
+		return nil, fmt.Errorf("invalid SCRIPT_CONCURRENCY: must be at least 1")
+	}
+
+	scriptMaxProcesses, err := getInt64("SCRIPT_MAX_PROCESSES", 64)
+	if err != nil {
+		return nil, err
+	}
+	if scriptMaxProcesses < 1 {
+		return nil, fmt.Errorf("invalid SCRIPT_MAX_PROCESSES: must be at least 1")
+	}
+
+	scriptMaxMemoryBytes, err := getInt64("SCRIPT_MAX_MEMORY_BYTES", 512<<20)
+	if err != nil {
+		return nil, err
+	}
+	if scriptMaxMemoryBytes < 16<<20 {
+		return nil, fmt.Errorf("invalid SCRIPT_MAX_MEMORY_BYTES: must be at least 16MiB")
+	}
+
+	passwordResetTTL, err := getDuration("PASSWORD_RESET_TTL", 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	if passwordResetTTL <= 0 {
+		return nil, fmt.Errorf("invalid PASSWORD_RESET_TTL: must be positive")
+	}
+
+	jwtIssuer := os.Getenv("JWT_ISSUER")
+	if jwtIssuer == "" {
+		jwtIssuer = "downloader"
+	}
+	jwtAudience := os.Getenv("JWT_AUDIENCE")
+	if jwtAudience == "" {
+		jwtAudience = "downloader"
+	}
+	var legacyTokensIssuedBefore time.Time
+	if value := os.Getenv("LEGACY_TOKENS_ISSUED_BEFORE"); value != "" {
+		legacyTokensIssuedBefore, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LEGACY_TOKENS_ISSUED_BEFORE: %v", err)
+		}
+	}
+
+	smtpAddr := os.Getenv("SMTP_ADDR")
+	mailFrom := os.Getenv("MAIL_FROM")
+	if smtpAddr != "" {
+		if _, _, err := net.SplitHostPort(smtpAddr); err != nil {
+			return nil, fmt.Errorf("invalid SMTP_ADDR: must be host:port")
+		}
+		if _, err := mail.ParseAddress(mailFrom); err != nil {
+			return nil, fmt.Errorf("invalid MAIL_FROM: must be an email address")
+		}
+	}
+
+	emailVerificationTTL, err := getDuration("EMAIL_VERIFICATION_TTL", 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	if emailVerificationTTL <= 0 {
+		return nil, fmt.Errorf("invalid EMAIL_VERIFICATION_TTL: must be positive")
+	}
+
+	requireEmailVerification := os.Getenv("REQUIRE_EMAIL_VERIFICATION") == "true"
+	if requireEmailVerification && smtpAddr == "" {
+		return nil, fmt.Errorf("invalid REQUIRE_EMAIL_VERIFICATION: SMTP_ADDR is required to send the verification emails")
+	}
+
+	pipelineConcurrency, err := getInt64("PIPELINE_CONCURRENCY", 2)
+	if err != nil {
+		return nil, err
+	}
+	if pipelineConcurrency < 1 {
+		return nil, fmt.Errorf("invalid PIPELINE_CONCURRENCY: must be at least 1")
+	}
+
+	pipelineStepTimeout, err := getDuration("PIPELINE_STEP_TIMEOUT", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	if pipelineStepTimeout < time.Second {
+		return nil, fmt.Errorf("invalid PIPELINE_STEP_TIMEOUT: must be at least 1s")
+	}
+
+	clamdScanAll := os.Getenv("CLAMD_SCAN_ALL") == "true"
+	if clamdScanAll && os.Getenv("CLAMD_ADDR") == "" {
+		return nil, fmt.Errorf("invalid CLAMD_SCAN_ALL: requires CLAMD_ADDR")
+	}
+
+	pipelineExtractMaxBytes, err := getInt64("PIPELINE_EXTRACT_MAX_BYTES", 10<<30)
+	if err != nil {
+		return nil, err
+	}
+
+	pipelineTranscodeFormat := os.Getenv("PIPELINE_TRANSCODE_FORMAT")
+	if pipelineTranscodeFormat == "" {
+		pipelineTranscodeFormat = "mp4"
+	}
+
+	pipelineThumbnailSize, err := getInt64("PIPELINE_THUMBNAIL_SIZE", 0)
+	if err != nil {
+		return nil, err
+	}
+	if pipelineThumbnailSize < 0 {
+		return nil, fmt.Errorf("invalid PIPELINE_THUMBNAIL_SIZE: must not be negative")
+	}
+
+	minFreeDiskBytes, err := getInt64("MIN_FREE_DISK_BYTES", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	fetchMaxSpeed, err := getInt64("FETCH_MAX_SPEED", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	proxyCacheMaxAge, err := getDuration("PROXY_CACHE_MAX_AGE", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	httpDialTimeout, err := getDuration("HTTP_DIAL_TIMEOUT", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	httpTLSHandshakeTimeout, err := getDuration("HTTP_TLS_HANDSHAKE_TIMEOUT", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	httpResponseHeaderTimeout, err := getDuration("HTTP_RESPONSE_HEADER_TIMEOUT", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	httpIdleConnTimeout, err := getDuration("HTTP_IDLE_CONN_TIMEOUT", 90*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	httpMaxIdleConnsPerHost, err := getInt64("HTTP_MAX_IDLE_CONNS_PER_HOST", 10)
+	if err != nil {
+		return nil, err
+	}
+
+	httpMaxRedirects, err := getInt64("HTTP_MAX_REDIRECTS", 10)
+	if err != nil {
+		return nil, err
+	}
+
+	prematureEOFResumes, err := getInt64("PREMATURE_EOF_RESUMES", 5)
+	if err != nil {
+		return nil, err
+	}
+	if prematureEOFResumes < 0 {
+		return nil, fmt.Errorf("invalid PREMATURE_EOF_RESUMES: must not be negative")
+	}
+
+	downloadTimeout, err := getDuration("DOWNLOAD_TIMEOUT", 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	startupTimeout, err := getDuration("STARTUP_TIMEOUT", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if startupTimeout <= 0 {
+		return nil, fmt.Errorf("invalid STARTUP_TIMEOUT: must be positive")
+	}
+	queryTimeout, err := getDuration("QUERY_TIMEOUT", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if queryTimeout < 0 {
+		return nil, fmt.Errorf("invalid QUERY_TIMEOUT: must not be negative")
+	}
+
+	tuningReadTimeout, err := getDurationRange("TUNING_READ_TIMEOUT", 5*time.Second, 10*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	tuningChunkSize, err := getInt64Range("TUNING_CHUNK_SIZE", 4<<10, 4<<20)
+	if err != nil {
+		return nil, err
+	}
+
+	tuningFlushThreshold, err := getInt64Range("TUNING_FLUSH_THRESHOLD", 128<<10, 256<<20)
+	if err != nil {
+		return nil, err
+	}
+
+	metricsInterval, err := getDuration("METRICS_INTERVAL", 15*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	remoteWriteURL := os.Getenv("REMOTE_WRITE_URL")
+	if remoteWriteURL != "" {
+		u, err := url.Parse(remoteWriteURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid REMOTE_WRITE_URL: must be an http or https url")
+		}
+	}
+	if os.Getenv("REMOTE_WRITE_USERNAME") != "" && os.Getenv("REMOTE_WRITE_BEARER_TOKEN") != "" {
+		return nil, fmt.Errorf("invalid REMOTE_WRITE_BEARER_TOKEN: REMOTE_WRITE_USERNAME is set")
+	}
+
+	numWorkers, err := getInt64("NUM_WORKERS", 3)
+	if err != nil {
+		return nil, err
+	}
+
+	maxWorkers, err := getInt64("MAX_WORKERS", 32)
+	if err != nil {
+		return nil, err
+	}
+
+	queueTTL, err := getDuration("QUEUE_TTL", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	planQueueTTLs, err := getDurationMap("QUEUE_TTL_PER_PLAN")
+	if err != nil {
+		return nil, err
+	}
+
+	retentionTTL, err := getDuration("RETENTION_TTL", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	planRetentionTTLs, err := getDurationMap("RETENTION_TTL_PER_PLAN")
+	if err != nil {
+		return nil, err
+	}
+
+	retentionInterval, err := getDuration("RETENTION_INTERVAL", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	if retentionInterval < time.Second {
+		return nil, fmt.Errorf("invalid RETENTION_INTERVAL: must be at least 1s")
+	}
+
+	trashRetention, err := getDuration("TRASH_RETENTION", 30*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	reconcileInterval, err := getDuration("RECONCILE_INTERVAL", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	instanceID := os.Getenv("INSTANCE_ID")
+	if instanceID == "" {
+		instanceID, err = os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("could not get hostname for INSTANCE_ID: %v", err)
+		}
+	}
+
+	instanceTTL, err := getDuration("INSTANCE_TTL", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	coldStorageAfter, err := getDuration("COLD_STORAGE_AFTER", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	coldStorageInterval, err := getDuration("COLD_STORAGE_INTERVAL", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	watchInterval, err := getDuration("WATCH_INTERVAL", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	coldStorageBackend := os.Getenv("COLD_STORAGE_BACKEND")
+	if coldStorageBackend == "" {
+		coldStorageBackend = ColdStorageS3
+	}
+	if coldStorageBackend != ColdStorageS3 && coldStorageBackend != ColdStorageGCS && coldStorageBackend != ColdStorageAzure {
+		return nil, fmt.Errorf("invalid COLD_STORAGE_BACKEND: must be %s, %s or %s", ColdStorageS3, ColdStorageGCS, ColdStorageAzure)
+	}
+
+	coldStorageRegion := os.Getenv("COLD_STORAGE_REGION")
+	if coldStorageRegion == "" {
+		coldStorageRegion = "us-east-1"
+		if coldStorageBackend == ColdStorageGCS {
+			coldStorageRegion = "auto"
+		}
+	}
+
+	coldStorageClass := os.Getenv("COLD_STORAGE_CLASS")
+	if coldStorageClass == "" {
+		switch coldStorageBackend {
+		case ColdStorageGCS:
+			coldStorageClass = "COLDLINE"
+		case ColdStorageAzure:
+			coldStorageClass = "Cool"
+		default:
+			coldStorageClass = "GLACIER_IR"
+		}
+	}
+
+	coldStorageURLTTL, err := getDuration("COLD_STORAGE_URL_TTL", 0)
+	if err != nil {
+		return nil, err
+	}
+	if coldStorageURLTTL > MaxSignedURLTTL && coldStorageBackend != ColdStorageAzure {
+		return nil, fmt.Errorf("invalid COLD_STORAGE_URL_TTL: must be at most %v", MaxSignedURLTTL)
+	}
+
+	outboxInterval, err := getDuration("OUTBOX_INTERVAL", 500*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+
+	redisMaxMemoryBytes, err := getInt64("REDIS_MAX_MEMORY_BYTES", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	queueMaxLength, err := getInt64("QUEUE_MAX_LENGTH", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	queuePressureInterval, err := getDuration("QUEUE_PRESSURE_INTERVAL", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if queuePressureInterval <= 0 {
+		return nil, fmt.Errorf("invalid QUEUE_PRESSURE_INTERVAL: must be positive")
+	}
+
+	queueRetryAfter, err := getDuration("QUEUE_RETRY_AFTER", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if queueRetryAfter < time.Second {
+		return nil, fmt.Errorf("invalid QUEUE_RETRY_AFTER: must be at least 1s")
+	}
+
+	var credentialsKey []byte
+	if value := os.Getenv("CREDENTIALS_KEY"); value != "" {
+		credentialsKey, err = base64.StdEncoding.DecodeString(value)
+		if err != nil || len(credentialsKey) != 32 {
+			return nil, fmt.Errorf("invalid CREDENTIALS_KEY: must be 32 base64 encoded bytes")
+		}
+	}
+
+	torrentDataDir := os.Getenv("TORRENT_DATA_DIR")
+	if torrentDataDir == "" {
+		torrentDataDir = "torrents"
+	}
+
+	torrentSeedRatio, err := getFloat64("TORRENT_SEED_RATIO", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	torrentListenPort, err := getInt64("TORRENT_LISTEN_PORT", 42069)
+	if err != nil {
+		return nil, err
+	}
+
+	queueEventsRetention, err := getDuration("QUEUE_EVENTS_RETENTION", 30*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	streamConcurrency, err := getInt64("STREAM_CONCURRENCY", 4)
+	if err != nil {
+		return nil, err
+	}
+	if streamConcurrency < 1 {
+		return nil, fmt.Errorf("invalid STREAM_CONCURRENCY: must be at least 1")
+	}
+
+	multipartConnections, err := getInt64("MULTIPART_CONNECTIONS", 4)
+	if err != nil {
+		return nil, err
+	}
+	if multipartConnections < 1 {
+		return nil, fmt.Errorf("invalid MULTIPART_CONNECTIONS: must be at least 1")
+	}
+
+	queueBackend := os.Getenv("QUEUE_BACKEND")
+	if queueBackend == "" {
+		queueBackend = QueueBackendRedis
+	}
+	if queueBackend != QueueBackendRedis && queueBackend != QueueBackendNATS {
+		return nil, fmt.Errorf("invalid QUEUE_BACKEND: must be %s or %s", QueueBackendRedis, QueueBackendNATS)
+	}
+
+	mode, err := ParseMode(os.Getenv("MODE"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid MODE: %v", err)
+	}
+
+	downloadPathTemplate := os.Getenv("DOWNLOAD_PATH_TEMPLATE")
+	if downloadPathTemplate == "" {
+		downloadPathTemplate = layout.DefaultTemplate
+	}
+	if err := layout.Check(downloadPathTemplate); err != nil {
+		return nil, fmt.Errorf("invalid DOWNLOAD_PATH_TEMPLATE: %v", err)
+	}
+
+	httpAddr := os.Getenv("HTTP_ADDR")
+	if httpAddr == "" {
+		httpAddr = ":8080"
+	}
+
+	natsURL := os.Getenv("NATS_URL")
+	if natsURL == "" {
+		natsURL = "nats://localhost:4222"
+	}
+
+	natsStream := os.Getenv("NATS_STREAM")
+	if natsStream == "" {
+		natsStream = "DOWNLOADS"
+	}
+
+	natsMaxDeliver, err := getInt64("NATS_MAX_DELIVER", 5)
+	if err != nil {
+		return nil, err
+	}
+	if natsMaxDeliver < 1 {
+		return nil, fmt.Errorf("invalid NATS_MAX_DELIVER: must be at least 1")
+	}
+
+	multipartMinBytes, err := getInt64("MULTIPART_MIN_BYTES", 16<<20)
+	if err != nil {
+		return nil, err
+	}
+
+	mirrorMinSpeed, err := getInt64("MIRROR_MIN_SPEED_BYTES_PER_SEC", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	mirrorSlowWindow, err := getDuration("MIRROR_SLOW_WINDOW", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	partialFileMaxAge, err := getDuration("PARTIAL_FILE_MAX_AGE", 7*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	partialFileGCInterval, err := getDuration("PARTIAL_FILE_GC_INTERVAL", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	linkProbeInterval, err := getDuration("LINK_PROBE_INTERVAL", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	linkProbeAttempts, err := getInt64("LINK_PROBE_ATTEMPTS", 3)
+	if err != nil {
+		return nil, err
+	}
+	if linkProbeAttempts < 1 {
+		return nil, fmt.Errorf("invalid LINK_PROBE_ATTEMPTS: must be at least 1")
+	}
+
+	linkProbeTimeout, err := getDuration("LINK_PROBE_TIMEOUT", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	preflightTimeout, err := getDuration("PREFLIGHT_TIMEOUT", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	labelPriorities, err := getLabelRules("LABEL_PRIORITY")
+	if err != nil {
+		return nil, err
+	}
+
+	labelMaxActive, err := getLabelRules("LABEL_MAX_ACTIVE")
+	if err != nil {
+		return nil, err
+	}
+
+	userMaxActive, err := getInt64("USER_MAX_ACTIVE", 0)
+	if err != nil {
+		return nil, err
+	}
+	if userMaxActive < 0 {
+		return nil, fmt.Errorf("invalid USER_MAX_ACTIVE: must not be negative")
+	}
+
+	workerLabelSelector, err := getLabelSelector("WORKER_LABEL_SELECTOR")
+	if err != nil {
+		return nil, err
+	}
+
+	workerHeartbeatInterval, err := getDuration("WORKER_HEARTBEAT_INTERVAL", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Config{
+		MaxDownloadBytes:          maxDownloadBytes,
+		AllowedContentTypes:       getList("ALLOWED_CONTENT_TYPES"),
+		BlockedContentTypes:       getList("BLOCKED_CONTENT_TYPES"),
+		HTMLGuardMaxBytes:         htmlGuardMaxBytes,
+		CheckpointFile:            os.Getenv("CHECKPOINT_FILE"),
+		UserQuotaBytes:            userQuotaBytes,
+		OrgQuotaBytes:             orgQuotaBytes,
+		HostBandwidth:             hostBandwidth,
+		FleetBandwidth:            fleetBandwidth,
+		FleetMaxConnections:       fleetMaxConnections,
+		EnableHTTP3:               os.Getenv("ENABLE_HTTP3") == "true",
+		AuthRateLimit:             authRateLimit,
+		DownloadsRateLimit:        downloadsRateLimit,
+		OrgDownloadsRateLimit:     orgDownloadsRateLimit,
+		IdempotencyKeyTTL:         idempotencyKeyTTL,
+		DownloadListCacheTTL:      downloadListCacheTTL,
+		MaxBatchDownloads:         maxBatchDownloads,
+		MaxScriptTimeout:          maxScriptTimeout,
+		ScriptConcurrency:         scriptConcurrency,
+		ScriptMaxProcesses:        scriptMaxProcesses,
+		ScriptMaxMemoryBytes:      scriptMaxMemoryBytes,
+		PasswordResetTTL:          passwordResetTTL,
+		JWTIssuer:                 jwtIssuer,
+		JWTAudience:               jwtAudience,
+		PreviousSecretKeys:        getList("PREVIOUS_SECRET_KEYS"),
+		LegacyTokensIssuedBefore:  legacyTokensIssuedBefore,
+		LegacySecretKey:           os.Getenv("LEGACY_SECRET_KEY"),
+		SMTPAddr:                  smtpAddr,
+		SMTPUsername:              os.Getenv("SMTP_USERNAME"),
+		SMTPPassword:              os.Getenv("SMTP_PASSWORD"),
+		MailFrom:                  mailFrom,
+		EmailVerificationTTL:      emailVerificationTTL,
+		RequireEmailVerification:  requireEmailVerification,
+		PipelineSteps:             getList("PIPELINE_STEPS"),
+		PipelineConcurrency:       pipelineConcurrency,
+		PipelineStepTimeout:       pipelineStepTimeout,
+		ClamdAddr:                 os.Getenv("CLAMD_ADDR"),
+		ClamdScanAll:              clamdScanAll,
+		QuarantineDir:             os.Getenv("QUARANTINE_DIR"),
+		PipelineExtractMaxBytes:   pipelineExtractMaxBytes,
+		PipelineTranscodeArgs:     strings.Fields(os.Getenv("PIPELINE_TRANSCODE_ARGS")),
+		PipelineTranscodeFormat:   pipelineTranscodeFormat,
+		PipelineUploadBucket:      os.Getenv("PIPELINE_UPLOAD_BUCKET"),
+		PipelineThumbnailSize:     pipelineThumbnailSize,
+		RateLimitWindow:           rateLimitWindow,
+		DownloadDir:               os.Getenv("DOWNLOAD_DIR"),
+		DownloadPathTemplate:      downloadPathTemplate,
+		ContentStoreDir:           os.Getenv("CONTENT_STORE_DIR"),
+		MinFreeDiskBytes:          minFreeDiskBytes,
+		AllowedDomains:            getList("ALLOWED_DOMAINS"),
+		BlockedDomains:            getList("BLOCKED_DOMAINS"),
+		AllowPrivateNetworks:      os.Getenv("ALLOW_PRIVATE_NETWORKS") == "true",
+		ProxyCacheMaxAge:          proxyCacheMaxAge,
+		FetchMaxSpeed:             fetchMaxSpeed,
+		HTTPDialTimeout:           httpDialTimeout,
+		HTTPTLSHandshakeTimeout:   httpTLSHandshakeTimeout,
+		HTTPResponseHeaderTimeout: httpResponseHeaderTimeout,
+		HTTPIdleConnTimeout:       httpIdleConnTimeout,
+		HTTPMaxIdleConnsPerHost:   httpMaxIdleConnsPerHost,
+		HTTPMaxRedirects:          httpMaxRedirects,
+		HTTPProxy:                 os.Getenv("DOWNLOAD_PROXY"),
+		DownloadTimeout:           downloadTimeout,
+		StartupTimeout:            startupTimeout,
+		QueryTimeout:              queryTimeout,
+		PrematureEOFResumes:       prematureEOFResumes,
+		TuningReadTimeout:         tuningReadTimeout,
+		TuningChunkSize:           tuningChunkSize,
+		TuningFlushThreshold:      tuningFlushThreshold,
+		TuningTCPCongestion:       getList("TUNING_TCP_CONGESTION"),
+		MetricsInterval:           metricsInterval,
+		StatsDAddr:                os.Getenv("STATSD_ADDR"),
+		StatsDPrefix:              os.Getenv("STATSD_PREFIX"),
+		RemoteWriteURL:            remoteWriteURL,
+		RemoteWriteUsername:       os.Getenv("REMOTE_WRITE_USERNAME"),
+		RemoteWritePassword:       os.Getenv("REMOTE_WRITE_PASSWORD"),
+		RemoteWriteBearerToken:    os.Getenv("REMOTE_WRITE_BEARER_TOKEN"),
+		NumWorkers:                numWorkers,
+		MaxWorkers:                maxWorkers,
+		QueueTTL:                  queueTTL,
+		PlanQueueTTLs:             planQueueTTLs,
+		RetentionTTL:              retentionTTL,
+		PlanRetentionTTLs:         planRetentionTTLs,
+		RetentionInterval:         retentionInterval,
+		TrashRetention:            trashRetention,
+		ReconcileInterval:         reconcileInterval,
+		OutboxInterval:            outboxInterval,
+		RedisMaxMemoryBytes:       redisMaxMemoryBytes,
+		QueueMaxLength:            queueMaxLength,
+		QueuePressureInterval:     queuePressureInterval,
+		QueueRetryAfter:           queueRetryAfter,
+		CredentialsKey:            credentialsKey,
+		SFTPKnownHosts:            os.Getenv("SFTP_KNOWN_HOSTS"),
+		TorrentDataDir:            torrentDataDir,
+		TorrentSeedRatio:          torrentSeedRatio,
+		TorrentListenPort:         torrentListenPort,
+		QueueEventsRetention:      queueEventsRetention,
+		StreamConcurrency:         streamConcurrency,
+		MultipartConnections:      multipartConnections,
+		MultipartMinBytes:         multipartMinBytes,
+		PreflightTimeout:          preflightTimeout,
+		MirrorMinSpeed:            mirrorMinSpeed,
+		MirrorSlowWindow:          mirrorSlowWindow,
+		PartialFileMaxAge:         partialFileMaxAge,
+		PartialFileGCInterval:     partialFileGCInterval,
+		PartialFileArchiveDir:     os.Getenv("PARTIAL_FILE_ARCHIVE_DIR"),
+		LinkProbeInterval:         linkProbeInterval,
+		LinkProbeAttempts:         linkProbeAttempts,
+		LinkProbeTimeout:          linkProbeTimeout,
+		LabelPriorities:           labelPriorities,
+		LabelMaxActive:            labelMaxActive,
+		UserMaxActive:             userMaxActive,
+		WorkerLabelSelector:       workerLabelSelector,
+		GRPCAddr:                  os.Getenv("GRPC_ADDR"),
+		HTTPAddr:                  httpAddr,
+		MetricsAddr:               os.Getenv("METRICS_ADDR"),
+		WorkerHeartbeatInterval:   workerHeartbeatInterval,
+		InstanceID:                instanceID,
+		InstanceTTL:               instanceTTL,
+		ColdStorageAfter:          coldStorageAfter,
+		ColdStorageInterval:       coldStorageInterval,
+		ColdStorageBackend:        coldStorageBackend,
+		ColdStorageEndpoint:       os.Getenv("COLD_STORAGE_ENDPOINT"),
+		ColdStorageBucket:         os.Getenv("COLD_STORAGE_BUCKET"),
+		ColdStorageRegion:         coldStorageRegion,
+		ColdStorageAccessKey:      os.Getenv("COLD_STORAGE_ACCESS_KEY"),
+		ColdStorageSecretKey:      os.Getenv("COLD_STORAGE_SECRET_KEY"),
+		ColdStorageClass:          coldStorageClass,
+		ColdStorageURLTTL:         coldStorageURLTTL,
+		WatchDir:                  os.Getenv("WATCH_DIR"),
+		WatchInterval:             watchInterval,
+		WatchUser:                 os.Getenv("WATCH_USER"),
+		QueueBackend:              queueBackend,
+		Mode:                      mode,
+		NATSURL:                   natsURL,
+		NATSStream:                natsStream,
+		NATSMaxDeliver:            natsMaxDeliver,
+	}, nil
+}
+
+func getInt64(key string, def int64) (int64, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	return n, nil
+}
+
+func getFloat64(key string, def float64) (float64, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	return f, nil
+}
+
+func getDuration(key string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	return d, nil
+}
+
+// getInt64Range parses the positive bounds key_MIN and key_MAX.
+func getInt64Range(key string, defMin int64, defMax int64) ([2]int64, error) {
+	lower, err := getInt64(key+"_MIN", defMin)
+	if err != nil {
+		return [2]int64{}, err
+	}
+	upper, err := getInt64(key+"_MAX", defMax)
+	if err != nil {
+		return [2]int64{}, err
+	}
+	if lower <= 0 || upper < lower {
+		return [2]int64{}, fmt.Errorf("invalid %s_MIN and %s_MAX: must be positive with the minimum not above the maximum", key, key)
+	}
+	return [2]int64{lower, upper}, nil
+}
+
+// getDurationRange parses the positive bounds key_MIN and key_MAX.
+func getDurationRange(key string, defMin time.Duration, defMax time.Duration) ([2]time.Duration, error) {
+	lower, err := getDuration(key+"_MIN", defMin)
+	if err != nil {
+		return [2]time.Duration{}, err
+	}
+	upper, err := getDuration(key+"_MAX", defMax)
+	if err != nil {
+		return [2]time.Duration{}, err
+	}
+	if lower <= 0 || upper < lower {
+		return [2]time.Duration{}, fmt.Errorf("invalid %s_MIN and %s_MAX: must be positive with the minimum not above the maximum", key, key)
+	}
+	return [2]time.Duration{lower, upper}, nil
+}
+
+// getList parses a comma separated env variable, ignoring empty items.
+func getList(key string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// getDurationMap parses a comma separated list of key=duration pairs, e.g. "free=24h,pro=168h".
+func getDurationMap(key string) (map[string]time.Duration, error) {
+	m := make(map[string]time.Duration)
+	for _, item := range getList(key) {
+		k, v, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid %s: %q is not key=duration", key, item)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", key, err)
+		}
+		m[strings.TrimSpace(k)] = d
+	}
+	return m, nil
+}
+
+// getLabelSelector parses a comma separated list like "env=prod,team=search".
+func getLabelSelector(key string) (map[string]string, error) {
+	selector := make(map[string]string)
+	for _, item := range getList(key) {
+		k, v, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("invalid %s: %q is not key=value", key, item)
+		}
+		selector[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return selector, nil
+}
+
+// getLabelRules parses a comma separated list like "env=prod:8,env=dev:1".
+func getLabelRules(key string) ([]LabelRule, error) {
+	var rules []LabelRule
+	for _, item := range getList(key) {
+		label, limit, ok := strings.Cut(item, ":")
+		k, v, isLabel := strings.Cut(label, "=")
+		if !ok || !isLabel || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("invalid %s: %q is not key=value:number", key, item)
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(limit), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", key, err)
+		}
+		rules = append(rules, LabelRule{Key: strings.TrimSpace(k), Value: strings.TrimSpace(v), Limit: n})
+	}
+	return rules, nil
+}
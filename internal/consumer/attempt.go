@@ -0,0 +1,66 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"example.com/internal/repository"
+)
+
+// redactedHeaders are left out of the recorded response headers since debug bundles are shared.
+var redactedHeaders = []string{"Set-Cookie", "Www-Authenticate", "Proxy-Authenticate"}
+
+// beginAttempt records the start of an attempt at the download request. Failing to record
+// it does not fail the download, the returned attempt is then just not persisted.
+func (w *worker) beginAttempt(ctx context.Context, downloadID int64, source string, offset int64) *repository.Attempt {
+	attempt := &repository.Attempt{
+		DownloadID:  downloadID,
+		Worker:      w.name,
+		Source:      source,
+		StartedAt:   time.Now(),
+		OffsetStart: offset,
+		OffsetEnd:   offset,
+	}
+
+	attemptID, err := w.repo.CreateAttempt(ctx, *attempt)
+	if err != nil {
+		log.Println(err)
+	}
+	attempt.ID = attemptID
+	return attempt
+}
+
+func (w *worker) finishAttempt(ctx context.Context, attempt *repository.Attempt, err error) {
+	if attempt.ID == 0 {
+		return
+	}
+
+	finishedAt := time.Now()
+	attempt.FinishedAt = &finishedAt
+	attempt.OffsetEnd = attempt.OffsetStart + attempt.Bytes
+	if err != nil {
+		attempt.Error = err.Error()
+		if errors.Is(err, context.Canceled) {
+			attempt.Error = "interrupted by shutdown"
+		}
+	}
+
+	// ctx is already done when the attempt was interrupted by a shutdown.
+	if dbErr := w.repo.FinishAttempt(context.WithoutCancel(ctx), *attempt); dbErr != nil {
+		log.Println(dbErr)
+	}
+}
+
+func recordResponse(attempt *repository.Attempt, resp *http.Response) {
+	attempt.StatusCode = resp.StatusCode
+	attempt.Protocol = resp.Proto
+
+	headers := resp.Header.Clone()
+	for _, key := range redactedHeaders {
+		headers.Del(key)
+	}
+	attempt.ResponseHeaders = headers
+}
@@ -0,0 +1,284 @@
+package consumer
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+const BandwidthSliceDuration = 100 * time.Millisecond
+
+// bandwidthScheduler divides the host bandwidth among the active downloads of this
+// process. Every slice, the budget of the slice is split with weighted max-min fairness:
+// downloads that did not use their whole allowance in the previous slice (slow origins)
+// are capped at what they actually used, and the rest is shared among the others in
+// proportion to their priority. With a fleet budget, the budget of the slice is what the
+// process took of it, see fleetBandwidth.
+type bandwidthScheduler struct {
+	mu       sync.Mutex
+	rate     int64           // bytes per second, 0 for no limit of the process
+	fleet    *fleetBandwidth // nil for no limit of the fleet
+	flows    map[int64]*flow
+	refilled chan struct{} // closed and replaced on every refill
+	_        struct{}
+}
+
+type flow struct {
+	weight    int64
+	allowance int64 // bytes left in the current slice
+	granted   int64 // bytes granted at the start of the current slice
+	hungry    bool  // used its whole allowance in the current slice
+}
+
+func newBandwidthScheduler(rate int64, fleet *fleetBandwidth) *bandwidthScheduler {
+	return &bandwidthScheduler{
+		rate:     rate,
+		fleet:    fleet,
+		flows:    make(map[int64]*flow),
+		refilled: make(chan struct{}),
+	}
+}
+
+// throttled reports whether the downloads are throttled at all.
+func (s *bandwidthScheduler) throttled() bool {
+	return s.rate > 0 || s.fleet != nil
+}
+
+func (s *bandwidthScheduler) run(ctx context.Context) {
+	if !s.throttled() {
+		return
+	}
+
+	ticker := time.NewTicker(BandwidthSliceDuration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.refill(ctx)
+		}
+	}
+}
+
+func (s *bandwidthScheduler) add(downloadID int64, priority int64) {
+	if !s.throttled() {
+		return
+	}
+	if priority < 1 {
+		priority = 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flows[downloadID] = &flow{weight: priority, hungry: true}
+}
+
+func (s *bandwidthScheduler) remove(downloadID int64) {
+	if !s.throttled() {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.flows, downloadID)
+}
+
+// wait blocks until the download is allowed to read and returns how many bytes (at most n) it may read.
+func (s *bandwidthScheduler) wait(ctx context.Context, downloadID int64, n int) (int, error) {
+	if !s.throttled() {
+		return n, nil
+	}
+
+	for {
+		s.mu.Lock()
+		f, ok := s.flows[downloadID]
+		if !ok {
+			s.mu.Unlock()
+			return n, nil
+		}
+		if f.allowance > 0 {
+			allowed := int64(n)
+			if allowed > f.allowance {
+				allowed = f.allowance
+			}
+			f.allowance -= allowed
+			if f.allowance == 0 {
+				f.hungry = true
+			}
+			s.mu.Unlock()
+			return int(allowed), nil
+		}
+		refilled := s.refilled
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-refilled:
+		}
+	}
+}
+
+// giveBack returns bytes that were allowed but not read.
+func (s *bandwidthScheduler) giveBack(downloadID int64, n int) {
+	if !s.throttled() || n <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.flows[downloadID]; ok {
+		f.allowance += int64(n)
+	}
+}
+
+func (s *bandwidthScheduler) refill(ctx context.Context) {
+	budget := int64(math.MaxInt64)
+	if s.rate > 0 {
+		budget = s.rate * int64(BandwidthSliceDuration) / int64(time.Second)
+	}
+	if s.fleet != nil {
+		// Taken without holding the lock, the downloads keep reading meanwhile.
+		budget = s.fleet.take(ctx, min(budget, s.demand()))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Demand of a flow is unbounded if it was hungry, otherwise what it used last slice.
+	pending := make(map[*flow]int64, len(s.flows))
+	for _, f := range s.flows {
+		demand := int64(-1)
+		if !f.hungry {
+			demand = f.granted - f.allowance
+		}
+		pending[f] = demand
+		f.granted = 0
+	}
+
+	for len(pending) > 0 && budget > 0 {
+		totalWeight := int64(0)
+		for f := range pending {
+			totalWeight += f.weight
+		}
+
+		capped := false
+		for f, demand := range pending {
+			share := budget * f.weight / totalWeight
+			if demand >= 0 && demand < share {
+				f.granted = demand
+				budget -= demand
+				delete(pending, f)
+				capped = true
+			}
+		}
+		if capped {
+			continue
+		}
+
+		for f := range pending {
+			f.granted = budget * f.weight / totalWeight
+		}
+		break
+	}
+
+	for _, f := range s.flows {
+		// Keep a trickle for idle flows so they can show they need more.
+		if f.granted == 0 {
+			f.granted = 1
+		}
+		f.allowance = f.granted
+		f.hungry = false
+	}
+
+	close(s.refilled)
+	s.refilled = make(chan struct{})
+}
+
+// demand estimates the bytes the downloads read in the next slice: what they read in the
+// current one, and no limit if one of them read all it was given.
+func (s *bandwidthScheduler) demand() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	demand := int64(0)
+	for _, f := range s.flows {
+		if f.hungry {
+			return math.MaxInt64
+		}
+		demand += f.granted - f.allowance
+	}
+	return demand
+}
+
+// speedLimiter throttles the reads of one transfer to the max speed of its download, which
+// may change while it runs. It is a token bucket holding at most a slice worth of bytes, so
+// that a transfer that was idle does not burst.
+type speedLimiter struct {
+	mu     sync.Mutex
+	rate   int64 // bytes per second, 0 for unlimited
+	tokens float64
+	last   time.Time
+	_      struct{}
+}
+
+func newSpeedLimiter(rate int64) *speedLimiter {
+	return &speedLimiter{rate: rate, last: time.Now()}
+}
+
+func (l *speedLimiter) setRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		l.tokens, l.last = 0, time.Now()
+	}
+	l.rate = rate
+}
+
+// wait blocks until the transfer is allowed to read and returns how many bytes (at most n) it may read.
+func (l *speedLimiter) wait(ctx context.Context, n int) (int, error) {
+	for {
+		l.mu.Lock()
+		if l.rate <= 0 {
+			l.mu.Unlock()
+			return n, nil
+		}
+
+		now := time.Now()
+		burst := max(float64(l.rate)*BandwidthSliceDuration.Seconds(), 1)
+		l.tokens = min(burst, l.tokens+now.Sub(l.last).Seconds()*float64(l.rate))
+		l.last = now
+		if l.tokens >= 1 {
+			allowed := min(n, int(l.tokens))
+			l.tokens -= float64(allowed)
+			l.mu.Unlock()
+			return allowed, nil
+		}
+		delay := time.Duration((1 - l.tokens) / float64(l.rate) * float64(time.Second))
+		l.mu.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// giveBack returns bytes that were allowed but not read.
+func (l *speedLimiter) giveBack(n int) {
+	if n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate > 0 {
+		l.tokens += float64(n)
+	}
+}
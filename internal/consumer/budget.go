@@ -0,0 +1,69 @@
+package consumer
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"example.com/internal/repository"
+)
+
+// fleetBandwidth takes the budget of every bandwidth slice of this process from
+// FLEET_BANDWIDTH_BYTES_PER_SEC, shared in Redis by all the processes: a process gets what its
+// downloads are estimated to read, at most its max-min fair share of the slice given what the
+// processes wanted in the previous one. While Redis can not be reached, the process is only
+// held to its own limit.
+type fleetBandwidth struct {
+	repo    repository.Repository
+	process string // instance ID
+	rate    int64  // bytes per second
+	failing bool   // only touched by the scheduler goroutine
+	_       struct{}
+}
+
+// newFleetBandwidth returns nil when the bandwidth of the fleet is not limited.
+func newFleetBandwidth(repo repository.Repository, process string, rate int64) *fleetBandwidth {
+	if rate <= 0 {
+		return nil
+	}
+	return &fleetBandwidth{repo: repo, process: process, rate: rate}
+}
+
+// take returns the bytes the downloads of the process may read in the slice, at most want.
+func (f *fleetBandwidth) take(ctx context.Context, want int64) int64 {
+	budget := f.rate * int64(BandwidthSliceDuration) / int64(time.Second)
+	want = min(want, budget)
+	if want <= 0 {
+		return 0
+	}
+
+	taken, err := f.repo.TakeFleetBandwidth(ctx, f.process, want, budget, BandwidthSliceDuration)
+	if err != nil {
+		if !f.failing && ctx.Err() == nil {
+			log.Printf("Fleet bandwidth unavailable, limiting this process only: %v\n", err)
+		}
+		f.failing = true
+		return want
+	}
+	if f.failing {
+		log.Println("Fleet bandwidth available again")
+		f.failing = false
+	}
+	return taken
+}
+
+// takeConnections takes the slots of FLEET_MAX_CONNECTIONS of up to want connections of the
+// download, and returns how many it may open: want when the connections are not limited, at
+// least the one it holds since it was admitted.
+func (w *worker) takeConnections(ctx context.Context, downloadID int64, want int64) int64 {
+	if w.cfg.FleetMaxConnections <= 0 {
+		return want
+	}
+
+	slots, _, err := w.repo.AcquireConnectionSlots(ctx, downloadID, want, w.cfg.FleetMaxConnections, LinkProcessingExpTime)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	return max(slots, 1)
+}
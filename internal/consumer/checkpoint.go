@@ -0,0 +1,155 @@
+package consumer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"example.com/internal/repository"
+)
+
+type activeDownload struct {
+	DownloadID int64  `json:"download_id"`
+	Offset     int64  `json:"offset"` // bytes synced to disk so far
+	LockToken  string `json:"lock_token"`
+	speed      speedMeter
+}
+
+type checkpoint struct {
+	CreatedAt time.Time        `json:"created_at"`
+	Downloads []activeDownload `json:"downloads"`
+}
+
+// tracker keeps the downloads currently being processed by the workers of this process,
+// so they can be checkpointed on shutdown.
+type tracker struct {
+	mu     sync.Mutex
+	active map[int64]*activeDownload
+	tokens map[int64]string // lock tokens restored from the previous checkpoint
+	_      struct{}
+}
+
+func newTracker() *tracker {
+	return &tracker{
+		active: make(map[int64]*activeDownload),
+		tokens: make(map[int64]string),
+	}
+}
+
+// begin registers a download and returns the lock token to use for it, reusing the
+// token of the previous process if the download was checkpointed.
+func (t *tracker) begin(downloadID int64) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	token, ok := t.tokens[downloadID]
+	if ok {
+		delete(t.tokens, downloadID)
+	} else {
+		token = newLockToken()
+	}
+	t.active[downloadID] = &activeDownload{
+		DownloadID: downloadID,
+		LockToken:  token,
+	}
+	return token
+}
+
+func (t *tracker) setOffset(downloadID int64, offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if d, ok := t.active[downloadID]; ok {
+		d.Offset = offset
+	}
+}
+
+// measure sets the speed and the ETA of the progress of the download, see speedMeter.
+func (t *tracker) measure(downloadID int64, progress *repository.Progress) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	progress.BytesPerSec, progress.ETA = 0, -1
+	if d, ok := t.active[downloadID]; ok {
+		d.speed.measure(progress, time.Now())
+	}
+}
+
+func (t *tracker) end(downloadID int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.active, downloadID)
+}
+
+func (t *tracker) snapshot() []activeDownload {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	downloads := make([]activeDownload, 0, len(t.active))
+	for _, d := range t.active {
+		downloads = append(downloads, *d)
+	}
+	return downloads
+}
+
+// writeCheckpoint atomically writes the interrupted downloads to path.
+func (t *tracker) writeCheckpoint(path string) error {
+	data, err := json.Marshal(checkpoint{
+		CreatedAt: time.Now(),
+		Downloads: t.snapshot(),
+	})
+	if err != nil {
+		return fmt.Errorf("could not encode checkpoint: %v", err)
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("could not write checkpoint: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("could not write checkpoint: %v", err)
+	}
+
+	return nil
+}
+
+// readCheckpoint loads and removes the checkpoint left by the previous process.
+// The lock tokens are kept so the workers can reclaim the locks without waiting
+// for them to expire. A missing checkpoint is not an error.
+func (t *tracker) readCheckpoint(path string) ([]activeDownload, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("could not read checkpoint: %v", err)
+	}
+
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("could not decode checkpoint: %v", err)
+	}
+	if err := os.Remove(path); err != nil {
+		return nil, fmt.Errorf("could not remove checkpoint: %v", err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, d := range cp.Downloads {
+		t.tokens[d.DownloadID] = d.LockToken
+	}
+
+	return cp.Downloads, nil
+}
+
+func newLockToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
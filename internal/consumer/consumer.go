@@ -2,38 +2,188 @@ package consumer
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"example.com/internal/coldstore"
+	"example.com/internal/config"
+	"example.com/internal/flags"
+	"example.com/internal/httpclient"
+	"example.com/internal/pipeline"
 	"example.com/internal/repository"
+	"example.com/internal/safepath"
+	"example.com/internal/secrets"
 )
 
 const SleepDurationInCaseOFNoDownloadRequest = 1 * time.Second
 const LinkProcessingExpTime = 60 * time.Second
 const DownloadBuffSizeBytes = 131072                  // 128KB
 const FlushThresholdBytes = 8 * DownloadBuffSizeBytes // 1MB
+const UserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36"
 
 type worker struct {
-	id   int
-	repo repository.Repository
-	_    struct{}
+	id        int
+	repo      repository.Repository
+	cfg       *config.Config
+	tracker   *tracker
+	bandwidth *bandwidthScheduler
+	labels    *labelScheduler
+	fetcher   *fetcher
+	origins   *originAuth
+	disk      *diskLedger
+	box       secrets.Box
+	flags     flags.Flags
+	scripts   *scriptPool
+	pipelines *pipelinePool
+	resumed   <-chan int64
+	state     *workerState
+	name      string // host/id, recorded with the attempts and the consumer of the queue
+	// popped from the queue and not acknowledged yet, only touched by the worker goroutine
+	entry repository.QueueEntry
+	_     struct{}
 }
 
-func Start(ctx context.Context, repo repository.Repository, numWorkers int) {
-	workers := make([]worker, 0, numWorkers)
+// consumer is a pool of supervised workers sharing the scheduler, fetcher and disk ledger.
+type consumer struct {
+	ctx       context.Context
+	hostname  string
+	repo      repository.Repository
+	cfg       *config.Config
+	tracker   *tracker
+	bandwidth *bandwidthScheduler
+	labels    *labelScheduler
+	fetcher   *fetcher
+	origins   *originAuth
+	disk      *diskLedger
+	box       secrets.Box
+	flags     flags.Flags
+	scripts   *scriptPool
+	pipelines *pipelinePool
+	resumed   chan int64
+	wg        sync.WaitGroup
 
-	for i := 0; i < numWorkers; i++ {
-		w := worker{
-			id:   i,
-			repo: repo,
+	mu      sync.Mutex
+	workers map[int]*worker
+	nextID  int
+	_       struct{}
+}
+
+type Consumer interface {
+	// Wait blocks until all workers have stopped (the context passed to Start is done)
+	// and writes the shutdown checkpoint of the interrupted downloads.
+	Wait() error
+	// Scale starts or stops workers until there are n of them. Stopped workers finish
+	// their current download first.
+	Scale(n int) error
+	// Workers reports what every worker is doing
+	Workers() []WorkerStatus
+	// Volumes reports the capacity of the directories this process writes files to
+	Volumes() []repository.Volume
+}
+
+func Start(ctx context.Context, repo repository.Repository, cfg *config.Config, client *http.Client, dialer *net.Dialer, box secrets.Box, cold coldstore.Store, flags flags.Flags, steps pipeline.Pipeline, numWorkers int) Consumer {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	c := &consumer{
+		ctx:       ctx,
+		hostname:  hostname,
+		repo:      repo,
+		cfg:       cfg,
+		tracker:   newTracker(),
+		bandwidth: newBandwidthScheduler(cfg.HostBandwidth, newFleetBandwidth(repo, cfg.InstanceID, cfg.FleetBandwidth)),
+		labels:    newLabelScheduler(cfg.WorkerLabelSelector, cfg.LabelMaxActive),
+		fetcher: newFetcher(client, cfg.EnableHTTP3 && cfg.HTTPProxy == "", map[string]http.RoundTripper{
+			"ftp":    &ftpTransport{dialer: dialer},
+			"sftp":   &sftpTransport{dialer: dialer, knownHosts: cfg.SFTPKnownHosts},
+			"magnet": newTorrentTransport(ctx, repo, cfg, dialer),
+			"oci":    &ociTransport{client: client},
+			"maven":  &mavenTransport{client: client},
+			"npm":    &npmTransport{client: client},
+		}, &streamTransport{client: client, repo: repo, concurrency: int(cfg.StreamConcurrency)}),
+		origins:   newOriginAuth(client),
+		disk:      newDiskLedger(downloadDir(cfg), cfg.MinFreeDiskBytes),
+		box:       box,
+		flags:     flags,
+		scripts:   newScriptPool(ctx, repo, cfg, flags),
+		pipelines: newPipelinePool(ctx, repo, cfg, steps),
+		workers:   make(map[int]*worker),
+	}
+
+	if err := os.MkdirAll(downloadDir(cfg), 0755); err != nil {
+		log.Printf("Could not create download directory: %v\n", err)
+	}
+	go c.bandwidth.run(ctx)
+	if cfg.MetricsInterval > 0 {
+		go recordQueueStats(ctx, repo, cfg.MetricsInterval)
+	}
+	go expireDownloadRequests(ctx, repo, cfg, ExpirationSweepInterval)
+	if cfg.QueueEventsRetention > 0 {
+		go purgeQueueEvents(ctx, repo, cfg.QueueEventsRetention)
+	}
+	if cfg.PartialFileMaxAge > 0 {
+		go collectPartialFiles(ctx, repo, cfg)
+	}
+	if cfg.LinkProbeInterval > 0 {
+		go probeLinks(ctx, repo, cfg, client)
+	}
+	if cfg.ReconcileInterval > 0 {
+		go reconcile(ctx, repo, cfg.ReconcileInterval)
+	}
+	if cfg.WorkerHeartbeatInterval > 0 {
+		go c.sendHeartbeats(ctx, cfg.WorkerHeartbeatInterval)
+		go reapWorkers(ctx, repo, cfg.WorkerHeartbeatInterval)
+	}
+	if cfg.InstanceTTL > 0 {
+		go sendInstanceHeartbeats(ctx, repo, cfg.InstanceID, cfg.InstanceTTL)
+	}
+	if cfg.ColdStorageAfter > 0 && cfg.ColdStorageEndpoint != "" {
+		go tierFiles(ctx, repo, cfg, cold)
+	}
+	// Also without a TTL, downloads deleted by their owners wait here for the host of their file.
+	go purgeOldDownloads(ctx, repo, cfg, cold)
+
+	var checkpointed []activeDownload
+	if cfg.CheckpointFile != "" {
+		var err error
+		checkpointed, err = c.tracker.readCheckpoint(cfg.CheckpointFile)
+		if err != nil {
+			log.Println(err)
 		}
-		workers = append(workers, w)
-		go w.run(ctx)
 	}
+	c.resumed = make(chan int64, len(checkpointed))
+	for _, d := range checkpointed {
+		log.Printf("Resuming download request %d from checkpoint: offset: %d\n", d.DownloadID, d.Offset)
+		c.resumed <- d.DownloadID
+	}
+
+	c.mu.Lock()
+	for i := 0; i < numWorkers; i++ {
+		c.spawn(ctx)
+	}
+	c.mu.Unlock()
+
+	return c
+}
+
+func (c *consumer) Wait() error {
+	c.wg.Wait()
+
+	if c.cfg.CheckpointFile == "" {
+		return nil
+	}
+	return c.tracker.writeCheckpoint(c.cfg.CheckpointFile)
 }
 
 func (w *worker) run(ctx context.Context) {
@@ -42,43 +192,216 @@ func (w *worker) run(ctx context.Context) {
 		case <-ctx.Done():
 			log.Printf("Worker %d is stopping\n", w.id)
 			return
+		case <-w.state.stop:
+			log.Printf("Worker %d is leaving the pool\n", w.id)
+			return
+		case downloadID := <-w.resumed:
+			if err := w.processDownloadRequest(ctx, downloadID); err != nil {
+				log.Printf("Worker %d: failed to resume download request %d: %v", w.id, downloadID, err)
+			}
 		default:
-			downloadID, err := w.repo.PopDownloadRequest(ctx)
+			entry, err := w.repo.PopDownloadRequest(ctx, w.cfg.InstanceID, w.name)
 			if err != nil {
 				if err == repository.NoMoreDownloadRequestErr {
 					time.Sleep(SleepDurationInCaseOFNoDownloadRequest)
 					continue
 				}
-				log.Printf("Worker %d: error reading from queue: %v", w.repo, err)
+				log.Printf("Worker %d: error reading from queue: %v", w.id, err)
 				continue
 			}
 
-			if err = w.processDownloadRequest(ctx, downloadID); err != nil {
-				log.Printf("Worker %d: failed to process download request %d: %v", w.id, downloadID, err)
+			w.entry = entry
+			if err = w.processDownloadRequest(ctx, entry.DownloadID); err != nil {
+				log.Printf("Worker %d: failed to process download request %d: %v", w.id, entry.DownloadID, err)
+			}
+			if err == nil {
+				w.ack(ctx)
 			}
+			// Otherwise it failed before claiming the download: the entry stays pending and
+			// is delivered again after repository.QueueClaimIdleTime.
+			w.entry = repository.QueueEntry{}
 		}
 	}
 }
 
-func (w *worker) processDownloadRequest(ctx context.Context, downloadID int64) error {
+// ack acknowledges the queue entry the worker is processing, if any.
+func (w *worker) ack(ctx context.Context) {
+	if w.entry.ID == "" {
+		return
+	}
+	if err := w.repo.AckDownloadRequest(ctx, w.entry); err != nil {
+		log.Println(err)
+	}
+	w.entry = repository.QueueEntry{}
+}
+
+// invalidateDownloadList drops the cached first pages of the list of downloads of the user, see
+// DOWNLOAD_LIST_CACHE_TTL. It is called by every change of a download shown in the list.
+func invalidateDownloadList(ctx context.Context, repo repository.Repository, cfg *config.Config, userID int64) {
+	if cfg.DownloadListCacheTTL == 0 {
+		return
+	}
+	if err := repo.InvalidateDownloadList(ctx, userID); err != nil {
+		log.Println(err)
+	}
+}
+
+func (w *worker) processDownloadRequest(ctx context.Context, downloadID int64) (err error) {
 	log.Printf("Worker %d: processing download request %d\n", w.id, downloadID)
+	w.state.setDownloading(downloadID)
+	defer w.state.setIdle()
+	// Set when the origin cut the transfer: the download is requeued to resume once this worker
+	// let go of it.
+	var resume error
+	defer func() {
+		if resume != nil {
+			err = w.resumeShortDownload(ctx, downloadID, resume)
+		}
+	}()
 
 	downloadRequest, err := w.repo.GetDownloadRequest(ctx, downloadID)
 	if err != nil {
 		return fmt.Errorf("Failed to retrieve download request %d: %v", downloadID, err)
 	}
 	log.Printf("Worker %d: download request %d: retrieved info from db\n", w.id, downloadID)
+	// Set while the download holds a slot of the downloads of its user in progress, see
+	// USER_MAX_ACTIVE.
+	holdsSlot := false
+	defer func() {
+		if holdsSlot {
+			if err := w.repo.ReleaseUserSlot(context.WithoutCancel(ctx), downloadRequest.UserID, downloadID); err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+	// The slots of FLEET_MAX_CONNECTIONS the download holds, likewise.
+	var connections atomic.Int64
+	defer func() {
+		if n := connections.Load(); n > 0 {
+			if err := w.repo.ReleaseConnectionSlots(context.WithoutCancel(ctx), downloadID, n); err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+
+	if downloadRequest.Status == repository.StatusQueued || downloadRequest.Status == repository.StatusDownloading {
+		if downloadRequest.Host != "" && downloadRequest.Host != w.cfg.InstanceID {
+			alive, err := w.repo.IsInstanceAlive(ctx, downloadRequest.Host)
+			if err != nil {
+				return fmt.Errorf("Failed to check host of download request %d: %v", downloadID, err)
+			}
+			if alive {
+				// Its partial file is on the disk of another process: resume it there.
+				log.Printf("Worker %d: download request %d: routed to host %s\n", w.id, downloadID, downloadRequest.Host)
+				return w.repo.PushDownloadRequestToHost(ctx, downloadID, downloadRequest.Host)
+			}
+			log.Printf("Worker %d: download request %d: host %s is dead, restarting it here\n", w.id, downloadID, downloadRequest.Host)
+		}
+
+		release, ok := w.labels.admit(downloadRequest.Labels)
+		if !ok {
+			// Left to another process or for later: back to the end of the queue.
+			log.Printf("Worker %d: download request %d: deferred by label rules\n", w.id, downloadID)
+			time.Sleep(LabelDeferDelay)
+			return w.repo.PushDownloadRequestToHost(ctx, downloadID, downloadRequest.Host)
+		}
+		defer release()
+
+		if w.cfg.UserMaxActive > 0 {
+			acquired, held, err := w.repo.AcquireUserSlot(ctx, downloadRequest.UserID, downloadID, w.cfg.UserMaxActive, LinkProcessingExpTime)
+			if err != nil {
+				return fmt.Errorf("Failed to acquire slot of download request %d: %v", downloadID, err)
+			}
+			if !acquired {
+				// Stays queued until a download of the user ends: back to the end of the queue.
+				log.Printf("Worker %d: download request %d: deferred: user %d has %d downloads in progress\n", w.id, downloadID, downloadRequest.UserID, w.cfg.UserMaxActive)
+				time.Sleep(LabelDeferDelay)
+				return w.repo.PushDownloadRequestToHost(ctx, downloadID, downloadRequest.Host)
+			}
+			// Held by the worker of a duplicate entry unless the lock below is ours.
+			holdsSlot = !held
+		}
 
-	acquired, err := w.repo.AcquireLock(ctx, downloadID, LinkProcessingExpTime)
+		if w.cfg.FleetMaxConnections > 0 {
+			slots, held, err := w.repo.AcquireConnectionSlots(ctx, downloadID, 1, w.cfg.FleetMaxConnections, LinkProcessingExpTime)
+			if err != nil {
+				return fmt.Errorf("Failed to acquire connection slot of download request %d: %v", downloadID, err)
+			}
+			if slots == 0 {
+				// Stays queued until a connection of the fleet is closed: back to the end of the queue.
+				log.Printf("Worker %d: download request %d: deferred: the fleet has %d connections open\n", w.id, downloadID, w.cfg.FleetMaxConnections)
+				time.Sleep(LabelDeferDelay)
+				return w.repo.PushDownloadRequestToHost(ctx, downloadID, downloadRequest.Host)
+			}
+			if !held {
+				connections.Store(slots)
+			}
+		}
+	}
+
+	started, err := w.repo.StartDownloadRequest(ctx, downloadID, w.cfg.InstanceID)
+	if err != nil {
+		return fmt.Errorf("Failed to start download request %d: %v", downloadID, err)
+	}
+	if !started {
+		expired, err := w.repo.ExpireDownloadRequests(ctx, downloadID)
+		if err != nil {
+			log.Println(err)
+		}
+		if len(expired) > 0 {
+			invalidateDownloadList(ctx, w.repo, w.cfg, downloadRequest.UserID)
+		}
+		log.Printf("Worker %d: download request %d: skipped: status: %s\n", w.id, downloadID, downloadRequest.Status)
+		return nil
+	}
+	// The cached list of downloads of the user shows it downloading now, and finished once it
+	// completed or failed.
+	invalidateDownloadList(ctx, w.repo, w.cfg, downloadRequest.UserID)
+	defer invalidateDownloadList(context.WithoutCancel(ctx), w.repo, w.cfg, downloadRequest.UserID)
+
+	// An interrupted download keeps its lock and stays tracked, so it ends up in the
+	// shutdown checkpoint and the next process can take it over right away.
+	interrupted := false
+	token := w.tracker.begin(downloadID)
+	defer func() {
+		if !interrupted {
+			w.tracker.end(downloadID)
+		}
+	}()
+
+	acquired, err := w.repo.AcquireLock(ctx, downloadID, token, LinkProcessingExpTime)
 	if err != nil {
 		return fmt.Errorf("Failed to acquire lock: %v", err)
 	}
 	if !acquired {
+		w.ack(ctx) // a duplicate, its lock holder is on it
 		return fmt.Errorf("Download request %d is already being processed:", downloadID)
 	}
 	log.Printf("Worker %d: download request %d: acquired lock for %v duration\n", w.id, downloadID, LinkProcessingExpTime)
+	if w.cfg.WorkerHeartbeatInterval > 0 {
+		owner := repository.DownloadOwner{Worker: w.name, InstanceID: w.cfg.InstanceID, Token: token, Since: time.Now()}
+		if err := w.repo.SetDownloadOwner(ctx, downloadID, owner); err != nil {
+			log.Println(err) // the download is requeued once its lock expired instead
+		}
+	}
+	holdsSlot = w.cfg.UserMaxActive > 0
+	if w.cfg.FleetMaxConnections > 0 {
+		connections.Store(max(connections.Load(), 1))
+	}
+	// From here on the lock, and reconcile once it expired, take care of the download.
+	w.ack(ctx)
 
-	defer w.repo.ReleaseLock(ctx, downloadID) // No need to handle the error since the lock will finally be released.
+	defer func() {
+		if !interrupted {
+			w.repo.ReleaseLock(ctx, downloadID, token) // No need to handle the error since the lock will finally be released.
+		}
+		// Interrupted, the lock is left for the next process rather than reaped.
+		if w.cfg.WorkerHeartbeatInterval > 0 {
+			if err := w.repo.ClearDownloadOwner(context.WithoutCancel(ctx), downloadID, token); err != nil {
+				log.Println(err)
+			}
+		}
+	}()
 
 	file, offset, err := w.openFile(downloadRequest.FileName)
 	if err != nil {
@@ -89,10 +412,104 @@ func (w *worker) processDownloadRequest(ctx context.Context, downloadID int64) e
 		return fmt.Errorf("Failed to open file for download request %d: %v", downloadID, err)
 	}
 	defer file.Close()
+	offset, err = w.recoverParts(ctx, file, downloadRequest.UserID, offset)
+	if err != nil {
+		dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
+		if dbErr != nil {
+			log.Println(dbErr)
+		}
+		return fmt.Errorf("Failed to recover the parts of download request %d: %v", downloadID, err)
+	}
+	restart, err := w.repo.TakeRestart(ctx, downloadID)
+	if err != nil {
+		return fmt.Errorf("Failed to check restart of download request %d: %v", downloadID, err)
+	}
+	if restart && offset > 0 {
+		// Retried by its owner without the partial file: start over.
+		if err := file.Truncate(0); err != nil {
+			dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
+			if dbErr != nil {
+				log.Println(dbErr)
+			}
+			return fmt.Errorf("Error truncating file for download request %d: %v", downloadID, err)
+		}
+		if _, err := w.repo.AddUserUsage(ctx, downloadRequest.UserID, -offset); err != nil {
+			log.Println(err)
+		}
+		log.Printf("Worker %d: download request %d: restarted, dropped %d bytes\n", w.id, downloadID, offset)
+		offset = 0
+	}
+	w.tracker.setOffset(downloadID, offset)
 	log.Printf("Worker %d: download request %d: opened file: offset: %d\n", w.id, downloadID, offset)
 
+	attempt := w.beginAttempt(ctx, downloadID, downloadRequest.Link, offset)
+	defer func() { w.finishAttempt(ctx, attempt, err) }()
+
+	// Shutdown is handled by the read loop below (the download is checkpointed rather than
+	// failed), so the request only inherits the values of ctx and gets its own deadline.
+	reqCtx, cancelReq := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelReq()
+	if w.cfg.DownloadTimeout > 0 {
+		var cancel context.CancelFunc
+		reqCtx, cancel = context.WithTimeout(reqCtx, w.cfg.DownloadTimeout)
+		defer cancel()
+	}
+	reqCtx = withDownloadID(reqCtx, downloadID)
+	tuning := newTransferTuning(downloadRequest.Tuning)
+	reqCtx, releaseTuning := tuning.apply(reqCtx)
+	defer releaseTuning()
+	if downloadRequest.Proxy != "" {
+		proxyURL, err := w.openProxy(downloadRequest.Proxy)
+		if err != nil {
+			dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
+			if dbErr != nil {
+				log.Println(dbErr)
+			}
+			return fmt.Errorf("Failed to open proxy of download request %d: %v", downloadID, err)
+		}
+		reqCtx = httpclient.WithProxy(reqCtx, proxyURL)
+	}
+	if downloadRequest.Credentials != "" {
+		credentials, err := w.openCredentials(downloadRequest.Credentials)
+		if err != nil {
+			dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
+			if dbErr != nil {
+				log.Println(dbErr)
+			}
+			return fmt.Errorf("Failed to open credentials of download request %d: %v", downloadID, err)
+		}
+		reqCtx = withCredentials(reqCtx, credentials)
+	}
+	profileID := downloadRequest.OriginProfileID
+	if host := linkHost(downloadRequest.Link); profileID == nil && downloadRequest.Credentials == "" && host != "" {
+		// A profile of the user for the host of the link applies by itself.
+		matched, found, err := w.repo.FindOriginProfileForHost(ctx, downloadRequest.UserID, host)
+		if err != nil {
+			return fmt.Errorf("Failed to find origin profile of download request %d: %v", downloadID, err)
+		}
+		if found {
+			profileID = &matched.ID
+		}
+	}
+	var profile repository.OriginProfile
+	var profileSecret repository.OriginSecret
+	if profileID != nil {
+		profile, profileSecret, err = w.openOriginProfile(ctx, *profileID)
+		if err != nil {
+			dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
+			if dbErr != nil {
+				log.Println(dbErr)
+			}
+			return fmt.Errorf("Failed to open origin profile of download request %d: %v", downloadID, err)
+		}
+		if profile.Kind == repository.OriginProfileBasic {
+			// for the sources, HTTP and registry requests get the Authorization header below
+			reqCtx = withCredentials(reqCtx, &repository.Credentials{Username: profileSecret.Username, Password: profileSecret.Password})
+		}
+	}
+
 	link := downloadRequest.Link
-	req, err := http.NewRequest("GET", link, nil)
+	req, err := http.NewRequestWithContext(reqCtx, "GET", link, nil)
 	if err != nil {
 		dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
 		if dbErr != nil {
@@ -100,21 +517,142 @@ func (w *worker) processDownloadRequest(ctx context.Context, downloadID int64) e
 		}
 		return fmt.Errorf("Failed to create HTTP request for link %s: %v", link, err)
 	}
-	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
-	// req.Header.Set("Accept-Encoding", "identity") // Disable compression
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
+	first, last := int64(0), int64(-1)
+	if downloadRequest.Range != "" {
+		first, last, err = repository.ParseByteRange(downloadRequest.Range)
+		if err != nil {
+			dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
+			if dbErr != nil {
+				log.Println(dbErr)
+			}
+			return fmt.Errorf("Invalid range of download request %d: %v", downloadID, err)
+		}
+		if last >= 0 && offset > last-first {
+			// The whole range is on disk but the download was not completed: fetch its last byte again.
+			if err := file.Truncate(last - first); err != nil {
+				dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
+				if dbErr != nil {
+					log.Println(dbErr)
+				}
+				return fmt.Errorf("Error truncating file for link %s: %v", link, err)
+			}
+			if _, err := w.repo.AddUserUsage(ctx, downloadRequest.UserID, last-first-offset); err != nil {
+				log.Println(err)
+			}
+			offset = last - first
+			attempt.OffsetStart = offset
+			w.tracker.setOffset(downloadID, offset)
+		}
+	}
+	req.Header.Set("Range", rangeHeader(first, last, offset))
+	// The origin answers with the whole file if it changed since the previous attempt, which
+	// then starts over instead of appending the bytes of another file. Mirrors have validators
+	// of their own and a byte range of a file cannot start over.
+	validator := ""
+	if offset > 0 && downloadRequest.Range == "" && len(downloadRequest.Mirrors) == 0 {
+		previous, found, err := w.repo.GetPreflight(ctx, downloadID)
+		if err != nil {
+			log.Println(err)
+		} else if found {
+			validator = ifRangeValidator(previous)
+		}
+		if validator != "" {
+			req.Header.Set("If-Range", validator)
+		}
+	}
+	// Set explicitly, so the transport does not decode gzip itself and hide the compressed size.
+	req.Header.Set("Accept-Encoding", acceptEncoding(tuning.encoding, offset))
+	req.Header.Set("User-Agent", UserAgent)
+	// The names of the headers of the user, only sent to the mirrors on the host of the link.
+	var customHeaders []string
+	if downloadRequest.Headers != "" {
+		headers, err := w.openHeaders(downloadRequest.Headers)
+		if err != nil {
+			dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
+			if dbErr != nil {
+				log.Println(dbErr)
+			}
+			return fmt.Errorf("Failed to open headers of download request %d: %v", downloadID, err)
+		}
+		// The parts and mirrors are requested with clones of req, so they send them too.
+		for name, value := range headers {
+			req.Header.Set(name, value)
+			customHeaders = append(customHeaders, name)
+		}
+	}
 
-	client := &http.Client{} // TODO performance: Use http connection pool
-	resp, err := client.Do(req)
+	if profile.ID != 0 && (req.URL.Scheme == "http" || req.URL.Scheme == "https" || isRegistryScheme(req.URL.Scheme)) {
+		if err := w.origins.authorize(req, profile, profileSecret); err != nil {
+			dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
+			if dbErr != nil {
+				log.Println(dbErr)
+			}
+			return fmt.Errorf("Failed to authorize request for link %s: %v", link, err)
+		}
+	}
+
+	// What the origin tells of the file decides how it is fetched, see multipartParts.
+	var preflight *repository.Preflight
+	if w.cfg.PreflightTimeout > 0 && (req.URL.Scheme == "http" || req.URL.Scheme == "https") && !isPlaylistLink(req.URL) {
+		checked, err := w.preflight(req)
+		if err != nil {
+			log.Printf("Worker %d: download request %d: preflight failed: %v\n", w.id, downloadID, err)
+		} else {
+			preflight = &checked
+			if err := w.repo.SetPreflight(ctx, downloadID, checked); err != nil {
+				log.Println(err)
+			}
+			log.Printf("Worker %d: download request %d: preflight: size: %d: ranges: %t\n", w.id, downloadID, checked.Size, checked.AcceptRanges)
+		}
+	}
+	// Fail before fetching a file that does not fit on the disk. The reservation is made again
+	// with the Content-Length of the response.
+	if preflight != nil && preflight.Size > offset && downloadRequest.Range == "" {
+		if err := w.disk.reserve(downloadID, preflight.Size-offset); err != nil {
+			w.markDiskError(ctx, downloadID, err)
+			return fmt.Errorf("Rejected link %s: %v", link, err)
+		}
+		defer w.disk.release(downloadID)
+	}
+
+	resp, err := w.fetcher.do(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && profile.Kind == repository.OriginProfileOAuth2 {
+		// The token may have been revoked before it expired: retry once with a new one.
+		resp.Body.Close()
+		w.origins.invalidate(profile.ID)
+		if err := w.origins.authorize(req, profile, profileSecret); err != nil {
+			dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
+			if dbErr != nil {
+				log.Println(dbErr)
+			}
+			return fmt.Errorf("Failed to authorize request for link %s: %v", link, err)
+		}
+		resp, err = w.fetcher.do(req)
+	}
+	if len(downloadRequest.Mirrors) > 0 {
+		resp, err = w.fetcher.failover(req, resp, err, downloadRequest.Mirrors, customHeaders, w.cfg.MirrorMinSpeed, w.cfg.MirrorSlowWindow)
+	}
 	if err != nil {
 		dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
 		if dbErr != nil {
 			log.Println(dbErr)
 		}
-		log.Printf("Failed to perform HTTP request for link %s: %v", link, err)
+		return fmt.Errorf("Failed to perform HTTP request for link %s: %v", link, err)
 	}
+	resp.Body = tuning.body(resp.Body)
 	defer resp.Body.Close()
-	log.Printf("Worker %d: download request %d: sent range request: offset: %d\n", w.id, downloadID, offset)
+	recordResponse(attempt, resp)
+	log.Printf("Worker %d: download request %d: sent range request: offset: %d: protocol: %s\n", w.id, downloadID, offset, resp.Proto)
+
+	if downloadRequest.Range != "" {
+		if err := checkRangeResponse(resp, downloadRequest.Range, first, last, offset); err != nil {
+			dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
+			if dbErr != nil {
+				log.Println(dbErr)
+			}
+			return fmt.Errorf("Rejected link %s: %v", link, err)
+		}
+	}
 
 	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
 		err = fmt.Errorf("Unexpected HTTP status code for link %s: %d", link, resp.StatusCode)
@@ -126,18 +664,166 @@ func (w *worker) processDownloadRequest(ctx context.Context, downloadID int64) e
 	}
 	log.Printf("Worker %d: download request %d: received status code %d\n", w.id, downloadID, resp.StatusCode)
 
-	buffer := make([]byte, DownloadBuffSizeBytes)
+	decoding, err := responseDecoding(resp, tuning.encoding)
+	if err == nil && decoding != "" && downloadRequest.Range != "" {
+		err = fmt.Errorf("The origin compressed the range with %s, which cannot be decoded apart from the file", decoding)
+	}
+	if err != nil {
+		dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
+		if dbErr != nil {
+			log.Println(dbErr)
+		}
+		return fmt.Errorf("Rejected link %s: %v", link, err)
+	}
+	restarted := false
+	if decoding != "" && resp.StatusCode == http.StatusPartialContent && offset > 0 {
+		// The origin compressed the rest of the file, which can only be decoded from its start.
+		resp.Body.Close()
+		log.Printf("Worker %d: download request %d: rest of the file compressed with %s, restarting from offset 0 instead of %d\n", w.id, downloadID, decoding, offset)
+		restart := req.Clone(req.Context())
+		restart.Header.Set("Range", rangeHeader(first, last, 0))
+		restart.Header.Set("Accept-Encoding", acceptEncoding(tuning.encoding, 0))
+		resp, err = w.fetcher.do(restart)
+		if err != nil {
+			dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
+			if dbErr != nil {
+				log.Println(dbErr)
+			}
+			return fmt.Errorf("Failed to perform HTTP request for link %s: %v", link, err)
+		}
+		resp.Body = tuning.body(resp.Body)
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("Unexpected HTTP status code for link %s: %d", link, resp.StatusCode)
+			dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
+			if dbErr != nil {
+				log.Println(dbErr)
+			}
+			return err
+		}
+		if decoding, err = responseDecoding(resp, tuning.encoding); err != nil {
+			dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
+			if dbErr != nil {
+				log.Println(dbErr)
+			}
+			return fmt.Errorf("Rejected link %s: %v", link, err)
+		}
+		restarted = true
+	}
+
+	if (resp.StatusCode == http.StatusOK || restarted) && offset > 0 {
+		// The origin ignored the range and sends the whole file, so start over instead of appending it.
+		if err := file.Truncate(0); err != nil {
+			dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
+			if dbErr != nil {
+				log.Println(dbErr)
+			}
+			return fmt.Errorf("Error truncating file for link %s: %v", link, err)
+		}
+		if _, err := w.repo.AddUserUsage(ctx, downloadRequest.UserID, -offset); err != nil {
+			log.Println(err)
+		}
+		if !restarted && validator != "" {
+			log.Printf("Worker %d: download request %d: file changed since the previous attempt (If-Range %s), restarting from offset 0 instead of %d\n", w.id, downloadID, validator, offset)
+		} else if !restarted {
+			log.Printf("Worker %d: download request %d: range not honored, restarting from offset 0 instead of %d\n", w.id, downloadID, offset)
+		}
+		offset = 0
+		attempt.OffsetStart = 0
+		w.tracker.setOffset(downloadID, 0)
+	}
+
+	if err := w.checkContentType(resp.Header.Get("Content-Type")); err != nil {
+		dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
+		if dbErr != nil {
+			log.Println(dbErr)
+		}
+		return fmt.Errorf("Rejected link %s: %v", link, err)
+	}
+	if resp.ContentLength >= 0 {
+		if err := w.checkSize(offset + resp.ContentLength); err != nil {
+			dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
+			if dbErr != nil {
+				log.Println(dbErr)
+			}
+			return fmt.Errorf("Rejected link %s: %v", link, err)
+		}
+	}
+
+	if resp.ContentLength > 0 {
+		if err := w.disk.reserve(downloadID, resp.ContentLength); err != nil {
+			w.markDiskError(ctx, downloadID, err)
+			return fmt.Errorf("Rejected link %s: %v", link, err)
+		}
+		defer w.disk.release(downloadID)
+	}
+
+	// Origins and CDNs may answer 200 with an HTML error, login or captcha page instead of the
+	// file. The page is told apart before it is written when its size is known, at its end otherwise.
+	html := false
+	expected := int64(-1)
+	if offset == 0 && w.cfg.HTMLGuardMaxBytes > 0 && !isHTMLLink(link) && htmlResponse(resp, decoding) {
+		html = true
+		expected = w.expectedSize(ctx, downloadID)
+		if decoding == "" && resp.ContentLength >= 0 && w.isHTMLPage(resp.ContentLength, expected) {
+			return w.rejectHTMLPage(ctx, downloadID, downloadRequest.UserID, file, 0, resp.ContentLength)
+		}
+	}
+
+	totalSize := int64(-1)
+	if resp.ContentLength >= 0 {
+		totalSize = offset + resp.ContentLength
+	}
+	w.reportProgress(ctx, downloadID, offset, totalSize)
+	// Content-Length counts the compressed bytes of a decoded response, not those of the file.
+	expectedSize := totalSize
+	if decoding != "" {
+		expectedSize = -1
+	}
+	if err := w.repo.SetExpectedBytes(ctx, downloadID, expectedSize); err != nil {
+		log.Println(err)
+	}
+
+	buffer := make([]byte, tuning.chunkSize)
 	bytesRead := int64(0)
 	totalBytesRead := int64(0)
+	start := time.Now()
+	defer func() { observeTransfer(resp, totalBytesRead, time.Since(start)) }()
 	ticker := time.NewTicker(LinkProcessingExpTime / 2)
 	defer ticker.Stop()
 
+	w.bandwidth.add(downloadID, downloadRequest.Priority)
+	defer w.bandwidth.remove(downloadID)
+	speed := newSpeedLimiter(downloadRequest.MaxSpeed)
+
 	go func() {
 		for {
 			select {
 			case <-ticker.C:
-				w.repo.ExtendLock(ctx, downloadID, LinkProcessingExpTime) // TODO handle succeeded, error
+				w.repo.ExtendLock(ctx, downloadID, token, LinkProcessingExpTime) // TODO handle succeeded, error
 				log.Printf("Worker %d: download request %d: extended expiration time for %v duration\n", w.id, downloadID, LinkProcessingExpTime)
+				if holdsSlot {
+					if _, _, err := w.repo.AcquireUserSlot(ctx, downloadRequest.UserID, downloadID, w.cfg.UserMaxActive, LinkProcessingExpTime); err != nil {
+						log.Println(err)
+					}
+				}
+				if n := connections.Load(); n > 0 {
+					if _, _, err := w.repo.AcquireConnectionSlots(ctx, downloadID, n, w.cfg.FleetMaxConnections, LinkProcessingExpTime); err != nil {
+						log.Println(err)
+					}
+				}
+				download, err := w.repo.GetDownloadRequest(ctx, downloadID)
+				if err != nil {
+					continue
+				}
+				if download.Status != repository.StatusDownloading {
+					log.Printf("Worker %d: download request %d: stopping: status: %s\n", w.id, downloadID, download.Status)
+					cancelReq() // e.g. canceled by the user
+					return
+				}
+				speed.setRate(download.MaxSpeed) // may have been changed by the user
+			case <-reqCtx.Done():
+				return
 			case <-ctx.Done():
 				// TODO What should I do here?
 				return
@@ -145,18 +831,92 @@ func (w *worker) processDownloadRequest(ctx context.Context, downloadID int64) e
 		}
 	}()
 
+	// The parts of a download with mirrors could not fail over, so it uses one connection.
+	parts := w.multipartParts(req, resp, preflight, downloadRequest.Range, offset, w.cfg.MultipartConnections)
+	segmented := parts != nil && len(downloadRequest.Mirrors) == 0 && w.flags.Enabled(ctx, flags.SegmentedDownloads, downloadRequest.UserID)
+	if segmented && w.cfg.FleetMaxConnections > 0 {
+		// As many parts as the fleet has connections left for.
+		n := w.takeConnections(ctx, downloadID, int64(len(parts)))
+		connections.Store(n)
+		parts = w.multipartParts(req, resp, preflight, downloadRequest.Range, offset, n)
+		segmented = parts != nil
+	}
+	if segmented {
+		log.Printf("Worker %d: download request %d: fetching %d bytes in %d parts\n", w.id, downloadID, totalSize-offset, len(parts))
+		totalBytesRead, err = w.fetchParts(ctx, req, resp, partialFileName(downloadRequest.FileName), downloadID, downloadRequest.UserID, offset, totalSize, parts, speed, tuning)
+		attempt.Bytes = totalBytesRead
+		if err != nil && ctx.Err() != nil {
+			interrupted = true
+			log.Printf("Worker %d:  download request %d: context terminated: offset: %d\n", w.id, downloadID, offset+totalBytesRead)
+			return ctx.Err()
+		}
+		if isPrematureEOF(err) && w.cfg.PrematureEOFResumes > 0 {
+			resume = err
+			return err
+		}
+		if err != nil {
+			w.markDiskError(ctx, downloadID, err)
+			return fmt.Errorf("Error fetching the parts of link %s: %v", link, err)
+		}
+		if err := w.finishDownload(ctx, downloadID, downloadRequest.UserID, link, downloadRequest.ManifestURL, downloadRequest.FileName, file, totalSize); err != nil {
+			return err
+		}
+		log.Printf("Worker %d: download request %d: completed: received %d total bytes in %d parts\n", w.id, downloadID, totalBytesRead, len(parts))
+		return nil
+	}
+
+	// Content-Length counts the compressed bytes of a decoded response, so is its progress.
+	progress := func() int64 { return offset + totalBytesRead }
+	if decoding != "" {
+		log.Printf("Worker %d: download request %d: decoding %s response\n", w.id, downloadID, decoding)
+		var wire *countingReader
+		resp.Body, wire = decodeBody(resp.Body, decoding)
+		progress = func() int64 { return wire.n }
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
-			dbErr := w.repo.MarkError(ctx, downloadID, ctx.Err().Error())
-			if dbErr != nil {
-				log.Println(dbErr)
+			if err := file.Sync(); err != nil {
+				return fmt.Errorf("Error syncing file (on shutdown) link %s: %v", link, err)
 			}
-			log.Printf("Worker %d:  download request %d: context terminated\n", w.id, downloadID)
+			w.tracker.setOffset(downloadID, offset+totalBytesRead)
+			interrupted = true
+			log.Printf("Worker %d:  download request %d: context terminated: offset: %d\n", w.id, downloadID, offset+totalBytesRead)
 			return ctx.Err()
 		default:
-			n, err := resp.Body.Read(buffer)
-			if err == io.EOF {
+			allowed, err := speed.wait(ctx, len(buffer))
+			if err != nil {
+				continue // context terminated, handled above
+			}
+			allowed, err = w.bandwidth.wait(ctx, downloadID, allowed)
+			if err != nil {
+				continue // context terminated, handled above
+			}
+			n, err := resp.Body.Read(buffer[:allowed])
+			w.bandwidth.giveBack(downloadID, allowed-n)
+			speed.giveBack(allowed - n)
+			// The last bytes of the body may come along with io.EOF.
+			if n > 0 {
+				if _, err := file.Write(buffer[:n]); err != nil {
+					w.markDiskError(ctx, downloadID, err)
+					return fmt.Errorf("Error writing to file for link %s: %v", link, err)
+				}
+
+				bytesRead += int64(n)
+				totalBytesRead += int64(n)
+				attempt.Bytes = totalBytesRead
+				w.state.addBytes(n)
+				// Content-Length may be missing or wrong, so enforce the limit on the actual bytes too.
+				if err := w.checkSize(offset + totalBytesRead); err != nil {
+					dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
+					if dbErr != nil {
+						log.Println(dbErr)
+					}
+					return fmt.Errorf("Aborted link %s: %v", link, err)
+				}
+			}
+			if err == io.EOF || (isPrematureEOF(err) && w.cfg.PrematureEOFResumes > 0) {
 				// TODO duplicate code
 
 				if err := file.Sync(); err != nil {
@@ -166,17 +926,40 @@ func (w *worker) processDownloadRequest(ctx context.Context, downloadID int64) e
 					}
 					return fmt.Errorf("Error syncing file (for the last time) link %s: %v", link, err)
 				}
+				w.disk.consume(downloadID, bytesRead)
+				w.reportProgress(ctx, downloadID, progress(), totalSize)
+				if err := w.accountUsage(ctx, downloadRequest.UserID, bytesRead); err != nil {
+					dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
+					if dbErr != nil {
+						log.Println(dbErr)
+					}
+					return fmt.Errorf("Aborted link %s: %v", link, err)
+				}
 
-				log.Printf("Worker %d: download request %d: flushed to disk: chunk %d: chuck size: %d bytes\n", w.id, downloadID, totalBytesRead/FlushThresholdBytes, FlushThresholdBytes)
+				log.Printf("Worker %d: download request %d: flushed to disk: chunk %d: chuck size: %d bytes\n", w.id, downloadID, totalBytesRead/tuning.flushThreshold, tuning.flushThreshold)
 				bytesRead = 0
 				log.Printf("Worker %d:  download request %d: EOF\n", w.id, downloadID)
-				err := w.repo.CompleteDownloadRequest(ctx, downloadID)
-				if err != nil {
-					log.Println(err)
-					dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
+				if err != io.EOF {
+					resume = err
+					return err
+				}
+				if totalSize >= 0 && progress() < totalSize {
+					// e.g. a connection closed by a proxy, or a source not checking the length
+					cause := fmt.Errorf("%w after %d of %d bytes", errPrematureEOF, progress(), totalSize)
+					if w.cfg.PrematureEOFResumes > 0 {
+						resume = cause
+						return cause
+					}
+					dbErr := w.repo.MarkError(ctx, downloadID, cause.Error())
 					if dbErr != nil {
 						log.Println(dbErr)
 					}
+					return fmt.Errorf("Rejected link %s: %v", link, cause)
+				}
+				if html && w.isHTMLPage(totalBytesRead, expected) {
+					return w.rejectHTMLPage(ctx, downloadID, downloadRequest.UserID, file, totalBytesRead, totalBytesRead)
+				}
+				if err := w.finishDownload(ctx, downloadID, downloadRequest.UserID, link, downloadRequest.ManifestURL, downloadRequest.FileName, file, offset+totalBytesRead); err != nil {
 					return err
 				}
 				log.Printf("Worker %d: download request %d: completed: received %d total bytes\n", w.id, downloadID, totalBytesRead)
@@ -190,18 +973,7 @@ func (w *worker) processDownloadRequest(ctx context.Context, downloadID int64) e
 				return fmt.Errorf("Error reading from HTTP response for link %s: %v", link, err)
 			}
 
-			if _, err := file.Write(buffer[:n]); err != nil {
-				dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
-				if dbErr != nil {
-					log.Println(dbErr)
-				}
-				return fmt.Errorf("Error writing to file for link %s: %v", link, err)
-			}
-			// log.Printf("Worker %d: download request %d: wrote %d byte into mapped file\n", w.id, downloadID, n)
-
-			bytesRead += int64(n)
-			totalBytesRead += int64(n)
-			if bytesRead >= FlushThresholdBytes {
+			if bytesRead >= tuning.flushThreshold {
 				if err := file.Sync(); err != nil {
 					dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
 					if dbErr != nil {
@@ -209,15 +981,139 @@ func (w *worker) processDownloadRequest(ctx context.Context, downloadID int64) e
 					}
 					return fmt.Errorf("Error syncing file for link %s: %v", link, err)
 				}
-				log.Printf("Worker %d: download request %d: flushed to disk: chunk %d: chuck size: %d bytes\n", w.id, downloadID, totalBytesRead/FlushThresholdBytes, FlushThresholdBytes)
+				w.tracker.setOffset(downloadID, offset+totalBytesRead)
+				w.disk.consume(downloadID, bytesRead)
+				if err := w.disk.check(downloadID); err != nil {
+					w.markDiskError(ctx, downloadID, err)
+					return fmt.Errorf("Aborted link %s: %v", link, err)
+				}
+				w.reportProgress(ctx, downloadID, progress(), totalSize)
+				if err := w.accountUsage(ctx, downloadRequest.UserID, bytesRead); err != nil {
+					dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
+					if dbErr != nil {
+						log.Println(dbErr)
+					}
+					return fmt.Errorf("Aborted link %s: %v", link, err)
+				}
+				log.Printf("Worker %d: download request %d: flushed to disk: chunk %d: chuck size: %d bytes\n", w.id, downloadID, totalBytesRead/tuning.flushThreshold, tuning.flushThreshold)
 				bytesRead = 0
 			}
 		}
 	}
 }
 
+// finishDownload verifies the complete file of size bytes against the manifest of the
+// download, if it has one, deduplicates it, marks the download completed, records its metadata
+// and queues its pipeline and the completion scripts of the user on it.
+func (w *worker) finishDownload(ctx context.Context, downloadID int64, userID int64, link string, manifestURL string, fileName string, file *os.File, size int64) error {
+	if manifestURL != "" {
+		if err := w.verifyManifest(ctx, downloadID, link, manifestURL, partialFileName(fileName)); err != nil {
+			// The file is corrupt: start over if the download is retried.
+			if truncErr := file.Truncate(0); truncErr != nil {
+				log.Println(truncErr)
+			} else if _, usageErr := w.repo.AddUserUsage(ctx, userID, -size); usageErr != nil {
+				log.Println(usageErr)
+			}
+			dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
+			if dbErr != nil {
+				log.Println(dbErr)
+			}
+			return fmt.Errorf("Rejected link %s: %v", link, err)
+		}
+	}
+	info, err := file.Stat()
+	if err == nil && info.Size() != size {
+		err = fmt.Errorf("File is %d bytes instead of %d", info.Size(), size)
+	}
+	if err != nil {
+		dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
+		if dbErr != nil {
+			log.Println(dbErr)
+		}
+		return fmt.Errorf("Rejected link %s: %v", link, err)
+	}
+	// Windows does not rename open files. The deferred Close of the caller then fails, unchecked.
+	err = file.Close()
+	if err == nil {
+		err = os.Rename(safepath.Long(partialFileName(fileName)), safepath.Long(fileName))
+	}
+	if err != nil {
+		dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
+		if dbErr != nil {
+			log.Println(dbErr)
+		}
+		return fmt.Errorf("Error renaming file for link %s: %v", link, err)
+	}
+	if err := w.deduplicate(ctx, downloadID, fileName); err != nil {
+		log.Printf("Worker %d: download request %d: deduplication failed: %v\n", w.id, downloadID, err)
+	}
+	completed, err := w.repo.CompleteDownloadRequest(ctx, downloadID, size)
+	if err != nil {
+		log.Println(err)
+		dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
+		if dbErr != nil {
+			log.Println(dbErr)
+		}
+		return err
+	}
+	if !completed {
+		// Canceled meanwhile, or completed by another attempt: its pipeline and scripts are not run twice.
+		log.Printf("Worker %d: download request %d: not completed: no longer downloading or not of the expected size\n", w.id, downloadID)
+		return nil
+	}
+	w.recordMetadata(ctx, downloadID, link, fileName)
+	w.pipelines.submit(downloadID, userID, link, fileName)
+	w.scripts.submit(ctx, downloadID, userID, fileName)
+	return nil
+}
+
+// reportProgress publishes the progress for clients watching the download; it is best effort.
+func (w *worker) reportProgress(ctx context.Context, downloadID int64, bytes int64, totalBytes int64) {
+	progress := repository.Progress{Bytes: bytes, TotalBytes: totalBytes}
+	w.tracker.measure(downloadID, &progress)
+	err := w.repo.SetProgress(ctx, downloadID, progress)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// PartialFileSuffix is appended to the file name of a download while it is received. The file
+// gets its name once it is complete and verified, so the directory never shows it half written.
+const PartialFileSuffix = ".part"
+
+func partialFileName(fileName string) string {
+	return fileName + PartialFileSuffix
+}
+
+// downloadDir is where the files of the downloads are kept, DOWNLOAD_DIR or the working directory.
+func downloadDir(cfg *config.Config) string {
+	if cfg.DownloadDir == "" {
+		return "."
+	}
+	return cfg.DownloadDir
+}
+
+// openFile opens the partial file of the download and returns its size, the offset the
+// download resumes from. A partial file left under the final name by an earlier version is
+// renamed first, with the state of its parts.
 func (w *worker) openFile(fileName string) (*os.File, int64, error) {
-	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	partial := partialFileName(fileName)
+	if dir := filepath.Dir(fileName); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, 0, err
+		}
+	}
+	if _, err := os.Stat(safepath.Long(partial)); errors.Is(err, os.ErrNotExist) {
+		err := os.Rename(safepath.Long(fileName), safepath.Long(partial))
+		if err == nil {
+			if err := os.Rename(fileName+PartsStateSuffix, partial+PartsStateSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, 0, err
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, 0, err
+		}
+	}
+	file, err := os.OpenFile(safepath.Long(partial), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -0,0 +1,121 @@
+package consumer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"example.com/internal/coldstore"
+	"example.com/internal/config"
+	"example.com/internal/flags"
+	"example.com/internal/pipeline"
+	"example.com/internal/repository"
+	"example.com/internal/repository/repositorytest"
+	"example.com/internal/secrets"
+)
+
+// BenchmarkDownload measures a worker downloading a file from a local origin into its
+// download directory, across chunk sizes (the buffer read from the origin and written at once)
+// and flush thresholds (the bytes written between syncs of the file and progress updates).
+// It reports the throughput of the buffered writes and the flushes, the origin and the
+// repository being in memory.
+func BenchmarkDownload(b *testing.B) {
+	const size = 16 << 20
+	content := make([]byte, size)
+	if _, err := rand.Read(content); err != nil {
+		b.Fatal(err)
+	}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer origin.Close()
+
+	// A line per flush would measure the logger.
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, chunkSize := range []int64{4 << 10, 32 << 10, DownloadBuffSizeBytes, 1 << 20} {
+		for _, flushThreshold := range []int64{256 << 10, FlushThresholdBytes, 16 << 20} {
+			if flushThreshold < chunkSize {
+				continue
+			}
+			b.Run(fmt.Sprintf("chunk=%dKiB/flush=%dKiB", chunkSize>>10, flushThreshold>>10), func(b *testing.B) {
+				repo := repositorytest.NewFake()
+				userID, err := repo.AddUser(repository.User{Username: "benchmark"}, "password")
+				if err != nil {
+					b.Fatal(err)
+				}
+				w := newBenchmarkWorker(b, repo)
+				tuning := repository.Tuning{ChunkSizeBytes: chunkSize, FlushThresholdBytes: flushThreshold}
+
+				b.SetBytes(size)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					downloadID := repo.AddDownload(repository.DownloadRequest{
+						UserID:   userID,
+						Link:     fmt.Sprintf("%s/%d.bin", origin.URL, i),
+						FileName: filepath.Join(w.cfg.DownloadDir, fmt.Sprintf("%d.bin", i)),
+						Tuning:   tuning,
+					})
+					if err := w.processDownloadRequest(context.Background(), downloadID); err != nil {
+						b.Fatal(err)
+					}
+
+					b.StopTimer()
+					download, err := repo.GetDownloadRequest(context.Background(), downloadID)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if download.Status != repository.StatusCompleted {
+						b.Fatalf("download request %d is %s: %s", downloadID, download.Status, download.Error)
+					}
+					os.Remove(download.FileName)
+					b.StartTimer()
+				}
+			})
+		}
+	}
+}
+
+// newBenchmarkWorker returns a worker of a pool without workers, on repo and a download
+// directory of the benchmark.
+func newBenchmarkWorker(b *testing.B, repo repository.Repository) *worker {
+	b.Helper()
+
+	cfg, err := config.Load()
+	if err != nil {
+		b.Fatal(err)
+	}
+	cfg.DownloadDir = b.TempDir()
+	cfg.MetricsInterval = 0
+	cfg.MultipartConnections = 1 // over a single connection, through the buffered writes
+	box, err := secrets.New(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	cold, err := coldstore.New(cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	steps, err := pipeline.New(cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b.Cleanup(cancel)
+	c := Start(ctx, repo, cfg, http.DefaultClient, &net.Dialer{}, box, cold, flags.New(repo), steps, 0).(*consumer)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.newWorker()
+}
@@ -0,0 +1,123 @@
+package consumer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"example.com/internal/config"
+	"example.com/internal/repository"
+)
+
+// deduplicate stores the completed file in the content store keyed by its sha256.
+// The first copy of a content is hard linked into the store; later copies (of any user)
+// are replaced by a hard link to the stored one, so identical files use the disk once.
+// The store must be on the same filesystem as the downloads.
+// A reference to the content is only taken once the file is linked, and at most once per download.
+func (w *worker) deduplicate(ctx context.Context, downloadID int64, fileName string) error {
+	if w.cfg.ContentStoreDir == "" {
+		return nil
+	}
+
+	download, err := w.repo.GetDownloadRequest(ctx, downloadID)
+	if err != nil {
+		return err
+	}
+	hash, size, err := hashFile(fileName)
+	if err != nil {
+		return err
+	}
+	if download.ContentHash == hash {
+		return nil // deduplicated by an earlier attempt
+	}
+	if err := os.MkdirAll(w.cfg.ContentStoreDir, 0755); err != nil {
+		return fmt.Errorf("could not create content store: %v", err)
+	}
+
+	created, err := linkContent(w.cfg.ContentStoreDir, hash, fileName)
+	if err != nil {
+		return err
+	}
+	if _, err := w.repo.AddContentRef(ctx, hash, size); err != nil {
+		if created {
+			os.Remove(filepath.Join(w.cfg.ContentStoreDir, hash))
+		}
+		return err
+	}
+	if err := w.repo.SetContentHash(ctx, downloadID, hash); err != nil {
+		releaseContent(ctx, w.repo, w.cfg, hash)
+		return err
+	}
+	if download.ContentHash != "" {
+		// The file changed since it was last deduplicated.
+		releaseContent(ctx, w.repo, w.cfg, download.ContentHash)
+	}
+	return nil
+}
+
+// linkContent replaces fileName with a hard link to the stored copy of hash, or makes
+// fileName the stored copy if there is none yet. It reports whether the stored copy was created.
+func linkContent(storeDir string, hash string, fileName string) (bool, error) {
+	storePath := filepath.Join(storeDir, hash)
+	tmp := fileName + ".dedup"
+	for attempt := 0; attempt < 2; attempt++ {
+		err := os.Link(storePath, tmp)
+		if err == nil {
+			if err := os.Rename(tmp, fileName); err != nil {
+				os.Remove(tmp)
+				return false, fmt.Errorf("could not replace %s with stored content: %v", fileName, err)
+			}
+			return false, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return false, fmt.Errorf("could not link stored content %s: %v", hash, err)
+		}
+
+		// There is no stored copy, this file becomes the stored copy.
+		err = os.Link(fileName, storePath)
+		if err == nil {
+			return true, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return false, fmt.Errorf("could not add %s to content store: %v", fileName, err)
+		}
+		// Another worker stored the same content in the meantime, link to its copy.
+	}
+	return false, fmt.Errorf("could not add %s to content store: stored copy keeps changing", fileName)
+}
+
+// releaseContent drops the reference of a removed file to the content and removes the
+// stored copy once nothing references it. Failures are only logged: the file is gone anyway.
+func releaseContent(ctx context.Context, repo repository.Repository, cfg *config.Config, hash string) {
+	refCount, err := repo.ReleaseContentRef(ctx, hash)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if refCount <= 0 && cfg.ContentStoreDir != "" {
+		if err := os.Remove(filepath.Join(cfg.ContentStoreDir, hash)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Println(err)
+		}
+	}
+}
+
+func hashFile(fileName string) (string, int64, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, file)
+	if err != nil {
+		return "", 0, fmt.Errorf("could not hash %s: %v", fileName, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
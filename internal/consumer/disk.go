@@ -0,0 +1,150 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"syscall"
+	"time"
+
+	"example.com/internal/repository"
+)
+
+// errInsufficientStorage fails the downloads whose file does not fit on the disk.
+var errInsufficientStorage = errors.New("Insufficient disk space")
+
+// diskLedger tracks the bytes that running downloads still expect to write, so that
+// concurrent downloads can't collectively overrun the disk. A reservation shrinks as
+// its bytes are flushed (they then show up in the free space of the volume) and
+// whatever is left is released when the download ends.
+type diskLedger struct {
+	mu           sync.Mutex
+	dir          string
+	minFree      int64 // bytes that must stay free on the volume
+	reserved     int64
+	reservations map[int64]int64
+	_            struct{}
+}
+
+func newDiskLedger(dir string, minFree int64) *diskLedger {
+	return &diskLedger{
+		dir:          dir,
+		minFree:      minFree,
+		reservations: make(map[int64]int64),
+	}
+}
+
+// reserve sets the reservation of the download to bytes, replacing the one it had.
+func (l *diskLedger) reserve(downloadID int64, bytes int64) error {
+	_, free, err := diskSpace(l.dir)
+	if err != nil {
+		return fmt.Errorf("Could not check free disk space: %v", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	available := free - (l.reserved - l.reservations[downloadID]) - l.minFree
+	if bytes > available {
+		return fmt.Errorf("%w: need %d bytes, %d bytes available", errInsufficientStorage, bytes, max(available, 0))
+	}
+
+	l.reserved += bytes - l.reservations[downloadID]
+	l.reservations[downloadID] = bytes
+	return nil
+}
+
+// check fails if what is left of the reservation of the download no longer fits on the
+// volume, e.g. because another process filled it, or if a download of unknown size would
+// write into the space reserved for the others.
+func (l *diskLedger) check(downloadID int64) error {
+	_, free, err := diskSpace(l.dir)
+	if err != nil {
+		log.Printf("Could not check free disk space: %v\n", err)
+		return nil // the download fails on writing if the disk is full
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	others := l.reserved - l.reservations[downloadID]
+	available := free - others - l.minFree
+	if available < 0 {
+		return fmt.Errorf("%w: %d bytes free, %d of them reserved or kept free", errInsufficientStorage, free, others+l.minFree)
+	}
+	if l.reservations[downloadID] > available {
+		return fmt.Errorf("%w: need %d more bytes, %d bytes available", errInsufficientStorage, l.reservations[downloadID], available)
+	}
+	return nil
+}
+
+// consume shrinks the reservation by bytes that were flushed to disk.
+func (l *diskLedger) consume(downloadID int64, bytes int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bytes = min(bytes, l.reservations[downloadID])
+	l.reservations[downloadID] -= bytes
+	l.reserved -= bytes
+}
+
+// release gives back what is left of the reservation, e.g. on failure or when the
+// file turned out smaller than announced.
+func (l *diskLedger) release(downloadID int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.reserved -= l.reservations[downloadID]
+	delete(l.reservations, downloadID)
+}
+
+// volume reports the capacity of the volume of the ledger with its reservations.
+func (l *diskLedger) volume() repository.Volume {
+	volume := newVolume(repository.VolumeDownloads, l.dir)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	volume.ReservedBytes = l.reserved
+	volume.MinFreeBytes = l.minFree
+	return volume
+}
+
+func newVolume(name string, dir string) repository.Volume {
+	volume := repository.Volume{Name: name, Path: dir, UpdatedAt: time.Now()}
+	total, free, err := diskSpace(dir)
+	if err != nil {
+		volume.Error = err.Error()
+		return volume
+	}
+	volume.TotalBytes, volume.FreeBytes = total, free
+	return volume
+}
+
+// Volumes reports the capacity of the directories this process writes files to.
+func (c *consumer) Volumes() []repository.Volume {
+	volumes := []repository.Volume{c.disk.volume()}
+	for _, dir := range []struct{ name, path string }{
+		{repository.VolumeContentStore, c.cfg.ContentStoreDir},
+		{repository.VolumeTorrents, c.cfg.TorrentDataDir},
+		{repository.VolumePartialArchive, c.cfg.PartialFileArchiveDir},
+		{repository.VolumeQuarantine, c.cfg.QuarantineDir},
+	} {
+		if dir.path != "" {
+			volumes = append(volumes, newVolume(dir.name, dir.path))
+		}
+	}
+	return volumes
+}
+
+// markDiskError fails the download with err, classified as insufficient storage if the file
+// did not fit on the disk.
+func (w *worker) markDiskError(ctx context.Context, downloadID int64, err error) {
+	code := ""
+	if errors.Is(err, errInsufficientStorage) || errors.Is(err, syscall.ENOSPC) {
+		code = repository.ErrorCodeInsufficientStorage
+	}
+	if dbErr := w.repo.MarkErrorCode(ctx, downloadID, code, err.Error()); dbErr != nil {
+		log.Println(dbErr)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package consumer
+
+import "syscall"
+
+// diskSpace returns the size of the volume of dir and the bytes available on it to the process.
+func diskSpace(dir string) (int64, int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, 0, err
+	}
+	return int64(stat.Blocks) * int64(stat.Bsize), int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,25 @@
+//go:build windows
+
+package consumer
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// diskSpace returns the size of the volume of dir and the bytes available on it to the process.
+func diskSpace(dir string) (int64, int64, error) {
+	path, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var freeBytesAvailable, totalBytes uint64
+	r, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(path)), uintptr(unsafe.Pointer(&freeBytesAvailable)), uintptr(unsafe.Pointer(&totalBytes)), 0)
+	if r == 0 {
+		return 0, 0, err
+	}
+	return int64(totalBytes), int64(freeBytesAvailable), nil
+}
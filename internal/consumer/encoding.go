@@ -0,0 +1,100 @@
+package consumer
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"example.com/internal/repository"
+)
+
+// acceptEncoding returns the Accept-Encoding of a download resumed at offset. A compressed
+// response can only be decoded from its start, so a resumed download asks for the rest of the
+// decoded file; only downloads storing the compressed file as received ask for it compressed.
+func acceptEncoding(mode string, offset int64) string {
+	if mode == repository.ContentEncodingStore || mode == repository.ContentEncodingDecompress && offset == 0 {
+		return "gzip, deflate"
+	}
+	return "identity"
+}
+
+// responseDecoding returns the Content-Encoding of the response the worker decodes, empty if
+// the body is written as received.
+func responseDecoding(resp *http.Response, mode string) (string, error) {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" || mode == repository.ContentEncodingStore {
+		return "", nil
+	}
+	switch encoding {
+	case "gzip", "x-gzip", "deflate":
+		return encoding, nil
+	}
+	return "", fmt.Errorf("Unsupported Content-Encoding %q, set tuning.content_encoding to %q to keep the file as received", encoding, repository.ContentEncodingStore)
+}
+
+// countingReader counts the bytes read through it, the compressed bytes of a decoded body.
+type countingReader struct {
+	r io.Reader
+	n int64
+	_ struct{}
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type decodedBody struct {
+	io.Reader
+	body io.ReadCloser
+	_    struct{}
+}
+
+func (d *decodedBody) Close() error {
+	return d.body.Close()
+}
+
+// decodeBody returns the decoded body, and the reader counting the bytes received. The
+// decoder is created on the first read, which waits for the first bytes from the origin.
+func decodeBody(body io.ReadCloser, encoding string) (io.ReadCloser, *countingReader) {
+	wire := &countingReader{r: body}
+	return &decodedBody{Reader: &lazyDecoder{wire: wire, encoding: encoding}, body: body}, wire
+}
+
+type lazyDecoder struct {
+	wire     *countingReader
+	encoding string
+	decoder  io.Reader
+	_        struct{}
+}
+
+func (l *lazyDecoder) Read(p []byte) (int, error) {
+	if l.decoder == nil {
+		decoder, err := newDecoder(l.wire, l.encoding)
+		if err != nil {
+			return 0, fmt.Errorf("could not decode %s response: %v", l.encoding, err)
+		}
+		l.decoder = decoder
+	}
+	return l.decoder.Read(p)
+}
+
+func newDecoder(r io.Reader, encoding string) (io.Reader, error) {
+	if encoding != "deflate" {
+		return gzip.NewReader(r)
+	}
+
+	// "deflate" is zlib wrapped, but some origins send the raw stream.
+	buffered := bufio.NewReader(r)
+	header, err := buffered.Peek(2)
+	if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(buffered)
+	}
+	return flate.NewReader(buffered), nil
+}
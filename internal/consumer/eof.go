@@ -0,0 +1,45 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"example.com/internal/metrics"
+)
+
+func init() {
+	metrics.Register("downloader_premature_eof_resumes_total", metrics.KindCounter, "Downloads requeued to resume because the origin closed the connection before the end of the file.")
+}
+
+// errPrematureEOF marks the transfers the origin ended before the end of the file, which are
+// resumed from the partial file instead of completed short.
+var errPrematureEOF = errors.New("the origin closed the connection before the end of the file")
+
+// isPrematureEOF reports whether err is the end of a transfer cut short by the origin.
+func isPrematureEOF(err error) bool {
+	return errors.Is(err, errPrematureEOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// resumeShortDownload requeues a download whose transfer the origin cut, so that it resumes from
+// its partial file, or fails it once it was resumed PREMATURE_EOF_RESUMES times. Its lock must
+// be released, so that the worker picking it up does not take it for a duplicate.
+func (w *worker) resumeShortDownload(ctx context.Context, downloadID int64, cause error) error {
+	resumed, err := w.repo.ResumeDownloadRequest(ctx, downloadID, w.cfg.PrematureEOFResumes)
+	if err == nil && !resumed {
+		err = fmt.Errorf("%v, %d resumes exhausted", cause, w.cfg.PrematureEOFResumes)
+	}
+	if err != nil {
+		dbErr := w.repo.MarkError(ctx, downloadID, err.Error())
+		if dbErr != nil {
+			log.Println(dbErr)
+		}
+		return fmt.Errorf("Failed to resume download request %d: %v", downloadID, err)
+	}
+
+	metrics.Add("downloader_premature_eof_resumes_total", nil, 1)
+	log.Printf("Worker %d: download request %d: requeued to resume: %v\n", w.id, downloadID, cause)
+	return fmt.Errorf("Download request %d requeued to resume: %v", downloadID, cause)
+}
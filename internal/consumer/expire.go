@@ -0,0 +1,69 @@
+package consumer
+
+import (
+	"context"
+	"log"
+	"slices"
+	"time"
+
+	"example.com/internal/config"
+	"example.com/internal/repository"
+)
+
+const ExpirationSweepInterval = 1 * time.Minute
+
+// expireDownloadRequests periodically expires the queued requests past their TTL, so their
+// owners are notified even when no worker gets to pop them. Workers also check the TTL
+// right before starting a request.
+func expireDownloadRequests(ctx context.Context, repo repository.Repository, cfg *config.Config, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		expired, err := repo.ExpireDownloadRequests(ctx, 0)
+		if err != nil {
+			log.Printf("Could not expire download requests: %v", err)
+			continue
+		}
+		if len(expired) == 0 {
+			continue
+		}
+		downloadIDs := make([]int64, 0, len(expired))
+		owners := map[int64]bool{}
+		for downloadID, userID := range expired {
+			downloadIDs = append(downloadIDs, downloadID)
+			owners[userID] = true
+		}
+		slices.Sort(downloadIDs)
+		log.Printf("Expired %d download requests: %v\n", len(downloadIDs), downloadIDs)
+		for userID := range owners {
+			invalidateDownloadList(ctx, repo, cfg, userID)
+		}
+	}
+}
+
+const QueueEventsPurgeInterval = 1 * time.Hour
+
+// purgeQueueEvents periodically deletes the queue events older than retention.
+func purgeQueueEvents(ctx context.Context, repo repository.Repository, retention time.Duration) {
+	ticker := time.NewTicker(QueueEventsPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := repo.PurgeQueueEvents(ctx, retention); err != nil {
+			log.Println(err)
+		}
+	}
+}
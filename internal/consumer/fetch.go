@@ -0,0 +1,153 @@
+package consumer
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/internal/httpclient"
+	"example.com/internal/metrics"
+)
+
+const (
+	ProtocolHTTP3 = "h3"
+	ProtocolHTTP2 = "h2"
+)
+
+func init() {
+	metrics.Register("downloader_transfer_bytes_total", metrics.KindCounter, "Bytes received from origins per protocol.")
+	metrics.Register("downloader_transfer_seconds_total", metrics.KindCounter, "Time spent receiving from origins per protocol.")
+}
+
+// fetcher sends download requests over HTTP/2 (falling back to HTTP/1.1) and, when enabled,
+// over HTTP/3 for origins that advertised it through Alt-Svc. The negotiated protocol is
+// cached per origin; an origin that fails over HTTP/3 is not tried again with it.
+type fetcher struct {
+	client   *http.Client
+	h3Client *http.Client                 // nil unless HTTP/3 is enabled
+	sources  map[string]http.RoundTripper // scheme -> transport for links that are not HTTP
+	stream   http.RoundTripper            // HLS/DASH playlists
+
+	mu         sync.Mutex
+	protocols  map[string]string       // origin -> preferred protocol
+	congestion map[string]*http.Client // TCP congestion control algorithm -> client with a pool of its own
+	_          struct{}
+}
+
+func newFetcher(client *http.Client, enableHTTP3 bool, sources map[string]http.RoundTripper, stream http.RoundTripper) *fetcher {
+	f := &fetcher{
+		client:     client,
+		sources:    sources,
+		stream:     stream,
+		protocols:  make(map[string]string),
+		congestion: make(map[string]*http.Client),
+	}
+	if enableHTTP3 {
+		f.h3Client = newHTTP3Client()
+	}
+	return f
+}
+
+func (f *fetcher) do(req *http.Request) (*http.Response, error) {
+	if source, ok := f.sources[req.URL.Scheme]; ok {
+		return source.RoundTrip(req)
+	}
+	if isPlaylistLink(req.URL) {
+		return f.stream.RoundTrip(req)
+	}
+
+	resp, err := f.doHTTP(req)
+	if err != nil {
+		return nil, err
+	}
+	if isPlaylistType(resp.Header.Get("Content-Type")) {
+		// a playlist behind a link that does not look like one
+		resp.Body.Close()
+		return f.stream.RoundTrip(req)
+	}
+	return resp, nil
+}
+
+func (f *fetcher) doHTTP(req *http.Request) (*http.Response, error) {
+	origin := req.URL.Scheme + "://" + req.URL.Host
+
+	// QUIC does not go through proxies.
+	direct := httpclient.Proxy(req.Context()) == nil
+	if f.h3Client != nil && direct && f.protocol(origin) == ProtocolHTTP3 {
+		resp, err := f.h3Client.Do(req)
+		if err == nil {
+			return resp, nil
+		}
+		log.Printf("HTTP/3 request to %s failed, falling back: %v", origin, err)
+		f.setProtocol(origin, ProtocolHTTP2)
+	}
+
+	resp, err := f.httpClient(req).Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.h3Client != nil && direct && f.protocol(origin) == "" {
+		protocol := ProtocolHTTP2
+		if advertisesHTTP3(resp.Header.Get("Alt-Svc")) {
+			protocol = ProtocolHTTP3
+		}
+		f.setProtocol(origin, protocol)
+	}
+
+	return resp, nil
+}
+
+// httpClient returns the client of the request. The connections of requests asking for a
+// congestion control algorithm are pooled apart, so that other downloads do not reuse them.
+func (f *fetcher) httpClient(req *http.Request) *http.Client {
+	algorithm := httpclient.Congestion(req.Context())
+	if algorithm == "" {
+		return f.client
+	}
+	transport, ok := f.client.Transport.(*http.Transport)
+	if !ok {
+		return f.client
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	client, ok := f.congestion[algorithm]
+	if !ok {
+		clone := *f.client
+		clone.Transport = transport.Clone()
+		client = &clone
+		f.congestion[algorithm] = client
+	}
+	return client
+}
+
+func (f *fetcher) protocol(origin string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.protocols[origin]
+}
+
+func (f *fetcher) setProtocol(origin string, protocol string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.protocols[origin] = protocol
+}
+
+// observeTransfer records the throughput of a finished (or interrupted) transfer.
+func observeTransfer(resp *http.Response, bytes int64, elapsed time.Duration) {
+	labels := metrics.Labels{"protocol": resp.Proto}
+	metrics.Add("downloader_transfer_bytes_total", labels, float64(bytes))
+	metrics.Add("downloader_transfer_seconds_total", labels, elapsed.Seconds())
+}
+
+func advertisesHTTP3(altSvc string) bool {
+	for _, service := range strings.Split(altSvc, ",") {
+		if strings.HasPrefix(strings.TrimSpace(service), ProtocolHTTP3+"=") {
+			return true
+		}
+	}
+	return false
+}
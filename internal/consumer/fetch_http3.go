@@ -0,0 +1,16 @@
+//go:build http3
+
+package consumer
+
+import (
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// HTTP3Compiled tells whether HTTP/3 is compiled in.
+const HTTP3Compiled = true
+
+func newHTTP3Client() *http.Client {
+	return &http.Client{Transport: &http3.RoundTripper{}}
+}
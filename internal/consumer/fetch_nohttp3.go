@@ -0,0 +1,16 @@
+//go:build !http3
+
+package consumer
+
+import (
+	"log"
+	"net/http"
+)
+
+// HTTP3Compiled tells whether HTTP/3 is compiled in.
+const HTTP3Compiled = false
+
+func newHTTP3Client() *http.Client {
+	log.Println("HTTP/3 is not compiled in (build with -tags http3), using HTTP/2 only")
+	return nil
+}
@@ -0,0 +1,124 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"example.com/internal/config"
+	"example.com/internal/metrics"
+	"example.com/internal/repository"
+	"example.com/internal/safepath"
+)
+
+const PartialFileGCBatchSize = 100
+
+func init() {
+	metrics.Register("downloader_partial_files_collected_total", metrics.KindCounter, "Partial files of failed downloads deleted or archived.")
+	metrics.Register("downloader_partial_bytes_collected_total", metrics.KindCounter, "Bytes of the collected partial files.")
+}
+
+// collectPartialFiles periodically deletes (or archives) the partial files of the downloads
+// that failed more than PARTIAL_FILE_MAX_AGE ago and gives their bytes back to the owners' quota.
+func collectPartialFiles(ctx context.Context, repo repository.Repository, cfg *config.Config) {
+	ticker := time.NewTicker(cfg.PartialFileGCInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for {
+			downloads, err := repo.GetStalePartialDownloads(ctx, cfg.PartialFileMaxAge, PartialFileGCBatchSize)
+			if err != nil {
+				log.Printf("Could not collect partial files: %v", err)
+				break
+			}
+
+			collected := 0
+			for _, download := range downloads {
+				if err := collectPartialFile(ctx, repo, cfg, download.ID, download.UserID, download.FileName); err != nil {
+					log.Printf("Could not collect partial file of download request %d: %v", download.ID, err)
+					continue
+				}
+				collected++
+			}
+			if len(downloads) < PartialFileGCBatchSize || collected == 0 {
+				break
+			}
+		}
+	}
+}
+
+// collectPartialFile holds the lock of the download while removing its file, so a worker
+// cannot pick it up again (e.g. after a retry) in the meantime.
+func collectPartialFile(ctx context.Context, repo repository.Repository, cfg *config.Config, downloadID int64, userID int64, fileName string) error {
+	token := newLockToken()
+	acquired, err := repo.AcquireLock(ctx, downloadID, token, LinkProcessingExpTime)
+	if err != nil {
+		return err
+	}
+	if !acquired {
+		return errors.New("download request is being processed")
+	}
+	defer repo.ReleaseLock(ctx, downloadID, token)
+
+	download, err := repo.GetDownloadRequest(ctx, downloadID)
+	if err != nil {
+		return err
+	}
+	if download.Status != repository.StatusFailed {
+		return nil // retried since it was listed
+	}
+
+	// The file of a download that failed once complete, e.g. quarantined, has its final name.
+	path := partialFileName(fileName)
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		path = fileName
+		info, err = os.Stat(path)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return repo.MarkFilePurged(ctx, downloadID)
+	}
+	if err != nil {
+		return err
+	}
+
+	if cfg.PartialFileArchiveDir != "" {
+		if err := os.MkdirAll(cfg.PartialFileArchiveDir, 0755); err != nil {
+			return err
+		}
+		archived := filepath.Join(cfg.PartialFileArchiveDir, safepath.Name(fmt.Sprintf("%d-%s", downloadID, filepath.Base(fileName))))
+		if err := os.Rename(path, archived); err != nil {
+			return err
+		}
+	} else if err := os.Remove(path); err != nil {
+		return err
+	}
+	if download.ContentHash != "" {
+		releaseContent(ctx, repo, cfg, download.ContentHash)
+		if err := repo.SetContentHash(ctx, downloadID, ""); err != nil {
+			log.Println(err)
+		}
+	}
+
+	if _, err := repo.AddUserUsage(ctx, userID, -info.Size()); err != nil {
+		log.Println(err)
+	}
+	if err := repo.MarkFilePurged(ctx, downloadID); err != nil {
+		return err
+	}
+
+	metrics.Add("downloader_partial_files_collected_total", nil, 1)
+	metrics.Add("downloader_partial_bytes_collected_total", nil, float64(info.Size()))
+	log.Printf("Collected partial file of download request %d: %d bytes\n", downloadID, info.Size())
+	return nil
+}
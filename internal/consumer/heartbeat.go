@@ -0,0 +1,107 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"example.com/internal/config"
+	"example.com/internal/repository"
+	"example.com/internal/version"
+)
+
+// WorkerHeartbeatTTLIntervals is how many intervals a heartbeat outlives its process.
+const WorkerHeartbeatTTLIntervals = 3
+
+// sendInstanceHeartbeats keeps the process alive for the affinity of the downloads whose
+// partial file is on its disk: their resumes are queued for it until the heartbeat expires.
+func sendInstanceHeartbeats(ctx context.Context, repo repository.Repository, instanceID string, ttl time.Duration) {
+	ticker := time.NewTicker(ttl / WorkerHeartbeatTTLIntervals)
+	defer ticker.Stop()
+
+	for {
+		if err := repo.SetInstanceHeartbeat(ctx, instanceID, ttl); err != nil {
+			log.Println(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// SendProcessHeartbeats reports the process, with its mode and how many workers it runs, every
+// interval, so that the admin endpoints of any process list all of them whatever their mode.
+// c is nil in a process without workers.
+func SendProcessHeartbeats(ctx context.Context, repo repository.Repository, cfg *config.Config, c Consumer, interval time.Duration) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		heartbeat := repository.ProcessHeartbeat{
+			InstanceID: cfg.InstanceID,
+			Hostname:   hostname,
+			Mode:       cfg.Mode,
+			Version:    version.Version,
+			StartedAt:  version.StartedAt.UTC(),
+			UpdatedAt:  time.Now(),
+		}
+		if c != nil {
+			heartbeat.Workers = len(c.Workers())
+		}
+		if err := repo.SetProcessHeartbeat(ctx, heartbeat, WorkerHeartbeatTTLIntervals*interval); err != nil {
+			log.Println(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendHeartbeats reports the state of the workers and the volumes of this process every
+// interval, so the admin endpoints of any process show those of all of them.
+func (c *consumer) sendHeartbeats(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		statuses := c.Workers()
+		heartbeats := make([]repository.WorkerHeartbeat, 0, len(statuses))
+		for _, status := range statuses {
+			heartbeats = append(heartbeats, repository.WorkerHeartbeat{
+				Worker:      fmt.Sprintf("%s/%d", c.hostname, status.ID),
+				InstanceID:  c.cfg.InstanceID,
+				State:       status.State,
+				DownloadID:  status.DownloadID,
+				Bytes:       status.Bytes,
+				BytesPerSec: status.BytesPerSec,
+				Restarts:    status.Restarts,
+				UpdatedAt:   now,
+			})
+		}
+		if err := c.repo.SetWorkerHeartbeats(ctx, heartbeats, WorkerHeartbeatTTLIntervals*interval); err != nil {
+			log.Println(err)
+		}
+		if err := c.repo.SetVolumes(ctx, c.hostname, c.Volumes(), WorkerHeartbeatTTLIntervals*interval); err != nil {
+			log.Println(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
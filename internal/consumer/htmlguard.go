@@ -0,0 +1,98 @@
+package consumer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"example.com/internal/metrics"
+	"example.com/internal/repository"
+)
+
+func init() {
+	metrics.Register("downloader_html_pages_total", metrics.KindCounter, "Downloads failed because the origin sent an HTML page instead of the file.")
+}
+
+// htmlSniffLen is how much of a response is read ahead to tell an HTML page from the file.
+const htmlSniffLen = 512
+
+// htmlExtensions are those of the links whose file is an HTML page, which the guard leaves alone.
+var htmlExtensions = map[string]bool{".html": true, ".htm": true, ".xhtml": true, ".shtml": true}
+
+// htmlResponse reports whether a response is an HTML page, by its Content-Type or, for the
+// origins sending files as application/octet-stream or without one, by its first bytes. The
+// body is read ahead, so it replaces resp.Body. The first bytes of a compressed response are
+// not sniffed.
+func htmlResponse(resp *http.Response, decoding string) bool {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err == nil && (mediaType == "text/html" || mediaType == "application/xhtml+xml") {
+		return true
+	}
+	if decoding != "" {
+		return false
+	}
+
+	body := bufio.NewReaderSize(resp.Body, htmlSniffLen)
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{body, resp.Body}
+	head, _ := body.Peek(htmlSniffLen) // a read error shows up again when the body is read
+	return strings.HasPrefix(http.DetectContentType(head), "text/html")
+}
+
+// isHTMLLink reports whether the link names an HTML page, e.g. https://example.com/index.html.
+func isHTMLLink(link string) bool {
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	return htmlExtensions[strings.ToLower(path.Ext(u.Path))]
+}
+
+// expectedSize returns the size of the file found by an earlier attempt of the download, -1 if
+// unknown. It must be called before the attempt reports its own progress.
+func (w *worker) expectedSize(ctx context.Context, downloadID int64) int64 {
+	progress, found, err := w.repo.GetProgress(ctx, downloadID)
+	if err != nil {
+		log.Println(err)
+	}
+	if err != nil || !found || progress.TotalBytes <= 0 {
+		return -1
+	}
+	return progress.TotalBytes
+}
+
+// isHTMLPage reports whether an HTML response of size bytes is an error page rather than the
+// file: it is no larger than HTML_GUARD_MAX_BYTES, or smaller than the expected size of the file.
+func (w *worker) isHTMLPage(size int64, expected int64) bool {
+	return size <= w.cfg.HTMLGuardMaxBytes || expected > 0 && size < expected
+}
+
+// rejectHTMLPage fails a download whose origin sent an HTML page of size bytes instead of the
+// file, and drops the written bytes of the page.
+func (w *worker) rejectHTMLPage(ctx context.Context, downloadID int64, userID int64, file *os.File, written int64, size int64) error {
+	if written > 0 {
+		if err := file.Truncate(0); err != nil {
+			log.Println(err)
+		} else if _, err := w.repo.AddUserUsage(ctx, userID, -written); err != nil {
+			log.Println(err)
+		}
+	}
+	metrics.Add("downloader_html_pages_total", nil, 1)
+
+	err := fmt.Errorf("The origin sent an HTML page of %d bytes instead of the file, e.g. an error, login or captcha page", size)
+	dbErr := w.repo.MarkErrorCode(ctx, downloadID, repository.ErrorCodeHTMLPage, err.Error())
+	if dbErr != nil {
+		log.Println(dbErr)
+	}
+	return err
+}
@@ -0,0 +1,64 @@
+package consumer
+
+import (
+	"sync"
+	"time"
+
+	"example.com/internal/config"
+)
+
+// LabelDeferDelay is how long a worker waits after handing back a download it may not
+// process, so a queue holding only such downloads is not spun through.
+const LabelDeferDelay = 500 * time.Millisecond
+
+// labelScheduler applies the label rules of this process: the selector restricting the
+// downloads it processes and the caps on the downloads of a label processed at the same time.
+type labelScheduler struct {
+	mu       sync.Mutex
+	selector map[string]string
+	rules    []config.LabelRule
+	active   []int64 // per rule
+	_        struct{}
+}
+
+func newLabelScheduler(selector map[string]string, rules []config.LabelRule) *labelScheduler {
+	return &labelScheduler{
+		selector: selector,
+		rules:    rules,
+		active:   make([]int64, len(rules)),
+	}
+}
+
+// admit reports whether a download with the given labels may be processed now. If so,
+// release must be called once it is done.
+func (s *labelScheduler) admit(labels map[string]string) (release func(), ok bool) {
+	for k, v := range s.selector {
+		if value, found := labels[k]; !found || value != v {
+			return nil, false
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var matched []int
+	for i, rule := range s.rules {
+		if value, found := labels[rule.Key]; found && value == rule.Value {
+			if s.active[i] >= rule.Limit {
+				return nil, false
+			}
+			matched = append(matched, i)
+		}
+	}
+	for _, i := range matched {
+		s.active[i]++
+	}
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, i := range matched {
+			s.active[i]--
+		}
+	}, true
+}
@@ -0,0 +1,63 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"strings"
+)
+
+// checkContentType validates the media type of the response against the configured
+// allow/block lists. Entries may be exact ("image/png") or wildcards ("video/*").
+func (w *worker) checkContentType(contentType string) error {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(contentType))
+	}
+
+	if matchContentType(w.cfg.BlockedContentTypes, mediaType) {
+		return fmt.Errorf("Content type %q is blocked", mediaType)
+	}
+	if len(w.cfg.AllowedContentTypes) > 0 && !matchContentType(w.cfg.AllowedContentTypes, mediaType) {
+		return fmt.Errorf("Content type %q is not allowed", mediaType)
+	}
+
+	return nil
+}
+
+// checkSize validates that a download of the given size fits the configured limit.
+func (w *worker) checkSize(size int64) error {
+	if w.cfg.MaxDownloadBytes > 0 && size > w.cfg.MaxDownloadBytes {
+		return fmt.Errorf("Download size %d bytes exceeds the limit of %d bytes", size, w.cfg.MaxDownloadBytes)
+	}
+
+	return nil
+}
+
+// accountUsage charges the flushed bytes to the user and reports an error once the
+// user's storage quota is exceeded.
+func (w *worker) accountUsage(ctx context.Context, userID int64, bytes int64) error {
+	storedBytes, err := w.repo.AddUserUsage(ctx, userID, bytes)
+	if err != nil {
+		return err
+	}
+	if w.cfg.UserQuotaBytes > 0 && storedBytes > w.cfg.UserQuotaBytes {
+		return fmt.Errorf("Storage quota of %d bytes exceeded", w.cfg.UserQuotaBytes)
+	}
+
+	return nil
+}
+
+func matchContentType(patterns []string, mediaType string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == mediaType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,278 @@
+package consumer
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"example.com/internal/repository"
+)
+
+// MaxManifestBytes bounds the checksum manifests read into memory.
+const MaxManifestBytes = 4 << 20 // 4MB
+
+// checksumStrength orders the algorithms: the strongest listed for a file is verified.
+var checksumStrength = map[string]int{"sha1": 1, "sha256": 2, "sha384": 3, "sha512": 4}
+
+// bsdChecksumLine matches the lines of BSD style checksum files, e.g. "SHA256 (file.iso) = <hex>".
+var bsdChecksumLine = regexp.MustCompile(`^([A-Za-z0-9-]+) \((.+)\) = ([0-9A-Fa-f]+)$`)
+
+// manifestEntry is the checksum of a file listed in a manifest.
+type manifestEntry struct {
+	algorithm string
+	sum       []byte
+}
+
+// ManifestEntryName is the name the file of link is looked up by in its manifest: the last
+// segment of its path. It is empty if the path has none.
+func ManifestEntryName(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		return ""
+	}
+	return name
+}
+
+// verifyManifest checks the downloaded file against its entry in the manifest of the download
+// and records the outcome. Only a mismatch (or failing to read the file) is an error: a
+// manifest that cannot be fetched or does not list the file leaves the download unverified.
+func (w *worker) verifyManifest(ctx context.Context, downloadID int64, link string, manifestURL string, fileName string) error {
+	record := func(verification string, detail string) {
+		if err := w.repo.SetVerification(ctx, downloadID, verification, detail); err != nil {
+			log.Println(err)
+		}
+	}
+
+	name := ManifestEntryName(link)
+	entries, err := w.fetchManifest(ctx, manifestURL)
+	if err != nil {
+		record(repository.VerificationUnverified, fmt.Sprintf("could not read manifest: %v", err))
+		return nil
+	}
+	entry, ok := entries[name]
+	if !ok {
+		record(repository.VerificationUnverified, fmt.Sprintf("manifest has no entry for %s", name))
+		return nil
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	h := newChecksum(entry.algorithm)
+	if _, err := io.Copy(h, file); err != nil {
+		return fmt.Errorf("could not hash %s: %v", fileName, err)
+	}
+
+	if sum := h.Sum(nil); !bytes.Equal(sum, entry.sum) {
+		detail := fmt.Sprintf("%s of %s is %x, the manifest lists %x", entry.algorithm, name, sum, entry.sum)
+		record(repository.VerificationMismatch, detail)
+		return fmt.Errorf("Checksum mismatch: %s", detail)
+	}
+	record(repository.VerificationVerified, fmt.Sprintf("%s of %s matches the manifest", entry.algorithm, name))
+	return nil
+}
+
+func (w *worker) fetchManifest(ctx context.Context, manifestURL string) (map[string]manifestEntry, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := w.fetcher.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status code %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MaxManifestBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxManifestBytes {
+		return nil, fmt.Errorf("manifest is larger than %d bytes", MaxManifestBytes)
+	}
+	return parseManifest(data)
+}
+
+// parseManifest reads the checksums of a manifest by file name. It may be:
+//   - a checksum file like SHA256SUMS, in GNU ("<hex>  <name>") or BSD ("SHA256 (<name>) = <hex>")
+//     style, possibly clearsigned;
+//   - checksum JSON: an object mapping names to digests, or a list of objects with a name and
+//     their digests, alone or under "files";
+//   - SLSA provenance: in-toto statements, plain or in DSSE envelopes, one per line in .intoto.jsonl
+//     files. The signatures are not verified.
+//
+// Digests are hex, optionally prefixed by their algorithm ("sha256:<hex>").
+func parseManifest(data []byte) (map[string]manifestEntry, error) {
+	entries := make(map[string]manifestEntry)
+
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && (data[0] == '{' || data[0] == '[') {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		for {
+			var doc any
+			err := decoder.Decode(&doc)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid JSON manifest: %v", err)
+			}
+			if err := addJSONEntries(entries, doc); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if m := bsdChecksumLine.FindStringSubmatch(line); m != nil {
+				addManifestEntry(entries, m[2], m[1], m[3])
+				continue
+			}
+			// Other lines, like comments or the armor of a clearsigned file, are skipped.
+			digest, name, ok := strings.Cut(line, " ")
+			if ok {
+				addManifestEntry(entries, strings.TrimPrefix(strings.TrimLeft(name, " \t"), "*"), "", digest)
+			}
+		}
+	}
+
+	if len(entries) == 0 {
+		return nil, errors.New("manifest lists no checksums")
+	}
+	return entries, nil
+}
+
+func addJSONEntries(entries map[string]manifestEntry, doc any) error {
+	switch doc := doc.(type) {
+	case []any:
+		for _, item := range doc {
+			if err := addJSONEntries(entries, item); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		if payload, ok := doc["payload"].(string); ok {
+			// a DSSE envelope around an in-toto statement
+			data, err := base64.StdEncoding.DecodeString(payload)
+			if err != nil {
+				return fmt.Errorf("invalid DSSE payload: %v", err)
+			}
+			var statement any
+			if err := json.Unmarshal(data, &statement); err != nil {
+				return fmt.Errorf("invalid DSSE payload: %v", err)
+			}
+			return addJSONEntries(entries, statement)
+		}
+		if envelope, ok := doc["dsseEnvelope"]; ok {
+			return addJSONEntries(entries, envelope) // a Sigstore bundle
+		}
+		if subjects, ok := doc["subject"]; ok {
+			return addJSONEntries(entries, subjects) // an in-toto statement
+		}
+		if files, ok := doc["files"]; ok {
+			return addJSONEntries(entries, files)
+		}
+
+		if name := jsonEntryName(doc); name != "" {
+			addJSONDigests(entries, name, doc)
+			return nil
+		}
+		// an object mapping names to digests
+		for name, value := range doc {
+			switch value := value.(type) {
+			case string:
+				addManifestEntry(entries, name, "", value)
+			case map[string]any:
+				addJSONDigests(entries, name, value)
+			}
+		}
+	}
+	return nil
+}
+
+// jsonEntryName returns the name of an object describing one file.
+func jsonEntryName(doc map[string]any) string {
+	for _, key := range []string{"name", "filename", "file", "path"} {
+		if name, ok := doc[key].(string); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// addJSONDigests adds the digests of an object describing one file: under the names of their
+// algorithms, or under "digest", "checksum" or "hash" as a map or an "<algorithm>:<hex>" string.
+func addJSONDigests(entries map[string]manifestEntry, name string, doc map[string]any) {
+	for key, value := range doc {
+		switch value := value.(type) {
+		case string:
+			switch key = strings.ToLower(key); key {
+			case "digest", "checksum", "hash":
+				addManifestEntry(entries, name, "", value)
+			default:
+				addManifestEntry(entries, name, key, value)
+			}
+		case map[string]any:
+			for algorithm, digest := range value {
+				if digest, ok := digest.(string); ok {
+					addManifestEntry(entries, name, algorithm, digest)
+				}
+			}
+		}
+	}
+}
+
+// addManifestEntry adds the checksum of a file, unless a stronger one is already listed. The
+// algorithm, if not given, comes from the prefix of the digest or else from its length.
+func addManifestEntry(entries map[string]manifestEntry, name string, algorithm string, digest string) {
+	if prefix, rest, ok := strings.Cut(digest, ":"); ok && algorithm == "" {
+		algorithm, digest = prefix, rest
+	}
+	sum, err := hex.DecodeString(strings.TrimSpace(digest))
+	if err != nil {
+		return
+	}
+	algorithm = strings.ReplaceAll(strings.ToLower(algorithm), "-", "")
+	if algorithm == "" {
+		switch len(sum) {
+		case 20:
+			algorithm = "sha1"
+		case 32:
+			algorithm = "sha256"
+		case 48:
+			algorithm = "sha384"
+		case 64:
+			algorithm = "sha512"
+		}
+	}
+	if checksumStrength[algorithm] == 0 || len(sum) != newChecksum(algorithm).Size() {
+		return
+	}
+
+	name = path.Base(strings.TrimSpace(name))
+	if existing, ok := entries[name]; ok && checksumStrength[existing.algorithm] >= checksumStrength[algorithm] {
+		return
+	}
+	entries[name] = manifestEntry{algorithm: algorithm, sum: sum}
+}
@@ -0,0 +1,162 @@
+package consumer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/internal/repository"
+	"example.com/internal/safepath"
+)
+
+// MetadataTimeout bounds the extraction of the metadata of a completed file, ffprobe included.
+const MetadataTimeout = 30 * time.Second
+
+// MetadataMaxPDFBytes is the size of the largest PDF whose pages are counted.
+const MetadataMaxPDFBytes = 64 << 20
+
+// recordMetadata records the metadata of the completed file of the download. It is best effort:
+// what can not be found out is left out.
+func (w *worker) recordMetadata(ctx context.Context, downloadID int64, link string, fileName string) {
+	ctx, cancel := context.WithTimeout(ctx, MetadataTimeout)
+	defer cancel()
+
+	metadata, err := extractMetadata(ctx, link, fileName)
+	if err != nil {
+		log.Printf("Worker %d: download request %d: could not extract metadata: %v\n", w.id, downloadID, err)
+		return
+	}
+	if err := w.repo.SetMetadata(ctx, downloadID, metadata); err != nil {
+		log.Println(err)
+	}
+}
+
+// extractMetadata sniffs the type of the file from its first bytes, falling back to the
+// extension of the link for the types that are not sniffed, and adds what is known for the
+// type: the dimensions of images, the duration and dimensions of audio and videos with ffprobe
+// when it is on the PATH, and the pages of PDFs.
+func extractMetadata(ctx context.Context, link string, fileName string) (repository.Metadata, error) {
+	f, err := os.Open(safepath.Long(fileName))
+	if err != nil {
+		return repository.Metadata{}, err
+	}
+	defer f.Close()
+
+	header := make([]byte, 512)
+	n, err := io.ReadFull(f, header)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return repository.Metadata{}, err
+	}
+	metadata := repository.Metadata{ContentType: http.DetectContentType(header[:n])}
+	if metadata.ContentType == "application/octet-stream" {
+		if contentType := mime.TypeByExtension(path.Ext(ManifestEntryName(link))); contentType != "" {
+			metadata.ContentType = contentType
+		}
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(metadata.ContentType)
+	switch {
+	case strings.HasPrefix(mediaType, "image/"):
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return metadata, nil
+		}
+		if config, _, err := image.DecodeConfig(f); err == nil {
+			metadata.Width, metadata.Height = config.Width, config.Height
+		}
+	case strings.HasPrefix(mediaType, "video/") || strings.HasPrefix(mediaType, "audio/") || mediaType == "application/ogg":
+		if err := probeMedia(ctx, fileName, &metadata); err != nil && !errors.Is(err, exec.ErrNotFound) {
+			log.Printf("Could not probe %s: %v\n", fileName, err)
+		}
+	case mediaType == "application/pdf":
+		if info, err := f.Stat(); err != nil || info.Size() > MetadataMaxPDFBytes {
+			return metadata, nil
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return metadata, nil
+		}
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return metadata, nil
+		}
+		metadata.Pages = countPDFPages(data)
+	}
+	return metadata, nil
+}
+
+// probeMedia sets the duration of an audio or video file, and the dimensions of its first
+// video stream, as ffprobe reads them.
+func probeMedia(ctx context.Context, fileName string, metadata *repository.Metadata) error {
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-show_entries", "format=duration:stream=codec_type,width,height", "-of", "json", fileName)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("ffprobe failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var probe struct {
+		Streams []struct {
+			CodecType string `json:"codec_type"`
+			Width     int    `json:"width"`
+			Height    int    `json:"height"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"` // seconds, "N/A" if unknown
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return fmt.Errorf("could not decode ffprobe output: %v", err)
+	}
+	if duration, err := strconv.ParseFloat(probe.Format.Duration, 64); err == nil {
+		metadata.DurationSeconds = duration
+	}
+	for _, stream := range probe.Streams {
+		if stream.CodecType == "video" && stream.Width > 0 {
+			metadata.Width, metadata.Height = stream.Width, stream.Height
+			break
+		}
+	}
+	return nil
+}
+
+var (
+	pdfPagesCount = regexp.MustCompile(`/Type\s*/Pages\b[^>]*?/Count\s+(\d+)|/Count\s+(\d+)[^>]*?/Type\s*/Pages\b`)
+	pdfPage       = regexp.MustCompile(`/Type\s*/Page\b`)
+)
+
+// countPDFPages returns the page count of the root of the page tree, the largest of the page
+// tree nodes, or else the page objects. It is 0 when the page tree is only in compressed
+// object streams.
+func countPDFPages(data []byte) int {
+	pages := 0
+	for _, match := range pdfPagesCount.FindAllSubmatch(data, -1) {
+		count := match[1]
+		if count == nil {
+			count = match[2]
+		}
+		if n, err := strconv.Atoi(string(count)); err == nil && n > pages {
+			pages = n
+		}
+	}
+	if pages == 0 {
+		pages = len(pdfPage.FindAllIndex(data, -1))
+	}
+	return pages
+}
@@ -0,0 +1,196 @@
+package consumer
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// failover answers the request of the primary link with the first of its mirrors that serves
+// the file if the primary did not (resp and err are its outcome), and lets the response fail
+// over to the next mirrors while it is read: when reading fails, or when the source is slower
+// than minSpeed over window. Mid-stream, a mirror continues at the current byte with a range
+// request and is skipped if it does not honor it. The private headers of req are only sent to
+// the mirrors on its host, see mirrorRequest.
+func (f *fetcher) failover(req *http.Request, resp *http.Response, err error, mirrors []string, private []string, minSpeed int64, window time.Duration) (*http.Response, error) {
+	link := req.URL.String()
+	for len(mirrors) > 0 && (err != nil || (resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent)) {
+		cause := err
+		if err == nil {
+			resp.Body.Close()
+			cause = fmt.Errorf("HTTP status code %d", resp.StatusCode)
+		}
+		log.Printf("Failing over from %s to %s: %v", link, mirrors[0], cause)
+
+		link, mirrors = mirrors[0], mirrors[1:]
+		mirrorReq, reqErr := mirrorRequest(req, link, req.Header.Get("Range"), private)
+		if reqErr != nil {
+			err = reqErr
+			continue
+		}
+		resp, err = f.do(mirrorReq)
+	}
+	if err != nil || len(mirrors) == 0 {
+		return resp, err
+	}
+
+	body := &mirrorBody{
+		f:           f,
+		req:         req,
+		body:        resp.Body,
+		link:        link,
+		mirrors:     mirrors,
+		private:     private,
+		size:        resp.ContentLength,
+		last:        -1,
+		minSpeed:    minSpeed,
+		window:      window,
+		windowStart: time.Now(),
+	}
+	if resp.StatusCode == http.StatusPartialContent {
+		start, _, size, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok {
+			return resp, nil // where to continue is not known
+		}
+		body.start, body.size = start, size
+	}
+	if _, last, ok := strings.Cut(req.Header.Get("Range"), "-"); ok && last != "" {
+		body.last, _ = strconv.ParseInt(last, 10, 64)
+	}
+	resp.Body = body
+	return resp, nil
+}
+
+// mirrorRequest clones the request of the primary link for a mirror. The Authorization and
+// Cookie headers belong to the origin of the primary link, as do the private ones (the headers
+// set by the user, e.g. an API key), so they are only kept for mirrors on the same host.
+func mirrorRequest(req *http.Request, link string, byteRange string, private []string) (*http.Request, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+
+	mirrorReq := req.Clone(req.Context())
+	mirrorReq.URL = u
+	mirrorReq.Host = ""
+	if u.Host != req.URL.Host {
+		mirrorReq.Header.Del("Authorization")
+		mirrorReq.Header.Del("Cookie")
+		for _, name := range private {
+			mirrorReq.Header.Del(name)
+		}
+		if mirrorReq.Header.Get("User-Agent") == "" {
+			mirrorReq.Header.Set("User-Agent", UserAgent) // the user's own was private
+		}
+	}
+	if byteRange != "" {
+		mirrorReq.Header.Set("Range", byteRange)
+	}
+	return mirrorReq, nil
+}
+
+// mirrorBody is the body of a response that fails over to the next mirror while it is read.
+type mirrorBody struct {
+	f       *fetcher
+	req     *http.Request // of the primary link
+	body    io.ReadCloser
+	link    string   // the source being read
+	mirrors []string // the sources left to fail over to
+	private []string // headers of req not sent to the other hosts
+	start   int64    // first byte of the response within the file
+	last    int64    // last byte requested, -1 for up to the end of the file
+	size    int64    // of the file, -1 if unknown
+	read    int64
+
+	minSpeed    int64
+	window      time.Duration
+	windowStart time.Time
+	windowBytes int64
+	windowTime  time.Duration // spent in reads of the source, so that throttling is not held against it
+	_           struct{}
+}
+
+func (b *mirrorBody) Read(p []byte) (int, error) {
+	begin := time.Now()
+	n, err := b.body.Read(p)
+	b.read += int64(n)
+	b.windowBytes += int64(n)
+	b.windowTime += time.Since(begin)
+
+	if err != nil && err != io.EOF && b.req.Context().Err() == nil {
+		if failoverErr := b.next(err); failoverErr != nil {
+			return n, failoverErr
+		}
+		return n, nil
+	}
+	if err == nil && b.slow() {
+		if failoverErr := b.next(fmt.Errorf("slower than %d bytes/s", b.minSpeed)); failoverErr != nil {
+			log.Println(failoverErr) // keep reading from the slow source
+		}
+	}
+	return n, err
+}
+
+func (b *mirrorBody) Close() error {
+	return b.body.Close()
+}
+
+// slow reports, once per window, whether the source sent less than minSpeed bytes per second
+// while it was read.
+func (b *mirrorBody) slow() bool {
+	if b.minSpeed <= 0 || len(b.mirrors) == 0 || time.Since(b.windowStart) < b.window {
+		return false
+	}
+
+	slow := float64(b.windowBytes) < float64(b.minSpeed)*b.windowTime.Seconds()
+	b.windowStart, b.windowBytes, b.windowTime = time.Now(), 0, 0
+	return slow
+}
+
+// next switches to the first of the mirrors left that continues at the current byte.
+func (b *mirrorBody) next(cause error) error {
+	for len(b.mirrors) > 0 {
+		link := b.mirrors[0]
+		b.mirrors = b.mirrors[1:]
+
+		resp, err := b.open(link)
+		if err != nil {
+			log.Printf("Could not fail over from %s to %s at byte %d: %v", b.link, link, b.start+b.read, err)
+			continue
+		}
+		log.Printf("Failing over from %s to %s at byte %d: %v", b.link, link, b.start+b.read, cause)
+		b.body.Close()
+		b.body, b.link = resp.Body, link
+		b.windowStart, b.windowBytes, b.windowTime = time.Now(), 0, 0
+		return nil
+	}
+	return fmt.Errorf("%v (no mirror left to fail over to)", cause)
+}
+
+// open requests the rest of the response from a mirror.
+func (b *mirrorBody) open(link string) (*http.Response, error) {
+	req, err := mirrorRequest(b.req, link, rangeHeader(b.start, b.last, b.read), b.private)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.f.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	start, _, size, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if resp.StatusCode != http.StatusPartialContent || !ok || start != b.start+b.read {
+		resp.Body.Close()
+		return nil, fmt.Errorf("the mirror answered the range with status code %d and Content-Range %q", resp.StatusCode, resp.Header.Get("Content-Range"))
+	}
+	if b.size >= 0 && size >= 0 && size != b.size {
+		resp.Body.Close()
+		return nil, fmt.Errorf("the file of the mirror is %d bytes instead of %d", size, b.size)
+	}
+	return resp, nil
+}
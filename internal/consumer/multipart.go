@@ -0,0 +1,374 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+
+	"example.com/internal/repository"
+	"example.com/internal/safepath"
+)
+
+// PartsStateSuffix is appended to the file name of a multi-part download for its state file.
+const PartsStateSuffix = ".parts"
+
+// partsState is kept next to the file of a multi-part download while its parts are written.
+// The file is preallocated, so after a crash its size says nothing about the progress: the
+// next attempt truncates it back to Offset instead.
+type partsState struct {
+	Offset int64 `json:"offset"` // the bytes before it are all synced
+	Stored int64 `json:"stored"` // bytes of the file charged to the user
+}
+
+// filePart is the bytes start..end-1 of a file, fetched over a connection of its own.
+type filePart struct {
+	start    int64
+	end      int64
+	received int64 // written to the file, only touched by the goroutine fetching the part
+	synced   int64 // guarded by multipartDownload.mu
+	charged  int64 // charged to the user, guarded by multipartDownload.mu
+}
+
+// multipartDownload writes the parts of a file fetched concurrently at their offsets.
+type multipartDownload struct {
+	w          *worker
+	downloadID int64
+	userID     int64
+	file       *os.File // opened without O_APPEND, for WriteAt
+	statePath  string
+	offset     int64 // bytes on disk before the parts, the first part starts there
+	size       int64
+	speed      *speedLimiter
+	tuning     *transferTuning
+
+	mu    sync.Mutex
+	parts []*filePart
+	_     struct{}
+}
+
+// multipartParts splits what is left of the file into parts fetched over that many separate
+// connections. It returns nil to fetch it over resp alone: fewer than 2 connections, the link
+// is not http(s) or a byte range of a file, the preflight found the origin serves no ranges or
+// another size, the origin did not answer with the rest of the file and its size, or too
+// little is left. preflight is nil if it was not sent or failed.
+func (w *worker) multipartParts(req *http.Request, resp *http.Response, preflight *repository.Preflight, byteRange string, offset int64, connections int64) []*filePart {
+	if connections < 2 || byteRange != "" {
+		return nil
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil
+	}
+	if resp.StatusCode != http.StatusPartialContent || resp.Uncompressed || resp.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	start, end, size, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if !ok || start != offset || size < 0 || end != size-1 || resp.ContentLength != size-offset {
+		return nil
+	}
+	if preflight != nil && (!preflight.AcceptRanges || preflight.Size >= 0 && preflight.Size != size) {
+		return nil
+	}
+	left := size - offset
+	if left < max(w.cfg.MultipartMinBytes, connections) {
+		return nil
+	}
+
+	parts := make([]*filePart, connections)
+	partSize := left / int64(len(parts))
+	for i := range parts {
+		parts[i] = &filePart{start: offset + int64(i)*partSize, end: offset + int64(i+1)*partSize}
+	}
+	parts[len(parts)-1].end = size
+	return parts
+}
+
+// fetchParts downloads the parts concurrently into the file, preallocated to size bytes: the
+// first one over resp, the others over range requests of their own. It returns the bytes kept.
+// On failure or shutdown the file is truncated to the bytes synced from its start on, so that
+// the download resumes from there.
+func (w *worker) fetchParts(ctx context.Context, req *http.Request, resp *http.Response, fileName string, downloadID int64, userID int64, offset int64, size int64, parts []*filePart, speed *speedLimiter, tuning *transferTuning) (int64, error) {
+	file, err := os.OpenFile(safepath.Long(fileName), os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	d := &multipartDownload{
+		w:          w,
+		downloadID: downloadID,
+		userID:     userID,
+		file:       file,
+		statePath:  fileName + PartsStateSuffix,
+		offset:     offset,
+		size:       size,
+		speed:      speed,
+		tuning:     tuning,
+		parts:      parts,
+	}
+	if err := d.saveState(); err != nil {
+		return 0, err
+	}
+	if err := file.Truncate(size); err != nil {
+		return 0, err
+	}
+
+	partsCtx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-ctx.Done(): // shutdown
+		case <-partsCtx.Done():
+		}
+		cancel()
+		resp.Body.Close() // interrupts the read of the first part
+	}()
+
+	errs := make(chan error, len(parts))
+	for i, part := range parts {
+		go func(i int, part *filePart) {
+			err := d.fetchPart(partsCtx, req, resp, i, part)
+			if err != nil {
+				cancel()
+			}
+			errs <- err
+		}(i, part)
+	}
+	var fetchErr error
+	for range parts {
+		// the parts canceled because another one failed report context.Canceled
+		if err := <-errs; err != nil && (fetchErr == nil || errors.Is(fetchErr, context.Canceled)) {
+			fetchErr = err
+		}
+	}
+
+	if fetchErr == nil {
+		fetchErr = d.checkLength()
+	}
+	if fetchErr != nil {
+		return d.truncate(ctx), fetchErr
+	}
+	if err := os.Remove(d.statePath); err != nil {
+		return size - offset, err
+	}
+	return size - offset, nil
+}
+
+// fetchPart copies the part from the origin to the file. What it wrote is synced and charged
+// to the user every flush threshold of the tuning and when it returns, also on failure.
+func (d *multipartDownload) fetchPart(ctx context.Context, req *http.Request, resp *http.Response, i int, part *filePart) (err error) {
+	defer func() {
+		if flushErr := d.flush(context.WithoutCancel(ctx), part); err == nil {
+			err = flushErr
+		}
+	}()
+
+	body := resp.Body
+	if i > 0 {
+		partReq := req.Clone(ctx)
+		partReq.Header.Set("Range", rangeHeader(part.start, part.end-1, 0))
+		partResp, err := d.w.fetcher.do(partReq)
+		if err != nil {
+			return err
+		}
+		partResp.Body = d.tuning.body(partResp.Body)
+		defer partResp.Body.Close()
+
+		start, end, size, ok := parseContentRange(partResp.Header.Get("Content-Range"))
+		if partResp.StatusCode != http.StatusPartialContent || !ok || start != part.start || end != part.end-1 || size != d.size {
+			return fmt.Errorf("Origin answered part %d-%d with status code %d and Content-Range %q", part.start, part.end-1, partResp.StatusCode, partResp.Header.Get("Content-Range"))
+		}
+		body = partResp.Body
+	}
+
+	buffer := make([]byte, d.tuning.chunkSize)
+	length := part.end - part.start
+	unflushed := int64(0)
+	for part.received < length {
+		allowed, err := d.speed.wait(ctx, int(min(int64(len(buffer)), length-part.received)))
+		if err != nil {
+			return err
+		}
+		allowed, err = d.w.bandwidth.wait(ctx, d.downloadID, allowed)
+		if err != nil {
+			return err
+		}
+		n, err := body.Read(buffer[:allowed])
+		d.w.bandwidth.giveBack(d.downloadID, allowed-n)
+		d.speed.giveBack(allowed - n)
+		if n > 0 {
+			if _, err := d.file.WriteAt(buffer[:n], part.start+part.received); err != nil {
+				return err
+			}
+			part.received += int64(n)
+			unflushed += int64(n)
+			d.w.state.addBytes(n)
+		}
+		if err == io.EOF && part.received < length {
+			return fmt.Errorf("Origin closed part %d-%d after %d bytes", part.start, part.end-1, part.received)
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		if unflushed >= d.tuning.flushThreshold {
+			if err := d.flush(ctx, part); err != nil {
+				return err
+			}
+			unflushed = 0
+		}
+	}
+
+	return nil
+}
+
+// flush syncs the file, charges the bytes the part received since the last flush to the user
+// and records the progress.
+func (d *multipartDownload) flush(ctx context.Context, part *filePart) error {
+	if err := d.file.Sync(); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.w.disk.consume(d.downloadID, part.received-part.synced)
+	part.synced = part.received
+	if err := d.w.disk.check(d.downloadID); err != nil {
+		return err
+	}
+	storedBytes, err := d.w.repo.AddUserUsage(ctx, d.userID, part.received-part.charged)
+	if err != nil {
+		return err
+	}
+	part.charged = part.received
+	if err := d.saveState(); err != nil {
+		return err
+	}
+
+	d.w.tracker.setOffset(d.downloadID, d.prefix())
+	synced := d.offset
+	for _, p := range d.parts {
+		synced += p.synced
+	}
+	d.w.reportProgress(ctx, d.downloadID, synced, d.size)
+
+	if d.w.cfg.UserQuotaBytes > 0 && storedBytes > d.w.cfg.UserQuotaBytes {
+		return fmt.Errorf("Storage quota of %d bytes exceeded", d.w.cfg.UserQuotaBytes)
+	}
+	return nil
+}
+
+// checkLength verifies that every part was received whole and the file has the size the
+// origin reported.
+func (d *multipartDownload) checkLength() error {
+	received := int64(0)
+	for _, part := range d.parts {
+		received += part.received
+	}
+	if received != d.size-d.offset {
+		return fmt.Errorf("Received %d bytes of the %d bytes left of the file", received, d.size-d.offset)
+	}
+
+	info, err := d.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != d.size {
+		return fmt.Errorf("File is %d bytes instead of %d", info.Size(), d.size)
+	}
+	return nil
+}
+
+// truncate cuts the file after the bytes synced from its start on, gives the bytes charged
+// for the rest back to the user and returns the bytes kept. Whatever fails is left to
+// recoverParts at the next attempt, through the state file.
+func (d *multipartDownload) truncate(ctx context.Context) int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	prefix := d.prefix()
+	if err := d.file.Truncate(prefix); err != nil {
+		log.Println(err)
+		d.w.tracker.setOffset(d.downloadID, d.offset)
+		return 0
+	}
+	charged := int64(0)
+	for _, part := range d.parts {
+		charged += part.charged
+	}
+	if _, err := d.w.repo.AddUserUsage(context.WithoutCancel(ctx), d.userID, prefix-d.offset-charged); err != nil {
+		log.Println(err)
+	} else if err := os.Remove(d.statePath); err != nil {
+		log.Println(err)
+	}
+	d.w.tracker.setOffset(d.downloadID, prefix)
+	return prefix - d.offset
+}
+
+// prefix returns the end of the bytes synced from the start of the file on. d.mu must be held.
+func (d *multipartDownload) prefix() int64 {
+	prefix := d.offset
+	for _, part := range d.parts {
+		prefix = part.start + part.synced
+		if part.synced < part.end-part.start {
+			break
+		}
+	}
+	return prefix
+}
+
+// saveState atomically writes the state file. d.mu must be held while the parts are fetched.
+func (d *multipartDownload) saveState() error {
+	state := partsState{Offset: d.prefix(), Stored: d.offset}
+	for _, part := range d.parts {
+		state.Stored += part.charged
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp := d.statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("could not write %s: %v", d.statePath, err)
+	}
+	if err := os.Rename(tmp, d.statePath); err != nil {
+		return fmt.Errorf("could not write %s: %v", d.statePath, err)
+	}
+	return nil
+}
+
+// recoverParts truncates the file of a multi-part download whose process crashed back to the
+// bytes synced from its start on, and gives the bytes charged for the rest back to the user.
+// It returns the offset to resume from.
+func (w *worker) recoverParts(ctx context.Context, file *os.File, userID int64, offset int64) (int64, error) {
+	statePath := file.Name() + PartsStateSuffix
+	data, err := os.ReadFile(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return offset, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var state partsState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return 0, fmt.Errorf("could not decode %s: %v", statePath, err)
+	}
+	if err := file.Truncate(state.Offset); err != nil {
+		return 0, err
+	}
+	if _, err := w.repo.AddUserUsage(ctx, userID, state.Offset-state.Stored); err != nil {
+		return 0, err
+	}
+	if err := os.Remove(statePath); err != nil {
+		return 0, err
+	}
+	return state.Offset, nil
+}
@@ -0,0 +1,160 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/internal/repository"
+)
+
+// OAuth2TokenRefreshMargin is how long before they expire the cached tokens are renewed,
+// so that a request does not go out with a token about to expire.
+const OAuth2TokenRefreshMargin = 1 * time.Minute
+
+// DefaultOAuth2TokenLifetime is how long tokens without an expires_in are cached.
+const DefaultOAuth2TokenLifetime = 5 * time.Minute
+
+type oauth2Token struct {
+	value     string
+	expiresAt time.Time
+}
+
+// originAuth authenticates the requests of the downloads that use an origin profile. The
+// tokens of the OAuth2 profiles are cached by profile and shared by the workers.
+type originAuth struct {
+	client *http.Client // guarded like the downloads, the token URLs are user supplied
+
+	mu     sync.Mutex
+	tokens map[int64]oauth2Token
+	_      struct{}
+}
+
+func newOriginAuth(client *http.Client) *originAuth {
+	return &originAuth{client: client, tokens: make(map[int64]oauth2Token)}
+}
+
+// openOriginProfile loads the profile of a download and decrypts its secret.
+func (w *worker) openOriginProfile(ctx context.Context, profileID int64) (repository.OriginProfile, repository.OriginSecret, error) {
+	var secret repository.OriginSecret
+
+	profile, found, err := w.repo.GetOriginProfile(ctx, profileID)
+	if err != nil {
+		return profile, secret, err
+	}
+	if !found {
+		return profile, secret, fmt.Errorf("Origin profile %d not found", profileID)
+	}
+
+	plaintext, err := w.box.Open(profile.Secret)
+	if err != nil {
+		return profile, secret, err
+	}
+	if err := json.Unmarshal(plaintext, &secret); err != nil {
+		return profile, secret, err
+	}
+	return profile, secret, nil
+}
+
+// linkHost returns the host name of a link in lower case for matching origin profiles. It is
+// empty if the link cannot be parsed or logs in with the user info in it.
+func linkHost(link string) string {
+	u, err := url.Parse(link)
+	if err != nil || u.User != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// authorize sets the Authorization header of an HTTP request to the origin.
+func (a *originAuth) authorize(req *http.Request, profile repository.OriginProfile, secret repository.OriginSecret) error {
+	switch profile.Kind {
+	case repository.OriginProfileBasic:
+		req.SetBasicAuth(secret.Username, secret.Password)
+	case repository.OriginProfileBearer:
+		req.Header.Set("Authorization", "Bearer "+secret.Token)
+	case repository.OriginProfileOAuth2:
+		token, err := a.token(req.Context(), profile.ID, secret)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	default:
+		return fmt.Errorf("Unknown origin profile kind %q", profile.Kind)
+	}
+	return nil
+}
+
+// invalidate drops the cached token of a profile, after the origin rejected it.
+func (a *originAuth) invalidate(profileID int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.tokens, profileID)
+}
+
+// token returns the cached token of an OAuth2 profile, or requests a new one with the
+// client credentials grant once it is about to expire.
+func (a *originAuth) token(ctx context.Context, profileID int64, secret repository.OriginSecret) (string, error) {
+	a.mu.Lock()
+	cached, ok := a.tokens[profileID]
+	a.mu.Unlock()
+	if ok && time.Until(cached.expiresAt) > OAuth2TokenRefreshMargin {
+		return cached.value, nil
+	}
+
+	// Outside the lock: workers may race to renew a token, which only costs a request.
+	token, err := a.requestToken(ctx, secret)
+	if err != nil {
+		return "", err
+	}
+
+	a.mu.Lock()
+	a.tokens[profileID] = token
+	a.mu.Unlock()
+	return token.value, nil
+}
+
+func (a *originAuth) requestToken(ctx context.Context, secret repository.OriginSecret) (oauth2Token, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(secret.Scopes) > 0 {
+		form.Set("scope", strings.Join(secret.Scopes, " "))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", secret.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return oauth2Token{}, fmt.Errorf("Could not request OAuth2 token: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(secret.ClientID), url.QueryEscape(secret.ClientSecret))
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return oauth2Token{}, fmt.Errorf("Could not request OAuth2 token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+		Error       string `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return oauth2Token{}, fmt.Errorf("Invalid OAuth2 token response: status %d: %v", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK || body.AccessToken == "" {
+		return oauth2Token{}, fmt.Errorf("OAuth2 token request failed: status %d: %s", resp.StatusCode, body.Error)
+	}
+
+	lifetime := DefaultOAuth2TokenLifetime
+	if body.ExpiresIn > 0 {
+		lifetime = time.Duration(body.ExpiresIn) * time.Second
+	}
+	return oauth2Token{value: body.AccessToken, expiresAt: time.Now().Add(lifetime)}, nil
+}
@@ -0,0 +1,220 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"example.com/internal/config"
+	"example.com/internal/metrics"
+	"example.com/internal/pipeline"
+	"example.com/internal/repository"
+	"example.com/internal/safepath"
+)
+
+// PipelineQueueSize bounds the completed downloads waiting for their pipeline. The pipelines of
+// downloads completed while it is full stay pending until the process restarts.
+const PipelineQueueSize = 1000
+
+func init() {
+	metrics.Register("downloader_pipeline_steps_total", metrics.KindCounter, "Pipeline steps run on completed downloads, by step and status.")
+	metrics.Register("downloader_pipelines_deferred_total", metrics.KindCounter, "Completed downloads whose pipeline was left pending because the pipeline queue was full.")
+	metrics.Register("downloader_infected_files_total", metrics.KindCounter, "Completed downloads failed because the virus scan found malware in their file.")
+}
+
+type pipelineJob struct {
+	downloadID int64
+	userID     int64
+	link       string
+	fileName   string
+}
+
+// pipelinePool runs the pipeline steps of completed downloads, at most PIPELINE_CONCURRENCY
+// downloads at a time, so that the workers move on to the next download instead of waiting
+// for them.
+type pipelinePool struct {
+	repo     repository.Repository
+	cfg      *config.Config
+	pipeline pipeline.Pipeline
+	jobs     chan pipelineJob
+	_        struct{}
+}
+
+func newPipelinePool(ctx context.Context, repo repository.Repository, cfg *config.Config, p pipeline.Pipeline) *pipelinePool {
+	pool := &pipelinePool{
+		repo:     repo,
+		cfg:      cfg,
+		pipeline: p,
+		jobs:     make(chan pipelineJob, PipelineQueueSize),
+	}
+	for i := int64(0); i < cfg.PipelineConcurrency; i++ {
+		go pool.run(ctx)
+	}
+	go pool.resume(ctx)
+	return pool
+}
+
+func (p *pipelinePool) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-p.jobs:
+			p.runPipeline(ctx, job)
+		}
+	}
+}
+
+// resume queues the pipelines left unfinished on the disk of this process when it stopped.
+func (p *pipelinePool) resume(ctx context.Context) {
+	downloads, err := p.repo.GetPendingPipelines(ctx, p.cfg.InstanceID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, download := range downloads {
+		log.Printf("Resuming pipeline of download request %d\n", download.ID)
+		p.submit(download.ID, download.UserID, download.Link, download.FileName)
+	}
+}
+
+// submit queues the pipeline of a completed download without waiting for it.
+func (p *pipelinePool) submit(downloadID int64, userID int64, link string, fileName string) {
+	select {
+	case p.jobs <- pipelineJob{downloadID: downloadID, userID: userID, link: link, fileName: fileName}:
+	default:
+		metrics.Add("downloader_pipelines_deferred_total", nil, 1)
+		log.Printf("Download request %d: pipeline deferred, %d downloads are waiting for theirs\n", downloadID, PipelineQueueSize)
+	}
+}
+
+// runPipeline runs the steps of the download left to run one after the other, and records
+// how each went. The first failing step skips the rest, a failing pipeline does not fail the
+// download.
+func (p *pipelinePool) runPipeline(ctx context.Context, job pipelineJob) {
+	steps, err := p.repo.GetPipelineSteps(ctx, job.downloadID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	file := pipeline.File{DownloadID: job.downloadID, UserID: job.userID, Link: job.link, Path: job.fileName}
+	for _, step := range steps {
+		if step.Status != repository.PipelineStepPending && step.Status != repository.PipelineStepRunning {
+			continue
+		}
+		run, found := p.pipeline.Step(step.Name)
+		if !found {
+			// PIPELINE_* changed since the download was requested.
+			p.finishStep(ctx, job.downloadID, step, repository.PipelineStepFailed, "", "the step is disabled")
+			p.skipRest(ctx, job.downloadID, step.Name)
+			return
+		}
+
+		if err := p.repo.StartPipelineStep(ctx, job.downloadID, step.Position); err != nil {
+			log.Println(err)
+			return
+		}
+		stepCtx, cancel := context.WithTimeout(ctx, p.cfg.PipelineStepTimeout)
+		result, err := run.Run(stepCtx, file)
+		timedOut := errors.Is(stepCtx.Err(), context.DeadlineExceeded)
+		cancel()
+		if ctx.Err() != nil {
+			// Stopping: the step stays running and is run again by the next process.
+			return
+		}
+
+		if result.Bytes > 0 {
+			if _, usageErr := p.repo.AddUserUsage(ctx, job.userID, result.Bytes); usageErr != nil {
+				log.Println(usageErr)
+			}
+		}
+		var infected *pipeline.InfectedError
+		switch {
+		case errors.As(err, &infected):
+			p.finishStep(ctx, job.downloadID, step, repository.PipelineStepFailed, result.Detail, err.Error())
+			p.skipRest(ctx, job.downloadID, step.Name)
+			p.quarantine(ctx, job, infected.Signature)
+			return
+		case errors.Is(err, pipeline.ErrNotApplicable):
+			p.finishStep(ctx, job.downloadID, step, repository.PipelineStepSkipped, "not applicable to this file", "")
+		case err != nil && timedOut:
+			p.finishStep(ctx, job.downloadID, step, repository.PipelineStepFailed, result.Detail, "timed out after "+p.cfg.PipelineStepTimeout.String())
+			p.skipRest(ctx, job.downloadID, step.Name)
+			return
+		case err != nil:
+			p.finishStep(ctx, job.downloadID, step, repository.PipelineStepFailed, result.Detail, err.Error())
+			p.skipRest(ctx, job.downloadID, step.Name)
+			return
+		default:
+			p.finishStep(ctx, job.downloadID, step, repository.PipelineStepSucceeded, result.Detail, "")
+		}
+	}
+}
+
+// quarantine fails a download whose file is infected with the signature, and moves its file to
+// QUARANTINE_DIR, if set. A file left in place is deleted with the partial files of failed
+// downloads.
+func (p *pipelinePool) quarantine(ctx context.Context, job pipelineJob, signature string) {
+	metrics.Add("downloader_infected_files_total", nil, 1)
+	log.Printf("Download request %d: malware found: %s\n", job.downloadID, signature)
+
+	quarantined, err := p.repo.QuarantineDownload(ctx, job.downloadID, "malware found: "+signature)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if !quarantined || p.cfg.QuarantineDir == "" {
+		return
+	}
+
+	if err := p.moveToQuarantine(ctx, job); err != nil {
+		log.Printf("Download request %d: could not move the infected file to quarantine: %v\n", job.downloadID, err)
+	}
+}
+
+func (p *pipelinePool) moveToQuarantine(ctx context.Context, job pipelineJob) error {
+	download, err := p.repo.GetDownloadRequest(ctx, job.downloadID)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(job.fileName)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(p.cfg.QuarantineDir, 0700); err != nil {
+		return err
+	}
+	quarantined := filepath.Join(p.cfg.QuarantineDir, safepath.Name(fmt.Sprintf("%d-%s", job.downloadID, filepath.Base(job.fileName))))
+	if err := os.Rename(job.fileName, quarantined); err != nil {
+		return err
+	}
+	if download.ContentHash != "" {
+		releaseContent(ctx, p.repo, p.cfg, download.ContentHash)
+		if err := p.repo.SetContentHash(ctx, job.downloadID, ""); err != nil {
+			log.Println(err)
+		}
+	}
+
+	if _, err := p.repo.AddUserUsage(ctx, job.userID, -info.Size()); err != nil {
+		log.Println(err)
+	}
+	return p.repo.MarkFilePurged(ctx, job.downloadID)
+}
+
+func (p *pipelinePool) finishStep(ctx context.Context, downloadID int64, step repository.PipelineStep, status string, detail string, errMessage string) {
+	log.Printf("Download request %d: pipeline step %s %s\n", downloadID, step.Name, status)
+	metrics.Add("downloader_pipeline_steps_total", metrics.Labels{"step": step.Name, "status": status}, 1)
+	if err := p.repo.FinishPipelineStep(ctx, downloadID, step.Position, status, detail, errMessage); err != nil {
+		log.Println(err)
+	}
+}
+
+func (p *pipelinePool) skipRest(ctx context.Context, downloadID int64, failed string) {
+	if err := p.repo.SkipPipelineSteps(ctx, downloadID, "step "+failed+" failed"); err != nil {
+		log.Println(err)
+	}
+}
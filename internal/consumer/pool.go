@@ -0,0 +1,212 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"example.com/internal/repository"
+)
+
+const WorkerRestartDelay = 1 * time.Second
+
+const (
+	WorkerIdle        = "idle"
+	WorkerDownloading = "downloading"
+	WorkerStopping    = "stopping" // finishing its current download before leaving the pool
+)
+
+var ErrStopped = errors.New("consumer is stopped")
+
+type WorkerStatus struct {
+	ID          int     `json:"id"`
+	State       string  `json:"state"`
+	DownloadID  int64   `json:"download_id,omitempty"`
+	Bytes       int64   `json:"bytes,omitempty"` // received in the current download
+	BytesPerSec float64 `json:"bytes_per_sec"`
+	Restarts    int     `json:"restarts"`
+}
+
+// workerState is what a worker reports about itself to the pool.
+type workerState struct {
+	mu         sync.Mutex
+	downloadID int64 // 0 when idle
+	bytes      int64
+	startedAt  time.Time
+	restarts   int
+	stopping   bool
+	stop       chan struct{} // closed when the pool scales the worker down
+}
+
+func (s *workerState) setDownloading(downloadID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.downloadID = downloadID
+	s.bytes = 0
+	s.startedAt = time.Now()
+}
+
+func (s *workerState) setIdle() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.downloadID = 0
+	s.bytes = 0
+}
+
+func (s *workerState) addBytes(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bytes += int64(n)
+}
+
+// spawn adds a supervised worker to the pool. c.mu must be held.
+func (c *consumer) spawn(ctx context.Context) {
+	w := c.newWorker()
+	c.workers[w.id] = w
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.supervise(ctx, w)
+	}()
+}
+
+// newWorker returns a worker sharing the schedulers, the fetcher and the disk ledger of the
+// pool, not started yet. c.mu must be held.
+func (c *consumer) newWorker() *worker {
+	w := &worker{
+		id:        c.nextID,
+		repo:      c.repo,
+		cfg:       c.cfg,
+		tracker:   c.tracker,
+		bandwidth: c.bandwidth,
+		labels:    c.labels,
+		fetcher:   c.fetcher,
+		origins:   c.origins,
+		disk:      c.disk,
+		box:       c.box,
+		flags:     c.flags,
+		scripts:   c.scripts,
+		pipelines: c.pipelines,
+		resumed:   c.resumed,
+		state:     &workerState{stop: make(chan struct{})},
+		name:      fmt.Sprintf("%s/%d", c.hostname, c.nextID),
+	}
+	c.nextID++
+	return w
+}
+
+// supervise runs the worker and restarts it whenever it panics, until it is scaled down
+// or the context is done.
+func (c *consumer) supervise(ctx context.Context, w *worker) {
+	defer func() {
+		c.mu.Lock()
+		delete(c.workers, w.id)
+		c.mu.Unlock()
+	}()
+
+	for w.runSupervised(ctx) {
+		w.state.mu.Lock()
+		w.state.restarts++
+		w.state.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.state.stop:
+			return
+		case <-time.After(WorkerRestartDelay):
+			log.Printf("Worker %d is restarting\n", w.id)
+		}
+	}
+}
+
+// runSupervised runs the worker and reports whether it crashed.
+func (w *worker) runSupervised(ctx context.Context) (crashed bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Worker %d crashed: %v\n%s", w.id, r, debug.Stack())
+			w.state.setIdle()
+			w.entry = repository.QueueEntry{} // left pending, to be delivered again
+			crashed = true
+		}
+	}()
+
+	w.run(ctx)
+	return false
+}
+
+func (c *consumer) Scale(n int) error {
+	if n < 0 || int64(n) > c.cfg.MaxWorkers {
+		return fmt.Errorf("number of workers must be between 0 and %d", c.cfg.MaxWorkers)
+	}
+	if c.ctx.Err() != nil {
+		return ErrStopped
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var running []*worker
+	for _, w := range c.workers {
+		w.state.mu.Lock()
+		if !w.state.stopping {
+			running = append(running, w)
+		}
+		w.state.mu.Unlock()
+	}
+
+	for i := len(running); i < n; i++ {
+		c.spawn(c.ctx)
+	}
+
+	// Stop the newest workers first; they finish their current download before leaving.
+	sort.Slice(running, func(i, j int) bool { return running[i].id > running[j].id })
+	for i := 0; i < len(running)-n; i++ {
+		w := running[i]
+		w.state.mu.Lock()
+		w.state.stopping = true
+		close(w.state.stop)
+		w.state.mu.Unlock()
+	}
+
+	log.Printf("Scaled workers from %d to %d\n", len(running), n)
+	return nil
+}
+
+func (c *consumer) Workers() []WorkerStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	statuses := make([]WorkerStatus, 0, len(c.workers))
+	for _, w := range c.workers {
+		s := w.state
+		s.mu.Lock()
+		status := WorkerStatus{
+			ID:       w.id,
+			State:    WorkerIdle,
+			Restarts: s.restarts,
+		}
+		if s.downloadID != 0 {
+			status.State = WorkerDownloading
+			status.DownloadID = s.downloadID
+			status.Bytes = s.bytes
+			if elapsed := time.Since(s.startedAt).Seconds(); elapsed > 0 {
+				status.BytesPerSec = float64(s.bytes) / elapsed
+			}
+		}
+		if s.stopping {
+			status.State = WorkerStopping
+		}
+		s.mu.Unlock()
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
+}
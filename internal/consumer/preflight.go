@@ -0,0 +1,84 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"example.com/internal/repository"
+)
+
+// preflight sends a HEAD request for the file of req, or a GET of its first byte to the
+// origins not allowing HEAD, with the headers and credentials of req. It reports the size,
+// type and validators of the file and whether the origin serves byte ranges of it.
+func (w *worker) preflight(req *http.Request) (repository.Preflight, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), w.cfg.PreflightTimeout)
+	defer cancel()
+
+	resp, err := w.fetcher.doHTTP(preflightRequest(ctx, req, http.MethodHead))
+	if err == nil && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+		resp.Body.Close()
+		resp, err = w.fetcher.doHTTP(preflightRequest(ctx, req, http.MethodGet))
+	}
+	if err != nil {
+		return repository.Preflight{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return repository.Preflight{}, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	preflight := repository.Preflight{
+		Size:        -1,
+		ContentType: resp.Header.Get("Content-Type"),
+		ETag:        resp.Header.Get("ETag"),
+		CheckedAt:   time.Now(),
+	}
+	if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		preflight.LastModified = &lastModified
+	}
+	encoded := resp.Uncompressed || resp.Header.Get("Content-Encoding") != ""
+	if resp.StatusCode == http.StatusPartialContent {
+		preflight.AcceptRanges = true
+		if _, _, size, ok := parseContentRange(resp.Header.Get("Content-Range")); ok && !encoded {
+			preflight.Size = size
+		}
+	} else {
+		// A GET answered with the whole file tells the origin ignores ranges.
+		if resp.Request.Method == http.MethodHead {
+			preflight.AcceptRanges = strings.Contains(resp.Header.Get("Accept-Ranges"), "bytes")
+		}
+		if resp.ContentLength >= 0 && !encoded {
+			preflight.Size = resp.ContentLength
+		}
+	}
+	return preflight, nil
+}
+
+// ifRangeValidator returns the If-Range of a request resuming the file of the preflight: its
+// ETag unless it is weak, which If-Range does not take, or else its Last-Modified, empty if
+// it has neither.
+func ifRangeValidator(preflight repository.Preflight) string {
+	if preflight.ETag != "" && !strings.HasPrefix(preflight.ETag, "W/") {
+		return preflight.ETag
+	}
+	if preflight.LastModified != nil {
+		return preflight.LastModified.UTC().Format(http.TimeFormat)
+	}
+	return ""
+}
+
+func preflightRequest(ctx context.Context, req *http.Request, method string) *http.Request {
+	preflightReq := req.Clone(ctx)
+	preflightReq.Method = method
+	preflightReq.Header.Del("Range")
+	preflightReq.Header.Del("If-Range")
+	// The size of the file, not of a compressed response.
+	preflightReq.Header.Set("Accept-Encoding", "identity")
+	if method == http.MethodGet {
+		preflightReq.Header.Set("Range", "bytes=0-0")
+	}
+	return preflightReq
+}
@@ -0,0 +1,157 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"example.com/internal/config"
+	"example.com/internal/metrics"
+	"example.com/internal/repository"
+)
+
+const LinkProbeBatchSize = 100
+const LinkProbeMaxBackoff = 24 * time.Hour
+
+func init() {
+	metrics.Register("downloader_link_probes_total", metrics.KindCounter, "Probes of the links of queued downloads, by result.")
+	metrics.Register("downloader_dead_links_total", metrics.KindCounter, "Queued downloads failed because their link was found dead.")
+}
+
+const (
+	linkAlive   = "alive"
+	linkDead    = "dead"
+	linkUnknown = "unknown" // e.g. a timeout or a server error, which says nothing about the file
+)
+
+// probeLinks periodically sends a HEAD request to the links of the downloads waiting in the
+// queue, and fails those whose link was found dead LINK_PROBE_ATTEMPTS times in a row before a
+// worker spends a slot on them. The probes of a dead link back off, so a link gone for a moment
+// has time to come back.
+func probeLinks(ctx context.Context, repo repository.Repository, cfg *config.Config, client *http.Client) {
+	ticker := time.NewTicker(cfg.LinkProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for {
+			probes, err := repo.ClaimLinkProbes(ctx, cfg.LinkProbeInterval, cfg.LinkProbeInterval, LinkProbeBatchSize)
+			if err != nil {
+				log.Printf("Could not probe links: %v", err)
+				break
+			}
+			for _, probe := range probes {
+				if err := probeLink(ctx, repo, cfg, client, probe); err != nil {
+					log.Printf("Could not probe link of download request %d: %v", probe.DownloadID, err)
+				}
+			}
+			if len(probes) < LinkProbeBatchSize {
+				break
+			}
+		}
+	}
+}
+
+func probeLink(ctx context.Context, repo repository.Repository, cfg *config.Config, client *http.Client, probe repository.LinkProbe) error {
+	// The origin may only know the file when asked with the credentials of the profile.
+	if host := linkHost(probe.Link); host != "" {
+		_, found, err := repo.FindOriginProfileForHost(ctx, probe.UserID, host)
+		if err != nil {
+			return err
+		}
+		if found {
+			return nil
+		}
+	}
+
+	result, reason := checkLink(ctx, client, probe.Link, cfg.LinkProbeTimeout)
+	metrics.Add("downloader_link_probes_total", metrics.Labels{"result": result}, 1)
+	switch result {
+	case linkAlive:
+		if probe.Failures > 0 {
+			return repo.SetLinkProbe(ctx, probe.DownloadID, 0, cfg.LinkProbeInterval)
+		}
+		return nil
+	case linkUnknown:
+		// Probed again after the lease of the claim, as if it had not been.
+		return nil
+	}
+
+	failures := probe.Failures + 1
+	if failures < cfg.LinkProbeAttempts {
+		log.Printf("Link of download request %d found dead (%d/%d): %s\n", probe.DownloadID, failures, cfg.LinkProbeAttempts, reason)
+		return repo.SetLinkProbe(ctx, probe.DownloadID, failures, linkProbeBackoff(cfg.LinkProbeInterval, failures))
+	}
+	failed, err := repo.FailDeadLink(ctx, probe.DownloadID, reason)
+	if err != nil {
+		return err
+	}
+	if failed {
+		log.Printf("Failed download request %d before it was started: %s\n", probe.DownloadID, reason)
+		metrics.Add("downloader_dead_links_total", nil, 1)
+		invalidateDownloadList(ctx, repo, cfg, probe.UserID)
+	}
+	return nil
+}
+
+// linkProbeBackoff returns how long after the failures-th probe finding a link dead it is
+// probed again: twice as long as the previous time, at most LinkProbeMaxBackoff.
+func linkProbeBackoff(interval time.Duration, failures int64) time.Duration {
+	backoff := interval
+	for i := int64(1); i < failures && backoff < LinkProbeMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, LinkProbeMaxBackoff)
+}
+
+// checkLink sends a HEAD request to link, or a GET of its first byte to the origins not
+// allowing HEAD, and returns the result with the reason of a dead link. Only a missing file
+// (404, 410) or host is dead: the origins refusing the request without credentials or failing
+// may serve the file to a worker later.
+func checkLink(ctx context.Context, client *http.Client, link string, timeout time.Duration) (string, string) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	resp, err := sendProbe(ctx, client, http.MethodHead, link)
+	if err == nil && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+		resp.Body.Close()
+		resp, err = sendProbe(ctx, client, http.MethodGet, link)
+	}
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return linkDead, fmt.Sprintf("host %s of the link does not exist", dnsErr.Name)
+		}
+		return linkUnknown, err.Error()
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return linkDead, fmt.Sprintf("the link is dead: HTTP %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	case resp.StatusCode < http.StatusBadRequest:
+		return linkAlive, ""
+	}
+	return linkUnknown, fmt.Sprintf("HTTP %d", resp.StatusCode)
+}
+
+func sendProbe(ctx context.Context, client *http.Client, method string, link string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, link, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", UserAgent)
+	if method == http.MethodGet {
+		req.Header.Set("Range", "bytes=0-0")
+	}
+	return client.Do(req)
+}
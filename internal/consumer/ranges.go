@@ -0,0 +1,76 @@
+package consumer
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// rangeHeader returns the Range header of a download of the bytes first-last of a file
+// (last is -1 for up to its end, first is 0 for the whole file) resumed at offset.
+func rangeHeader(first int64, last int64, offset int64) string {
+	if last < 0 {
+		return fmt.Sprintf("bytes=%d-", first+offset)
+	}
+	return fmt.Sprintf("bytes=%d-%d", first+offset, last)
+}
+
+// checkRangeResponse validates the response to the request of a byte range (resumed at
+// offset) against the size of the file the origin reports in Content-Range. Origins that
+// ignore the range are rejected, as the download is only a part of the file.
+func checkRangeResponse(resp *http.Response, byteRange string, first int64, last int64, offset int64) error {
+	start, end, size, ok := parseContentRange(resp.Header.Get("Content-Range"))
+
+	switch resp.StatusCode {
+	case http.StatusRequestedRangeNotSatisfiable:
+		if size >= 0 {
+			return fmt.Errorf("Range %s starts beyond the end of the file (%d bytes)", byteRange, size)
+		}
+		return fmt.Errorf("Range %s is not satisfiable", byteRange)
+	case http.StatusOK:
+		return fmt.Errorf("Origin does not support byte ranges")
+	case http.StatusPartialContent:
+	default:
+		return nil // left to the status check of the worker
+	}
+
+	if !ok || start != first+offset {
+		return fmt.Errorf("Origin answered range %s with unexpected Content-Range %q", byteRange, resp.Header.Get("Content-Range"))
+	}
+	if last >= 0 && size >= 0 && last >= size {
+		return fmt.Errorf("Range %s ends beyond the end of the file (%d bytes)", byteRange, size)
+	}
+	if last >= 0 && end != last {
+		return fmt.Errorf("Origin answered range %s with unexpected Content-Range %q", byteRange, resp.Header.Get("Content-Range"))
+	}
+	return nil
+}
+
+// parseContentRange parses "bytes <start>-<end>/<size>" and "bytes */<size>"; unknown
+// values ("*") are -1.
+func parseContentRange(value string) (start int64, end int64, size int64, ok bool) {
+	rangeStr, sizeStr, found := strings.Cut(strings.TrimPrefix(value, "bytes "), "/")
+	if !found {
+		return -1, -1, -1, false
+	}
+
+	size = -1
+	if sizeStr != "*" {
+		var err error
+		if size, err = strconv.ParseInt(sizeStr, 10, 64); err != nil {
+			return -1, -1, -1, false
+		}
+	}
+	if rangeStr == "*" {
+		return -1, -1, size, false
+	}
+
+	startStr, endStr, found := strings.Cut(rangeStr, "-")
+	start, err1 := strconv.ParseInt(startStr, 10, 64)
+	end, err2 := strconv.ParseInt(endStr, 10, 64)
+	if !found || err1 != nil || err2 != nil {
+		return -1, -1, size, false
+	}
+	return start, end, size, true
+}
@@ -0,0 +1,63 @@
+package consumer
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"example.com/internal/repository"
+)
+
+// reapWorkers periodically requeues the downloads of the workers whose heartbeat expired, whose
+// process died or hangs, without waiting for their lock to expire and reconcile to find them.
+// Each download is requeued once, by the first process to reap it.
+func reapWorkers(ctx context.Context, repo repository.Repository, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := reapWorkersOnce(ctx, repo, WorkerHeartbeatTTLIntervals*interval); err != nil {
+			log.Printf("Could not reap dead workers: %v", err)
+		}
+	}
+}
+
+func reapWorkersOnce(ctx context.Context, repo repository.Repository, ttl time.Duration) error {
+	owners, err := repo.GetDownloadOwners(ctx)
+	if err != nil {
+		return err
+	}
+
+	for downloadID, owner := range owners {
+		if time.Since(owner.Since) < ttl {
+			continue // a worker spawned since the last heartbeat
+		}
+		alive, err := repo.IsWorkerAlive(ctx, owner.Worker)
+		if err != nil {
+			return err
+		}
+		if alive {
+			continue
+		}
+
+		reaped, err := repo.ReapDownloadOwner(ctx, downloadID, owner.Token)
+		if err != nil {
+			return err
+		}
+		if !reaped {
+			continue
+		}
+		if err := repo.RequeueDownloadRequest(ctx, downloadID); err != nil {
+			log.Println(err)
+			continue
+		}
+		log.Printf("Requeued download request %d of dead worker %s\n", downloadID, owner.Worker)
+	}
+	return nil
+}
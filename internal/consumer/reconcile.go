@@ -0,0 +1,92 @@
+package consumer
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"example.com/internal/repository"
+)
+
+// reconcile periodically requeues the download requests that fell through the cracks:
+// queued ones whose push failed (or whose id was popped by a worker that died before
+// locking it), and downloading ones whose worker died and whose lock expired. Requests
+// younger than LinkProcessingExpTime are left alone, they may still be on their way.
+//
+// The requests queued for a process that is dead (see IsInstanceAlive) go to the queues of their
+// users first, so that they restart elsewhere, and the users whose queue still holds requests get
+// turns again (see RestoreQueueUsers).
+//
+// Requeuing twice is harmless: the lock and the status check in StartDownloadRequest
+// make sure a request is only processed once.
+func reconcile(ctx context.Context, repo repository.Repository, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := reconcileOnce(ctx, repo); err != nil {
+			log.Printf("Could not reconcile download requests: %v", err)
+		}
+	}
+}
+
+func reconcileOnce(ctx context.Context, repo repository.Repository) error {
+	requeued, err := repo.RequeueDeadHosts(ctx)
+	if err != nil {
+		return err
+	}
+	if len(requeued) > 0 {
+		log.Printf("Requeued download requests of dead hosts to restart elsewhere: %v\n", requeued)
+	}
+	if err := repo.RestoreQueueUsers(ctx); err != nil {
+		return err
+	}
+	if err := repo.PruneQueuedAt(ctx); err != nil {
+		return err
+	}
+
+	unfinished, err := repo.GetUnfinishedDownloadRequests(ctx, LinkProcessingExpTime)
+	if err != nil {
+		return err
+	}
+	if len(unfinished) == 0 {
+		return nil
+	}
+
+	queuedIDs, err := repo.GetQueuedDownloadRequests(ctx)
+	if err != nil {
+		return err
+	}
+	queued := make(map[int64]bool, len(queuedIDs))
+	for _, downloadID := range queuedIDs {
+		queued[downloadID] = true
+	}
+
+	downloadIDs := make([]int64, 0, len(unfinished))
+	for _, req := range unfinished {
+		downloadIDs = append(downloadIDs, req.ID)
+	}
+	locked, err := repo.GetLockedDownloadRequests(ctx, downloadIDs)
+	if err != nil {
+		return err
+	}
+
+	for _, req := range unfinished {
+		if queued[req.ID] || locked[req.ID] {
+			continue
+		}
+		if err := repo.RequeueDownloadRequest(ctx, req.ID); err != nil {
+			log.Println(err)
+			continue
+		}
+		log.Printf("Requeued orphaned download request %d: status: %s\n", req.ID, req.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,226 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"slices"
+	"time"
+
+	"example.com/internal/coldstore"
+	"example.com/internal/config"
+	"example.com/internal/metrics"
+	"example.com/internal/pipeline"
+	"example.com/internal/repository"
+)
+
+const RetentionBatchSize = 100
+
+// Reasons a download is purged, the reason label of the retention metrics.
+const (
+	PurgeReasonRetention = "retention" // its retention ran out
+	PurgeReasonUser      = "user"      // its owner deleted it
+	PurgeReasonTrash     = "trash"     // it was in the trash for TRASH_RETENTION
+	PurgeReasonAccount   = "account"   // its owner deleted their account
+)
+
+// ErrDownloadActive is returned when purging a download that is queued or downloading.
+var ErrDownloadActive = errors.New("download request is not finished")
+
+func init() {
+	metrics.Register("downloader_retention_files_deleted_total", metrics.KindCounter, "Files of finished downloads deleted by retention or by their owner.")
+	metrics.Register("downloader_retention_bytes_reclaimed_total", metrics.KindCounter, "Bytes of the deleted files of finished downloads.")
+	metrics.Register("downloader_retention_rows_deleted_total", metrics.KindCounter, "Finished download requests deleted by retention or by their owner.")
+}
+
+// purgeOldDownloads periodically deletes the finished downloads of which RETENTION_TTL, the
+// override of the plan or of the user ran out, with their files, those in the trash for longer
+// than TRASH_RETENTION and those their owners deleted while the file was on the disk of this
+// process, then removes the deleted accounts left with no download. Hot files are only deleted
+// by their host.
+func purgeOldDownloads(ctx context.Context, repo repository.Repository, cfg *config.Config, cold coldstore.Store) {
+	ticker := time.NewTicker(cfg.RetentionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for {
+			downloads, err := repo.GetRetentionCandidates(ctx, cfg.InstanceID, cfg.RetentionTTL, cfg.PlanRetentionTTLs, cfg.TrashRetention, RetentionBatchSize)
+			if err != nil {
+				log.Printf("Could not purge old downloads: %v", err)
+				break
+			}
+
+			purged := 0
+			for _, download := range downloads {
+				reason := PurgeReasonRetention
+				if download.DeletedAt != nil {
+					reason = PurgeReasonTrash
+				}
+				if _, err := PurgeDownload(ctx, repo, cfg, cold, download.ID, reason); err != nil {
+					log.Printf("Could not purge download request %d: %v", download.ID, err)
+					continue
+				}
+				purged++
+			}
+			if len(downloads) < RetentionBatchSize || purged == 0 {
+				break
+			}
+		}
+		if _, err := repo.DeletePurgedAccounts(ctx); err != nil {
+			log.Printf("Could not delete purged accounts: %v", err)
+		}
+	}
+}
+
+// PurgeDownload deletes a finished download with its file, from the disk of this process or
+// from cold storage, gives its bytes back to the owner's quota and returns them. It holds the
+// lock of the download meanwhile like collectPartialFile, so a retry cannot start in between.
+func PurgeDownload(ctx context.Context, repo repository.Repository, cfg *config.Config, cold coldstore.Store, downloadID int64, reason string) (int64, error) {
+	token := newLockToken()
+	acquired, err := repo.AcquireLock(ctx, downloadID, token, LinkProcessingExpTime)
+	if err != nil {
+		return 0, err
+	}
+	if !acquired {
+		return 0, errors.New("download request is being processed")
+	}
+	defer repo.ReleaseLock(ctx, downloadID, token)
+
+	download, err := repo.GetDownloadRequest(ctx, downloadID)
+	if err != nil {
+		return 0, err
+	}
+	switch download.Status {
+	case repository.StatusCompleted, repository.StatusFailed, repository.StatusExpired:
+	default:
+		return 0, ErrDownloadActive // retried since it was listed
+	}
+	if reason == PurgeReasonTrash && download.DeletedAt == nil {
+		return 0, nil // restored from the trash since it was listed
+	}
+
+	var size int64
+	files := 0
+	if download.Tier == repository.TierHot {
+		// A failed download has its partial file, unless it failed once complete.
+		for _, path := range []string{download.FileName, partialFileName(download.FileName)} {
+			info, err := os.Stat(path)
+			switch {
+			case err == nil:
+				if err := os.Remove(path); err != nil {
+					return 0, err
+				}
+				size += info.Size()
+				files++
+			case !errors.Is(err, os.ErrNotExist):
+				return 0, err
+			}
+		}
+		// Left next to the file by the extract, transcode and thumbnail pipeline steps.
+		if err := os.RemoveAll(download.FileName + ".extracted"); err != nil {
+			log.Println(err)
+		}
+		if err := os.Remove(pipeline.ThumbnailPath(download.FileName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Println(err)
+		}
+		if cfg.PipelineTranscodeFormat != "" {
+			if err := os.Remove(download.FileName + "." + cfg.PipelineTranscodeFormat); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Println(err)
+			}
+		}
+	} else if download.ColdKey != "" {
+		if err := cold.Delete(ctx, download.ColdKey); err != nil {
+			return 0, err
+		}
+		if download.Bytes != nil {
+			size = *download.Bytes
+		}
+		files++
+	}
+	if download.ContentHash != "" {
+		releaseContent(ctx, repo, cfg, download.ContentHash)
+		if err := repo.SetContentHash(ctx, downloadID, ""); err != nil {
+			log.Println(err)
+		}
+	}
+
+	deleted, err := repo.DeleteDownloadRequest(ctx, downloadID)
+	if err != nil {
+		return 0, err
+	}
+	invalidateDownloadList(ctx, repo, cfg, download.UserID)
+	if size > 0 {
+		if _, err := repo.AddUserUsage(ctx, download.UserID, -size); err != nil {
+			log.Println(err)
+		}
+	}
+
+	labels := metrics.Labels{"reason": reason}
+	metrics.Add("downloader_retention_files_deleted_total", labels, float64(files))
+	metrics.Add("downloader_retention_bytes_reclaimed_total", labels, float64(size))
+	if deleted {
+		metrics.Add("downloader_retention_rows_deleted_total", labels, 1)
+	}
+	log.Printf("Purged download request %d (%s): %d bytes\n", downloadID, reason, size)
+	return size, nil
+}
+
+// RestoreFromTrash takes a download out of the trash, holding its lock like PurgeDownload so
+// that it is not purged meanwhile. It returns false if the download is not in the trash.
+func RestoreFromTrash(ctx context.Context, repo repository.Repository, downloadID int64) (bool, error) {
+	token := newLockToken()
+	acquired, err := repo.AcquireLock(ctx, downloadID, token, LinkProcessingExpTime)
+	if err != nil {
+		return false, err
+	}
+	if !acquired {
+		return false, errors.New("download request is being processed")
+	}
+	defer repo.ReleaseLock(ctx, downloadID, token)
+
+	return repo.RestoreFromTrash(ctx, downloadID)
+}
+
+// PurgeAccount purges the downloads of a deleted account that this process can at once, those
+// not on the disk of another process, not running anymore and whose pipeline finished, then
+// removes the account if no download is left. The retention loops purge the others and remove
+// the account later. It reports whether the account was removed.
+func PurgeAccount(ctx context.Context, repo repository.Repository, cfg *config.Config, cold coldstore.Store, userID int64) (bool, error) {
+	downloads, err := repo.GetUserDownloadRequests(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	for _, download := range downloads {
+		if download.Tier == repository.TierHot && download.Host != "" && download.Host != cfg.InstanceID {
+			continue
+		}
+		steps, err := repo.GetPipelineSteps(ctx, download.ID)
+		if err != nil {
+			return false, err
+		}
+		if slices.ContainsFunc(steps, func(step repository.PipelineStep) bool {
+			return step.Status == repository.PipelineStepPending || step.Status == repository.PipelineStepRunning
+		}) {
+			continue
+		}
+		if _, err := PurgeDownload(ctx, repo, cfg, cold, download.ID, PurgeReasonAccount); err != nil {
+			log.Printf("Could not purge download request %d: %v", download.ID, err)
+		}
+	}
+
+	if _, err := repo.DeletePurgedAccounts(ctx); err != nil {
+		return false, err
+	}
+	_, found, err := repo.GetUser(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	return !found, nil
+}
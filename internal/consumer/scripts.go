@@ -0,0 +1,114 @@
+package consumer
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"example.com/internal/config"
+	"example.com/internal/flags"
+	"example.com/internal/metrics"
+	"example.com/internal/repository"
+	"example.com/internal/sandbox"
+)
+
+// ScriptQueueSize bounds the completed downloads waiting for their completion scripts. The
+// scripts of downloads completed while it is full are skipped.
+const ScriptQueueSize = 1000
+
+func init() {
+	metrics.Register("downloader_scripts_skipped_total", metrics.KindCounter, "Completed downloads whose completion scripts were skipped because the script queue was full.")
+}
+
+type scriptJob struct {
+	downloadID int64
+	userID     int64
+	fileName   string
+}
+
+// scriptPool runs the completion scripts of completed downloads, at most SCRIPT_CONCURRENCY
+// at a time, so that the workers move on to the next download instead of waiting for them.
+type scriptPool struct {
+	repo  repository.Repository
+	cfg   *config.Config
+	flags flags.Flags
+	jobs  chan scriptJob
+	_     struct{}
+}
+
+func newScriptPool(ctx context.Context, repo repository.Repository, cfg *config.Config, flags flags.Flags) *scriptPool {
+	p := &scriptPool{
+		repo:  repo,
+		cfg:   cfg,
+		flags: flags,
+		jobs:  make(chan scriptJob, ScriptQueueSize),
+	}
+	for i := int64(0); i < cfg.ScriptConcurrency; i++ {
+		go p.run(ctx)
+	}
+	return p
+}
+
+func (p *scriptPool) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-p.jobs:
+			p.runCompletionScripts(ctx, job.downloadID, job.userID, job.fileName)
+		}
+	}
+}
+
+// submit queues the completion scripts of the user for the file of a completed download
+// without waiting for them.
+func (p *scriptPool) submit(ctx context.Context, downloadID int64, userID int64, fileName string) {
+	if !p.flags.Enabled(ctx, flags.CompletionScripts, userID) {
+		return
+	}
+
+	select {
+	case p.jobs <- scriptJob{downloadID: downloadID, userID: userID, fileName: fileName}:
+	default:
+		metrics.Add("downloader_scripts_skipped_total", nil, 1)
+		log.Printf("Download request %d: completion scripts skipped, %d downloads are waiting for theirs\n", downloadID, ScriptQueueSize)
+	}
+}
+
+// runCompletionScripts runs the completion scripts of the user on the file of a completed
+// download, one after the other, and records how each went. A failing script does not fail
+// the download.
+func (p *scriptPool) runCompletionScripts(ctx context.Context, downloadID int64, userID int64, fileName string) {
+	scripts, err := p.repo.GetCompletionScripts(ctx, userID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, script := range scripts {
+		limits := sandbox.Limits{
+			// MAX_SCRIPT_TIMEOUT may have been lowered since the script was created.
+			Timeout:        min(time.Duration(script.Timeout)*time.Second, p.cfg.MaxScriptTimeout),
+			MaxProcesses:   p.cfg.ScriptMaxProcesses,
+			MaxMemoryBytes: p.cfg.ScriptMaxMemoryBytes,
+		}
+		result, err := sandbox.Run(ctx, script.Script, fileName, limits)
+		run := repository.ScriptRun{
+			ScriptID: script.ID,
+			Name:     script.Name,
+			ExitCode: result.ExitCode,
+			TimedOut: result.TimedOut,
+			Output:   result.Output,
+			Duration: result.Duration,
+		}
+		if err != nil {
+			run.ExitCode = -1
+			run.Error = err.Error()
+		}
+		log.Printf("Download request %d: completion script %d exited with %d in %dms\n", downloadID, script.ID, run.ExitCode, run.Duration)
+
+		if err := p.repo.AddScriptRun(ctx, downloadID, run); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"example.com/internal/httpclient"
+	"example.com/internal/repository"
+)
+
+// Links that are not HTTP are fetched by sources: http.RoundTrippers that translate the
+// download request (a GET with an optional "Range: bytes=<offset>-" header) into their own
+// protocol and answer like an HTTP server would, with 206 when they resumed at the offset
+// and 200 when they started over. This way the worker handles every protocol the same.
+
+type credentialsKey struct{}
+type downloadIDKey struct{}
+
+// withDownloadID attaches the id of the download to the request context, for sources that report progress themselves.
+func withDownloadID(ctx context.Context, downloadID int64) context.Context {
+	return context.WithValue(ctx, downloadIDKey{}, downloadID)
+}
+
+func sourceDownloadID(req *http.Request) int64 {
+	downloadID, _ := req.Context().Value(downloadIDKey{}).(int64)
+	return downloadID
+}
+
+// withCredentials attaches the credentials of the download to the request context for the sources.
+func withCredentials(ctx context.Context, credentials *repository.Credentials) context.Context {
+	return context.WithValue(ctx, credentialsKey{}, credentials)
+}
+
+// sourceCredentials returns the credentials of the download, falling back to the user info of the link.
+func sourceCredentials(req *http.Request, defaultUser string, defaultPassword string) repository.Credentials {
+	if credentials, ok := req.Context().Value(credentialsKey{}).(*repository.Credentials); ok && credentials != nil {
+		return *credentials
+	}
+
+	credentials := repository.Credentials{Username: defaultUser, Password: defaultPassword}
+	if req.URL.User != nil {
+		credentials.Username = req.URL.User.Username()
+		credentials.Password, _ = req.URL.User.Password()
+	}
+	return credentials
+}
+
+// rangeOffset parses the "bytes=<offset>-" range the worker sends.
+func rangeOffset(req *http.Request) int64 {
+	offset, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(req.Header.Get("Range"), "bytes="), "-"), 10, 64)
+	if err != nil || offset < 0 {
+		return 0
+	}
+	return offset
+}
+
+// sourceResponse builds the response of a source for a file of size bytes (-1 if unknown)
+// whose body starts at offset.
+func sourceResponse(req *http.Request, proto string, body io.ReadCloser, offset int64, size int64) *http.Response {
+	resp := &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         proto,
+		Header:        make(http.Header),
+		Body:          body,
+		ContentLength: size,
+		Request:       req,
+	}
+	if offset > 0 {
+		resp.Status = "206 Partial Content"
+		resp.StatusCode = http.StatusPartialContent
+		if size >= 0 {
+			resp.ContentLength = size - offset
+			resp.Header.Set("Content-Range", "bytes "+strconv.FormatInt(offset, 10)+"-"+strconv.FormatInt(size-1, 10)+"/"+strconv.FormatInt(size, 10))
+		}
+	}
+	if resp.ContentLength >= 0 {
+		resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(req.URL.Path))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	resp.Header.Set("Content-Type", contentType)
+	return resp
+}
+
+// openCredentials decrypts the credentials stored with a download request.
+func (w *worker) openCredentials(sealed string) (*repository.Credentials, error) {
+	plaintext, err := w.box.Open(sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	var credentials repository.Credentials
+	if err := json.Unmarshal(plaintext, &credentials); err != nil {
+		return nil, err
+	}
+	return &credentials, nil
+}
+
+// openProxy decrypts the proxy stored with a download request.
+func (w *worker) openProxy(sealed string) (*url.URL, error) {
+	plaintext, err := w.box.Open(sealed)
+	if err != nil {
+		return nil, err
+	}
+	return httpclient.ParseProxy(string(plaintext))
+}
+
+// openHeaders decrypts the request headers stored with a download request.
+func (w *worker) openHeaders(sealed string) (repository.Headers, error) {
+	plaintext, err := w.box.Open(sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	var headers repository.Headers
+	if err := json.Unmarshal(plaintext, &headers); err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
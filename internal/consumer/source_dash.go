@@ -0,0 +1,283 @@
+package consumer
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The parts of the MPD schema needed to list the segments of a representation.
+
+type mpd struct {
+	Type     string      `xml:"type,attr"`
+	Duration string      `xml:"mediaPresentationDuration,attr"`
+	BaseURL  string      `xml:"BaseURL"`
+	Periods  []mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	Duration       string             `xml:"duration,attr"`
+	BaseURL        string             `xml:"BaseURL"`
+	AdaptationSets []mpdAdaptationSet `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	MimeType        string              `xml:"mimeType,attr"`
+	ContentType     string              `xml:"contentType,attr"`
+	BaseURL         string              `xml:"BaseURL"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList     *mpdSegmentList     `xml:"SegmentList"`
+	Representations []mpdRepresentation `xml:"Representation"`
+}
+
+type mpdRepresentation struct {
+	ID              string              `xml:"id,attr"`
+	Bandwidth       int64               `xml:"bandwidth,attr"`
+	MimeType        string              `xml:"mimeType,attr"`
+	BaseURL         string              `xml:"BaseURL"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList     *mpdSegmentList     `xml:"SegmentList"`
+}
+
+type mpdSegmentTemplate struct {
+	Initialization string `xml:"initialization,attr"`
+	Media          string `xml:"media,attr"`
+	StartNumber    *int64 `xml:"startNumber,attr"`
+	Timescale      int64  `xml:"timescale,attr"`
+	Duration       int64  `xml:"duration,attr"`
+	Timeline       []struct {
+		T *int64 `xml:"t,attr"`
+		D int64  `xml:"d,attr"`
+		R int64  `xml:"r,attr"`
+	} `xml:"SegmentTimeline>S"`
+}
+
+type mpdSegmentList struct {
+	Initialization struct {
+		SourceURL string `xml:"sourceURL,attr"`
+	} `xml:"Initialization"`
+	SegmentURLs []struct {
+		Media string `xml:"media,attr"`
+	} `xml:"SegmentURL"`
+}
+
+// MaxDASHSegments bounds the segments a template may expand to.
+const MaxDASHSegments = 100000
+
+var dashTemplateIdentifier = regexp.MustCompile(`\$(RepresentationID|Number|Time|Bandwidth|)(%0\d+d)?\$`)
+
+// parseDASH parses a static MPD and lists the segments of the representation with the highest
+// bandwidth of the video adaptation set (or the first one) of every period. Audio in separate
+// adaptation sets is not muxed in.
+func parseDASH(base *url.URL, body []byte) (*streamPlaylist, error) {
+	var manifest mpd
+	if err := xml.Unmarshal(body, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid MPD: %v", err)
+	}
+	if manifest.Type == "dynamic" {
+		return nil, errors.New("live DASH manifests are not supported")
+	}
+
+	playlist := &streamPlaylist{protocol: ProtocolDASH, contentType: "video/mp4"}
+	base, err := resolveBase(base, manifest.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, period := range manifest.Periods {
+		periodBase, err := resolveBase(base, period.BaseURL)
+		if err != nil {
+			return nil, err
+		}
+		duration := parseISODuration(period.Duration)
+		if duration == 0 && len(manifest.Periods) == 1 {
+			duration = parseISODuration(manifest.Duration)
+		}
+
+		set, rep := bestDASHRepresentation(period.AdaptationSets)
+		if rep == nil {
+			continue
+		}
+		if mimeType := firstNonEmpty(rep.MimeType, set.MimeType); mimeType != "" {
+			playlist.contentType = mimeType
+		}
+
+		repBase, err := resolveBase(periodBase, set.BaseURL)
+		if err != nil {
+			return nil, err
+		}
+		if repBase, err = resolveBase(repBase, rep.BaseURL); err != nil {
+			return nil, err
+		}
+
+		var refs []string
+		switch {
+		case rep.SegmentList != nil || set.SegmentList != nil:
+			list := rep.SegmentList
+			if list == nil {
+				list = set.SegmentList
+			}
+			if list.Initialization.SourceURL != "" {
+				refs = append(refs, list.Initialization.SourceURL)
+			}
+			for _, segment := range list.SegmentURLs {
+				refs = append(refs, segment.Media)
+			}
+		case rep.SegmentTemplate != nil || set.SegmentTemplate != nil:
+			template := rep.SegmentTemplate
+			if template == nil {
+				template = set.SegmentTemplate
+			}
+			if refs, err = expandDASHTemplate(template, rep, duration); err != nil {
+				return nil, err
+			}
+		default:
+			// SegmentBase or a single file: the representation's BaseURL is the whole media
+			refs = append(refs, "")
+		}
+
+		for _, ref := range refs {
+			u, err := resolveReference(repBase, ref)
+			if err != nil {
+				return nil, err
+			}
+			playlist.segments = append(playlist.segments, streamSegment{url: u.String()})
+		}
+	}
+
+	return playlist, nil
+}
+
+func bestDASHRepresentation(sets []mpdAdaptationSet) (*mpdAdaptationSet, *mpdRepresentation) {
+	if len(sets) == 0 {
+		return nil, nil
+	}
+
+	set := &sets[0]
+	for i := range sets {
+		if strings.HasPrefix(sets[i].MimeType, "video/") || sets[i].ContentType == "video" {
+			set = &sets[i]
+			break
+		}
+	}
+
+	var best *mpdRepresentation
+	for i := range set.Representations {
+		if best == nil || set.Representations[i].Bandwidth > best.Bandwidth {
+			best = &set.Representations[i]
+		}
+	}
+	return set, best
+}
+
+// expandDASHTemplate lists the initialization and media segments of a SegmentTemplate, from
+// its SegmentTimeline or else from the segment duration and the period duration.
+func expandDASHTemplate(template *mpdSegmentTemplate, rep *mpdRepresentation, periodSeconds float64) ([]string, error) {
+	fill := func(s string, number int64, time int64) string {
+		return dashTemplateIdentifier.ReplaceAllStringFunc(s, func(identifier string) string {
+			m := dashTemplateIdentifier.FindStringSubmatch(identifier)
+			format := "%d"
+			if m[2] != "" {
+				format = m[2]
+			}
+			switch m[1] {
+			case "RepresentationID":
+				return rep.ID
+			case "Number":
+				return fmt.Sprintf(format, number)
+			case "Time":
+				return fmt.Sprintf(format, time)
+			case "Bandwidth":
+				return fmt.Sprintf(format, rep.Bandwidth)
+			}
+			return "$"
+		})
+	}
+
+	var refs []string
+	if template.Initialization != "" {
+		refs = append(refs, fill(template.Initialization, 0, 0))
+	}
+
+	number := int64(1)
+	if template.StartNumber != nil {
+		number = *template.StartNumber
+	}
+
+	if len(template.Timeline) > 0 {
+		time := int64(0)
+		for _, s := range template.Timeline {
+			if s.T != nil {
+				time = *s.T
+			}
+			if s.R < 0 {
+				return nil, errors.New("open-ended segment timelines are not supported")
+			}
+			for i := int64(0); i <= s.R; i++ {
+				refs = append(refs, fill(template.Media, number, time))
+				number++
+				time += s.D
+				if len(refs) > MaxDASHSegments {
+					return nil, fmt.Errorf("more than %d segments", MaxDASHSegments)
+				}
+			}
+		}
+		return refs, nil
+	}
+
+	timescale := template.Timescale
+	if timescale == 0 {
+		timescale = 1
+	}
+	if template.Duration == 0 || periodSeconds == 0 {
+		return nil, errors.New("segment template has neither a timeline nor durations")
+	}
+	count := int64(math.Ceil(periodSeconds * float64(timescale) / float64(template.Duration)))
+	if count > MaxDASHSegments {
+		return nil, fmt.Errorf("more than %d segments", MaxDASHSegments)
+	}
+	for i := int64(0); i < count; i++ {
+		refs = append(refs, fill(template.Media, number+i, i*template.Duration))
+	}
+	return refs, nil
+}
+
+func resolveBase(base *url.URL, ref string) (*url.URL, error) {
+	if strings.TrimSpace(ref) == "" {
+		return base, nil
+	}
+	return resolveReference(base, ref)
+}
+
+var isoDuration = regexp.MustCompile(`^P(?:(\d+(?:\.\d+)?)D)?(?:T(?:(\d+(?:\.\d+)?)H)?(?:(\d+(?:\.\d+)?)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseISODuration parses durations like PT1H2M3.5S into seconds, 0 if invalid.
+func parseISODuration(s string) float64 {
+	m := isoDuration.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0
+	}
+
+	seconds := 0.0
+	for i, unit := range []float64{86400, 3600, 60, 1} {
+		if m[i+1] != "" {
+			value, _ := strconv.ParseFloat(m[i+1], 64)
+			seconds += value * unit
+		}
+	}
+	return seconds
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,166 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+const ProtocolFTP = "FTP"
+
+// ftpTransport fetches ftp:// links in passive binary mode, resuming with REST.
+type ftpTransport struct {
+	dialer *net.Dialer
+	_      struct{}
+}
+
+func (t *ftpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	host := req.URL.Hostname()
+	addr := req.URL.Host
+	if req.URL.Port() == "" {
+		addr = net.JoinHostPort(host, "21")
+	}
+
+	conn, err := t.dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	control := textproto.NewConn(conn)
+	fail := func(err error) (*http.Response, error) {
+		stop()
+		control.Close()
+		return nil, err
+	}
+
+	if _, _, err := control.ReadResponse(2); err != nil {
+		return fail(fmt.Errorf("ftp greeting: %v", err))
+	}
+
+	credentials := sourceCredentials(req, "anonymous", "anonymous@")
+	code, _, err := ftpCmd(control, 0, "USER %s", credentials.Username)
+	if err != nil {
+		return fail(fmt.Errorf("ftp login: %v", err))
+	}
+	if code == 331 {
+		if _, _, err := ftpCmd(control, 2, "PASS %s", credentials.Password); err != nil {
+			return fail(fmt.Errorf("ftp login: %v", err))
+		}
+	} else if code/100 != 2 {
+		return fail(fmt.Errorf("ftp login: unexpected response %d", code))
+	}
+
+	if _, _, err := ftpCmd(control, 2, "TYPE I"); err != nil {
+		return fail(fmt.Errorf("ftp binary mode: %v", err))
+	}
+
+	filePath := strings.TrimPrefix(req.URL.Path, "/")
+	size := int64(-1)
+	if _, msg, err := ftpCmd(control, 213, "SIZE %s", filePath); err == nil {
+		if n, err := strconv.ParseInt(strings.TrimSpace(msg), 10, 64); err == nil {
+			size = n
+		}
+	}
+
+	port, err := ftpPassive(control)
+	if err != nil {
+		return fail(err)
+	}
+	// The address in a PASV reply is often wrong behind NAT, and could point anywhere,
+	// so the data connection always goes to the host of the control connection.
+	dataConn, err := t.dialer.DialContext(ctx, "tcp", net.JoinHostPort(conn.RemoteAddr().(*net.TCPAddr).IP.String(), strconv.Itoa(port)))
+	if err != nil {
+		return fail(fmt.Errorf("ftp data connection: %v", err))
+	}
+	stopData := context.AfterFunc(ctx, func() { dataConn.Close() })
+
+	offset := rangeOffset(req)
+	if offset > 0 {
+		if _, _, err := ftpCmd(control, 3, "REST %d", offset); err != nil {
+			offset = 0 // the server cannot resume, start over
+		}
+	}
+
+	if _, _, err := ftpCmd(control, 1, "RETR %s", filePath); err != nil {
+		stopData()
+		dataConn.Close()
+		return fail(fmt.Errorf("ftp retrieve %s: %v", filePath, err))
+	}
+
+	body := &ftpBody{
+		data:    dataConn,
+		control: control,
+		stop: func() {
+			stopData()
+			stop()
+		},
+	}
+	return sourceResponse(req, ProtocolFTP, body, offset, size), nil
+}
+
+// ftpBody is the data connection of a transfer; closing it finishes the FTP session.
+type ftpBody struct {
+	data    net.Conn
+	control *textproto.Conn
+	stop    func()
+}
+
+func (b *ftpBody) Read(p []byte) (int, error) {
+	return b.data.Read(p)
+}
+
+func (b *ftpBody) Close() error {
+	b.stop()
+	b.data.Close()
+	// Best effort: the transfer result only matters if the whole body was read.
+	b.control.ReadResponse(2)
+	b.control.Cmd("QUIT")
+	return b.control.Close()
+}
+
+// ftpCmd sends a command and reads its reply; expectCode works like textproto.ReadResponse,
+// 0 accepts any code.
+func ftpCmd(c *textproto.Conn, expectCode int, format string, args ...any) (int, string, error) {
+	if _, err := c.Cmd(format, args...); err != nil {
+		return 0, "", err
+	}
+	return c.ReadResponse(expectCode)
+}
+
+// ftpPassive enters passive mode, with EPSV (RFC 2428) or else PASV, and returns the data port.
+func ftpPassive(c *textproto.Conn) (int, error) {
+	if _, msg, err := ftpCmd(c, 229, "EPSV"); err == nil {
+		// 229 Entering Extended Passive Mode (|||6446|)
+		start, end := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)")
+		if start >= 0 && end > start+4 {
+			if port, err := strconv.Atoi(msg[start+4 : end]); err == nil {
+				return port, nil
+			}
+		}
+	}
+
+	_, msg, err := ftpCmd(c, 227, "PASV")
+	if err != nil {
+		return 0, fmt.Errorf("ftp passive mode: %v", err)
+	}
+	// 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+	start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+	if start < 0 || end <= start {
+		return 0, fmt.Errorf("ftp passive mode: invalid reply %q", msg)
+	}
+	fields := strings.Split(msg[start+1:end], ",")
+	if len(fields) != 6 {
+		return 0, fmt.Errorf("ftp passive mode: invalid reply %q", msg)
+	}
+	p1, err1 := strconv.Atoi(strings.TrimSpace(fields[4]))
+	p2, err2 := strconv.Atoi(strings.TrimSpace(fields[5]))
+	if err1 != nil || err2 != nil {
+		return 0, fmt.Errorf("ftp passive mode: invalid reply %q", msg)
+	}
+	return p1*256 + p2, nil
+}
@@ -0,0 +1,187 @@
+package consumer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// parseHLS parses an HLS playlist. For a master playlist the variant with the highest
+// bandwidth is fetched and parsed instead. AES-128 keys are fetched once per URI.
+func (t *streamTransport) parseHLS(ctx context.Context, base *url.URL, body []byte, header http.Header) (*streamPlaylist, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(body), []byte("#EXTM3U")) {
+		return nil, errors.New("not an HLS playlist")
+	}
+
+	if variant, err := bestHLSVariant(base, body); err != nil {
+		return nil, err
+	} else if variant != nil {
+		body, _, err = t.get(ctx, variant.String(), header)
+		if err != nil {
+			return nil, fmt.Errorf("could not fetch variant playlist: %v", err)
+		}
+		base = variant
+	}
+
+	playlist := &streamPlaylist{protocol: ProtocolHLS, contentType: "video/mp2t"}
+	keys := make(map[string][]byte)
+	var key, iv []byte
+	var initURL string
+	var sequence int64
+	var byteRange struct{ offset, length int64 }
+	ended := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		tag, value, _ := strings.Cut(line, ":")
+
+		switch {
+		case line == "":
+		case tag == "#EXT-X-MEDIA-SEQUENCE":
+			sequence, _ = strconv.ParseInt(value, 10, 64)
+		case tag == "#EXT-X-ENDLIST":
+			ended = true
+		case tag == "#EXT-X-BYTERANGE":
+			length, offset, hasOffset := strings.Cut(value, "@")
+			byteRange.length, _ = strconv.ParseInt(length, 10, 64)
+			if hasOffset {
+				byteRange.offset, _ = strconv.ParseInt(offset, 10, 64)
+			}
+		case tag == "#EXT-X-MAP":
+			attrs := parseHLSAttributes(value)
+			u, err := resolveReference(base, attrs["URI"])
+			if err != nil {
+				return nil, err
+			}
+			if u.String() != initURL {
+				// the initialization section of fragmented MP4 segments, written once
+				initURL = u.String()
+				playlist.contentType = "video/mp4"
+				playlist.segments = append(playlist.segments, streamSegment{url: initURL})
+			}
+		case tag == "#EXT-X-KEY":
+			attrs := parseHLSAttributes(value)
+			switch attrs["METHOD"] {
+			case "NONE":
+				key, iv = nil, nil
+			case "AES-128":
+				u, err := resolveReference(base, attrs["URI"])
+				if err != nil {
+					return nil, err
+				}
+				if keys[u.String()] == nil {
+					data, _, err := t.get(ctx, u.String(), header)
+					if err != nil {
+						return nil, fmt.Errorf("could not fetch key: %v", err)
+					}
+					if len(data) != 16 {
+						return nil, errors.New("AES-128 key must be 16 bytes")
+					}
+					keys[u.String()] = data
+				}
+				key, iv = keys[u.String()], nil
+				if value := attrs["IV"]; value != "" {
+					decoded, err := hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(value, "0x"), "0X"))
+					if err != nil || len(decoded) != 16 {
+						return nil, fmt.Errorf("invalid IV %s", value)
+					}
+					iv = decoded
+				}
+			default:
+				return nil, fmt.Errorf("unsupported encryption %s", attrs["METHOD"])
+			}
+		case strings.HasPrefix(line, "#"):
+			// other tags and comments
+		default:
+			u, err := resolveReference(base, line)
+			if err != nil {
+				return nil, err
+			}
+			segment := streamSegment{url: u.String(), key: key, iv: iv}
+			if key != nil && iv == nil {
+				// without an IV attribute the media sequence number is the IV
+				segment.iv = binary.BigEndian.AppendUint64(make([]byte, 8), uint64(sequence))
+			}
+			if byteRange.length > 0 {
+				segment.offset, segment.length = byteRange.offset, byteRange.length
+				// the next range continues where this one ends unless it has an offset
+				byteRange.offset += byteRange.length
+				byteRange.length = 0
+			}
+			playlist.segments = append(playlist.segments, segment)
+			sequence++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !ended {
+		return nil, errors.New("live HLS playlists are not supported")
+	}
+
+	return playlist, nil
+}
+
+// bestHLSVariant returns the variant of a master playlist with the highest bandwidth, or nil
+// if body is a media playlist.
+func bestHLSVariant(base *url.URL, body []byte) (*url.URL, error) {
+	var best *url.URL
+	bestBandwidth := int64(-1)
+	bandwidth := int64(-1)
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if tag, value, _ := strings.Cut(line, ":"); tag == "#EXT-X-STREAM-INF" {
+			bandwidth, _ = strconv.ParseInt(parseHLSAttributes(value)["BANDWIDTH"], 10, 64)
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") || bandwidth < 0 {
+			continue
+		}
+
+		if bandwidth > bestBandwidth {
+			u, err := resolveReference(base, line)
+			if err != nil {
+				return nil, err
+			}
+			best, bestBandwidth = u, bandwidth
+		}
+		bandwidth = -1
+	}
+
+	return best, scanner.Err()
+}
+
+// parseHLSAttributes parses an attribute list like `METHOD=AES-128,URI="key.bin"`.
+func parseHLSAttributes(s string) map[string]string {
+	attrs := make(map[string]string)
+	for s != "" {
+		name, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			value, rest = rest[1:end+1], rest[min(end+2, len(rest)):]
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		attrs[strings.TrimSpace(name)] = value
+		s = strings.TrimPrefix(rest, ",")
+	}
+	return attrs
+}
@@ -0,0 +1,173 @@
+package consumer
+
+import (
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const ProtocolMaven = "MAVEN"
+
+// mavenTransport fetches maven://<repository>/<group>:<artifact>:<version>[:<classifier>][@<extension>]
+// links, e.g. maven://repo.maven.apache.org/maven2/com.google.guava:guava:33.0.0-jre: the artifact
+// (a jar unless the extension says otherwise), verified against the strongest checksum file
+// the repository publishes next to it. The version may be "latest" or "release", resolved
+// through the maven-metadata.xml of the artifact; snapshots are not supported.
+type mavenTransport struct {
+	client *http.Client
+	_      struct{}
+}
+
+// mavenChecksums are the checksum files looked for, strongest first.
+var mavenChecksums = []string{"sha512", "sha256", "sha1"}
+
+type mavenCoordinates struct {
+	group      string
+	artifact   string
+	version    string
+	classifier string
+	extension  string
+}
+
+func (t *mavenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	repository, coordinates, err := parseMavenLink(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	auth := registryAuthorization(req)
+	artifactPath := repository + "/" + strings.ReplaceAll(coordinates.group, ".", "/") + "/" + coordinates.artifact
+
+	if v := strings.ToLower(coordinates.version); v == "latest" || v == "release" {
+		coordinates.version, err = t.resolveVersion(req, artifactPath, v, auth)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if strings.HasSuffix(coordinates.version, "-SNAPSHOT") {
+		return nil, fmt.Errorf("maven snapshot versions are not supported")
+	}
+
+	fileName := coordinates.artifact + "-" + coordinates.version
+	if coordinates.classifier != "" {
+		fileName += "-" + coordinates.classifier
+	}
+	fileName += "." + coordinates.extension
+	fileURL := artifactPath + "/" + url.PathEscape(coordinates.version) + "/" + fileName
+
+	algorithm, sum, err := t.checksum(req, fileURL, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := registryGet(req, t.client, fileURL, "", auth)
+	if err != nil {
+		return nil, fmt.Errorf("maven artifact: %v", err)
+	}
+	contentType := mime.TypeByExtension("." + coordinates.extension)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	body := &checksumReader{body: resp.Body, hash: newChecksum(algorithm), algorithm: algorithm, want: sum}
+	return registryResponse(req, ProtocolMaven, body, resp.ContentLength, contentType), nil
+}
+
+// resolveVersion reads the latest or release version from the metadata of the artifact.
+func (t *mavenTransport) resolveVersion(req *http.Request, artifactPath string, which string, auth string) (string, error) {
+	resp, err := registryGet(req, t.client, artifactPath+"/maven-metadata.xml", "", auth)
+	if err != nil {
+		return "", fmt.Errorf("maven metadata: %v", err)
+	}
+	data, err := readRegistryMetadata(resp)
+	if err != nil {
+		return "", fmt.Errorf("maven metadata: %v", err)
+	}
+
+	var metadata struct {
+		Versioning struct {
+			Latest  string `xml:"latest"`
+			Release string `xml:"release"`
+		} `xml:"versioning"`
+	}
+	if err := xml.Unmarshal(data, &metadata); err != nil {
+		return "", fmt.Errorf("invalid maven metadata: %v", err)
+	}
+
+	version := metadata.Versioning.Release
+	if which == "latest" {
+		version = metadata.Versioning.Latest
+	}
+	if version == "" {
+		return "", fmt.Errorf("maven metadata has no %s version", which)
+	}
+	return version, nil
+}
+
+// checksum fetches the strongest checksum file published for the file.
+func (t *mavenTransport) checksum(req *http.Request, fileURL string, auth string) (string, []byte, error) {
+	for _, algorithm := range mavenChecksums {
+		resp, err := registryGet(req, t.client, fileURL+"."+algorithm, "", auth)
+		var statusErr *registryStatusError
+		if errors.As(err, &statusErr) && statusErr.statusCode == http.StatusNotFound {
+			continue
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("maven checksum: %v", err)
+		}
+		data, err := readRegistryMetadata(resp)
+		if err != nil {
+			return "", nil, fmt.Errorf("maven checksum: %v", err)
+		}
+
+		// Usually just the hex sum, sometimes followed by the file name.
+		fields := strings.Fields(string(data))
+		if len(fields) == 0 {
+			return "", nil, fmt.Errorf("empty maven %s checksum", algorithm)
+		}
+		sum, err := hex.DecodeString(fields[0])
+		if err != nil || len(sum) != newChecksum(algorithm).Size() {
+			return "", nil, fmt.Errorf("invalid maven %s checksum %q", algorithm, fields[0])
+		}
+		return algorithm, sum, nil
+	}
+	return "", nil, fmt.Errorf("repository publishes no %s checksum for %s", strings.Join(mavenChecksums, ", "), fileURL)
+}
+
+// parseMavenLink splits a maven link into the repository URL and the coordinates of the artifact.
+func parseMavenLink(u *url.URL) (string, mavenCoordinates, error) {
+	var coordinates mavenCoordinates
+
+	p := strings.Trim(u.Path, "/")
+	prefix, spec := "", p
+	if i := strings.LastIndex(p, "/"); i >= 0 {
+		prefix, spec = p[:i], p[i+1:]
+	}
+
+	spec, coordinates.extension, _ = strings.Cut(spec, "@")
+	if coordinates.extension == "" {
+		coordinates.extension = "jar"
+	}
+	parts := strings.Split(spec, ":")
+	if len(parts) < 3 || len(parts) > 4 {
+		return "", coordinates, fmt.Errorf("maven link must end with <group>:<artifact>:<version>[:<classifier>][@<extension>]")
+	}
+	for _, part := range append(parts, coordinates.extension) {
+		if part == "" || strings.ContainsAny(part, "/\\") || part == "." || part == ".." {
+			return "", coordinates, fmt.Errorf("invalid maven coordinates %q", spec)
+		}
+	}
+	coordinates.group, coordinates.artifact, coordinates.version = parts[0], parts[1], parts[2]
+	if len(parts) == 4 {
+		coordinates.classifier = parts[3]
+	}
+
+	repository := "https://" + u.Host
+	if prefix != "" {
+		repository += "/" + prefix
+	}
+	return repository, coordinates, nil
+}
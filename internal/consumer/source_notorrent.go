@@ -0,0 +1,28 @@
+//go:build !torrent
+
+package consumer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"example.com/internal/config"
+	"example.com/internal/repository"
+)
+
+// TorrentCompiled tells whether BitTorrent is compiled in.
+const TorrentCompiled = false
+
+type torrentTransport struct {
+	_ struct{}
+}
+
+func newTorrentTransport(ctx context.Context, repo repository.Repository, cfg *config.Config, dialer *net.Dialer) http.RoundTripper {
+	return &torrentTransport{}
+}
+
+func (t *torrentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, errors.New("BitTorrent is not compiled in (build with -tags torrent)")
+}
@@ -0,0 +1,119 @@
+package consumer
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const ProtocolNPM = "NPM"
+
+// npmTransport fetches npm://<registry>/<package>@<version> links, e.g.
+// npm://registry.npmjs.org/@types/node@20.11.0: the tarball of the version (or dist-tag) of
+// the package, verified against the integrity, or else the shasum, of the registry metadata.
+type npmTransport struct {
+	client *http.Client
+	_      struct{}
+}
+
+func (t *npmTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	registry, name, version, err := parseNPMLink(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	auth := registryAuthorization(req)
+
+	resp, err := registryGet(req, t.client, registry+"/"+url.PathEscape(name)+"/"+url.PathEscape(version), "application/json", auth)
+	if err != nil {
+		return nil, fmt.Errorf("npm metadata of %s@%s: %v", name, version, err)
+	}
+	data, err := readRegistryMetadata(resp)
+	if err != nil {
+		return nil, fmt.Errorf("npm metadata of %s@%s: %v", name, version, err)
+	}
+	var metadata struct {
+		Dist struct {
+			Tarball   string `json:"tarball"`
+			Integrity string `json:"integrity"`
+			Shasum    string `json:"shasum"`
+		} `json:"dist"`
+	}
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("invalid npm metadata of %s@%s: %v", name, version, err)
+	}
+
+	algorithm, sum, err := npmChecksum(metadata.Dist.Integrity, metadata.Dist.Shasum)
+	if err != nil {
+		return nil, fmt.Errorf("npm metadata of %s@%s: %v", name, version, err)
+	}
+	tarball, err := url.Parse(metadata.Dist.Tarball)
+	if err != nil || (tarball.Scheme != "https" && tarball.Scheme != "http") {
+		return nil, fmt.Errorf("npm metadata of %s@%s has no valid tarball url", name, version)
+	}
+	if tarball.Host != req.URL.Host {
+		auth = "" // the credentials are for the registry only
+	}
+
+	resp, err = registryGet(req, t.client, tarball.String(), "", auth)
+	if err != nil {
+		return nil, fmt.Errorf("npm tarball of %s@%s: %v", name, version, err)
+	}
+	body := &checksumReader{body: resp.Body, hash: newChecksum(algorithm), algorithm: algorithm, want: sum}
+	return registryResponse(req, ProtocolNPM, body, resp.ContentLength, "application/gzip"), nil
+}
+
+// parseNPMLink splits a npm link into the registry URL, the (possibly scoped) package name and
+// the version. The registry may have a path, as proxies like Artifactory serve several.
+func parseNPMLink(u *url.URL) (string, string, string, error) {
+	p := strings.Trim(u.Path, "/")
+	prefix, spec := "", p
+	if i := strings.LastIndex(p, "/"); i >= 0 {
+		prefix, spec = p[:i], p[i+1:]
+	}
+	if i := strings.LastIndex(prefix, "/"); strings.HasPrefix(prefix[i+1:], "@") {
+		spec = prefix[i+1:] + "/" + spec
+		prefix = prefix[:max(i, 0)]
+	}
+
+	at := strings.LastIndex(spec, "@")
+	if at <= 0 || at == len(spec)-1 {
+		return "", "", "", fmt.Errorf("npm link must end with <package>@<version>")
+	}
+
+	registry := "https://" + u.Host
+	if prefix != "" {
+		registry += "/" + prefix
+	}
+	return registry, spec[:at], spec[at+1:], nil
+}
+
+// npmChecksum picks the strongest hash of a Subresource Integrity string, falling back to the
+// SHA-1 shasum older packages only have.
+func npmChecksum(integrity string, shasum string) (string, []byte, error) {
+	for _, algorithm := range []string{"sha512", "sha384", "sha256", "sha1"} {
+		for _, entry := range strings.Fields(integrity) {
+			digest, ok := strings.CutPrefix(entry, algorithm+"-")
+			if !ok {
+				continue
+			}
+			sum, err := base64.StdEncoding.DecodeString(digest)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid integrity %q", entry)
+			}
+			return algorithm, sum, nil
+		}
+	}
+
+	if shasum != "" {
+		sum, err := hex.DecodeString(shasum)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid shasum %q", shasum)
+		}
+		return "sha1", sum, nil
+	}
+	return "", nil, fmt.Errorf("no integrity or shasum")
+}
@@ -0,0 +1,378 @@
+package consumer
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const ProtocolOCI = "OCI"
+
+// Media types of the image manifests and indexes, in their OCI and Docker flavors.
+const (
+	ociManifestType        = "application/vnd.oci.image.manifest.v1+json"
+	ociIndexType           = "application/vnd.oci.image.index.v1+json"
+	dockerManifestType     = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerManifestListType = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// DefaultOCIPlatform is the image picked from multi-platform images unless the link sets one.
+const DefaultOCIPlatform = "linux/amd64"
+
+var ociDigestPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociPlatform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// ociManifest is an image manifest or, with Manifests set, an index of them.
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Config    ociDescriptor   `json:"config"`
+	Layers    []ociDescriptor `json:"layers"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+// ociIndex is the index.json of the image layout.
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// ociTransport fetches oci://<registry>/<repository>[:<tag>|@<digest>] links, e.g.
+// oci://registry-1.docker.io/library/alpine:3.19: the manifest of the image (of the platform
+// given by ?platform=<os>/<arch>[/<variant>] for multi-platform images), its config and its
+// layers, assembled as a tar in the OCI image layout, which skopeo, podman and crane load.
+// Every blob is verified against its digest. Registries that answer with a bearer challenge
+// are given a token from their realm, requested with the basic credentials of the download.
+type ociTransport struct {
+	client *http.Client
+	_      struct{}
+}
+
+// ociSession is the state of one pull: the repository and the authorization for it.
+type ociSession struct {
+	req        *http.Request
+	client     *http.Client
+	base       string // https://<registry>/v2/<repository>
+	repository string
+	auth       string // replaced by a bearer token after a challenge
+	basic      string // basic credentials to request tokens with, if any
+}
+
+func (t *ociTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	repository, reference, err := parseOCIPath(req.URL.Path)
+	if err != nil {
+		return nil, err
+	}
+	platform := req.URL.Query().Get("platform")
+	if platform == "" {
+		platform = DefaultOCIPlatform
+	}
+
+	s := &ociSession{
+		req:        req,
+		client:     t.client,
+		base:       "https://" + req.URL.Host + "/v2/" + repository,
+		repository: repository,
+		auth:       registryAuthorization(req),
+	}
+	if strings.HasPrefix(s.auth, "Basic ") {
+		s.basic = s.auth
+	}
+
+	manifestData, manifestDesc, err := s.manifest(reference)
+	if err != nil {
+		return nil, err
+	}
+	var manifest ociManifest
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid image manifest: %v", err)
+	}
+	if manifestDesc.MediaType == ociIndexType || manifestDesc.MediaType == dockerManifestListType {
+		desc, err := pickOCIPlatform(manifest.Manifests, platform)
+		if err != nil {
+			return nil, err
+		}
+		if manifestData, manifestDesc, err = s.manifest(desc.Digest); err != nil {
+			return nil, err
+		}
+		manifest = ociManifest{}
+		if err := json.Unmarshal(manifestData, &manifest); err != nil {
+			return nil, fmt.Errorf("invalid image manifest: %v", err)
+		}
+	}
+	if manifestDesc.MediaType != ociManifestType && manifestDesc.MediaType != dockerManifestType {
+		return nil, fmt.Errorf("unsupported image manifest type %q", manifestDesc.MediaType)
+	}
+	if !strings.HasPrefix(reference, "sha256:") {
+		manifestDesc.Annotations = map[string]string{"org.opencontainers.image.ref.name": reference}
+	}
+
+	// The blobs are named by their digests in the tar, so only well formed ones are accepted.
+	blobs := []ociDescriptor{manifest.Config}
+	seen := map[string]bool{manifest.Config.Digest: true}
+	for _, layer := range manifest.Layers {
+		if !seen[layer.Digest] {
+			seen[layer.Digest] = true
+			blobs = append(blobs, layer)
+		}
+	}
+	for _, blob := range blobs {
+		if !ociDigestPattern.MatchString(blob.Digest) || blob.Size < 0 {
+			return nil, fmt.Errorf("unsupported blob digest %q", blob.Digest)
+		}
+	}
+
+	index, _ := json.Marshal(ociIndex{SchemaVersion: 2, MediaType: ociIndexType, Manifests: []ociDescriptor{manifestDesc}})
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`)},
+		{"index.json", index},
+		{ociBlobName(manifestDesc.Digest), manifestData},
+	}
+
+	size := int64(1024) // the end of archive marker
+	for _, file := range files {
+		size += tarEntrySize(int64(len(file.data)))
+	}
+	for _, blob := range blobs {
+		size += tarEntrySize(blob.Size)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		for _, file := range files {
+			if err := writeTarEntry(tw, file.name, int64(len(file.data)), bytes.NewReader(file.data)); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		for _, blob := range blobs {
+			if err := s.copyBlob(tw, blob); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(tw.Close())
+	}()
+
+	return registryResponse(req, ProtocolOCI, pr, size, "application/x-tar"), nil
+}
+
+// manifest fetches a manifest or index by tag or digest and returns it with its descriptor.
+func (s *ociSession) manifest(reference string) ([]byte, ociDescriptor, error) {
+	accept := strings.Join([]string{ociManifestType, ociIndexType, dockerManifestType, dockerManifestListType}, ", ")
+	resp, err := s.get("/manifests/"+reference, accept)
+	if err != nil {
+		return nil, ociDescriptor{}, fmt.Errorf("image manifest: %v", err)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	data, err := readRegistryMetadata(resp)
+	if err != nil {
+		return nil, ociDescriptor{}, fmt.Errorf("image manifest: %v", err)
+	}
+
+	sum := sha256.Sum256(data)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	if strings.HasPrefix(reference, "sha256:") && digest != reference {
+		return nil, ociDescriptor{}, fmt.Errorf("image manifest digest mismatch: expected %s, got %s", reference, digest)
+	}
+
+	var body struct {
+		MediaType string `json:"mediaType"`
+	}
+	json.Unmarshal(data, &body)
+	mediaType := body.MediaType
+	if mediaType == "" {
+		mediaType, _, _ = strings.Cut(contentType, ";")
+	}
+	return data, ociDescriptor{MediaType: mediaType, Digest: digest, Size: int64(len(data))}, nil
+}
+
+// copyBlob streams a blob into the tar, verifying its size and digest.
+func (s *ociSession) copyBlob(tw *tar.Writer, blob ociDescriptor) error {
+	resp, err := s.get("/blobs/"+blob.Digest, "")
+	if err != nil {
+		return fmt.Errorf("image blob %s: %v", blob.Digest, err)
+	}
+	defer resp.Body.Close()
+
+	h := sha256.New()
+	if err := writeTarEntry(tw, ociBlobName(blob.Digest), blob.Size, io.TeeReader(resp.Body, h)); err != nil {
+		return fmt.Errorf("image blob %s: %v", blob.Digest, err)
+	}
+	if digest := "sha256:" + hex.EncodeToString(h.Sum(nil)); digest != blob.Digest {
+		return fmt.Errorf("image blob digest mismatch: expected %s, got %s", blob.Digest, digest)
+	}
+	return nil
+}
+
+// get sends a GET to the registry API of the repository, answering a bearer challenge once.
+func (s *ociSession) get(path string, accept string) (*http.Response, error) {
+	resp, err := registryGet(s.req, s.client, s.base+path, accept, s.auth)
+	statusErr, ok := err.(*registryStatusError)
+	if !ok || statusErr.statusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	if err := s.authenticate(statusErr.header.Get("WWW-Authenticate")); err != nil {
+		return nil, err
+	}
+	return registryGet(s.req, s.client, s.base+path, accept, s.auth)
+}
+
+// authenticate requests a pull token from the realm of a bearer challenge.
+func (s *ociSession) authenticate(challenge string) error {
+	scheme, params := parseAuthChallenge(challenge)
+	if !strings.EqualFold(scheme, "Bearer") {
+		return fmt.Errorf("registry requires authentication")
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || (realm.Scheme != "https" && realm.Scheme != "http") {
+		return fmt.Errorf("registry has an invalid token realm %q", params["realm"])
+	}
+	query := realm.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + s.repository + ":pull"
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	resp, err := registryGet(s.req, s.client, realm.String(), "application/json", s.basic)
+	if err != nil {
+		return fmt.Errorf("registry token: %v", err)
+	}
+	data, err := readRegistryMetadata(resp)
+	if err != nil {
+		return fmt.Errorf("registry token: %v", err)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return fmt.Errorf("invalid registry token response: %v", err)
+	}
+	token := body.Token
+	if token == "" {
+		token = body.AccessToken
+	}
+	if token == "" {
+		return fmt.Errorf("registry token response has no token")
+	}
+	s.auth = "Bearer " + token
+	return nil
+}
+
+// parseOCIPath splits the path of an oci link into the repository and the tag or digest.
+func parseOCIPath(p string) (string, string, error) {
+	p = strings.Trim(p, "/")
+	repository, reference := p, "latest"
+	if i := strings.LastIndex(p, "@"); i >= 0 {
+		repository, reference = p[:i], p[i+1:]
+		if !ociDigestPattern.MatchString(reference) {
+			return "", "", fmt.Errorf("invalid image digest %q", reference)
+		}
+	} else if i := strings.LastIndex(p, ":"); i > strings.LastIndex(p, "/") {
+		repository, reference = p[:i], p[i+1:]
+	}
+	if repository == "" || reference == "" {
+		return "", "", fmt.Errorf("oci link must be oci://<registry>/<repository>[:<tag>|@<digest>]")
+	}
+	for _, part := range strings.Split(repository, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", "", fmt.Errorf("invalid image repository %q", repository)
+		}
+	}
+	return repository, reference, nil
+}
+
+// pickOCIPlatform returns the manifest of the platform (os/arch[/variant]) from an index.
+func pickOCIPlatform(manifests []ociDescriptor, platform string) (ociDescriptor, error) {
+	os, arch, _ := strings.Cut(platform, "/")
+	arch, variant, _ := strings.Cut(arch, "/")
+	for _, desc := range manifests {
+		if desc.Platform == nil || desc.Platform.OS != os || desc.Platform.Architecture != arch {
+			continue
+		}
+		if variant != "" && desc.Platform.Variant != variant {
+			continue
+		}
+		if !ociDigestPattern.MatchString(desc.Digest) {
+			return ociDescriptor{}, fmt.Errorf("unsupported manifest digest %q", desc.Digest)
+		}
+		return desc, nil
+	}
+	return ociDescriptor{}, fmt.Errorf("image has no %s manifest", platform)
+}
+
+// parseAuthChallenge parses a WWW-Authenticate header like
+// `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`.
+func parseAuthChallenge(challenge string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	params := make(map[string]string)
+	for rest != "" {
+		var key, value string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, " ,"), "=")
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		params[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+	return scheme, params
+}
+
+func ociBlobName(digest string) string {
+	return "blobs/sha256/" + strings.TrimPrefix(digest, "sha256:")
+}
+
+// tarEntrySize is the size of a file of n bytes in a ustar archive: a header block and the
+// data padded to whole blocks.
+func tarEntrySize(n int64) int64 {
+	return 512 + (n+511)/512*512
+}
+
+func writeTarEntry(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	// ustar, without any extended header, so that the size of the archive is known upfront.
+	header := &tar.Header{Typeflag: tar.TypeReg, Name: name, Size: size, Mode: 0o644, ModTime: time.Unix(0, 0), Format: tar.FormatUSTAR}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(tw, r, size); err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("shorter than %d bytes", size)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package consumer
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"slices"
+)
+
+// Artifacts of registries (OCI images, Maven and npm packages) are fetched over HTTPS by
+// sources that resolve the artifact from its coordinates and verify it against the digest or
+// checksum the registry publishes. A checksum covers the whole artifact, and a tag may point
+// to another one by the next attempt, so these sources always start over instead of resuming.
+
+// MaxRegistryMetadataBytes bounds the manifests, checksums and metadata read into memory.
+const MaxRegistryMetadataBytes = 4 << 20 // 4MB
+
+// RegistrySchemes are the schemes of the links fetched from artifact registries.
+var RegistrySchemes = []string{"oci", "maven", "npm"}
+
+func isRegistryScheme(scheme string) bool {
+	return slices.Contains(RegistrySchemes, scheme)
+}
+
+// registryAuthorization returns the Authorization header for the registry: the one set from
+// the origin profile of the download or else basic auth with its credentials, if any.
+func registryAuthorization(req *http.Request) string {
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		return auth
+	}
+	credentials := sourceCredentials(req, "", "")
+	if credentials.Username == "" {
+		return ""
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials.Username+":"+credentials.Password))
+}
+
+// registryGet sends a GET to the registry and fails unless it answers 200.
+func registryGet(req *http.Request, client *http.Client, link string, accept string, auth string) (*http.Response, error) {
+	r, err := http.NewRequestWithContext(req.Context(), "GET", link, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("User-Agent", req.Header.Get("User-Agent"))
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	if auth != "" {
+		r.Header.Set("Authorization", auth)
+	}
+
+	resp, err := client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &registryStatusError{link: link, statusCode: resp.StatusCode, header: resp.Header}
+	}
+	return resp, nil
+}
+
+type registryStatusError struct {
+	link       string
+	statusCode int
+	header     http.Header
+}
+
+func (e *registryStatusError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status code %d for %s", e.statusCode, e.link)
+}
+
+// readRegistryMetadata reads a small response body, up to MaxRegistryMetadataBytes.
+func readRegistryMetadata(resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MaxRegistryMetadataBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxRegistryMetadataBytes {
+		return nil, fmt.Errorf("%s is larger than %d bytes", resp.Request.URL, MaxRegistryMetadataBytes)
+	}
+	return data, nil
+}
+
+// newChecksum returns the hash of a checksum algorithm as registries name it, nil if unsupported.
+func newChecksum(algorithm string) hash.Hash {
+	switch algorithm {
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	case "sha384":
+		return sha512.New384()
+	case "sha512":
+		return sha512.New()
+	}
+	return nil
+}
+
+// checksumReader hashes the body it reads and fails at its end if the sum is not the expected one.
+type checksumReader struct {
+	body      io.ReadCloser
+	hash      hash.Hash
+	algorithm string
+	want      []byte
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF {
+		if n > 0 {
+			return n, nil // checked by the next read, which ends the body again
+		}
+		if sum := r.hash.Sum(nil); !bytes.Equal(sum, r.want) {
+			return 0, fmt.Errorf("%s checksum mismatch: expected %x, got %x", r.algorithm, r.want, sum)
+		}
+	}
+	return n, err
+}
+
+func (r *checksumReader) Close() error {
+	return r.body.Close()
+}
+
+// registryResponse answers the worker with the whole artifact, whatever offset it asked for.
+func registryResponse(req *http.Request, proto string, body io.ReadCloser, size int64, contentType string) *http.Response {
+	resp := sourceResponse(req, proto, body, 0, size)
+	resp.Header.Set("Content-Type", contentType)
+	return resp
+}
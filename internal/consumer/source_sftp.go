@@ -0,0 +1,276 @@
+package consumer
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const ProtocolSFTP = "SFTP"
+
+// Packet types and constants of the SFTP protocol version 3 (draft-ietf-secsh-filexfer-02),
+// only what is needed to read a file.
+const (
+	sftpInit    = 1
+	sftpVersion = 2
+	sftpOpen    = 3
+	sftpClose   = 4
+	sftpRead    = 5
+	sftpFstat   = 8
+	sftpStatus  = 101
+	sftpHandle  = 102
+	sftpData    = 103
+	sftpAttrs   = 105
+
+	sftpFlagRead     = 0x1
+	sftpAttrSize     = 0x1
+	sftpStatusEOF    = 1
+	sftpReadSize     = 32 * 1024
+	sftpMaxPacketLen = 256 * 1024
+)
+
+// sftpTransport fetches sftp:// links over SSH, resuming by reading from the offset.
+// The server must be known: either the host key is given with the credentials or it
+// is listed in the known_hosts file of the config.
+type sftpTransport struct {
+	dialer     *net.Dialer
+	knownHosts string
+	_          struct{}
+}
+
+func (t *sftpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	addr := req.URL.Host
+	if req.URL.Port() == "" {
+		addr = net.JoinHostPort(req.URL.Hostname(), "22")
+	}
+
+	credentials := sourceCredentials(req, "", "")
+	config := &ssh.ClientConfig{
+		User:    credentials.Username,
+		Timeout: t.dialer.Timeout,
+	}
+	if credentials.Password != "" {
+		config.Auth = append(config.Auth, ssh.Password(credentials.Password))
+	}
+	if credentials.PrivateKey != "" {
+		signer, err := ssh.ParsePrivateKey([]byte(credentials.PrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid sftp private key: %v", err)
+		}
+		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
+	}
+	switch {
+	case credentials.HostKey != "":
+		hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(credentials.HostKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid sftp host key: %v", err)
+		}
+		config.HostKeyCallback = ssh.FixedHostKey(hostKey)
+	case t.knownHosts != "":
+		callback, err := knownhosts.New(t.knownHosts)
+		if err != nil {
+			return nil, fmt.Errorf("could not read known hosts: %v", err)
+		}
+		config.HostKeyCallback = callback
+	default:
+		return nil, errors.New("sftp host key is unknown: give it with the credentials or configure SFTP_KNOWN_HOSTS")
+	}
+
+	conn, err := t.dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		stop()
+		conn.Close()
+		return nil, fmt.Errorf("ssh handshake: %v", err)
+	}
+	client := ssh.NewClient(sshConn, chans, reqs)
+
+	file, size, err := openSFTPFile(client, req.URL.Path)
+	if err != nil {
+		stop()
+		client.Close()
+		return nil, err
+	}
+
+	offset := rangeOffset(req)
+	file.offset = offset
+	file.stop = stop
+	return sourceResponse(req, ProtocolSFTP, file, offset, size), nil
+}
+
+// sftpFile reads a remote file sequentially, one READ request at a time.
+type sftpFile struct {
+	client  *ssh.Client
+	session *ssh.Session
+	w       io.WriteCloser
+	r       io.Reader
+	handle  string
+	offset  int64
+	nextID  uint32
+	stop    func() bool
+	once    sync.Once
+}
+
+func openSFTPFile(client *ssh.Client, path string) (*sftpFile, int64, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, 0, fmt.Errorf("ssh session: %v", err)
+	}
+	w, err := session.StdinPipe()
+	if err != nil {
+		return nil, 0, err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		return nil, 0, fmt.Errorf("sftp subsystem: %v", err)
+	}
+
+	f := &sftpFile{client: client, session: session, w: w, r: r}
+
+	// INIT carries no request id, only the version
+	if err := f.send(sftpInit, binary.BigEndian.AppendUint32(nil, 3)); err != nil {
+		return nil, 0, err
+	}
+	if typ, _, err := f.recv(); err != nil || typ != sftpVersion {
+		return nil, 0, fmt.Errorf("sftp init: unexpected reply %d: %v", typ, err)
+	}
+
+	payload := sftpString(nil, path)
+	payload = binary.BigEndian.AppendUint32(payload, sftpFlagRead)
+	payload = binary.BigEndian.AppendUint32(payload, 0) // no attributes
+	typ, data, err := f.request(sftpOpen, payload)
+	if err != nil {
+		return nil, 0, err
+	}
+	if typ != sftpHandle {
+		return nil, 0, fmt.Errorf("sftp open %s: %v", path, sftpError(typ, data))
+	}
+	f.handle, _ = sftpReadString(data)
+
+	size := int64(-1)
+	typ, data, err = f.request(sftpFstat, sftpString(nil, f.handle))
+	if err == nil && typ == sftpAttrs && len(data) >= 12 && binary.BigEndian.Uint32(data)&sftpAttrSize != 0 {
+		size = int64(binary.BigEndian.Uint64(data[4:]))
+	}
+
+	return f, size, nil
+}
+
+func (f *sftpFile) Read(p []byte) (int, error) {
+	n := len(p)
+	if n > sftpReadSize {
+		n = sftpReadSize
+	}
+
+	payload := sftpString(nil, f.handle)
+	payload = binary.BigEndian.AppendUint64(payload, uint64(f.offset))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(n))
+	typ, data, err := f.request(sftpRead, payload)
+	if err != nil {
+		return 0, err
+	}
+	if typ == sftpStatus && len(data) >= 4 && binary.BigEndian.Uint32(data) == sftpStatusEOF {
+		return 0, io.EOF
+	}
+	if typ != sftpData {
+		return 0, fmt.Errorf("sftp read: %v", sftpError(typ, data))
+	}
+
+	chunk, _ := sftpReadString(data)
+	copied := copy(p, chunk)
+	f.offset += int64(copied)
+	return copied, nil
+}
+
+func (f *sftpFile) Close() error {
+	f.once.Do(func() {
+		f.request(sftpClose, sftpString(nil, f.handle))
+		f.w.Close()
+		f.session.Close()
+		f.client.Close()
+		f.stop()
+	})
+	return nil
+}
+
+// request sends a packet with a new request id and returns the type and payload (after the id) of the reply.
+func (f *sftpFile) request(typ byte, payload []byte) (byte, []byte, error) {
+	f.nextID++
+	id := f.nextID
+	if err := f.send(typ, append(binary.BigEndian.AppendUint32(nil, id), payload...)); err != nil {
+		return 0, nil, err
+	}
+
+	replyType, reply, err := f.recv()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(reply) < 4 || binary.BigEndian.Uint32(reply) != id {
+		return 0, nil, fmt.Errorf("sftp: unexpected reply to request %d", id)
+	}
+	return replyType, reply[4:], nil
+}
+
+func (f *sftpFile) send(typ byte, payload []byte) error {
+	packet := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+	packet = append(packet, typ)
+	_, err := f.w.Write(append(packet, payload...))
+	return err
+}
+
+func (f *sftpFile) recv() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(f.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < 1 || length > sftpMaxPacketLen {
+		return 0, nil, fmt.Errorf("sftp: invalid packet length %d", length)
+	}
+	data := make([]byte, length-1)
+	if _, err := io.ReadFull(f.r, data); err != nil {
+		return 0, nil, err
+	}
+	return header[4], data, nil
+}
+
+func sftpString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+func sftpReadString(b []byte) (string, []byte) {
+	if len(b) < 4 {
+		return "", nil
+	}
+	n := binary.BigEndian.Uint32(b)
+	if uint32(len(b)-4) < n {
+		return "", nil
+	}
+	return string(b[4 : 4+n]), b[4+n:]
+}
+
+func sftpError(typ byte, data []byte) error {
+	if typ != sftpStatus || len(data) < 4 {
+		return fmt.Errorf("unexpected reply %d", typ)
+	}
+	msg, _ := sftpReadString(data[4:])
+	return fmt.Errorf("status %d: %s", binary.BigEndian.Uint32(data), msg)
+}
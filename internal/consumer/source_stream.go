@@ -0,0 +1,264 @@
+package consumer
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"example.com/internal/repository"
+)
+
+const (
+	ProtocolHLS  = "HLS"
+	ProtocolDASH = "DASH"
+)
+
+// MaxPlaylistBytes bounds the playlists and keys read into memory.
+const MaxPlaylistBytes = 4 << 20 // 4MB
+
+// streamPlaylist is a parsed HLS or DASH playlist: the segments that, concatenated in order,
+// make up the output file.
+type streamPlaylist struct {
+	protocol    string
+	contentType string // of the concatenated segments
+	segments    []streamSegment
+}
+
+type streamSegment struct {
+	url    string
+	offset int64 // byte range within url, only if length > 0
+	length int64
+	key    []byte // AES-128 key for HLS, nil if the segment is not encrypted
+	iv     []byte
+}
+
+// streamTransport captures HLS (m3u8) and DASH (MPD) playlist links: it fetches the playlist,
+// downloads the segments of the best variant concurrently, and streams them concatenated in
+// order to the worker. Only complete (VOD) playlists are supported. Resuming re-fetches the
+// segments before the offset and skips their bytes, since segment sizes are not known upfront.
+type streamTransport struct {
+	client      *http.Client
+	repo        repository.Repository
+	concurrency int
+	_           struct{}
+}
+
+// isPlaylistLink reports whether the path of u ends like an HLS or DASH playlist.
+func isPlaylistLink(u *url.URL) bool {
+	ext := strings.ToLower(path.Ext(u.Path))
+	return ext == ".m3u8" || ext == ".mpd"
+}
+
+// isPlaylistType reports whether contentType is the media type of an HLS or DASH playlist.
+func isPlaylistType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch strings.ToLower(mediaType) {
+	case "application/vnd.apple.mpegurl", "application/x-mpegurl", "audio/mpegurl", "application/dash+xml":
+		return true
+	}
+	return false
+}
+
+func (t *streamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+
+	body, contentType, err := t.get(ctx, req.URL.String(), req.Header)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch playlist: %v", err)
+	}
+
+	var playlist *streamPlaylist
+	if strings.Contains(contentType, "dash") || strings.HasPrefix(strings.TrimSpace(string(body)), "<") {
+		playlist, err = parseDASH(req.URL, body)
+	} else {
+		playlist, err = t.parseHLS(ctx, req.URL, body, req.Header)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(playlist.segments) == 0 {
+		return nil, errors.New("playlist has no segments")
+	}
+
+	offset := rangeOffset(req)
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(t.capture(ctx, sourceDownloadID(req), playlist, req.Header, offset, pw))
+	}()
+
+	resp := sourceResponse(req, playlist.protocol, pr, offset, -1)
+	resp.Header.Set("Content-Type", playlist.contentType)
+	return resp, nil
+}
+
+// capture downloads the segments, up to concurrency at a time, and writes them in order to
+// w, skipping the first offset bytes. Progress is reported by segment count.
+func (t *streamTransport) capture(ctx context.Context, downloadID int64, playlist *streamPlaylist, header http.Header, offset int64, w io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	results := make([]chan result, len(playlist.segments))
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+
+	// Segments are fetched in order, at most concurrency ahead of the one being written.
+	sem := make(chan struct{}, t.concurrency)
+	go func() {
+		for i, segment := range playlist.segments {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func(i int, segment streamSegment) {
+				data, err := t.fetchSegment(ctx, segment, header)
+				results[i] <- result{data, err}
+			}(i, segment)
+		}
+	}()
+
+	progress := repository.Progress{TotalBytes: -1, Segments: int64(len(playlist.segments))}
+	var speed speedMeter
+	written := int64(0)
+	for i := range playlist.segments {
+		var r result
+		select {
+		case r = <-results[i]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		<-sem
+		if r.err != nil {
+			return fmt.Errorf("segment %d of %d: %v", i+1, len(playlist.segments), r.err)
+		}
+
+		data := r.data
+		if skip := offset - written; skip > 0 {
+			written += min(skip, int64(len(data)))
+			data = data[min(skip, int64(len(data))):]
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		written += int64(len(data))
+
+		progress.SegmentsCompleted = int64(i + 1)
+		progress.Bytes = written
+		speed.measure(&progress, time.Now())
+		if err := t.repo.SetProgress(ctx, downloadID, progress); err != nil && ctx.Err() == nil {
+			log.Println(err)
+		}
+	}
+
+	return nil
+}
+
+func (t *streamTransport) fetchSegment(ctx context.Context, segment streamSegment, header http.Header) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", segment.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", header.Get("User-Agent"))
+	if segment.length > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", segment.offset, segment.offset+segment.length-1))
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("unexpected HTTP status code %d for %s", resp.StatusCode, segment.url)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK && segment.length > 0 {
+		// the origin ignored the byte range
+		if segment.offset+segment.length > int64(len(data)) {
+			return nil, fmt.Errorf("byte range of %s is out of bounds", segment.url)
+		}
+		data = data[segment.offset : segment.offset+segment.length]
+	}
+
+	if segment.key != nil {
+		return decryptSegment(data, segment.key, segment.iv)
+	}
+	return data, nil
+}
+
+// get fetches a playlist or key, which are small enough to be read into memory.
+func (t *streamTransport) get(ctx context.Context, link string, header http.Header) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", link, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("User-Agent", header.Get("User-Agent"))
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unexpected HTTP status code %d for %s", resp.StatusCode, link)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MaxPlaylistBytes+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) > MaxPlaylistBytes {
+		return nil, "", fmt.Errorf("%s is larger than %d bytes", link, MaxPlaylistBytes)
+	}
+	return data, resp.Header.Get("Content-Type"), nil
+}
+
+// resolveReference resolves a link found in a playlist against the playlist's URL, allowing only http(s).
+func resolveReference(base *url.URL, ref string) (*url.URL, error) {
+	u, err := base.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return nil, fmt.Errorf("invalid link %q in playlist: %v", ref, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported link %q in playlist", ref)
+	}
+	return u, nil
+}
+
+// decryptSegment decrypts an AES-128 (CBC, PKCS#7) encrypted HLS segment.
+func decryptSegment(data []byte, key []byte, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("encrypted segment is not a multiple of the block size")
+	}
+
+	plaintext := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, data)
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize || padding > len(plaintext) {
+		return nil, errors.New("invalid padding of encrypted segment")
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
@@ -0,0 +1,247 @@
+//go:build torrent
+
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"example.com/internal/config"
+	"example.com/internal/repository"
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/iplist"
+)
+
+// TorrentCompiled tells whether BitTorrent is compiled in.
+const TorrentCompiled = true
+
+const ProtocolTorrent = "BitTorrent"
+const TorrentProgressInterval = 1 * time.Second
+
+// torrentTransport fetches magnet links with an embedded BitTorrent engine, shared by all
+// workers and started on the first magnet link. The largest file of the torrent is streamed
+// to the worker like any other source (seeking to the offset to resume) while the engine
+// reports piece progress. Completed payloads are seeded until TORRENT_SEED_RATIO is reached.
+type torrentTransport struct {
+	ctx    context.Context
+	repo   repository.Repository
+	cfg    *config.Config
+	dialer *net.Dialer
+
+	once   sync.Once
+	client *torrent.Client
+	err    error
+	_      struct{}
+}
+
+func newTorrentTransport(ctx context.Context, repo repository.Repository, cfg *config.Config, dialer *net.Dialer) http.RoundTripper {
+	return &torrentTransport{
+		ctx:    ctx,
+		repo:   repo,
+		cfg:    cfg,
+		dialer: dialer,
+	}
+}
+
+func (t *torrentTransport) engine() (*torrent.Client, error) {
+	t.once.Do(func() {
+		clientConfig := torrent.NewDefaultClientConfig()
+		clientConfig.DataDir = t.cfg.TorrentDataDir
+		clientConfig.ListenPort = int(t.cfg.TorrentListenPort)
+		clientConfig.Seed = t.cfg.TorrentSeedRatio > 0
+		clientConfig.NoDefaultPortForwarding = true
+		clientConfig.HTTPDialContext = t.dialer.DialContext // trackers
+		if !t.cfg.AllowPrivateNetworks {
+			clientConfig.IPBlocklist = guardRanger{t.dialer}
+		}
+
+		t.client, t.err = torrent.NewClient(clientConfig)
+		if t.err != nil {
+			t.err = fmt.Errorf("could not start BitTorrent engine: %v", t.err)
+			return
+		}
+		go func() {
+			<-t.ctx.Done()
+			t.client.Close()
+		}()
+	})
+	return t.client, t.err
+}
+
+func (t *torrentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	client, err := t.engine()
+	if err != nil {
+		return nil, err
+	}
+
+	tor, err := client.AddMagnet(req.URL.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid magnet link: %v", err)
+	}
+	select {
+	case <-tor.GotInfo():
+	case <-ctx.Done():
+		tor.Drop()
+		return nil, fmt.Errorf("could not get torrent metadata: %v", ctx.Err())
+	}
+
+	var file *torrent.File
+	for _, f := range tor.Files() {
+		if file == nil || f.Length() > file.Length() {
+			file = f
+		}
+	}
+	if file == nil {
+		tor.Drop()
+		return nil, fmt.Errorf("torrent %s has no files", tor.Name())
+	}
+	if len(tor.Files()) > 1 {
+		log.Printf("Torrent %s has %d files, downloading the largest: %s\n", tor.Name(), len(tor.Files()), file.DisplayPath())
+	}
+	file.Download()
+
+	offset := rangeOffset(req)
+	reader := file.NewReader()
+	reader.SetResponsive()
+	if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+		reader.Close()
+		tor.Drop()
+		return nil, err
+	}
+
+	downloadID := sourceDownloadID(req)
+	reportCtx, stopReporting := context.WithCancel(t.ctx)
+	go t.reportProgress(reportCtx, downloadID, tor)
+
+	body := &torrentBody{ctx: ctx, reader: reader, length: file.Length() - offset}
+	body.done = func() {
+		stopReporting()
+		if body.completed && t.cfg.TorrentSeedRatio > 0 {
+			go t.seed(downloadID, tor)
+			return
+		}
+		t.drop(tor)
+	}
+	return sourceResponse(req, ProtocolTorrent, body, offset, file.Length()), nil
+}
+
+// seed keeps a completed torrent in the swarm until its seed ratio is reached or the
+// engine stops, reporting the ratio meanwhile.
+func (t *torrentTransport) seed(downloadID int64, tor *torrent.Torrent) {
+	ticker := time.NewTicker(TorrentProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
+			progress := torrentProgress(tor)
+			t.repo.SetProgress(t.ctx, downloadID, progress) // best effort, like the worker's reports
+			if progress.SeedRatio >= t.cfg.TorrentSeedRatio {
+				log.Printf("Torrent %s reached seed ratio %.2f\n", tor.Name(), progress.SeedRatio)
+				t.drop(tor)
+				return
+			}
+		}
+	}
+}
+
+func (t *torrentTransport) reportProgress(ctx context.Context, downloadID int64, tor *torrent.Torrent) {
+	ticker := time.NewTicker(TorrentProgressInterval)
+	defer ticker.Stop()
+	var speed speedMeter
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			progress := torrentProgress(tor)
+			speed.measure(&progress, time.Now())
+			if err := t.repo.SetProgress(ctx, downloadID, progress); err != nil && ctx.Err() == nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// drop removes the torrent from the engine along with its payload, which has been copied to the download's file.
+func (t *torrentTransport) drop(tor *torrent.Torrent) {
+	name := filepath.Base(tor.Name())
+	tor.Drop()
+	if name != "." && name != ".." && name != string(filepath.Separator) {
+		if err := os.RemoveAll(filepath.Join(t.cfg.TorrentDataDir, name)); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func torrentProgress(tor *torrent.Torrent) repository.Progress {
+	progress := repository.Progress{
+		Bytes:      tor.BytesCompleted(),
+		TotalBytes: tor.Length(),
+		Pieces:     int64(tor.NumPieces()),
+	}
+	for _, run := range tor.PieceStateRuns() {
+		if run.Complete {
+			progress.PiecesCompleted += int64(run.Length)
+		}
+	}
+	stats := tor.Stats()
+	if downloaded := stats.BytesReadData.Int64(); downloaded > 0 {
+		progress.SeedRatio = float64(stats.BytesWrittenData.Int64()) / float64(downloaded)
+	}
+	return progress
+}
+
+// torrentBody reads a file of a torrent, waiting for its pieces as needed.
+type torrentBody struct {
+	ctx       context.Context
+	reader    torrent.Reader
+	length    int64 // left to read
+	completed bool  // the whole file was read
+	done      func()
+	once      sync.Once
+}
+
+func (b *torrentBody) Read(p []byte) (int, error) {
+	if b.length <= 0 {
+		b.completed = true
+		return 0, io.EOF
+	}
+	n, err := b.reader.ReadContext(b.ctx, p)
+	b.length -= int64(n)
+	return n, err
+}
+
+func (b *torrentBody) Close() error {
+	b.once.Do(func() {
+		b.reader.Close()
+		b.done()
+	})
+	return nil
+}
+
+// guardRanger blocks peers on addresses the dialer's guard refuses.
+type guardRanger struct {
+	dialer *net.Dialer
+}
+
+func (g guardRanger) Lookup(ip net.IP) (iplist.Range, bool) {
+	if err := g.dialer.Control("tcp", net.JoinHostPort(ip.String(), "0"), nil); err != nil {
+		return iplist.Range{First: ip, Last: ip, Description: err.Error()}, true
+	}
+	return iplist.Range{}, false
+}
+
+func (g guardRanger) NumRanges() int {
+	return 0
+}
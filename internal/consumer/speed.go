@@ -0,0 +1,42 @@
+package consumer
+
+import (
+	"time"
+
+	"example.com/internal/repository"
+)
+
+// SpeedWindow is the span of the progress reports the transfer speed of a download is
+// averaged over.
+const SpeedWindow = 10 * time.Second
+
+type speedSample struct {
+	at    time.Time
+	bytes int64
+}
+
+// speedMeter computes the transfer speed of a download from its progress reports.
+type speedMeter struct {
+	samples []speedSample // the reports of the last SpeedWindow, and the one before them
+}
+
+// measure records the bytes of the progress and sets its speed, over the last SpeedWindow,
+// and its ETA, -1 while the speed or the size of the file is unknown.
+func (m *speedMeter) measure(progress *repository.Progress, at time.Time) {
+	if len(m.samples) > 0 && progress.Bytes < m.samples[len(m.samples)-1].bytes {
+		m.samples = m.samples[:0] // started over
+	}
+	m.samples = append(m.samples, speedSample{at: at, bytes: progress.Bytes})
+	for len(m.samples) > 2 && at.Sub(m.samples[1].at) >= SpeedWindow {
+		m.samples = m.samples[1:]
+	}
+
+	progress.BytesPerSec, progress.ETA = 0, -1
+	first := m.samples[0]
+	if elapsed := at.Sub(first.at); elapsed > 0 {
+		progress.BytesPerSec = int64(float64(progress.Bytes-first.bytes) / elapsed.Seconds())
+	}
+	if progress.BytesPerSec > 0 && progress.TotalBytes >= 0 {
+		progress.ETA = max(progress.TotalBytes-progress.Bytes, 0) / progress.BytesPerSec
+	}
+}
@@ -0,0 +1,49 @@
+package consumer
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"example.com/internal/metrics"
+	"example.com/internal/repository"
+)
+
+func init() {
+	metrics.Register("downloader_queue_length", metrics.KindGauge, "Download requests waiting in the queue.")
+	metrics.Register("downloader_queue_oldest_age_seconds", metrics.KindGauge, "How long the oldest download request not started yet has been queued.")
+	metrics.Register("downloader_queue_unacked", metrics.KindGauge, "Download requests read from the queue and not acknowledged yet.")
+	metrics.Register("downloader_downloads", metrics.KindGauge, "Download requests per state.")
+}
+
+// recordQueueStats snapshots the queue statistics into the metrics registry every interval,
+// so they are both scraped from /metrics and pushed along with the other metrics.
+func recordQueueStats(ctx context.Context, repo repository.Repository, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		stats, err := repo.GetQueueStats(ctx)
+		if err != nil {
+			log.Printf("Could not record queue statistics: %v", err)
+		} else {
+			metrics.Set("downloader_queue_length", nil, float64(stats.Queued))
+			metrics.Set("downloader_queue_unacked", nil, float64(stats.Unacked))
+			metrics.Set("downloader_downloads", metrics.Labels{"state": "pending"}, float64(stats.Pending))
+			metrics.Set("downloader_downloads", metrics.Labels{"state": "completed"}, float64(stats.Completed))
+			metrics.Set("downloader_downloads", metrics.Labels{"state": "failed"}, float64(stats.Failed))
+			metrics.Set("downloader_downloads", metrics.Labels{"state": "expired"}, float64(stats.Expired))
+		}
+		if age, err := repo.OldestQueuedAge(ctx); err != nil {
+			log.Printf("Could not record queue statistics: %v", err)
+		} else {
+			metrics.Set("downloader_queue_oldest_age_seconds", nil, age.Seconds())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"example.com/internal/coldstore"
+	"example.com/internal/config"
+	"example.com/internal/metrics"
+	"example.com/internal/repository"
+	"example.com/internal/safepath"
+)
+
+const TieringBatchSize = 100
+
+func init() {
+	metrics.Register("downloader_cold_files_total", metrics.KindCounter, "Files of completed downloads moved to cold storage.")
+	metrics.Register("downloader_cold_bytes_total", metrics.KindCounter, "Bytes of the files moved to cold storage.")
+	metrics.Register("downloader_restored_files_total", metrics.KindCounter, "Files restored from cold storage to a disk.")
+}
+
+// tierFiles periodically moves the files of the downloads that completed more than
+// COLD_STORAGE_AFTER ago from the disk of this process to cold storage, and restores the
+// files their owners asked back. Any process restores a file, onto its own disk.
+func tierFiles(ctx context.Context, repo repository.Repository, cfg *config.Config, cold coldstore.Store) {
+	ticker := time.NewTicker(cfg.ColdStorageInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		downloads, err := repo.GetRestoringDownloads(ctx, TieringBatchSize)
+		if err != nil {
+			log.Printf("Could not restore files from cold storage: %v", err)
+		}
+		for _, download := range downloads {
+			if err := restoreFile(ctx, repo, cfg, cold, download.ID); err != nil {
+				log.Printf("Could not restore file of download request %d: %v", download.ID, err)
+			}
+		}
+
+		for {
+			downloads, err := repo.GetTieringCandidates(ctx, cfg.InstanceID, cfg.ColdStorageAfter, TieringBatchSize)
+			if err != nil {
+				log.Printf("Could not move files to cold storage: %v", err)
+				break
+			}
+
+			moved := 0
+			for _, download := range downloads {
+				if err := moveToCold(ctx, repo, cfg, cold, download.ID, download.FileName); err != nil {
+					log.Printf("Could not move file of download request %d to cold storage: %v", download.ID, err)
+					continue
+				}
+				moved++
+			}
+			if len(downloads) < TieringBatchSize || moved == 0 {
+				break
+			}
+		}
+	}
+}
+
+// coldKey is where the file of a download is kept in cold storage.
+func coldKey(downloadID int64, fileName string) string {
+	return fmt.Sprintf("downloads/%d/%s", downloadID, filepath.Base(fileName))
+}
+
+// moveToCold uploads the file and only then removes it from the disk, holding the lock of the
+// download meanwhile like collectPartialFile.
+func moveToCold(ctx context.Context, repo repository.Repository, cfg *config.Config, cold coldstore.Store, downloadID int64, fileName string) error {
+	token := newLockToken()
+	acquired, err := repo.AcquireLock(ctx, downloadID, token, LinkProcessingExpTime)
+	if err != nil {
+		return err
+	}
+	if !acquired {
+		return errors.New("download request is being processed")
+	}
+	defer repo.ReleaseLock(ctx, downloadID, token)
+
+	download, err := repo.GetDownloadRequest(ctx, downloadID)
+	if err != nil {
+		return err
+	}
+	if download.Tier != repository.TierHot {
+		return nil // moved since it was listed
+	}
+
+	file, err := os.Open(safepath.Long(fileName))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	key := coldKey(downloadID, fileName)
+	if err := cold.Put(ctx, key, file, info.Size()); err != nil {
+		return err
+	}
+	if err := repo.SetTier(ctx, downloadID, repository.TierCold, key, cfg.InstanceID); err != nil {
+		return err
+	}
+	invalidateDownloadList(ctx, repo, cfg, download.UserID)
+	if err := os.Remove(fileName); err != nil {
+		log.Println(err)
+	}
+	if download.ContentHash != "" {
+		// The cold copy is a copy of its own, the file no longer shares the stored content.
+		releaseContent(ctx, repo, cfg, download.ContentHash)
+		if err := repo.SetContentHash(ctx, downloadID, ""); err != nil {
+			log.Println(err)
+		}
+	}
+
+	metrics.Add("downloader_cold_files_total", nil, 1)
+	metrics.Add("downloader_cold_bytes_total", nil, float64(info.Size()))
+	log.Printf("Moved file of download request %d to cold storage: %d bytes\n", downloadID, info.Size())
+	return nil
+}
+
+// restoreFile copies the file of a download back from cold storage to the disk of this process
+// and deletes it from cold storage.
+func restoreFile(ctx context.Context, repo repository.Repository, cfg *config.Config, cold coldstore.Store, downloadID int64) error {
+	token := newLockToken()
+	acquired, err := repo.AcquireLock(ctx, downloadID, token, LinkProcessingExpTime)
+	if err != nil {
+		return err
+	}
+	if !acquired {
+		return errors.New("download request is being processed")
+	}
+	defer repo.ReleaseLock(ctx, downloadID, token)
+
+	download, err := repo.GetDownloadRequest(ctx, downloadID)
+	if err != nil {
+		return err
+	}
+	if download.Tier != repository.TierRestoring {
+		return nil // restored by another process since it was listed
+	}
+
+	body, _, err := cold.Get(ctx, download.ColdKey)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if dir := filepath.Dir(download.FileName); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	target := safepath.Long(download.FileName)
+	tmp := target + ".restore"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	size, err := io.Copy(file, body)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, target)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := repo.SetTier(ctx, downloadID, repository.TierHot, "", cfg.InstanceID); err != nil {
+		return err
+	}
+	invalidateDownloadList(ctx, repo, cfg, download.UserID)
+	if err := cold.Delete(ctx, download.ColdKey); err != nil {
+		log.Println(err)
+	}
+
+	metrics.Add("downloader_restored_files_total", nil, 1)
+	log.Printf("Restored file of download request %d from cold storage: %d bytes\n", downloadID, size)
+	return nil
+}
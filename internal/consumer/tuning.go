@@ -0,0 +1,93 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"example.com/internal/httpclient"
+	"example.com/internal/repository"
+)
+
+var errReadTimeout = errors.New("read timeout")
+
+// transferTuning is how a download is transferred: the defaults of the workers, with the
+// overrides of the download.
+type transferTuning struct {
+	chunkSize      int64 // bytes read from the origin at once
+	flushThreshold int64 // bytes written between syncs of the file
+	readTimeout    time.Duration
+	congestion     string
+	encoding       string // one of the repository.ContentEncoding* constants
+
+	ctx     context.Context         // of the requests, set by apply
+	stalled context.CancelCauseFunc // cancels ctx when a read took longer than readTimeout
+	_       struct{}
+}
+
+func newTransferTuning(tuning repository.Tuning) *transferTuning {
+	t := &transferTuning{
+		chunkSize:      DownloadBuffSizeBytes,
+		flushThreshold: FlushThresholdBytes,
+		readTimeout:    time.Duration(tuning.ReadTimeoutSeconds) * time.Second,
+		congestion:     tuning.TCPCongestion,
+		encoding:       tuning.ContentEncoding,
+	}
+	if tuning.ChunkSizeBytes > 0 {
+		t.chunkSize = tuning.ChunkSizeBytes
+	}
+	if tuning.FlushThresholdBytes > 0 {
+		t.flushThreshold = tuning.FlushThresholdBytes
+	}
+	if t.encoding == "" {
+		t.encoding = repository.ContentEncodingIdentity
+	}
+	return t
+}
+
+// apply returns the context of the requests of the download, and a function releasing it.
+func (t *transferTuning) apply(ctx context.Context) (context.Context, func()) {
+	if t.congestion != "" {
+		ctx = httpclient.WithCongestion(ctx, t.congestion)
+	}
+	t.ctx = ctx
+	if t.readTimeout <= 0 {
+		return ctx, func() {}
+	}
+	t.ctx, t.stalled = context.WithCancelCause(ctx)
+	return t.ctx, func() { t.stalled(nil) }
+}
+
+// body returns the body of a response to a request made with the context of apply, whose
+// reads fail after readTimeout. The time spent between reads, e.g. throttled, does not count.
+func (t *transferTuning) body(body io.ReadCloser) io.ReadCloser {
+	if t.readTimeout <= 0 {
+		return body
+	}
+	timer := time.AfterFunc(t.readTimeout, func() {
+		t.stalled(fmt.Errorf("%w: the origin sent nothing for %v", errReadTimeout, t.readTimeout))
+	})
+	timer.Stop()
+	return &readTimeoutBody{ReadCloser: body, t: t, timer: timer}
+}
+
+type readTimeoutBody struct {
+	io.ReadCloser
+	t     *transferTuning
+	timer *time.Timer
+	_     struct{}
+}
+
+func (b *readTimeoutBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.t.readTimeout)
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Stop()
+	if err != nil && err != io.EOF {
+		if cause := context.Cause(b.t.ctx); errors.Is(cause, errReadTimeout) {
+			return n, cause
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,93 @@
+package flags
+
+import (
+	"context"
+	"hash/fnv"
+	"log"
+	"strconv"
+
+	"example.com/internal/repository"
+)
+
+const SegmentedDownloads = "segmented_downloads"
+const BatchDownloads = "batch_downloads"
+const CompletionScripts = "completion_scripts"
+
+// Flag is a behavior that can be rolled out gradually. Default applies while no admin set
+// the flag, or when it cannot be read.
+type Flag struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Default     bool   `json:"default"`
+}
+
+// Known are the flags the code checks. Others cannot be set.
+var Known = []Flag{
+	{Name: SegmentedDownloads, Description: "fetch large files over several connections", Default: true},
+	{Name: BatchDownloads, Description: "create downloads with POST /downloads/batch", Default: true},
+	{Name: CompletionScripts, Description: "run sandboxed scripts on the completed files", Default: false},
+}
+
+// Lookup returns the known flag with the name.
+func Lookup(name string) (Flag, bool) {
+	for _, flag := range Known {
+		if flag.Name == name {
+			return flag, true
+		}
+	}
+	return Flag{}, false
+}
+
+type flags struct {
+	repo repository.Repository
+	_    struct{}
+}
+
+type Flags interface {
+	// Enabled reports whether the flag is on for the user.
+	Enabled(ctx context.Context, name string, userID int64) bool
+}
+
+func (f *flags) Enabled(ctx context.Context, name string, userID int64) bool {
+	known, ok := Lookup(name)
+	if !ok {
+		return false
+	}
+
+	flag, found, err := f.repo.GetFeatureFlag(ctx, name)
+	if err != nil {
+		log.Println(err)
+		return known.Default
+	}
+	if !found {
+		return known.Default
+	}
+	return Evaluate(flag, userID)
+}
+
+// Evaluate reports whether the flag is on for the user: a listed one, or one whose bucket is
+// below the rollout percentage.
+func Evaluate(flag repository.FeatureFlag, userID int64) bool {
+	if !flag.Enabled {
+		return false
+	}
+	for _, id := range flag.UserIDs {
+		if id == userID {
+			return true
+		}
+	}
+	return bucket(flag.Name, userID) < flag.RolloutPercent
+}
+
+// bucket places the user in one of 100 buckets, the same in every process. It is hashed with
+// the flag name so that the first users of a rollout are not the same for every flag, and
+// raising the percentage only adds users.
+func bucket(name string, userID int64) int64 {
+	h := fnv.New32a()
+	h.Write([]byte(name + ":" + strconv.FormatInt(userID, 10)))
+	return int64(h.Sum32() % 100)
+}
+
+func New(repo repository.Repository) Flags {
+	return &flags{repo: repo}
+}
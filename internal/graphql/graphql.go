@@ -0,0 +1,76 @@
+// Package graphql is the GraphQL schema of schema.graphqls, executed by gqlgen. The resolvers
+// are in the handler package.
+package graphql
+
+//go:generate go run github.com/99designs/gqlgen@v0.17.49 generate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/99designs/gqlgen/graphql"
+)
+
+// MarshalStringMap writes the StringMap scalar, an object of string values.
+func MarshalStringMap(m map[string]string) graphql.Marshaler {
+	return graphql.WriterFunc(func(w io.Writer) {
+		writeJSON(w, m)
+	})
+}
+
+func UnmarshalStringMap(v any) (map[string]string, error) {
+	object, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%T is not an object", v)
+	}
+
+	m := make(map[string]string, len(object))
+	for key, value := range object {
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("value of %q is not a string", key)
+		}
+		m[key] = s
+	}
+	return m, nil
+}
+
+// MarshalStringListMap writes the StringListMap scalar, an object of lists of strings.
+func MarshalStringListMap(m map[string][]string) graphql.Marshaler {
+	return graphql.WriterFunc(func(w io.Writer) {
+		writeJSON(w, m)
+	})
+}
+
+func UnmarshalStringListMap(v any) (map[string][]string, error) {
+	object, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%T is not an object", v)
+	}
+
+	m := make(map[string][]string, len(object))
+	for key, value := range object {
+		list, ok := value.([]any)
+		if !ok {
+			return nil, fmt.Errorf("value of %q is not a list", key)
+		}
+		for _, item := range list {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("value of %q is not a list of strings", key)
+			}
+			m[key] = append(m[key], s)
+		}
+	}
+	return m, nil
+}
+
+func writeJSON(w io.Writer, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		io.WriteString(w, "null")
+		return
+	}
+	w.Write(data)
+}
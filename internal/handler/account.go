@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"context"
+	"log"
+
+	"example.com/internal/consumer"
+	"example.com/internal/jwtkeys"
+	"github.com/gofiber/fiber/v3"
+)
+
+// passwordMatches reports whether password is the one of the user.
+func (h *handler) passwordMatches(ctx context.Context, userID int64, password string) (bool, error) {
+	user, found, err := h.repo.GetUser(ctx, userID)
+	if err != nil || !found {
+		return false, err
+	}
+	authUserID, err := h.repo.AuthUser(ctx, user.Username, password)
+	if err != nil {
+		return false, err
+	}
+	return authUserID == userID, nil
+}
+
+// ChangePassword sets a new password given the current one. The tokens of the user are
+// revoked, including the one of the request; a new one is returned.
+func (h *handler) ChangePassword(c fiber.Ctx, keys jwtkeys.Keys) error {
+	userID := c.Locals("userID").(int64)
+
+	var payload struct {
+		CurrentPassword string `json:"current_password" validate:"required"`
+		NewPassword     string `json:"new_password" validate:"required,min=8"`
+	}
+	if !bindBody(c, &payload) {
+		return nil
+	}
+	hashedPassword, err := hashPassword(payload.NewPassword)
+	if err != nil {
+		return err
+	}
+
+	matches, err := h.passwordMatches(c.Context(), userID, payload.CurrentPassword)
+	if err != nil {
+		return err
+	}
+	if !matches {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "invalid password"})
+	}
+
+	if err := h.repo.ResetPassword(c.Context(), userID, hashedPassword); err != nil {
+		return err
+	}
+
+	version, err := tokenVersion(c.Context(), h.repo, userID)
+	if err != nil {
+		return err
+	}
+	tokenString, err := issueToken(c.Context(), h.repo, userID, version, keys, c.IP(), c.Get(fiber.HeaderUserAgent))
+	if err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "could not create token"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "done", "token": tokenString})
+}
+
+// DeleteAccount deletes the account of the user given its password. The account is disabled
+// at once and its unfinished downloads canceled; it is removed with its downloads, files and
+// everything it owns as soon as the files are purged, at once unless some are on the disk of
+// another process or still being processed.
+func (h *handler) DeleteAccount(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	var payload struct {
+		Password string `json:"password" validate:"required"`
+	}
+	if !bindBody(c, &payload) {
+		return nil
+	}
+	matches, err := h.passwordMatches(c.Context(), userID, payload.Password)
+	if err != nil {
+		return err
+	}
+	if !matches {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "invalid password"})
+	}
+
+	deleted, err := h.repo.DeleteAccount(c.Context(), userID)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "user not found"})
+	}
+
+	removed, err := consumer.PurgeAccount(c.Context(), h.repo, h.cfg, h.cold, userID)
+	if err != nil {
+		log.Println(err) // the retention loops finish it
+	}
+	if !removed {
+		return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"message": "the account is disabled and is deleted once its files are"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "deleted"})
+}
@@ -0,0 +1,331 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"example.com/internal/consumer"
+	"example.com/internal/flags"
+	"example.com/internal/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+const DefaultTimelineRange = 24 * time.Hour
+const DefaultTimelineBucket = 1 * time.Hour
+const MaxTimelineBuckets = 1000
+const DashboardFailures = 10
+const MaxFailures = 100
+
+// AdminMiddleware lets only admins through. It must run after AuthMiddleware. The role is
+// checked against the database on every request so revoking it takes effect immediately.
+func AdminMiddleware(c fiber.Ctx, repo repository.Repository) error {
+	userID := c.Locals("userID").(int64)
+
+	isAdmin, err := repo.IsAdmin(c.Context(), userID)
+	if err != nil {
+		return err
+	}
+	if !isAdmin {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "admin access required"})
+	}
+
+	return c.Next()
+}
+
+func (h *handler) GetCachePolicies(c fiber.Ctx) error {
+	policies, err := h.repo.GetCachePolicies(c.Context())
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"policies": policies})
+}
+
+func (h *handler) CreateCachePolicy(c fiber.Ctx) error {
+	var policy repository.CachePolicy
+	if !bindBody(c, &policy) {
+		return nil
+	}
+
+	policyID, err := h.repo.CreateCachePolicy(c.Context(), policy)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"policy_id": policyID})
+}
+
+func (h *handler) DeleteCachePolicy(c fiber.Ctx) error {
+	policyID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid policy id"})
+	}
+
+	if err := h.repo.DeleteCachePolicy(c.Context(), policyID); err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "done"})
+}
+
+// featureFlag is a known flag and its setting, nil while it keeps its default.
+type featureFlag struct {
+	flags.Flag
+	Setting *repository.FeatureFlag `json:"setting"`
+}
+
+func (h *handler) GetFeatureFlags(c fiber.Ctx) error {
+	settings, err := h.repo.GetFeatureFlags(c.Context())
+	if err != nil {
+		return err
+	}
+
+	result := make([]featureFlag, 0, len(flags.Known))
+	for _, flag := range flags.Known {
+		item := featureFlag{Flag: flag}
+		for i := range settings {
+			if settings[i].Name == flag.Name {
+				item.Setting = &settings[i]
+			}
+		}
+		result = append(result, item)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"flags": result})
+}
+
+// SetFeatureFlag enables the flag for the listed users and a percentage of the others, or
+// disables it for everyone.
+func (h *handler) SetFeatureFlag(c fiber.Ctx) error {
+	flag, ok := flags.Lookup(c.Params("name"))
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "unknown feature flag"})
+	}
+
+	var setting repository.FeatureFlag
+	if !bindBody(c, &setting) {
+		return nil
+	}
+	setting.Name = flag.Name
+
+	setting, err := h.repo.SetFeatureFlag(c.Context(), setting)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(featureFlag{Flag: flag, Setting: &setting})
+}
+
+// DeleteFeatureFlag drops the setting of the flag, which goes back to its default.
+func (h *handler) DeleteFeatureFlag(c fiber.Ctx) error {
+	flag, ok := flags.Lookup(c.Params("name"))
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "unknown feature flag"})
+	}
+
+	if _, err := h.repo.DeleteFeatureFlag(c.Context(), flag.Name); err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "done"})
+}
+
+// errNoWorkers answers the requests for the workers of a process started with MODE=api.
+var errNoWorkers = errors.New("This process runs no workers, scale a worker process instead")
+
+func (h *handler) GetWorkers(c fiber.Ctx) error {
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"workers": h.workers()})
+}
+
+// workers reports what the workers of this process are doing, none without workers.
+func (h *handler) workers() []consumer.WorkerStatus {
+	if h.consumer == nil {
+		return []consumer.WorkerStatus{}
+	}
+	return h.consumer.Workers()
+}
+
+func (h *handler) ScaleWorkers(c fiber.Ctx) error {
+	var payload struct {
+		Count *int `json:"count" validate:"required"`
+	}
+	if !bindBody(c, &payload) {
+		return nil
+	}
+	if h.consumer == nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": errNoWorkers.Error()})
+	}
+
+	if err := h.consumer.Scale(*payload.Count); err != nil {
+		if errors.Is(err, consumer.ErrStopped) {
+			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"workers": h.consumer.Workers()})
+}
+
+// GetLiveWorkers lists the workers of all the processes that sent a heartbeat lately.
+func (h *handler) GetLiveWorkers(c fiber.Ctx) error {
+	heartbeats, err := h.repo.GetWorkerHeartbeats(c.Context())
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"workers": heartbeats})
+}
+
+// GetProcesses lists the processes of the API and of the workers, from their heartbeats.
+func (h *handler) GetProcesses(c fiber.Ctx) error {
+	processes, err := h.repo.GetProcessHeartbeats(c.Context())
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"processes": processes})
+}
+
+// GetVolumes reports the capacity of the volumes of all the processes, from their heartbeats.
+func (h *handler) GetVolumes(c fiber.Ctx) error {
+	volumes, err := h.repo.GetVolumes(c.Context())
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"volumes": volumes})
+}
+
+// GetQueueTimeline counts the queue events per time bucket, for charting the queue. The range
+// is given by the from and to query parameters (RFC 3339, default the last day) and the bucket
+// size by bucket (a duration, default 1h).
+func (h *handler) GetQueueTimeline(c fiber.Ctx) error {
+	to := time.Now()
+	if value := c.Query("to"); value != "" {
+		var err error
+		if to, err = time.Parse(time.RFC3339, value); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid to"})
+		}
+	}
+	from := to.Add(-DefaultTimelineRange)
+	if value := c.Query("from"); value != "" {
+		var err error
+		if from, err = time.Parse(time.RFC3339, value); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid from"})
+		}
+	}
+	bucket := DefaultTimelineBucket
+	if value := c.Query("bucket"); value != "" {
+		var err error
+		if bucket, err = time.ParseDuration(value); err != nil || bucket < time.Second {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "bucket must be a duration of at least 1s"})
+		}
+	}
+	if !from.Before(to) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "from must be before to"})
+	}
+	if to.Sub(from)/bucket >= MaxTimelineBuckets {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("at most %d buckets are allowed, use a larger bucket", MaxTimelineBuckets)})
+	}
+
+	buckets, err := h.repo.GetQueueTimeline(c.Context(), from, to, bucket)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"bucket_seconds": int64(bucket.Seconds()),
+		"buckets":        buckets,
+	})
+}
+
+// inFlightDownload is a download being received by a worker, on the admin dashboard.
+type inFlightDownload struct {
+	repository.DownloadSummary
+	Worker      string  `json:"worker"`
+	Bytes       int64   `json:"bytes"`
+	TotalBytes  int64   `json:"total_bytes"` // -1 if unknown
+	BytesPerSec float64 `json:"bytes_per_sec"`
+}
+
+// GetDashboard is the state of the whole system for operators: the queue, the workers of all
+// the processes (from their heartbeats), the downloads in flight and the recent failures.
+func (h *handler) GetDashboard(c fiber.Ctx) error {
+	ctx := c.Context()
+
+	stats, err := h.repo.GetQueueStats(ctx)
+	if err != nil {
+		return err
+	}
+	heartbeats, err := h.repo.GetWorkerHeartbeats(ctx)
+	if err != nil {
+		return err
+	}
+
+	var downloadIDs []int64
+	for _, heartbeat := range heartbeats {
+		if heartbeat.DownloadID != 0 {
+			downloadIDs = append(downloadIDs, heartbeat.DownloadID)
+		}
+	}
+	summaries, err := h.repo.GetDownloadSummaries(ctx, downloadIDs)
+	if err != nil {
+		return err
+	}
+	byID := make(map[int64]repository.DownloadSummary, len(summaries))
+	for _, summary := range summaries {
+		byID[summary.ID] = summary
+	}
+
+	inFlight := []inFlightDownload{}
+	for _, heartbeat := range heartbeats {
+		summary, ok := byID[heartbeat.DownloadID]
+		if !ok {
+			continue
+		}
+		download := inFlightDownload{DownloadSummary: summary, Worker: heartbeat.Worker, Bytes: heartbeat.Bytes, TotalBytes: -1, BytesPerSec: heartbeat.BytesPerSec}
+		if progress, found, err := h.repo.GetProgress(ctx, heartbeat.DownloadID); err != nil {
+			log.Println(err)
+		} else if found {
+			download.Bytes, download.TotalBytes = progress.Bytes, progress.TotalBytes
+		}
+		inFlight = append(inFlight, download)
+	}
+
+	failures, err := h.repo.GetRecentFailures(ctx, DashboardFailures)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"queue": fiber.Map{
+			"depth":     stats.Queued,
+			"unacked":   stats.Unacked,
+			"pending":   stats.Pending,
+			"completed": stats.Completed,
+			"failed":    stats.Failed,
+			"expired":   stats.Expired,
+		},
+		"workers":         heartbeats,
+		"in_flight":       inFlight,
+		"recent_failures": failures,
+	})
+}
+
+// GetFailures lists the last failed downloads with their retry counts, limit at a time.
+func (h *handler) GetFailures(c fiber.Ctx) error {
+	limit, err := strconv.ParseInt(c.Query("limit"), 10, 64)
+	if err != nil || limit <= 0 || limit > MaxFailures {
+		limit = MaxFailures
+	}
+
+	failures, err := h.repo.GetRecentFailures(c.Context(), limit)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"failures": failures})
+}
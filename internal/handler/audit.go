@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"example.com/internal/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+const MaxAuditEntries = 1000
+
+// AuditMiddleware records the requests that change something, those of every method but GET,
+// HEAD and OPTIONS outside of GraphQL, in the audit log once they are handled. It runs before the middlewares of
+// the routes, so it sees the user set by AuthMiddleware, and the username Register and Login
+// set. The request is not failed if it cannot be recorded.
+func AuditMiddleware(c fiber.Ctx, repo repository.Repository) error {
+	err := c.Next()
+
+	switch c.Method() {
+	case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions:
+		return err
+	}
+	action := c.Route().Path
+	switch action {
+	case "/": // no route matched, this is the route of the middleware
+		return err
+	case "/graphql": // queries only
+		return err
+	}
+
+	status := c.Response().StatusCode()
+	if err != nil {
+		status = errorStatus(err) // answered by ErrorHandler once the middlewares return
+	}
+	entry := repository.AuditEntry{
+		Action:   c.Method() + " " + action,
+		Resource: c.Path(),
+		IP:       c.IP(),
+		Status:   strconv.Itoa(status),
+		Result:   repository.AuditResultSuccess,
+	}
+	if status >= fiber.StatusBadRequest {
+		entry.Result = repository.AuditResultFailure
+	}
+	if userID, ok := c.Locals("userID").(int64); ok {
+		entry.UserID = &userID
+	}
+	entry.Username, _ = c.Locals("username").(string)
+	addAuditEntry(c.Context(), repo, entry)
+
+	return err
+}
+
+func addAuditEntry(ctx context.Context, repo repository.Repository, entry repository.AuditEntry) {
+	if err := repo.AddAuditEntry(ctx, entry); err != nil {
+		log.Println(err)
+	}
+}
+
+// GetAuditLog lists the audit log, the latest first, optionally only the entries of a user,
+// whose action contains action, with a result or in [since, until).
+func (h *handler) GetAuditLog(c fiber.Ctx) error {
+	page, err := strconv.ParseInt(c.Query("page"), 10, 64)
+	if err != nil || page < 0 {
+		page = 0
+	}
+	limit, err := strconv.ParseInt(c.Query("limit"), 10, 64)
+	if err != nil || limit <= 0 {
+		limit = DefaultPageSize
+	}
+	if limit > MaxAuditEntries {
+		limit = MaxAuditEntries
+	}
+
+	filter := repository.AuditFilter{Action: c.Query("action"), Result: c.Query("result")}
+	if value := c.Query("user_id"); value != "" {
+		userID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid user_id"})
+		}
+		filter.UserID = &userID
+	}
+	switch filter.Result {
+	case "", repository.AuditResultSuccess, repository.AuditResultFailure:
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "result must be success or failure"})
+	}
+	if value := c.Query("since"); value != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, value); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid since"})
+		}
+	}
+	if value := c.Query("until"); value != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, value); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid until"})
+		}
+	}
+
+	entries, err := h.repo.GetAuditEntries(c.Context(), filter, page, limit)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"entries": entries})
+}
@@ -0,0 +1,181 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+
+	"example.com/internal/consumer"
+	"example.com/internal/flags"
+	"example.com/internal/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+const (
+	BatchCreated = "created"
+	BatchExists  = "exists" // requested before, or earlier in the same batch
+	BatchInvalid = "invalid"
+)
+
+// batchResult is the outcome of one link of a batch.
+type batchResult struct {
+	Link       string `json:"link"`
+	Result     string `json:"result"`
+	DownloadID int64  `json:"download_id,omitempty"`
+	Status     string `json:"status,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// CreateDownloadRequests creates the downloads of up to MAX_BATCH_DOWNLOADS links at once.
+// Invalid links are reported and skipped; the others are created in one transaction, so that
+// all of them reach the queue or none does. Like POST /downloads/, a link requested before
+// gets its existing download.
+func (h *handler) CreateDownloadRequests(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+	if !h.flags.Enabled(c.Context(), flags.BatchDownloads, userID) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "batch downloads are not enabled for this user"})
+	}
+
+	var payload struct {
+		Downloads []struct {
+			Link string `json:"link"`
+			downloadOptions
+		} `json:"downloads" validate:"min=1"` // invalid links are reported in the results
+	}
+	if !bindBody(c, &payload) {
+		return nil
+	}
+	if int64(len(payload.Downloads)) > h.cfg.MaxBatchDownloads {
+		return invalidFields(c, FieldError{Field: "downloads", Message: fmt.Sprintf("at most %d downloads per batch", h.cfg.MaxBatchDownloads)})
+	}
+	// Every link counts against the downloads rate limit, as if it was requested on its own.
+	if !rateLimit(c, h.repo, UserRateLimitKey(c, "downloads"), h.cfg.DownloadsRateLimit, h.cfg.RateLimitWindow, int64(len(payload.Downloads))) {
+		return nil
+	}
+
+	results := make([]batchResult, len(payload.Downloads))
+	prepared := make([]*repository.NewDownload, len(payload.Downloads)) // nil for the invalid links
+	orgHits := map[int64]int64{}                                        // links of every organization
+	for i, item := range payload.Downloads {
+		results[i].Link = item.Link
+		download, err := h.prepareDownload(c.Context(), userID, item.Link, item.downloadOptions)
+		if errors.Is(err, errSomethingWentWrong) {
+			return err
+		}
+		if err != nil {
+			results[i].Result, results[i].Error = BatchInvalid, err.Error()
+			continue
+		}
+		prepared[i] = &download
+		if download.OrgID != nil {
+			orgHits[*download.OrgID]++
+		}
+	}
+	// The links requested for an organization count against its rate limit too.
+	for orgID, hits := range orgHits {
+		if !h.orgRateLimit(c, orgID, hits) {
+			return nil
+		}
+	}
+
+	var downloads []repository.NewDownload
+	var created []int         // index in results of every download
+	first := map[string]int{} // index in results of the first request of a link and range
+	duplicates := map[int]int{}
+	fileNames := map[string]bool{} // of the downloads created
+	for i, download := range prepared {
+		if download == nil {
+			continue
+		}
+
+		key := download.Link + " " + download.Range
+		if j, ok := first[key]; ok {
+			duplicates[i] = j
+			continue
+		}
+		first[key] = i
+
+		existing, found, err := h.repo.FindDownloadRequest(c.Context(), userID, download.Link, download.Range)
+		if err != nil {
+			return err
+		}
+		if found {
+			if existing.DeletedAt != nil {
+				if _, err := consumer.RestoreFromTrash(c.Context(), h.repo, existing.ID); err != nil {
+					return err
+				}
+				h.invalidateDownloadList(c.Context(), userID)
+			}
+			if download.CollectionID != nil {
+				if _, err := h.repo.AddToCollection(c.Context(), userID, *download.CollectionID, []int64{existing.ID}); err != nil {
+					return err
+				}
+			}
+			results[i] = batchResult{Link: results[i].Link, Result: BatchExists, DownloadID: existing.ID, Status: existing.Status}
+			continue
+		}
+
+		download.FileName, err = h.fileName(c.Context(), userID, download.Link, download.Range, fileNames)
+		if err != nil {
+			return err
+		}
+		fileNames[download.FileName] = true
+		downloads = append(downloads, *download)
+		created = append(created, i)
+	}
+
+	if len(downloads) > 0 {
+		if h.pressure.Overloaded() {
+			return h.queueOverloaded(c)
+		}
+		err := h.checkQuota(c.Context(), userID)
+		for orgID := range orgHits {
+			if err == nil {
+				err = h.checkOrgQuota(c.Context(), orgID)
+			}
+		}
+		if errors.Is(err, errQuotaExceeded) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err != nil {
+			return err
+		}
+
+		expiresAt, err := h.queueExpiry(c.Context(), userID)
+		if err != nil {
+			return err
+		}
+		for i := range downloads {
+			downloads[i].ExpiresAt = expiresAt
+		}
+
+		// The requests are pushed to the queue by the outbox relay.
+		downloadIDs, err := h.repo.CreateDownloadRequests(c.Context(), downloads)
+		if err != nil {
+			return err
+		}
+		h.invalidateDownloadList(c.Context(), userID)
+		for j, downloadID := range downloadIDs {
+			i := created[j]
+			if downloadID != 0 {
+				results[i] = batchResult{Link: results[i].Link, Result: BatchCreated, DownloadID: downloadID, Status: repository.StatusQueued}
+				continue
+			}
+
+			// Requested by a concurrent request of the user since it was looked up above.
+			existing, found, err := h.repo.FindDownloadRequest(c.Context(), userID, downloads[j].Link, downloads[j].Range)
+			if err == nil && !found {
+				err = fmt.Errorf("download request of %s conflicted but was not found", downloads[j].Link)
+			}
+			if err != nil {
+				return err
+			}
+			results[i] = batchResult{Link: results[i].Link, Result: BatchExists, DownloadID: existing.ID, Status: existing.Status}
+		}
+	}
+
+	for i, j := range duplicates {
+		results[i] = batchResult{Link: results[i].Link, Result: BatchExists, DownloadID: results[j].DownloadID, Status: results[j].Status}
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"results": results})
+}
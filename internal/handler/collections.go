@@ -0,0 +1,400 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"example.com/internal/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+// MaxCollectionNameLength bounds the names of the collections.
+const MaxCollectionNameLength = 256
+
+// MaxCollectionAdd bounds the downloads added to a collection by one request.
+const MaxCollectionAdd = 1000
+
+// MaxCollectionMembers bounds the users a collection is shared with.
+const MaxCollectionMembers = 100
+
+var (
+	errCollectionNotFound  = fmt.Errorf("collection %w", repository.ErrNotFound)
+	errCollectionForbidden = fmt.Errorf("%w: your role in the collection does not allow it", repository.ErrForbidden)
+)
+
+// collectionProgress aggregates the downloads of a collection. Bytes and TotalBytes only count
+// the downloads whose progress is known: running, or finished within the hour.
+type collectionProgress struct {
+	CollectionID int64   `json:"collection_id"`
+	Downloads    int64   `json:"downloads"`
+	Queued       int64   `json:"queued"`
+	Downloading  int64   `json:"downloading"`
+	Completed    int64   `json:"completed"`
+	Failed       int64   `json:"failed"`
+	Expired      int64   `json:"expired"`
+	Bytes        int64   `json:"bytes"`
+	TotalBytes   int64   `json:"total_bytes"`
+	Percent      float64 `json:"percent"` // completed downloads count in full, running ones by their bytes
+}
+
+func (h *handler) GetCollections(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	collections, err := h.repo.GetCollections(c.Context(), userID)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"collections": collections})
+}
+
+func (h *handler) CreateCollection(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	var payload struct {
+		Name string `json:"name"`
+	}
+	if !bindBody(c, &payload) {
+		return nil
+	}
+	if strings.TrimSpace(payload.Name) == "" {
+		return invalidFields(c, FieldError{Field: "name", Message: "name is required"})
+	}
+	if len(payload.Name) > MaxCollectionNameLength {
+		return invalidFields(c, FieldError{Field: "name", Message: "name is too long"})
+	}
+
+	collectionID, err := h.repo.CreateCollection(c.Context(), repository.Collection{UserID: userID, Name: payload.Name})
+	if errors.Is(err, repository.CollectionExistsErr) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"collection_id": collectionID})
+}
+
+// DeleteCollection deletes a collection, its downloads are left as they are.
+func (h *handler) DeleteCollection(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	collectionID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid collection id"})
+	}
+
+	deleted, err := h.repo.DeleteCollection(c.Context(), userID, collectionID)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return errCollectionNotFound
+	}
+	h.invalidateDownloadList(c.Context(), userID)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "done"})
+}
+
+// AddToCollection adds downloads of the user to a collection they own or contribute to. Those
+// already in it are skipped.
+func (h *handler) AddToCollection(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	collection, err := h.collectionParam(c.Context(), userID, c.Params("id"))
+	if err != nil {
+		return collectionError(c, err)
+	}
+	if collection.Role == repository.CollectionRoleViewer {
+		return collectionError(c, errCollectionForbidden)
+	}
+
+	var payload struct {
+		DownloadIDs []int64 `json:"download_ids" validate:"min=1"`
+	}
+	if !bindBody(c, &payload) {
+		return nil
+	}
+	if len(payload.DownloadIDs) > MaxCollectionAdd {
+		return invalidFields(c, FieldError{Field: "download_ids", Message: fmt.Sprintf("at most %d downloads per request", MaxCollectionAdd)})
+	}
+
+	missing, err := h.repo.AddToCollection(c.Context(), userID, collection.ID, payload.DownloadIDs)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("downloads not found: %v", missing)})
+	}
+	h.invalidateDownloadList(c.Context(), userID)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "done"})
+}
+
+// RemoveFromCollection removes a download from a collection: any of them by the owner, their
+// own by a contributor.
+func (h *handler) RemoveFromCollection(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	collection, err := h.collectionParam(c.Context(), userID, c.Params("id"))
+	if err != nil {
+		return collectionError(c, err)
+	}
+	downloadID, err := strconv.ParseInt(c.Params("download_id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid download id"})
+	}
+	if collection.Role == repository.CollectionRoleViewer {
+		return collectionError(c, errCollectionForbidden)
+	}
+	download, err := h.repo.GetDownloadRequest(c.Context(), downloadID)
+	if err != nil && !errors.Is(err, repository.DownloadRequestNotFoundErr) {
+		return err
+	}
+	if collection.Role == repository.CollectionRoleContributor {
+		if err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "download not in collection"})
+		}
+		if download.UserID != userID {
+			return collectionError(c, errCollectionForbidden)
+		}
+	}
+
+	removed, err := h.repo.RemoveFromCollection(c.Context(), collection.ID, downloadID)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "download not in collection"})
+	}
+	if download.UserID != 0 {
+		h.invalidateDownloadList(c.Context(), download.UserID) // the owner may be a contributor
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "done"})
+}
+
+// GetCollectionProgress sums up the downloads of a collection by status, and how far along
+// the whole collection is.
+func (h *handler) GetCollectionProgress(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	collection, err := h.collectionParam(c.Context(), userID, c.Params("id"))
+	if err != nil {
+		return collectionError(c, err)
+	}
+
+	statuses, err := h.repo.GetCollectionStatuses(c.Context(), collection.ID)
+	if err != nil {
+		return err
+	}
+
+	downloadIDs := make([]int64, 0, len(statuses))
+	for downloadID, status := range statuses {
+		if status != repository.StatusQueued && status != repository.StatusExpired {
+			downloadIDs = append(downloadIDs, downloadID)
+		}
+	}
+	progresses, err := h.repo.GetProgresses(c.Context(), downloadIDs)
+	if err != nil {
+		return err
+	}
+
+	result := collectionProgress{CollectionID: collection.ID, Downloads: int64(len(statuses))}
+	var done float64
+	for downloadID, status := range statuses {
+		switch status {
+		case repository.StatusQueued:
+			result.Queued++
+			continue
+		case repository.StatusDownloading:
+			result.Downloading++
+		case repository.StatusCompleted:
+			result.Completed++
+			done++
+		case repository.StatusFailed:
+			result.Failed++
+		case repository.StatusExpired:
+			result.Expired++
+			continue
+		}
+
+		progress, found := progresses[downloadID]
+		if !found || progress.TotalBytes <= 0 {
+			continue
+		}
+		result.Bytes += progress.Bytes
+		result.TotalBytes += progress.TotalBytes
+		if status == repository.StatusDownloading {
+			done += float64(min(progress.Bytes, progress.TotalBytes)) / float64(progress.TotalBytes)
+		}
+	}
+	if result.Downloads > 0 {
+		result.Percent = 100 * done / float64(result.Downloads)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(result)
+}
+
+// GetCollectionMembers lists the users a collection is shared with, to its owner and members.
+func (h *handler) GetCollectionMembers(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	collection, err := h.collectionParam(c.Context(), userID, c.Params("id"))
+	if err != nil {
+		return collectionError(c, err)
+	}
+
+	members, err := h.repo.GetCollectionMembers(c.Context(), collection.ID)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"members": members})
+}
+
+// SetCollectionMember shares a collection of the user with another user, or changes the role of
+// a member.
+func (h *handler) SetCollectionMember(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	collection, err := h.collectionParam(c.Context(), userID, c.Params("id"))
+	if err != nil {
+		return collectionError(c, err)
+	}
+	if collection.Role != repository.CollectionRoleOwner {
+		return collectionError(c, errCollectionForbidden)
+	}
+
+	var payload struct {
+		Username string `json:"username" validate:"required"`
+		Role     string `json:"role" validate:"oneof=viewer contributor"` // repository.CollectionRoleViewer or CollectionRoleContributor
+	}
+	if !bindBody(c, &payload) {
+		return nil
+	}
+
+	memberID, found, err := h.repo.FindUser(c.Context(), payload.Username)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "user not found"})
+	}
+	if memberID == userID {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "the owner cannot be a member of the collection"})
+	}
+
+	_, isMember, err := h.repo.GetCollectionMember(c.Context(), collection.ID, memberID)
+	if err != nil {
+		return err
+	}
+	if !isMember {
+		members, err := h.repo.GetCollectionMembers(c.Context(), collection.ID)
+		if err != nil {
+			return err
+		}
+		if len(members) >= MaxCollectionMembers {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("a collection is shared with at most %d users", MaxCollectionMembers)})
+		}
+	}
+
+	member := repository.CollectionMember{CollectionID: collection.ID, UserID: memberID, Role: payload.Role}
+	if err := h.repo.SetCollectionMember(c.Context(), member); err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "done", "user_id": memberID})
+}
+
+// RemoveCollectionMember stops sharing a collection with a user: done by the owner, or by the
+// member leaving it. The downloads the member added stay in the collection.
+func (h *handler) RemoveCollectionMember(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	collection, err := h.collectionParam(c.Context(), userID, c.Params("id"))
+	if err != nil {
+		return collectionError(c, err)
+	}
+	memberID, err := strconv.ParseInt(c.Params("user_id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid user id"})
+	}
+	if collection.Role != repository.CollectionRoleOwner && memberID != userID {
+		return collectionError(c, errCollectionForbidden)
+	}
+
+	removed, err := h.repo.RemoveCollectionMember(c.Context(), collection.ID, memberID)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "user is not a member of the collection"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "done"})
+}
+
+// collectionParam returns the collection with the id in the path if the user owns it or is a
+// member of it, with the role of the user.
+func (h *handler) collectionParam(ctx context.Context, userID int64, param string) (repository.Collection, error) {
+	collectionID, err := strconv.ParseInt(param, 10, 64)
+	if err != nil {
+		return repository.Collection{}, errors.New("invalid collection id")
+	}
+	return h.checkCollection(ctx, userID, collectionID)
+}
+
+func (h *handler) checkCollection(ctx context.Context, userID int64, collectionID int64) (repository.Collection, error) {
+	collection, found, err := h.repo.GetCollection(ctx, collectionID)
+	if err != nil {
+		log.Println(err)
+		return repository.Collection{}, errSomethingWentWrong
+	}
+	if !found {
+		return repository.Collection{}, errCollectionNotFound
+	}
+	if collection.UserID == userID {
+		collection.Role = repository.CollectionRoleOwner
+		return collection, nil
+	}
+
+	member, found, err := h.repo.GetCollectionMember(ctx, collectionID, userID)
+	if err != nil {
+		log.Println(err)
+		return repository.Collection{}, errSomethingWentWrong
+	}
+	if !found {
+		return repository.Collection{}, errCollectionNotFound
+	}
+	collection.Role = member.Role
+	return collection, nil
+}
+
+// canViewDownload reports whether the user owns the download or it is in a collection shared
+// with them.
+func (h *handler) canViewDownload(ctx context.Context, userID int64, downloadID int64, ownerID int64) (bool, error) {
+	if ownerID == userID {
+		return true, nil
+	}
+	shared, err := h.repo.IsDownloadShared(ctx, userID, downloadID)
+	if err != nil {
+		log.Println(err)
+		return false, errSomethingWentWrong
+	}
+	return shared, nil
+}
+
+// collectionError answers the errors of collectionParam, checkCollection, organizationParam and
+// checkOrganization: the domain errors and errSomethingWentWrong are answered by ErrorHandler,
+// the others are the client's.
+func collectionError(c fiber.Ctx, err error) error {
+	if errors.Is(err, errSomethingWentWrong) || errorStatus(err) != fiber.StatusInternalServerError {
+		return err
+	}
+	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+}
@@ -0,0 +1,222 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"strings"
+
+	"example.com/internal/mailer"
+	"example.com/internal/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+const MaxEmailLength = 320
+
+var errEmailNotVerified = errors.New("email is not verified")
+
+// parseEmail validates a bare email address, e.g. "amir@example.com".
+func parseEmail(email string) (string, error) {
+	if email == "" {
+		return "", errors.New("email is required")
+	}
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email || len(email) > MaxEmailLength {
+		return "", errors.New("invalid email")
+	}
+	return email, nil
+}
+
+// newSecret returns a random token of 32 bytes, hex encoded. Only its hashToken is stored.
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// sendVerificationEmail mails a token verifying the email to the user. It returns
+// mailer.ErrDisabled without SMTP_ADDR.
+func (h *handler) sendVerificationEmail(ctx context.Context, userID int64, username string, email string) error {
+	token, err := newSecret()
+	if err != nil {
+		return err
+	}
+	if err := h.repo.SaveEmailVerificationToken(ctx, hashToken(token), userID, email, h.cfg.EmailVerificationTTL); err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Hello %s,\n\nUse this token to verify your email address, by POST /verify-email with {\"token\": \"<token>\"}:\n\n%s\n\nIt expires in %v. If you did not use this address on our downloader, ignore this email.\n",
+		username, token, h.cfg.EmailVerificationTTL)
+	return h.mail.Send(ctx, email, "Verify your email address", body)
+}
+
+// checkEmailVerified refuses the users whose email is not verified yet when
+// REQUIRE_EMAIL_VERIFICATION is set. Accounts without an email, from before it was set, pass.
+func (h *handler) checkEmailVerified(ctx context.Context, userID int64) error {
+	if !h.cfg.RequireEmailVerification {
+		return nil
+	}
+	user, found, err := h.repo.GetUser(ctx, userID)
+	if err != nil {
+		log.Println(err)
+		return errSomethingWentWrong
+	}
+	if found && user.Email != nil && user.EmailVerifiedAt == nil {
+		return errEmailNotVerified
+	}
+	return nil
+}
+
+// SetEmail sets or changes the email of the user and mails a verification token to it.
+func (h *handler) SetEmail(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	var payload struct {
+		Email string `json:"email"`
+	}
+	if !bindBody(c, &payload) {
+		return nil
+	}
+	email, err := parseEmail(payload.Email)
+	if err != nil {
+		return invalidFields(c, FieldError{Field: "email", Message: err.Error()})
+	}
+
+	user, found, err := h.repo.GetUser(c.Context(), userID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "user not found"})
+	}
+	err = h.repo.SetUserEmail(c.Context(), userID, email)
+	if errors.Is(err, repository.EmailTakenErr) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+	if user.Email != nil && strings.EqualFold(*user.Email, email) && user.EmailVerifiedAt != nil {
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "the email is verified already"})
+	}
+
+	if err := h.sendVerificationEmail(c.Context(), userID, user.Username, email); err != nil {
+		if !errors.Is(err, mailer.ErrDisabled) {
+			log.Println(err)
+		}
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "email set, the verification email could not be sent"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "verification email sent"})
+}
+
+// VerifyEmail verifies the email of a user with the token mailed to it.
+func (h *handler) VerifyEmail(c fiber.Ctx) error {
+	var payload struct {
+		Token string `json:"token" validate:"required"`
+	}
+	if !bindBody(c, &payload) {
+		return nil
+	}
+
+	userID, email, found, err := h.repo.TakeEmailVerificationToken(c.Context(), hashToken(payload.Token))
+	if err != nil {
+		return err
+	}
+	if !found {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid or expired token"})
+	}
+	c.Locals("userID", userID) // for AuditMiddleware
+
+	verified, err := h.repo.VerifyEmail(c.Context(), userID, email)
+	if err != nil {
+		return err
+	}
+	if !verified {
+		// The email was changed since the token was sent.
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid or expired token"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "email verified"})
+}
+
+// ResendVerificationEmail mails a new verification token to an email not verified yet. The
+// answer is the same whether the email belongs to an account or not.
+func (h *handler) ResendVerificationEmail(c fiber.Ctx) error {
+	var payload struct {
+		Email string `json:"email"`
+	}
+	if !bindBody(c, &payload) {
+		return nil
+	}
+	email, err := parseEmail(payload.Email)
+	if err != nil {
+		return invalidFields(c, FieldError{Field: "email", Message: err.Error()})
+	}
+	if h.cfg.SMTPAddr == "" {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": mailer.ErrDisabled.Error()})
+	}
+
+	user, found, err := h.repo.GetUserByEmail(c.Context(), email)
+	if err != nil {
+		return err
+	}
+	if found && user.EmailVerifiedAt == nil && user.DeletedAt == nil {
+		if err := h.sendVerificationEmail(c.Context(), user.ID, user.Username, *user.Email); err != nil {
+			log.Println(err)
+		}
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "if the email belongs to an account waiting for its verification, a new token is sent to it"})
+}
+
+// ForgotPassword mails a password reset token, used at /password-reset, to a verified email.
+// The answer is the same whether the email belongs to an account or not.
+func (h *handler) ForgotPassword(c fiber.Ctx) error {
+	var payload struct {
+		Email string `json:"email"`
+	}
+	if !bindBody(c, &payload) {
+		return nil
+	}
+	email, err := parseEmail(payload.Email)
+	if err != nil {
+		return invalidFields(c, FieldError{Field: "email", Message: err.Error()})
+	}
+	if h.cfg.SMTPAddr == "" {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": mailer.ErrDisabled.Error()})
+	}
+
+	user, found, err := h.repo.GetUserByEmail(c.Context(), email)
+	if err != nil {
+		return err
+	}
+	// Only to verified emails: an unverified one may not be the user's.
+	if found && user.EmailVerifiedAt != nil && user.DeletedAt == nil {
+		if err := h.sendPasswordResetEmail(c.Context(), user); err != nil {
+			log.Println(err)
+		}
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "if the email belongs to an account, a password reset token is sent to it"})
+}
+
+func (h *handler) sendPasswordResetEmail(ctx context.Context, user repository.User) error {
+	token, err := newSecret()
+	if err != nil {
+		return err
+	}
+	if err := h.repo.SavePasswordResetToken(ctx, hashToken(token), user.ID, h.cfg.PasswordResetTTL); err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Hello %s,\n\nUse this token to set a new password, by POST /password-reset with {\"token\": \"<token>\", \"password\": \"<new password>\"}:\n\n%s\n\nIt expires in %v. If you did not ask for it, ignore this email: your password is unchanged.\n",
+		user.Username, token, h.cfg.PasswordResetTTL)
+	return h.mail.Send(ctx, *user.Email, "Reset your password", body)
+}
@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"errors"
+	"log"
+
+	"example.com/internal/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+// ErrorHandler answers the errors returned by the handlers with {"error": <message>} and the
+// status of the error, see errorStatus. The message of a server error is "something went
+// wrong", the error is logged unless it is errSomethingWentWrong, which is logged already.
+func ErrorHandler(c fiber.Ctx, err error) error {
+	status := errorStatus(err)
+	message := err.Error()
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		message = fiberErr.Message
+	}
+	if status >= fiber.StatusInternalServerError {
+		if !errors.Is(err, errSomethingWentWrong) {
+			log.Println(err)
+		}
+		message = errSomethingWentWrong.Error()
+	}
+	return c.Status(status).JSON(fiber.Map{"error": message})
+}
+
+// errorStatus maps the domain errors of the repository to the status they are answered with.
+// Other errors are server errors.
+func errorStatus(err error) int {
+	var fiberErr *fiber.Error
+	switch {
+	case errors.As(err, &fiberErr):
+		return fiberErr.Code
+	case errors.Is(err, repository.ErrNotFound):
+		return fiber.StatusNotFound
+	case errors.Is(err, repository.ErrForbidden):
+		return fiber.StatusForbidden
+	case errors.Is(err, repository.ErrDuplicateUser),
+		errors.Is(err, repository.ErrDuplicateLink),
+		errors.Is(err, repository.EmailTakenErr),
+		errors.Is(err, repository.FolderExistsErr),
+		errors.Is(err, repository.CollectionExistsErr):
+		return fiber.StatusConflict
+	}
+	return fiber.StatusInternalServerError
+}
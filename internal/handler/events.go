@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"example.com/internal/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+const ProgressPollInterval = 1 * time.Second
+
+type progressEvent struct {
+	DownloadID  int64  `json:"download_id"`
+	Status      string `json:"status"`
+	Bytes       int64  `json:"bytes"`
+	TotalBytes  int64  `json:"total_bytes"` // -1 if unknown
+	BytesPerSec int64  `json:"bytes_per_sec"`
+	ETA         int64  `json:"eta_seconds"` // -1 if unknown or not running
+	Error       string `json:"error,omitempty"`
+	// torrents only
+	Pieces          int64   `json:"pieces,omitempty"`
+	PiecesCompleted int64   `json:"pieces_completed,omitempty"`
+	SeedRatio       float64 `json:"seed_ratio,omitempty"`
+	// HLS/DASH only
+	Segments          int64 `json:"segments,omitempty"`
+	SegmentsCompleted int64 `json:"segments_completed,omitempty"`
+}
+
+// WatchDownload streams the progress of a download as server-sent "progress" events, one
+// per ProgressPollInterval while it changes, until the download is completed, failed or expired.
+func (h *handler) WatchDownload(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	downloadID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid download id"})
+	}
+
+	download, err := h.repo.GetDownloadRequest(c.Context(), downloadID)
+	if err != nil && !errors.Is(err, repository.DownloadRequestNotFoundErr) {
+		return err
+	}
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "download not found"})
+	}
+	allowed, err := h.canViewDownload(c.Context(), userID, download.ID, download.UserID)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "download not found"})
+	}
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+
+	// The stream is written after the handler returned, so it cannot use the request context.
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		for event := range h.watchProgress(ctx, downloadID) {
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data)
+			if err := w.Flush(); err != nil {
+				return // client went away
+			}
+		}
+	})
+
+	return nil
+}
+
+// watchProgress polls the progress of a download every ProgressPollInterval and sends it
+// whenever it changed, until the download is completed, failed or expired or ctx is done.
+func (h *handler) watchProgress(ctx context.Context, downloadID int64) <-chan progressEvent {
+	events := make(chan progressEvent)
+
+	go func() {
+		defer close(events)
+		var last progressEvent
+		for {
+			event, err := h.progressEvent(ctx, downloadID)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Println(err)
+				}
+				return
+			}
+
+			if event != last {
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+				last = event
+			}
+
+			switch event.Status {
+			case repository.StatusCompleted, repository.StatusFailed, repository.StatusExpired:
+				return
+			}
+			select {
+			case <-time.After(ProgressPollInterval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events
+}
+
+func (h *handler) progressEvent(ctx context.Context, downloadID int64) (progressEvent, error) {
+	download, err := h.repo.GetDownloadRequest(ctx, downloadID)
+	if err != nil {
+		return progressEvent{}, err
+	}
+	progress, found, err := h.repo.GetProgress(ctx, downloadID)
+	if err != nil {
+		return progressEvent{}, err
+	}
+	if !found {
+		progress.TotalBytes = -1
+	}
+	if !found || download.Status != repository.StatusDownloading {
+		progress.BytesPerSec, progress.ETA = 0, -1
+	}
+
+	return progressEvent{
+		DownloadID:        downloadID,
+		Status:            download.Status,
+		Bytes:             progress.Bytes,
+		TotalBytes:        progress.TotalBytes,
+		BytesPerSec:       progress.BytesPerSec,
+		ETA:               progress.ETA,
+		Error:             download.Error,
+		Pieces:            progress.Pieces,
+		PiecesCompleted:   progress.PiecesCompleted,
+		SeedRatio:         progress.SeedRatio,
+		Segments:          progress.Segments,
+		SegmentsCompleted: progress.SegmentsCompleted,
+	}, nil
+}
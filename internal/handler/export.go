@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/internal/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+// ExportBatchSize is the number of downloads an export reads from the database at once.
+const ExportBatchSize = 500
+
+// exportColumns are the header of the CSV exports.
+var exportColumns = []string{"id", "link", "file_name", "byte_range", "status", "error_code", "error", "bytes", "content_hash", "labels", "folder_id", "org_id", "created_at", "started_at", "finished_at", "deleted_at"}
+
+// ExportDownloadRequests streams the whole download history of the user, deleted downloads
+// included, as CSV or as a JSON array, oldest first. since and until select the downloads by
+// when they were requested and status (repeated) by their status. The export is read in
+// batches while it is written, so an error midway ends it truncated.
+func (h *handler) ExportDownloadRequests(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	format := c.Query("format", "json")
+	if format != "csv" && format != "json" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "format must be csv or json"})
+	}
+	var filter repository.ExportFilter
+	var err error
+	if value := c.Query("since"); value != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, value); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid since"})
+		}
+	}
+	if value := c.Query("until"); value != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, value); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid until"})
+		}
+	}
+	for _, value := range c.Context().QueryArgs().PeekMulti("status") {
+		status := string(value)
+		if !slices.Contains(repository.Statuses, status) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("invalid status %q, must be one of %s", status, strings.Join(repository.Statuses, ", "))})
+		}
+		filter.Statuses = append(filter.Statuses, status)
+	}
+
+	if format == "csv" {
+		c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	} else {
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	}
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="downloads.%s"`, format))
+
+	// The stream is written after the handler returned, so it cannot use the request context.
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		if err := h.exportDownloads(context.Background(), w, userID, filter, format); err != nil {
+			log.Printf("Could not export the downloads of user %d: %v\n", userID, err)
+		}
+	})
+
+	return nil
+}
+
+func (h *handler) exportDownloads(ctx context.Context, w *bufio.Writer, userID int64, filter repository.ExportFilter, format string) error {
+	csvWriter := csv.NewWriter(w)
+	if format == "csv" {
+		if err := csvWriter.Write(exportColumns); err != nil {
+			return err
+		}
+	} else {
+		w.WriteString("[")
+	}
+
+	afterID, first := int64(0), true
+	for {
+		downloads, err := h.repo.ExportDownloadRequests(ctx, userID, filter, afterID, ExportBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, download := range downloads {
+			if format == "csv" {
+				err = csvWriter.Write(exportRecord(download))
+			} else {
+				if !first {
+					w.WriteString(",")
+				}
+				var data []byte
+				if data, err = json.Marshal(download); err == nil {
+					_, err = w.Write(data)
+				}
+			}
+			if err != nil {
+				return err
+			}
+			first = false
+		}
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return nil // client went away
+		}
+		if len(downloads) < ExportBatchSize {
+			break
+		}
+		afterID = downloads[len(downloads)-1].ID
+	}
+
+	if format == "json" {
+		w.WriteString("]")
+	}
+	return w.Flush()
+}
+
+// exportRecord returns the CSV record of a download: labels as key=value pairs separated by
+// commas, times in RFC 3339 and what is unset as empty fields.
+func exportRecord(download repository.ExportedDownload) []string {
+	optionalInt := func(value *int64) string {
+		if value == nil {
+			return ""
+		}
+		return strconv.FormatInt(*value, 10)
+	}
+	optionalTime := func(value *time.Time) string {
+		if value == nil {
+			return ""
+		}
+		return value.UTC().Format(time.RFC3339)
+	}
+	labels := make([]string, 0, len(download.Labels))
+	for key, value := range download.Labels {
+		labels = append(labels, key+"="+value)
+	}
+	sort.Strings(labels)
+
+	return []string{
+		strconv.FormatInt(download.ID, 10),
+		download.Link,
+		download.FileName,
+		download.Range,
+		download.Status,
+		download.ErrorCode,
+		download.Error,
+		optionalInt(download.Bytes),
+		download.ContentHash,
+		strings.Join(labels, ","),
+		optionalInt(download.FolderID),
+		optionalInt(download.OrgID),
+		download.CreatedAt.UTC().Format(time.RFC3339),
+		optionalTime(download.StartedAt),
+		optionalTime(download.FinishedAt),
+		optionalTime(download.DeletedAt),
+	}
+}
@@ -0,0 +1,275 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"example.com/internal/consumer"
+	"example.com/internal/pipeline"
+	"example.com/internal/repository"
+	"example.com/internal/safepath"
+	"github.com/gofiber/fiber/v3"
+)
+
+// GetDownloadFile serves the file of a completed download of the user, or in a collection shared
+// with them. Hot files are read from
+// the disk of the process holding them, cold ones (also while they are restored) from cold
+// storage, or redirected to a signed URL of it with COLD_STORAGE_URL_TTL; X-Storage-Tier tells which.
+func (h *handler) GetDownloadFile(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	downloadID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid download id"})
+	}
+
+	download, err := h.repo.GetDownloadRequest(c.Context(), downloadID)
+	if err != nil && !errors.Is(err, repository.DownloadRequestNotFoundErr) {
+		return err
+	}
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "download not found"})
+	}
+	allowed, err := h.canViewDownload(c.Context(), userID, download.ID, download.UserID)
+	if err != nil {
+		return err
+	}
+	if !allowed || download.DeletedAt != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "download not found"})
+	}
+	if download.Status != repository.StatusCompleted {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "the download is not completed"})
+	}
+	steps, err := h.repo.GetPipelineSteps(c.Context(), downloadID)
+	if err != nil {
+		return err
+	}
+	for _, step := range steps {
+		// The file may be infected until it is scanned.
+		if step.Name == "virus_scan" && (step.Status == repository.PipelineStepPending || step.Status == repository.PipelineStepRunning) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "the file is being scanned for malware"})
+		}
+	}
+
+	var body io.ReadCloser
+	var size int64
+	if download.Tier == repository.TierHot {
+		if download.Host != "" && download.Host != h.cfg.InstanceID {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": fmt.Sprintf("the file is on the disk of %s", download.Host)})
+		}
+		file, err := os.Open(safepath.Long(download.FileName))
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		body, size = file, info.Size()
+	} else if h.cfg.ColdStorageURLTTL > 0 {
+		signedURL, err := h.cold.SignedURL(c.Context(), download.ColdKey, h.cfg.ColdStorageURLTTL)
+		if err != nil {
+			return err
+		}
+		c.Set("X-Storage-Tier", download.Tier)
+		return c.Redirect().Status(fiber.StatusTemporaryRedirect).To(signedURL)
+	} else {
+		body, size, err = h.cold.Get(c.Context(), download.ColdKey)
+		if err != nil {
+			log.Println(err)
+			return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "could not read the file from cold storage"})
+		}
+	}
+
+	c.Set("X-Storage-Tier", download.Tier)
+	c.Set(fiber.HeaderContentType, fiber.MIMEOctetStream)
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s"`, filepath.Base(download.FileName)))
+	if size >= 0 {
+		c.Set(fiber.HeaderContentLength, strconv.FormatInt(size, 10))
+	}
+	return c.Status(fiber.StatusOK).SendStream(body, int(size))
+}
+
+// GetDownloadThumbnail serves the JPEG thumbnail the thumbnail pipeline step wrote next to the
+// file of a completed download, which stays on the disk of its process when the file is tiered.
+func (h *handler) GetDownloadThumbnail(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	downloadID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid download id"})
+	}
+
+	download, err := h.repo.GetDownloadRequest(c.Context(), downloadID)
+	if err != nil && !errors.Is(err, repository.DownloadRequestNotFoundErr) {
+		return err
+	}
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "download not found"})
+	}
+	allowed, err := h.canViewDownload(c.Context(), userID, download.ID, download.UserID)
+	if err != nil {
+		return err
+	}
+	if !allowed || download.DeletedAt != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "download not found"})
+	}
+	if download.Status != repository.StatusCompleted {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "the download is not completed"})
+	}
+	steps, err := h.repo.GetPipelineSteps(c.Context(), downloadID)
+	if err != nil {
+		return err
+	}
+	status := ""
+	for _, step := range steps {
+		if step.Name == "thumbnail" {
+			status = step.Status
+		}
+	}
+	switch status {
+	case repository.PipelineStepPending, repository.PipelineStepRunning:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "the thumbnail is being made"})
+	case repository.PipelineStepSucceeded:
+	default:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "the download has no thumbnail"})
+	}
+	if download.Host != "" && download.Host != h.cfg.InstanceID {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": fmt.Sprintf("the thumbnail is on the disk of %s", download.Host)})
+	}
+
+	file, err := os.Open(safepath.Long(pipeline.ThumbnailPath(download.FileName)))
+	if errors.Is(err, os.ErrNotExist) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "the download has no thumbnail"})
+	}
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	c.Set(fiber.HeaderContentType, "image/jpeg")
+	c.Set(fiber.HeaderContentLength, strconv.FormatInt(info.Size(), 10))
+	return c.Status(fiber.StatusOK).SendStream(file, int(info.Size()))
+}
+
+// RestoreDownloadFile takes a download out of the trash, or else asks for its file in cold
+// storage to be copied back to the disk of a process, which the tiering job of the next
+// process to run does.
+func (h *handler) RestoreDownloadFile(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	downloadID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid download id"})
+	}
+
+	download, err := h.repo.GetDownloadRequestForUser(c.Context(), userID, downloadID)
+	if errors.Is(err, repository.DownloadRequestNotFoundErr) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "download not found"})
+	}
+	if err != nil {
+		return err
+	}
+
+	if download.DeletedAt != nil {
+		restored, err := consumer.RestoreFromTrash(c.Context(), h.repo, downloadID)
+		if err != nil {
+			return err
+		}
+		if !restored {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "download not found"}) // purged meanwhile
+		}
+		h.invalidateDownloadList(c.Context(), userID)
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "restored from the trash"})
+	}
+
+	switch download.Tier {
+	case repository.TierHot:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "the file is not in cold storage"})
+	case repository.TierRestoring:
+		return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"message": "the file is being restored"})
+	}
+
+	requested, err := h.repo.RequestRestore(c.Context(), downloadID)
+	if err != nil {
+		return err
+	}
+	if !requested {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "the file is not in cold storage"})
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"message": "the file is being restored"})
+}
+
+// DeleteDownloadRequest moves a finished download of the user to the trash, where it is kept
+// with its file for TRASH_RETENTION. Downloads in the trash, and all of them without a trash,
+// are deleted with their file at once; a file on the disk of another process is deleted by that
+// process, which the response tells with 202.
+func (h *handler) DeleteDownloadRequest(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	downloadID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid download id"})
+	}
+
+	download, err := h.repo.GetDownloadRequestForUser(c.Context(), userID, downloadID)
+	if errors.Is(err, repository.DownloadRequestNotFoundErr) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "download not found"})
+	}
+	if err != nil {
+		return err
+	}
+	if download.Status == repository.StatusQueued || download.Status == repository.StatusDownloading {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "the download is not finished, cancel it first"})
+	}
+	if download.DeletedAt == nil && h.cfg.TrashRetention > 0 {
+		trashed, err := h.repo.TrashDownloadRequest(c.Context(), downloadID)
+		if err != nil {
+			return err
+		}
+		if !trashed {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "the download is not finished, cancel it first"})
+		}
+		h.invalidateDownloadList(c.Context(), userID)
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "moved to the trash", "purge_at": time.Now().Add(h.cfg.TrashRetention)})
+	}
+	steps, err := h.repo.GetPipelineSteps(c.Context(), downloadID)
+	if err != nil {
+		return err
+	}
+	for _, step := range steps {
+		if step.Status == repository.PipelineStepPending || step.Status == repository.PipelineStepRunning {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "the file is being processed"})
+		}
+	}
+
+	if download.Tier == repository.TierHot && download.Host != "" && download.Host != h.cfg.InstanceID {
+		if err := h.repo.RequestPurge(c.Context(), downloadID); err != nil {
+			return err
+		}
+		return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"message": fmt.Sprintf("the file is deleted by %s", download.Host)})
+	}
+
+	reclaimed, err := consumer.PurgeDownload(c.Context(), h.repo, h.cfg, h.cold, downloadID, consumer.PurgeReasonUser)
+	if errors.Is(err, consumer.ErrDownloadActive) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "the download is not finished, cancel it first"})
+	}
+	if err != nil {
+		return err
+	}
+	h.invalidateDownloadList(c.Context(), userID)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "deleted", "bytes_reclaimed": reclaimed})
+}
@@ -0,0 +1,176 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+
+	"example.com/internal/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+// MaxFolderNameLength bounds the names of the folders.
+const MaxFolderNameLength = 256
+
+var errFolderNotFound = errors.New("folder not found")
+
+func (h *handler) GetFolders(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	folders, err := h.repo.GetFolders(c.Context(), userID)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"folders": folders})
+}
+
+func (h *handler) CreateFolder(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	var payload struct {
+		Name     string `json:"name"`
+		ParentID *int64 `json:"parent_id"`
+	}
+	if !bindBody(c, &payload) {
+		return nil
+	}
+
+	if err := validateFolderName(payload.Name); err != nil {
+		return invalidFields(c, FieldError{Field: "name", Message: err.Error()})
+	}
+	parentID, err := h.checkFolder(c.Context(), userID, payload.ParentID)
+	if errors.Is(err, errSomethingWentWrong) {
+		return err
+	}
+	if err != nil {
+		return invalidFields(c, FieldError{Field: "parent_id", Message: "parent " + err.Error()})
+	}
+
+	folderID, err := h.repo.CreateFolder(c.Context(), repository.Folder{UserID: userID, ParentID: parentID, Name: payload.Name})
+	if errors.Is(err, repository.FolderExistsErr) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"folder_id": folderID})
+}
+
+// UpdateFolder renames a folder and moves it, with its subfolders and downloads, under
+// another parent (parent_id 0 for the top level).
+func (h *handler) UpdateFolder(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	folderID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid folder id"})
+	}
+
+	var payload struct {
+		Name     *string `json:"name"`
+		ParentID *int64  `json:"parent_id"`
+	}
+	if !bindBody(c, &payload) {
+		return nil
+	}
+	if payload.Name == nil && payload.ParentID == nil {
+		return invalidFields(c, FieldError{Field: "name", Message: "name or parent_id is required"})
+	}
+
+	folder, found, err := h.repo.GetFolder(c.Context(), folderID)
+	if err != nil {
+		return err
+	}
+	if !found || folder.UserID != userID {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": errFolderNotFound.Error()})
+	}
+
+	if payload.Name != nil {
+		if err := validateFolderName(*payload.Name); err != nil {
+			return invalidFields(c, FieldError{Field: "name", Message: err.Error()})
+		}
+		folder.Name = *payload.Name
+	}
+	if payload.ParentID != nil {
+		folder.ParentID, err = h.checkFolder(c.Context(), userID, payload.ParentID)
+		if errors.Is(err, errSomethingWentWrong) {
+			return err
+		}
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "parent " + err.Error()})
+		}
+	}
+
+	err = h.repo.UpdateFolder(c.Context(), folder)
+	if errors.Is(err, repository.FolderExistsErr) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+	}
+	if errors.Is(err, repository.FolderCycleErr) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+	if payload.ParentID != nil {
+		// Its downloads moved out of the folders listing them recursively.
+		h.invalidateDownloadList(c.Context(), userID)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(folder)
+}
+
+// DeleteFolder deletes a folder with its subfolders; their downloads are kept, in no folder.
+func (h *handler) DeleteFolder(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	folderID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid folder id"})
+	}
+
+	deleted, err := h.repo.DeleteFolder(c.Context(), userID, folderID)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": errFolderNotFound.Error()})
+	}
+	h.invalidateDownloadList(c.Context(), userID)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "done"})
+}
+
+func validateFolderName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return errors.New("name is required")
+	}
+	if len(name) > MaxFolderNameLength {
+		return errors.New("name is too long")
+	}
+	if strings.Contains(name, "/") {
+		return errors.New("name must not contain /")
+	}
+	return nil
+}
+
+// checkFolder checks that the folder, if any, is one of the user's. 0 means no folder, for
+// which it returns nil. Errors other than errSomethingWentWrong are the client's.
+func (h *handler) checkFolder(ctx context.Context, userID int64, folderID *int64) (*int64, error) {
+	if folderID == nil || *folderID == 0 {
+		return nil, nil
+	}
+
+	folder, found, err := h.repo.GetFolder(ctx, *folderID)
+	if err != nil {
+		log.Println(err)
+		return nil, errSomethingWentWrong
+	}
+	if !found || folder.UserID != userID {
+		return nil, errFolderNotFound
+	}
+	return folderID, nil
+}
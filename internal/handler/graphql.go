@@ -0,0 +1,135 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"example.com/internal/graphql"
+	gqlgen "github.com/99designs/gqlgen/graphql"
+	"github.com/99designs/gqlgen/graphql/executor"
+	"github.com/99designs/gqlgen/graphql/handler/extension"
+	"github.com/gofiber/fiber/v3"
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+type userIDKey struct{}
+
+// graphqlResolver is the root of the resolvers of internal/graphql/schema.graphqls, which
+// are in graphql.resolvers.go.
+type graphqlResolver struct {
+	h *handler
+}
+
+func (h *handler) newGraphQLExecutor() *executor.Executor {
+	exec := executor.New(graphql.NewExecutableSchema(graphql.Config{Resolvers: &graphqlResolver{h: h}}))
+	exec.Use(extension.Introspection{})
+	return exec
+}
+
+// GraphQL serves the GraphQL API: queries as JSON and subscriptions as server-sent "next"
+// events followed by a "complete" event (the distinct connections mode of GraphQL over SSE).
+// Field names are the same as in the REST API.
+func (h *handler) GraphQL(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	start := gqlgen.Now()
+	params := &gqlgen.RawParams{}
+	if err := json.Unmarshal(c.Body(), params); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "could not parse request body"})
+	}
+	params.ReadTime = gqlgen.TraceTiming{Start: start, End: gqlgen.Now()}
+
+	// Subscriptions are streamed after the handler returned, so they cannot use the request context.
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), userIDKey{}, userID))
+	ctx = gqlgen.StartOperationTrace(ctx)
+	op, errs := h.graphql.CreateOperationContext(ctx, params)
+	if errs != nil {
+		cancel()
+		return c.Status(fiber.StatusBadRequest).JSON(h.graphql.DispatchError(gqlgen.WithOperationContext(ctx, op), errs))
+	}
+	responses, ctx := h.graphql.DispatchOperation(ctx, op)
+
+	if op.Operation.Operation != ast.Subscription {
+		defer cancel()
+		return c.Status(fiber.StatusOK).JSON(responses(ctx))
+	}
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer cancel()
+		for response := responses(ctx); response != nil; response = responses(ctx) {
+			data, _ := json.Marshal(response)
+			fmt.Fprintf(w, "event: next\ndata: %s\n\n", data)
+			if err := w.Flush(); err != nil {
+				return // client went away
+			}
+		}
+		fmt.Fprint(w, "event: complete\ndata:\n\n")
+		w.Flush()
+	})
+
+	return nil
+}
+
+// requireAdmin is AdminMiddleware for single fields.
+func (r *graphqlResolver) requireAdmin(ctx context.Context) error {
+	isAdmin, err := r.h.repo.IsAdmin(ctx, ctx.Value(userIDKey{}).(int64))
+	if err != nil {
+		log.Println(err)
+		return errSomethingWentWrong
+	}
+	if !isAdmin {
+		return errors.New("admin access required")
+	}
+	return nil
+}
+
+// graphqlDownload builds a Download model.
+func graphqlDownload(id int64, userID int64, link string, fileName string, completed bool, downloadErr string, priority int64, contentHash string, status string, expiresAt *time.Time, labels map[string]string, byteRange string, originProfileID *int64, maxSpeed int64, manifestURL string, verification string, verificationDetail string, folderID *int64, mirrors []string, tier string) *graphql.Download {
+	return &graphql.Download{
+		ID:                  id,
+		UserID:              userID,
+		Link:                link,
+		FileName:            fileName,
+		Completed:           completed,
+		Error:               downloadErr,
+		Priority:            priority,
+		ContentHash:         contentHash,
+		Status:              status,
+		ExpiresAt:           expiresAt,
+		Labels:              labels,
+		Range:               byteRange,
+		OriginProfileID:     originProfileID,
+		MaxSpeedBytesPerSec: maxSpeed,
+		ManifestURL:         manifestURL,
+		Verification:        verification,
+		VerificationDetail:  verificationDetail,
+		FolderID:            folderID,
+		Mirrors:             mirrors,
+		Tier:                tier,
+	}
+}
+
+// graphqlProgress builds a Progress model.
+func graphqlProgress(event progressEvent) *graphql.Progress {
+	return &graphql.Progress{
+		DownloadID:        event.DownloadID,
+		Status:            event.Status,
+		Bytes:             event.Bytes,
+		TotalBytes:        event.TotalBytes,
+		Error:             event.Error,
+		Pieces:            event.Pieces,
+		PiecesCompleted:   event.PiecesCompleted,
+		SeedRatio:         event.SeedRatio,
+		Segments:          event.Segments,
+		SegmentsCompleted: event.SegmentsCompleted,
+	}
+}
@@ -0,0 +1,196 @@
+package handler
+
+// This file will be automatically regenerated based on the schema, any resolver implementations
+// will be copied through when generating and any unknown code will be moved to the end.
+// Code generated by github.com/99designs/gqlgen version v0.17.49
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"example.com/internal/consumer"
+	graphql1 "example.com/internal/graphql"
+	"example.com/internal/repository"
+)
+
+// Progress is the resolver for the progress field.
+func (r *downloadGraphqlResolver) Progress(ctx context.Context, obj *graphql1.Download) (*graphql1.Progress, error) {
+	event, err := r.h.progressEvent(ctx, obj.ID)
+	if err != nil {
+		log.Println(err)
+		return nil, errSomethingWentWrong
+	}
+	return graphqlProgress(event), nil
+}
+
+// Attempts is the resolver for the attempts field.
+func (r *downloadGraphqlResolver) Attempts(ctx context.Context, obj *graphql1.Download) ([]repository.Attempt, error) {
+	attempts, err := r.h.repo.GetAttempts(ctx, obj.ID)
+	if err != nil {
+		log.Println(err)
+		return nil, errSomethingWentWrong
+	}
+	return attempts, nil
+}
+
+// Downloads is the resolver for the downloads field.
+func (r *queryGraphqlResolver) Downloads(ctx context.Context, page *int64, limit *int64, labels map[string]string, folderID *int64, recursive *bool) ([]graphql1.Download, error) {
+	userID := ctx.Value(userIDKey{}).(int64)
+
+	p, l := int64(0), int64(DefaultPageSize)
+	if page != nil {
+		p = *page
+	}
+	if limit != nil {
+		l = *limit
+	}
+	if p < 0 || l <= 0 {
+		return nil, errors.New("page must not be negative and limit must be positive")
+	}
+	if l > MaxPageSize {
+		l = MaxPageSize
+	}
+
+	filter := repository.DownloadFilter{Labels: make(map[string]string)}
+	for key, value := range labels {
+		if err := validateLabel(key, value); err != nil {
+			return nil, err
+		}
+		filter.Labels[key] = value
+	}
+	if folderID != nil {
+		if _, err := r.h.checkFolder(ctx, userID, folderID); err != nil {
+			return nil, err
+		}
+		filter.FolderID = folderID
+	}
+	if recursive != nil {
+		filter.Recursive = *recursive
+	}
+
+	downloads, _, err := r.h.repo.GetDownloadRequests(ctx, userID, p, l, filter)
+	if err != nil {
+		log.Println(err)
+		return nil, errSomethingWentWrong
+	}
+
+	result := make([]graphql1.Download, 0, len(downloads))
+	for _, download := range downloads {
+		result = append(result, *graphqlDownload(download.ID, download.UserID, download.Link, download.FileName, download.Completed, download.Error, download.Priority, download.ContentHash, download.Status, download.ExpiresAt, download.Labels, download.Range, download.OriginProfileID, download.MaxSpeed, download.ManifestURL, download.Verification, download.VerificationDetail, download.FolderID, download.Mirrors, download.Tier))
+	}
+	return result, nil
+}
+
+// Download is the resolver for the download field.
+func (r *queryGraphqlResolver) Download(ctx context.Context, id int64) (*graphql1.Download, error) {
+	download, err := r.h.repo.GetDownloadRequest(ctx, id)
+	if errors.Is(err, repository.DownloadRequestNotFoundErr) {
+		return nil, nil
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, errSomethingWentWrong
+	}
+	allowed, err := r.h.canViewDownload(ctx, ctx.Value(userIDKey{}).(int64), download.ID, download.UserID)
+	if err != nil || !allowed {
+		return nil, err
+	}
+	return graphqlDownload(download.ID, download.UserID, download.Link, download.FileName, download.Completed, download.Error, download.Priority, download.ContentHash, download.Status, download.ExpiresAt, download.Labels, download.Range, download.OriginProfileID, download.MaxSpeed, download.ManifestURL, download.Verification, download.VerificationDetail, download.FolderID, download.Mirrors, download.Tier), nil
+}
+
+// Notifications is the resolver for the notifications field.
+func (r *queryGraphqlResolver) Notifications(ctx context.Context, limit *int64) ([]repository.Notification, error) {
+	l := int64(MaxNotifications)
+	if limit != nil && *limit > 0 && *limit < MaxNotifications {
+		l = *limit
+	}
+
+	notifications, err := r.h.repo.GetNotifications(ctx, ctx.Value(userIDKey{}).(int64), l)
+	if err != nil {
+		log.Println(err)
+		return nil, errSomethingWentWrong
+	}
+	return notifications, nil
+}
+
+// Folders is the resolver for the folders field.
+func (r *queryGraphqlResolver) Folders(ctx context.Context) ([]repository.Folder, error) {
+	folders, err := r.h.repo.GetFolders(ctx, ctx.Value(userIDKey{}).(int64))
+	if err != nil {
+		log.Println(err)
+		return nil, errSomethingWentWrong
+	}
+	return folders, nil
+}
+
+// Usage is the resolver for the usage field.
+func (r *queryGraphqlResolver) Usage(ctx context.Context) (*graphql1.Usage, error) {
+	storedBytes, err := r.h.repo.GetUserUsage(ctx, ctx.Value(userIDKey{}).(int64))
+	if err != nil {
+		log.Println(err)
+		return nil, errSomethingWentWrong
+	}
+	return &graphql1.Usage{StoredBytes: storedBytes, QuotaBytes: r.h.cfg.UserQuotaBytes}, nil
+}
+
+// Stats is the resolver for the stats field.
+func (r *queryGraphqlResolver) Stats(ctx context.Context) (*repository.QueueStats, error) {
+	if err := r.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	stats, err := r.h.repo.GetQueueStats(ctx)
+	if err != nil {
+		log.Println(err)
+		return nil, errSomethingWentWrong
+	}
+	return &stats, nil
+}
+
+// Workers is the resolver for the workers field.
+func (r *queryGraphqlResolver) Workers(ctx context.Context) ([]consumer.WorkerStatus, error) {
+	if err := r.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	return r.h.workers(), nil
+}
+
+// DownloadProgress is the resolver for the download_progress field.
+func (r *subscriptionGraphqlResolver) DownloadProgress(ctx context.Context, id int64) (<-chan *graphql1.Progress, error) {
+	download, err := r.Query().Download(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if download == nil {
+		return nil, errors.New("download not found")
+	}
+
+	progress := make(chan *graphql1.Progress)
+	go func() {
+		defer close(progress)
+		for event := range r.h.watchProgress(ctx, id) {
+			select {
+			case progress <- graphqlProgress(event):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return progress, nil
+}
+
+// Download returns graphql1.DownloadResolver implementation.
+func (r *graphqlResolver) Download() graphql1.DownloadResolver { return &downloadGraphqlResolver{r} }
+
+// Query returns graphql1.QueryResolver implementation.
+func (r *graphqlResolver) Query() graphql1.QueryResolver { return &queryGraphqlResolver{r} }
+
+// Subscription returns graphql1.SubscriptionResolver implementation.
+func (r *graphqlResolver) Subscription() graphql1.SubscriptionResolver {
+	return &subscriptionGraphqlResolver{r}
+}
+
+type downloadGraphqlResolver struct{ *graphqlResolver }
+type queryGraphqlResolver struct{ *graphqlResolver }
+type subscriptionGraphqlResolver struct{ *graphqlResolver }
@@ -0,0 +1,438 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"example.com/internal/jwtkeys"
+	"example.com/internal/repository"
+	"example.com/pkg/downloaderpb"
+	"github.com/gofiber/fiber/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/encoding/gzip" // gzip compressed messages
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcServer implements the downloader.v1.Downloader service of proto/downloader.proto with
+// the operations of the REST API for users. Rate limits are shared with the REST API.
+type grpcServer struct {
+	downloaderpb.UnimplementedDownloaderServer
+	h    *handler
+	keys jwtkeys.Keys
+	_    struct{}
+}
+
+// GRPC returns the gRPC server of the downloader.v1.Downloader service, ready to be served.
+func (h *handler) GRPC(keys jwtkeys.Keys) *grpc.Server {
+	s := &grpcServer{h: h, keys: keys}
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(s.authUnary),
+		grpc.StreamInterceptor(s.authStream),
+	)
+	downloaderpb.RegisterDownloaderServer(srv, s)
+	return srv
+}
+
+// authenticate is AuthMiddleware and the downloads rate limit for gRPC methods: the user of
+// the token in the authorization metadata is put in the returned context under userIDKey.
+// Register and Login are left alone.
+func (s *grpcServer) authenticate(ctx context.Context, method string) (context.Context, error) {
+	if method == downloaderpb.Downloader_Register_FullMethodName || method == downloaderpb.Downloader_Login_FullMethodName {
+		return ctx, nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	authHeader := strings.Join(md.Get("authorization"), "")
+	if authHeader == "" {
+		return nil, status.Error(codes.Unauthenticated, "missing authorization metadata")
+	}
+	userID, version, sessionID, err := parseToken(authHeader, s.keys)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "%v", err)
+	}
+	if err := checkToken(ctx, s.h.repo, userID, version, sessionID); err != nil {
+		return nil, grpcError(err, codes.Unauthenticated)
+	}
+
+	if err := s.rateLimit(ctx, fmt.Sprintf("downloads:user:%d", userID), s.h.cfg.DownloadsRateLimit); err != nil {
+		return nil, err
+	}
+	return context.WithValue(ctx, userIDKey{}, userID), nil
+}
+
+func (s *grpcServer) authUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	authCtx, err := s.authenticate(ctx, info.FullMethod)
+	if err != nil {
+		s.audit(ctx, info.FullMethod, req, nil, err)
+		return nil, err
+	}
+	resp, err := handler(authCtx, req)
+	s.audit(authCtx, info.FullMethod, req, resp, err)
+	return resp, err
+}
+
+// auditedMethods are the methods recorded in the audit log, those that change something.
+var auditedMethods = map[string]bool{
+	downloaderpb.Downloader_Register_FullMethodName:       true,
+	downloaderpb.Downloader_Login_FullMethodName:          true,
+	downloaderpb.Downloader_CreateDownload_FullMethodName: true,
+	downloaderpb.Downloader_CancelDownload_FullMethodName: true,
+}
+
+// audit is AuditMiddleware for gRPC methods: the action is the method and the resource the
+// download it acted on.
+func (s *grpcServer) audit(ctx context.Context, method string, req any, resp any, err error) {
+	if !auditedMethods[method] {
+		return
+	}
+
+	entry := repository.AuditEntry{
+		Action:   method,
+		Resource: method,
+		IP:       peerIP(ctx),
+		Status:   status.Code(err).String(),
+		Result:   repository.AuditResultSuccess,
+	}
+	if err != nil {
+		entry.Result = repository.AuditResultFailure
+	}
+	if userID, ok := ctx.Value(userIDKey{}).(int64); ok {
+		entry.UserID = &userID
+	}
+	switch req := req.(type) {
+	case *downloaderpb.Credentials:
+		entry.Username = req.Username
+	case *downloaderpb.CancelDownloadRequest:
+		entry.Resource = fmt.Sprintf("/downloads/%d", req.Id)
+	}
+	if err == nil {
+		switch resp := resp.(type) {
+		case *downloaderpb.RegisterResponse:
+			entry.UserID = &resp.UserId
+		case *downloaderpb.CreateDownloadResponse:
+			entry.Resource = fmt.Sprintf("/downloads/%d", resp.DownloadId)
+		}
+	}
+	addAuditEntry(ctx, s.h.repo, entry)
+}
+
+func (s *grpcServer) authStream(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authenticate(stream.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+}
+
+// authenticatedStream is a server stream carrying the context of authenticate.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// rateLimit is RateLimitMiddleware for gRPC methods.
+func (s *grpcServer) rateLimit(ctx context.Context, key string, limit int64) error {
+	if limit <= 0 {
+		return nil
+	}
+
+	result, err := s.h.repo.RateLimit(ctx, key, limit, s.h.cfg.RateLimitWindow, 1)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	if !result.Allowed {
+		return status.Errorf(codes.ResourceExhausted, "too many requests, retry in %v", result.Reset.Round(1e9))
+	}
+	return nil
+}
+
+// grpcError maps the errors of the shared handler helpers to gRPC statuses: errSomethingWentWrong
+// to Internal, the domain errors of the repository to the status matching theirs (see
+// errorStatus) and the others, which are the client's, to code.
+func grpcError(err error, code codes.Code) error {
+	if errors.Is(err, errSomethingWentWrong) {
+		return status.Errorf(codes.Internal, "%v", err)
+	}
+	switch errorStatus(err) {
+	case fiber.StatusNotFound:
+		code = codes.NotFound
+	case fiber.StatusForbidden:
+		code = codes.PermissionDenied
+	case fiber.StatusConflict:
+		code = codes.AlreadyExists
+	}
+	return status.Errorf(code, "%v", err)
+}
+
+func (s *grpcServer) Register(ctx context.Context, req *downloaderpb.Credentials) (*downloaderpb.RegisterResponse, error) {
+	if err := s.rateLimit(ctx, "register:ip:"+peerIP(ctx), s.h.cfg.AuthRateLimit); err != nil {
+		return nil, err
+	}
+
+	hashedPassword, err := hashCredentials(req.Username, req.Password)
+	if err != nil {
+		return nil, grpcError(err, codes.InvalidArgument)
+	}
+	if s.h.cfg.RequireEmailVerification {
+		return nil, status.Error(codes.FailedPrecondition, "an email is required, register with the REST API")
+	}
+
+	userID, err := s.h.repo.CreateUser(ctx, req.Username, hashedPassword, "")
+	if errors.Is(err, repository.ErrDuplicateUser) {
+		return nil, grpcError(err, codes.AlreadyExists)
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, grpcError(errSomethingWentWrong, codes.Internal)
+	}
+
+	return &downloaderpb.RegisterResponse{UserId: userID}, nil
+}
+
+func (s *grpcServer) Login(ctx context.Context, req *downloaderpb.Credentials) (*downloaderpb.LoginResponse, error) {
+	if err := s.rateLimit(ctx, "login:ip:"+peerIP(ctx), s.h.cfg.AuthRateLimit); err != nil {
+		return nil, err
+	}
+
+	userID, err := s.h.repo.AuthUser(ctx, req.Username, req.Password)
+	if err != nil {
+		log.Println(err)
+		return nil, grpcError(errSomethingWentWrong, codes.Internal)
+	}
+	if userID == 0 {
+		return nil, status.Error(codes.Unauthenticated, "invalid username or password")
+	}
+
+	version, err := tokenVersion(ctx, s.h.repo, userID)
+	if err == nil {
+		err = s.h.checkEmailVerified(ctx, userID)
+	}
+	if err != nil {
+		return nil, grpcError(err, codes.PermissionDenied)
+	}
+
+	var userAgent string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		userAgent = strings.Join(md.Get("user-agent"), " ")
+	}
+	token, err := issueToken(ctx, s.h.repo, userID, version, s.keys, peerIP(ctx), userAgent)
+	if err != nil {
+		log.Println(err)
+		return nil, status.Error(codes.Internal, "could not create token")
+	}
+
+	return &downloaderpb.LoginResponse{Token: token}, nil
+}
+
+func (s *grpcServer) CreateDownload(ctx context.Context, req *downloaderpb.CreateDownloadRequest) (*downloaderpb.CreateDownloadResponse, error) {
+	userID := ctx.Value(userIDKey{}).(int64)
+
+	options := downloadOptions{
+		Labels:      req.Labels,
+		Range:       req.Range,
+		MaxSpeed:    req.MaxSpeedBytesPerSec,
+		ManifestURL: req.ManifestUrl,
+		Mirrors:     req.Mirrors,
+	}
+	if options.Labels == nil {
+		options.Labels = make(map[string]string)
+	}
+	if req.Priority != 0 {
+		options.Priority = &req.Priority
+	}
+	if req.Credentials != nil {
+		options.Credentials = &repository.Credentials{
+			Username:   req.Credentials.Username,
+			Password:   req.Credentials.Password,
+			PrivateKey: req.Credentials.PrivateKey,
+			HostKey:    req.Credentials.HostKey,
+		}
+	}
+	if req.OriginProfileId != 0 {
+		options.OriginProfileID = &req.OriginProfileId
+	}
+	if req.FolderId != 0 {
+		options.FolderID = &req.FolderId
+	}
+
+	download, err := s.h.prepareDownload(ctx, userID, req.Link, options)
+	if err != nil {
+		return nil, grpcError(err, codes.InvalidArgument)
+	}
+	downloadID, downloadStatus, created, err := s.h.createDownload(ctx, download)
+	if errors.Is(err, errQueueOverloaded) {
+		return nil, status.Errorf(codes.Unavailable, "%v", err)
+	}
+	if err != nil {
+		return nil, grpcError(err, codes.ResourceExhausted)
+	}
+
+	return &downloaderpb.CreateDownloadResponse{DownloadId: downloadID, Created: created, Status: downloadStatus}, nil
+}
+
+func (s *grpcServer) ListDownloads(ctx context.Context, req *downloaderpb.ListDownloadsRequest) (*downloaderpb.ListDownloadsResponse, error) {
+	userID := ctx.Value(userIDKey{}).(int64)
+
+	page, limit := req.Page, req.Limit
+	if page < 0 {
+		page = 0
+	}
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+	filter := repository.DownloadFilter{Labels: req.Labels, FolderID: req.FolderId, Recursive: req.Recursive}
+	if filter.Labels == nil {
+		filter.Labels = make(map[string]string)
+	}
+	for key, value := range filter.Labels {
+		if err := validateLabel(key, value); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+	}
+	if filter.FolderID != nil {
+		if _, err := s.h.checkFolder(ctx, userID, filter.FolderID); err != nil {
+			return nil, grpcError(err, codes.InvalidArgument)
+		}
+	}
+
+	downloads, _, err := s.h.repo.GetDownloadRequests(ctx, userID, page, limit, filter)
+	if err != nil {
+		log.Println(err)
+		return nil, grpcError(errSomethingWentWrong, codes.Internal)
+	}
+
+	resp := &downloaderpb.ListDownloadsResponse{}
+	for _, download := range downloads {
+		resp.Downloads = append(resp.Downloads, grpcDownload(download.ID, download.UserID, download.Link, download.FileName, download.Completed, download.Error, download.Priority, download.ContentHash, download.Status, download.ExpiresAt, download.Labels, download.Range, download.OriginProfileID, download.MaxSpeed, download.ManifestURL, download.Verification, download.VerificationDetail, download.FolderID, download.Mirrors, download.Tier))
+	}
+	return resp, nil
+}
+
+func (s *grpcServer) GetDownload(ctx context.Context, req *downloaderpb.GetDownloadRequest) (*downloaderpb.Download, error) {
+	return s.download(ctx, req.Id)
+}
+
+func (s *grpcServer) CancelDownload(ctx context.Context, req *downloaderpb.CancelDownloadRequest) (*downloaderpb.Download, error) {
+	download, err := s.download(ctx, req.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	canceled, err := s.h.repo.CancelDownloadRequest(ctx, download.Id)
+	if err != nil {
+		log.Println(err)
+		return nil, grpcError(errSomethingWentWrong, codes.Internal)
+	}
+	if !canceled {
+		return nil, status.Errorf(codes.FailedPrecondition, "download is already %s", download.Status)
+	}
+	s.h.invalidateDownloadList(ctx, download.UserId)
+
+	return s.download(ctx, req.Id)
+}
+
+func (s *grpcServer) WatchProgress(req *downloaderpb.WatchProgressRequest, stream grpc.ServerStreamingServer[downloaderpb.Progress]) error {
+	ctx := stream.Context()
+	download, err := s.download(ctx, req.Id)
+	if err != nil {
+		return err
+	}
+
+	for event := range s.h.watchProgress(ctx, download.Id) {
+		err := stream.Send(&downloaderpb.Progress{
+			DownloadId:        event.DownloadID,
+			Status:            event.Status,
+			Bytes:             event.Bytes,
+			TotalBytes:        event.TotalBytes,
+			Error:             event.Error,
+			Pieces:            event.Pieces,
+			PiecesCompleted:   event.PiecesCompleted,
+			SeedRatio:         event.SeedRatio,
+			Segments:          event.Segments,
+			SegmentsCompleted: event.SegmentsCompleted,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return status.Error(codes.DeadlineExceeded, "deadline exceeded")
+	}
+	return nil
+}
+
+// download returns the download of the user with the id of a Get/Cancel/WatchProgress request.
+func (s *grpcServer) download(ctx context.Context, downloadID int64) (*downloaderpb.Download, error) {
+	download, err := s.h.repo.GetDownloadRequestForUser(ctx, ctx.Value(userIDKey{}).(int64), downloadID)
+	if errors.Is(err, repository.DownloadRequestNotFoundErr) {
+		return nil, status.Error(codes.NotFound, "download not found")
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, grpcError(errSomethingWentWrong, codes.Internal)
+	}
+
+	return grpcDownload(download.ID, download.UserID, download.Link, download.FileName, download.Completed, download.Error, download.Priority, download.ContentHash, download.Status, download.ExpiresAt, download.Labels, download.Range, download.OriginProfileID, download.MaxSpeed, download.ManifestURL, download.Verification, download.VerificationDetail, download.FolderID, download.Mirrors, download.Tier), nil
+}
+
+// grpcDownload builds a Download message.
+func grpcDownload(id int64, userID int64, link string, fileName string, completed bool, downloadErr string, priority int64, contentHash string, downloadStatus string, expiresAt *time.Time, labels map[string]string, byteRange string, originProfileID *int64, maxSpeed int64, manifestURL string, verification string, verificationDetail string, folderID *int64, mirrors []string, tier string) *downloaderpb.Download {
+	download := &downloaderpb.Download{
+		Id:                  id,
+		UserId:              userID,
+		Link:                link,
+		FileName:            fileName,
+		Completed:           completed,
+		Error:               downloadErr,
+		Priority:            priority,
+		ContentHash:         contentHash,
+		Status:              downloadStatus,
+		Labels:              labels,
+		Range:               byteRange,
+		MaxSpeedBytesPerSec: maxSpeed,
+		ManifestUrl:         manifestURL,
+		Verification:        verification,
+		VerificationDetail:  verificationDetail,
+		Mirrors:             mirrors,
+		Tier:                tier,
+	}
+	if expiresAt != nil {
+		download.ExpiresAt = timestamppb.New(*expiresAt)
+	}
+	if originProfileID != nil {
+		download.OriginProfileId = *originProfileID
+	}
+	if folderID != nil {
+		download.FolderId = *folderID
+	}
+	return download
+}
+
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
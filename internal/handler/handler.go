@@ -1,23 +1,61 @@
 package handler
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash/fnv"
 	"log"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
+	"example.com/internal/coldstore"
+	"example.com/internal/config"
+	"example.com/internal/consumer"
+	"example.com/internal/flags"
+	"example.com/internal/httpclient"
+	"example.com/internal/jwtkeys"
+	"example.com/internal/layout"
+	"example.com/internal/mailer"
+	"example.com/internal/outbox"
+	"example.com/internal/pipeline"
+	"example.com/internal/proxy"
 	"example.com/internal/repository"
+	"example.com/internal/secrets"
+	"example.com/internal/urlguard"
+	"github.com/99designs/gqlgen/graphql/executor"
 	"github.com/gofiber/fiber/v3"
-	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc"
 )
 
+const MinPriority = 1
+const MaxPriority = 10
+const DefaultPriority = 1
+const MaxNotifications = 100
+const DefaultPageSize = 20
+const MaxPageSize = 100 // larger limits are lowered to it
+const MaxMirrors = 8
+
 type handler struct {
-	repo repository.Repository
-	_    struct{}
+	repo     repository.Repository
+	cfg      *config.Config
+	guard    urlguard.Guard
+	proxy    proxy.Proxy
+	consumer consumer.Consumer
+	box      secrets.Box
+	cold     coldstore.Store
+	flags    flags.Flags
+	pressure outbox.Pressure
+	pipeline pipeline.Pipeline
+	mail     mailer.Sender
+	graphql  *executor.Executor
+	_        struct{}
 }
 
 type Handler interface {
@@ -25,107 +63,837 @@ type Handler interface {
 	GetDownloadRequests(c fiber.Ctx) error
 	// Command: download a file
 	CreateDownloadRequest(c fiber.Ctx) error
+	// Command: download many files, with a result per link
+	CreateDownloadRequests(c fiber.Ctx) error
+	// Command: stop a queued or running download
+	CancelDownloadRequest(c fiber.Ctx) error
+	// Command: queue a failed download again
+	RetryDownloadRequest(c fiber.Ctx) error
+	// Command: change the speed limit or the folder of a download
+	UpdateDownloadRequest(c fiber.Ctx) error
+	// Progress of a download as server-sent events
+	WatchDownload(c fiber.Ctx) error
+	// Debug bundle of a download: the request and all its attempts
+	GetDownloadDebug(c fiber.Ctx) error
+	// Steps of the processing of a download once it completed, with their status
+	GetDownloadPipeline(c fiber.Ctx) error
+	// File of a completed download, from the disk or (slower) from cold storage
+	ExportDownloadRequests(c fiber.Ctx) error
+	GetDownloadFile(c fiber.Ctx) error
+	GetDownloadThumbnail(c fiber.Ctx) error
+	// Command: copy the file of a download back from cold storage to a disk
+	RestoreDownloadFile(c fiber.Ctx) error
+	// Command: delete a finished download with its file before its retention runs out
+	DeleteDownloadRequest(c fiber.Ctx) error
 	// User Registeration
 	Register(c fiber.Ctx) error
 	// User Login
-	Login(c fiber.Ctx, jwtSecret string) error
+	Login(c fiber.Ctx, keys jwtkeys.Keys) error
+	// Set a new password with a reset token issued by an admin
+	ResetPassword(c fiber.Ctx) error
+	// Set a new password given the current one
+	ChangePassword(c fiber.Ctx, keys jwtkeys.Keys) error
+	// Sessions of the tokens of the user: list them and revoke one
+	GetSessions(c fiber.Ctx) error
+	DeleteSession(c fiber.Ctx) error
+	// Email of the account: set it, verify it with the mailed token, and reset a forgotten
+	// password with a token mailed to it
+	SetEmail(c fiber.Ctx) error
+	VerifyEmail(c fiber.Ctx) error
+	ResendVerificationEmail(c fiber.Ctx) error
+	ForgotPassword(c fiber.Ctx) error
+	// Command: delete the account with its downloads and files
+	DeleteAccount(c fiber.Ctx) error
+	// Storage consumption of the user
+	GetUsage(c fiber.Ctx) error
+	// Notifications of the user, e.g. expired downloads
+	GetNotifications(c fiber.Ctx) error
+	// Caching proxy: serve a URL from the content store or the origin
+	Proxy(c fiber.Ctx) error
+	// Pass-through: stream a URL from its origin to the client, without queueing or storing it
+	Fetch(c fiber.Ctx) error
+	// Watch folder: enqueue the links of the files dropped in WATCH_DIR until ctx is done
+	WatchFolder(ctx context.Context)
+	// Admin: manage the cache policies of the proxy
+	GetCachePolicies(c fiber.Ctx) error
+	CreateCachePolicy(c fiber.Ctx) error
+	DeleteCachePolicy(c fiber.Ctx) error
+	// Admin: feature flags gating new behaviors per user
+	GetFeatureFlags(c fiber.Ctx) error
+	SetFeatureFlag(c fiber.Ctx) error
+	DeleteFeatureFlag(c fiber.Ctx) error
+	// Admin: status and scaling of the worker pool
+	GetWorkers(c fiber.Ctx) error
+	ScaleWorkers(c fiber.Ctx) error
+	GetLiveWorkers(c fiber.Ctx) error
+	// Admin: the API and worker processes sending heartbeats
+	GetProcesses(c fiber.Ctx) error
+	// Admin: capacity of the volumes the processes write files to
+	GetVolumes(c fiber.Ctx) error
+	// Admin: search users, see their usage, disable accounts and force password resets
+	GetUsers(c fiber.Ctx) error
+	GetUser(c fiber.Ctx) error
+	DisableUser(c fiber.Ctx) error
+	EnableUser(c fiber.Ctx) error
+	RequirePasswordReset(c fiber.Ctx) error
+	SetUserRetention(c fiber.Ctx) error
+	// Admin: queue events per time bucket
+	GetQueueTimeline(c fiber.Ctx) error
+	// Admin: queue, workers of all processes, downloads in flight and recent failures
+	GetDashboard(c fiber.Ctx) error
+	GetFailures(c fiber.Ctx) error
+	// Audit log of the actions of users and admins
+	GetAuditLog(c fiber.Ctx) error
+	// Webhooks: secret URLs for external systems to enqueue downloads
+	GetHooks(c fiber.Ctx) error
+	CreateHook(c fiber.Ctx) error
+	DeleteHook(c fiber.Ctx) error
+	TriggerHook(c fiber.Ctx) error
+	// Completion scripts: run in a sandbox on the files of the completed downloads
+	GetCompletionScripts(c fiber.Ctx) error
+	CreateCompletionScript(c fiber.Ctx) error
+	DeleteCompletionScript(c fiber.Ctx) error
+	// Origin profiles: reusable credentials of authenticated origins
+	GetOriginProfiles(c fiber.Ctx) error
+	CreateOriginProfile(c fiber.Ctx) error
+	DeleteOriginProfile(c fiber.Ctx) error
+	// Folders: a tree per user to organize the downloads in
+	GetFolders(c fiber.Ctx) error
+	CreateFolder(c fiber.Ctx) error
+	UpdateFolder(c fiber.Ctx) error
+	DeleteFolder(c fiber.Ctx) error
+	// Collections: named groups of downloads, with their progress as a whole, shared with
+	// other users as viewers or contributors
+	GetCollections(c fiber.Ctx) error
+	CreateCollection(c fiber.Ctx) error
+	DeleteCollection(c fiber.Ctx) error
+	AddToCollection(c fiber.Ctx) error
+	RemoveFromCollection(c fiber.Ctx) error
+	GetCollectionProgress(c fiber.Ctx) error
+	GetCollectionMembers(c fiber.Ctx) error
+	SetCollectionMember(c fiber.Ctx) error
+	RemoveCollectionMember(c fiber.Ctx) error
+	// Organizations: users who request downloads for them, all seen by their members and
+	// counted against the quota and the rate limit of the organization
+	GetOrganizations(c fiber.Ctx) error
+	CreateOrganization(c fiber.Ctx) error
+	GetOrganization(c fiber.Ctx) error
+	DeleteOrganization(c fiber.Ctx) error
+	GetOrganizationUsage(c fiber.Ctx) error
+	GetOrganizationMembers(c fiber.Ctx) error
+	SetOrganizationMember(c fiber.Ctx) error
+	RemoveOrganizationMember(c fiber.Ctx) error
+	// Admin: override the quota and the rate limit of an organization
+	SetOrganizationLimits(c fiber.Ctx) error
+	// GraphQL API for dashboards: queries and progress subscriptions
+	GraphQL(c fiber.Ctx) error
+	// gRPC API for internal services, see proto/downloader.proto
+	GRPC(keys jwtkeys.Keys) *grpc.Server
+	// Liveness and readiness probes
+	Healthz(c fiber.Ctx) error
+	Readyz(c fiber.Ctx) error
+	// Build and runtime information of the process
+	Version(c fiber.Ctx) error
 }
 
-func generateFileName(userID int64, link string) string {
+func generateFileName(userID int64, link string, byteRange string) string {
 	h := fnv.New32a()
 	h.Write([]byte(link))
 	fmt.Fprint(h, userID)
+	if byteRange != "" {
+		fmt.Fprint(h, "#bytes=", byteRange)
+	}
 	return fmt.Sprintf("%d", h.Sum32())
 }
 
-func validateUserCredentials(c fiber.Ctx) (string, string, string, error) {
+// fileName returns the path of the file of a new download of the user: DOWNLOAD_PATH_TEMPLATE
+// in DOWNLOAD_DIR. Unless the template has the hash of the download, a path taken by another
+// download, or in taken by another download created with it, gets the hash added.
+func (h *handler) fileName(ctx context.Context, userID int64, link string, byteRange string, taken map[string]bool) (string, error) {
+	hash := generateFileName(userID, link, byteRange)
+	fields := layout.Fields{UserID: userID, Link: link, Hash: hash, Time: time.Now()}
+	fileName := filepath.Join(h.cfg.DownloadDir, layout.Render(h.cfg.DownloadPathTemplate, fields))
+	if layout.Unique(h.cfg.DownloadPathTemplate) {
+		return fileName, nil
+	}
+
+	exists, err := h.repo.FileNameExists(ctx, fileName)
+	if err != nil {
+		return "", err
+	}
+	if exists || taken[fileName] {
+		fileName = layout.WithHash(fileName, hash)
+	}
+	return fileName, nil
+}
+
+// checkManifestURL checks that the download of link can be verified against the manifest.
+func (h *handler) checkManifestURL(ctx context.Context, link string, manifestURL string) error {
+	if !strings.HasPrefix(manifestURL, "http://") && !strings.HasPrefix(manifestURL, "https://") {
+		return errors.New("manifest_url must be an http or https url")
+	}
+	// The workers fetch the manifests, so they are held to the rules of the links.
+	if err := h.guard.ValidateLink(ctx, manifestURL); err != nil {
+		return fmt.Errorf("invalid manifest_url: %v", err)
+	}
+	for _, scheme := range []string{"http://", "https://", "ftp://", "sftp://"} {
+		if strings.HasPrefix(link, scheme) {
+			if consumer.ManifestEntryName(link) == "" {
+				return errors.New("the link has no file name to look up in the manifest")
+			}
+			return nil
+		}
+	}
+	return errors.New("manifests are only supported for http, https, ftp and sftp links")
+}
+
+// checkMirrors checks the links of the same file the download of link fails over to. Failing
+// over continues at the current offset with a range request, so only http(s) is supported.
+func (h *handler) checkMirrors(ctx context.Context, link string, mirrors []string) error {
+	if len(mirrors) > MaxMirrors {
+		return fmt.Errorf("at most %d mirrors are allowed", MaxMirrors)
+	}
+	if !strings.HasPrefix(link, "http://") && !strings.HasPrefix(link, "https://") {
+		return errors.New("mirrors are only supported for http and https links")
+	}
+	seen := map[string]bool{link: true}
+	for _, mirror := range mirrors {
+		if !strings.HasPrefix(mirror, "http://") && !strings.HasPrefix(mirror, "https://") {
+			return errors.New("mirrors must be http or https urls")
+		}
+		if seen[mirror] {
+			return fmt.Errorf("mirror %s is listed twice", mirror)
+		}
+		seen[mirror] = true
+		// The workers fetch the mirrors, so they are held to the rules of the links.
+		if err := h.guard.ValidateLink(ctx, mirror); err != nil {
+			return fmt.Errorf("invalid mirror %s: %v", mirror, err)
+		}
+	}
+	return nil
+}
+
+// isRegistryLink reports whether the link is fetched from an artifact registry.
+func isRegistryLink(link string) bool {
+	return strings.HasPrefix(link, "oci://") || strings.HasPrefix(link, "maven://") || strings.HasPrefix(link, "npm://")
+}
+
+var (
+	errSomethingWentWrong = errors.New("something went wrong") // already logged, not the client's fault
+	errQuotaExceeded      = errors.New("storage quota exceeded")
+	errQueueOverloaded    = errors.New("the queue is overloaded, try again later")
+)
+
+// validateUserCredentials returns the username, the password and its hash given in the body.
+// It answers and returns false if they are invalid.
+func validateUserCredentials(c fiber.Ctx) (string, string, string, bool) {
 	var payload struct {
 		Username string `json:"username" validate:"required"`
-		Password string `json:"password" validate:"required"`
+		Password string `json:"password" validate:"required,min=8"`
 	}
-
-	if err := json.Unmarshal(c.Body(), &payload); err != nil {
-		return "", "", "", c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "could not parse request body"})
+	if !bindBody(c, &payload) {
+		return "", "", "", false
 	}
 
-	username := payload.Username
-	if username == "" {
-		return "", "", "", c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "username is required"})
+	hashedPassword, err := hashCredentials(payload.Username, payload.Password)
+	if err != nil {
+		c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		return "", "", "", false
 	}
 
-	password := payload.Password
+	return payload.Username, payload.Password, hashedPassword, true
+}
+
+// hashCredentials validates the username and password and returns the bcrypt hash of the password.
+func hashCredentials(username string, password string) (string, error) {
 	if username == "" {
-		return "", "", "", c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "password is required"})
+		return "", errors.New("username is required")
 	}
+	if password == "" {
+		return "", errors.New("password is required")
+	}
+	return hashPassword(password)
+}
 
+// hashPassword validates the password and returns its bcrypt hash.
+func hashPassword(password string) (string, error) {
 	if len(password) < 8 {
-		return "", "", "", c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "password must be at least 8 characters long"})
+		return "", errors.New("password must be at least 8 characters long")
 	}
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		log.Println(err)
-		return "", "", "", c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "something went wrong"})
+		return "", errSomethingWentWrong
 	}
-
-	return username, password, string(hashedPassword), nil
+	return string(hashedPassword), nil
 }
 
-func AuthMiddleware(c fiber.Ctx, secretKey string) error {
+// AuthMiddleware accepts the tokens of enabled accounts that were issued since their last
+// revocation. Like the admin role, the account is checked against the database on every request.
+func AuthMiddleware(c fiber.Ctx, keys jwtkeys.Keys, repo repository.Repository) error {
 	authHeader := c.Get("Authorization")
 	if authHeader == "" {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "missing authorization header"})
 	}
 
+	userID, tokenVersion, sessionID, err := parseToken(authHeader, keys)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if err := checkToken(c.Context(), repo, userID, tokenVersion, sessionID); errors.Is(err, errSomethingWentWrong) {
+		return err
+	} else if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	c.Locals("userID", userID)
+	c.Locals("sessionID", sessionID)
+	return c.Next()
+}
+
+var (
+	errAccountDisabled       = errors.New("account is disabled")
+	errPasswordResetRequired = errors.New("password reset required")
+	errTokenRevoked          = errors.New("token revoked")
+)
+
+// tokenVersion returns the version the tokens of the user must carry, or an error if the user
+// may not have tokens at all.
+func tokenVersion(ctx context.Context, repo repository.Repository, userID int64) (int64, error) {
+	auth, found, err := repo.GetUserAuth(ctx, userID)
+	if err != nil {
+		log.Println(err)
+		return 0, errSomethingWentWrong
+	}
+	if !found {
+		return 0, errTokenRevoked
+	}
+	if auth.Disabled {
+		return 0, errAccountDisabled
+	}
+	if auth.PasswordResetRequired {
+		return 0, errPasswordResetRequired
+	}
+	return auth.TokenVersion, nil
+}
+
+// checkToken verifies that a token of the user with the version and the session is not
+// revoked. Tokens issued before sessions existed have none and are only revoked by version.
+func checkToken(ctx context.Context, repo repository.Repository, userID int64, version int64, sessionID string) error {
+	current, err := tokenVersion(ctx, repo, userID)
+	if err != nil {
+		return err
+	}
+	if version != current {
+		return errTokenRevoked
+	}
+	if sessionID == "" {
+		return nil
+	}
+	_, found, err := repo.GetSession(ctx, userID, sessionID)
+	if err != nil {
+		log.Println(err)
+		return errSomethingWentWrong
+	}
+	if !found {
+		return errTokenRevoked
+	}
+	return nil
+}
+
+// parseToken returns the user, the token version and the session of the token in an
+// authorization header ("Bearer <token>"). Tokens issued before versions existed are of
+// version 0.
+func parseToken(authHeader string, keys jwtkeys.Keys) (int64, int64, string, error) {
 	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 	if tokenString == authHeader {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid authorization header format"})
+		return 0, 0, "", errors.New("invalid authorization header format")
+	}
+
+	claims, err := keys.Parse(tokenString)
+	if err != nil {
+		log.Println(err)
+		return 0, 0, "", jwtkeys.ErrInvalidToken
+	}
+
+	userID, ok := claims["user_id"].(float64)
+	if !ok {
+		return 0, 0, "", errors.New("invalid token claims")
+	}
+	version, _ := claims["token_version"].(float64)
+	sessionID, _ := claims["jti"].(string)
+	return int64(userID), int64(version), sessionID, nil
+}
+
+func (h *handler) GetDownloadRequests(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	page, err := strconv.Atoi(c.Query("page"))
+	if err != nil {
+		page = 0
+	}
+	limit, err := strconv.Atoi(c.Query("limit"))
+	if err != nil || limit <= 0 {
+		limit = DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
 	}
 
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fiber.NewError(fiber.StatusUnauthorized, "unexpected signing method")
+	var filters []string
+	for _, filter := range c.Context().QueryArgs().PeekMulti("label") {
+		filters = append(filters, string(filter))
+	}
+	labels, err := parseLabelSelector(filters)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	filter := repository.DownloadFilter{Labels: labels, Recursive: c.Query("recursive") == "true", Trashed: c.Query("trashed") == "true"}
+	if value := c.Query("folder_id"); value != "" {
+		folderID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid folder id"})
 		}
-		return []byte(secretKey), nil
-	})
+		if _, err := h.checkFolder(c.Context(), userID, &folderID); err != nil {
+			if errors.Is(err, errSomethingWentWrong) {
+				return err
+			}
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		filter.FolderID = &folderID
+	}
+	if value := c.Query("collection_id"); value != "" {
+		collection, err := h.collectionParam(c.Context(), userID, value)
+		if err != nil {
+			if errors.Is(err, errSomethingWentWrong) {
+				return err
+			}
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		filter.CollectionID = &collection.ID
+	}
+	if value := c.Query("org_id"); value != "" {
+		organization, err := h.organizationParam(c.Context(), userID, value)
+		if err != nil {
+			if errors.Is(err, errSomethingWentWrong) {
+				return err
+			}
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		filter.OrgID = &organization.ID
+	}
+	if err := parseDownloadSearch(c, &filter); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := parseDownloadCursor(c, &filter); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// The first page of the own downloads is what dashboards poll. The lists of collections and
+	// organizations change with the downloads of other users, so they are not cached.
+	cacheTTL := h.cfg.DownloadListCacheTTL
+	if filter.CollectionID != nil || filter.OrgID != nil {
+		cacheTTL = 0
+	}
+	downloads, next, err := h.repo.GetCachedDownloadRequests(c.Context(), userID, int64(page), int64(limit), filter, cacheTTL)
+	if err != nil {
+		return err
+	}
 
+	var running []int64
+	for _, download := range downloads {
+		if download.Status == repository.StatusDownloading {
+			running = append(running, download.ID)
+		}
+	}
+	progresses, err := h.repo.GetProgresses(c.Context(), running)
 	if err != nil {
-		log.Printf("invalid token: %v", err)
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid token"})
+		return err
+	}
+	for i := range downloads {
+		if progress, ok := progresses[downloads[i].ID]; ok && downloads[i].Status == repository.StatusDownloading {
+			downloads[i].BytesPerSec = &progress.BytesPerSec
+			if progress.ETA >= 0 {
+				downloads[i].ETASeconds = &progress.ETA
+			}
+		}
+	}
+
+	var nextCursor *string
+	if next != nil {
+		token := encodeDownloadCursor(*next)
+		nextCursor = &token
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"downloads": downloads, "next_cursor": nextCursor})
+}
+
+// parseDownloadSearch sets the filter from the search parameters of the list of downloads:
+// status (repeated), since and until (RFC 3339), query (part of the link), domain, min_bytes
+// and max_bytes, sort and order (asc or desc).
+func parseDownloadSearch(c fiber.Ctx, filter *repository.DownloadFilter) error {
+	var err error
+	for _, value := range c.Context().QueryArgs().PeekMulti("status") {
+		status := string(value)
+		if !slices.Contains(repository.Statuses, status) {
+			return fmt.Errorf("invalid status %q, must be one of %s", status, strings.Join(repository.Statuses, ", "))
+		}
+		filter.Statuses = append(filter.Statuses, status)
+	}
+	if value := c.Query("since"); value != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, value); err != nil {
+			return errors.New("invalid since")
+		}
+	}
+	if value := c.Query("until"); value != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, value); err != nil {
+			return errors.New("invalid until")
+		}
+	}
+	filter.Query = c.Query("query")
+	filter.Domain = c.Query("domain")
+	if value := c.Query("min_bytes"); value != "" {
+		minBytes, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || minBytes < 0 {
+			return errors.New("invalid min_bytes")
+		}
+		filter.MinBytes = &minBytes
+	}
+	if value := c.Query("max_bytes"); value != "" {
+		maxBytes, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || maxBytes < 0 {
+			return errors.New("invalid max_bytes")
+		}
+		filter.MaxBytes = &maxBytes
+	}
+	if filter.MinBytes != nil && filter.MaxBytes != nil && *filter.MinBytes > *filter.MaxBytes {
+		return errors.New("min_bytes must not be greater than max_bytes")
+	}
+	if filter.Sort = c.Query("sort"); filter.Sort != "" && !slices.Contains(repository.DownloadSorts, filter.Sort) {
+		return fmt.Errorf("invalid sort, must be one of %s", strings.Join(repository.DownloadSorts, ", "))
+	}
+	switch c.Query("order", "asc") {
+	case "asc":
+	case "desc":
+		filter.Descending = true
+	default:
+		return errors.New("invalid order, must be asc or desc")
+	}
+	return nil
+}
+
+// downloadCursor is the JSON of the cursors of the list of downloads, whose tokens are it
+// encoded in unpadded base64url.
+type downloadCursor struct {
+	Sort       string          `json:"sort"`
+	Descending bool            `json:"desc,omitempty"`
+	Value      json.RawMessage `json:"value"`
+	ID         int64           `json:"id"`
+}
+
+func encodeDownloadCursor(cursor repository.DownloadCursor) string {
+	value, _ := json.Marshal(cursor.Value)
+	data, _ := json.Marshal(downloadCursor{Sort: cursor.Sort, Descending: cursor.Descending, Value: value, ID: cursor.ID})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeDownloadCursor(token string) (repository.DownloadCursor, error) {
+	var cursor downloadCursor
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || json.Unmarshal(data, &cursor) != nil {
+		return repository.DownloadCursor{}, errors.New("invalid cursor")
 	}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		userID, ok := claims["user_id"].(float64)
-		if !ok {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid token claims"})
+	var value any
+	if len(cursor.Value) > 0 && string(cursor.Value) != "null" {
+		switch cursor.Sort {
+		case "created_at", "finished_at":
+			var t time.Time
+			if err = json.Unmarshal(cursor.Value, &t); err == nil {
+				value = t
+			}
+		case "link", "status":
+			var s string
+			if err = json.Unmarshal(cursor.Value, &s); err == nil {
+				value = s
+			}
+		case "id", "bytes", "priority":
+			var n int64
+			if err = json.Unmarshal(cursor.Value, &n); err == nil {
+				value = n
+			}
+		default:
+			err = errors.New("unknown sort")
 		}
+		if err != nil {
+			return repository.DownloadCursor{}, errors.New("invalid cursor")
+		}
+	}
+	return repository.DownloadCursor{Sort: cursor.Sort, Descending: cursor.Descending, Value: value, ID: cursor.ID}, nil
+}
 
-		c.Locals("userID", int64(userID))
-		return c.Next()
+// parseDownloadCursor sets the filter to list the downloads after the cursor, the next_cursor of
+// the previous page, or after the download after_id in the id order. Both replace page.
+func parseDownloadCursor(c fiber.Ctx, filter *repository.DownloadFilter) error {
+	sort := filter.Sort
+	if sort == "" {
+		sort = "id"
+	}
+	token, afterID := c.Query("cursor"), c.Query("after_id")
+	if token == "" && afterID == "" {
+		return nil
+	}
+	if token != "" && afterID != "" {
+		return errors.New("cursor and after_id are exclusive")
+	}
+	if c.Query("page") != "" {
+		return errors.New("page is exclusive with cursor and after_id")
+	}
+
+	if afterID != "" {
+		id, err := strconv.ParseInt(afterID, 10, 64)
+		if err != nil {
+			return errors.New("invalid after_id")
+		}
+		if sort != "id" {
+			return errors.New("after_id is only for the id sort, use cursor")
+		}
+		filter.After = &repository.DownloadCursor{Sort: sort, Descending: filter.Descending, ID: id}
+		return nil
 	}
 
-	return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid token"})
+	cursor, err := decodeDownloadCursor(token)
+	if err != nil {
+		return err
+	}
+	if cursor.Sort != sort || cursor.Descending != filter.Descending {
+		return errors.New("the cursor is of another sort or order")
+	}
+	filter.After = &cursor
+	return nil
 }
 
-func (h *handler) GetDownloadRequests(c fiber.Ctx) error {
+func (h *handler) GetDownloadDebug(c fiber.Ctx) error {
 	userID := c.Locals("userID").(int64)
 
-	page, err := strconv.Atoi(c.Params("page"))
+	downloadID, err := strconv.ParseInt(c.Params("id"), 10, 64)
 	if err != nil {
-		page = 0
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid download id"})
+	}
+
+	download, err := h.repo.GetDownloadRequestForUser(c.Context(), userID, downloadID)
+	if errors.Is(err, repository.DownloadRequestNotFoundErr) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "download not found"})
 	}
-	limit, err := strconv.Atoi(c.Params("limit"))
 	if err != nil {
-		limit = 0
+		return err
 	}
 
-	downloads, err := h.repo.GetDownloadRequests(c.Context(), userID, int64(page), int64(limit))
+	attempts, err := h.repo.GetAttempts(c.Context(), downloadID)
 	if err != nil {
-		log.Println(err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "something went wrong"})
+		return err
+	}
+	scriptRuns, err := h.repo.GetScriptRuns(c.Context(), downloadID)
+	if err != nil {
+		return err
+	}
+	steps, err := h.repo.GetPipelineSteps(c.Context(), downloadID)
+	if err != nil {
+		return err
+	}
+	var preflight *repository.Preflight
+	if checked, found, err := h.repo.GetPreflight(c.Context(), downloadID); err != nil {
+		return err
+	} else if found {
+		preflight = &checked
+	}
+
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="download-%d-debug.json"`, downloadID))
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"generated_at": time.Now().UTC(),
+		"download":     download,
+		"attempts":     attempts,
+		"script_runs":  scriptRuns,
+		"pipeline":     steps,
+		"preflight":    preflight,
+	})
+}
+
+// GetDownloadPipeline returns the steps run on the file of a download once it completed, and
+// how each went.
+func (h *handler) GetDownloadPipeline(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	downloadID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid download id"})
+	}
+
+	download, err := h.repo.GetDownloadRequest(c.Context(), downloadID)
+	if err != nil && !errors.Is(err, repository.DownloadRequestNotFoundErr) {
+		return err
+	}
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "download not found"})
+	}
+	allowed, err := h.canViewDownload(c.Context(), userID, download.ID, download.UserID)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "download not found"})
+	}
+
+	steps, err := h.repo.GetPipelineSteps(c.Context(), downloadID)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"steps": steps})
+}
+
+// CancelDownloadRequest fails a queued or running download of the user. A running download
+// is stopped by its worker at the next lock extension.
+func (h *handler) CancelDownloadRequest(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	downloadID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid download id"})
+	}
+
+	download, err := h.repo.GetDownloadRequestForUser(c.Context(), userID, downloadID)
+	if errors.Is(err, repository.DownloadRequestNotFoundErr) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "download not found"})
+	}
+	if err != nil {
+		return err
+	}
+
+	canceled, err := h.repo.CancelDownloadRequest(c.Context(), downloadID)
+	if err != nil {
+		return err
+	}
+	if !canceled {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": fmt.Sprintf("download is already %s", download.Status)})
+	}
+	h.invalidateDownloadList(c.Context(), download.UserID)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "canceled"})
+}
+
+// RetryDownloadRequest queues a failed download of the user again, without creating another
+// request. Its partial file is resumed, or dropped with {"restart": true}.
+func (h *handler) RetryDownloadRequest(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	downloadID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid download id"})
+	}
+
+	var payload struct {
+		Restart bool `json:"restart"`
+	}
+	if len(c.Body()) > 0 && !bindBody(c, &payload) {
+		return nil
+	}
+
+	download, err := h.repo.GetDownloadRequestForUser(c.Context(), userID, downloadID)
+	if errors.Is(err, repository.DownloadRequestNotFoundErr) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "download not found"})
+	}
+	if err != nil {
+		return err
+	}
+	if download.DeletedAt != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "the download is in the trash, restore it first"})
+	}
+	if download.Status != repository.StatusFailed {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": fmt.Sprintf("download is %s, only failed downloads are retried", download.Status)})
+	}
+
+	if h.pressure.Overloaded() {
+		return h.queueOverloaded(c)
+	}
+	if err := h.checkQuota(c.Context(), userID); errors.Is(err, errQuotaExceeded) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+	} else if err != nil {
+		return err
+	}
+	if download.OrgID != nil {
+		if err := h.checkOrgQuota(c.Context(), *download.OrgID); errors.Is(err, errQuotaExceeded) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+		} else if err != nil {
+			return err
+		}
+	}
+
+	retries, err := h.repo.RetryDownloadRequest(c.Context(), downloadID, payload.Restart)
+	if err != nil {
+		return err
+	}
+	if retries == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "download is no longer failed"})
+	}
+	h.invalidateDownloadList(c.Context(), userID)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "queued", "retries": retries})
+}
+
+// UpdateDownloadRequest changes the speed limit of a download, also while it runs (its
+// worker applies the new one within 30s), and moves it into another folder (0 for none).
+func (h *handler) UpdateDownloadRequest(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	downloadID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid download id"})
 	}
 
-	return c.Status(fiber.StatusOK).JSON(fiber.Map{"downloads": downloads})
+	var payload struct {
+		MaxSpeed *int64 `json:"max_speed_bytes_per_sec" validate:"omitempty,gte=0"`
+		FolderID *int64 `json:"folder_id"`
+	}
+	if !bindBody(c, &payload) {
+		return nil
+	}
+	if payload.MaxSpeed == nil && payload.FolderID == nil {
+		return invalidFields(c, FieldError{Field: "max_speed_bytes_per_sec", Message: "max_speed_bytes_per_sec or folder_id is required"})
+	}
+
+	download, err := h.repo.GetDownloadRequestForUser(c.Context(), userID, downloadID)
+	if errors.Is(err, repository.DownloadRequestNotFoundErr) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "download not found"})
+	}
+	if err != nil {
+		return err
+	}
+
+	if payload.FolderID != nil {
+		folderID, err := h.checkFolder(c.Context(), userID, payload.FolderID)
+		if errors.Is(err, errSomethingWentWrong) {
+			return err
+		}
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := h.repo.SetDownloadFolder(c.Context(), downloadID, folderID); err != nil {
+			return err
+		}
+		download.FolderID = folderID
+	}
+	if payload.MaxSpeed != nil {
+		if err := h.repo.SetMaxSpeed(c.Context(), downloadID, *payload.MaxSpeed); err != nil {
+			return err
+		}
+		download.MaxSpeed = *payload.MaxSpeed
+	}
+	h.invalidateDownloadList(c.Context(), userID)
+
+	return c.Status(fiber.StatusOK).JSON(download)
 }
 
 func (h *handler) CreateDownloadRequest(c fiber.Ctx) error {
@@ -133,73 +901,419 @@ func (h *handler) CreateDownloadRequest(c fiber.Ctx) error {
 
 	var payload struct {
 		Link string `json:"link" validate:"required"`
+		downloadOptions
+	}
+	if !bindBody(c, &payload) {
+		return nil
 	}
 
-	if err := json.Unmarshal(c.Body(), &payload); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "could not parse request body"})
+	download, err := h.prepareDownload(c.Context(), userID, payload.Link, payload.downloadOptions)
+	if errors.Is(err, errSomethingWentWrong) {
+		return err
+	}
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if download.OrgID != nil && !h.orgRateLimit(c, *download.OrgID, 1) {
+		return nil
 	}
 
-	link := payload.Link
+	return h.enqueueDownload(c, download)
+}
+
+// downloadOptions are the optional fields of a new download.
+type downloadOptions struct {
+	Priority        *int64                  `json:"priority"`
+	Labels          map[string]string       `json:"labels"`
+	Credentials     *repository.Credentials `json:"credentials"`
+	Range           string                  `json:"range"`
+	OriginProfileID *int64                  `json:"origin_profile_id"`
+	MaxSpeed        int64                   `json:"max_speed_bytes_per_sec"`
+	ManifestURL     string                  `json:"manifest_url"`
+	FolderID        *int64                  `json:"folder_id"`
+	CollectionID    *int64                  `json:"collection_id"`
+	OrgID           *int64                  `json:"org_id"`
+	Mirrors         []string                `json:"mirrors"`
+	Headers         map[string]string       `json:"headers"`
+	Cookies         map[string]string       `json:"cookies"`
+	Tuning          repository.Tuning       `json:"tuning"`
+	Proxy           string                  `json:"proxy"`
+	Pipeline        []string                `json:"pipeline"` // nil for PIPELINE_STEPS, empty for none
+}
+
+// prepareDownload validates a new download of the user. Errors other than errSomethingWentWrong
+// are the client's.
+func (h *handler) prepareDownload(ctx context.Context, userID int64, link string, options downloadOptions) (repository.NewDownload, error) {
+	labels, credentials, byteRange := options.Labels, options.Credentials, options.Range
 	if link == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "link is required"})
+		return repository.NewDownload{}, errors.New("link is required")
+	}
+	if err := h.guard.ValidateLink(ctx, link); err != nil {
+		return repository.NewDownload{}, err
+	}
+	if err := validateLabels(labels); err != nil {
+		return repository.NewDownload{}, err
+	}
+
+	priority := int64(DefaultPriority)
+	if options.Priority != nil {
+		priority = *options.Priority
+	} else if p, ok := labelPriority(h.cfg.LabelPriorities, labels); ok {
+		priority = p
+	}
+	if priority < MinPriority || priority > MaxPriority {
+		return repository.NewDownload{}, fmt.Errorf("priority must be between %d and %d", MinPriority, MaxPriority)
+	}
+
+	if options.MaxSpeed < 0 {
+		return repository.NewDownload{}, errors.New("max_speed_bytes_per_sec must not be negative")
+	}
+	if err := h.validateTuning(link, options.Tuning); err != nil {
+		return repository.NewDownload{}, err
+	}
+
+	if byteRange != "" {
+		// Sources other than HTTP only resume from an offset, they do not serve ranges.
+		if !strings.HasPrefix(link, "http://") && !strings.HasPrefix(link, "https://") {
+			return repository.NewDownload{}, errors.New("ranges are only supported for http and https links")
+		}
+		if _, _, err := repository.ParseByteRange(byteRange); err != nil {
+			return repository.NewDownload{}, err
+		}
+		// A range of the compressed file cannot be decoded apart from the rest.
+		if options.Tuning.ContentEncoding == repository.ContentEncodingDecompress {
+			return repository.NewDownload{}, errors.New("tuning.content_encoding decompress is not supported with a range")
+		}
+	}
+
+	steps := options.Pipeline
+	if steps == nil {
+		steps = h.pipeline.Defaults()
+	} else if err := h.pipeline.Validate(steps); err != nil {
+		return repository.NewDownload{}, fmt.Errorf("invalid pipeline: %v", err)
+	}
+	if h.cfg.ClamdScanAll && (len(steps) == 0 || steps[0] != "virus_scan") {
+		// The file is scanned before any other step handles it.
+		scanned := []string{"virus_scan"}
+		for _, step := range steps {
+			if step != "virus_scan" {
+				scanned = append(scanned, step)
+			}
+		}
+		steps = scanned
+	}
+
+	folderID, err := h.checkFolder(ctx, userID, options.FolderID)
+	if err != nil {
+		return repository.NewDownload{}, err
+	}
+
+	if options.CollectionID != nil {
+		collection, err := h.checkCollection(ctx, userID, *options.CollectionID)
+		if err != nil {
+			return repository.NewDownload{}, err
+		}
+		if collection.Role == repository.CollectionRoleViewer {
+			return repository.NewDownload{}, errCollectionForbidden
+		}
+	}
+
+	if options.OrgID != nil {
+		// Any member requests downloads for the organization.
+		if _, err := h.checkOrganization(ctx, userID, *options.OrgID); err != nil {
+			return repository.NewDownload{}, err
+		}
+	}
+
+	if options.ManifestURL != "" {
+		if err := h.checkManifestURL(ctx, link, options.ManifestURL); err != nil {
+			return repository.NewDownload{}, err
+		}
+	}
+
+	if len(options.Mirrors) > 0 {
+		if err := h.checkMirrors(ctx, link, options.Mirrors); err != nil {
+			return repository.NewDownload{}, err
+		}
+	}
+
+	if options.OriginProfileID != nil {
+		if credentials != nil {
+			return repository.NewDownload{}, errors.New("credentials and origin_profile_id are mutually exclusive")
+		}
+		if err := h.checkOriginProfile(ctx, userID, *options.OriginProfileID, link); err != nil {
+			return repository.NewDownload{}, err
+		}
+	}
+
+	download := repository.NewDownload{UserID: userID, Link: link, Priority: priority, Labels: labels, Range: byteRange, OriginProfileID: options.OriginProfileID, MaxSpeed: options.MaxSpeed, ManifestURL: options.ManifestURL, FolderID: folderID, CollectionID: options.CollectionID, Mirrors: options.Mirrors, Tuning: options.Tuning, Pipeline: steps, OrgID: options.OrgID}
+	if credentials != nil {
+		if !strings.HasPrefix(link, "ftp://") && !strings.HasPrefix(link, "sftp://") && !isRegistryLink(link) {
+			return repository.NewDownload{}, errors.New("credentials are only supported for ftp, sftp, oci, maven and npm links")
+		}
+		data, _ := json.Marshal(credentials)
+		sealed, err := h.box.Seal(data)
+		if errors.Is(err, secrets.ErrNoKey) {
+			return repository.NewDownload{}, errors.New("storing credentials is not enabled")
+		}
+		if err != nil {
+			log.Println(err)
+			return repository.NewDownload{}, errSomethingWentWrong
+		}
+		download.Credentials = sealed
+	}
+	if len(options.Headers) > 0 || len(options.Cookies) > 0 {
+		if !strings.HasPrefix(link, "http://") && !strings.HasPrefix(link, "https://") {
+			return repository.NewDownload{}, errors.New("headers and cookies are only supported for http and https links")
+		}
+		headers, err := requestHeaders(options.Headers, options.Cookies)
+		if err != nil {
+			return repository.NewDownload{}, err
+		}
+		data, _ := json.Marshal(headers)
+		sealed, err := h.box.Seal(data)
+		if errors.Is(err, secrets.ErrNoKey) {
+			return repository.NewDownload{}, errors.New("storing headers is not enabled")
+		}
+		if err != nil {
+			log.Println(err)
+			return repository.NewDownload{}, errSomethingWentWrong
+		}
+		download.Headers = sealed
+	}
+	if options.Proxy != "" {
+		if !strings.HasPrefix(link, "http://") && !strings.HasPrefix(link, "https://") {
+			return repository.NewDownload{}, errors.New("proxy is only supported for http and https links")
+		}
+		if _, err := httpclient.ParseProxy(options.Proxy); err != nil {
+			return repository.NewDownload{}, err
+		}
+		sealed, err := h.box.Seal([]byte(options.Proxy))
+		if errors.Is(err, secrets.ErrNoKey) {
+			return repository.NewDownload{}, errors.New("storing proxies is not enabled")
+		}
+		if err != nil {
+			log.Println(err)
+			return repository.NewDownload{}, errSomethingWentWrong
+		}
+		download.Proxy = sealed
+	}
+
+	return download, nil
+}
+
+// enqueueDownload creates the download request of an already validated link and pushes it to the queue.
+func (h *handler) enqueueDownload(c fiber.Ctx, download repository.NewDownload) error {
+	downloadID, status, created, err := h.createDownload(c.Context(), download)
+	if errors.Is(err, errQuotaExceeded) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+	}
+	if errors.Is(err, errQueueOverloaded) {
+		return h.queueOverloaded(c)
+	}
+	if err != nil {
+		return err
+	}
+	if !created {
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "already requested", "download_id": downloadID, "status": status})
+	}
+
+	// The request is pushed to the queue by the outbox relay.
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"message": "done", "download_id": downloadID})
+}
+
+// createDownload creates the download request unless the user already requested the link
+// (the same range of it), in which case the existing one is returned with created false, after
+// adding it to the collection of the new one.
+// Errors are errQuotaExceeded, errQueueOverloaded or errSomethingWentWrong.
+func (h *handler) createDownload(ctx context.Context, download repository.NewDownload) (downloadID int64, status string, created bool, err error) {
+	userID, link := download.UserID, download.Link
+
+	existing, found, err := h.repo.FindDownloadRequest(ctx, userID, link, download.Range)
+	if err != nil {
+		log.Println(err)
+		return 0, "", false, errSomethingWentWrong
+	}
+	if found {
+		if existing.DeletedAt != nil {
+			// Requesting it again takes it out of the trash.
+			if _, err := consumer.RestoreFromTrash(ctx, h.repo, existing.ID); err != nil {
+				log.Println(err)
+				return 0, "", false, errSomethingWentWrong
+			}
+			h.invalidateDownloadList(ctx, userID)
+		}
+		if download.CollectionID != nil {
+			if _, err := h.repo.AddToCollection(ctx, userID, *download.CollectionID, []int64{existing.ID}); err != nil {
+				log.Println(err)
+				return 0, "", false, errSomethingWentWrong
+			}
+		}
+		return existing.ID, existing.Status, false, nil
+	}
+
+	if h.pressure.Overloaded() {
+		return 0, "", false, errQueueOverloaded
+	}
+	if err := h.checkQuota(ctx, userID); err != nil {
+		return 0, "", false, err
+	}
+	if download.OrgID != nil {
+		if err := h.checkOrgQuota(ctx, *download.OrgID); err != nil {
+			return 0, "", false, err
+		}
 	}
 
-	fileName := generateFileName(userID, link)
-	downloadID, err := h.repo.CreateDownloadRequest(c.Context(), userID, link, fileName)
+	expiresAt, err := h.queueExpiry(ctx, userID)
 	if err != nil {
-		// TODO handle duplicate link per user error separatly
 		log.Println(err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "something went wrong"})
+		return 0, "", false, errSomethingWentWrong
 	}
 
-	// Important: Even if this push fails, the background job pushes again later.
-	err = h.repo.PushDownloadRequest(c.Context(), downloadID)
+	download.FileName, err = h.fileName(ctx, userID, link, download.Range, nil)
+	if err != nil {
+		log.Println(err)
+		return 0, "", false, errSomethingWentWrong
+	}
+	download.ExpiresAt = expiresAt
+	downloadID, err = h.repo.CreateDownloadRequest(ctx, download)
+	if errors.Is(err, repository.ErrDuplicateLink) {
+		// Requested concurrently by another request of the user, which created it.
+		existing, found, err := h.repo.FindDownloadRequest(ctx, userID, link, download.Range)
+		if err != nil {
+			log.Println(err)
+			return 0, "", false, errSomethingWentWrong
+		}
+		if found {
+			return existing.ID, existing.Status, false, nil
+		}
+	}
 	if err != nil {
 		log.Println(err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "something went wrong"})
+		return 0, "", false, errSomethingWentWrong
 	}
+	h.invalidateDownloadList(ctx, userID)
 
-	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"message": "done"})
+	return downloadID, repository.StatusQueued, true, nil
 }
 
-func (h *handler) Register(c fiber.Ctx) error {
-	username, _, hashedPassword, err := validateUserCredentials(c)
-	if err != nil {
-		return err
+// invalidateDownloadList drops the cached first pages of the list of downloads of the user, one
+// of which changed.
+func (h *handler) invalidateDownloadList(ctx context.Context, userID int64) {
+	if h.cfg.DownloadListCacheTTL == 0 {
+		return
+	}
+	if err := h.repo.InvalidateDownloadList(ctx, userID); err != nil {
+		log.Println(err)
+	}
+}
+
+// queueOverloaded refuses a new download request until the pressure on the queue subsides.
+func (h *handler) queueOverloaded(c fiber.Ctx) error {
+	c.Set(fiber.HeaderRetryAfter, strconv.FormatInt(int64(h.cfg.QueueRetryAfter/time.Second), 10))
+	return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": errQueueOverloaded.Error()})
+}
+
+// checkQuota fails with errQuotaExceeded if the user stores USER_QUOTA_BYTES already.
+func (h *handler) checkQuota(ctx context.Context, userID int64) error {
+	if h.cfg.UserQuotaBytes <= 0 {
+		return nil
 	}
 
-	userID, err := h.repo.CreateUser(c.Context(), username, hashedPassword)
+	storedBytes, err := h.repo.GetUserUsage(ctx, userID)
 	if err != nil {
-		// TODO handle duplicate user
 		log.Println(err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "something went wrong"})
+		return errSomethingWentWrong
+	}
+	if storedBytes >= h.cfg.UserQuotaBytes {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// queueExpiry returns when a download of the user expires if it has not started by then,
+// according to the queue TTL of the user's plan. nil means it never expires.
+func (h *handler) queueExpiry(ctx context.Context, userID int64) (*time.Time, error) {
+	ttl := h.cfg.QueueTTL
+	if len(h.cfg.PlanQueueTTLs) > 0 {
+		plan, err := h.repo.GetUserPlan(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		if planTTL, ok := h.cfg.PlanQueueTTLs[plan]; ok {
+			ttl = planTTL
+		}
+	}
+	if ttl <= 0 {
+		return nil, nil
 	}
 
-	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"user_id": userID})
+	expiresAt := time.Now().Add(ttl)
+	return &expiresAt, nil
 }
 
-func (h *handler) Login(c fiber.Ctx, jwtSecret string) error {
-	username, password, _, err := validateUserCredentials(c)
+func (h *handler) Register(c fiber.Ctx) error {
+	username, _, hashedPassword, ok := validateUserCredentials(c)
+	if !ok {
+		return nil
+	}
+	c.Locals("username", username) // for AuditMiddleware
+
+	var payload struct {
+		Email string `json:"email"`
+	}
+	json.Unmarshal(c.Body(), &payload) // parsed by validateUserCredentials already
+	email := payload.Email
+	if email != "" || h.cfg.RequireEmailVerification {
+		var err error
+		if email, err = parseEmail(payload.Email); err != nil {
+			return invalidFields(c, FieldError{Field: "email", Message: err.Error()})
+		}
+	}
+
+	userID, err := h.repo.CreateUser(c.Context(), username, hashedPassword, email)
 	if err != nil {
-		return err
+		return err // 409 if the username or the email is taken
+	}
+	c.Locals("userID", userID)
+
+	if email != "" {
+		if err := h.sendVerificationEmail(c.Context(), userID, username, email); err != nil && !errors.Is(err, mailer.ErrDisabled) {
+			log.Println(err) // sent again at /verify-email/resend
+		}
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"user_id": userID})
+}
+
+func (h *handler) Login(c fiber.Ctx, keys jwtkeys.Keys) error {
+	username, password, _, ok := validateUserCredentials(c)
+	if !ok {
+		return nil
 	}
+	c.Locals("username", username) // for AuditMiddleware
 
 	userID, err := h.repo.AuthUser(c.Context(), username, password)
 	if err != nil {
-		// TODO better error handling for user does not exist
-		log.Println(err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "something went wrong"})
+		return err
 	}
 	if userID == 0 {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid username or password"})
 	}
+	c.Locals("userID", userID)
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id": userID,
-		"exp":     time.Now().Add(time.Hour * 72).Unix(),
-	})
+	version, err := tokenVersion(c.Context(), h.repo, userID)
+	if err == nil {
+		err = h.checkEmailVerified(c.Context(), userID)
+	}
+	if errors.Is(err, errSomethingWentWrong) {
+		return err
+	}
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+	}
 
-	tokenString, err := token.SignedString([]byte(jwtSecret))
+	tokenString, err := issueToken(c.Context(), h.repo, userID, version, keys, c.IP(), c.Get(fiber.HeaderUserAgent))
 	if err != nil {
 		log.Println(err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "could not create token"})
@@ -208,8 +1322,50 @@ func (h *handler) Login(c fiber.Ctx, jwtSecret string) error {
 	return c.JSON(fiber.Map{"token": tokenString})
 }
 
-func New(repo repository.Repository) Handler {
-	return &handler{
-		repo: repo,
+func (h *handler) GetUsage(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	storedBytes, err := h.repo.GetUserUsage(c.Context(), userID)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"stored_bytes": storedBytes,
+		"quota_bytes":  h.cfg.UserQuotaBytes,
+	})
+}
+
+func (h *handler) GetNotifications(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	limit, err := strconv.ParseInt(c.Query("limit"), 10, 64)
+	if err != nil || limit <= 0 || limit > MaxNotifications {
+		limit = MaxNotifications
+	}
+
+	notifications, err := h.repo.GetNotifications(c.Context(), userID, limit)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"notifications": notifications})
+}
+
+func New(repo repository.Repository, cfg *config.Config, guard urlguard.Guard, proxy proxy.Proxy, consumer consumer.Consumer, box secrets.Box, cold coldstore.Store, flags flags.Flags, pressure outbox.Pressure, pipeline pipeline.Pipeline, mail mailer.Sender) Handler {
+	h := &handler{
+		repo:     repo,
+		cfg:      cfg,
+		guard:    guard,
+		proxy:    proxy,
+		consumer: consumer,
+		box:      box,
+		cold:     cold,
+		flags:    flags,
+		pressure: pressure,
+		pipeline: pipeline,
+		mail:     mail,
 	}
+	h.graphql = h.newGraphQLExecutor()
+	return h
 }
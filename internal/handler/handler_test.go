@@ -0,0 +1,819 @@
+package handler_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/internal/coldstore"
+	"example.com/internal/config"
+	"example.com/internal/flags"
+	"example.com/internal/handler"
+	"example.com/internal/jwtkeys"
+	"example.com/internal/mailer"
+	"example.com/internal/outbox"
+	"example.com/internal/pipeline"
+	"example.com/internal/repository"
+	"example.com/internal/repository/repositorytest"
+	"example.com/internal/secrets"
+	"example.com/internal/urlguard"
+	"github.com/gofiber/fiber/v3"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testSecret = "test-secret-key"
+
+// testServer serves the routes under test like main does, on a repository of the test.
+type testServer struct {
+	app  *fiber.App
+	keys jwtkeys.Keys
+}
+
+// newTestServer returns a server of the API on repo, with the default config changed by
+// configure.
+func newTestServer(t *testing.T, repo repository.Repository, configure func(cfg *config.Config)) *testServer {
+	t.Helper()
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.DownloadListCacheTTL = 0
+	if configure != nil {
+		configure(cfg)
+	}
+	keys, err := jwtkeys.New(testSecret, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	box, err := secrets.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cold, err := coldstore.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps, err := pipeline.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mail, err := mailer.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	guard := urlguard.New(nil, nil, true)
+	h := handler.New(repo, cfg, guard, nil, nil, box, cold, flags.New(repo), outbox.NewPressure(repo, 0, 0), steps, mail)
+
+	app := fiber.New(fiber.Config{ErrorHandler: handler.ErrorHandler})
+	authMiddleware := func(c fiber.Ctx) error {
+		return handler.AuthMiddleware(c, keys, repo)
+	}
+	app.Post("/register/", h.Register)
+	app.Post("/login/", func(c fiber.Ctx) error { return h.Login(c, keys) })
+	app.Get("/downloads/", h.GetDownloadRequests, authMiddleware)
+	app.Post("/downloads/", h.CreateDownloadRequest, authMiddleware)
+	return &testServer{app: app, keys: keys}
+}
+
+// do sends the request with the authorization header, if any, and returns the status and the
+// decoded JSON body of the response.
+func (s *testServer) do(t *testing.T, method string, target string, authorization string, body string) (int, map[string]any) {
+	t.Helper()
+
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := s.app.Test(req, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]any
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("%s %s: invalid JSON body %q: %v", method, target, data, err)
+	}
+	return resp.StatusCode, decoded
+}
+
+// login logs the user in and returns the authorization header of its token.
+func (s *testServer) login(t *testing.T, username string, password string) string {
+	t.Helper()
+
+	status, body := s.do(t, http.MethodPost, "/login/", "", `{"username": "`+username+`", "password": "`+password+`"}`)
+	if status != http.StatusOK {
+		t.Fatalf("login of %s: got %d %v", username, status, body)
+	}
+	return "Bearer " + body["token"].(string)
+}
+
+// addUser adds a user with the password "password1" to the fake.
+func addUser(t *testing.T, repo *repositorytest.Fake, user repository.User) int64 {
+	t.Helper()
+
+	userID, err := repo.AddUser(user, "password1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return userID
+}
+
+// checkBody fails the test unless every field of want is in the body with the same value.
+// Numbers are compared as JSON decodes them, as float64.
+func checkBody(t *testing.T, body map[string]any, want map[string]any) {
+	t.Helper()
+
+	for key, value := range want {
+		if got, ok := body[key]; !ok || got != value {
+			t.Errorf("body[%q] = %v, want %v (body %v)", key, got, value, body)
+		}
+	}
+}
+
+var errDatabase = errors.New("database is down")
+
+func TestRegister(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		configure  func(repo *repositorytest.Fake)
+		wantStatus int
+		wantBody   map[string]any
+	}{
+		{
+			name:       "created",
+			body:       `{"username": "alice", "password": "password1"}`,
+			wantStatus: http.StatusCreated,
+			wantBody:   map[string]any{"user_id": float64(1)},
+		},
+		{
+			name:       "created with an email",
+			body:       `{"username": "alice", "password": "password1", "email": "alice@example.com"}`,
+			wantStatus: http.StatusCreated,
+			wantBody:   map[string]any{"user_id": float64(1)},
+		},
+		{
+			name: "username taken",
+			body: `{"username": "bob", "password": "password1"}`,
+			configure: func(repo *repositorytest.Fake) {
+				addUser(t, repo, repository.User{Username: "bob"})
+			},
+			wantStatus: http.StatusConflict,
+			wantBody:   map[string]any{"error": repository.ErrDuplicateUser.Error()},
+		},
+		{
+			name:       "unparsable body",
+			body:       `{"username": `,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   map[string]any{"error": "could not parse request body"},
+		},
+		{
+			name:       "missing username",
+			body:       `{"password": "password1"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "short password",
+			body:       `{"username": "alice", "password": "short"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid email",
+			body:       `{"username": "alice", "password": "password1", "email": "not an email"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name: "database error",
+			body: `{"username": "alice", "password": "password1"}`,
+			configure: func(repo *repositorytest.Fake) {
+				repo.CreateUserFunc = func(context.Context, string, string, string) (int64, error) {
+					return 0, errDatabase
+				}
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   map[string]any{"error": "something went wrong"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := repositorytest.NewFake()
+			if tt.configure != nil {
+				tt.configure(repo)
+			}
+			s := newTestServer(t, repo, nil)
+
+			status, body := s.do(t, http.MethodPost, "/register/", "", tt.body)
+			if status != tt.wantStatus {
+				t.Fatalf("got %d %v, want %d", status, body, tt.wantStatus)
+			}
+			checkBody(t, body, tt.wantBody)
+			if status == http.StatusBadRequest {
+				if _, ok := body["error"].(string); !ok {
+					t.Errorf("no error in %v", body)
+				}
+				if n := repo.Called("CreateUser"); n != 0 {
+					t.Errorf("CreateUser called %d times on an invalid request", n)
+				}
+			}
+		})
+	}
+}
+
+func TestLogin(t *testing.T) {
+	disabledAt := time.Now()
+	tests := []struct {
+		name       string
+		body       string
+		configure  func(repo *repositorytest.Fake)
+		wantStatus int
+		wantBody   map[string]any
+	}{
+		{
+			name:       "logged in",
+			body:       `{"username": "alice", "password": "password1"}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "wrong password",
+			body:       `{"username": "alice", "password": "password2"}`,
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   map[string]any{"error": "invalid username or password"},
+		},
+		{
+			name:       "unknown user",
+			body:       `{"username": "carol", "password": "password1"}`,
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   map[string]any{"error": "invalid username or password"},
+		},
+		{
+			name:       "missing password",
+			body:       `{"username": "alice"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name: "disabled account",
+			body: `{"username": "dave", "password": "password1"}`,
+			configure: func(repo *repositorytest.Fake) {
+				addUser(t, repo, repository.User{Username: "dave", DisabledAt: &disabledAt})
+			},
+			wantStatus: http.StatusForbidden,
+			wantBody:   map[string]any{"error": "account is disabled"},
+		},
+		{
+			name: "password reset required",
+			body: `{"username": "erin", "password": "password1"}`,
+			configure: func(repo *repositorytest.Fake) {
+				addUser(t, repo, repository.User{Username: "erin", PasswordResetRequired: true})
+			},
+			wantStatus: http.StatusForbidden,
+			wantBody:   map[string]any{"error": "password reset required"},
+		},
+		{
+			name: "database error",
+			body: `{"username": "alice", "password": "password1"}`,
+			configure: func(repo *repositorytest.Fake) {
+				repo.AuthUserFunc = func(context.Context, string, string) (int64, error) {
+					return 0, errDatabase
+				}
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   map[string]any{"error": "something went wrong"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := repositorytest.NewFake()
+			aliceID := addUser(t, repo, repository.User{Username: "alice"})
+			if tt.configure != nil {
+				tt.configure(repo)
+			}
+			s := newTestServer(t, repo, nil)
+
+			status, body := s.do(t, http.MethodPost, "/login/", "", tt.body)
+			if status != tt.wantStatus {
+				t.Fatalf("got %d %v, want %d", status, body, tt.wantStatus)
+			}
+			checkBody(t, body, tt.wantBody)
+			if status != http.StatusOK {
+				if _, ok := body["token"]; ok {
+					t.Errorf("token in %v", body)
+				}
+				return
+			}
+
+			claims, err := s.keys.Parse(body["token"].(string))
+			if err != nil {
+				t.Fatalf("invalid token: %v", err)
+			}
+			if claims["user_id"] != float64(aliceID) {
+				t.Errorf("user_id claim = %v, want %d", claims["user_id"], aliceID)
+			}
+			sessions, err := repo.GetSessions(context.Background(), aliceID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sessions) != 1 || sessions[0].ID != claims["jti"] {
+				t.Errorf("sessions = %v, want the one of jti %v", sessions, claims["jti"])
+			}
+		})
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	tests := []struct {
+		name string
+		// authorization returns the authorization header of the request of alice.
+		authorization func(t *testing.T, s *testServer, repo *repositorytest.Fake, aliceID int64) string
+		configure     func(cfg *config.Config)
+		wantStatus    int
+		wantBody      map[string]any
+	}{
+		{
+			name: "valid token",
+			authorization: func(t *testing.T, s *testServer, repo *repositorytest.Fake, aliceID int64) string {
+				return s.login(t, "alice", "password1")
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "missing header",
+			authorization: func(t *testing.T, s *testServer, repo *repositorytest.Fake, aliceID int64) string {
+				return ""
+			},
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   map[string]any{"error": "missing authorization header"},
+		},
+		{
+			name: "not a bearer token",
+			authorization: func(t *testing.T, s *testServer, repo *repositorytest.Fake, aliceID int64) string {
+				return "Basic YWxpY2U6cGFzc3dvcmQx"
+			},
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   map[string]any{"error": "invalid authorization header format"},
+		},
+		{
+			name: "malformed token",
+			authorization: func(t *testing.T, s *testServer, repo *repositorytest.Fake, aliceID int64) string {
+				return "Bearer not.a.token"
+			},
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   map[string]any{"error": jwtkeys.ErrInvalidToken.Error()},
+		},
+		{
+			name: "signed with another key",
+			authorization: func(t *testing.T, s *testServer, repo *repositorytest.Fake, aliceID int64) string {
+				token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+					"user_id": aliceID,
+					"exp":     time.Now().Add(time.Hour).Unix(),
+				}).SignedString([]byte("another-key"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return "Bearer " + token
+			},
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   map[string]any{"error": jwtkeys.ErrInvalidToken.Error()},
+		},
+		{
+			name: "without kid",
+			authorization: func(t *testing.T, s *testServer, repo *repositorytest.Fake, aliceID int64) string {
+				return legacyToken(t, testSecret, jwt.MapClaims{"user_id": aliceID, "iat": time.Now().Add(-time.Hour).Unix()})
+			},
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   map[string]any{"error": jwtkeys.ErrInvalidToken.Error()},
+		},
+		{
+			name: "without kid issued before the cutoff",
+			authorization: func(t *testing.T, s *testServer, repo *repositorytest.Fake, aliceID int64) string {
+				return legacyToken(t, testSecret, jwt.MapClaims{"user_id": aliceID, "iat": time.Now().Add(-time.Hour).Unix()})
+			},
+			configure: func(cfg *config.Config) {
+				cfg.LegacyTokensIssuedBefore = time.Now().Add(-time.Minute)
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "without kid nor iat issued before the cutoff",
+			authorization: func(t *testing.T, s *testServer, repo *repositorytest.Fake, aliceID int64) string {
+				return legacyToken(t, testSecret, jwt.MapClaims{"user_id": aliceID})
+			},
+			configure: func(cfg *config.Config) {
+				cfg.LegacyTokensIssuedBefore = time.Now().Add(-time.Minute)
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "without kid issued after the cutoff",
+			authorization: func(t *testing.T, s *testServer, repo *repositorytest.Fake, aliceID int64) string {
+				return legacyToken(t, testSecret, jwt.MapClaims{"user_id": aliceID, "iat": time.Now().Add(-time.Minute).Unix()})
+			},
+			configure: func(cfg *config.Config) {
+				cfg.LegacyTokensIssuedBefore = time.Now().Add(-time.Hour)
+			},
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   map[string]any{"error": jwtkeys.ErrInvalidToken.Error()},
+		},
+		{
+			name: "without kid signed with a previous key",
+			authorization: func(t *testing.T, s *testServer, repo *repositorytest.Fake, aliceID int64) string {
+				return legacyToken(t, "previous-key", jwt.MapClaims{"user_id": aliceID, "iat": time.Now().Add(-time.Hour).Unix()})
+			},
+			configure: func(cfg *config.Config) {
+				cfg.PreviousSecretKeys = []string{"previous-key"}
+				cfg.LegacyTokensIssuedBefore = time.Now().Add(-time.Minute)
+			},
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   map[string]any{"error": jwtkeys.ErrInvalidToken.Error()},
+		},
+		{
+			name: "without kid signed with the legacy key",
+			authorization: func(t *testing.T, s *testServer, repo *repositorytest.Fake, aliceID int64) string {
+				return legacyToken(t, "previous-key", jwt.MapClaims{"user_id": aliceID, "iat": time.Now().Add(-time.Hour).Unix()})
+			},
+			configure: func(cfg *config.Config) {
+				cfg.PreviousSecretKeys = []string{"previous-key"}
+				cfg.LegacySecretKey = "previous-key"
+				cfg.LegacyTokensIssuedBefore = time.Now().Add(-time.Minute)
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "session logged out",
+			authorization: func(t *testing.T, s *testServer, repo *repositorytest.Fake, aliceID int64) string {
+				authorization := s.login(t, "alice", "password1")
+				claims, err := s.keys.Parse(strings.TrimPrefix(authorization, "Bearer "))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := repo.DeleteSession(context.Background(), aliceID, claims["jti"].(string)); err != nil {
+					t.Fatal(err)
+				}
+				return authorization
+			},
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   map[string]any{"error": "token revoked"},
+		},
+		{
+			name: "token version revoked",
+			authorization: func(t *testing.T, s *testServer, repo *repositorytest.Fake, aliceID int64) string {
+				authorization := s.login(t, "alice", "password1")
+				repo.GetUserAuthFunc = func(context.Context, int64) (repository.UserAuth, bool, error) {
+					return repository.UserAuth{TokenVersion: 1}, true, nil
+				}
+				return authorization
+			},
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   map[string]any{"error": "token revoked"},
+		},
+		{
+			name: "account disabled after login",
+			authorization: func(t *testing.T, s *testServer, repo *repositorytest.Fake, aliceID int64) string {
+				authorization := s.login(t, "alice", "password1")
+				repo.GetUserAuthFunc = func(context.Context, int64) (repository.UserAuth, bool, error) {
+					return repository.UserAuth{Disabled: true}, true, nil
+				}
+				return authorization
+			},
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   map[string]any{"error": "account is disabled"},
+		},
+		{
+			name: "database error",
+			authorization: func(t *testing.T, s *testServer, repo *repositorytest.Fake, aliceID int64) string {
+				authorization := s.login(t, "alice", "password1")
+				repo.GetUserAuthFunc = func(context.Context, int64) (repository.UserAuth, bool, error) {
+					return repository.UserAuth{}, false, errDatabase
+				}
+				return authorization
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   map[string]any{"error": "something went wrong"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := repositorytest.NewFake()
+			aliceID := addUser(t, repo, repository.User{Username: "alice"})
+			s := newTestServer(t, repo, tt.configure)
+
+			status, body := s.do(t, http.MethodGet, "/downloads/", tt.authorization(t, s, repo, aliceID), "")
+			if status != tt.wantStatus {
+				t.Fatalf("got %d %v, want %d", status, body, tt.wantStatus)
+			}
+			checkBody(t, body, tt.wantBody)
+			if _, ok := body["downloads"]; ok != (status == http.StatusOK) {
+				t.Errorf("downloads in the body %v: %t, want %t", body, ok, status == http.StatusOK)
+			}
+		})
+	}
+}
+
+// legacyToken returns the authorization header of a token issued before kids existed, without
+// kid, iss nor aud, signed with secret and expiring in an hour.
+func legacyToken(t *testing.T, secret string, claims jwt.MapClaims) string {
+	t.Helper()
+
+	claims["exp"] = time.Now().Add(time.Hour).Unix()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + token
+}
+
+func TestCreateDownloadRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		configure  func(repo *repositorytest.Fake, cfg *config.Config, aliceID int64)
+		wantStatus int
+		wantBody   map[string]any
+		wantQueued bool // a new download request is queued
+	}{
+		{
+			name:       "created",
+			body:       `{"link": "http://127.0.0.1:8000/file.bin"}`,
+			wantStatus: http.StatusCreated,
+			wantBody:   map[string]any{"message": "done", "download_id": float64(2)},
+			wantQueued: true,
+		},
+		{
+			name: "already requested",
+			body: `{"link": "http://127.0.0.1:8000/file.bin"}`,
+			configure: func(repo *repositorytest.Fake, cfg *config.Config, aliceID int64) {
+				repo.AddDownload(repository.DownloadRequest{UserID: aliceID, Link: "http://127.0.0.1:8000/file.bin", Status: repository.StatusCompleted})
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   map[string]any{"message": "already requested", "download_id": float64(2), "status": repository.StatusCompleted},
+		},
+		{
+			name: "requested by another user",
+			body: `{"link": "http://127.0.0.1:8000/file.bin"}`,
+			configure: func(repo *repositorytest.Fake, cfg *config.Config, aliceID int64) {
+				repo.AddDownload(repository.DownloadRequest{UserID: aliceID + 100, Link: "http://127.0.0.1:8000/file.bin"})
+			},
+			wantStatus: http.StatusCreated,
+			wantBody:   map[string]any{"message": "done", "download_id": float64(3)},
+			wantQueued: true,
+		},
+		{
+			name:       "missing link",
+			body:       `{}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unparsable body",
+			body:       `{"link": `,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   map[string]any{"error": "could not parse request body"},
+		},
+		{
+			name:       "unsupported scheme",
+			body:       `{"link": "gopher://127.0.0.1/file.bin"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "priority out of range",
+			body:       `{"link": "http://127.0.0.1:8000/file.bin", "priority": 1000}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   map[string]any{"error": "priority must be between 1 and 10"},
+		},
+		{
+			name:       "negative max speed",
+			body:       `{"link": "http://127.0.0.1:8000/file.bin", "max_speed_bytes_per_sec": -1}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   map[string]any{"error": "max_speed_bytes_per_sec must not be negative"},
+		},
+		{
+			name: "quota exceeded",
+			body: `{"link": "http://127.0.0.1:8000/file.bin"}`,
+			configure: func(repo *repositorytest.Fake, cfg *config.Config, aliceID int64) {
+				cfg.UserQuotaBytes = 100
+				if _, err := repo.AddUserUsage(context.Background(), aliceID, 100); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "database error",
+			body: `{"link": "http://127.0.0.1:8000/file.bin"}`,
+			configure: func(repo *repositorytest.Fake, cfg *config.Config, aliceID int64) {
+				repo.CreateDownloadRequestFunc = func(context.Context, repository.NewDownload) (int64, error) {
+					return 0, errDatabase
+				}
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   map[string]any{"error": "something went wrong"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := repositorytest.NewFake()
+			aliceID := addUser(t, repo, repository.User{Username: "alice"})
+			s := newTestServer(t, repo, func(cfg *config.Config) {
+				if tt.configure != nil {
+					tt.configure(repo, cfg, aliceID)
+				}
+			})
+
+			status, body := s.do(t, http.MethodPost, "/downloads/", s.login(t, "alice", "password1"), tt.body)
+			if status != tt.wantStatus {
+				t.Fatalf("got %d %v, want %d", status, body, tt.wantStatus)
+			}
+			checkBody(t, body, tt.wantBody)
+			if status >= http.StatusBadRequest {
+				if _, ok := body["error"].(string); !ok {
+					t.Errorf("no error in %v", body)
+				}
+			}
+
+			created := repo.Called("CreateDownloadRequest") > 0 && status == http.StatusCreated
+			if created != tt.wantQueued {
+				t.Fatalf("created a download request: %t, want %t", created, tt.wantQueued)
+			}
+			if !created {
+				return
+			}
+			downloadID := int64(body["download_id"].(float64))
+			download, err := repo.GetDownloadRequest(context.Background(), downloadID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if download.UserID != aliceID || download.Status != repository.StatusQueued || download.Link != "http://127.0.0.1:8000/file.bin" {
+				t.Errorf("download request = %+v, want queued for user %d", download, aliceID)
+			}
+		})
+	}
+}
+
+func TestGetDownloadRequests(t *testing.T) {
+	const link = "http://127.0.0.1:8000/"
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantLinks  []string
+		wantNext   bool
+		wantError  string
+	}{
+		{
+			name:       "own downloads",
+			wantStatus: http.StatusOK,
+			wantLinks:  []string{link + "a.bin", link + "b.bin", link + "c.bin"},
+		},
+		{
+			name:       "first page",
+			query:      "limit=2",
+			wantStatus: http.StatusOK,
+			wantLinks:  []string{link + "a.bin", link + "b.bin"},
+			wantNext:   true,
+		},
+		{
+			name:       "by status",
+			query:      "status=completed",
+			wantStatus: http.StatusOK,
+			wantLinks:  []string{link + "b.bin"},
+		},
+		{
+			name:       "newest first",
+			query:      "sort=id&order=desc",
+			wantStatus: http.StatusOK,
+			wantLinks:  []string{link + "c.bin", link + "b.bin", link + "a.bin"},
+		},
+		{
+			name:       "by part of the link",
+			query:      "query=c.bin",
+			wantStatus: http.StatusOK,
+			wantLinks:  []string{link + "c.bin"},
+		},
+		{
+			name:       "invalid status",
+			query:      "status=lost",
+			wantStatus: http.StatusBadRequest,
+			wantError:  `invalid status "lost"`,
+		},
+		{
+			name:       "invalid sort",
+			query:      "sort=size",
+			wantStatus: http.StatusBadRequest,
+			wantError:  "invalid sort",
+		},
+		{
+			name:       "invalid cursor",
+			query:      "cursor=!!!",
+			wantStatus: http.StatusBadRequest,
+			wantError:  "invalid cursor",
+		},
+		{
+			name:       "unknown folder",
+			query:      "folder_id=42",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := repositorytest.NewFake()
+			aliceID := addUser(t, repo, repository.User{Username: "alice"})
+			bobID := addUser(t, repo, repository.User{Username: "bob"})
+			repo.AddDownload(repository.DownloadRequest{UserID: aliceID, Link: link + "a.bin"})
+			repo.AddDownload(repository.DownloadRequest{UserID: bobID, Link: link + "bob.bin"})
+			repo.AddDownload(repository.DownloadRequest{UserID: aliceID, Link: link + "b.bin", Status: repository.StatusCompleted})
+			repo.AddDownload(repository.DownloadRequest{UserID: aliceID, Link: link + "c.bin", Status: repository.StatusFailed})
+			s := newTestServer(t, repo, nil)
+
+			status, body := s.do(t, http.MethodGet, "/downloads/?"+tt.query, s.login(t, "alice", "password1"), "")
+			if status != tt.wantStatus {
+				t.Fatalf("got %d %v, want %d", status, body, tt.wantStatus)
+			}
+			if status != http.StatusOK {
+				if message, _ := body["error"].(string); !strings.Contains(message, tt.wantError) {
+					t.Errorf("error = %q, want it to contain %q", message, tt.wantError)
+				}
+				return
+			}
+
+			downloads, _ := body["downloads"].([]any)
+			var links []string
+			for _, download := range downloads {
+				links = append(links, download.(map[string]any)["Link"].(string))
+			}
+			if strings.Join(links, " ") != strings.Join(tt.wantLinks, " ") {
+				t.Errorf("links = %v, want %v", links, tt.wantLinks)
+			}
+			if next, _ := body["next_cursor"].(string); (next != "") != tt.wantNext {
+				t.Errorf("next_cursor = %v, want one: %t", body["next_cursor"], tt.wantNext)
+			}
+		})
+	}
+}
+
+// TestGetDownloadRequestsArguments checks what the handler asks the repository for, on a Mock
+// answering only the methods the request needs.
+func TestGetDownloadRequestsArguments(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		wantPage  int64
+		wantLimit int64
+	}{
+		{name: "defaults", wantLimit: handler.DefaultPageSize},
+		{name: "page and limit", query: "page=3&limit=5", wantPage: 3, wantLimit: 5},
+		{name: "invalid limit", query: "limit=-1", wantLimit: handler.DefaultPageSize},
+		{name: "largest limit", query: "limit=100", wantLimit: handler.MaxPageSize},
+		{name: "limit too large", query: "limit=1000000", wantLimit: handler.MaxPageSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &repositorytest.Mock{
+				GetUserAuthFunc: func(context.Context, int64) (repository.UserAuth, bool, error) {
+					return repository.UserAuth{}, true, nil
+				},
+				GetSessionFunc: func(context.Context, int64, string) (repository.Session, bool, error) {
+					return repository.Session{}, true, nil
+				},
+				GetCachedDownloadRequestsFunc: func(context.Context, int64, int64, int64, repository.DownloadFilter, time.Duration) ([]repository.DownloadRequest, *repository.DownloadCursor, error) {
+					return []repository.DownloadRequest{}, nil, nil
+				},
+			}
+			s := newTestServer(t, repo, nil)
+			token, err := s.keys.Sign(jwt.MapClaims{"user_id": 7, "exp": time.Now().Add(time.Hour).Unix()})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			status, body := s.do(t, http.MethodGet, "/downloads/?"+tt.query, "Bearer "+token, "")
+			if status != http.StatusOK {
+				t.Fatalf("got %d %v, want 200", status, body)
+			}
+			var calls []repositorytest.Call
+			for _, call := range repo.Calls() {
+				if call.Method == "GetCachedDownloadRequests" {
+					calls = append(calls, call)
+				}
+			}
+			if len(calls) != 1 {
+				t.Fatalf("GetCachedDownloadRequests called %d times, want once", len(calls))
+			}
+			args := calls[0].Args // userID, page, limit, filter, ttl
+			if args[0] != int64(7) || args[1] != tt.wantPage || args[2] != tt.wantLimit {
+				t.Errorf("user, page and limit = %v, %v, %v, want 7, %d, %d", args[0], args[1], args[2], tt.wantPage, tt.wantLimit)
+			}
+		})
+	}
+}
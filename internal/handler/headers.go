@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"example.com/internal/repository"
+	"golang.org/x/net/http/httpguts"
+)
+
+const MaxHeaders = 32
+const MaxHeaderBytes = 8 << 10
+
+// blockedHeaders are set by the workers or the transport, or change how the response is
+// framed, so a download cannot choose them.
+var blockedHeaders = map[string]bool{
+	"Accept-Encoding":     true, // the file would be stored compressed
+	"Connection":          true,
+	"Content-Length":      true,
+	"Expect":              true,
+	"Host":                true,
+	"If-Match":            true,
+	"If-Modified-Since":   true,
+	"If-None-Match":       true,
+	"If-Range":            true,
+	"If-Unmodified-Since": true,
+	"Keep-Alive":          true,
+	"Range":               true, // see the range of the download
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+// requestHeaders validates the headers and cookies of a new download and merges them into the
+// headers the workers send, the cookies into one Cookie header.
+func requestHeaders(headers map[string]string, cookies map[string]string) (repository.Headers, error) {
+	if len(headers) > MaxHeaders {
+		return nil, fmt.Errorf("at most %d headers are allowed", MaxHeaders)
+	}
+
+	merged := make(repository.Headers, len(headers)+1)
+	size := 0
+	for name, value := range headers {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		if !httpguts.ValidHeaderFieldValue(value) {
+			return nil, fmt.Errorf("invalid value of header %q", name)
+		}
+		name = http.CanonicalHeaderKey(name)
+		if blockedHeaders[name] || strings.HasPrefix(name, "Proxy-") || strings.HasPrefix(name, "Sec-") {
+			return nil, fmt.Errorf("header %q is not allowed", name)
+		}
+		if _, ok := merged[name]; ok {
+			return nil, fmt.Errorf("duplicate header %q", name)
+		}
+		merged[name] = value
+		size += len(name) + len(value)
+	}
+
+	if len(cookies) > 0 {
+		if _, ok := merged["Cookie"]; ok {
+			return nil, errors.New("cookies and a Cookie header are mutually exclusive")
+		}
+		names := make([]string, 0, len(cookies))
+		for name := range cookies {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		pairs := make([]string, 0, len(cookies))
+		for _, name := range names {
+			cookie := &http.Cookie{Name: name, Value: cookies[name]}
+			if err := cookie.Valid(); err != nil {
+				return nil, fmt.Errorf("invalid cookie %q: %v", name, err)
+			}
+			pairs = append(pairs, cookie.String())
+		}
+		merged["Cookie"] = strings.Join(pairs, "; ")
+		size += len(merged["Cookie"])
+	}
+
+	if size > MaxHeaderBytes {
+		return nil, fmt.Errorf("headers and cookies must not exceed %d bytes", MaxHeaderBytes)
+	}
+	return merged, nil
+}
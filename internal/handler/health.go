@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"time"
+
+	"example.com/internal/consumer"
+	"example.com/internal/version"
+	"github.com/gofiber/fiber/v3"
+)
+
+// ReadinessCheckTimeout bounds every dependency check of the readiness probe.
+const ReadinessCheckTimeout = 2 * time.Second
+
+// Healthz is the liveness probe: it answers as long as the process serves requests and
+// does not check the dependencies, so an outage of Postgres or Redis does not restart it.
+func (h *handler) Healthz(c fiber.Ctx) error {
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"status": "ok"})
+}
+
+// Readyz is the readiness probe: 200 if every dependency is usable, 503 otherwise, with
+// the status of each one.
+func (h *handler) Readyz(c fiber.Ctx) error {
+	checks := []struct {
+		name  string
+		check func(ctx context.Context) error
+	}{
+		{"postgres", h.repo.PingDB},
+		{"redis", h.repo.PingRedis},
+		{"queue", h.repo.PingQueue},
+		{"storage", checkStorage},
+	}
+
+	ready := true
+	results := make(fiber.Map, len(checks))
+	for _, check := range checks {
+		// One at a time, as the database connection is not safe for concurrent use.
+		ctx, cancel := context.WithTimeout(c.Context(), ReadinessCheckTimeout)
+		err := check.check(ctx)
+		cancel()
+
+		if err != nil {
+			ready = false
+			results[check.name] = fiber.Map{"status": "unavailable", "error": err.Error()}
+		} else {
+			results[check.name] = fiber.Map{"status": "ok"}
+		}
+	}
+
+	if !ready {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"status": "unavailable", "checks": results})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"status": "ok", "checks": results})
+}
+
+// checkStorage checks that files can be created in the storage directory (the working directory).
+func checkStorage(ctx context.Context) error {
+	file, err := os.CreateTemp(".", ".readyz-*")
+	if err != nil {
+		return fmt.Errorf("storage is not writable: %v", err)
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// Version reports the build (set with -ldflags, see the version package) and the runtime
+// state of the process, so that operators can tell what runs on every instance. The schema
+// version is null when the database is unavailable.
+func (h *handler) Version(c fiber.Ctx) error {
+	var schemaVersion any
+	ctx, cancel := context.WithTimeout(c.Context(), ReadinessCheckTimeout)
+	defer cancel()
+	if v, err := h.repo.GetSchemaVersion(ctx); err != nil {
+		log.Println(err)
+	} else {
+		schemaVersion = v
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"version":        version.Version,
+		"commit":         version.Revision(),
+		"go_version":     runtime.Version(),
+		"instance_id":    h.cfg.InstanceID,
+		"schema_version": schemaVersion,
+		"queue_backend":  h.cfg.QueueBackend,
+		"mode":           h.cfg.Mode,
+		"features":       h.features(),
+		"started_at":     version.StartedAt.UTC(),
+		"uptime_seconds": int64(time.Since(version.StartedAt).Seconds()),
+	})
+}
+
+// features lists the optional features compiled in and enabled by the config.
+func (h *handler) features() []string {
+	flags := []struct {
+		name    string
+		enabled bool
+	}{
+		{"torrent", consumer.TorrentCompiled},
+		{"http3", consumer.HTTP3Compiled && h.cfg.EnableHTTP3},
+		{"grpc", h.cfg.GRPCAddr != ""},
+		{"credentials", len(h.cfg.CredentialsKey) > 0},
+		{"multipart", h.cfg.MultipartConnections > 1},
+		{"host_affinity", h.cfg.InstanceTTL > 0},
+		{"cold_storage", h.cfg.ColdStorageAfter > 0 && h.cfg.ColdStorageEndpoint != ""},
+		{"watch_folder", h.cfg.WatchDir != ""},
+		{"outbox_relay", h.cfg.OutboxInterval > 0},
+		{"reconcile", h.cfg.ReconcileInterval > 0},
+		{"checkpoint", h.cfg.CheckpointFile != ""},
+		{"statsd", h.cfg.StatsDAddr != ""},
+		{"remote_write", h.cfg.RemoteWriteURL != ""},
+	}
+
+	features := []string{}
+	for _, flag := range flags {
+		if flag.enabled {
+			features = append(features, flag.name)
+		}
+	}
+	return features
+}
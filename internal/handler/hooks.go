@@ -0,0 +1,181 @@
+package handler
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"example.com/internal/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+const DefaultHookRateLimit = 60
+
+// HookMiddleware resolves the hook of the secret token in the URL and checks the caller's IP
+// against its allow list. The hook is stored in the "hook" local for the rate limit and handler.
+func HookMiddleware(c fiber.Ctx, repo repository.Repository) error {
+	hook, found, err := repo.GetHookByTokenHash(c.Context(), hashToken(c.Params("token")))
+	if err != nil {
+		return err
+	}
+	if !found {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "hook not found"})
+	}
+
+	if len(hook.AllowedIPs) > 0 && !ipAllowed(hook.AllowedIPs, c.IP()) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "source address not allowed"})
+	}
+
+	c.Locals("hook", hook)
+	return c.Next()
+}
+
+func HookRateLimitKey(c fiber.Ctx) string {
+	return fmt.Sprintf("hook:%d", c.Locals("hook").(repository.Hook).ID)
+}
+
+func (h *handler) GetHooks(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	hooks, err := h.repo.GetHooks(c.Context(), userID)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"hooks": hooks})
+}
+
+func (h *handler) CreateHook(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	var payload struct {
+		Name       string   `json:"name"`
+		RateLimit  *int64   `json:"rate_limit" validate:"omitempty,gte=0"`
+		AllowedIPs []string `json:"allowed_ips"`
+		Priority   *int64   `json:"priority"`
+	}
+	if !bindBody(c, &payload) {
+		return nil
+	}
+
+	hook := repository.Hook{
+		UserID:     userID,
+		Name:       payload.Name,
+		RateLimit:  DefaultHookRateLimit,
+		AllowedIPs: []string{},
+		Priority:   DefaultPriority,
+	}
+	if payload.RateLimit != nil {
+		hook.RateLimit = *payload.RateLimit
+	}
+	if payload.Priority != nil {
+		hook.Priority = *payload.Priority
+	}
+	if hook.Priority < MinPriority || hook.Priority > MaxPriority {
+		return invalidFields(c, FieldError{Field: "priority", Message: fmt.Sprintf("priority must be between %d and %d", MinPriority, MaxPriority)})
+	}
+	for i, ip := range payload.AllowedIPs {
+		if _, err := parsePrefix(ip); err != nil {
+			return invalidFields(c, FieldError{Field: fmt.Sprintf("allowed_ips[%d]", i), Message: fmt.Sprintf("invalid allowed ip %q", ip)})
+		}
+		hook.AllowedIPs = append(hook.AllowedIPs, ip)
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(b)
+	hook.TokenHash = hashToken(token)
+
+	hookID, err := h.repo.CreateHook(c.Context(), hook)
+	if err != nil {
+		return err
+	}
+
+	// The token is only shown once, it cannot be recovered from the stored hash.
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"hook_id": hookID, "token": token, "url": "/hooks/" + token})
+}
+
+func (h *handler) DeleteHook(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	hookID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid hook id"})
+	}
+
+	deleted, err := h.repo.DeleteHook(c.Context(), userID, hookID)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "hook not found"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "done"})
+}
+
+// TriggerHook enqueues the link of the payload for the owner of the hook, with the hook's preset.
+// Both "link" and "url" are accepted since that is what most senders call it.
+func (h *handler) TriggerHook(c fiber.Ctx) error {
+	hook := c.Locals("hook").(repository.Hook)
+
+	var payload struct {
+		Link string `json:"link"`
+		URL  string `json:"url"`
+	}
+	if !bindBody(c, &payload) {
+		return nil
+	}
+
+	link := payload.Link
+	if link == "" {
+		link = payload.URL
+	}
+	if link == "" {
+		return invalidFields(c, FieldError{Field: "link", Message: "link is required"})
+	}
+	if err := h.guard.ValidateLink(c.Context(), link); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return h.enqueueDownload(c, repository.NewDownload{UserID: hook.UserID, Link: link, Priority: hook.Priority})
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// parsePrefix accepts either a CIDR or a single address.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func ipAllowed(allowed []string, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, s := range allowed {
+		prefix, err := parsePrefix(s)
+		if err == nil && prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"example.com/internal/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+// IdempotencyKeyLockTime bounds how long a request holds its Idempotency-Key before its
+// response is stored, so that the retries of a request whose process died are not refused
+// for the whole IDEMPOTENCY_KEY_TTL.
+const IdempotencyKeyLockTime = 1 * time.Minute
+const MaxIdempotencyKeyLength = 255
+
+// IdempotencyMiddleware replays the response of the first request the user made with the
+// same Idempotency-Key header, so that the retries of a client do not create the download
+// twice. Responses are stored for ttl (0 disables it) except the 5xx ones, which may be
+// retried for real. Like RateLimitMiddleware, the request is let through if Redis is
+// unavailable.
+func IdempotencyMiddleware(c fiber.Ctx, repo repository.Repository, ttl time.Duration) error {
+	idempotencyKey := c.Get("Idempotency-Key")
+	if idempotencyKey == "" || ttl <= 0 {
+		return c.Next()
+	}
+	if len(idempotencyKey) > MaxIdempotencyKeyLength {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("Idempotency-Key must be at most %d characters", MaxIdempotencyKeyLength)})
+	}
+
+	keySum := sha256.Sum256([]byte(idempotencyKey))
+	key := fmt.Sprintf("user:%d:%s", c.Locals("userID").(int64), hex.EncodeToString(keySum[:]))
+	requestSum := sha256.Sum256([]byte(c.Method() + " " + c.Path() + "\n" + string(c.Body())))
+	fingerprint := hex.EncodeToString(requestSum[:])
+
+	stored, reserved, err := repo.ReserveIdempotencyKey(c.Context(), key, fingerprint, IdempotencyKeyLockTime)
+	if err != nil {
+		log.Println(err)
+		return c.Next()
+	}
+	if !reserved {
+		if stored.Fingerprint != fingerprint {
+			return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"error": "the Idempotency-Key was used for another request"})
+		}
+		if stored.Status == 0 {
+			c.Set(fiber.HeaderRetryAfter, "1")
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "a request with this Idempotency-Key is in progress"})
+		}
+		c.Set("Idempotent-Replayed", "true")
+		c.Set(fiber.HeaderContentType, stored.ContentType)
+		return c.Status(stored.Status).Send(stored.Body)
+	}
+
+	err = c.Next()
+	status := c.Response().StatusCode()
+	// Failures and rate limited requests (batches are limited by the handler) may be retried.
+	if err != nil || status >= fiber.StatusInternalServerError || status == fiber.StatusTooManyRequests {
+		if err := repo.ReleaseIdempotencyKey(c.Context(), key); err != nil {
+			log.Println(err)
+		}
+		return err
+	}
+
+	response := repository.IdempotentResponse{
+		Fingerprint: fingerprint,
+		Status:      status,
+		ContentType: string(c.Response().Header.ContentType()),
+		Body:        append([]byte(nil), c.Response().Body()...),
+	}
+	if err := repo.SaveIdempotentResponse(c.Context(), key, response, ttl); err != nil {
+		log.Println(err)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"example.com/internal/config"
+)
+
+const MaxLabels = 16
+
+// Label keys and values follow the Kubernetes syntax: an optional DNS subdomain prefix and a
+// name of up to 63 alphanumerics, '-', '_' or '.' that begins and ends with an alphanumeric.
+var (
+	labelName   = regexp.MustCompile(`^([A-Za-z0-9]([-A-Za-z0-9_.]{0,61}[A-Za-z0-9])?)$`)
+	labelPrefix = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+)
+
+func validateLabels(labels map[string]string) error {
+	if len(labels) > MaxLabels {
+		return fmt.Errorf("at most %d labels are allowed", MaxLabels)
+	}
+	for key, value := range labels {
+		if err := validateLabel(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateLabel(key string, value string) error {
+	name := key
+	if prefix, rest, ok := strings.Cut(key, "/"); ok {
+		if len(prefix) > 253 || !labelPrefix.MatchString(prefix) {
+			return fmt.Errorf("invalid prefix of label %q", key)
+		}
+		name = rest
+	}
+	if !labelName.MatchString(name) {
+		return fmt.Errorf("invalid label key %q", key)
+	}
+	if value != "" && !labelName.MatchString(value) {
+		return fmt.Errorf("invalid value of label %q", key)
+	}
+	return nil
+}
+
+// parseLabelSelector parses label filters like env=prod, all of which must match.
+func parseLabelSelector(filters []string) (map[string]string, error) {
+	selector := make(map[string]string)
+	for _, filter := range filters {
+		key, value, ok := strings.Cut(filter, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid label filter %q: must be key=value", filter)
+		}
+		if err := validateLabel(key, value); err != nil {
+			return nil, err
+		}
+		selector[key] = value
+	}
+	return selector, nil
+}
+
+// labelPriority returns the priority of the first rule matching the labels, if any.
+func labelPriority(rules []config.LabelRule, labels map[string]string) (int64, bool) {
+	for _, rule := range rules {
+		if value, ok := labels[rule.Key]; ok && value == rule.Value {
+			return min(max(rule.Limit, MinPriority), MaxPriority), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,363 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"example.com/internal/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+// MaxOrganizationNameLength bounds the names of the organizations.
+const MaxOrganizationNameLength = 256
+
+// MaxOrganizationMembers bounds the users of an organization.
+const MaxOrganizationMembers = 1000
+
+var (
+	errOrganizationNotFound  = fmt.Errorf("organization %w", repository.ErrNotFound)
+	errOrganizationForbidden = fmt.Errorf("%w: your role in the organization does not allow it", repository.ErrForbidden)
+	errLastOwner             = errors.New("the organization must keep an owner")
+	errOrgQuotaExceeded      = fmt.Errorf("%w by the organization", errQuotaExceeded)
+)
+
+func (h *handler) GetOrganizations(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	organizations, err := h.repo.GetOrganizations(c.Context(), userID)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"organizations": organizations})
+}
+
+// CreateOrganization creates an organization owned by the user.
+func (h *handler) CreateOrganization(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	var payload struct {
+		Name string `json:"name"`
+	}
+	if !bindBody(c, &payload) {
+		return nil
+	}
+	if strings.TrimSpace(payload.Name) == "" {
+		return invalidFields(c, FieldError{Field: "name", Message: "name is required"})
+	}
+	if len(payload.Name) > MaxOrganizationNameLength {
+		return invalidFields(c, FieldError{Field: "name", Message: "name is too long"})
+	}
+
+	orgID, err := h.repo.CreateOrganization(c.Context(), payload.Name, userID)
+	if errors.Is(err, repository.OrganizationExistsErr) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"org_id": orgID})
+}
+
+func (h *handler) GetOrganization(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	organization, err := h.organizationParam(c.Context(), userID, c.Params("id"))
+	if err != nil {
+		return collectionError(c, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(organization)
+}
+
+// DeleteOrganization deletes an organization of which the user is an owner. Its downloads stay
+// with the members who requested them.
+func (h *handler) DeleteOrganization(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	organization, err := h.organizationParam(c.Context(), userID, c.Params("id"))
+	if err != nil {
+		return collectionError(c, err)
+	}
+	if organization.Role != repository.OrgRoleOwner {
+		return collectionError(c, errOrganizationForbidden)
+	}
+
+	deleted, err := h.repo.DeleteOrganization(c.Context(), organization.ID)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return errOrganizationNotFound
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "done"})
+}
+
+// GetOrganizationUsage returns the bytes the downloads of an organization store, and its quota.
+func (h *handler) GetOrganizationUsage(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	organization, err := h.organizationParam(c.Context(), userID, c.Params("id"))
+	if err != nil {
+		return collectionError(c, err)
+	}
+
+	storedBytes, err := h.repo.GetOrganizationUsage(c.Context(), organization.ID)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"stored_bytes": storedBytes,
+		"quota_bytes":  h.orgQuota(organization),
+	})
+}
+
+func (h *handler) GetOrganizationMembers(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	organization, err := h.organizationParam(c.Context(), userID, c.Params("id"))
+	if err != nil {
+		return collectionError(c, err)
+	}
+
+	members, err := h.repo.GetOrganizationMembers(c.Context(), organization.ID)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"members": members})
+}
+
+// SetOrganizationMember adds a user to an organization or changes the role of a member. Admins
+// only manage the members with the member role, owners manage all of them.
+func (h *handler) SetOrganizationMember(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	organization, err := h.organizationParam(c.Context(), userID, c.Params("id"))
+	if err != nil {
+		return collectionError(c, err)
+	}
+	if organization.Role == repository.OrgRoleMember {
+		return collectionError(c, errOrganizationForbidden)
+	}
+
+	var payload struct {
+		Username string `json:"username" validate:"required"`
+		Role     string `json:"role" validate:"oneof=owner admin member"` // one of the repository.OrgRole* constants
+	}
+	if !bindBody(c, &payload) {
+		return nil
+	}
+	if organization.Role == repository.OrgRoleAdmin && payload.Role != repository.OrgRoleMember {
+		return collectionError(c, errOrganizationForbidden)
+	}
+
+	memberID, found, err := h.repo.FindUser(c.Context(), payload.Username)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "user not found"})
+	}
+
+	members, err := h.repo.GetOrganizationMembers(c.Context(), organization.ID)
+	if err != nil {
+		return err
+	}
+	current, isMember := organizationMember(members, memberID)
+	if !isMember && len(members) >= MaxOrganizationMembers {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("an organization has at most %d members", MaxOrganizationMembers)})
+	}
+	if isMember && organization.Role == repository.OrgRoleAdmin && current.Role != repository.OrgRoleMember {
+		return collectionError(c, errOrganizationForbidden)
+	}
+	if isMember && current.Role == repository.OrgRoleOwner && payload.Role != repository.OrgRoleOwner && countOwners(members) == 1 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": errLastOwner.Error()})
+	}
+
+	member := repository.OrganizationMember{OrgID: organization.ID, UserID: memberID, Role: payload.Role}
+	if err := h.repo.SetOrganizationMember(c.Context(), member); err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "done", "user_id": memberID})
+}
+
+// RemoveOrganizationMember removes a user from an organization: done by an owner, by an admin
+// for the members with the member role, or by the member leaving it. The downloads the member
+// requested for the organization stay with it.
+func (h *handler) RemoveOrganizationMember(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	organization, err := h.organizationParam(c.Context(), userID, c.Params("id"))
+	if err != nil {
+		return collectionError(c, err)
+	}
+	memberID, err := strconv.ParseInt(c.Params("user_id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid user id"})
+	}
+
+	members, err := h.repo.GetOrganizationMembers(c.Context(), organization.ID)
+	if err != nil {
+		return err
+	}
+	member, found := organizationMember(members, memberID)
+	if !found {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "user is not a member of the organization"})
+	}
+	if memberID != userID {
+		switch organization.Role {
+		case repository.OrgRoleMember:
+			return collectionError(c, errOrganizationForbidden)
+		case repository.OrgRoleAdmin:
+			if member.Role != repository.OrgRoleMember {
+				return collectionError(c, errOrganizationForbidden)
+			}
+		}
+	}
+	if member.Role == repository.OrgRoleOwner && countOwners(members) == 1 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": errLastOwner.Error()})
+	}
+
+	removed, err := h.repo.RemoveOrganizationMember(c.Context(), organization.ID, memberID)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "user is not a member of the organization"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "done"})
+}
+
+// SetOrganizationLimits overrides the storage quota and the downloads rate limit of an
+// organization, null for ORG_QUOTA_BYTES and RATE_LIMIT_ORG_DOWNLOADS. 0 means unlimited.
+func (h *handler) SetOrganizationLimits(c fiber.Ctx) error {
+	orgID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid organization id"})
+	}
+
+	var payload struct {
+		QuotaBytes *int64 `json:"quota_bytes" validate:"omitempty,gte=0"`
+		RateLimit  *int64 `json:"rate_limit" validate:"omitempty,gte=0"`
+	}
+	if !bindBody(c, &payload) {
+		return nil
+	}
+
+	found, err := h.repo.SetOrganizationLimits(c.Context(), orgID, payload.QuotaBytes, payload.RateLimit)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errOrganizationNotFound
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "done"})
+}
+
+// organizationParam returns the organization with the id in the path if the user is a member of
+// it, with the role of the user.
+func (h *handler) organizationParam(ctx context.Context, userID int64, param string) (repository.Organization, error) {
+	orgID, err := strconv.ParseInt(param, 10, 64)
+	if err != nil {
+		return repository.Organization{}, errors.New("invalid organization id")
+	}
+	return h.checkOrganization(ctx, userID, orgID)
+}
+
+func (h *handler) checkOrganization(ctx context.Context, userID int64, orgID int64) (repository.Organization, error) {
+	organization, found, err := h.repo.GetOrganization(ctx, orgID)
+	if err != nil {
+		log.Println(err)
+		return repository.Organization{}, errSomethingWentWrong
+	}
+	if !found {
+		return repository.Organization{}, errOrganizationNotFound
+	}
+
+	member, found, err := h.repo.GetOrganizationMember(ctx, orgID, userID)
+	if err != nil {
+		log.Println(err)
+		return repository.Organization{}, errSomethingWentWrong
+	}
+	if !found {
+		return repository.Organization{}, errOrganizationNotFound
+	}
+	organization.Role = member.Role
+	return organization, nil
+}
+
+// checkOrgQuota fails with errOrgQuotaExceeded if the organization stores its quota already.
+func (h *handler) checkOrgQuota(ctx context.Context, orgID int64) error {
+	organization, found, err := h.repo.GetOrganization(ctx, orgID)
+	if err != nil {
+		log.Println(err)
+		return errSomethingWentWrong
+	}
+	quota := h.orgQuota(organization)
+	if !found || quota <= 0 {
+		return nil
+	}
+
+	storedBytes, err := h.repo.GetOrganizationUsage(ctx, orgID)
+	if err != nil {
+		log.Println(err)
+		return errSomethingWentWrong
+	}
+	if storedBytes >= quota {
+		return errOrgQuotaExceeded
+	}
+	return nil
+}
+
+// orgRateLimit counts hits downloads requested for the organization against its rate limit. It
+// reports false once it has written the response.
+func (h *handler) orgRateLimit(c fiber.Ctx, orgID int64, hits int64) bool {
+	limit := h.cfg.OrgDownloadsRateLimit
+	organization, found, err := h.repo.GetOrganization(c.Context(), orgID)
+	if err != nil {
+		log.Println(err) // let through, as when Redis is unavailable
+		return true
+	}
+	if found && organization.RateLimit != nil {
+		limit = *organization.RateLimit
+	}
+	return rateLimit(c, h.repo, OrgRateLimitKey(orgID), limit, h.cfg.RateLimitWindow, hits)
+}
+
+// orgQuota returns the storage quota of the organization, 0 for none.
+func (h *handler) orgQuota(organization repository.Organization) int64 {
+	if organization.QuotaBytes != nil {
+		return *organization.QuotaBytes
+	}
+	return h.cfg.OrgQuotaBytes
+}
+
+func organizationMember(members []repository.OrganizationMember, userID int64) (repository.OrganizationMember, bool) {
+	for _, member := range members {
+		if member.UserID == userID {
+			return member, true
+		}
+	}
+	return repository.OrganizationMember{}, false
+}
+
+func countOwners(members []repository.OrganizationMember) int {
+	owners := 0
+	for _, member := range members {
+		if member.Role == repository.OrgRoleOwner {
+			owners++
+		}
+	}
+	return owners
+}
@@ -0,0 +1,159 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"example.com/internal/repository"
+	"example.com/internal/secrets"
+	"github.com/gofiber/fiber/v3"
+)
+
+const MaxProfileHosts = 16
+
+func (h *handler) GetOriginProfiles(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	profiles, err := h.repo.GetOriginProfiles(c.Context(), userID)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"profiles": profiles})
+}
+
+// CreateOriginProfile stores the secrets of an origin sealed; they are never returned.
+func (h *handler) CreateOriginProfile(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	var payload struct {
+		Name  string   `json:"name" validate:"required"`
+		Kind  string   `json:"kind"`
+		Hosts []string `json:"hosts"`
+		repository.OriginSecret
+	}
+	if !bindBody(c, &payload) {
+		return nil
+	}
+
+	secret, err := h.validateOriginSecret(c.Context(), payload.Kind, payload.OriginSecret)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	hosts, err := validateProfileHosts(payload.Hosts)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	data, _ := json.Marshal(secret)
+	sealed, err := h.box.Seal(data)
+	if errors.Is(err, secrets.ErrNoKey) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "storing credentials is not enabled"})
+	}
+	if err != nil {
+		return err
+	}
+
+	profileID, err := h.repo.CreateOriginProfile(c.Context(), repository.OriginProfile{UserID: userID, Name: payload.Name, Kind: payload.Kind, Secret: sealed, Hosts: hosts})
+	if err != nil {
+		// TODO handle duplicate name
+		return err
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"profile_id": profileID})
+}
+
+func (h *handler) DeleteOriginProfile(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	profileID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid profile id"})
+	}
+
+	deleted, err := h.repo.DeleteOriginProfile(c.Context(), userID, profileID)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "profile not found"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "done"})
+}
+
+// validateProfileHosts checks the hosts an origin profile is used for automatically: host names
+// or IP addresses, or "*." and a domain for its subdomains. They are returned in lower case.
+func validateProfileHosts(hosts []string) ([]string, error) {
+	if len(hosts) > MaxProfileHosts {
+		return nil, fmt.Errorf("at most %d hosts are allowed", MaxProfileHosts)
+	}
+
+	valid := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		host = strings.ToLower(host)
+		domain, wildcard := strings.CutPrefix(host, "*.")
+		if _, err := netip.ParseAddr(domain); err == nil && !wildcard {
+			valid = append(valid, host)
+			continue
+		}
+		// Wildcards of top level domains would match most of the internet.
+		if len(domain) > 253 || !labelPrefix.MatchString(domain) || wildcard && !strings.Contains(domain, ".") {
+			return nil, fmt.Errorf("invalid host %q", host)
+		}
+		valid = append(valid, host)
+	}
+	return valid, nil
+}
+
+// validateOriginSecret checks that the fields of the kind are set and returns only those.
+func (h *handler) validateOriginSecret(ctx context.Context, kind string, secret repository.OriginSecret) (repository.OriginSecret, error) {
+	switch kind {
+	case repository.OriginProfileBasic:
+		if secret.Username == "" {
+			return secret, errors.New("username is required")
+		}
+		return repository.OriginSecret{Username: secret.Username, Password: secret.Password}, nil
+	case repository.OriginProfileBearer:
+		if secret.Token == "" {
+			return secret, errors.New("token is required")
+		}
+		return repository.OriginSecret{Token: secret.Token}, nil
+	case repository.OriginProfileOAuth2:
+		if secret.TokenURL == "" || secret.ClientID == "" || secret.ClientSecret == "" {
+			return secret, errors.New("token_url, client_id and client_secret are required")
+		}
+		if !strings.HasPrefix(secret.TokenURL, "https://") && !strings.HasPrefix(secret.TokenURL, "http://") {
+			return secret, errors.New("token_url must be an http or https url")
+		}
+		// The workers fetch the tokens, so the token URL is held to the rules of the links.
+		if err := h.guard.ValidateLink(ctx, secret.TokenURL); err != nil {
+			return secret, fmt.Errorf("invalid token_url: %v", err)
+		}
+		return repository.OriginSecret{TokenURL: secret.TokenURL, ClientID: secret.ClientID, ClientSecret: secret.ClientSecret, Scopes: secret.Scopes}, nil
+	}
+	return secret, fmt.Errorf("kind must be one of %s, %s or %s", repository.OriginProfileBasic, repository.OriginProfileBearer, repository.OriginProfileOAuth2)
+}
+
+// checkOriginProfile checks that a new download of link can use the profile of the user.
+func (h *handler) checkOriginProfile(ctx context.Context, userID int64, profileID int64, link string) error {
+	profile, found, err := h.repo.GetOriginProfile(ctx, profileID)
+	if err != nil {
+		log.Println(err)
+		return errSomethingWentWrong
+	}
+	if !found || profile.UserID != userID {
+		return errors.New("origin profile not found")
+	}
+
+	if profile.Kind != repository.OriginProfileBasic && !strings.HasPrefix(link, "http://") && !strings.HasPrefix(link, "https://") && !isRegistryLink(link) {
+		return fmt.Errorf("%s origin profiles are only supported for http, https, oci, maven and npm links", profile.Kind)
+	}
+	return nil
+}
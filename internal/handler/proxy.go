@@ -0,0 +1,140 @@
+package handler
+
+import (
+	"errors"
+	"log"
+	"mime"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"example.com/internal/proxy"
+	"github.com/gofiber/fiber/v3"
+)
+
+func (h *handler) Proxy(c fiber.Ctx) error {
+	link, ok := h.proxiedLink(c)
+	if !ok {
+		return nil
+	}
+
+	resp, err := h.proxy.Fetch(c.Context(), link)
+	if err != nil {
+		if errors.Is(err, proxy.ErrDisabled) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+		}
+		log.Println(err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "could not fetch url"})
+	}
+
+	c.Set("X-Cache", resp.Cache)
+	if resp.ContentType != "" {
+		c.Set(fiber.HeaderContentType, resp.ContentType)
+	}
+	if resp.ETag != "" {
+		c.Set(fiber.HeaderETag, resp.ETag)
+	}
+	if resp.Size >= 0 {
+		c.Set(fiber.HeaderContentLength, strconv.FormatInt(resp.Size, 10))
+	}
+
+	return c.Status(fiber.StatusOK).SendStream(resp.Body, int(resp.Size))
+}
+
+// Fetch streams the file of the url query parameter from its origin to the client, without
+// queueing or storing it. The client's Range is forwarded. The file may not be larger than
+// MAX_DOWNLOAD_BYTES nor max_bytes, and is streamed at most at FETCH_MAX_SPEED and max_speed
+// bytes per second.
+func (h *handler) Fetch(c fiber.Ctx) error {
+	link, ok := h.proxiedLink(c)
+	if !ok {
+		return nil
+	}
+	maxBytes, err := strconv.ParseInt(c.Query("max_bytes", "0"), 10, 64)
+	if err != nil || maxBytes < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "max_bytes must be a number of bytes"})
+	}
+	maxSpeed, err := strconv.ParseInt(c.Query("max_speed", "0"), 10, 64)
+	if err != nil || maxSpeed < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "max_speed must be a number of bytes per second"})
+	}
+
+	resp, err := h.proxy.PassThrough(c.Context(), link, c.Get(fiber.HeaderRange), lowestLimit(h.cfg.MaxDownloadBytes, maxBytes), lowestLimit(h.cfg.FetchMaxSpeed, maxSpeed))
+	if errors.Is(err, proxy.ErrTooLarge) {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "could not fetch url"})
+	}
+
+	if resp.ContentType != "" {
+		c.Set(fiber.HeaderContentType, resp.ContentType)
+	}
+	if resp.ETag != "" {
+		c.Set(fiber.HeaderETag, resp.ETag)
+	}
+	if disposition := attachment(link); disposition != "" {
+		c.Set(fiber.HeaderContentDisposition, disposition)
+	}
+	if resp.Size >= 0 {
+		c.Set(fiber.HeaderContentLength, strconv.FormatInt(resp.Size, 10))
+	}
+	status := fiber.StatusOK
+	if resp.ContentRange != "" {
+		c.Set(fiber.HeaderContentRange, resp.ContentRange)
+		status = fiber.StatusPartialContent
+	}
+
+	return c.Status(status).SendStream(resp.Body, int(resp.Size))
+}
+
+// proxiedLink returns the url query parameter, an http(s) link the guard lets through. It answers
+// 400 and returns false otherwise.
+func (h *handler) proxiedLink(c fiber.Ctx) (string, bool) {
+	link := c.Query("url")
+	if link == "" {
+		c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "url is required"})
+		return "", false
+	}
+	if !strings.HasPrefix(link, "http://") && !strings.HasPrefix(link, "https://") {
+		c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "only http and https urls can be proxied"})
+		return "", false
+	}
+	if err := h.guard.ValidateLink(c.Context(), link); err != nil {
+		c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		return "", false
+	}
+	return link, true
+}
+
+// lowestLimit returns the lowest of the limits that are set, 0 if none is.
+func lowestLimit(limits ...int64) int64 {
+	lowest := int64(0)
+	for _, limit := range limits {
+		if limit > 0 && (lowest == 0 || limit < lowest) {
+			lowest = limit
+		}
+	}
+	return lowest
+}
+
+// attachment returns the Content-Disposition of the response to a fetch of link, named after
+// the last element of its path, or "" for a link without one. The name is decoded from the
+// url, so mime.FormatMediaType quotes it, or encodes it (RFC 2231) when it holds control or
+// non-ASCII characters; should it fail, the name is left out.
+func attachment(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		return ""
+	}
+	if disposition := mime.FormatMediaType("attachment", map[string]string{"filename": name}); disposition != "" {
+		return disposition
+	}
+	return "attachment"
+}
@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"example.com/internal/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+// RateLimitMiddleware allows at most limit requests per window for the given key
+// (e.g. "login:ip:1.2.3.4"). A limit of 0 disables it. If Redis is unavailable the
+// request is let through rather than taking the API down with it.
+func RateLimitMiddleware(c fiber.Ctx, repo repository.Repository, key string, limit int64, window time.Duration) error {
+	if !rateLimit(c, repo, key, limit, window, 1) {
+		return nil
+	}
+	return c.Next()
+}
+
+// rateLimit counts hits requests against the limit of the key and sets the rate limit headers.
+// It reports false once it has written the 429 response.
+func rateLimit(c fiber.Ctx, repo repository.Repository, key string, limit int64, window time.Duration, hits int64) bool {
+	if limit <= 0 {
+		return true
+	}
+
+	result, err := repo.RateLimit(c.Context(), key, limit, window, hits)
+	if err != nil {
+		log.Println(err)
+		return true
+	}
+
+	resetSeconds := int64(math.Ceil(result.Reset.Seconds()))
+	c.Set("X-RateLimit-Limit", strconv.FormatInt(limit, 10))
+	c.Set("X-RateLimit-Remaining", strconv.FormatInt(result.Remaining, 10))
+	c.Set("X-RateLimit-Reset", strconv.FormatInt(resetSeconds, 10))
+
+	if !result.Allowed {
+		c.Set(fiber.HeaderRetryAfter, strconv.FormatInt(resetSeconds, 10))
+		c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "too many requests"})
+		return false
+	}
+
+	return true
+}
+
+func IPRateLimitKey(c fiber.Ctx, scope string) string {
+	return fmt.Sprintf("%s:ip:%s", scope, c.IP())
+}
+
+func UserRateLimitKey(c fiber.Ctx, scope string) string {
+	return fmt.Sprintf("%s:user:%d", scope, c.Locals("userID").(int64))
+}
+
+// OrgRateLimitKey is the key of the downloads requested for the organization.
+func OrgRateLimitKey(orgID int64) string {
+	return fmt.Sprintf("downloads:org:%d", orgID)
+}
@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"example.com/internal/flags"
+	"example.com/internal/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+const DefaultScriptTimeout = 1 * time.Minute
+const MaxCompletionScripts = 10
+const MaxScriptBytes = 16 << 10 // 16KB
+
+func (h *handler) GetCompletionScripts(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	scripts, err := h.repo.GetCompletionScripts(c.Context(), userID)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"scripts": scripts})
+}
+
+// CreateCompletionScript registers a script run on the file of every download of the user
+// that completes from now on. It is only offered to the users with the completion_scripts flag.
+func (h *handler) CreateCompletionScript(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+	if !h.flags.Enabled(c.Context(), flags.CompletionScripts, userID) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "completion scripts are not enabled for this user"})
+	}
+
+	var payload struct {
+		Name    string `json:"name"`
+		Script  string `json:"script" validate:"required"`
+		Timeout *int64 `json:"timeout_seconds"`
+	}
+	if !bindBody(c, &payload) {
+		return nil
+	}
+	if len(payload.Script) > MaxScriptBytes {
+		return invalidFields(c, FieldError{Field: "script", Message: fmt.Sprintf("script must not be longer than %d bytes", MaxScriptBytes)})
+	}
+
+	script := repository.CompletionScript{
+		UserID:  userID,
+		Name:    payload.Name,
+		Script:  payload.Script,
+		Timeout: int64(min(DefaultScriptTimeout, h.cfg.MaxScriptTimeout).Seconds()),
+	}
+	if payload.Timeout != nil {
+		script.Timeout = *payload.Timeout
+	}
+	if maxTimeout := int64(h.cfg.MaxScriptTimeout.Seconds()); script.Timeout < 1 || script.Timeout > maxTimeout {
+		return invalidFields(c, FieldError{Field: "timeout_seconds", Message: fmt.Sprintf("timeout_seconds must be between 1 and %d", maxTimeout)})
+	}
+
+	scripts, err := h.repo.GetCompletionScripts(c.Context(), userID)
+	if err != nil {
+		return err
+	}
+	if len(scripts) >= MaxCompletionScripts {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": fmt.Sprintf("at most %d completion scripts are allowed", MaxCompletionScripts)})
+	}
+
+	scriptID, err := h.repo.CreateCompletionScript(c.Context(), script)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"script_id": scriptID})
+}
+
+func (h *handler) DeleteCompletionScript(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	scriptID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid script id"})
+	}
+
+	deleted, err := h.repo.DeleteCompletionScript(c.Context(), userID, scriptID)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "script not found"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "done"})
+}
@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"example.com/internal/jwtkeys"
+	"example.com/internal/repository"
+	"github.com/gofiber/fiber/v3"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const TokenExpTime = 72 * time.Hour
+
+// issueToken signs a token for the user with the version and stores its session, which is
+// listed at /account/sessions and revoked with the token.
+func issueToken(ctx context.Context, repo repository.Repository, userID int64, version int64, keys jwtkeys.Keys, ip string, userAgent string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	session := repository.Session{
+		ID:           hex.EncodeToString(b),
+		TokenVersion: version,
+		IP:           ip,
+		UserAgent:    userAgent,
+		IssuedAt:     now,
+		ExpiresAt:    now.Add(TokenExpTime),
+	}
+
+	tokenString, err := keys.Sign(jwt.MapClaims{
+		"user_id":       userID,
+		"token_version": version,
+		"jti":           session.ID,
+		"iat":           session.IssuedAt.Unix(),
+		"exp":           session.ExpiresAt.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := repo.AddSession(ctx, userID, session); err != nil {
+		return "", err
+	}
+	return tokenString, nil
+}
+
+// GetSessions lists the tokens of the user that are not revoked or expired, the latest first.
+// The one of the request is marked current.
+func (h *handler) GetSessions(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+	sessionID, _ := c.Locals("sessionID").(string)
+
+	version, err := tokenVersion(c.Context(), h.repo, userID)
+	if err != nil {
+		return err
+	}
+	sessions, err := h.repo.GetSessions(c.Context(), userID)
+	if err != nil {
+		return err
+	}
+
+	type sessionResponse struct {
+		repository.Session
+		Current bool `json:"current"`
+	}
+	response := []sessionResponse{}
+	for _, session := range sessions {
+		if session.TokenVersion != version {
+			continue // revoked with all the tokens of the user, e.g. by a password change
+		}
+		response = append(response, sessionResponse{Session: session, Current: session.ID == sessionID})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"sessions": response})
+}
+
+// DeleteSession revokes a token of the user, the one of the request included.
+func (h *handler) DeleteSession(c fiber.Ctx) error {
+	userID := c.Locals("userID").(int64)
+
+	deleted, err := h.repo.DeleteSession(c.Context(), userID, c.Params("id"))
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "session not found"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "done"})
+}
@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"example.com/internal/httpclient"
+	"example.com/internal/repository"
+)
+
+// validateTuning checks the transfer overrides of a new download against the bounds the
+// admins configured.
+func (h *handler) validateTuning(link string, tuning repository.Tuning) error {
+	if tuning.ReadTimeoutSeconds != 0 {
+		bounds := h.cfg.TuningReadTimeout
+		readTimeout := time.Duration(tuning.ReadTimeoutSeconds) * time.Second
+		if readTimeout < bounds[0] || readTimeout > bounds[1] {
+			return fmt.Errorf("tuning.read_timeout_seconds must be between %d and %d", int64(bounds[0]/time.Second), int64(bounds[1]/time.Second))
+		}
+	}
+	if tuning.ChunkSizeBytes != 0 {
+		bounds := h.cfg.TuningChunkSize
+		if tuning.ChunkSizeBytes < bounds[0] || tuning.ChunkSizeBytes > bounds[1] {
+			return fmt.Errorf("tuning.chunk_size_bytes must be between %d and %d", bounds[0], bounds[1])
+		}
+	}
+	if tuning.FlushThresholdBytes != 0 {
+		bounds := h.cfg.TuningFlushThreshold
+		if tuning.FlushThresholdBytes < bounds[0] || tuning.FlushThresholdBytes > bounds[1] {
+			return fmt.Errorf("tuning.flush_threshold_bytes must be between %d and %d", bounds[0], bounds[1])
+		}
+	}
+	if tuning.TCPCongestion != "" {
+		if !strings.HasPrefix(link, "http://") && !strings.HasPrefix(link, "https://") {
+			return errors.New("tuning.tcp_congestion is only supported for http and https links")
+		}
+		if len(h.cfg.TuningTCPCongestion) == 0 || !httpclient.CongestionSupported {
+			return errors.New("tuning.tcp_congestion is not enabled")
+		}
+		if !slices.Contains(h.cfg.TuningTCPCongestion, tuning.TCPCongestion) {
+			return fmt.Errorf("tuning.tcp_congestion must be one of %s", strings.Join(h.cfg.TuningTCPCongestion, ", "))
+		}
+	}
+	switch tuning.ContentEncoding {
+	case "", repository.ContentEncodingIdentity:
+	case repository.ContentEncodingDecompress, repository.ContentEncodingStore:
+		if !strings.HasPrefix(link, "http://") && !strings.HasPrefix(link, "https://") {
+			return errors.New("tuning.content_encoding is only supported for http and https links")
+		}
+	default:
+		return fmt.Errorf("tuning.content_encoding must be one of %s, %s, %s", repository.ContentEncodingIdentity, repository.ContentEncodingDecompress, repository.ContentEncodingStore)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// GetUsers lists the users whose username contains the "query" parameter, a page at a time.
+func (h *handler) GetUsers(c fiber.Ctx) error {
+	page, err := strconv.ParseInt(c.Query("page"), 10, 64)
+	if err != nil || page < 0 {
+		page = 0
+	}
+	limit, err := strconv.ParseInt(c.Query("limit"), 10, 64)
+	if err != nil || limit <= 0 {
+		limit = DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+
+	users, err := h.repo.SearchUsers(c.Context(), c.Query("query"), page, limit)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"users": users})
+}
+
+// GetUser returns a user with the resources it uses: stored bytes against the quota and its
+// downloads by status.
+func (h *handler) GetUser(c fiber.Ctx) error {
+	userID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid user id"})
+	}
+
+	user, found, err := h.repo.GetUser(c.Context(), userID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "user not found"})
+	}
+
+	downloads, err := h.repo.GetUserDownloadCounts(c.Context(), userID)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"user":        user,
+		"quota_bytes": h.cfg.UserQuotaBytes,
+		"downloads":   downloads,
+	})
+}
+
+// DisableUser disables an account. Its tokens stop working at once and it cannot log in
+// until it is enabled again; its downloads are left alone.
+func (h *handler) DisableUser(c fiber.Ctx) error {
+	return h.setUserDisabled(c, true)
+}
+
+func (h *handler) EnableUser(c fiber.Ctx) error {
+	return h.setUserDisabled(c, false)
+}
+
+func (h *handler) setUserDisabled(c fiber.Ctx, disabled bool) error {
+	userID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid user id"})
+	}
+	if disabled && userID == c.Locals("userID").(int64) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot disable your own account"})
+	}
+
+	found, err := h.repo.SetUserDisabled(c.Context(), userID, disabled)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "user not found"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "done"})
+}
+
+// RequirePasswordReset revokes the tokens of a user and refuses its password until it sets a
+// new one with the returned token, which the admin hands over out of band.
+func (h *handler) RequirePasswordReset(c fiber.Ctx) error {
+	userID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid user id"})
+	}
+
+	found, err := h.repo.RequirePasswordReset(c.Context(), userID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "user not found"})
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(b)
+	if err := h.repo.SavePasswordResetToken(c.Context(), hashToken(token), userID, h.cfg.PasswordResetTTL); err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"reset_token": token,
+		"expires_at":  time.Now().Add(h.cfg.PasswordResetTTL),
+	})
+}
+
+// SetUserRetention overrides how long the finished downloads of a user are kept, 0 keeps
+// them forever and null falls back to the retention of their plan.
+func (h *handler) SetUserRetention(c fiber.Ctx) error {
+	userID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid user id"})
+	}
+
+	var payload struct {
+		RetentionSeconds *int64 `json:"retention_seconds" validate:"omitempty,gte=0,lte=9223372036"` // math.MaxInt64 / time.Second
+	}
+	if !bindBody(c, &payload) {
+		return nil
+	}
+	var retention *time.Duration
+	if payload.RetentionSeconds != nil {
+		r := time.Duration(*payload.RetentionSeconds) * time.Second
+		retention = &r
+	}
+
+	found, err := h.repo.SetUserRetention(c.Context(), userID, retention)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "user not found"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "done"})
+}
+
+// ResetPassword sets a new password with a reset token, which can be used once. Tokens issued
+// before are revoked.
+func (h *handler) ResetPassword(c fiber.Ctx) error {
+	var payload struct {
+		Token    string `json:"token" validate:"required"`
+		Password string `json:"password" validate:"required,min=8"`
+	}
+	// Validated before the token is taken, so a too short password does not use it up.
+	if !bindBody(c, &payload) {
+		return nil
+	}
+
+	hashedPassword, err := hashPassword(payload.Password)
+	if err != nil {
+		return err
+	}
+
+	userID, found, err := h.repo.TakePasswordResetToken(c.Context(), hashToken(payload.Token))
+	if err != nil {
+		return err
+	}
+	if !found {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid or expired reset token"})
+	}
+
+	if err := h.repo.ResetPassword(c.Context(), userID, hashedPassword); err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "done"})
+}
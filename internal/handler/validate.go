@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v3"
+)
+
+// embeddedField names the embedded structs, flattened in JSON, in the paths of the validator.
+const embeddedField = "~"
+
+// validate checks the `validate` tags of the request bodies. Fields are named by their json
+// name.
+var validate = newValidator()
+
+func newValidator() *validator.Validate {
+	v := validator.New(validator.WithRequiredStructEnabled())
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		if field.Anonymous {
+			return embeddedField
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		return name
+	})
+	return v
+}
+
+// FieldError is why a field of a request body is invalid. Bodies failing validation are
+// answered with 400 and {"error": <the messages joined>, "errors": [<FieldError>...]}.
+type FieldError struct {
+	Field   string `json:"field"` // json path, e.g. "downloads[2].link"
+	Message string `json:"message"`
+}
+
+// bindBody parses the JSON request body into payload and checks its validate tags. It answers
+// 400 and returns false if the body cannot be parsed or is invalid.
+func bindBody(c fiber.Ctx, payload any) bool {
+	if err := json.Unmarshal(c.Body(), payload); err != nil {
+		c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "could not parse request body"})
+		return false
+	}
+
+	err := validate.Struct(payload)
+	if err == nil {
+		return true
+	}
+	validationErrors, ok := err.(validator.ValidationErrors)
+	if !ok {
+		panic(err) // not a struct, or a tag that does not exist
+	}
+	// The namespaces of the fields start with the name of the struct, unless it is anonymous.
+	named := reflect.Indirect(reflect.ValueOf(payload)).Type().Name() != ""
+	var fieldErrors []FieldError
+	for _, fieldError := range validationErrors {
+		fieldErrors = append(fieldErrors, newFieldError(fieldError, named))
+	}
+	invalidFields(c, fieldErrors...)
+	return false
+}
+
+// invalidFields answers 400 with the fields of the body that are invalid.
+func invalidFields(c fiber.Ctx, fieldErrors ...FieldError) error {
+	messages := make([]string, len(fieldErrors))
+	for i, fieldError := range fieldErrors {
+		messages[i] = fieldError.Message
+	}
+	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": strings.Join(messages, "; "), "errors": fieldErrors})
+}
+
+func newFieldError(err validator.FieldError, named bool) FieldError {
+	names := strings.Split(err.Namespace(), ".")
+	if named {
+		names = names[1:]
+	}
+	var path []string
+	for _, name := range names {
+		if !strings.HasPrefix(name, embeddedField) {
+			path = append(path, name)
+		}
+	}
+	field := strings.Join(path, ".")
+
+	var message string
+	switch err.Tag() {
+	case "required":
+		message = "is required"
+	case "oneof":
+		message = "must be one of " + strings.ReplaceAll(err.Param(), " ", ", ")
+	case "email":
+		message = "must be an email address"
+	case "min", "gte":
+		message = "must be at least " + err.Param()
+	case "max", "lte":
+		message = "must be at most " + err.Param()
+	default:
+		message = "is invalid"
+	}
+	switch err.Kind() {
+	case reflect.String:
+		switch err.Tag() {
+		case "min":
+			message = fmt.Sprintf("must be at least %s characters long", err.Param())
+		case "max":
+			message = fmt.Sprintf("must be at most %s characters long", err.Param())
+		}
+	case reflect.Slice, reflect.Map:
+		switch err.Tag() {
+		case "min":
+			message = fmt.Sprintf("must have at least %s items", err.Param())
+			if err.Param() == "1" {
+				message = "must not be empty"
+			}
+		case "max":
+			message = fmt.Sprintf("must have at most %s items", err.Param())
+		}
+	}
+
+	return FieldError{Field: field, Message: field + " " + message}
+}
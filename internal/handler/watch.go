@@ -0,0 +1,163 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// WatchProcessedDir is where the files of a watched folder go once their links are enqueued.
+const WatchProcessedDir = "processed"
+const MaxWatchFileBytes = 1 << 20 // 1MB
+
+// WatchFolder scans WATCH_DIR every WATCH_INTERVAL until ctx is done and enqueues the links
+// of the .txt files (one link per line, # for comments) and .url files (Internet shortcuts)
+// dropped there: the ones directly in WATCH_DIR for WATCH_USER, the ones in a folder named
+// after a user for that user. A file is taken once it has not changed for an interval, by
+// moving it to the processed folder next to it, so that processes sharing the directory
+// do not take it twice.
+func (h *handler) WatchFolder(ctx context.Context) {
+	ticker := time.NewTicker(h.cfg.WatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if h.cfg.WatchUser != "" {
+			h.watchDir(ctx, h.cfg.WatchDir, h.cfg.WatchUser)
+		}
+		entries, err := os.ReadDir(h.cfg.WatchDir)
+		if err != nil {
+			log.Printf("Could not watch %s: %v", h.cfg.WatchDir, err)
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() && entry.Name() != WatchProcessedDir {
+				h.watchDir(ctx, filepath.Join(h.cfg.WatchDir, entry.Name()), entry.Name())
+			}
+		}
+	}
+}
+
+// watchDir enqueues the links of the files of dir for the user.
+func (h *handler) watchDir(ctx context.Context, dir string, username string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("Could not watch %s: %v", dir, err)
+		return
+	}
+
+	var userID int64
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || (ext != ".txt" && ext != ".url") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < h.cfg.WatchInterval {
+			continue // gone, or maybe still being written
+		}
+
+		if userID == 0 {
+			var found bool
+			userID, found, err = h.repo.FindUser(ctx, username)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			if !found {
+				log.Printf("Could not watch %s: no user %s", dir, username)
+				return
+			}
+		}
+
+		fileName, err := claimWatchedFile(dir, entry.Name())
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) { // otherwise taken by another process
+				log.Println(err)
+			}
+			continue
+		}
+		h.enqueueWatchedFile(ctx, userID, fileName, ext)
+	}
+}
+
+// claimWatchedFile moves the file to the processed folder and returns its new name.
+func claimWatchedFile(dir string, name string) (string, error) {
+	processed := filepath.Join(dir, WatchProcessedDir)
+	if err := os.MkdirAll(processed, 0755); err != nil {
+		return "", err
+	}
+
+	fileName := filepath.Join(processed, fmt.Sprintf("%s-%s", time.Now().UTC().Format("20060102T150405"), name))
+	if err := os.Rename(filepath.Join(dir, name), fileName); err != nil {
+		return "", err
+	}
+	return fileName, nil
+}
+
+func (h *handler) enqueueWatchedFile(ctx context.Context, userID int64, fileName string, ext string) {
+	links, err := readWatchedFile(fileName, ext)
+	if err != nil {
+		log.Printf("Could not read %s: %v", fileName, err)
+		return
+	}
+
+	enqueued := 0
+	for _, link := range links {
+		download, err := h.prepareDownload(ctx, userID, link, downloadOptions{})
+		if err == nil {
+			_, _, _, err = h.createDownload(ctx, download)
+		}
+		if err != nil {
+			log.Printf("Could not enqueue %s of %s: %v", link, fileName, err)
+			continue
+		}
+		enqueued++
+	}
+	log.Printf("Enqueued %d of the %d links of %s for user %d\n", enqueued, len(links), fileName, userID)
+}
+
+// readWatchedFile returns the links of a .txt file, or the URL of a .url file.
+func readWatchedFile(fileName string, ext string) ([]string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var links []string
+	scanner := bufio.NewScanner(io.LimitReader(file, MaxWatchFileBytes))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if ext == ".url" {
+			// [InternetShortcut]
+			// URL=https://example.com/file.zip
+			if key, value, ok := strings.Cut(line, "="); ok && strings.EqualFold(strings.TrimSpace(key), "URL") {
+				return []string{strings.TrimSpace(value)}, nil
+			}
+			continue
+		}
+		if line != "" && !strings.HasPrefix(line, "#") {
+			links = append(links, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if ext == ".url" {
+		return nil, errors.New("no URL in the shortcut")
+	}
+	return links, nil
+}
@@ -0,0 +1,17 @@
+package httpclient
+
+import "context"
+
+type congestionKey struct{}
+
+// WithCongestion asks for the connections dialed for the requests of ctx to use the TCP
+// congestion control algorithm, e.g. "bbr". It is ignored where it cannot be set.
+func WithCongestion(ctx context.Context, algorithm string) context.Context {
+	return context.WithValue(ctx, congestionKey{}, algorithm)
+}
+
+// Congestion returns the congestion control algorithm requested by WithCongestion, empty if none.
+func Congestion(ctx context.Context) string {
+	algorithm, _ := ctx.Value(congestionKey{}).(string)
+	return algorithm
+}
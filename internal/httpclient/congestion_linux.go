@@ -0,0 +1,27 @@
+//go:build linux
+
+package httpclient
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// CongestionSupported tells whether the congestion control of connections can be set.
+const CongestionSupported = true
+
+// setCongestion fails if the kernel does not have the algorithm, see
+// /proc/sys/net/ipv4/tcp_available_congestion_control.
+func setCongestion(c syscall.RawConn, algorithm string) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptString(int(fd), syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, algorithm)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not set TCP congestion control %s: %v", algorithm, err)
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package httpclient
+
+import "syscall"
+
+// CongestionSupported tells whether the congestion control of connections can be set.
+const CongestionSupported = false
+
+func setCongestion(c syscall.RawConn, algorithm string) error {
+	return nil
+}
@@ -0,0 +1,110 @@
+package httpclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"syscall"
+	"time"
+
+	"example.com/internal/config"
+	"example.com/internal/urlguard"
+)
+
+// NewDialer returns the dialer for connections to origins, which refuses non-public addresses.
+// It is also used directly by the sources that are not HTTP (FTP, SFTP).
+func NewDialer(cfg *config.Config, guard urlguard.Guard) *net.Dialer {
+	return &net.Dialer{
+		Timeout:   cfg.HTTPDialTimeout,
+		KeepAlive: 30 * time.Second,
+		Control:   guard.Control,
+	}
+}
+
+// New returns the client shared by everything that fetches remote links. Connections
+// are pooled per host, every phase of a request has a timeout, redirects are capped
+// and validated, and connections to non-public addresses are refused.
+//
+// There is deliberately no overall client timeout since downloads can legitimately
+// take hours; callers put a deadline on the request context instead.
+func New(cfg *config.Config, guard urlguard.Guard) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	control := guard.Control
+	if cfg.HTTPProxy != "" {
+		proxyURL, err := ParseProxy(cfg.HTTPProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DOWNLOAD_PROXY: %v", err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+
+		// The proxy usually lives on a private network itself, so it is exempted from the guard.
+		proxyAddrs, err := net.LookupHost(proxyURL.Hostname())
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve proxy %s: %v", proxyURL.Hostname(), err)
+		}
+		control = func(network string, address string, c syscall.RawConn) error {
+			host, _, _ := net.SplitHostPort(address)
+			if slices.Contains(proxyAddrs, host) {
+				return nil
+			}
+			return guard.Control(network, address, c)
+		}
+	}
+
+	// Through a proxy the dialer only ever sees the address of the proxy, so the target of
+	// every request, redirects included, is resolved and checked here. The proxy resolves the
+	// host again itself, which leaves a window for DNS rebinding the dialer otherwise closes.
+	// The proxy of a download (see WithProxy) replaces the one of the client; unlike that one,
+	// it is not exempted from the guard.
+	proxyFor := proxy
+	proxy = func(req *http.Request) (*url.URL, error) {
+		proxyURL, err := proxyFor(req)
+		if override := Proxy(req.Context()); override != nil {
+			proxyURL, err = override, nil
+		}
+		if err != nil || proxyURL == nil {
+			return proxyURL, err
+		}
+		if err := guard.ValidateLink(req.Context(), req.URL.String()); err != nil {
+			return nil, err
+		}
+		return proxyURL, nil
+	}
+
+	dialer := NewDialer(cfg, guard)
+	dialer.Control = nil
+	dialer.ControlContext = func(ctx context.Context, network string, address string, c syscall.RawConn) error {
+		if err := control(network, address, c); err != nil {
+			return err
+		}
+		if algorithm := Congestion(ctx); algorithm != "" && (network == "tcp4" || network == "tcp6") {
+			return setCongestion(c, algorithm)
+		}
+		return nil
+	}
+
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   int(cfg.HTTPMaxIdleConnsPerHost),
+		IdleConnTimeout:       cfg.HTTPIdleConnTimeout,
+		TLSHandshakeTimeout:   cfg.HTTPTLSHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.HTTPResponseHeaderTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if int64(len(via)) >= cfg.HTTPMaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", cfg.HTTPMaxRedirects)
+			}
+			return guard.ValidateURL(req.URL)
+		},
+	}, nil
+}
@@ -0,0 +1,137 @@
+package jwtkeys
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"example.com/internal/config"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// legacyTokenLifetime is how long the tokens issued before iat existed were valid: their
+// time of issue is their expiry less it.
+const legacyTokenLifetime = 72 * time.Hour
+
+type keys struct {
+	kid      string            // of the key signing the new tokens
+	secrets  map[string][]byte // by kid, the signing key and the previous ones
+	issuer   string
+	audience string
+	// Tokens without a kid are verified with legacySecret only, and accepted if they were
+	// issued before legacyBefore.
+	legacySecret []byte
+	legacyBefore time.Time
+	_            struct{}
+}
+
+// Keys signs the tokens with SECRET_KEY and verifies them with the key named by their kid
+// header, SECRET_KEY or one of PREVIOUS_SECRET_KEYS. Rotating the secret is making the old one
+// a previous key: its tokens are accepted until they expire, or it is removed.
+type Keys interface {
+	// Sign signs the claims with the current key, setting their iss and aud.
+	Sign(claims jwt.MapClaims) (string, error)
+	// Parse verifies a token and returns its claims. Its iss and aud must be ours, and its iat
+	// not in the future. Tokens issued before kids existed carry neither: they are verified
+	// with LEGACY_SECRET_KEY and accepted only if issued before LEGACY_TOKENS_ISSUED_BEFORE.
+	Parse(tokenString string) (jwt.MapClaims, error)
+}
+
+// KeyID names a secret in the kid header of its tokens without revealing it.
+func KeyID(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (k *keys) Sign(claims jwt.MapClaims) (string, error) {
+	claims["iss"] = k.issuer
+	claims["aud"] = k.audience
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = k.kid
+	return token.SignedString(k.secrets[k.kid])
+}
+
+func (k *keys) Parse(tokenString string) (jwt.MapClaims, error) {
+	var kid string
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		kid, _ = token.Header["kid"].(string)
+		if kid == "" {
+			if k.legacyBefore.IsZero() {
+				return nil, errors.New("missing kid")
+			}
+			return k.legacySecret, nil
+		}
+		secret, ok := k.secrets[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown kid %q", kid)
+		}
+		return secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithIssuedAt(), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, ErrInvalidToken
+	}
+	if kid == "" {
+		if !k.issuedBeforeKids(claims) {
+			return nil, fmt.Errorf("%w: missing kid", ErrInvalidToken)
+		}
+		return claims, nil
+	}
+	if issuer, _ := claims.GetIssuer(); issuer != k.issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer", ErrInvalidToken)
+	}
+	if audience, _ := claims.GetAudience(); !slices.Contains(audience, k.audience) {
+		return nil, fmt.Errorf("%w: unexpected audience", ErrInvalidToken)
+	}
+	return claims, nil
+}
+
+// issuedBeforeKids reports whether the token of claims, without a kid, was issued before
+// legacyBefore. The oldest tokens carry no iat: their expiry tells when they were issued.
+func (k *keys) issuedBeforeKids(claims jwt.MapClaims) bool {
+	issuedAt, err := claims.GetIssuedAt()
+	if err != nil {
+		return false
+	}
+	if issuedAt == nil {
+		expiresAt, err := claims.GetExpirationTime()
+		if err != nil || expiresAt == nil {
+			return false
+		}
+		return expiresAt.Add(-legacyTokenLifetime).Before(k.legacyBefore)
+	}
+	return issuedAt.Before(k.legacyBefore)
+}
+
+// New returns the keys signing with secret and verifying with it and cfg.PreviousSecretKeys,
+// and the tokens without a kid with cfg.LegacySecretKey, or secret.
+func New(secret string, cfg *config.Config) (Keys, error) {
+	if slices.Contains(cfg.PreviousSecretKeys, secret) {
+		return nil, fmt.Errorf("the secret key is among the previous ones")
+	}
+
+	k := &keys{
+		kid:          KeyID(secret),
+		secrets:      map[string][]byte{KeyID(secret): []byte(secret)},
+		issuer:       cfg.JWTIssuer,
+		audience:     cfg.JWTAudience,
+		legacySecret: []byte(secret),
+		legacyBefore: cfg.LegacyTokensIssuedBefore,
+	}
+	if cfg.LegacySecretKey != "" {
+		k.legacySecret = []byte(cfg.LegacySecretKey)
+	}
+	for _, previous := range cfg.PreviousSecretKeys {
+		k.secrets[KeyID(previous)] = []byte(previous)
+	}
+	return k, nil
+}
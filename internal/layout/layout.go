@@ -0,0 +1,103 @@
+// Package layout names the files of the downloads after DOWNLOAD_PATH_TEMPLATE, a path with
+// placeholders such as {user_id}/{yyyy}/{mm}/{filename}. Every element of a rendered path is
+// sanitized by safepath.Name, so the values filled in can neither add elements nor escape the
+// download directory.
+package layout
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"example.com/internal/safepath"
+)
+
+// DefaultTemplate names the files after a hash of their link, all in the download directory.
+const DefaultTemplate = "{hash}"
+
+// Placeholders are the values a template can hold.
+var Placeholders = []string{"{user_id}", "{host}", "{yyyy}", "{mm}", "{dd}", "{filename}", "{hash}"}
+
+// Fields are what the placeholders of a template are filled with.
+type Fields struct {
+	UserID int64
+	Link   string
+	Hash   string    // unique to the user, the link and the range of the download
+	Time   time.Time // when the download was requested
+}
+
+// Check reports the templates that are empty, absolute, have empty, "." or ".." elements, or
+// have unknown placeholders.
+func Check(template string) error {
+	if template == "" {
+		return errors.New("must not be empty")
+	}
+	if strings.HasPrefix(template, "/") || strings.HasPrefix(template, `\`) || filepath.VolumeName(template) != "" {
+		return errors.New("must be relative to the download directory")
+	}
+	for _, elem := range strings.Split(template, "/") {
+		if elem == "" || elem == "." || elem == ".." || strings.Contains(elem, `\`) {
+			return fmt.Errorf("invalid element %q", elem)
+		}
+	}
+
+	rest := template
+	for _, placeholder := range Placeholders {
+		rest = strings.ReplaceAll(rest, placeholder, "")
+	}
+	if strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("unknown placeholder, must be one of %s", strings.Join(Placeholders, ", "))
+	}
+	return nil
+}
+
+// Render returns the path of the file of a download, relative to the download directory. The
+// template must have passed Check.
+func Render(template string, fields Fields) string {
+	host, name := "", ""
+	if u, err := url.Parse(fields.Link); err == nil {
+		host = u.Hostname()
+		if base := path.Base(u.Path); base != "." && base != ".." && base != "/" {
+			name = base
+		}
+	}
+	if name == "" {
+		name = fields.Hash
+	}
+	t := fields.Time.UTC()
+	replacer := strings.NewReplacer(
+		"{user_id}", fmt.Sprint(fields.UserID),
+		"{host}", safepath.Name(host),
+		"{yyyy}", fmt.Sprintf("%04d", t.Year()),
+		"{mm}", fmt.Sprintf("%02d", t.Month()),
+		"{dd}", fmt.Sprintf("%02d", t.Day()),
+		"{filename}", safepath.Name(name),
+		"{hash}", fields.Hash,
+	)
+
+	elems := strings.Split(template, "/")
+	for i, elem := range elems {
+		elems[i] = safepath.Name(replacer.Replace(elem))
+	}
+	return filepath.Join(elems...)
+}
+
+// Unique reports whether the paths rendered from the template differ for every download.
+func Unique(template string) bool {
+	return strings.Contains(template, "{hash}")
+}
+
+// WithHash returns the path with the hash added to the name of its file, before its extension,
+// for the downloads whose rendered path is taken.
+func WithHash(name string, hash string) string {
+	base := filepath.Base(name)
+	ext := filepath.Ext(base)
+	if ext == base {
+		ext = ""
+	}
+	return filepath.Join(filepath.Dir(name), safepath.Name(strings.TrimSuffix(base, ext)+"-"+hash+ext))
+}
@@ -0,0 +1,141 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"example.com/internal/config"
+)
+
+// SendTimeout bounds the delivery of a message to the SMTP server when ctx has no deadline.
+const SendTimeout = 30 * time.Second
+
+var ErrDisabled = errors.New("email is not configured")
+
+// Sender sends the emails of the account flows, e.g. email verification and password reset.
+type Sender interface {
+	// Send sends a plain text message to the address.
+	Send(ctx context.Context, to string, subject string, body string) error
+}
+
+// disabled is the Sender without SMTP_ADDR.
+type disabled struct {
+	_ struct{}
+}
+
+func (*disabled) Send(ctx context.Context, to string, subject string, body string) error {
+	return ErrDisabled
+}
+
+type smtpSender struct {
+	addr     string
+	host     string
+	from     *mail.Address
+	username string
+	password string
+	_        struct{}
+}
+
+// Send delivers the message over TLS on port 465, and upgrades the connection with STARTTLS on
+// the other ports when the server offers it. net/smtp refuses to send the credentials over a
+// connection that is not encrypted, except to localhost.
+func (s *smtpSender) Send(ctx context.Context, to string, subject string, body string) error {
+	if _, err := mail.ParseAddress(to); err != nil {
+		return fmt.Errorf("invalid recipient %s: %v", to, err)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("could not connect to smtp server %s: %v", s.addr, err)
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(SendTimeout)
+	}
+	conn.SetDeadline(deadline)
+	if _, port, _ := net.SplitHostPort(s.addr); port == "465" {
+		conn = tls.Client(conn, &tls.Config{ServerName: s.host})
+	}
+
+	client, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("could not connect to smtp server %s: %v", s.addr, err)
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: s.host}); err != nil {
+			return fmt.Errorf("could not start tls with smtp server %s: %v", s.addr, err)
+		}
+	}
+	if s.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.username, s.password, s.host)); err != nil {
+			return fmt.Errorf("could not authenticate to smtp server %s: %v", s.addr, err)
+		}
+	}
+	if err := client.Mail(s.from.Address); err != nil {
+		return fmt.Errorf("could not send mail to %s: %v", to, err)
+	}
+	if err := client.Rcpt(to); err != nil {
+		return fmt.Errorf("could not send mail to %s: %v", to, err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("could not send mail to %s: %v", to, err)
+	}
+	if _, err := w.Write(message(s.from.String(), to, subject, body)); err != nil {
+		return fmt.Errorf("could not send mail to %s: %v", to, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("could not send mail to %s: %v", to, err)
+	}
+
+	return client.Quit()
+}
+
+// message formats a plain text message with CRLF line endings.
+func message(from string, to string, subject string, body string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// New returns the Sender over SMTP_ADDR, or one that returns ErrDisabled without it.
+func New(cfg *config.Config) (Sender, error) {
+	if cfg.SMTPAddr == "" {
+		return &disabled{}, nil
+	}
+
+	host, _, err := net.SplitHostPort(cfg.SMTPAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid smtp address %s: %v", cfg.SMTPAddr, err)
+	}
+	from, err := mail.ParseAddress(cfg.MailFrom)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mail from address %s: %v", cfg.MailFrom, err)
+	}
+	return &smtpSender{
+		addr:     cfg.SMTPAddr,
+		host:     host,
+		from:     from,
+		username: cfg.SMTPUsername,
+		password: cfg.SMTPPassword,
+	}, nil
+}
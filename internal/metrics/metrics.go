@@ -0,0 +1,144 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+const (
+	KindCounter = "counter"
+	KindGauge   = "gauge"
+)
+
+type Labels map[string]string
+
+type Sample struct {
+	Name   string
+	Kind   string
+	Labels Labels
+	Value  float64
+}
+
+type metric struct {
+	name   string
+	kind   string
+	help   string
+	values map[string]*Sample // keyed by the rendered labels
+}
+
+type registry struct {
+	mu      sync.Mutex
+	metrics map[string]*metric
+	_       struct{}
+}
+
+var defaultRegistry = &registry{metrics: make(map[string]*metric)}
+
+// Register declares a metric so it is exported with its type and help text, even before it has values.
+func Register(name string, kind string, help string) {
+	defaultRegistry.mu.Lock()
+	defer defaultRegistry.mu.Unlock()
+
+	if _, ok := defaultRegistry.metrics[name]; !ok {
+		defaultRegistry.metrics[name] = &metric{name: name, kind: kind, help: help, values: make(map[string]*Sample)}
+	}
+}
+
+// Add increments a counter (or gauge) by v.
+func Add(name string, labels Labels, v float64) {
+	defaultRegistry.update(name, labels, func(s *Sample) { s.Value += v })
+}
+
+// Set sets a gauge to v.
+func Set(name string, labels Labels, v float64) {
+	defaultRegistry.update(name, labels, func(s *Sample) { s.Value = v })
+}
+
+func (r *registry) update(name string, labels Labels, fn func(s *Sample)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m, ok := r.metrics[name]
+	if !ok {
+		m = &metric{name: name, kind: KindGauge, values: make(map[string]*Sample)}
+		r.metrics[name] = m
+	}
+
+	key := renderLabels(labels)
+	s, ok := m.values[key]
+	if !ok {
+		s = &Sample{Name: name, Kind: m.kind, Labels: labels}
+		m.values[key] = s
+	}
+	fn(s)
+}
+
+// Snapshot returns a copy of all current samples.
+func Snapshot() []Sample {
+	defaultRegistry.mu.Lock()
+	defer defaultRegistry.mu.Unlock()
+
+	var samples []Sample
+	for _, m := range defaultRegistry.metrics {
+		for _, s := range m.values {
+			samples = append(samples, *s)
+		}
+	}
+	return samples
+}
+
+// Handler serves all metrics in the Prometheus text exposition format.
+func Handler(c fiber.Ctx) error {
+	defaultRegistry.mu.Lock()
+	defer defaultRegistry.mu.Unlock()
+
+	names := make([]string, 0, len(defaultRegistry.metrics))
+	for name := range defaultRegistry.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		m := defaultRegistry.metrics[name]
+		if m.help != "" {
+			fmt.Fprintf(&b, "# HELP %s %s\n", m.name, m.help)
+		}
+		fmt.Fprintf(&b, "# TYPE %s %s\n", m.name, m.kind)
+
+		keys := make([]string, 0, len(m.values))
+		for key := range m.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(&b, "%s%s %v\n", m.name, key, m.values[key].Value)
+		}
+	}
+
+	c.Set(fiber.HeaderContentType, "text/plain; version=0.0.4")
+	return c.SendString(b.String())
+}
+
+func renderLabels(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[key])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, key, value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
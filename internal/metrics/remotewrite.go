@@ -0,0 +1,124 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/klauspost/compress/s2"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// RemoteWrite is the endpoint the metrics are pushed to with the Prometheus remote-write
+// protocol, and its credentials: basic auth if Username is set, a bearer token if
+// BearerToken is.
+type RemoteWrite struct {
+	URL         string
+	Username    string
+	Password    string
+	BearerToken string
+}
+
+// PushRemoteWrite sends all metrics of the registry to a Prometheus remote-write endpoint
+// (Prometheus, Mimir, VictoriaMetrics, ...) every interval, for deployments that cannot scrape
+// /metrics. Every push is a snappy compressed prompb.WriteRequest holding a sample per series,
+// stamped with the time of the push, so counters keep their cumulative values. A failed push
+// is logged and not retried, the next one carries the current values. It blocks until ctx is
+// done.
+func PushRemoteWrite(ctx context.Context, rw RemoteWrite, interval time.Duration) error {
+	client := &http.Client{Timeout: interval}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			if err := rw.push(ctx, client, encodeWriteRequest(Snapshot(), now)); err != nil {
+				log.Printf("could not push metrics to %s: %v", rw.URL, err)
+			}
+		}
+	}
+}
+
+func (rw RemoteWrite) push(ctx context.Context, client *http.Client, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rw.URL, bytes.NewReader(s2.EncodeSnappy(nil, body)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	switch {
+	case rw.Username != "":
+		req.SetBasicAuth(rw.Username, rw.Password)
+	case rw.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+rw.BearerToken)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// encodeWriteRequest encodes the samples as a prompb.WriteRequest:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+//
+// The labels of a series are sorted by name, __name__ included, as receivers require.
+func encodeWriteRequest(samples []Sample, now time.Time) []byte {
+	timestamp := now.UnixMilli()
+
+	var req, series, field []byte
+	for _, s := range samples {
+		names := make([]string, 0, len(s.Labels)+1)
+		names = append(names, "__name__")
+		for name := range s.Labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		series = series[:0]
+		for _, name := range names {
+			value := s.Labels[name]
+			if name == "__name__" {
+				value = s.Name
+			}
+			field = protowire.AppendTag(field[:0], 1, protowire.BytesType)
+			field = protowire.AppendString(field, name)
+			field = protowire.AppendTag(field, 2, protowire.BytesType)
+			field = protowire.AppendString(field, value)
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, field)
+		}
+		field = protowire.AppendTag(field[:0], 1, protowire.Fixed64Type)
+		field = protowire.AppendFixed64(field, math.Float64bits(s.Value))
+		field = protowire.AppendTag(field, 2, protowire.VarintType)
+		field = protowire.AppendVarint(field, uint64(timestamp))
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, field)
+
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, series)
+	}
+	return req
+}
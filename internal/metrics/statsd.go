@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxPacketBytes keeps StatsD datagrams below the usual network MTU.
+const maxPacketBytes = 1432
+
+// PushStatsD sends all metrics of the registry to a StatsD server over UDP every interval,
+// for deployments that cannot scrape /metrics. Gauges are sent as they are and counters as
+// the increment since the previous push. Labels are appended to the name, e.g.
+// downloader_downloads{state="failed"} becomes <prefix>downloader_downloads.state_failed.
+// It blocks until ctx is done.
+func PushStatsD(ctx context.Context, addr string, prefix string, interval time.Duration) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return fmt.Errorf("could not connect to statsd %s: %v", addr, err)
+	}
+	defer conn.Close()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	sent := make(map[string]float64) // counter values of the previous push
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		var lines []string
+		for _, s := range Snapshot() {
+			name := prefix + statsdName(s)
+			switch s.Kind {
+			case KindCounter:
+				delta := s.Value - sent[name]
+				sent[name] = s.Value
+				if delta > 0 {
+					lines = append(lines, fmt.Sprintf("%s:%v|c", name, delta))
+				}
+			default:
+				lines = append(lines, fmt.Sprintf("%s:%v|g", name, s.Value))
+			}
+		}
+
+		for _, packet := range packLines(lines) {
+			if _, err := conn.Write([]byte(packet)); err != nil {
+				log.Printf("could not push metrics to statsd %s: %v", addr, err)
+				break
+			}
+		}
+	}
+}
+
+func statsdName(s Sample) string {
+	keys := make([]string, 0, len(s.Labels))
+	for key := range s.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	clean := strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_", "#", "_", " ", "_", "/", "_")
+	name := s.Name
+	for _, key := range keys {
+		name += "." + key + "_" + clean.Replace(s.Labels[key])
+	}
+	return name
+}
+
+// packLines joins lines into newline separated datagrams of at most maxPacketBytes.
+func packLines(lines []string) []string {
+	var packets []string
+	var b strings.Builder
+	for _, line := range lines {
+		if b.Len() > 0 && b.Len()+1+len(line) > maxPacketBytes {
+			packets = append(packets, b.String())
+			b.Reset()
+		}
+		if b.Len() > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(line)
+	}
+	if b.Len() > 0 {
+		packets = append(packets, b.String())
+	}
+	return packets
+}
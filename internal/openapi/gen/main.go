@@ -0,0 +1,421 @@
+// Command gen generates the Go client of the REST API (pkg/apiclient) from its OpenAPI
+// document. It supports the subset of OpenAPI 3 the document uses: object schemas with
+// $refs, path and query parameters, JSON request bodies and JSON responses. Operations
+// without a JSON response (streams, files) are left out.
+//
+//	go generate ./internal/openapi
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"strings"
+)
+
+// ordered is a JSON object decoded in document order, so the output is stable.
+type ordered[T any] []entry[T]
+
+type entry[T any] struct {
+	Key   string
+	Value T
+}
+
+func (o *ordered[T]) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		var value T
+		if err := dec.Decode(&value); err != nil {
+			return err
+		}
+		*o = append(*o, entry[T]{Key: key.(string), Value: value})
+	}
+	return nil
+}
+
+type schema struct {
+	Ref                  string            `json:"$ref"`
+	Type                 string            `json:"type"`
+	Format               string            `json:"format"`
+	Description          string            `json:"description"`
+	Nullable             bool              `json:"nullable"`
+	Properties           ordered[*schema]  `json:"properties"`
+	Required             []string          `json:"required"`
+	Items                *schema           `json:"items"`
+	AdditionalProperties *schema           `json:"additionalProperties"`
+	Enum                 []json.RawMessage `json:"enum"`
+}
+
+type parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Required    bool    `json:"required"`
+	Description string  `json:"description"`
+	Schema      *schema `json:"schema"`
+}
+
+type operation struct {
+	OperationID string      `json:"operationId"`
+	Summary     string      `json:"summary"`
+	Parameters  []parameter `json:"parameters"`
+	RequestBody *struct {
+		Content ordered[struct {
+			Schema *schema `json:"schema"`
+		}] `json:"content"`
+	} `json:"requestBody"`
+	Responses ordered[struct {
+		Description string `json:"description"`
+		Content     ordered[struct {
+			Schema *schema `json:"schema"`
+		}] `json:"content"`
+	}] `json:"responses"`
+}
+
+type document struct {
+	Paths      ordered[ordered[operation]] `json:"paths"`
+	Components struct {
+		Schemas ordered[*schema] `json:"schemas"`
+	} `json:"components"`
+}
+
+func main() {
+	specFile := flag.String("spec", "openapi.json", "OpenAPI document")
+	outFile := flag.String("out", "apiclient.gen.go", "generated Go file")
+	flag.Parse()
+
+	data, err := os.ReadFile(*specFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var doc document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		log.Fatalf("invalid OpenAPI document: %v", err)
+	}
+
+	var g generator
+	g.generate(&doc)
+
+	src, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		os.Stderr.Write(g.buf.Bytes())
+		log.Fatalf("invalid generated code: %v", err)
+	}
+	if err := os.WriteFile(*outFile, src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+type generator struct {
+	buf     bytes.Buffer
+	methods bytes.Buffer // of the Client interface
+	funcs   bytes.Buffer
+	_       struct{}
+}
+
+func (g *generator) printf(format string, args ...any) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+func (g *generator) generate(doc *document) {
+	g.printf("// Code generated by internal/openapi/gen from internal/openapi/openapi.json. DO NOT EDIT.\n\n")
+	g.printf("// Package apiclient is a client of every operation of the REST API with a JSON response,\n")
+	g.printf("// generated from its OpenAPI document. See pkg/client for a client with retries and progress streams.\n")
+	g.printf("package apiclient\n\n")
+	g.printf("import (\n\t\"bytes\"\n\t\"context\"\n\t\"encoding/json\"\n\t\"fmt\"\n\t\"net/http\"\n\t\"net/url\"\n\t\"strconv\"\n\t\"time\"\n)\n\n")
+
+	for _, s := range doc.Components.Schemas {
+		g.schemaType(s.Key, s.Value)
+	}
+
+	var skipped []string
+	for _, path := range doc.Paths {
+		for _, op := range path.Value {
+			if !g.operation(path.Key, strings.ToUpper(op.Key), &op.Value) {
+				skipped = append(skipped, op.Value.OperationID)
+			}
+		}
+	}
+
+	g.printf("// Client calls the REST API. Operations without a JSON response are not generated: %s.\n", strings.Join(skipped, ", "))
+	g.printf("type Client interface {\n%s}\n\n", g.methods.String())
+	g.buf.Write(g.funcs.Bytes())
+	g.buf.WriteString(runtime)
+}
+
+func (g *generator) schemaType(name string, s *schema) {
+	if s.Description != "" {
+		g.printf("// %s: %s\n", name, s.Description)
+	}
+	if s.Type != "object" || len(s.Properties) == 0 {
+		g.printf("type %s %s\n\n", name, goType(s, true))
+		return
+	}
+
+	g.printf("type %s struct {\n", name)
+	for _, p := range s.Properties {
+		required := contains(s.Required, p.Key)
+		tag := p.Key
+		if !required {
+			tag += ",omitempty"
+		}
+		g.printf("\t%s %s `json:%q`", fieldName(p.Key), goType(p.Value, required), tag)
+		if p.Value.Description != "" {
+			g.printf(" // %s", p.Value.Description)
+		}
+		g.printf("\n")
+	}
+	g.printf("}\n\n")
+}
+
+// operation generates the method of an operation, it reports false if it has no JSON response.
+func (g *generator) operation(path string, method string, op *operation) bool {
+	var result *schema
+	for _, resp := range op.Responses {
+		if !strings.HasPrefix(resp.Key, "2") {
+			continue
+		}
+		for _, c := range resp.Value.Content {
+			if c.Key == "application/json" {
+				result = c.Value.Schema
+			}
+		}
+		break
+	}
+	if result == nil {
+		return false
+	}
+
+	name := upperFirst(op.OperationID)
+	args := []string{"ctx context.Context"}
+	pathFormat, pathArgs := path, []string{}
+	var query []parameter
+	for _, p := range op.Parameters {
+		switch p.In {
+		case "path":
+			args = append(args, fmt.Sprintf("%s %s", p.Name, goType(p.Schema, true)))
+			pathFormat = strings.Replace(pathFormat, "{"+p.Name+"}", "%s", 1)
+			pathArgs = append(pathArgs, fmt.Sprintf("url.PathEscape(fmt.Sprint(%s))", p.Name))
+		case "query":
+			query = append(query, p)
+		}
+	}
+	if len(query) > 0 {
+		g.printf("// %sParams are the query parameters of %s.\n", name, name)
+		g.printf("type %sParams struct {\n", name)
+		for _, p := range query {
+			g.printf("\t%s %s", fieldName(p.Name), goType(p.Schema, p.Required))
+			if p.Description != "" {
+				g.printf(" // %s", p.Description)
+			}
+			g.printf("\n")
+		}
+		g.printf("}\n\n")
+		args = append(args, fmt.Sprintf("params %sParams", name))
+	}
+	body := "nil"
+	if op.RequestBody != nil {
+		for _, c := range op.RequestBody.Content {
+			if c.Key == "application/json" {
+				args = append(args, "body "+goType(c.Value.Schema, true))
+				body = "body"
+			}
+		}
+	}
+
+	resultType := goType(result, true)
+	fmt.Fprintf(&g.methods, "\t// %s (%s %s).\n", op.Summary, method, path)
+	fmt.Fprintf(&g.methods, "\t%s(%s) (*%s, error)\n", name, strings.Join(args, ", "), resultType)
+
+	f := &g.funcs
+	fmt.Fprintf(f, "func (c *client) %s(%s) (*%s, error) {\n", name, strings.Join(args, ", "), resultType)
+	fmt.Fprintf(f, "\tquery := url.Values{}\n")
+	for _, p := range query {
+		writeQueryParam(f, p)
+	}
+	if len(pathArgs) > 0 {
+		fmt.Fprintf(f, "\tpath := fmt.Sprintf(%q, %s)\n", pathFormat, strings.Join(pathArgs, ", "))
+	} else {
+		fmt.Fprintf(f, "\tpath := %q\n", path)
+	}
+	fmt.Fprintf(f, "\tvar result %s\n", resultType)
+	fmt.Fprintf(f, "\tif err := c.do(ctx, %q, path, query, %s, &result); err != nil {\n\t\treturn nil, err\n\t}\n", method, body)
+	fmt.Fprintf(f, "\treturn &result, nil\n}\n\n")
+	return true
+}
+
+func writeQueryParam(f *bytes.Buffer, p parameter) {
+	field := "params." + fieldName(p.Name)
+	value := func(v string, s *schema) string {
+		switch {
+		case s.Type == "integer":
+			if s.Format == "int32" {
+				return fmt.Sprintf("strconv.FormatInt(int64(%s), 10)", v)
+			}
+			return fmt.Sprintf("strconv.FormatInt(%s, 10)", v)
+		case s.Type == "boolean":
+			return fmt.Sprintf("strconv.FormatBool(%s)", v)
+		case s.Type == "number":
+			return fmt.Sprintf("strconv.FormatFloat(%s, 'g', -1, 64)", v)
+		case s.Format == "date-time":
+			return fmt.Sprintf("%s.Format(time.RFC3339)", v)
+		}
+		return v
+	}
+
+	switch {
+	case p.Schema.Type == "array":
+		fmt.Fprintf(f, "\tfor _, v := range %s {\n\t\tquery.Add(%q, %s)\n\t}\n", field, p.Name, value("v", p.Schema.Items))
+	case p.Required:
+		fmt.Fprintf(f, "\tquery.Set(%q, %s)\n", p.Name, value(field, p.Schema))
+	case p.Schema.Type == "string" && p.Schema.Format != "date-time":
+		fmt.Fprintf(f, "\tif %s != \"\" {\n\t\tquery.Set(%q, %s)\n\t}\n", field, p.Name, field)
+	case p.Schema.Format == "date-time":
+		fmt.Fprintf(f, "\tif %s != nil {\n\t\tquery.Set(%q, %s)\n\t}\n", field, p.Name, value(field, p.Schema))
+	default:
+		fmt.Fprintf(f, "\tif %s != nil {\n\t\tquery.Set(%q, %s)\n\t}\n", field, p.Name, value("*"+field, p.Schema))
+	}
+}
+
+// goType is the Go type of a schema. Optional and nullable numbers, booleans, times and
+// objects are pointers, so their zero values can be told apart from missing values.
+func goType(s *schema, required bool) string {
+	pointer := ""
+	if !required || s.Nullable {
+		pointer = "*"
+	}
+
+	switch {
+	case s.Ref != "":
+		return pointer + s.Ref[strings.LastIndex(s.Ref, "/")+1:]
+	case s.Type == "string" && s.Format == "date-time":
+		return pointer + "time.Time"
+	case s.Type == "string":
+		return "string"
+	case s.Type == "integer" && s.Format == "int32":
+		return pointer + "int32"
+	case s.Type == "integer":
+		return pointer + "int64"
+	case s.Type == "number":
+		return pointer + "float64"
+	case s.Type == "boolean":
+		return pointer + "bool"
+	case s.Type == "array":
+		return "[]" + goType(s.Items, true)
+	case s.Type == "object" && s.AdditionalProperties != nil && (s.AdditionalProperties.Type != "" || s.AdditionalProperties.Ref != ""):
+		return "map[string]" + goType(s.AdditionalProperties, true)
+	case s.Type == "object":
+		return "map[string]any"
+	}
+	return "any"
+}
+
+var initialisms = map[string]string{"id": "ID", "ids": "IDs", "ip": "IP", "ips": "IPs", "url": "URL", "http": "HTTP", "json": "JSON", "api": "API"}
+
+// fieldName turns a JSON name like allowed_ips into a Go name like AllowedIPs.
+func fieldName(name string) string {
+	var b strings.Builder
+	for _, part := range strings.Split(name, "_") {
+		if initialism, ok := initialisms[part]; ok {
+			b.WriteString(initialism)
+		} else {
+			b.WriteString(upperFirst(part))
+		}
+	}
+	return b.String()
+}
+
+func upperFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+const runtime = `// APIError is a non-2xx response of the API.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("apiclient: %d: %s", e.StatusCode, e.Message)
+}
+
+type client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+	_          struct{}
+}
+
+// New returns a client of the API at baseURL (e.g. "http://127.0.0.1:8080"). token is the
+// token of Login, empty for the operations without authentication. httpClient may be nil.
+func New(baseURL string, token string, httpClient *http.Client) Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &client{baseURL: baseURL, token: token, httpClient: httpClient}
+}
+
+func (c *client) do(ctx context.Context, method string, path string, query url.Values, body any, result any) error {
+	link := c.baseURL + path
+	if len(query) > 0 {
+		link += "?" + query.Encode()
+	}
+
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, link, &reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var apiErr struct {
+			Error string ` + "`json:\"error\"`" + `
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		if apiErr.Error == "" {
+			apiErr.Error = http.StatusText(resp.StatusCode)
+		}
+		return &APIError{StatusCode: resp.StatusCode, Message: apiErr.Error}
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+`
@@ -0,0 +1,105 @@
+package openapi
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+//go:generate go run ./gen -spec openapi.json -out ../../pkg/apiclient/apiclient.gen.go
+
+// Document is the OpenAPI 3 document of the REST API. It is written by hand and checked
+// against the routes of the app on startup (see Check).
+//
+//go:embed openapi.json
+var Document []byte
+
+// Handler serves the OpenAPI document.
+func Handler(c fiber.Ctx) error {
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Status(fiber.StatusOK).Send(Document)
+}
+
+// SwaggerUI serves Swagger UI (loaded from a CDN) for the document at specURL.
+func SwaggerUI(specURL string) fiber.Handler {
+	page := fmt.Sprintf(swaggerUIPage, specURL)
+	return func(c fiber.Ctx) error {
+		c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+		return c.Status(fiber.StatusOK).SendString(page)
+	}
+}
+
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="utf-8">
+	<title>Downloader API</title>
+	<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+	<div id="swagger-ui"></div>
+	<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+	<script>SwaggerUIBundle({url: %q, dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`
+
+var (
+	fiberParam   = regexp.MustCompile(`:[^/]+`)
+	openAPIParam = regexp.MustCompile(`\{[^/}]+\}`)
+)
+
+// Check compares the routes of the app with the operations of the document, ignoring the
+// paths in undocumented (e.g. the document itself), and reports the differences.
+func Check(routes []fiber.Route, undocumented ...string) error {
+	var document struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(Document, &document); err != nil {
+		return fmt.Errorf("invalid OpenAPI document: %v", err)
+	}
+
+	documented := make(map[string]bool)
+	for path, operations := range document.Paths {
+		for method := range operations {
+			documented[strings.ToUpper(method)+" "+openAPIParam.ReplaceAllString(path, "{}")] = true
+		}
+	}
+
+	skip := make(map[string]bool)
+	for _, path := range undocumented {
+		skip[path] = true
+	}
+
+	var missing []string
+	for _, route := range routes {
+		if route.Method == fiber.MethodHead || skip[route.Path] {
+			continue
+		}
+		key := route.Method + " " + fiberParam.ReplaceAllString(route.Path, "{}")
+		if !documented[key] {
+			missing = append(missing, route.Method+" "+route.Path)
+		}
+		delete(documented, key)
+	}
+
+	var stale []string
+	for key := range documented {
+		stale = append(stale, key)
+	}
+	sort.Strings(missing)
+	sort.Strings(stale)
+
+	switch {
+	case len(missing) > 0:
+		return fmt.Errorf("routes missing from the OpenAPI document: %s", strings.Join(missing, ", "))
+	case len(stale) > 0:
+		return fmt.Errorf("operations of the OpenAPI document without a route: %s", strings.Join(stale, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package outbox
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"example.com/internal/repository"
+)
+
+const BatchSize = 100
+const Retention = 24 * time.Hour // sent entries are kept this long for troubleshooting
+const PurgeInterval = 1 * time.Hour
+
+// Relay publishes the outbox entries written along with new download requests to the
+// Redis queue every interval, and marks them sent. An entry is only marked after its push
+// succeeded, so no enqueue is lost; a crash in between pushes it twice, which the workers
+// tolerate. Several processes may relay at the same time for the same reason.
+// Nothing is relayed while the pressure is overloaded. It blocks until ctx is done.
+func Relay(ctx context.Context, repo repository.Repository, interval time.Duration, pressure Pressure) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastPurge := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for !pressure.Overloaded() {
+			n, err := relayOnce(ctx, repo)
+			if err != nil {
+				log.Printf("Could not relay outbox: %v", err)
+				break
+			}
+			if n < BatchSize {
+				break
+			}
+		}
+
+		if time.Since(lastPurge) >= PurgeInterval {
+			if err := repo.PurgeOutbox(ctx, Retention); err != nil {
+				log.Println(err)
+			}
+			lastPurge = time.Now()
+		}
+	}
+}
+
+// relayOnce publishes one batch and returns its size.
+func relayOnce(ctx context.Context, repo repository.Repository) (int, error) {
+	entries, err := repo.GetOutbox(ctx, BatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := make([]int64, 0, len(entries))
+	for _, entry := range entries {
+		if err := repo.PushDownloadRequest(ctx, entry.DownloadID); err != nil {
+			log.Println(err)
+			break // keep the order, retry from here on the next tick
+		}
+		sent = append(sent, entry.ID)
+	}
+
+	if len(sent) > 0 {
+		if err := repo.MarkOutboxSent(ctx, sent); err != nil {
+			return 0, err
+		}
+	}
+	return len(sent), nil
+}
@@ -0,0 +1,124 @@
+package outbox
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"example.com/internal/metrics"
+	"example.com/internal/repository"
+)
+
+func init() {
+	metrics.Register("downloader_queue_overloaded", metrics.KindGauge, "1 while new download requests are refused because Redis or the queue is over its limit.")
+	metrics.Register("downloader_queue_spilled_total", metrics.KindCounter, "Download requests moved from the queue back to the outbox.")
+}
+
+// ResumeRatio is the share of the limits the usage must fall below before pressure subsides,
+// so that enqueues are not switched on and off at every check around a limit.
+const ResumeRatio = 0.9
+
+type pressure struct {
+	repo       repository.Repository
+	maxMemory  int64
+	maxLength  int64
+	overloaded atomic.Bool
+	_          struct{}
+}
+
+// Pressure tells whether Redis uses more than maxMemory bytes or more than maxLength requests
+// wait in the queues and the outbox, a limit of 0 is never exceeded. Once one is, new download
+// requests are refused and the relay leaves the outbox alone until the usage fell below
+// ResumeRatio of the limits. While Redis memory is over its limit, the newest requests no
+// worker read yet are also spilled from the queue to the outbox, which keeps them in Postgres
+// until they are relayed back.
+type Pressure interface {
+	Overloaded() bool
+	// Watch checks the usage every interval until ctx is done.
+	Watch(ctx context.Context, interval time.Duration)
+}
+
+func NewPressure(repo repository.Repository, maxMemory int64, maxLength int64) Pressure {
+	return &pressure{repo: repo, maxMemory: maxMemory, maxLength: maxLength}
+}
+
+func (p *pressure) Overloaded() bool {
+	return p.overloaded.Load()
+}
+
+func (p *pressure) Watch(ctx context.Context, interval time.Duration) {
+	if p.maxMemory <= 0 && p.maxLength <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := p.check(ctx); err != nil {
+			log.Printf("Could not check queue pressure: %v", err)
+		}
+	}
+}
+
+func (p *pressure) check(ctx context.Context) error {
+	var memory, length int64
+	if p.maxMemory > 0 {
+		var err error
+		if memory, err = p.repo.GetRedisMemory(ctx); err != nil {
+			return err
+		}
+	}
+	if p.maxLength > 0 {
+		depth, err := p.repo.QueueDepth(ctx)
+		if err != nil {
+			return err
+		}
+		pending, err := p.repo.GetOutboxLength(ctx)
+		if err != nil {
+			return err
+		}
+		length = depth + pending
+	}
+
+	overMemory := p.maxMemory > 0 && memory > p.maxMemory
+	over := overMemory || p.maxLength > 0 && length > p.maxLength
+	under := below(memory, p.maxMemory) && below(length, p.maxLength)
+	switch {
+	case over && !p.overloaded.Load():
+		log.Printf("Queue overloaded, refusing new download requests: redis memory: %d bytes, queue length: %d\n", memory, length)
+		p.overloaded.Store(true)
+		metrics.Set("downloader_queue_overloaded", nil, 1)
+	case under && p.overloaded.Load():
+		log.Printf("Queue pressure subsided, accepting download requests again: redis memory: %d bytes, queue length: %d\n", memory, length)
+		p.overloaded.Store(false)
+		metrics.Set("downloader_queue_overloaded", nil, 0)
+	}
+
+	// Moving requests to the outbox frees Redis memory but leaves the length as it is, and the
+	// workers keep the older ones to process meanwhile.
+	if !overMemory {
+		return nil
+	}
+	spilled, err := p.repo.SpillDownloadRequests(ctx, BatchSize)
+	if err != nil {
+		return err
+	}
+	if spilled > 0 {
+		log.Printf("Spilled %d download requests from the queue to the outbox\n", spilled)
+		metrics.Add("downloader_queue_spilled_total", nil, float64(spilled))
+	}
+	return nil
+}
+
+// below reports whether usage is under the resume level of limit, always for no limit.
+func below(usage int64, limit int64) bool {
+	return limit <= 0 || float64(usage) < float64(limit)*ResumeRatio
+}
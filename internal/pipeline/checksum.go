@@ -0,0 +1,58 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"example.com/internal/config"
+)
+
+func init() {
+	Register("checksum", func(cfg *config.Config) (Step, error) {
+		return &checksum{}, nil
+	})
+}
+
+// checksum records the SHA-256 of the file, e.g. to compare it with the one the publisher
+// announced.
+type checksum struct {
+	_ struct{}
+}
+
+func (s *checksum) Name() string {
+	return "checksum"
+}
+
+func (s *checksum) Run(ctx context.Context, file File) (Result, error) {
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return Result{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, &contextReader{ctx: ctx, r: f})
+	if err != nil {
+		return Result{}, fmt.Errorf("could not hash the file: %v", err)
+	}
+	return Result{Detail: fmt.Sprintf("sha256:%s (%d bytes)", hex.EncodeToString(h.Sum(nil)), n)}, nil
+}
+
+// contextReader stops reading once ctx is done, so long hashes and uploads honor the timeout
+// of their step.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+	_   struct{}
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,212 @@
+package pipeline
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"example.com/internal/config"
+	"example.com/internal/safepath"
+)
+
+// MaxExtractEntries bounds the files and directories extracted from an archive.
+const MaxExtractEntries = 100000
+
+func init() {
+	Register("extract", func(cfg *config.Config) (Step, error) {
+		if cfg.PipelineExtractMaxBytes <= 0 {
+			return nil, nil
+		}
+		return &extract{maxBytes: cfg.PipelineExtractMaxBytes}, nil
+	})
+}
+
+// extract unpacks zip, tar and gzipped tar archives into a directory next to the file, named
+// after it with an .extracted suffix. Entries escaping the directory and links are skipped.
+type extract struct {
+	maxBytes int64
+	_        struct{}
+}
+
+func (s *extract) Name() string {
+	return "extract"
+}
+
+func (s *extract) Run(ctx context.Context, file File) (Result, error) {
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return Result{}, err
+	}
+	defer f.Close()
+
+	// The files of the downloads have no extension, so archives are told by their content.
+	buffered := bufio.NewReader(f)
+	header, _ := buffered.Peek(512)
+	var next func() (string, bool, io.Reader, error)
+	switch {
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")):
+		info, err := f.Stat()
+		if err != nil {
+			return Result{}, err
+		}
+		archive, err := zip.NewReader(f, info.Size())
+		if err != nil {
+			return Result{}, fmt.Errorf("invalid zip archive: %v", err)
+		}
+		next = zipEntries(archive)
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return Result{}, fmt.Errorf("invalid gzip file: %v", err)
+		}
+		defer gz.Close()
+		unzipped := bufio.NewReader(gz)
+		if !isTar(peek(unzipped)) {
+			return Result{}, ErrNotApplicable
+		}
+		next = tarEntries(tar.NewReader(unzipped))
+	case isTar(header):
+		next = tarEntries(tar.NewReader(buffered))
+	default:
+		return Result{}, ErrNotApplicable
+	}
+
+	dir := file.Path + ".extracted"
+	if err := os.RemoveAll(dir); err != nil { // left by an earlier run
+		return Result{}, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return Result{}, err
+	}
+
+	var files, written int64
+	for entries := 0; ; entries++ {
+		if err := ctx.Err(); err != nil {
+			return Result{Bytes: written}, err
+		}
+		name, isDir, content, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Result{Bytes: written}, fmt.Errorf("invalid archive: %v", err)
+		}
+		if entries >= MaxExtractEntries {
+			return Result{Bytes: written}, fmt.Errorf("the archive has more than %d entries", MaxExtractEntries)
+		}
+		target, ok := extractPath(dir, name)
+		if !ok {
+			continue
+		}
+		if isDir {
+			if err := os.MkdirAll(safepath.Long(target), 0755); err != nil {
+				return Result{Bytes: written}, err
+			}
+			continue
+		}
+		if content == nil { // links and special files
+			continue
+		}
+		n, err := writeEntry(target, content, s.maxBytes-written)
+		written += n
+		if err != nil {
+			return Result{Bytes: written}, err
+		}
+		files++
+	}
+
+	return Result{Detail: fmt.Sprintf("extracted %d files (%d bytes) to %s", files, written, filepath.Base(dir)), Bytes: written}, nil
+}
+
+// extractPath returns where the entry goes in dir, false for the entries escaping it. Names
+// invalid on the OS, e.g. with a colon or of a device on Windows, are sanitized.
+func extractPath(dir string, name string) (string, bool) {
+	return safepath.Join(dir, name)
+}
+
+// writeEntry writes the content of an entry to the target, failing once more than left bytes
+// were written.
+func writeEntry(target string, content io.Reader, left int64) (int64, error) {
+	target = safepath.Long(target) // archives nest deeper than MAX_PATH on Windows
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return 0, err
+	}
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	n, err := io.Copy(out, io.LimitReader(content, left+1))
+	if err != nil {
+		return n, err
+	}
+	if n > left {
+		return n, errors.New("the archive is larger than PIPELINE_EXTRACT_MAX_BYTES once extracted")
+	}
+	return n, out.Close()
+}
+
+func zipEntries(archive *zip.Reader) func() (string, bool, io.Reader, error) {
+	i := 0
+	var open io.ReadCloser
+	return func() (string, bool, io.Reader, error) {
+		if open != nil {
+			open.Close()
+			open = nil
+		}
+		if i == len(archive.File) {
+			return "", false, nil, io.EOF
+		}
+		entry := archive.File[i]
+		i++
+		mode := entry.Mode()
+		if mode.IsDir() {
+			return entry.Name, true, nil, nil
+		}
+		if !mode.IsRegular() {
+			return entry.Name, false, nil, nil
+		}
+		rc, err := entry.Open()
+		if err != nil {
+			return "", false, nil, err
+		}
+		open = rc
+		return entry.Name, false, rc, nil
+	}
+}
+
+func tarEntries(archive *tar.Reader) func() (string, bool, io.Reader, error) {
+	return func() (string, bool, io.Reader, error) {
+		header, err := archive.Next()
+		if err != nil {
+			return "", false, nil, err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			return header.Name, true, nil, nil
+		case tar.TypeReg:
+			return header.Name, false, archive, nil
+		}
+		return header.Name, false, nil, nil
+	}
+}
+
+func peek(r *bufio.Reader) []byte {
+	header, _ := r.Peek(512)
+	return header
+}
+
+// isTar reports whether the header is the one of a POSIX or GNU tar archive.
+func isTar(header []byte) bool {
+	return len(header) >= 262 && strings.HasPrefix(string(header[257:262]), "ustar")
+}
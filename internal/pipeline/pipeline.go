@@ -0,0 +1,119 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"example.com/internal/config"
+)
+
+// ErrNotApplicable is returned by the steps that have nothing to do on a file, e.g. extract on
+// a file that is not an archive. The step is skipped instead of failed.
+var ErrNotApplicable = errors.New("not applicable")
+
+// File is the file of a completed download a step processes.
+type File struct {
+	DownloadID int64
+	UserID     int64
+	Link       string
+	Path       string
+}
+
+// Result is what a step did: a detail for the user, and the bytes it wrote next to the file,
+// which count towards the quota of its owner.
+type Result struct {
+	Detail string
+	Bytes  int64
+}
+
+// Step is a stage of the processing of completed downloads. Steps run one after the other on
+// the file, a failing one skips the rest.
+type Step interface {
+	Name() string
+	Run(ctx context.Context, file File) (Result, error)
+}
+
+// Factory builds a step from the config, or returns nil if the config disables it.
+type Factory func(cfg *config.Config) (Step, error)
+
+var factories = map[string]Factory{}
+
+// Register makes a step available under its name. Steps register themselves in init, so a
+// step of another package is added by importing it.
+func Register(name string, factory Factory) {
+	if _, found := factories[name]; found {
+		panic(fmt.Sprintf("pipeline step %s registered twice", name))
+	}
+	factories[name] = factory
+}
+
+type pipeline struct {
+	steps    map[string]Step
+	defaults []string
+	_        struct{}
+}
+
+// Pipeline holds the steps enabled by the config.
+type Pipeline interface {
+	// Names returns the names of the enabled steps, sorted.
+	Names() []string
+	// Defaults returns the steps of the downloads that name none, PIPELINE_STEPS.
+	Defaults() []string
+	// Validate checks that the steps are enabled and named at most once.
+	Validate(names []string) error
+	// Step returns the enabled step with the name.
+	Step(name string) (Step, bool)
+}
+
+// New builds the registered steps the config enables, and checks PIPELINE_STEPS against them.
+func New(cfg *config.Config) (Pipeline, error) {
+	p := &pipeline{steps: make(map[string]Step), defaults: cfg.PipelineSteps}
+	for name, factory := range factories {
+		step, err := factory(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config of pipeline step %s: %v", name, err)
+		}
+		if step != nil {
+			p.steps[name] = step
+		}
+	}
+	if err := p.Validate(cfg.PipelineSteps); err != nil {
+		return nil, fmt.Errorf("invalid PIPELINE_STEPS: %v", err)
+	}
+	return p, nil
+}
+
+func (p *pipeline) Names() []string {
+	names := make([]string, 0, len(p.steps))
+	for name := range p.steps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (p *pipeline) Defaults() []string {
+	return p.defaults
+}
+
+func (p *pipeline) Validate(names []string) error {
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if _, found := p.steps[name]; !found {
+			return fmt.Errorf("unknown or disabled step %q, the steps are: %s", name, strings.Join(p.Names(), ", "))
+		}
+		if seen[name] {
+			return fmt.Errorf("step %q is named twice", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+func (p *pipeline) Step(name string) (Step, bool) {
+	step, found := p.steps[name]
+	return step, found
+}
@@ -0,0 +1,105 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"example.com/internal/config"
+)
+
+// ScanChunkBytes is the size of the chunks the file is streamed to clamd in, below its default
+// StreamMaxLength of a chunk.
+const ScanChunkBytes = 64 << 10
+
+func init() {
+	Register("virus_scan", func(cfg *config.Config) (Step, error) {
+		if cfg.ClamdAddr == "" {
+			return nil, nil
+		}
+		return &virusScan{addr: cfg.ClamdAddr}, nil
+	})
+}
+
+// InfectedError is returned by the steps finding malware in the file. The download fails and its
+// file is quarantined.
+type InfectedError struct {
+	Signature string // name of the malware, e.g. Eicar-Test-Signature
+}
+
+func (e *InfectedError) Error() string {
+	return "virus found: " + e.Signature
+}
+
+// virusScan streams the file to clamd with the INSTREAM command and fails on a signature.
+type virusScan struct {
+	addr string // host:port, or the path of a unix socket
+	_    struct{}
+}
+
+func (s *virusScan) Name() string {
+	return "virus_scan"
+}
+
+func (s *virusScan) Run(ctx context.Context, file File) (Result, error) {
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return Result{}, err
+	}
+	defer f.Close()
+
+	network := "tcp"
+	if strings.HasPrefix(s.addr, "/") {
+		network = "unix"
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, s.addr)
+	if err != nil {
+		return Result{}, fmt.Errorf("could not connect to clamd: %v", err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return Result{}, fmt.Errorf("could not send the file to clamd: %v", err)
+	}
+	chunk := make([]byte, 4+ScanChunkBytes)
+	for {
+		n, err := f.Read(chunk[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(chunk[:4], uint32(n))
+			if _, err := conn.Write(chunk[:4+n]); err != nil {
+				return Result{}, fmt.Errorf("could not send the file to clamd: %v", err)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Result{}, err
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return Result{}, fmt.Errorf("could not send the file to clamd: %v", err)
+	}
+
+	reply, err := io.ReadAll(io.LimitReader(conn, 4096))
+	if err != nil {
+		return Result{}, fmt.Errorf("could not read the reply of clamd: %v", err)
+	}
+	// e.g. "stream: OK", "stream: Eicar-Signature FOUND" or "INSTREAM size limit exceeded. ERROR"
+	verdict := strings.TrimSpace(strings.TrimRight(string(reply), "\x00"))
+	verdict = strings.TrimPrefix(verdict, "stream: ")
+	switch {
+	case verdict == "OK":
+		return Result{Detail: "no virus found"}, nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return Result{}, &InfectedError{Signature: strings.TrimSuffix(verdict, " FOUND")}
+	}
+	return Result{}, fmt.Errorf("clamd could not scan the file: %s", verdict)
+}
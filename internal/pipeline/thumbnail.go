@@ -0,0 +1,160 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"example.com/internal/config"
+)
+
+// ThumbnailSuffix is appended to the path of a file for the path of its thumbnail.
+const ThumbnailSuffix = ".thumbnail.jpg"
+
+// ThumbnailMaxPixels bounds the images decoded for a thumbnail, so that a small file claiming
+// huge dimensions does not exhaust the memory.
+const ThumbnailMaxPixels = 100_000_000
+
+func init() {
+	Register("thumbnail", func(cfg *config.Config) (Step, error) {
+		if cfg.PipelineThumbnailSize <= 0 {
+			return nil, nil
+		}
+		return &thumbnail{size: int(cfg.PipelineThumbnailSize)}, nil
+	})
+}
+
+// ThumbnailPath returns the path of the thumbnail of the file at path.
+func ThumbnailPath(path string) string {
+	return path + ThumbnailSuffix
+}
+
+// thumbnail writes a JPEG preview next to images (GIF, JPEG, PNG) and videos, the latter a
+// representative frame picked by ffmpeg. Both are scaled down to fit in size by size pixels.
+type thumbnail struct {
+	size int
+	_    struct{}
+}
+
+func (s *thumbnail) Name() string {
+	return "thumbnail"
+}
+
+func (s *thumbnail) Run(ctx context.Context, file File) (Result, error) {
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return Result{}, err
+	}
+	header := make([]byte, 512)
+	n, _ := f.Read(header)
+	f.Close()
+	contentType := http.DetectContentType(header[:n])
+
+	out := ThumbnailPath(file.Path)
+	switch {
+	case contentType == "image/gif" || contentType == "image/jpeg" || contentType == "image/png":
+		err = s.image(file.Path, out)
+	case strings.HasPrefix(contentType, "video/"):
+		err = s.video(ctx, file.Path, out)
+	default:
+		return Result{}, ErrNotApplicable
+	}
+	if err != nil {
+		os.Remove(out)
+		return Result{}, err
+	}
+
+	info, err := os.Stat(out)
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{Detail: fmt.Sprintf("thumbnail of %s (%d bytes)", contentType, info.Size()), Bytes: info.Size()}, nil
+}
+
+func (s *thumbnail) image(path string, out string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bounds, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return fmt.Errorf("could not decode the image: %v", err)
+	}
+	if int64(bounds.Width)*int64(bounds.Height) > ThumbnailMaxPixels {
+		return fmt.Errorf("the image is too large: %dx%d", bounds.Width, bounds.Height)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return fmt.Errorf("could not decode the image: %v", err)
+	}
+
+	dst, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	err = jpeg.Encode(dst, scaleDown(img, s.size), &jpeg.Options{Quality: 80})
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *thumbnail) video(ctx context.Context, path string, out string) error {
+	scale := fmt.Sprintf("thumbnail,scale=%d:%d:force_original_aspect_ratio=decrease", s.size, s.size)
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-nostdin", "-y", "-loglevel", "error", "-i", path, "-vf", scale, "-frames:v", "1", out)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		message := strings.TrimSpace(stderr.String())
+		if len(message) > 1024 {
+			message = message[len(message)-1024:]
+		}
+		return fmt.Errorf("ffmpeg failed: %v: %s", err, message)
+	}
+	return nil
+}
+
+// scaleDown returns the image scaled to fit in size by size pixels, each pixel the average of
+// the ones it covers. Smaller images are returned as they are.
+func scaleDown(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+	dw, dh := size, max(h*size/w, 1)
+	if h > w {
+		dw, dh = max(w*size/h, 1), size
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := bounds.Min.Y+y*h/dh, bounds.Min.Y+max((y+1)*h/dh, y*h/dh+1)
+		for x := 0; x < dw; x++ {
+			x0, x1 := bounds.Min.X+x*w/dw, bounds.Min.X+max((x+1)*w/dw, x*w/dw+1)
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,71 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"example.com/internal/config"
+)
+
+func init() {
+	Register("transcode", func(cfg *config.Config) (Step, error) {
+		if len(cfg.PipelineTranscodeArgs) == 0 {
+			return nil, nil
+		}
+		if strings.ContainsAny(cfg.PipelineTranscodeFormat, `/\`) {
+			return nil, fmt.Errorf("invalid PIPELINE_TRANSCODE_FORMAT %q", cfg.PipelineTranscodeFormat)
+		}
+		return &transcode{args: cfg.PipelineTranscodeArgs, format: cfg.PipelineTranscodeFormat}, nil
+	})
+}
+
+// transcode converts audio and video files with ffmpeg and the options of
+// PIPELINE_TRANSCODE_ARGS, to a file next to it with the PIPELINE_TRANSCODE_FORMAT extension.
+type transcode struct {
+	args   []string // ffmpeg output options, e.g. -c:v libx264 -preset fast
+	format string
+	_      struct{}
+}
+
+func (s *transcode) Name() string {
+	return "transcode"
+}
+
+func (s *transcode) Run(ctx context.Context, file File) (Result, error) {
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return Result{}, err
+	}
+	header := make([]byte, 512)
+	n, _ := f.Read(header)
+	f.Close()
+	contentType := http.DetectContentType(header[:n])
+	if !strings.HasPrefix(contentType, "video/") && !strings.HasPrefix(contentType, "audio/") && contentType != "application/ogg" {
+		return Result{}, ErrNotApplicable
+	}
+
+	out := file.Path + "." + s.format
+	args := append([]string{"-nostdin", "-y", "-loglevel", "error", "-i", file.Path}, s.args...)
+	cmd := exec.CommandContext(ctx, "ffmpeg", append(args, out)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(out)
+		message := strings.TrimSpace(stderr.String())
+		if len(message) > 1024 {
+			message = message[len(message)-1024:]
+		}
+		return Result{}, fmt.Errorf("ffmpeg failed: %v: %s", err, message)
+	}
+
+	info, err := os.Stat(out)
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{Detail: fmt.Sprintf("transcoded %s to %s (%d bytes)", contentType, s.format, info.Size()), Bytes: info.Size()}, nil
+}
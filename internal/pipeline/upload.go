@@ -0,0 +1,64 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+
+	"example.com/internal/coldstore"
+	"example.com/internal/config"
+)
+
+func init() {
+	Register("upload", func(cfg *config.Config) (Step, error) {
+		if cfg.PipelineUploadBucket == "" {
+			return nil, nil
+		}
+		if cfg.ColdStorageEndpoint == "" {
+			return nil, fmt.Errorf("PIPELINE_UPLOAD_BUCKET needs COLD_STORAGE_ENDPOINT")
+		}
+		store, err := coldstore.NewBucket(cfg, cfg.PipelineUploadBucket, "")
+		if err != nil {
+			return nil, err
+		}
+		scheme := map[string]string{config.ColdStorageS3: "s3", config.ColdStorageGCS: "gs", config.ColdStorageAzure: "az"}[cfg.ColdStorageBackend]
+		return &upload{store: store, location: scheme + "://" + cfg.PipelineUploadBucket}, nil
+	})
+}
+
+// upload copies the file to PIPELINE_UPLOAD_BUCKET of the endpoint of the cold storage, under
+// <user id>/<download id>/<name of the link>.
+type upload struct {
+	store    coldstore.Store
+	location string // of the bucket, e.g. s3://<bucket>
+	_        struct{}
+}
+
+func (s *upload) Name() string {
+	return "upload"
+}
+
+func (s *upload) Run(ctx context.Context, file File) (Result, error) {
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return Result{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return Result{}, err
+	}
+
+	name := path.Base(file.Path)
+	if u, err := url.Parse(file.Link); err == nil && path.Base(u.Path) != "/" && path.Base(u.Path) != "." {
+		name = path.Base(u.Path)
+	}
+	key := path.Join(strconv.FormatInt(file.UserID, 10), strconv.FormatInt(file.DownloadID, 10), name)
+	if err := s.store.Put(ctx, key, f, info.Size()); err != nil {
+		return Result{}, err
+	}
+	return Result{Detail: fmt.Sprintf("uploaded %d bytes to %s/%s", info.Size(), s.location, key)}, nil
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// ErrTooLarge is returned for files announced larger than the limit of a pass-through.
+var ErrTooLarge = errors.New("the file is too large")
+
+// errLimitReached cuts a pass-through whose origin did not announce the size of the file.
+var errLimitReached = errors.New("size limit reached")
+
+func (p *proxy) PassThrough(ctx context.Context, link string, rangeHeader string, maxBytes int64, maxSpeed int64) (*Response, error) {
+	// The body is streamed after the handler returned, so it must not depend on the request context.
+	req, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		return nil, err
+	}
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch %s: %v", link, err)
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected HTTP status code for %s: %d", link, resp.StatusCode)
+	}
+	if maxBytes > 0 && resp.ContentLength > maxBytes {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %d bytes, more than %d", ErrTooLarge, resp.ContentLength, maxBytes)
+	}
+
+	response := &Response{
+		Body:        resp.Body,
+		ContentType: resp.Header.Get("Content-Type"),
+		Size:        resp.ContentLength,
+		ETag:        resp.Header.Get("ETag"),
+		Cache:       CacheBypass,
+	}
+	if resp.StatusCode == http.StatusPartialContent {
+		response.ContentRange = resp.Header.Get("Content-Range")
+	}
+	if maxBytes > 0 || maxSpeed > 0 {
+		response.Body = &limitedReader{body: resp.Body, maxBytes: maxBytes, speed: maxSpeed, start: time.Now()}
+	}
+	return response, nil
+}
+
+// limitedReader fails once the origin sends more than maxBytes, and waits between reads so as
+// not to read faster than its speed.
+type limitedReader struct {
+	body     io.ReadCloser
+	maxBytes int64 // 0 for no limit
+	speed    int64 // bytes per second, 0 for no limit
+	start    time.Time
+	read     int64
+}
+
+func (r *limitedReader) Read(b []byte) (int, error) {
+	if r.maxBytes > 0 && r.read >= r.maxBytes {
+		// Only the end of the body may follow.
+		var probe [1]byte
+		n, err := r.body.Read(probe[:])
+		if n > 0 {
+			return 0, errLimitReached
+		}
+		return 0, err
+	}
+	if r.maxBytes > 0 && int64(len(b)) > r.maxBytes-r.read {
+		b = b[:r.maxBytes-r.read]
+	}
+	if r.speed > 0 && int64(len(b)) > r.speed {
+		b = b[:r.speed] // at most a second of bytes at once
+	}
+
+	n, err := r.body.Read(b)
+	r.read += int64(n)
+	if r.speed > 0 {
+		time.Sleep(time.Until(r.start.Add(time.Duration(float64(r.read) / float64(r.speed) * float64(time.Second)))))
+	}
+	return n, err
+}
+
+func (r *limitedReader) Close() error {
+	return r.body.Close()
+}
@@ -0,0 +1,275 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"example.com/internal/config"
+	"example.com/internal/repository"
+)
+
+const (
+	CacheHit         = "HIT"
+	CacheRevalidated = "REVALIDATED"
+	CacheMiss        = "MISS"
+	CacheBypass      = "BYPASS"
+)
+
+var ErrDisabled = errors.New("proxy mode is disabled")
+
+type Response struct {
+	Body         io.ReadCloser
+	ContentType  string
+	Size         int64 // -1 if unknown
+	ETag         string
+	Cache        string // one of the Cache* constants
+	ContentRange string // of a partial response, empty otherwise
+}
+
+type proxy struct {
+	repo   repository.Repository
+	cfg    *config.Config
+	client *http.Client
+	_      struct{}
+}
+
+type Proxy interface {
+	// Fetch returns the response for the link, from the content store when the cached copy is fresh
+	// (or still valid according to its ETag/Last-Modified), otherwise from the origin while storing it.
+	Fetch(ctx context.Context, link string) (*Response, error)
+	// PassThrough returns the response of the origin for the link, or for its byte range, without
+	// caching it. It fails with ErrTooLarge if the file is announced larger than maxBytes.
+	PassThrough(ctx context.Context, link string, rangeHeader string, maxBytes int64, maxSpeed int64) (*Response, error)
+}
+
+func (p *proxy) Fetch(ctx context.Context, link string) (*Response, error) {
+	if p.cfg.ContentStoreDir == "" {
+		return nil, ErrDisabled
+	}
+
+	policies, err := p.repo.GetCachePolicies(ctx)
+	if err != nil {
+		return nil, err
+	}
+	maxAge, noStore := p.policyFor(policies, link)
+	if noStore {
+		return p.fetchOrigin(ctx, link, nil, false)
+	}
+
+	entry, found, err := p.repo.GetProxyCacheEntry(ctx, link)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		if _, err := os.Stat(p.storePath(entry.ContentHash)); err != nil {
+			found = false // the stored copy is gone, fetch it again
+		}
+	}
+	if !found {
+		return p.fetchOrigin(ctx, link, nil, true)
+	}
+
+	if time.Since(entry.FetchedAt) < maxAge {
+		return p.serveStored(entry, CacheHit)
+	}
+	return p.fetchOrigin(ctx, link, &entry, true)
+}
+
+// fetchOrigin requests the link from the origin, conditionally if there is a stale cached copy.
+func (p *proxy) fetchOrigin(ctx context.Context, link string, stale *repository.ProxyCacheEntry, store bool) (*Response, error) {
+	// The body is streamed after the handler returned, so it must not depend on the request context.
+	req, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		return nil, err
+	}
+	if stale != nil {
+		if stale.ETag != "" {
+			req.Header.Set("If-None-Match", stale.ETag)
+		}
+		if stale.LastModified != "" {
+			req.Header.Set("If-Modified-Since", stale.LastModified)
+		}
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch %s: %v", link, err)
+	}
+
+	if stale != nil && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		if err := p.repo.TouchProxyCacheEntry(ctx, link); err != nil {
+			log.Println(err)
+		}
+		return p.serveStored(*stale, CacheRevalidated)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected HTTP status code for %s: %d", link, resp.StatusCode)
+	}
+
+	response := &Response{
+		Body:        resp.Body,
+		ContentType: resp.Header.Get("Content-Type"),
+		Size:        resp.ContentLength,
+		ETag:        resp.Header.Get("ETag"),
+		Cache:       CacheBypass,
+	}
+	if !store || strings.Contains(resp.Header.Get("Cache-Control"), "no-store") {
+		return response, nil
+	}
+
+	tmp, err := os.CreateTemp(p.cfg.ContentStoreDir, "proxy-*.part")
+	if err != nil {
+		log.Printf("could not cache %s: %v", link, err)
+		return response, nil
+	}
+
+	h := sha256.New()
+	response.Body = &storingReader{
+		proxy: p,
+		body:  resp.Body,
+		tmp:   tmp,
+		hash:  h,
+		tee:   io.TeeReader(resp.Body, io.MultiWriter(tmp, h)),
+		entry: repository.ProxyCacheEntry{
+			URL:          link,
+			ContentType:  response.ContentType,
+			ETag:         response.ETag,
+			LastModified: resp.Header.Get("Last-Modified"),
+		},
+	}
+	response.Cache = CacheMiss
+	return response, nil
+}
+
+func (p *proxy) serveStored(entry repository.ProxyCacheEntry, cache string) (*Response, error) {
+	file, err := os.Open(p.storePath(entry.ContentHash))
+	if err != nil {
+		return nil, fmt.Errorf("could not open stored content %s: %v", entry.ContentHash, err)
+	}
+
+	return &Response{
+		Body:        file,
+		ContentType: entry.ContentType,
+		Size:        entry.Size,
+		ETag:        entry.ETag,
+		Cache:       cache,
+	}, nil
+}
+
+// policyFor returns the max age of the link according to the longest matching policy.
+func (p *proxy) policyFor(policies []repository.CachePolicy, link string) (time.Duration, bool) {
+	maxAge := p.cfg.ProxyCacheMaxAge
+	noStore := false
+	matched := -1
+	for _, policy := range policies {
+		if strings.HasPrefix(link, policy.URLPrefix) && len(policy.URLPrefix) > matched {
+			matched = len(policy.URLPrefix)
+			maxAge = time.Duration(policy.MaxAge) * time.Second
+			noStore = policy.NoStore
+		}
+	}
+	return maxAge, noStore
+}
+
+func (p *proxy) storePath(hash string) string {
+	return filepath.Join(p.cfg.ContentStoreDir, hash)
+}
+
+// storingReader streams the origin response to the client while writing it to a
+// temporary file, which is moved into the content store once the body is complete.
+type storingReader struct {
+	proxy *proxy
+	body  io.ReadCloser
+	tmp   *os.File
+	hash  hash.Hash
+	tee   io.Reader
+	size  int64
+	done  bool
+	entry repository.ProxyCacheEntry
+}
+
+func (r *storingReader) Read(b []byte) (int, error) {
+	n, err := r.tee.Read(b)
+	r.size += int64(n)
+	if err == io.EOF && !r.done {
+		r.done = true
+		if storeErr := r.store(); storeErr != nil {
+			log.Printf("could not cache %s: %v", r.entry.URL, storeErr)
+		}
+	}
+	return n, err
+}
+
+func (r *storingReader) Close() error {
+	if !r.done {
+		// The client went away before the end, the partial copy is useless.
+		r.done = true
+		r.tmp.Close()
+		os.Remove(r.tmp.Name())
+	}
+	return r.body.Close()
+}
+
+func (r *storingReader) store() error {
+	defer os.Remove(r.tmp.Name())
+	if err := r.tmp.Close(); err != nil {
+		return err
+	}
+
+	// The entry is stored even if the client went away in the meantime, within its own deadline.
+	ctx := context.Background()
+	if r.proxy.cfg.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.proxy.cfg.QueryTimeout)
+		defer cancel()
+	}
+	r.entry.ContentHash = hex.EncodeToString(r.hash.Sum(nil))
+	r.entry.Size = r.size
+
+	storePath := r.proxy.storePath(r.entry.ContentHash)
+	if _, err := os.Stat(storePath); errors.Is(err, os.ErrNotExist) {
+		if err := os.Rename(r.tmp.Name(), storePath); err != nil {
+			return err
+		}
+	}
+
+	if _, err := r.proxy.repo.AddContentRef(ctx, r.entry.ContentHash, r.entry.Size); err != nil {
+		return err
+	}
+	previousHash, err := r.proxy.repo.SaveProxyCacheEntry(ctx, r.entry)
+	if err != nil {
+		return err
+	}
+	if previousHash != "" {
+		refCount, err := r.proxy.repo.ReleaseContentRef(ctx, previousHash)
+		if err != nil {
+			return err
+		}
+		if refCount <= 0 {
+			os.Remove(r.proxy.storePath(previousHash))
+		}
+	}
+
+	return nil
+}
+
+func New(repo repository.Repository, cfg *config.Config, client *http.Client) Proxy {
+	return &proxy{
+		repo:   repo,
+		cfg:    cfg,
+		client: client,
+	}
+}
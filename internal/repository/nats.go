@@ -0,0 +1,334 @@
+package repository
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// natsUserConsumerInactiveTime is how long the consumer of the queue of a user is kept by the
+// server once no worker reads it, as every user who ever downloaded would otherwise keep one.
+const natsUserConsumerInactiveTime = 24 * time.Hour
+
+// natsRequestTimeout bounds the JetStream API requests made outside of a request context.
+const natsRequestTimeout = 5 * time.Second
+
+// natsQueue keeps the queues in a JetStream stream with work queue retention: every queue is
+// a subject of the stream read through a durable pull consumer of its own, shared by all the
+// workers, and an entry is removed once acknowledged. An entry not acknowledged within
+// QueueClaimIdleTime is delivered again, up to maxDeliver times; after that it is dropped
+// from the stream and left to the reconciliation like any lost request.
+//
+// The client reconnects by itself whenever the connection is lost; calls made meanwhile fail.
+type natsQueue struct {
+	conn       *nats.Conn
+	js         jetstream.JetStream
+	stream     jetstream.Stream
+	name       string // of the stream
+	maxDeliver int64
+	mu         sync.Mutex // guards consumers
+	consumers  map[string]jetstream.Consumer
+	_          struct{}
+}
+
+// NewNATSQueue connects to the NATS server at url and creates the stream if it does not exist.
+func NewNATSQueue(ctx context.Context, url string, stream string, maxDeliver int64) (Queue, error) {
+	conn, err := nats.Connect(url,
+		nats.Name("downloader"),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Printf("Disconnected from nats: %v", err)
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			log.Printf("Reconnected to nats at %s", conn.ConnectedUrl())
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to nats: %v", err)
+	}
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not connect to jetstream: %v", err)
+	}
+
+	s, err := js.Stream(ctx, stream)
+	if errors.Is(err, jetstream.ErrStreamNotFound) {
+		s, err = js.CreateStream(ctx, jetstream.StreamConfig{
+			Name:      stream,
+			Subjects:  []string{stream + ".>"},
+			Retention: jetstream.WorkQueuePolicy,
+			Storage:   jetstream.FileStorage,
+		})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not create stream %s: %v", stream, err)
+	}
+
+	q := &natsQueue{
+		conn:       conn,
+		js:         js,
+		stream:     s,
+		name:       stream,
+		maxDeliver: maxDeliver,
+		consumers:  make(map[string]jetstream.Consumer),
+	}
+	// Subscriptions are restored by the client after a reconnect.
+	_, err = conn.Subscribe("$JS.EVENT.ADVISORY.CONSUMER.MAX_DELIVERIES."+stream+".*", func(msg *nats.Msg) {
+		go q.dropUndeliverable(msg)
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not subscribe to max deliveries advisories: %v", err)
+	}
+	return q, nil
+}
+
+// subject returns the subject and the durable consumer of the queue. Instance IDs are hex
+// encoded, as they may hold the dots separating the tokens of a subject.
+func (q *natsQueue) subject(key string) (string, string) {
+	if host, ok := strings.CutPrefix(key, HostQueueKeyPrefix); ok {
+		token := hex.EncodeToString([]byte(host))
+		return q.name + ".host." + token, "host_" + token
+	}
+	if user, ok := strings.CutPrefix(key, UserQueueKeyPrefix); ok {
+		return q.name + ".user." + user, "user_" + user
+	}
+	return q.name + ".shared", "shared"
+}
+
+func (q *natsQueue) consumer(ctx context.Context, subject string, durable string) (jetstream.Consumer, error) {
+	q.mu.Lock()
+	consumer, known := q.consumers[durable]
+	q.mu.Unlock()
+	if known {
+		return consumer, nil
+	}
+
+	config := jetstream.ConsumerConfig{
+		Durable:       durable,
+		FilterSubject: subject,
+		DeliverPolicy: jetstream.DeliverAllPolicy,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       QueueClaimIdleTime,
+		MaxDeliver:    int(q.maxDeliver),
+	}
+	if strings.HasPrefix(durable, "user_") {
+		// Deleted meanwhile, a cached one fails once and is created again, see Pop.
+		config.InactiveThreshold = natsUserConsumerInactiveTime
+	}
+	consumer, err := q.stream.CreateConsumer(ctx, config)
+	if err != nil {
+		// created by an older version with another config, which is kept
+		var infoErr error
+		consumer, infoErr = q.stream.Consumer(ctx, durable)
+		if infoErr != nil {
+			return nil, fmt.Errorf("could not create consumer %s: %v", durable, err)
+		}
+	}
+
+	q.mu.Lock()
+	q.consumers[durable] = consumer
+	q.mu.Unlock()
+	return consumer, nil
+}
+
+func (q *natsQueue) forgetConsumer(durable string) {
+	q.mu.Lock()
+	delete(q.consumers, durable)
+	q.mu.Unlock()
+}
+
+func (q *natsQueue) Push(ctx context.Context, key string, downloadID int64) error {
+	subject, _ := q.subject(key)
+	if _, err := q.js.Publish(ctx, subject, []byte(strconv.FormatInt(downloadID, 10))); err != nil {
+		return fmt.Errorf("could not push download request %d to %s: %v", downloadID, key, err)
+	}
+
+	return nil
+}
+
+// Pop pulls the next entry of the consumer of the queue without waiting: a new one, or one
+// whose ack wait expired. The consumer name is not used, the workers share the consumer.
+func (q *natsQueue) Pop(ctx context.Context, key string, consumer string) (QueueEntry, bool, error) {
+	subject, durable := q.subject(key)
+	c, err := q.consumer(ctx, subject, durable)
+	if err != nil {
+		return QueueEntry{}, false, err
+	}
+	batch, err := c.FetchNoWait(1)
+	if err != nil {
+		q.forgetConsumer(durable)
+		return QueueEntry{}, false, fmt.Errorf("could not pop download request from %s: %v", key, err)
+	}
+	msg, ok := <-batch.Messages()
+	if err := batch.Error(); err != nil {
+		q.forgetConsumer(durable)
+		return QueueEntry{}, false, fmt.Errorf("could not pop download request from %s: %v", key, err)
+	}
+	if !ok {
+		return QueueEntry{}, false, nil
+	}
+
+	entry := QueueEntry{Stream: key, ID: msg.Reply()}
+	entry.DownloadID, err = strconv.ParseInt(string(msg.Data()), 10, 64)
+	if err != nil {
+		// not a download request
+		return entry, false, q.Ack(ctx, entry)
+	}
+	return entry, true, nil
+}
+
+// Ack acknowledges the entry on its reply subject, which is all the entry keeps of the message.
+func (q *natsQueue) Ack(ctx context.Context, entry QueueEntry) error {
+	if err := q.conn.Publish(entry.ID, []byte("+ACK")); err != nil {
+		return fmt.Errorf("could not acknowledge download request %d: %v", entry.DownloadID, err)
+	}
+
+	return nil
+}
+
+func (q *natsQueue) Entries(ctx context.Context, key string) ([]QueueEntry, error) {
+	subject, _ := q.subject(key)
+	var entries []QueueEntry
+	for seq := uint64(1); ; {
+		msg, err := q.stream.GetMsg(ctx, seq, jetstream.WithGetMsgSubject(subject))
+		if errors.Is(err, jetstream.ErrMsgNotFound) {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read download requests queue %s: %v", key, err)
+		}
+
+		downloadID, err := strconv.ParseInt(string(msg.Data), 10, 64)
+		if err == nil {
+			entries = append(entries, QueueEntry{Stream: key, ID: strconv.FormatUint(msg.Sequence, 10), DownloadID: downloadID})
+		}
+		seq = msg.Sequence + 1
+	}
+}
+
+func (q *natsQueue) Delete(ctx context.Context, key string) error {
+	subject, durable := q.subject(key)
+	if err := q.stream.Purge(ctx, jetstream.WithPurgeSubject(subject)); err != nil {
+		return fmt.Errorf("could not delete queue %s: %v", key, err)
+	}
+	err := q.stream.DeleteConsumer(ctx, durable)
+	if err != nil && !errors.Is(err, jetstream.ErrConsumerNotFound) {
+		return fmt.Errorf("could not delete consumer of queue %s: %v", key, err)
+	}
+	q.forgetConsumer(durable)
+
+	return nil
+}
+
+// HostKeys lists the queues of the hosts holding entries.
+func (q *natsQueue) HostKeys(ctx context.Context) ([]string, error) {
+	subjects, err := q.subjects(ctx, q.name+".host.>")
+	if err != nil {
+		return nil, fmt.Errorf("could not list host queues: %v", err)
+	}
+
+	var keys []string
+	for subject := range subjects {
+		host, err := hex.DecodeString(strings.TrimPrefix(subject, q.name+".host."))
+		if err == nil {
+			keys = append(keys, HostQueueKeyPrefix+string(host))
+		}
+	}
+	return keys, nil
+}
+
+// UserKeys lists the queues of the users holding entries. The consumers of the empty ones are
+// deleted by the server once inactive.
+func (q *natsQueue) UserKeys(ctx context.Context) ([]string, error) {
+	subjects, err := q.subjects(ctx, q.name+".user.>")
+	if err != nil {
+		return nil, fmt.Errorf("could not list user queues: %v", err)
+	}
+
+	keys := make([]string, 0, len(subjects))
+	for subject := range subjects {
+		keys = append(keys, UserQueueKeyPrefix+strings.TrimPrefix(subject, q.name+".user."))
+	}
+	return keys, nil
+}
+
+// subjects returns how many messages the stream holds per subject matching the filter.
+func (q *natsQueue) subjects(ctx context.Context, filter string) (map[string]uint64, error) {
+	info, err := q.stream.Info(ctx, jetstream.WithSubjectFilter(filter))
+	if err != nil {
+		return nil, err
+	}
+	return info.State.Subjects, nil
+}
+
+func (q *natsQueue) Len(ctx context.Context, key string) (int64, int64, error) {
+	subject, durable := q.subject(key)
+	subjects, err := q.subjects(ctx, subject)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not get queue length: %v", err)
+	}
+
+	var pending int64
+	consumer, err := q.stream.Consumer(ctx, durable)
+	if err != nil && !errors.Is(err, jetstream.ErrConsumerNotFound) {
+		return 0, 0, fmt.Errorf("could not get pending entries of the queue: %v", err)
+	}
+	if err == nil {
+		info, err := consumer.Info(ctx)
+		if err != nil {
+			return 0, 0, fmt.Errorf("could not get pending entries of the queue: %v", err)
+		}
+		pending = int64(info.NumAckPending)
+	}
+	return int64(subjects[subject]), pending, nil
+}
+
+// Spill returns nothing: JetStream keeps the queue on its own disk, not in Redis memory.
+func (q *natsQueue) Spill(ctx context.Context, key string, count int64) ([]int64, error) {
+	return nil, nil
+}
+
+func (q *natsQueue) Ping(ctx context.Context) error {
+	if _, err := q.stream.Info(ctx); err != nil {
+		return fmt.Errorf("could not read queue: %v", err)
+	}
+	return nil
+}
+
+// dropUndeliverable deletes the entry of a max deliveries advisory from the stream: its
+// consumer does not deliver it anymore, but it would be listed as queued forever.
+func (q *natsQueue) dropUndeliverable(msg *nats.Msg) {
+	var advisory struct {
+		Consumer   string `json:"consumer"`
+		StreamSeq  uint64 `json:"stream_seq"`
+		Deliveries int64  `json:"deliveries"`
+	}
+	if err := json.Unmarshal(msg.Data, &advisory); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), natsRequestTimeout)
+	defer cancel()
+	err := q.stream.DeleteMsg(ctx, advisory.StreamSeq)
+	if errors.Is(err, jetstream.ErrMsgNotFound) {
+		return // dropped by another process
+	}
+	if err != nil {
+		log.Printf("Could not drop queue entry %d of %s: %v", advisory.StreamSeq, advisory.Consumer, err)
+		return
+	}
+	log.Printf("Dropped queue entry %d of %s, delivered %d times without being acknowledged\n", advisory.StreamSeq, advisory.Consumer, advisory.Deliveries)
+}
@@ -0,0 +1,247 @@
+package repository
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/net/context"
+)
+
+// Queue carries the download requests from the API to the workers. Every key is a queue:
+// DownloadRequestsKey is shared by all the processes, HostQueueKeyPrefix + instance ID
+// belongs to one, UserQueueKeyPrefix + user ID holds the requests of a user. A popped entry stays pending until it is acknowledged, and is delivered
+// again once it was not acknowledged for QueueClaimIdleTime.
+type Queue interface {
+	Push(ctx context.Context, key string, downloadID int64) error
+	// Pop returns false when the queue has no entry to deliver.
+	Pop(ctx context.Context, key string, consumer string) (QueueEntry, bool, error)
+	Ack(ctx context.Context, entry QueueEntry) error
+	// Entries returns the entries of the queue that were not acknowledged yet.
+	Entries(ctx context.Context, key string) ([]QueueEntry, error)
+	// Delete drops the queue and its entries.
+	Delete(ctx context.Context, key string) error
+	// HostKeys lists the keys of the queues of the hosts.
+	HostKeys(ctx context.Context) ([]string, error)
+	// UserKeys lists the keys of the queues of the users.
+	UserKeys(ctx context.Context) ([]string, error)
+	// Len returns how many entries the queue holds, and how many of them were delivered but
+	// not acknowledged yet.
+	Len(ctx context.Context, key string) (int64, int64, error)
+	// Spill removes up to count of the newest entries of the queue that no consumer read yet and
+	// returns their download IDs, oldest first. Queues that do not keep their entries in Redis
+	// memory return none.
+	Spill(ctx context.Context, key string, count int64) ([]int64, error)
+	Ping(ctx context.Context) error
+}
+
+// redisQueue keeps every queue in a Redis stream, read through the DownloadRequestsGroup
+// consumer group.
+type redisQueue struct {
+	rdb *redis.Client
+	_   struct{}
+}
+
+func NewRedisQueue(rdb *redis.Client) Queue {
+	return &redisQueue{rdb: rdb}
+}
+
+func (q *redisQueue) Push(ctx context.Context, key string, downloadID int64) error {
+	err := q.rdb.XAdd(ctx, &redis.XAddArgs{Stream: key, Values: map[string]any{"download_id": downloadID}}).Err()
+	if err != nil {
+		return fmt.Errorf("could not push download request %d to %s: %v", downloadID, key, err)
+	}
+
+	return nil
+}
+
+// Pop claims the oldest entry of the stream that a consumer read but did not acknowledge
+// for QueueClaimIdleTime (it died), or else reads a new one.
+func (q *redisQueue) Pop(ctx context.Context, key string, consumer string) (QueueEntry, bool, error) {
+	messages, _, err := q.rdb.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+		Stream:   key,
+		Group:    DownloadRequestsGroup,
+		Consumer: consumer,
+		MinIdle:  QueueClaimIdleTime,
+		Start:    "0-0",
+		Count:    1,
+	}).Result()
+	if isNoGroup(err) {
+		err = q.rdb.XGroupCreateMkStream(ctx, key, DownloadRequestsGroup, "0").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return QueueEntry{}, false, fmt.Errorf("could not create consumer group of %s: %v", key, err)
+		}
+		messages, err = nil, nil
+	}
+	if err != nil {
+		return QueueEntry{}, false, fmt.Errorf("could not claim download request from %s: %v", key, err)
+	}
+
+	if len(messages) == 0 {
+		streams, err := q.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    DownloadRequestsGroup,
+			Consumer: consumer,
+			Streams:  []string{key, ">"},
+			Count:    1,
+			Block:    -1,
+		}).Result()
+		if err != nil && err != redis.Nil {
+			return QueueEntry{}, false, fmt.Errorf("could not pop download request from %s: %v", key, err)
+		}
+		for _, stream := range streams {
+			messages = append(messages, stream.Messages...)
+		}
+	}
+	if len(messages) == 0 {
+		return QueueEntry{}, false, nil
+	}
+
+	entry := QueueEntry{Stream: key, ID: messages[0].ID}
+	entry.DownloadID, err = strconv.ParseInt(fmt.Sprint(messages[0].Values["download_id"]), 10, 64)
+	if err != nil {
+		// deleted since it was read, or not a download request
+		return entry, false, q.Ack(ctx, entry)
+	}
+	return entry, true, nil
+}
+
+func isNoGroup(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "NOGROUP")
+}
+
+func (q *redisQueue) Ack(ctx context.Context, entry QueueEntry) error {
+	pipe := q.rdb.TxPipeline()
+	pipe.XAck(ctx, entry.Stream, DownloadRequestsGroup, entry.ID)
+	pipe.XDel(ctx, entry.Stream, entry.ID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("could not acknowledge download request %d: %v", entry.DownloadID, err)
+	}
+
+	return nil
+}
+
+func (q *redisQueue) Entries(ctx context.Context, key string) ([]QueueEntry, error) {
+	messages, err := q.rdb.XRange(ctx, key, "-", "+").Result()
+	if err != nil {
+		return nil, fmt.Errorf("could not read download requests queue %s: %v", key, err)
+	}
+
+	entries := make([]QueueEntry, 0, len(messages))
+	for _, message := range messages {
+		downloadID, err := strconv.ParseInt(fmt.Sprint(message.Values["download_id"]), 10, 64)
+		if err == nil {
+			entries = append(entries, QueueEntry{Stream: key, ID: message.ID, DownloadID: downloadID})
+		}
+	}
+	return entries, nil
+}
+
+func (q *redisQueue) Delete(ctx context.Context, key string) error {
+	if err := q.rdb.Del(ctx, key).Err(); err != nil {
+		return fmt.Errorf("could not delete queue %s: %v", key, err)
+	}
+
+	return nil
+}
+
+func (q *redisQueue) HostKeys(ctx context.Context) ([]string, error) {
+	var keys []string
+	iter := q.rdb.Scan(ctx, 0, HostQueueKeyPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("could not list host queues: %v", err)
+	}
+	return keys, nil
+}
+
+func (q *redisQueue) UserKeys(ctx context.Context) ([]string, error) {
+	var keys []string
+	iter := q.rdb.Scan(ctx, 0, UserQueueKeyPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("could not list user queues: %v", err)
+	}
+	return keys, nil
+}
+
+func (q *redisQueue) Len(ctx context.Context, key string) (int64, int64, error) {
+	queued, err := q.rdb.XLen(ctx, key).Result()
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not get queue length: %v", err)
+	}
+
+	pending, err := q.rdb.XPending(ctx, key, DownloadRequestsGroup).Result()
+	if isNoGroup(err) {
+		return queued, 0, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not get pending entries of the queue: %v", err)
+	}
+	return queued, pending.Count, nil
+}
+
+// spillScript takes the newest entries of the stream after the last one delivered to the
+// consumer group, all of them if the group does not exist yet. It runs atomically, so an entry
+// is never both spilled and read, and two processes never spill the same entry.
+var spillScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return {}
+end
+local last = "0-0"
+for _, group in ipairs(redis.call("XINFO", "GROUPS", KEYS[1])) do
+	local info = {}
+	for i = 1, #group, 2 do
+		info[group[i]] = group[i + 1]
+	end
+	if info["name"] == ARGV[2] then
+		last = info["last-delivered-id"]
+	end
+end
+local ids, downloadIDs = {}, {}
+for _, message in ipairs(redis.call("XREVRANGE", KEYS[1], "+", "(" .. last, "COUNT", ARGV[1])) do
+	table.insert(ids, message[1])
+	local fields = message[2]
+	for i = 1, #fields, 2 do
+		if fields[i] == "download_id" then
+			table.insert(downloadIDs, fields[i + 1])
+		end
+	end
+end
+if #ids > 0 then
+	redis.call("XDEL", KEYS[1], unpack(ids))
+end
+return downloadIDs
+`)
+
+func (q *redisQueue) Spill(ctx context.Context, key string, count int64) ([]int64, error) {
+	values, err := spillScript.Run(ctx, q.rdb, []string{key}, count, DownloadRequestsGroup).StringSlice()
+	if err != nil {
+		return nil, fmt.Errorf("could not spill download requests of %s: %v", key, err)
+	}
+
+	downloadIDs := make([]int64, 0, len(values))
+	for i := len(values) - 1; i >= 0; i-- {
+		downloadID, err := strconv.ParseInt(values[i], 10, 64)
+		if err == nil {
+			downloadIDs = append(downloadIDs, downloadID)
+		}
+	}
+	return downloadIDs, nil
+}
+
+// Ping checks that the queue can be read: its key is a stream, or does not exist yet.
+func (q *redisQueue) Ping(ctx context.Context) error {
+	keyType, err := q.rdb.Type(ctx, DownloadRequestsKey).Result()
+	if err != nil {
+		return fmt.Errorf("could not read queue: %v", err)
+	}
+	if keyType != "stream" && keyType != "none" {
+		return fmt.Errorf("queue key %s is a %s, not a stream", DownloadRequestsKey, keyType)
+	}
+	return nil
+}
@@ -2,20 +2,357 @@ package repository
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/redis/go-redis/v9"
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/net/context"
 )
 
-const DownloadRequestsKey = "download_requests"
+// DownloadRequestsKey is the queue of the download requests any process may work on. Its
+// entries are acknowledged once a worker claimed the download (or let it go), so the ones
+// read by a worker that died are delivered again after QueueClaimIdleTime. On Redis it is
+// a stream read through the DownloadRequestsGroup consumer group.
+const DownloadRequestsKey = "download_requests_stream"
+const DownloadRequestsGroup = "workers"
+const QueueClaimIdleTime = 1 * time.Minute
+const RateLimitKeyPrefix = "rate_limit:"
+const IdempotencyKeyPrefix = "idempotency:"
+const ProgressKeyPrefix = "progress:"
+const ProgressExpTime = 1 * time.Hour
+const WorkerHeartbeatKeyPrefix = "worker_heartbeats:"
+
+// DownloadOwnersKey is a hash of the DownloadOwner of every locked download, by download ID.
+const DownloadOwnersKey = "download_owners"
+
+// ProcessHeartbeatKeyPrefix + instance ID holds the heartbeat a process last sent.
+const ProcessHeartbeatKeyPrefix = "process_heartbeats:"
+
+// VolumesKeyPrefix + hostname holds the volumes a process last reported.
+const VolumesKeyPrefix = "volumes:"
+const PasswordResetKeyPrefix = "password_reset:"
+const EmailVerificationKeyPrefix = "email_verification:"
+
+// SessionKeyPrefix is prefixed to the id of a user for a hash of the sessions of its tokens,
+// keyed by session id. It expires with the last token issued.
+const SessionKeyPrefix = "sessions:"
+
+// HostQueueKeyPrefix is prefixed to the instance ID of a process for its own queue, which
+// holds the download requests whose partial file is on the disk of that process.
+const HostQueueKeyPrefix = "download_requests_stream:"
+const InstanceKeyPrefix = "instances:"
+
+// UserQueueKeyPrefix is prefixed to the id of a user for the queue of their download requests.
+// The workers take turns between the users in QueueUsersKey, see PopDownloadRequest.
+const UserQueueKeyPrefix = "download_requests_user:"
+
+// QueueUsersKey is a sorted set of the users with requests in their queue, scored by the turns
+// they were given. QueueUserVersionsKey holds the version of each of them, changed by every push
+// (from the QueueUsersSeqKey counter), so that a user is not taken out of turn while a request
+// is pushed for them.
+const QueueUsersKey = "queue_users"
+const QueueUserVersionsKey = "queue_users:versions"
+const QueueUsersSeqKey = "queue_users:seq"
+
+// UserSlotsKeyPrefix is prefixed to the id of a user for a sorted set of their downloads in
+// progress, scored by the unix milliseconds their slot expires at unless it is extended.
+const UserSlotsKeyPrefix = "user_slots:"
+
+// ConnectionSlotsKey is a sorted set of the remote connections of the downloads of all the
+// processes, <download id>:<connection>, scored like the slots of the users.
+const ConnectionSlotsKey = "connection_slots"
+
+// FleetBandwidthKeyPrefix is prefixed to the index of a time slice for the bytes the processes
+// took from the bandwidth of the whole fleet in that slice.
+const FleetBandwidthKeyPrefix = "fleet_bandwidth:"
+
+// QueuedAtKey is a sorted set of the download requests pushed to a queue and not started yet,
+// scored by the unix milliseconds they were first pushed at.
+const QueuedAtKey = "queued_at"
+
+// FeatureFlagKeyPrefix is prefixed to the name of a feature flag for its cached row, read
+// on every gated request. Changes made by another process are seen after FeatureFlagCacheTime.
+const FeatureFlagKeyPrefix = "feature_flags:"
+const FeatureFlagCacheTime = 30 * time.Second
+
+// DownloadListKeyPrefix is prefixed to the id of a user for a hash of the cached first pages of
+// their list of downloads, by filter. It is deleted whenever a download of the user changes,
+// see InvalidateDownloadList, and expires once the last page cached in it is stale.
+const DownloadListKeyPrefix = "download_list:"
+
+// acquireLockScript sets the lock if it is free, or refreshes it if it is already held
+// with the same token. The latter lets a restarted process reclaim the locks it
+// checkpointed on shutdown instead of waiting for them to expire.
+var acquireLockScript = redis.NewScript(`
+local v = redis.call('GET', KEYS[1])
+if v == false then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+	return 1
+end
+if v == ARGV[1] then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// rateLimitScript implements a sliding window log: every hit is a member of a sorted set
+// scored by its timestamp, and hits older than the window are trimmed before counting.
+// A request of several hits is allowed only if all of them fit, and then records all of them.
+// It returns whether the hits are allowed, the hits in the window, and ms until the oldest hit expires.
+var rateLimitScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+local hits = tonumber(ARGV[5])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], 0, now - window)
+local count = redis.call('ZCARD', KEYS[1])
+local allowed = 0
+if count + hits <= limit then
+	for i = 1, hits do
+		redis.call('ZADD', KEYS[1], now, ARGV[4] .. '-' .. i)
+	end
+	redis.call('PEXPIRE', KEYS[1], window)
+	count = count + hits
+	allowed = 1
+end
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+local reset = window
+if oldest[2] then
+	reset = tonumber(oldest[2]) + window - now
+end
+return {allowed, count, reset}
+`)
+
+// acquireSlotScript drops the expired slots of the sorted set and takes one for the download
+// until now + ttl, if it holds none and fewer than limit are taken. It returns 0 when all of
+// them are taken, 1 when it took one, 2 when the download held one already, which is extended.
+var acquireSlotScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local ttl = tonumber(ARGV[4])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], 0, now)
+local result = 2
+if redis.call('ZSCORE', KEYS[1], ARGV[2]) == false then
+	if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[3]) then
+		return 0
+	end
+	result = 1
+end
+redis.call('ZADD', KEYS[1], now + ttl, ARGV[2])
+redis.call('PEXPIRE', KEYS[1], ttl)
+return result
+`)
+
+// acquireConnectionsScript drops the expired slots of the sorted set and takes, or extends, the
+// slots of the connections 0 to want-1 of the download until now + ttl, as long as fewer than
+// limit are taken. It returns how many it holds, and 1 if it held the first one already.
+var acquireConnectionsScript = redis.NewScript(`
+local now, limit, ttl = tonumber(ARGV[1]), tonumber(ARGV[3]), tonumber(ARGV[4])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+local held = 0
+if redis.call('ZSCORE', KEYS[1], ARGV[2] .. ':0') then
+	held = 1
+end
+local count = 0
+for i = 0, tonumber(ARGV[5]) - 1 do
+	local member = ARGV[2] .. ':' .. i
+	if not redis.call('ZSCORE', KEYS[1], member) and redis.call('ZCARD', KEYS[1]) >= limit then
+		break
+	end
+	redis.call('ZADD', KEYS[1], now + ttl, member)
+	count = count + 1
+end
+redis.call('PEXPIRE', KEYS[1], ttl)
+return {count, held}
+`)
+
+// takeBandwidthScript records that the process ARGV[3] wants ARGV[1] bytes in the slice and
+// takes at most its max-min fair share of the budget ARGV[2] of the slice, given the bytes the
+// processes wanted in the previous slice, out of what is left of it. KEYS[1] counts the bytes
+// taken in the slice, KEYS[2] and KEYS[3] hold the wants of the slice and of the previous one.
+var takeBandwidthScript = redis.NewScript(`
+local want, budget = tonumber(ARGV[1]), tonumber(ARGV[2])
+redis.call('HSET', KEYS[2], ARGV[3], want)
+redis.call('PEXPIRE', KEYS[2], ARGV[4])
+
+local wants = {want}
+local previous = redis.call('HGETALL', KEYS[3])
+for i = 1, #previous, 2 do
+	if previous[i] ~= ARGV[3] then
+		table.insert(wants, tonumber(previous[i + 1]))
+	end
+end
+table.sort(wants)
+local share, left = budget, budget
+for i, w in ipairs(wants) do
+	share = math.floor(left / (#wants - i + 1))
+	if w > share then
+		break
+	end
+	left = left - w
+end
+
+local taken = math.min(want, share, budget - tonumber(redis.call('GET', KEYS[1]) or '0'))
+if taken <= 0 then
+	return 0
+end
+redis.call('INCRBY', KEYS[1], taken)
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+return taken
+`)
+
+// joinQueueUsersScript bumps the version of the user and gives them turns, starting at the
+// turns of the user served next so that they do not get the turns they missed.
+var joinQueueUsersScript = redis.NewScript(`
+redis.call('HSET', KEYS[2], ARGV[1], redis.call('INCR', KEYS[3]))
+if redis.call('ZSCORE', KEYS[1], ARGV[1]) == false then
+	local first = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+	redis.call('ZADD', KEYS[1], first[2] or 0, ARGV[1])
+end
+return 1
+`)
+
+// takeTurnScript returns the user with the fewest turns, with their version, and counts the
+// turn. It returns nil when no user has queued requests.
+var takeTurnScript = redis.NewScript(`
+local first = redis.call('ZRANGE', KEYS[1], 0, 0)
+if #first == 0 then
+	return false
+end
+redis.call('ZINCRBY', KEYS[1], 1, first[1])
+return {first[1], redis.call('HGET', KEYS[2], first[1]) or '0'}
+`)
+
+// leaveQueueUsersScript takes the user out of turn, unless a request was pushed for them since
+// their version was read.
+var leaveQueueUsersScript = redis.NewScript(`
+if redis.call('HGET', KEYS[2], ARGV[1]) ~= ARGV[2] then
+	return 0
+end
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('HDEL', KEYS[2], ARGV[1])
+return 1
+`)
+
+var extendLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+var releaseLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// clearOwnerScript forgets the owner of a download unless the download was taken over.
+var clearOwnerScript = redis.NewScript(`
+local owner = redis.call('HGET', KEYS[1], ARGV[1])
+if owner and cjson.decode(owner)['token'] == ARGV[2] then
+	return redis.call('HDEL', KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+// reapOwnerScript releases the lock of a download on behalf of its dead owner, and forgets the
+// owner. It returns 1 when the download is left without a lock, 0 when it was taken over.
+var reapOwnerScript = redis.NewScript(`
+local owner = redis.call('HGET', KEYS[1], ARGV[1])
+if not owner or cjson.decode(owner)['token'] ~= ARGV[2] then
+	return 0
+end
+redis.call('HDEL', KEYS[1], ARGV[1])
+local token = redis.call('GET', KEYS[2])
+if token == ARGV[2] then
+	redis.call('DEL', KEYS[2])
+	return 1
+end
+if token then
+	return 0
+end
+return 1
+`)
+
+const (
+	StatusQueued      = "queued"
+	StatusDownloading = "downloading"
+	StatusCompleted   = "completed"
+	StatusFailed      = "failed"
+	StatusExpired     = "expired" // not started before its TTL ran out
+)
+
+// Statuses are the statuses of the downloads.
+var Statuses = []string{StatusQueued, StatusDownloading, StatusCompleted, StatusFailed, StatusExpired}
+
+// Types of the queue events, recorded along with the state changes of the downloads.
+const (
+	QueueEventEnqueued  = "enqueued"
+	QueueEventClaimed   = "claimed"
+	QueueEventCompleted = "completed"
+	QueueEventFailed    = "failed"
+	QueueEventExpired   = "expired"
+	QueueEventScript    = "script" // a completion script ran, its ScriptRun is the detail
+)
+
+// Outcomes of verifying a download against its manifest.
+const (
+	VerificationVerified   = "verified"
+	VerificationMismatch   = "mismatch"   // the download fails
+	VerificationUnverified = "unverified" // the manifest could not be fetched or has no entry for the file
+)
+
+// Storage tiers of the files of completed downloads.
+const (
+	TierHot       = "hot"       // on the disk of the host
+	TierCold      = "cold"      // in cold storage only
+	TierRestoring = "restoring" // in cold storage, to be copied back to a disk
+)
+
+// CanceledError is the error of the download requests canceled by their users.
+const CanceledError = "Canceled by the user"
+
+// Classes of the errors of failed downloads, for clients to tell them apart without parsing
+// the error.
+const (
+	ErrorCodeHTMLPage = "html_error_page" // the origin sent an HTML page (error, login, captcha) instead of the file
+	ErrorCodeMalware  = "malware"         // the virus scan found malware in the file, which is quarantined
+
+	ErrorCodeInsufficientStorage = "insufficient_storage" // the file did not fit on the disk of the worker
+)
+
+// QueueEntry is a download request read from a queue.
+type QueueEntry struct {
+	Stream     string // key of the queue
+	ID         string // of the entry in the queue
+	DownloadID int64
+}
+
+// Domain errors, matched with errors.Is. The errors of the repository wrap them and the API
+// answers them with their status, e.g. 404 for ErrNotFound (see handler.ErrorHandler).
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrDuplicateUser = errors.New("this username is already taken")
+	ErrDuplicateLink = errors.New("this link is already requested")
+	ErrForbidden     = errors.New("forbidden")
+)
 
 var NoMoreDownloadRequestErr = errors.New("There is no more download request in queue")
+var DownloadRequestNotFoundErr = fmt.Errorf("download request %w", ErrNotFound)
 
 type downloadRequest struct {
 	ID        int64
@@ -24,168 +361,3224 @@ type downloadRequest struct {
 	FileName  string // relative path (either stored in local disk or S3)
 	Completed bool
 	Error     string // any error happended during downloading from destination
+	Priority  int64  // weight of the download when sharing bandwidth
+	// sha256 of the completed file, set when content deduplication is enabled
+	ContentHash string
+	Status      string     // one of the Status* constants
+	ExpiresAt   *time.Time // when a queued request expires if it has not started, nil means never
+	Credentials string     `json:"-"` // sealed Credentials for the origin, empty if none
+	Headers     string     `json:"-"` // sealed Headers sent with the HTTP requests, empty if none
+	Labels      map[string]string
+	Range       string // "<first>-[<last>]" bytes to download, empty for the whole file
+	// OriginProfile whose credentials authenticate the requests to the origin, nil if none
+	OriginProfileID *int64
+	MaxSpeed        int64 // bytes per second the transfer is throttled to, 0 for unlimited
+	// checksum manifest (SHA256SUMS, checksum JSON or SLSA provenance) listing the file, empty if none
+	ManifestURL        string
+	Verification       string   // one of the Verification* constants, empty until verified
+	VerificationDetail string   // what was compared, or why it could not be
+	FolderID           *int64   // nil if the download is in no folder
+	Mirrors            []string // links of the same file to fail over to, in order
+	Host               string   `json:"-"` // instance ID of the process whose disk holds the file, empty if none
+	Tier               string   // one of the Tier* constants
+	ColdKey            string   `json:"-"` // key of the file in cold storage, empty while it is hot
+	Tuning             Tuning
+	Proxy              string     `json:"-"` // sealed URL of the proxy the requests go through, empty for DOWNLOAD_PROXY
+	ErrorCode          string     // one of the ErrorCode* constants when the error is classified, empty otherwise
+	Bytes              *int64     // size of the completed file, nil until completed
+	DeletedAt          *time.Time // when its owner moved it to the trash, nil unless it is there
+	OrgID              *int64     // organization the download was requested for, nil for none
+	Metadata           *Metadata  // of the completed file, nil until it is extracted
+	// Of a running download, from its progress when it is listed: bytes per second and seconds
+	// remaining, nil otherwise or if unknown.
+	BytesPerSec *int64
+	ETASeconds  *int64
+}
+
+// DownloadRequest names downloadRequest for the implementations of Repository outside of this
+// package, such as the mock and the fake of package repositorytest.
+type DownloadRequest = downloadRequest
+
+// NewDownload holds the fields of a download request to create.
+type NewDownload struct {
+	UserID          int64
+	Link            string
+	FileName        string
+	Priority        int64
+	ExpiresAt       *time.Time
+	Credentials     string // sealed Credentials
+	Headers         string // sealed Headers
+	Labels          map[string]string
+	Range           string // see downloadRequest.Range
+	OriginProfileID *int64
+	MaxSpeed        int64 // see downloadRequest.MaxSpeed
+	ManifestURL     string
+	FolderID        *int64
+	Mirrors         []string
+	Tuning          Tuning
+	Proxy           string   // sealed proxy URL
+	CollectionID    *int64   // collection the download is added to, nil for none
+	Pipeline        []string // names of the steps run on the file once it completes
+	OrgID           *int64   // organization the download is requested for, nil for none
+}
+
+// Credentials to log into the origin of a download (FTP/SFTP), stored sealed.
+type Credentials struct {
+	Username   string `json:"username"`
+	Password   string `json:"password,omitempty"`
+	PrivateKey string `json:"private_key,omitempty"` // PEM, for SFTP
+	HostKey    string `json:"host_key,omitempty"`    // expected SFTP host key in authorized_keys format
+}
+
+// Tuning overrides how a download is transferred, for unusual origins such as satellite links
+// or flaky CDNs. A zero field keeps the default of the workers.
+type Tuning struct {
+	ReadTimeoutSeconds  int64  `json:"read_timeout_seconds,omitempty"`  // the attempt fails when a read from the origin takes longer
+	ChunkSizeBytes      int64  `json:"chunk_size_bytes,omitempty"`      // read from the origin at once
+	FlushThresholdBytes int64  `json:"flush_threshold_bytes,omitempty"` // written between syncs of the file and progress updates
+	TCPCongestion       string `json:"tcp_congestion,omitempty"`        // congestion control algorithm of the connections, Linux only
+	ContentEncoding     string `json:"content_encoding,omitempty"`      // one of the ContentEncoding* constants, empty for ContentEncodingIdentity
+}
+
+// How a download treats compressed (gzip, deflate) responses.
+const (
+	ContentEncodingIdentity   = "identity"   // asks for the file uncompressed, and decodes it if the origin compresses it anyway
+	ContentEncodingDecompress = "decompress" // asks for it compressed and decodes it while it is received
+	ContentEncodingStore      = "store"      // asks for it compressed and stores it as received
+)
+
+// Headers are the request headers of an HTTP download, e.g. a Cookie or a Referer, stored
+// sealed since they often carry a session.
+type Headers map[string]string
+
+// ParseByteRange parses the Range of a download: "<first>-<last>" (inclusive) or "<first>-"
+// up to the end of the file, in which case last is -1.
+func ParseByteRange(byteRange string) (first int64, last int64, err error) {
+	firstStr, lastStr, ok := strings.Cut(byteRange, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid range %q: expected <first>-<last>", byteRange)
+	}
+	first, err = strconv.ParseInt(firstStr, 10, 64)
+	if err != nil || first < 0 {
+		return 0, 0, fmt.Errorf("invalid range %q: invalid first byte", byteRange)
+	}
+	if lastStr == "" {
+		return first, -1, nil
+	}
+	last, err = strconv.ParseInt(lastStr, 10, 64)
+	if err != nil || last < first {
+		return 0, 0, fmt.Errorf("invalid range %q: last byte must be a number not less than the first", byteRange)
+	}
+	return first, last, nil
+}
+
+type ProxyCacheEntry struct {
+	URL          string    `json:"url"`
+	ContentHash  string    `json:"content_hash"`
+	ContentType  string    `json:"content_type"`
+	ETag         string    `json:"etag"`
+	LastModified string    `json:"last_modified"`
+	Size         int64     `json:"size"`
+	FetchedAt    time.Time `json:"fetched_at"`
+}
+
+// User is an account as seen by the admins.
+type User struct {
+	ID                    int64      `json:"id"`
+	Username              string     `json:"username"`
+	IsAdmin               bool       `json:"is_admin"`
+	Plan                  string     `json:"plan"`
+	StoredBytes           int64      `json:"stored_bytes"`
+	DisabledAt            *time.Time `json:"disabled_at"` // nil while the account is enabled
+	PasswordResetRequired bool       `json:"password_reset_required"`
+	RetentionSeconds      *int64     `json:"retention_seconds"` // overrides the retention of the plan, nil for none
+	DeletedAt             *time.Time `json:"deleted_at"`        // set while the account is being deleted
+	Email                 *string    `json:"email"`
+	EmailVerifiedAt       *time.Time `json:"email_verified_at"` // nil until the email is verified
+}
+
+var EmailTakenErr = errors.New("this email is already used by another account")
+
+// UserAuth is what decides whether a token of the user is still accepted.
+type UserAuth struct {
+	TokenVersion          int64 // the tokens of older versions are revoked
+	Disabled              bool
+	PasswordResetRequired bool
+}
+
+// Session is the metadata of a token, stored when it is issued. Revoking the session revokes
+// the token.
+type Session struct {
+	ID           string    `json:"id"`
+	TokenVersion int64     `json:"-"` // the session is revoked with the tokens of its version
+	IP           string    `json:"ip"`
+	UserAgent    string    `json:"user_agent"`
+	IssuedAt     time.Time `json:"issued_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// CachePolicy controls how long responses for URLs starting with URLPrefix are served from the proxy cache.
+type CachePolicy struct {
+	ID        int64  `json:"id"`
+	URLPrefix string `json:"url_prefix" validate:"required"`
+	MaxAge    int64  `json:"max_age_seconds" validate:"gte=0"`
+	NoStore   bool   `json:"no_store"`
+}
+
+// FeatureFlag enables a gated behavior for the users listed in UserIDs and for RolloutPercent
+// percent of the others. A disabled flag is off for everyone.
+type FeatureFlag struct {
+	Name           string    `json:"name"`
+	Enabled        bool      `json:"enabled"`
+	RolloutPercent int64     `json:"rollout_percent" validate:"gte=0,lte=100"`
+	UserIDs        []int64   `json:"user_ids"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// CompletionScript is run with Shell on the file of every completed download of the user.
+type CompletionScript struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"user_id"`
+	Name      string    `json:"name"`
+	Script    string    `json:"script"`
+	Timeout   int64     `json:"timeout_seconds"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ScriptRun is the outcome of a completion script on a download. ExitCode is -1 when the
+// script was killed or could not start, Error tells why it could not.
+type ScriptRun struct {
+	ScriptID  int64     `json:"script_id"`
+	Name      string    `json:"name"`
+	ExitCode  int       `json:"exit_code"`
+	TimedOut  bool      `json:"timed_out"`
+	Output    string    `json:"output"`
+	Duration  int64     `json:"duration_ms"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Progress of a running download, reported by its worker on every flush.
+type Progress struct {
+	Bytes      int64 `redis:"bytes"`
+	TotalBytes int64 `redis:"total_bytes"` // -1 if unknown
+	// bytes per second over the last seconds, and seconds remaining at that speed, -1 if unknown
+	BytesPerSec int64 `redis:"bytes_per_sec"`
+	ETA         int64 `redis:"eta_seconds"`
+	// Torrents only: pieces of the payload verified so far and uploaded/downloaded bytes,
+	// which keeps being reported while the completed payload is seeded.
+	Pieces          int64   `redis:"pieces,omitempty"`
+	PiecesCompleted int64   `redis:"pieces_completed,omitempty"`
+	SeedRatio       float64 `redis:"seed_ratio,omitempty"`
+	// HLS/DASH only: segments of the playlist written so far
+	Segments          int64 `redis:"segments,omitempty"`
+	SegmentsCompleted int64 `redis:"segments_completed,omitempty"`
+}
+
+// Metadata is what was found in the file of a completed download. Only the fields known for
+// its type are set.
+type Metadata struct {
+	ContentType     string  `json:"content_type"`               // sniffed from the contents of the file
+	Width           int     `json:"width,omitempty"`            // in pixels, of images and videos
+	Height          int     `json:"height,omitempty"`           // in pixels, of images and videos
+	DurationSeconds float64 `json:"duration_seconds,omitempty"` // of audio and videos
+	Pages           int     `json:"pages,omitempty"`            // of PDF documents
+}
+
+// Preflight is what the origin answered to the HEAD request sent before fetching the file of
+// an http(s) download, or to a GET of its first byte if it does not allow HEAD.
+type Preflight struct {
+	Size         int64      `json:"size"` // -1 if unknown
+	ContentType  string     `json:"content_type,omitempty"`
+	LastModified *time.Time `json:"last_modified,omitempty"`
+	ETag         string     `json:"etag,omitempty"`
+	AcceptRanges bool       `json:"accept_ranges"` // the origin serves byte ranges of the file
+	CheckedAt    time.Time  `json:"checked_at"`
+}
+
+// OutboxEntry is a download request waiting to be pushed to the queue.
+type OutboxEntry struct {
+	ID         int64
+	DownloadID int64
+}
+
+// Attempt is one try of a worker at a download request, kept for debugging.
+type Attempt struct {
+	ID              int64               `json:"id"`
+	DownloadID      int64               `json:"download_id"`
+	Worker          string              `json:"worker"` // host/worker id
+	Source          string              `json:"source"` // URL actually fetched, e.g. the selected mirror
+	StartedAt       time.Time           `json:"started_at"`
+	FinishedAt      *time.Time          `json:"finished_at"`
+	OffsetStart     int64               `json:"offset_start"` // byte range of the file covered by the attempt
+	OffsetEnd       int64               `json:"offset_end"`
+	Bytes           int64               `json:"bytes"`
+	StatusCode      int                 `json:"status_code"`
+	Protocol        string              `json:"protocol"`
+	ResponseHeaders map[string][]string `json:"response_headers"`
+	Error           string              `json:"error"`
+}
+
+// LinkProbe is a queued download whose link is due for a health probe.
+type LinkProbe struct {
+	DownloadID int64
+	UserID     int64
+	Link       string
+	Failures   int64 // probes in a row that found the link dead
+}
+
+type Notification struct {
+	ID         int64     `json:"id"`
+	DownloadID int64     `json:"download_id"`
+	Message    string    `json:"message"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Hook is a secret URL through which external systems enqueue downloads on behalf of a user.
+// Only the sha256 of its token is stored.
+type Hook struct {
+	ID         int64    `json:"id"`
+	UserID     int64    `json:"user_id"`
+	Name       string   `json:"name"`
+	TokenHash  string   `json:"-"`
+	RateLimit  int64    `json:"rate_limit"`  // calls per rate limit window, 0 means unlimited
+	AllowedIPs []string `json:"allowed_ips"` // IPs or CIDRs the hook may be called from, empty means any
+	Priority   int64    `json:"priority"`    // preset of the downloads it creates
+}
+
+// Kinds of origin profiles.
+const (
+	OriginProfileBasic  = "basic"  // HTTP basic auth, or the login of ftp/sftp links
+	OriginProfileBearer = "bearer" // a static bearer token
+	OriginProfileOAuth2 = "oauth2" // bearer tokens of the OAuth2 client credentials flow
+)
+
+// OriginProfile is a named set of credentials for an authenticated origin (an API, an
+// artifact registry), which downloads refer to instead of carrying the secrets themselves.
+type OriginProfile struct {
+	ID     int64  `json:"id"`
+	UserID int64  `json:"user_id"`
+	Name   string `json:"name"`
+	Kind   string `json:"kind"` // one of the OriginProfile* constants
+	Secret string `json:"-"`    // sealed OriginSecret
+	// Hosts whose downloads use the profile when they have no profile or credentials of their
+	// own, e.g. "files.example.com" or "*.example.com" for its subdomains
+	Hosts     []string  `json:"hosts"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Folder organizes the downloads of a user in a tree.
+type Folder struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"user_id"`
+	ParentID  *int64    `json:"parent_id"` // nil at the top level
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Collection is a named group of downloads of a user. A download may be in several collections.
+type Collection struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"user_id"`
+	Name      string    `json:"name"`
+	Downloads int64     `json:"downloads"`
+	Role      string    `json:"role"` // of the user it was retrieved for, one of the CollectionRole* constants
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var CollectionExistsErr = errors.New("a collection with this name already exists")
+
+// Roles of the users in a collection. Only the owner shares it or removes the downloads of others.
+const (
+	CollectionRoleOwner       = "owner"
+	CollectionRoleContributor = "contributor" // also adds downloads of their own
+	CollectionRoleViewer      = "viewer"      // sees the downloads and the progress
+)
+
+// CollectionMember is a user a collection is shared with.
+type CollectionMember struct {
+	CollectionID int64     `json:"collection_id"`
+	UserID       int64     `json:"user_id"`
+	Username     string    `json:"username"`
+	Role         string    `json:"role"` // CollectionRoleContributor or CollectionRoleViewer
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Organization is a group of users who request downloads for it: all of its members see them,
+// and they count against the storage quota and the rate limit of the organization.
+type Organization struct {
+	ID         int64     `json:"id"`
+	Name       string    `json:"name"`
+	QuotaBytes *int64    `json:"quota_bytes"` // overrides ORG_QUOTA_BYTES, nil for none
+	RateLimit  *int64    `json:"rate_limit"`  // downloads per rate limit window, overrides RATE_LIMIT_ORG_DOWNLOADS, nil for none
+	Members    int64     `json:"members"`
+	Role       string    `json:"role"` // of the user it was retrieved for, one of the OrgRole* constants
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+var OrganizationExistsErr = errors.New("an organization with this name already exists")
+
+// Roles of the members of an organization.
+const (
+	OrgRoleOwner  = "owner"  // also changes the roles of admins and owners, and deletes the organization
+	OrgRoleAdmin  = "admin"  // also adds and removes members
+	OrgRoleMember = "member" // requests downloads for the organization and sees all of them
+)
+
+// OrganizationMember is a user of an organization.
+type OrganizationMember struct {
+	OrgID     int64     `json:"org_id"`
+	UserID    int64     `json:"user_id"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"` // one of the OrgRole* constants
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// PipelineStep is a step of the processing of a download once it completed, and how it went.
+type PipelineStep struct {
+	Position   int64      `json:"position"`
+	Name       string     `json:"name"`
+	Status     string     `json:"status"` // one of the PipelineStep* constants
+	Detail     string     `json:"detail,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  *time.Time `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+}
+
+// Statuses of a pipeline step.
+const (
+	PipelineStepPending   = "pending"
+	PipelineStepRunning   = "running"
+	PipelineStepSucceeded = "succeeded"
+	PipelineStepFailed    = "failed"
+	PipelineStepSkipped   = "skipped" // nothing to do on the file, or an earlier step failed
+)
+
+var (
+	FolderExistsErr = errors.New("a folder with this name already exists")
+	FolderCycleErr  = errors.New("a folder cannot be moved into itself or its subfolders")
+)
+
+// OriginSecret holds the secrets of an OriginProfile, the fields of its kind are set.
+type OriginSecret struct {
+	Username     string   `json:"username,omitempty"`      // basic
+	Password     string   `json:"password,omitempty"`      // basic
+	Token        string   `json:"token,omitempty"`         // bearer
+	TokenURL     string   `json:"token_url,omitempty"`     // oauth2
+	ClientID     string   `json:"client_id,omitempty"`     // oauth2
+	ClientSecret string   `json:"client_secret,omitempty"` // oauth2
+	Scopes       []string `json:"scopes,omitempty"`        // oauth2
+}
+
+// TimelineBucket counts the queue events of one time bucket starting at Start.
+type TimelineBucket struct {
+	Start     time.Time `json:"start"`
+	Enqueued  int64     `json:"enqueued"` // pushed to the queue, including requeues
+	Claimed   int64     `json:"claimed"`  // started by a worker
+	Completed int64     `json:"completed"`
+	Failed    int64     `json:"failed"`
+	Expired   int64     `json:"expired"`
+}
+
+// WorkerHeartbeat is what a worker of any process last reported about itself. Heartbeats
+// expire, so workers of processes that are gone drop out.
+type WorkerHeartbeat struct {
+	Worker      string    `json:"worker"`      // host/id, as recorded with the attempts
+	InstanceID  string    `json:"instance_id"` // of the process
+	State       string    `json:"state"`
+	DownloadID  int64     `json:"download_id,omitempty"`
+	Bytes       int64     `json:"bytes,omitempty"` // received in the current download
+	BytesPerSec float64   `json:"bytes_per_sec"`
+	Restarts    int       `json:"restarts"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// DownloadOwner is the worker holding the lock of a download, so that the download is requeued
+// as soon as the heartbeat of the worker expires rather than once its lock does.
+type DownloadOwner struct {
+	Worker     string    `json:"worker"` // host/id, as in the heartbeats
+	InstanceID string    `json:"instance_id"`
+	Token      string    `json:"token"` // of the lock
+	Since      time.Time `json:"since"`
+}
+
+// ProcessHeartbeat is what a process of the API, the workers or both reports about itself.
+type ProcessHeartbeat struct {
+	InstanceID string    `json:"instance_id"`
+	Hostname   string    `json:"hostname"`
+	Mode       string    `json:"mode"` // api, worker or all
+	Version    string    `json:"version"`
+	Workers    int       `json:"workers"` // 0 for the API
+	StartedAt  time.Time `json:"started_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Names of the directories whose volume a process reports.
+const (
+	VolumeDownloads      = "downloads"       // the files of the downloads, with the reservations of the running ones
+	VolumeContentStore   = "content_store"   // CONTENT_STORE_DIR
+	VolumeTorrents       = "torrents"        // TORRENT_DATA_DIR
+	VolumePartialArchive = "partial_archive" // PARTIAL_FILE_ARCHIVE_DIR
+	VolumeQuarantine     = "quarantine"      // QUARANTINE_DIR
+)
+
+// Volume is the capacity of the volume of a directory a process writes files to, as the
+// process last reported it. Directories on the same volume report the same capacity.
+type Volume struct {
+	Host          string    `json:"host"` // hostname of the process, as in the names of its workers
+	Name          string    `json:"name"` // one of the Volume* constants
+	Path          string    `json:"path"`
+	TotalBytes    int64     `json:"total_bytes"`
+	FreeBytes     int64     `json:"free_bytes"`     // available to the process
+	ReservedBytes int64     `json:"reserved_bytes"` // still expected by the running downloads
+	MinFreeBytes  int64     `json:"min_free_bytes"` // that the downloads must leave free
+	Error         string    `json:"error,omitempty"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// DownloadSummary is a download as shown on the admin dashboard.
+type DownloadSummary struct {
+	ID         int64      `json:"id"`
+	UserID     int64      `json:"user_id"`
+	Link       string     `json:"link"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  *time.Time `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Attempts   int64      `json:"attempts"`
+	Retries    int64      `json:"retries"` // attempts after the first one
+}
+
+// Lock is the lock of a download request held by a worker or a background job.
+type Lock struct {
+	DownloadID int64
+	Token      string
+	TTL        time.Duration // -1 if it never expires
+}
+
+// RequeueFilter selects the download requests to requeue, zero fields match any.
+type RequeueFilter struct {
+	Status    string // StatusQueued, StatusDownloading or StatusFailed
+	UserID    int64
+	Host      string
+	ErrorCode string // failed downloads with ErrorCodeMalware only match it explicitly
+	Since     time.Time
+	Until     time.Time
+	Limit     int64
+}
+
+// AuditEntry records an action of a user or an admin in the audit log.
+type AuditEntry struct {
+	ID       int64  `json:"id"`
+	UserID   *int64 `json:"user_id"`            // nil if the request was not authenticated
+	Username string `json:"username,omitempty"` // given to register or log in
+	// e.g. "POST /downloads/:id/cancel", or the gRPC method
+	Action    string    `json:"action"`
+	Resource  string    `json:"resource"` // e.g. "/downloads/42/cancel"
+	IP        string    `json:"ip"`
+	Status    string    `json:"status"` // the HTTP status, or the gRPC code
+	Result    string    `json:"result"` // AuditResultSuccess or AuditResultFailure
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Results of an audited action.
+const (
+	AuditResultSuccess = "success"
+	AuditResultFailure = "failure"
+)
+
+// AuditFilter selects the entries of the audit log to list, zero fields match any.
+type AuditFilter struct {
+	UserID *int64
+	Action string // contained in the action
+	Result string
+	Since  time.Time
+	Until  time.Time
+}
+
+// QueueStats is a snapshot of the download queue and of the downloads by state.
+type QueueStats struct {
+	Queued    int64 // ids in the redis queues, including the unacknowledged ones
+	Unacked   int64 // ids read by a worker that did not claim or let go of them yet
+	Pending   int64 // queued or downloading
+	Completed int64
+	Failed    int64
+	Expired   int64
+}
+
+// IdempotentResponse is the response to a request made with an Idempotency-Key, replayed to
+// the retries of the request.
+type IdempotentResponse struct {
+	Fingerprint string `json:"fingerprint"` // of the request, the key is only valid for the same request
+	Status      int    `json:"status"`      // 0 while the request is in progress
+	ContentType string `json:"content_type"`
+	Body        []byte `json:"body"`
+}
+
+type RateLimitResult struct {
+	Allowed   bool
+	Remaining int64
+	Reset     time.Duration // until a slot frees up in the window
 }
 
 type repository struct {
-	db  *pgx.Conn
-	rdb *redis.Client
-	_   struct{}
+	db    *pgxpool.Pool
+	rdb   *redis.Client
+	queue Queue
+	_     struct{}
 }
 
 type Repository interface {
 	GetDownloadRequest(ctx context.Context, downloadID int64) (downloadRequest, error)
-	GetDownloadRequests(ctx context.Context, userID int64, page int64, limit int64) ([]downloadRequest, error)
-	CreateDownloadRequest(ctx context.Context, userID int64, link string, fileName string) (int64, error)
-	CompleteDownloadRequest(ctx context.Context, downloadID int64) error
+	// GetDownloadRequestForUser gets a download of the user. It fails with
+	// DownloadRequestNotFoundErr if the download does not exist or another user owns it.
+	GetDownloadRequestForUser(ctx context.Context, userID int64, downloadID int64) (downloadRequest, error)
+	// GetDownloadRequests returns a page of downloads, and the cursor of the next one if the page
+	// is full.
+	GetDownloadRequests(ctx context.Context, userID int64, page int64, limit int64, filter DownloadFilter) ([]downloadRequest, *DownloadCursor, error)
+	// ExportDownloadRequests returns the next limit downloads of the user selected by the filter,
+	// by id after afterID, deleted ones included.
+	ExportDownloadRequests(ctx context.Context, userID int64, filter ExportFilter, afterID int64, limit int64) ([]ExportedDownload, error)
+	// GetCachedDownloadRequests is GetDownloadRequests with the first pages cached for ttl, unless
+	// InvalidateDownloadList is called meanwhile. A ttl of 0 bypasses the cache.
+	GetCachedDownloadRequests(ctx context.Context, userID int64, page int64, limit int64, filter DownloadFilter, ttl time.Duration) ([]downloadRequest, *DownloadCursor, error)
+	// InvalidateDownloadList drops the cached pages of the list of downloads of the user. Every
+	// writer changing a download of the user, or the folders listing it, calls it.
+	InvalidateDownloadList(ctx context.Context, userID int64) error
+	FindDownloadRequest(ctx context.Context, userID int64, link string, byteRange string) (downloadRequest, bool, error)
+	FileNameExists(ctx context.Context, fileName string) (bool, error)
+	CreateDownloadRequest(ctx context.Context, download NewDownload) (int64, error)
+	// CreateDownloadRequests creates the download requests in one transaction, all of them or
+	// none, and returns their ids in order. The id is 0 for a link and range the user requested
+	// concurrently, which is left as it is.
+	CreateDownloadRequests(ctx context.Context, downloads []NewDownload) ([]int64, error)
+	GetOutbox(ctx context.Context, limit int64) ([]OutboxEntry, error)
+	MarkOutboxSent(ctx context.Context, entryIDs []int64) error
+	PurgeOutbox(ctx context.Context, olderThan time.Duration) error
+	// SpillDownloadRequests moves up to limit of the newest requests no worker read yet from the
+	// queues of the users back to the outbox and returns how many it moved.
+	SpillDownloadRequests(ctx context.Context, limit int64) (int64, error)
+	// GetOutboxLength returns how many entries wait in the outbox.
+	GetOutboxLength(ctx context.Context) (int64, error)
+	// GetRedisMemory returns the bytes Redis uses for its data.
+	GetRedisMemory(ctx context.Context) (int64, error)
+	// StartDownloadRequest marks the request as downloading by the process with the instance ID host.
+	StartDownloadRequest(ctx context.Context, downloadID int64, host string) (bool, error)
+	ExpireDownloadRequests(ctx context.Context, downloadID int64) (map[int64]int64, error)
+	// ClaimLinkProbes returns up to limit queued and never started http(s) downloads whose link is
+	// due for a probe, and pushes their next probe lease later so other processes skip them.
+	// Downloads waiting less than interval, and those with credentials, headers, an origin
+	// profile, a proxy or mirrors are left alone.
+	ClaimLinkProbes(ctx context.Context, interval time.Duration, lease time.Duration, limit int64) ([]LinkProbe, error)
+	// SetLinkProbe records the probes in a row that found the link dead and when it is probed next.
+	SetLinkProbe(ctx context.Context, downloadID int64, failures int64, next time.Duration) error
+	// FailDeadLink fails the download if it is still queued and never started, and notifies its
+	// owner. It reports whether it did.
+	FailDeadLink(ctx context.Context, downloadID int64, reason string) (bool, error)
+	GetUnfinishedDownloadRequests(ctx context.Context, idleFor time.Duration) ([]downloadRequest, error)
+	RequeueDownloadRequest(ctx context.Context, downloadID int64) error
+	// CompleteDownloadRequest marks a downloading request completed with a file of size bytes,
+	// once: it returns false if the request is no longer downloading (e.g. canceled or already
+	// completed) or size is not the one expected with SetExpectedBytes.
+	CompleteDownloadRequest(ctx context.Context, downloadID int64, size int64) (bool, error)
+	// SetExpectedBytes records the size of the file announced by the origin, -1 if unknown.
+	SetExpectedBytes(ctx context.Context, downloadID int64, size int64) error
+	// SetPreflight records the preflight of the latest attempt at the download.
+	SetPreflight(ctx context.Context, downloadID int64, preflight Preflight) error
+	// GetPreflight returns the preflight of the latest attempt at the download, if any.
+	GetPreflight(ctx context.Context, downloadID int64) (Preflight, bool, error)
+	// SetMetadata records the metadata of the completed file of the download.
+	SetMetadata(ctx context.Context, downloadID int64, metadata Metadata) error
+	// ResumeDownloadRequest requeues a downloading request whose transfer the origin cut, to the
+	// process with its partial file, unless it was resumed maxResumes times already.
+	ResumeDownloadRequest(ctx context.Context, downloadID int64, maxResumes int64) (bool, error)
+	CreateAttempt(ctx context.Context, attempt Attempt) (int64, error)
+	FinishAttempt(ctx context.Context, attempt Attempt) error
+	GetAttempts(ctx context.Context, downloadID int64) ([]Attempt, error)
 	MarkError(ctx context.Context, downloadID int64, err string) error
-	CreateUser(ctx context.Context, username string, hashedPassword string) (int64, error)
+	// QuarantineDownload fails a completed download whose file is infected with ErrorCodeMalware,
+	// and notifies its owner. It returns false if the download is not completed.
+	QuarantineDownload(ctx context.Context, downloadID int64, reason string) (bool, error)
+	// MarkErrorCode fails the download request like MarkError, with the class of its error.
+	MarkErrorCode(ctx context.Context, downloadID int64, code string, err string) error
+	// CancelDownloadRequest fails a queued or downloading download request with CanceledError.
+	// It returns false if the download request has already finished.
+	CancelDownloadRequest(ctx context.Context, downloadID int64) (bool, error)
+	// SetMaxSpeed changes the speed limit of a download request, picked up by its worker while it runs.
+	SetMaxSpeed(ctx context.Context, downloadID int64, maxSpeed int64) error
+	// SetVerification records the outcome of verifying a download against its manifest.
+	SetVerification(ctx context.Context, downloadID int64, verification string, detail string) error
+	SetContentHash(ctx context.Context, downloadID int64, hash string) error
+	AddContentRef(ctx context.Context, hash string, size int64) (int64, error)
+	ReleaseContentRef(ctx context.Context, hash string) (int64, error)
+	// CreateUser returns EmailTakenErr if another account has the email, empty for none.
+	CreateUser(ctx context.Context, username string, hashedPassword string, email string) (int64, error)
+	// SetUserEmail changes the email of the user, which is verified again unless it is the
+	// same. It returns EmailTakenErr if another account has it.
+	SetUserEmail(ctx context.Context, userID int64, email string) error
+	// GetUserByEmail returns the user with the email, whatever its case.
+	GetUserByEmail(ctx context.Context, email string) (User, bool, error)
+	// VerifyEmail marks the email of the user as verified and reports whether it still is the
+	// email of the user.
+	VerifyEmail(ctx context.Context, userID int64, email string) (bool, error)
+	SaveEmailVerificationToken(ctx context.Context, tokenHash string, userID int64, email string, ttl time.Duration) error
+	// TakeEmailVerificationToken returns the user and the email of the token and deletes it, so
+	// it is used once.
+	TakeEmailVerificationToken(ctx context.Context, tokenHash string) (int64, string, bool, error)
 	AuthUser(ctx context.Context, username string, hashedPassword string) (int64, error)
+	// FindUser returns the id of the user with the username, if there is one.
+	FindUser(ctx context.Context, username string) (int64, bool, error)
+	IsAdmin(ctx context.Context, userID int64) (bool, error)
+	GetUserAuth(ctx context.Context, userID int64) (UserAuth, bool, error)
+	GetUser(ctx context.Context, userID int64) (User, bool, error)
+	// SearchUsers lists the users whose username contains query, all of them if it is empty.
+	SearchUsers(ctx context.Context, query string, page int64, limit int64) ([]User, error)
+	// SetUserRetention sets how long the finished downloads of the user are kept, nil for the
+	// retention of its plan, and reports whether the user exists.
+	SetUserRetention(ctx context.Context, userID int64, retention *time.Duration) (bool, error)
+	// SetUserDisabled disables or enables an account and reports whether the user exists.
+	// Disabling it revokes its tokens. Deleted accounts are not enabled again.
+	SetUserDisabled(ctx context.Context, userID int64, disabled bool) (bool, error)
+	// RequirePasswordReset revokes the tokens of the user and refuses its password until it is
+	// reset. It reports whether the user exists.
+	RequirePasswordReset(ctx context.Context, userID int64) (bool, error)
+	// ResetPassword sets the password of the user and revokes its tokens.
+	ResetPassword(ctx context.Context, userID int64, hashedPassword string) error
+	// DeleteAccount starts the deletion of an account: it disables it, revoking its tokens,
+	// deletes its hooks, cancels its downloads that are not finished and requests the purge of
+	// all of them. It reports whether the user exists and was not deleted already.
+	DeleteAccount(ctx context.Context, userID int64) (bool, error)
+	// DeletePurgedAccounts removes the deleted accounts with no download left, with everything
+	// they own, and returns how many it removed.
+	DeletePurgedAccounts(ctx context.Context) (int64, error)
+	// GetUserDownloadRequests returns all the download requests of the user.
+	GetUserDownloadRequests(ctx context.Context, userID int64) ([]downloadRequest, error)
+	// AddSession stores the session of a token issued to the user.
+	AddSession(ctx context.Context, userID int64, session Session) error
+	// GetSession returns the session of the user if it is not revoked or expired.
+	GetSession(ctx context.Context, userID int64, sessionID string) (Session, bool, error)
+	// GetSessions lists the sessions of the user that are not revoked or expired, the latest
+	// first.
+	GetSessions(ctx context.Context, userID int64) ([]Session, error)
+	// DeleteSession revokes a session of the user and reports whether it existed.
+	DeleteSession(ctx context.Context, userID int64, sessionID string) (bool, error)
+	SavePasswordResetToken(ctx context.Context, tokenHash string, userID int64, ttl time.Duration) error
+	// TakePasswordResetToken returns the user of the token and deletes it, so it is used once.
+	TakePasswordResetToken(ctx context.Context, tokenHash string) (int64, bool, error)
+	// GetUserDownloadCounts counts the downloads of the user by status.
+	GetUserDownloadCounts(ctx context.Context, userID int64) (map[string]int64, error)
+	GetUserPlan(ctx context.Context, userID int64) (string, error)
+	GetUserUsage(ctx context.Context, userID int64) (int64, error)
+	AddUserUsage(ctx context.Context, userID int64, bytes int64) (int64, error)
+	// PushDownloadRequest pushes the request to the queue of its user.
 	PushDownloadRequest(ctx context.Context, downloadID int64) error
-	PopDownloadRequest(ctx context.Context) (int64, error)
-	AcquireLock(ctx context.Context, downloadID int64, expiration time.Duration) (bool, error)
-	ReleaseLock(ctx context.Context, downloadID int64) error
-	ExtendLock(ctx context.Context, downloadID int64, expiration time.Duration) (bool, error)
+	// PushDownloadRequestToHost pushes the request to the queue of the process with the instance
+	// ID host while it is alive, to the queue of its user otherwise.
+	PushDownloadRequestToHost(ctx context.Context, downloadID int64, host string) error
+	// PopDownloadRequest reads a request for the worker consumer from the queue of the process
+	// with the instance ID host first, then from the queues of the users in turn, so that every
+	// user with queued requests gets the same share of the workers however many they queued,
+	// then from the shared queue. The entry stays pending until it is acknowledged.
+	PopDownloadRequest(ctx context.Context, host string, consumer string) (QueueEntry, error)
+	AckDownloadRequest(ctx context.Context, entry QueueEntry) error
+	// RequeueDeadHosts moves the requests queued for processes that are not alive anymore to
+	// the queues of their users and returns them.
+	RequeueDeadHosts(ctx context.Context) ([]int64, error)
+	// RestoreQueueUsers gives turns again to the users whose queue still holds requests, e.g.
+	// read by a worker that died before acknowledging them, and drops the other empty queues.
+	RestoreQueueUsers(ctx context.Context) error
+	SetInstanceHeartbeat(ctx context.Context, instanceID string, ttl time.Duration) error
+	IsInstanceAlive(ctx context.Context, instanceID string) (bool, error)
+	GetQueuedDownloadRequests(ctx context.Context) ([]int64, error)
+	GetQueueStats(ctx context.Context) (QueueStats, error)
+	// QueueDepth returns how many entries the shared queue and the queues of the users and of
+	// the hosts hold.
+	QueueDepth(ctx context.Context) (int64, error)
+	// OldestQueuedAge returns how long ago the oldest request not started yet was pushed, 0 if
+	// there is none.
+	OldestQueuedAge(ctx context.Context) (time.Duration, error)
+	// PruneQueuedAt forgets the push times of the requests that left the queues without being
+	// started, e.g. canceled or expired ones.
+	PruneQueuedAt(ctx context.Context) error
+	SetWorkerHeartbeats(ctx context.Context, heartbeats []WorkerHeartbeat, ttl time.Duration) error
+	GetWorkerHeartbeats(ctx context.Context) ([]WorkerHeartbeat, error)
+	IsWorkerAlive(ctx context.Context, worker string) (bool, error)
+	// SetDownloadOwner records the worker that locked the download, ClearDownloadOwner forgets
+	// it once the worker released the lock.
+	SetDownloadOwner(ctx context.Context, downloadID int64, owner DownloadOwner) error
+	ClearDownloadOwner(ctx context.Context, downloadID int64, token string) error
+	GetDownloadOwners(ctx context.Context) (map[int64]DownloadOwner, error)
+	// ReapDownloadOwner releases the lock the dead owner with the token holds on the download,
+	// and reports whether the download is left without a lock to be requeued.
+	ReapDownloadOwner(ctx context.Context, downloadID int64, token string) (bool, error)
+	SetProcessHeartbeat(ctx context.Context, heartbeat ProcessHeartbeat, ttl time.Duration) error
+	// GetProcessHeartbeats returns the heartbeats of all the processes, by instance ID.
+	GetProcessHeartbeats(ctx context.Context) ([]ProcessHeartbeat, error)
+	// SetVolumes records the volumes of the process with the hostname until the ttl expires.
+	SetVolumes(ctx context.Context, hostname string, volumes []Volume, ttl time.Duration) error
+	// GetVolumes returns the volumes of all the processes, by host and name.
+	GetVolumes(ctx context.Context) ([]Volume, error)
+	GetDownloadSummaries(ctx context.Context, downloadIDs []int64) ([]DownloadSummary, error)
+	GetRecentFailures(ctx context.Context, limit int64) ([]DownloadSummary, error)
+	// PingDB, PingRedis and PingQueue check the dependencies for the readiness probe.
+	PingDB(ctx context.Context) error
+	PingRedis(ctx context.Context) error
+	PingQueue(ctx context.Context) error
+	// GetSchemaVersion returns the latest version in the schema_migrations table, 0 for the
+	// databases created before it.
+	GetSchemaVersion(ctx context.Context) (int64, error)
+	GetStalePartialDownloads(ctx context.Context, olderThan time.Duration, limit int64) ([]downloadRequest, error)
+	MarkFilePurged(ctx context.Context, downloadID int64) error
+	GetQueueTimeline(ctx context.Context, from time.Time, to time.Time, bucket time.Duration) ([]TimelineBucket, error)
+	PurgeQueueEvents(ctx context.Context, olderThan time.Duration) error
+	SetProgress(ctx context.Context, downloadID int64, progress Progress) error
+	GetProgress(ctx context.Context, downloadID int64) (Progress, bool, error)
+	// GetProgresses returns the progress of the downloads in one round trip, leaving out those without one.
+	GetProgresses(ctx context.Context, downloadIDs []int64) (map[int64]Progress, error)
+	GetLockedDownloadRequests(ctx context.Context, downloadIDs []int64) (map[int64]bool, error)
+	AcquireLock(ctx context.Context, downloadID int64, token string, expiration time.Duration) (bool, error)
+	ReleaseLock(ctx context.Context, downloadID int64, token string) error
+	ExtendLock(ctx context.Context, downloadID int64, token string, expiration time.Duration) (bool, error)
+	// AcquireUserSlot takes one of the limit slots of the downloads of the user in progress for
+	// the download, for ttl, or extends the one the download holds already, which it reports
+	// with held. It reports false when the user has limit downloads in progress already.
+	AcquireUserSlot(ctx context.Context, userID int64, downloadID int64, limit int64, ttl time.Duration) (acquired bool, held bool, err error)
+	ReleaseUserSlot(ctx context.Context, userID int64, downloadID int64) error
+	// AcquireConnectionSlots takes up to want of the limit slots of the remote connections of
+	// all the processes for the download, for ttl, and extends the ones it holds already. It
+	// returns how many the download holds, 0 when all of them are taken, and reports with held
+	// that it held its first one already.
+	AcquireConnectionSlots(ctx context.Context, downloadID int64, want int64, limit int64, ttl time.Duration) (slots int64, held bool, err error)
+	ReleaseConnectionSlots(ctx context.Context, downloadID int64, slots int64) error
+	// TakeFleetBandwidth takes up to want bytes of the budget of the bandwidth of all the
+	// processes in the current slice of the given length for the process, and returns how many
+	// it took. A process gets at most its fair share while others want more.
+	TakeFleetBandwidth(ctx context.Context, process string, want int64, budget int64, slice time.Duration) (int64, error)
+	// RateLimit counts hits requests (e.g. the links of a batch) against the limit of the key.
+	RateLimit(ctx context.Context, key string, limit int64, window time.Duration, hits int64) (RateLimitResult, error)
+	// ReserveIdempotencyKey stores an in progress response of the request under the key for
+	// ttl, unless the key holds one already: that one is returned with false.
+	ReserveIdempotencyKey(ctx context.Context, key string, fingerprint string, ttl time.Duration) (IdempotentResponse, bool, error)
+	SaveIdempotentResponse(ctx context.Context, key string, response IdempotentResponse, ttl time.Duration) error
+	ReleaseIdempotencyKey(ctx context.Context, key string) error
+	GetProxyCacheEntry(ctx context.Context, url string) (ProxyCacheEntry, bool, error)
+	SaveProxyCacheEntry(ctx context.Context, entry ProxyCacheEntry) (string, error)
+	TouchProxyCacheEntry(ctx context.Context, url string) error
+	GetCachePolicies(ctx context.Context) ([]CachePolicy, error)
+	CreateCachePolicy(ctx context.Context, policy CachePolicy) (int64, error)
+	DeleteCachePolicy(ctx context.Context, policyID int64) error
+	GetFeatureFlags(ctx context.Context) ([]FeatureFlag, error)
+	// GetFeatureFlag returns the flag from the cache, or from the database on a miss.
+	GetFeatureFlag(ctx context.Context, name string) (FeatureFlag, bool, error)
+	SetFeatureFlag(ctx context.Context, flag FeatureFlag) (FeatureFlag, error)
+	DeleteFeatureFlag(ctx context.Context, name string) (bool, error)
+	GetNotifications(ctx context.Context, userID int64, limit int64) ([]Notification, error)
+	GetHooks(ctx context.Context, userID int64) ([]Hook, error)
+	GetHookByTokenHash(ctx context.Context, tokenHash string) (Hook, bool, error)
+	CreateHook(ctx context.Context, hook Hook) (int64, error)
+	DeleteHook(ctx context.Context, userID int64, hookID int64) (bool, error)
+	GetCompletionScripts(ctx context.Context, userID int64) ([]CompletionScript, error)
+	CreateCompletionScript(ctx context.Context, script CompletionScript) (int64, error)
+	DeleteCompletionScript(ctx context.Context, userID int64, scriptID int64) (bool, error)
+	// AddScriptRun records the run of a completion script as a QueueEventScript event.
+	AddScriptRun(ctx context.Context, downloadID int64, run ScriptRun) error
+	GetScriptRuns(ctx context.Context, downloadID int64) ([]ScriptRun, error)
+	GetOriginProfiles(ctx context.Context, userID int64) ([]OriginProfile, error)
+	GetOriginProfile(ctx context.Context, profileID int64) (OriginProfile, bool, error)
+	// FindOriginProfileForHost returns the profile of the user for the host, preferring an
+	// exact host over the closest wildcard and then the oldest profile.
+	FindOriginProfileForHost(ctx context.Context, userID int64, host string) (OriginProfile, bool, error)
+	CreateOriginProfile(ctx context.Context, profile OriginProfile) (int64, error)
+	DeleteOriginProfile(ctx context.Context, userID int64, profileID int64) (bool, error)
+	GetFolders(ctx context.Context, userID int64) ([]Folder, error)
+	GetFolder(ctx context.Context, folderID int64) (Folder, bool, error)
+	// CreateFolder returns FolderExistsErr if the parent already has a folder with the name.
+	CreateFolder(ctx context.Context, folder Folder) (int64, error)
+	// UpdateFolder renames and moves a folder. It returns FolderExistsErr if the new parent
+	// already has a folder with the name and FolderCycleErr if the new parent is in the folder.
+	UpdateFolder(ctx context.Context, folder Folder) error
+	// DeleteFolder deletes a folder of the user with its subfolders and reports whether it
+	// existed. Their downloads are left in no folder.
+	DeleteFolder(ctx context.Context, userID int64, folderID int64) (bool, error)
+	// GetCollections returns the collections of the user and those shared with them.
+	GetCollections(ctx context.Context, userID int64) ([]Collection, error)
+	GetCollection(ctx context.Context, collectionID int64) (Collection, bool, error)
+	// CreateCollection returns CollectionExistsErr if the user already has a collection with the name.
+	CreateCollection(ctx context.Context, collection Collection) (int64, error)
+	DeleteCollection(ctx context.Context, userID int64, collectionID int64) (bool, error)
+	// AddToCollection adds downloads of the user to the collection, unless some of them are not
+	// downloads of the user: it returns those and adds none.
+	AddToCollection(ctx context.Context, userID int64, collectionID int64, downloadIDs []int64) ([]int64, error)
+	RemoveFromCollection(ctx context.Context, collectionID int64, downloadID int64) (bool, error)
+	// GetCollectionStatuses returns the status of every download of the collection.
+	GetCollectionStatuses(ctx context.Context, collectionID int64) (map[int64]string, error)
+	GetCollectionMembers(ctx context.Context, collectionID int64) ([]CollectionMember, error)
+	GetCollectionMember(ctx context.Context, collectionID int64, userID int64) (CollectionMember, bool, error)
+	// SetCollectionMember shares the collection with the user, or changes the role of a member.
+	SetCollectionMember(ctx context.Context, member CollectionMember) error
+	RemoveCollectionMember(ctx context.Context, collectionID int64, userID int64) (bool, error)
+	// IsDownloadShared reports whether the download is in a collection the user owns or is a
+	// member of, or belongs to an organization of the user.
+	IsDownloadShared(ctx context.Context, userID int64, downloadID int64) (bool, error)
+	// GetOrganizations returns the organizations the user is a member of, with their role.
+	GetOrganizations(ctx context.Context, userID int64) ([]Organization, error)
+	GetOrganization(ctx context.Context, orgID int64) (Organization, bool, error)
+	// CreateOrganization creates an organization owned by the user. It returns
+	// OrganizationExistsErr if the name is taken.
+	CreateOrganization(ctx context.Context, name string, userID int64) (int64, error)
+	// DeleteOrganization deletes the organization, its downloads stay with their members.
+	DeleteOrganization(ctx context.Context, orgID int64) (bool, error)
+	// SetOrganizationLimits overrides the storage quota and the rate limit of the organization,
+	// nil for the defaults, and reports whether it exists.
+	SetOrganizationLimits(ctx context.Context, orgID int64, quotaBytes *int64, rateLimit *int64) (bool, error)
+	// GetOrganizationUsage returns the bytes the completed downloads of the organization store.
+	GetOrganizationUsage(ctx context.Context, orgID int64) (int64, error)
+	GetOrganizationMembers(ctx context.Context, orgID int64) ([]OrganizationMember, error)
+	GetOrganizationMember(ctx context.Context, orgID int64, userID int64) (OrganizationMember, bool, error)
+	// SetOrganizationMember adds the user to the organization, or changes the role of a member.
+	SetOrganizationMember(ctx context.Context, member OrganizationMember) error
+	RemoveOrganizationMember(ctx context.Context, orgID int64, userID int64) (bool, error)
+	GetPipelineSteps(ctx context.Context, downloadID int64) ([]PipelineStep, error)
+	// StartPipelineStep marks a step as running.
+	StartPipelineStep(ctx context.Context, downloadID int64, position int64) error
+	// FinishPipelineStep records how a step went, errMessage is empty unless it failed.
+	FinishPipelineStep(ctx context.Context, downloadID int64, position int64, status string, detail string, errMessage string) error
+	// SkipPipelineSteps marks the steps of the download that did not finish as skipped.
+	SkipPipelineSteps(ctx context.Context, downloadID int64, reason string) error
+	// GetPendingPipelines returns the completed downloads on the disk of host whose pipeline has
+	// steps left to run, e.g. because the process stopped while running them.
+	GetPendingPipelines(ctx context.Context, host string) ([]downloadRequest, error)
+	// GetTieringCandidates returns the hot files on the disk of host of the downloads that
+	// completed more than olderThan ago and whose pipeline finished.
+	GetTieringCandidates(ctx context.Context, host string, olderThan time.Duration, limit int64) ([]downloadRequest, error)
+	GetRestoringDownloads(ctx context.Context, limit int64) ([]downloadRequest, error)
+	// SetTier records where the file of a download is: coldKey in cold storage, or the disk of host.
+	SetTier(ctx context.Context, downloadID int64, tier string, coldKey string, host string) error
+	// RequestRestore marks a cold file to be restored to a disk. It reports false if the file is not cold.
+	RequestRestore(ctx context.Context, downloadID int64) (bool, error)
+	// GetRetentionCandidates returns the finished downloads whose retention ran out, ttl unless
+	// their owner or its plan has another one (0 keeps them forever), those in the trash for
+	// longer than trashRetention and those whose owner asked to purge them. Those with a file on
+	// the disk of another process than host are left to it.
+	GetRetentionCandidates(ctx context.Context, host string, ttl time.Duration, planTTLs map[string]time.Duration, trashRetention time.Duration, limit int64) ([]downloadRequest, error)
+	// TrashDownloadRequest moves a finished download to the trash and returns false if it is not
+	// finished or already there.
+	TrashDownloadRequest(ctx context.Context, downloadID int64) (bool, error)
+	// RestoreFromTrash takes a download out of the trash and returns false if it is not there.
+	RestoreFromTrash(ctx context.Context, downloadID int64) (bool, error)
+	// RequestPurge marks a finished download to be purged by the process with its file.
+	RequestPurge(ctx context.Context, downloadID int64) error
+	// DeleteDownloadRequest deletes a finished download request with its attempts and reports
+	// whether it existed.
+	DeleteDownloadRequest(ctx context.Context, downloadID int64) (bool, error)
+	// SetDownloadFolder moves a download request into a folder, nil for none.
+	SetDownloadFolder(ctx context.Context, downloadID int64, folderID *int64) error
+	// GetLocks returns the locks of the download requests.
+	GetLocks(ctx context.Context) ([]Lock, error)
+	// GetRequeueCandidates returns the download requests matching the filter, oldest first.
+	GetRequeueCandidates(ctx context.Context, filter RequeueFilter) ([]downloadRequest, error)
+	// RetryDownloadRequest queues a failed download request again, clearing its error and
+	// counting the retry. Its worker resumes the partial file, or starts over with restart. It
+	// returns the number of times the download was retried, 0 if it is not failed.
+	RetryDownloadRequest(ctx context.Context, downloadID int64, restart bool) (int64, error)
+	// TakeRestart reports whether the download was retried with restart, once.
+	TakeRestart(ctx context.Context, downloadID int64) (bool, error)
+	// GetHostedDownloads returns the download requests with a file on the disk of host.
+	GetHostedDownloads(ctx context.Context, host string) ([]downloadRequest, error)
+	// GetAppliedMigrations returns the versions recorded in the schema_migrations table, none
+	// before it is created.
+	GetAppliedMigrations(ctx context.Context) (map[int64]bool, error)
+	// ApplyMigration runs the statements of a migration in a transaction.
+	ApplyMigration(ctx context.Context, version int64, statements string) error
+	AddAuditEntry(ctx context.Context, entry AuditEntry) error
+	// GetAuditEntries lists the entries of the audit log selected by the filter, the latest first.
+	GetAuditEntries(ctx context.Context, filter AuditFilter, page int64, limit int64) ([]AuditEntry, error)
 }
 
+const getDownloadRequestQuery = `SELECT id, user_id, link, file_name, completed, error, priority, content_hash, status, expires_at, credentials, headers, labels, byte_range, origin_profile_id, max_speed, manifest_url, verification, verification_detail, folder_id, mirrors, host, tier, cold_key, tuning, proxy, error_code, bytes, deleted_at, org_id, metadata FROM downloads WHERE id = $1`
+
 func (r *repository) GetDownloadRequest(ctx context.Context, downloadID int64) (downloadRequest, error) {
-	query := `SELECT id, user_id, link, file_name, completed, error FROM downloads WHERE id = $1`
+	return r.getDownloadRequest(ctx, downloadID, getDownloadRequestQuery, downloadID)
+}
+
+func (r *repository) GetDownloadRequestForUser(ctx context.Context, userID int64, downloadID int64) (downloadRequest, error) {
+	return r.getDownloadRequest(ctx, downloadID, getDownloadRequestQuery+` AND user_id = $2`, downloadID, userID)
+}
 
+func (r *repository) getDownloadRequest(ctx context.Context, downloadID int64, query string, args ...any) (downloadRequest, error) {
 	var req downloadRequest
-	rows, err := r.db.Query(ctx, query, downloadID)
+	rows, err := r.db.Query(ctx, query, args...)
 	if err != nil {
 		return req, fmt.Errorf("could not retrieve download request %d: %v", downloadID, err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		err := rows.Scan(&req.ID, &req.UserID, &req.Link, &req.FileName, &req.Completed, &req.Error)
+		err := rows.Scan(&req.ID, &req.UserID, &req.Link, &req.FileName, &req.Completed, &req.Error, &req.Priority, &req.ContentHash, &req.Status, &req.ExpiresAt, &req.Credentials, &req.Headers, &req.Labels, &req.Range, &req.OriginProfileID, &req.MaxSpeed, &req.ManifestURL, &req.Verification, &req.VerificationDetail, &req.FolderID, &req.Mirrors, &req.Host, &req.Tier, &req.ColdKey, &req.Tuning, &req.Proxy, &req.ErrorCode, &req.Bytes, &req.DeletedAt, &req.OrgID, &req.Metadata)
 		if err != nil {
 			return req, fmt.Errorf("could not scan download request %d: %v", downloadID, err)
 		}
 		return req, nil
 	}
 
-	return req, fmt.Errorf("download request %d not found", downloadID)
+	return req, fmt.Errorf("could not retrieve download request %d: %w", downloadID, DownloadRequestNotFoundErr)
 }
 
-func (r *repository) GetDownloadRequests(ctx context.Context, userID int64, page int64, limit int64) ([]downloadRequest, error) {
-	var downloadRequests []downloadRequest
-	query := `SELECT id, user_id, link, file_name, completed, error FROM downloads OFFSET $1 LIMIT $2`
+// DownloadFilter selects the download requests to list, and how they are sorted.
+type DownloadFilter struct {
+	Labels map[string]string // having all these labels, any if empty
+	// in this folder, 0 for the downloads in no folder, any if nil
+	FolderID     *int64
+	Recursive    bool      // also in the subfolders of FolderID
+	CollectionID *int64    // in this collection, any of the user if nil
+	OrgID        *int64    // of this organization, any of the user if nil
+	Trashed      bool      // in the trash instead of out of it
+	Statuses     []string  // in one of these statuses, any if empty
+	Since        time.Time // requested since this time, any if zero
+	Until        time.Time // requested before this time, any if zero
+	Query        string    // contained in the link, case-insensitively
+	Domain       string    // of a link to this host or to one of its subdomains
+	MinBytes     *int64    // completed with at least this many bytes
+	MaxBytes     *int64    // completed with at most this many bytes
+	Sort         string    // one of DownloadSorts, by id if empty; unset values last
+	Descending   bool
+	// after this cursor of the same sort order instead of at an offset, nil for the first page
+	After *DownloadCursor
+}
+
+// DownloadCursor is where a page of downloads ends, the value of the sort column and the id of
+// its last download: the next page starts after it, whatever was inserted or deleted since.
+type DownloadCursor struct {
+	Sort       string
+	Descending bool
+	Value      any // of the sort column, nil if the download has none
+	ID         int64
+}
+
+// DownloadSorts are the columns the downloads can be sorted by.
+var DownloadSorts = []string{"id", "created_at", "finished_at", "bytes", "link", "status", "priority"}
+
+// where gathers the conditions of a WHERE clause and their arguments, numbered in the order
+// they are added.
+type where struct {
+	conditions []string
+	args       []any
+}
+
+// arg adds an argument and returns its placeholder.
+func (w *where) arg(value any) string {
+	w.args = append(w.args, value)
+	return fmt.Sprintf("$%d", len(w.args))
+}
+
+func (w *where) add(condition string) {
+	w.conditions = append(w.conditions, condition)
+}
+
+func (w *where) String() string {
+	if len(w.conditions) == 0 {
+		return "TRUE"
+	}
+	return strings.Join(w.conditions, " AND ")
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// containsPattern returns the LIKE pattern of the values containing s.
+func containsPattern(s string) string {
+	return "%" + likeEscaper.Replace(s) + "%"
+}
+
+// GetDownloadRequests lists the download requests of the user selected by the filter. With a
+// collection or an organization, the downloads of its other members are listed too. The
+// query only has the conditions of the filters set, so that it uses their indexes.
+func (r *repository) GetDownloadRequests(ctx context.Context, userID int64, page int64, limit int64, filter DownloadFilter) ([]downloadRequest, *DownloadCursor, error) {
+	sort := filter.Sort
+	if sort == "" {
+		sort = "id"
+	}
+	if !slices.Contains(DownloadSorts, sort) {
+		return nil, nil, fmt.Errorf("could not retrieve download requests: unknown sort %q", sort)
+	}
+	order, after := "ASC", ">"
+	if filter.Descending {
+		order, after = "DESC", "<"
+	}
+
+	var w where
+	with := ""
+	if filter.CollectionID != nil {
+		w.add("id IN (SELECT download_id FROM collection_downloads WHERE collection_id = " + w.arg(*filter.CollectionID) + ")")
+	}
+	if filter.OrgID != nil {
+		w.add("org_id = " + w.arg(*filter.OrgID))
+	}
+	if filter.CollectionID == nil && filter.OrgID == nil {
+		w.add("user_id = " + w.arg(userID))
+	}
+	if len(filter.Labels) > 0 {
+		w.add("labels @> " + w.arg(filter.Labels))
+	}
+	switch {
+	case filter.FolderID == nil:
+	case *filter.FolderID == 0:
+		w.add("folder_id IS NULL")
+	case filter.Recursive:
+		with = `WITH RECURSIVE subtree AS (
+			SELECT id FROM folders WHERE id = ` + w.arg(*filter.FolderID) + `
+			UNION ALL
+			SELECT folders.id FROM folders JOIN subtree ON folders.parent_id = subtree.id
+		) `
+		w.add("folder_id IN (SELECT id FROM subtree)")
+	default:
+		w.add("folder_id = " + w.arg(*filter.FolderID))
+	}
+	if filter.Trashed {
+		w.add("deleted_at IS NOT NULL")
+	} else {
+		w.add("deleted_at IS NULL")
+	}
+	if len(filter.Statuses) > 0 {
+		w.add("status = ANY(" + w.arg(filter.Statuses) + ")")
+	}
+	if !filter.Since.IsZero() {
+		w.add("created_at >= " + w.arg(filter.Since))
+	}
+	if !filter.Until.IsZero() {
+		w.add("created_at < " + w.arg(filter.Until))
+	}
+	if filter.Query != "" {
+		w.add("link ILIKE " + w.arg(containsPattern(filter.Query)))
+	}
+	if filter.Domain != "" {
+		domain := strings.ToLower(strings.TrimSuffix(filter.Domain, "."))
+		w.add("(link_host = " + w.arg(domain) + " OR link_host LIKE " + w.arg("%."+likeEscaper.Replace(domain)) + ")")
+	}
+	if filter.MinBytes != nil {
+		w.add("bytes >= " + w.arg(*filter.MinBytes))
+	}
+	if filter.MaxBytes != nil {
+		w.add("bytes <= " + w.arg(*filter.MaxBytes))
+	}
+	if cursor := filter.After; cursor != nil {
+		if cursor.Sort != sort || cursor.Descending != filter.Descending {
+			return nil, nil, fmt.Errorf("could not retrieve download requests: the cursor is of another sort order")
+		}
+		id := w.arg(cursor.ID)
+		switch {
+		case sort == "id":
+			w.add("id " + after + " " + id)
+		case cursor.Value == nil:
+			// Downloads without a value come last, by id.
+			w.add(fmt.Sprintf("(%s IS NULL AND id %s %s)", sort, after, id))
+		default:
+			value := w.arg(cursor.Value)
+			w.add(fmt.Sprintf("(%[1]s %[2]s %[3]s OR (%[1]s = %[3]s AND id %[2]s %[4]s) OR %[1]s IS NULL)", sort, after, value, id))
+		}
+	}
+
+	query := with + `SELECT id, user_id, link, file_name, completed, error, priority, content_hash, status, expires_at, credentials, headers, labels, byte_range, origin_profile_id, max_speed, manifest_url, verification, verification_detail, folder_id, mirrors, host, tier, cold_key, tuning, proxy, error_code, bytes, deleted_at, org_id, metadata, ` + sort + ` FROM downloads
+		WHERE ` + w.String() + `
+		ORDER BY ` + sort + ` ` + order + ` NULLS LAST, id ` + order + `
+		OFFSET ` + w.arg(page*limit) + ` LIMIT ` + w.arg(limit)
 
-	rows, err := r.db.Query(ctx, query, page*limit, limit)
+	rows, err := r.db.Query(ctx, query, w.args...)
 	if err != nil {
-		return nil, fmt.Errorf("could not retrieve download requests: %v", err)
+		return nil, nil, fmt.Errorf("could not retrieve download requests: %v", err)
 	}
 	defer rows.Close()
 
+	var downloadRequests []downloadRequest
+	var next *DownloadCursor
 	for rows.Next() {
 		var req downloadRequest
-		err := rows.Scan(&req.ID, &req.UserID, &req.Link, &req.FileName, &req.Completed, &req.Error)
+		var value any
+		err := rows.Scan(&req.ID, &req.UserID, &req.Link, &req.FileName, &req.Completed, &req.Error, &req.Priority, &req.ContentHash, &req.Status, &req.ExpiresAt, &req.Credentials, &req.Headers, &req.Labels, &req.Range, &req.OriginProfileID, &req.MaxSpeed, &req.ManifestURL, &req.Verification, &req.VerificationDetail, &req.FolderID, &req.Mirrors, &req.Host, &req.Tier, &req.ColdKey, &req.Tuning, &req.Proxy, &req.ErrorCode, &req.Bytes, &req.DeletedAt, &req.OrgID, &req.Metadata, &value)
 		if err != nil {
-			return nil, fmt.Errorf("could not scan download request: %v", err)
+			return nil, nil, fmt.Errorf("could not scan download request: %v", err)
 		}
 		downloadRequests = append(downloadRequests, req)
+		next = &DownloadCursor{Sort: sort, Descending: filter.Descending, Value: value, ID: req.ID}
+	}
+	if int64(len(downloadRequests)) < limit {
+		next = nil
 	}
 
-	return downloadRequests, nil
+	return downloadRequests, next, rows.Err()
 }
 
-func (r *repository) CreateDownloadRequest(ctx context.Context, userID int64, link string, fileName string) (int64, error) {
-	var downloadID int64
-	query := `INSERT INTO downloads (user_id, link, file_name, completed, error) VALUES ($1, $2, $3, false, '') RETURNING id`
-	err := r.db.QueryRow(ctx, query, userID, link, fileName).Scan(&downloadID)
+// cachedDownloadList is a first page of a list of downloads in the DownloadListKeyPrefix hash of
+// its user.
+type cachedDownloadList struct {
+	ExpiresAt time.Time
+	Downloads []downloadRequest
+	Next      *DownloadCursor
+}
+
+func (r *repository) GetCachedDownloadRequests(ctx context.Context, userID int64, page int64, limit int64, filter DownloadFilter, ttl time.Duration) ([]downloadRequest, *DownloadCursor, error) {
+	if ttl <= 0 || page != 0 || filter.After != nil {
+		return r.GetDownloadRequests(ctx, userID, page, limit, filter)
+	}
+
+	key := fmt.Sprintf("%s%d", DownloadListKeyPrefix, userID)
+	field, err := json.Marshal(struct {
+		Limit  int64
+		Filter DownloadFilter
+	}{limit, filter})
 	if err != nil {
-		return 0, fmt.Errorf("could not create download request: user_id: %d, link: %s: %v", userID, link, err)
+		return nil, nil, fmt.Errorf("could not retrieve download requests: %v", err)
 	}
 
-	return downloadID, nil
-}
+	data, err := r.rdb.HGet(ctx, key, string(field)).Bytes()
+	if err == nil {
+		var cached cachedDownloadList
+		if err := json.Unmarshal(data, &cached); err == nil && time.Now().Before(cached.ExpiresAt) {
+			return cached.Downloads, cached.Next, nil
+		}
+	}
 
-func (r *repository) CompleteDownloadRequest(ctx context.Context, downloadID int64) error {
-	_, err := r.db.Exec(ctx, `UPDATE downloads SET completed = TRUE WHERE id = $1`, downloadID)
+	downloads, next, err := r.GetDownloadRequests(ctx, userID, 0, limit, filter)
 	if err != nil {
-		return fmt.Errorf("could not complete download request %d: %v", downloadID, err)
+		return nil, nil, err
 	}
-
-	return nil
+	// A cache failure only costs a query per call. A page read before an invalidation and
+	// cached after it is stale for ttl at most.
+	if data, err := json.Marshal(cachedDownloadList{ExpiresAt: time.Now().Add(ttl), Downloads: downloads, Next: next}); err == nil {
+		pipe := r.rdb.TxPipeline()
+		pipe.HSet(ctx, key, string(field), data)
+		pipe.Expire(ctx, key, ttl)
+		pipe.Exec(ctx)
+	}
+	return downloads, next, nil
 }
 
-func (r *repository) MarkError(ctx context.Context, downloadID int64, downloadErr string) error {
-	_, err := r.db.Exec(ctx, `UPDATE downloads SET error = $1 WHERE id = $2`, downloadErr, downloadID)
-	if err != nil {
-		return fmt.Errorf("could not update download request %d error: %v", downloadID, err)
+func (r *repository) InvalidateDownloadList(ctx context.Context, userID int64) error {
+	if err := r.rdb.Del(ctx, fmt.Sprintf("%s%d", DownloadListKeyPrefix, userID)).Err(); err != nil {
+		return fmt.Errorf("could not invalidate cached download list of user %d: %v", userID, err)
 	}
 
 	return nil
 }
 
-func (r *repository) CreateUser(ctx context.Context, username string, hashedPassword string) (int64, error) {
-	var userID int64
-	query := `INSERT INTO users (username, password) VALUES ($1, $2) RETURNING id`
-	err := r.db.QueryRow(ctx, query, username, hashedPassword).Scan(&userID)
-	if err != nil {
-		return 0, fmt.Errorf("could not insert new user %s: %v", username, err)
-	}
+// ExportFilter selects the downloads of an export.
+type ExportFilter struct {
+	Since    time.Time // requested since this time, any if zero
+	Until    time.Time // requested before this time, any if zero
+	Statuses []string  // in one of these statuses, any if empty
+}
 
-	return userID, nil
+// ExportedDownload is a download as it is exported, for accounting or to move it elsewhere.
+type ExportedDownload struct {
+	ID          int64             `json:"id"`
+	Link        string            `json:"link"`
+	FileName    string            `json:"file_name"`
+	Range       string            `json:"byte_range"` // empty for the whole file
+	Status      string            `json:"status"`
+	ErrorCode   string            `json:"error_code"`
+	Error       string            `json:"error"`
+	Bytes       *int64            `json:"bytes"` // nil unless completed
+	ContentHash string            `json:"content_hash"`
+	Labels      map[string]string `json:"labels"`
+	FolderID    *int64            `json:"folder_id"`
+	OrgID       *int64            `json:"org_id"`
+	CreatedAt   time.Time         `json:"created_at"`
+	StartedAt   *time.Time        `json:"started_at"`
+	FinishedAt  *time.Time        `json:"finished_at"`
+	DeletedAt   *time.Time        `json:"deleted_at"`
 }
 
-func (r *repository) AuthUser(ctx context.Context, username string, password string) (int64, error) {
-	var retrievedUserID sql.NullInt64
-	var retrievedHashedPassword sql.NullString
-	err := r.db.QueryRow(ctx, `SELECT id, password FROM users WHERE username = $1`, username).Scan(&retrievedUserID, &retrievedHashedPassword)
-	if err != nil || !retrievedHashedPassword.Valid {
-		return 0, fmt.Errorf("could not authenticate user %s: %v", username, err)
+func (r *repository) ExportDownloadRequests(ctx context.Context, userID int64, filter ExportFilter, afterID int64, limit int64) ([]ExportedDownload, error) {
+	var since, until *time.Time
+	if !filter.Since.IsZero() {
+		since = &filter.Since
 	}
-
-	err = bcrypt.CompareHashAndPassword([]byte(retrievedHashedPassword.String), []byte(password))
+	if !filter.Until.IsZero() {
+		until = &filter.Until
+	}
+	statuses := filter.Statuses
+	if statuses == nil {
+		statuses = []string{}
+	}
+	rows, err := r.db.Query(ctx, `SELECT id, link, file_name, byte_range, status, error_code, error, bytes, content_hash, labels, folder_id, org_id, created_at, started_at, finished_at, deleted_at FROM downloads
+		WHERE user_id = $1 AND id > $2 AND ($3::timestamptz IS NULL OR created_at >= $3) AND ($4::timestamptz IS NULL OR created_at < $4)
+		AND (cardinality($5::text[]) = 0 OR status = ANY($5))
+		ORDER BY id LIMIT $6`, userID, afterID, since, until, statuses, limit)
 	if err != nil {
-		return 0, nil
+		return nil, fmt.Errorf("could not export download requests: user_id: %d: %v", userID, err)
 	}
+	defer rows.Close()
 
-	return retrievedUserID.Int64, nil
-}
-
-func (r *repository) PushDownloadRequest(ctx context.Context, downloadID int64) error {
-	err := r.rdb.LPush(ctx, DownloadRequestsKey, downloadID).Err()
-	if err != nil {
-		return fmt.Errorf("could not push download request %d: %v", downloadID, err)
+	var downloads []ExportedDownload
+	for rows.Next() {
+		var download ExportedDownload
+		err := rows.Scan(&download.ID, &download.Link, &download.FileName, &download.Range, &download.Status, &download.ErrorCode, &download.Error, &download.Bytes, &download.ContentHash, &download.Labels, &download.FolderID, &download.OrgID, &download.CreatedAt, &download.StartedAt, &download.FinishedAt, &download.DeletedAt)
+		if err != nil {
+			return nil, fmt.Errorf("could not scan exported download request: %v", err)
+		}
+		downloads = append(downloads, download)
 	}
 
-	return nil
+	return downloads, rows.Err()
 }
 
-func (r *repository) PopDownloadRequest(ctx context.Context) (int64, error) {
-	downloadIDStr, err := r.rdb.RPop(ctx, DownloadRequestsKey).Result()
+// FindDownloadRequest returns the download request of the user for the byte range of link, if there is one.
+func (r *repository) FindDownloadRequest(ctx context.Context, userID int64, link string, byteRange string) (downloadRequest, bool, error) {
+	query := `SELECT id, user_id, link, file_name, completed, error, priority, content_hash, status, expires_at, credentials, headers, labels, byte_range, origin_profile_id, max_speed, manifest_url, verification, verification_detail, folder_id, mirrors, host, tier, cold_key, tuning, proxy, error_code, bytes, deleted_at, org_id, metadata FROM downloads WHERE user_id = $1 AND link = $2 AND byte_range = $3`
+
+	var req downloadRequest
+	err := r.db.QueryRow(ctx, query, userID, link, byteRange).Scan(&req.ID, &req.UserID, &req.Link, &req.FileName, &req.Completed, &req.Error, &req.Priority, &req.ContentHash, &req.Status, &req.ExpiresAt, &req.Credentials, &req.Headers, &req.Labels, &req.Range, &req.OriginProfileID, &req.MaxSpeed, &req.ManifestURL, &req.Verification, &req.VerificationDetail, &req.FolderID, &req.Mirrors, &req.Host, &req.Tier, &req.ColdKey, &req.Tuning, &req.Proxy, &req.ErrorCode, &req.Bytes, &req.DeletedAt, &req.OrgID, &req.Metadata)
 	if err != nil {
-		if err == redis.Nil {
-			return 0, NoMoreDownloadRequestErr
+		if errors.Is(err, pgx.ErrNoRows) {
+			return req, false, nil
 		}
-		return 0, fmt.Errorf("could not pop download request: %v", err)
+		return req, false, fmt.Errorf("could not find download request: user_id: %d, link: %s: %v", userID, link, err)
 	}
 
-	downloadID, _ := strconv.ParseInt(downloadIDStr, 10, 64)
-	return downloadID, nil
+	return req, true, nil
 }
 
-func (r *repository) AcquireLock(ctx context.Context, downloadID int64, expiration time.Duration) (bool, error) {
-	succeeded, err := r.rdb.SetNX(ctx, fmt.Sprint(downloadID), "locked", expiration).Result()
+// FileNameExists reports whether a download, deleted ones whose file is kept included, has the file name.
+func (r *repository) FileNameExists(ctx context.Context, fileName string) (bool, error) {
+	var exists bool
+	err := r.db.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM downloads WHERE file_name = $1)`, fileName).Scan(&exists)
 	if err != nil {
-		return false, fmt.Errorf("Error acquiring lock: %v", err)
+		return false, fmt.Errorf("could not check file name %s: %v", fileName, err)
 	}
-	return succeeded, nil
+
+	return exists, nil
 }
 
-func (r *repository) ExtendLock(ctx context.Context, downloadID int64, expiration time.Duration) (bool, error) {
-	succeeded, err := r.rdb.Expire(ctx, fmt.Sprint(downloadID), expiration).Result()
-	if err != nil {
-		return false, fmt.Errorf("Error extending lock: %v", err)
+// createDownloadQuery inserts a download request, adds it to its collection, inserts its
+// pipeline steps and its outbox entry, for the relay to push it to the queue.
+const createDownloadQuery = `WITH created AS (
+		INSERT INTO downloads (user_id, link, file_name, completed, error, priority, expires_at, credentials, headers, labels, byte_range, origin_profile_id, max_speed, manifest_url, folder_id, mirrors, tuning, proxy, org_id)
+		VALUES ($1, $2, $3, false, '', $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $19)
+		ON CONFLICT (user_id, link, byte_range) DO NOTHING RETURNING id
+	), collected AS (
+		INSERT INTO collection_downloads (collection_id, download_id) SELECT $17, id FROM created WHERE $17::int IS NOT NULL
+	), piped AS (
+		INSERT INTO pipeline_steps (download_id, position, name) SELECT created.id, step.position, step.name FROM created, unnest($18::text[]) WITH ORDINALITY AS step(name, position)
+	)
+	INSERT INTO outbox (download_id) SELECT id FROM created RETURNING download_id`
+
+func createDownloadArgs(download NewDownload) []any {
+	labels := download.Labels
+	if labels == nil {
+		labels = map[string]string{}
 	}
-	return succeeded, nil
+	mirrors := download.Mirrors
+	if mirrors == nil {
+		mirrors = []string{}
+	}
+	steps := download.Pipeline
+	if steps == nil {
+		steps = []string{}
+	}
+	return []any{download.UserID, download.Link, download.FileName, download.Priority, download.ExpiresAt, download.Credentials, download.Headers, labels, download.Range, download.OriginProfileID, download.MaxSpeed, download.ManifestURL, download.FolderID, mirrors, download.Tuning, download.Proxy, download.CollectionID, steps, download.OrgID}
 }
 
-func (r *repository) ReleaseLock(ctx context.Context, downloadID int64) error {
-	_, err := r.rdb.Del(ctx, fmt.Sprint(downloadID)).Result()
+// CreateDownloadRequest inserts the request together with its outbox entry in one statement
+// (and so one transaction), the relay then pushes it to the queue. See GetOutbox.
+func (r *repository) CreateDownloadRequest(ctx context.Context, download NewDownload) (int64, error) {
+	var downloadID int64
+	err := r.db.QueryRow(ctx, createDownloadQuery, createDownloadArgs(download)...).Scan(&downloadID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, fmt.Errorf("could not create download request: user_id: %d, link: %s: requested concurrently: %w", download.UserID, download.Link, ErrDuplicateLink)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("could not create download request: user_id: %d, link: %s: %v", download.UserID, download.Link, err)
+	}
+
+	return downloadID, nil
+}
+
+func (r *repository) CreateDownloadRequests(ctx context.Context, downloads []NewDownload) ([]int64, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not create download requests: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	downloadIDs := make([]int64, 0, len(downloads))
+	for _, download := range downloads {
+		var downloadID int64
+		err := tx.QueryRow(ctx, createDownloadQuery, createDownloadArgs(download)...).Scan(&downloadID)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("could not create download request: user_id: %d, link: %s: %v", download.UserID, download.Link, err)
+		}
+		downloadIDs = append(downloadIDs, downloadID)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("could not create download requests: %v", err)
+	}
+
+	return downloadIDs, nil
+}
+
+// GetOutbox returns the oldest outbox entries that were not published to the queue yet.
+func (r *repository) GetOutbox(ctx context.Context, limit int64) ([]OutboxEntry, error) {
+	var entries []OutboxEntry
+	rows, err := r.db.Query(ctx, `SELECT id, download_id FROM outbox WHERE sent_at IS NULL ORDER BY id LIMIT $1`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve outbox: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry OutboxEntry
+		if err := rows.Scan(&entry.ID, &entry.DownloadID); err != nil {
+			return nil, fmt.Errorf("could not scan outbox entry: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func (r *repository) MarkOutboxSent(ctx context.Context, entryIDs []int64) error {
+	query := `WITH sent AS (
+			UPDATE outbox SET sent_at = NOW() WHERE id = ANY($1) RETURNING download_id
+		)
+		INSERT INTO queue_events (download_id, type) SELECT download_id, 'enqueued' FROM sent`
+	_, err := r.db.Exec(ctx, query, entryIDs)
+	if err != nil {
+		return fmt.Errorf("could not mark outbox entries as sent: %v", err)
+	}
+
+	return nil
+}
+
+// PurgeOutbox deletes the entries sent more than olderThan ago.
+func (r *repository) PurgeOutbox(ctx context.Context, olderThan time.Duration) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM outbox WHERE sent_at < NOW() - $1::BIGINT * INTERVAL '1 millisecond'`, olderThan.Milliseconds())
+	if err != nil {
+		return fmt.Errorf("could not purge outbox: %v", err)
+	}
+
+	return nil
+}
+
+// SpillDownloadRequests takes the requests out of the queue before writing them to the outbox,
+// so that no other process spills or pops them meanwhile. The requests of a crash in between
+// are still queued in the database, and requeued by reconcile. The users with the most queued
+// requests are spilled first.
+func (r *repository) SpillDownloadRequests(ctx context.Context, limit int64) (int64, error) {
+	keys, err := r.queue.UserKeys(ctx)
+	if err != nil {
+		return 0, err
+	}
+	lengths := make(map[string]int64, len(keys))
+	for _, key := range keys {
+		if lengths[key], _, err = r.queue.Len(ctx, key); err != nil {
+			return 0, err
+		}
+	}
+	sort.SliceStable(keys, func(i, j int) bool { return lengths[keys[i]] > lengths[keys[j]] })
+
+	var downloadIDs []int64
+	var spillErr error
+	for _, key := range append([]string{DownloadRequestsKey}, keys...) {
+		if int64(len(downloadIDs)) >= limit {
+			break
+		}
+		spilled, err := r.queue.Spill(ctx, key, limit-int64(len(downloadIDs)))
+		if err != nil {
+			spillErr = err // the ones spilled already are written
+			break
+		}
+		downloadIDs = append(downloadIDs, spilled...)
+	}
+	if len(downloadIDs) == 0 {
+		return 0, spillErr
+	}
+
+	query := `INSERT INTO outbox (download_id) SELECT download_id FROM UNNEST($1::BIGINT[]) WITH ORDINALITY AS spilled(download_id, n) ORDER BY n`
+	if _, err := r.db.Exec(ctx, query, downloadIDs); err != nil {
+		return 0, fmt.Errorf("could not spill download requests %v to the outbox: %v", downloadIDs, err)
+	}
+
+	return int64(len(downloadIDs)), spillErr
+}
+
+func (r *repository) GetOutboxLength(ctx context.Context) (int64, error) {
+	var length int64
+	if err := r.db.QueryRow(ctx, `SELECT COUNT(*) FROM outbox WHERE sent_at IS NULL`).Scan(&length); err != nil {
+		return 0, fmt.Errorf("could not get outbox length: %v", err)
+	}
+	return length, nil
+}
+
+func (r *repository) GetRedisMemory(ctx context.Context) (int64, error) {
+	info, err := r.rdb.InfoMap(ctx, "memory").Result()
+	if err != nil {
+		return 0, fmt.Errorf("could not get redis memory: %v", err)
+	}
+
+	usedMemory, err := strconv.ParseInt(info["Memory"]["used_memory"], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse redis used_memory: %v", err)
+	}
+	return usedMemory, nil
+}
+
+// StartDownloadRequest marks the request as downloading and records the host whose disk gets
+// the file. It reports false, without changing anything, if the request is already finished or
+// expired (or past its TTL and never started).
+func (r *repository) StartDownloadRequest(ctx context.Context, downloadID int64, host string) (bool, error) {
+	query := `WITH started AS (
+			UPDATE downloads SET status = 'downloading', started_at = COALESCE(started_at, NOW()), host = $2
+			WHERE id = $1 AND status IN ('queued', 'downloading') AND NOT (started_at IS NULL AND expires_at <= NOW())
+			RETURNING id
+		)
+		INSERT INTO queue_events (download_id, type) SELECT id, 'claimed' FROM started`
+	tag, err := r.db.Exec(ctx, query, downloadID, host)
+	if err != nil {
+		return false, fmt.Errorf("could not start download request %d: %v", downloadID, err)
+	}
+	if err := r.rdb.ZRem(ctx, QueuedAtKey, downloadID).Err(); err != nil {
+		return false, fmt.Errorf("could not forget push time of download request %d: %v", downloadID, err)
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+// ExpireDownloadRequests moves the queued requests past their TTL to expired and notifies their
+// owners, all of them if downloadID is 0. It returns the owners of the expired requests, by id.
+func (r *repository) ExpireDownloadRequests(ctx context.Context, downloadID int64) (map[int64]int64, error) {
+	query := `WITH expired AS (
+			UPDATE downloads SET status = 'expired', error = 'expired before it was started', finished_at = NOW()
+			WHERE status = 'queued' AND started_at IS NULL AND expires_at <= NOW() AND ($1 = 0 OR id = $1)
+			RETURNING id, user_id, link
+		), notified AS (
+			INSERT INTO notifications (user_id, download_id, message)
+			SELECT user_id, id, 'The download of ' || link || ' expired before it was started' FROM expired
+		), events AS (
+			INSERT INTO queue_events (download_id, type) SELECT id, 'expired' FROM expired
+		)
+		SELECT id, user_id FROM expired`
+	rows, err := r.db.Query(ctx, query, downloadID)
+	if err != nil {
+		return nil, fmt.Errorf("could not expire download requests: %v", err)
+	}
+	defer rows.Close()
+
+	owners := map[int64]int64{}
+	for rows.Next() {
+		var id, userID int64
+		if err := rows.Scan(&id, &userID); err != nil {
+			return nil, fmt.Errorf("could not scan expired download request: %v", err)
+		}
+		owners[id] = userID
+	}
+
+	return owners, rows.Err()
+}
+
+func (r *repository) ClaimLinkProbes(ctx context.Context, interval time.Duration, lease time.Duration, limit int64) ([]LinkProbe, error) {
+	query := `UPDATE downloads SET probe_at = NOW() + $2::BIGINT * INTERVAL '1 millisecond'
+		WHERE id IN (
+			SELECT id FROM downloads
+			WHERE status = 'queued' AND started_at IS NULL AND (link LIKE 'http://%' OR link LIKE 'https://%')
+				AND credentials = '' AND headers = '' AND origin_profile_id IS NULL AND proxy = '' AND cardinality(mirrors) = 0
+				AND COALESCE(probe_at, created_at + $1::BIGINT * INTERVAL '1 millisecond') <= NOW()
+			ORDER BY COALESCE(probe_at, created_at) LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, user_id, link, probe_failures`
+	rows, err := r.db.Query(ctx, query, interval.Milliseconds(), lease.Milliseconds(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not claim link probes: %v", err)
+	}
+	defer rows.Close()
+
+	var probes []LinkProbe
+	for rows.Next() {
+		var probe LinkProbe
+		if err := rows.Scan(&probe.DownloadID, &probe.UserID, &probe.Link, &probe.Failures); err != nil {
+			return nil, fmt.Errorf("could not scan link probe: %v", err)
+		}
+		probes = append(probes, probe)
+	}
+
+	return probes, rows.Err()
+}
+
+func (r *repository) SetLinkProbe(ctx context.Context, downloadID int64, failures int64, next time.Duration) error {
+	query := `UPDATE downloads SET probe_failures = $1, probe_at = NOW() + $2::BIGINT * INTERVAL '1 millisecond' WHERE id = $3`
+	_, err := r.db.Exec(ctx, query, failures, next.Milliseconds(), downloadID)
+	if err != nil {
+		return fmt.Errorf("could not record link probe of download request %d: %v", downloadID, err)
+	}
+
+	return nil
+}
+
+func (r *repository) FailDeadLink(ctx context.Context, downloadID int64, reason string) (bool, error) {
+	query := `WITH failed AS (
+			UPDATE downloads SET status = 'failed', error = $2::TEXT, finished_at = NOW()
+			WHERE id = $1 AND status = 'queued' AND started_at IS NULL
+			RETURNING id, user_id, link
+		), notified AS (
+			INSERT INTO notifications (user_id, download_id, message)
+			SELECT user_id, id, 'The download of ' || link || ' failed before it was started: ' || $2::TEXT FROM failed
+		)
+		INSERT INTO queue_events (download_id, type) SELECT id, 'failed' FROM failed
+		RETURNING download_id`
+	var id int64
+	err := r.db.QueryRow(ctx, query, downloadID, reason).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not fail dead link of download request %d: %v", downloadID, err)
+	}
+
+	return true, nil
+}
+
+// GetUnfinishedDownloadRequests returns the queued and downloading requests that were
+// created (or started) more than idleFor ago.
+func (r *repository) GetUnfinishedDownloadRequests(ctx context.Context, idleFor time.Duration) ([]downloadRequest, error) {
+	var downloadRequests []downloadRequest
+	query := `SELECT id, user_id, link, file_name, completed, error, priority, content_hash, status, expires_at, credentials, headers, labels, byte_range, origin_profile_id, max_speed, manifest_url, verification, verification_detail, folder_id, mirrors, host, tier, cold_key, tuning, proxy, error_code, bytes, deleted_at, org_id, metadata FROM downloads
+		WHERE status IN ('queued', 'downloading') AND COALESCE(started_at, created_at) < NOW() - $1::BIGINT * INTERVAL '1 millisecond'`
+
+	rows, err := r.db.Query(ctx, query, idleFor.Milliseconds())
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve unfinished download requests: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var req downloadRequest
+		err := rows.Scan(&req.ID, &req.UserID, &req.Link, &req.FileName, &req.Completed, &req.Error, &req.Priority, &req.ContentHash, &req.Status, &req.ExpiresAt, &req.Credentials, &req.Headers, &req.Labels, &req.Range, &req.OriginProfileID, &req.MaxSpeed, &req.ManifestURL, &req.Verification, &req.VerificationDetail, &req.FolderID, &req.Mirrors, &req.Host, &req.Tier, &req.ColdKey, &req.Tuning, &req.Proxy, &req.ErrorCode, &req.Bytes, &req.DeletedAt, &req.OrgID, &req.Metadata)
+		if err != nil {
+			return nil, fmt.Errorf("could not scan download request: %v", err)
+		}
+		downloadRequests = append(downloadRequests, req)
+	}
+
+	return downloadRequests, nil
+}
+
+// GetStalePartialDownloads returns the failed requests that finished more than olderThan ago
+// and whose partial file was not purged yet.
+func (r *repository) GetStalePartialDownloads(ctx context.Context, olderThan time.Duration, limit int64) ([]downloadRequest, error) {
+	var downloadRequests []downloadRequest
+	query := `SELECT id, user_id, link, file_name, completed, error, priority, content_hash, status, expires_at, credentials, headers, labels, byte_range, origin_profile_id, max_speed, manifest_url, verification, verification_detail, folder_id, mirrors, host, tier, cold_key, tuning, proxy, error_code, bytes, deleted_at, org_id, metadata FROM downloads
+		WHERE status = 'failed' AND file_purged_at IS NULL AND finished_at < NOW() - $1::BIGINT * INTERVAL '1 millisecond'
+		ORDER BY finished_at LIMIT $2`
+
+	rows, err := r.db.Query(ctx, query, olderThan.Milliseconds(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve stale partial downloads: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var req downloadRequest
+		err := rows.Scan(&req.ID, &req.UserID, &req.Link, &req.FileName, &req.Completed, &req.Error, &req.Priority, &req.ContentHash, &req.Status, &req.ExpiresAt, &req.Credentials, &req.Headers, &req.Labels, &req.Range, &req.OriginProfileID, &req.MaxSpeed, &req.ManifestURL, &req.Verification, &req.VerificationDetail, &req.FolderID, &req.Mirrors, &req.Host, &req.Tier, &req.ColdKey, &req.Tuning, &req.Proxy, &req.ErrorCode, &req.Bytes, &req.DeletedAt, &req.OrgID, &req.Metadata)
+		if err != nil {
+			return nil, fmt.Errorf("could not scan download request: %v", err)
+		}
+		downloadRequests = append(downloadRequests, req)
+	}
+
+	return downloadRequests, nil
+}
+
+func (r *repository) GetTieringCandidates(ctx context.Context, host string, olderThan time.Duration, limit int64) ([]downloadRequest, error) {
+	query := `SELECT id, user_id, link, file_name, completed, error, priority, content_hash, status, expires_at, credentials, headers, labels, byte_range, origin_profile_id, max_speed, manifest_url, verification, verification_detail, folder_id, mirrors, host, tier, cold_key, tuning, proxy, error_code, bytes, deleted_at, org_id, metadata FROM downloads
+		WHERE status = 'completed' AND tier = 'hot' AND host = $1 AND finished_at < NOW() - $2::BIGINT * INTERVAL '1 millisecond'
+			AND NOT EXISTS (SELECT 1 FROM pipeline_steps WHERE download_id = downloads.id AND status IN ('pending', 'running'))
+		ORDER BY finished_at LIMIT $3`
+	return r.queryDownloadRequests(ctx, "tiering candidates", query, host, olderThan.Milliseconds(), limit)
+}
+
+func (r *repository) GetRestoringDownloads(ctx context.Context, limit int64) ([]downloadRequest, error) {
+	query := `SELECT id, user_id, link, file_name, completed, error, priority, content_hash, status, expires_at, credentials, headers, labels, byte_range, origin_profile_id, max_speed, manifest_url, verification, verification_detail, folder_id, mirrors, host, tier, cold_key, tuning, proxy, error_code, bytes, deleted_at, org_id, metadata FROM downloads
+		WHERE tier = 'restoring' ORDER BY tiered_at LIMIT $1`
+	return r.queryDownloadRequests(ctx, "restoring downloads", query, limit)
+}
+
+func (r *repository) queryDownloadRequests(ctx context.Context, what string, query string, args ...any) ([]downloadRequest, error) {
+	var downloadRequests []downloadRequest
+	rows, err := r.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve %s: %v", what, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var req downloadRequest
+		err := rows.Scan(&req.ID, &req.UserID, &req.Link, &req.FileName, &req.Completed, &req.Error, &req.Priority, &req.ContentHash, &req.Status, &req.ExpiresAt, &req.Credentials, &req.Headers, &req.Labels, &req.Range, &req.OriginProfileID, &req.MaxSpeed, &req.ManifestURL, &req.Verification, &req.VerificationDetail, &req.FolderID, &req.Mirrors, &req.Host, &req.Tier, &req.ColdKey, &req.Tuning, &req.Proxy, &req.ErrorCode, &req.Bytes, &req.DeletedAt, &req.OrgID, &req.Metadata)
+		if err != nil {
+			return nil, fmt.Errorf("could not scan download request: %v", err)
+		}
+		downloadRequests = append(downloadRequests, req)
+	}
+
+	return downloadRequests, nil
+}
+
+func (r *repository) SetTier(ctx context.Context, downloadID int64, tier string, coldKey string, host string) error {
+	_, err := r.db.Exec(ctx, `UPDATE downloads SET tier = $1, cold_key = $2, host = $3, tiered_at = NOW() WHERE id = $4`, tier, coldKey, host, downloadID)
+	if err != nil {
+		return fmt.Errorf("could not set tier of download request %d: %v", downloadID, err)
+	}
+
+	return nil
+}
+
+func (r *repository) RequestRestore(ctx context.Context, downloadID int64) (bool, error) {
+	tag, err := r.db.Exec(ctx, `UPDATE downloads SET tier = 'restoring', tiered_at = NOW() WHERE id = $1 AND tier = 'cold'`, downloadID)
+	if err != nil {
+		return false, fmt.Errorf("could not request restore of download request %d: %v", downloadID, err)
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+// MarkFilePurged records that the partial file of a failed request was deleted or archived.
+func (r *repository) MarkFilePurged(ctx context.Context, downloadID int64) error {
+	_, err := r.db.Exec(ctx, `UPDATE downloads SET file_purged_at = NOW() WHERE id = $1 AND status = 'failed'`, downloadID)
+	if err != nil {
+		return fmt.Errorf("could not mark file of download request %d as purged: %v", downloadID, err)
+	}
+
+	return nil
+}
+
+// RequeueDownloadRequest moves an abandoned download back to queued and pushes it to the queue
+// of the host holding its partial file, see PushDownloadRequestToHost. It keeps started_at, so
+// a download that already started does not expire.
+func (r *repository) RequeueDownloadRequest(ctx context.Context, downloadID int64) error {
+	query := `WITH requeued AS (
+			UPDATE downloads SET status = 'queued' WHERE id = $1 AND status IN ('queued', 'downloading') RETURNING id, host
+		), events AS (
+			INSERT INTO queue_events (download_id, type) SELECT id, 'enqueued' FROM requeued
+		)
+		SELECT host FROM requeued`
+	var host string
+	err := r.db.QueryRow(ctx, query, downloadID).Scan(&host)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("could not requeue download request %d: %v", downloadID, err)
+	}
+
+	return r.PushDownloadRequestToHost(ctx, downloadID, host)
+}
+
+func (r *repository) CompleteDownloadRequest(ctx context.Context, downloadID int64, size int64) (bool, error) {
+	query := `WITH completed AS (
+			UPDATE downloads SET completed = TRUE, status = 'completed', bytes = $2, finished_at = NOW()
+			WHERE id = $1 AND status = 'downloading' AND (expected_bytes IS NULL OR expected_bytes = $2)
+			RETURNING id
+		)
+		INSERT INTO queue_events (download_id, type) SELECT id, 'completed' FROM completed
+		RETURNING download_id`
+	var id int64
+	err := r.db.QueryRow(ctx, query, downloadID, size).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not complete download request %d: %v", downloadID, err)
+	}
+
+	return true, nil
+}
+
+func (r *repository) SetExpectedBytes(ctx context.Context, downloadID int64, size int64) error {
+	_, err := r.db.Exec(ctx, `UPDATE downloads SET expected_bytes = NULLIF($2::BIGINT, -1) WHERE id = $1`, downloadID, size)
+	if err != nil {
+		return fmt.Errorf("could not set expected size of download request %d: %v", downloadID, err)
+	}
+
+	return nil
+}
+
+func (r *repository) SetPreflight(ctx context.Context, downloadID int64, preflight Preflight) error {
+	_, err := r.db.Exec(ctx, `UPDATE downloads SET preflight = $2 WHERE id = $1`, downloadID, preflight)
+	if err != nil {
+		return fmt.Errorf("could not set preflight of download request %d: %v", downloadID, err)
+	}
+
+	return nil
+}
+
+func (r *repository) GetPreflight(ctx context.Context, downloadID int64) (Preflight, bool, error) {
+	var preflight *Preflight
+	err := r.db.QueryRow(ctx, `SELECT preflight FROM downloads WHERE id = $1`, downloadID).Scan(&preflight)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Preflight{}, false, nil
+	}
+	if err != nil {
+		return Preflight{}, false, fmt.Errorf("could not get preflight of download request %d: %v", downloadID, err)
+	}
+	if preflight == nil {
+		return Preflight{}, false, nil
+	}
+
+	return *preflight, true, nil
+}
+
+func (r *repository) SetMetadata(ctx context.Context, downloadID int64, metadata Metadata) error {
+	_, err := r.db.Exec(ctx, `UPDATE downloads SET metadata = $2 WHERE id = $1`, downloadID, metadata)
+	if err != nil {
+		return fmt.Errorf("could not set metadata of download request %d: %v", downloadID, err)
+	}
+
+	return nil
+}
+
+func (r *repository) ResumeDownloadRequest(ctx context.Context, downloadID int64, maxResumes int64) (bool, error) {
+	query := `WITH resumed AS (
+			UPDATE downloads SET status = 'queued', eof_resumes = eof_resumes + 1
+			WHERE id = $1 AND status = 'downloading' AND eof_resumes < $2
+			RETURNING id, host
+		), events AS (
+			INSERT INTO queue_events (download_id, type) SELECT id, 'enqueued' FROM resumed
+		)
+		SELECT host FROM resumed`
+	var host string
+	err := r.db.QueryRow(ctx, query, downloadID, maxResumes).Scan(&host)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not resume download request %d: %v", downloadID, err)
+	}
+
+	return true, r.PushDownloadRequestToHost(ctx, downloadID, host)
+}
+
+func (r *repository) CreateAttempt(ctx context.Context, attempt Attempt) (int64, error) {
+	var attemptID int64
+	query := `INSERT INTO attempts (download_id, worker, source, started_at, offset_start, offset_end) VALUES ($1, $2, $3, $4, $5, $5) RETURNING id`
+	err := r.db.QueryRow(ctx, query, attempt.DownloadID, attempt.Worker, attempt.Source, attempt.StartedAt, attempt.OffsetStart).Scan(&attemptID)
+	if err != nil {
+		return 0, fmt.Errorf("could not create attempt of download request %d: %v", attempt.DownloadID, err)
+	}
+
+	return attemptID, nil
+}
+
+func (r *repository) FinishAttempt(ctx context.Context, attempt Attempt) error {
+	query := `UPDATE attempts SET finished_at = $1, offset_end = $2, bytes = $3, status_code = $4, protocol = $5, response_headers = $6, error = $7 WHERE id = $8`
+	_, err := r.db.Exec(ctx, query, attempt.FinishedAt, attempt.OffsetEnd, attempt.Bytes, attempt.StatusCode, attempt.Protocol, attempt.ResponseHeaders, attempt.Error, attempt.ID)
+	if err != nil {
+		return fmt.Errorf("could not finish attempt %d: %v", attempt.ID, err)
+	}
+
+	return nil
+}
+
+func (r *repository) GetAttempts(ctx context.Context, downloadID int64) ([]Attempt, error) {
+	attempts := []Attempt{}
+	query := `SELECT id, download_id, worker, source, started_at, finished_at, offset_start, offset_end, bytes, status_code, protocol, response_headers, error
+		FROM attempts WHERE download_id = $1 ORDER BY id`
+	rows, err := r.db.Query(ctx, query, downloadID)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve attempts of download request %d: %v", downloadID, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a Attempt
+		err := rows.Scan(&a.ID, &a.DownloadID, &a.Worker, &a.Source, &a.StartedAt, &a.FinishedAt, &a.OffsetStart, &a.OffsetEnd, &a.Bytes, &a.StatusCode, &a.Protocol, &a.ResponseHeaders, &a.Error)
+		if err != nil {
+			return nil, fmt.Errorf("could not scan attempt: %v", err)
+		}
+		attempts = append(attempts, a)
+	}
+
+	return attempts, nil
+}
+
+func (r *repository) MarkError(ctx context.Context, downloadID int64, downloadErr string) error {
+	return r.MarkErrorCode(ctx, downloadID, "", downloadErr)
+}
+
+func (r *repository) MarkErrorCode(ctx context.Context, downloadID int64, code string, downloadErr string) error {
+	query := `WITH failed AS (
+			UPDATE downloads SET error = $1, error_code = $3, status = 'failed', finished_at = NOW() WHERE id = $2 AND status <> 'failed' RETURNING id
+		)
+		INSERT INTO queue_events (download_id, type) SELECT id, 'failed' FROM failed`
+	_, err := r.db.Exec(ctx, query, downloadErr, downloadID, code)
+	if err != nil {
+		return fmt.Errorf("could not update download request %d error: %v", downloadID, err)
+	}
+
+	return nil
+}
+
+func (r *repository) QuarantineDownload(ctx context.Context, downloadID int64, reason string) (bool, error) {
+	query := `WITH failed AS (
+			UPDATE downloads SET status = 'failed', completed = false, error = $2::TEXT, error_code = $3, finished_at = NOW()
+			WHERE id = $1 AND status = 'completed'
+			RETURNING id, user_id, link
+		), notified AS (
+			INSERT INTO notifications (user_id, download_id, message)
+			SELECT user_id, id, 'The file of ' || link || ' was quarantined: ' || $2::TEXT FROM failed
+		)
+		INSERT INTO queue_events (download_id, type) SELECT id, 'failed' FROM failed
+		RETURNING download_id`
+	var id int64
+	err := r.db.QueryRow(ctx, query, downloadID, reason, ErrorCodeMalware).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not quarantine download request %d: %v", downloadID, err)
+	}
+
+	return true, nil
+}
+
+func (r *repository) CancelDownloadRequest(ctx context.Context, downloadID int64) (bool, error) {
+	query := `WITH canceled AS (
+			UPDATE downloads SET error = $1, status = 'failed', finished_at = NOW() WHERE id = $2 AND status IN ('queued', 'downloading') RETURNING id
+		)
+		INSERT INTO queue_events (download_id, type) SELECT id, 'failed' FROM canceled RETURNING download_id`
+	var id int64
+	err := r.db.QueryRow(ctx, query, CanceledError, downloadID).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not cancel download request %d: %v", downloadID, err)
+	}
+
+	return true, nil
+}
+
+func (r *repository) SetMaxSpeed(ctx context.Context, downloadID int64, maxSpeed int64) error {
+	_, err := r.db.Exec(ctx, `UPDATE downloads SET max_speed = $1 WHERE id = $2`, maxSpeed, downloadID)
+	if err != nil {
+		return fmt.Errorf("could not set max speed of download request %d: %v", downloadID, err)
+	}
+
+	return nil
+}
+
+func (r *repository) SetVerification(ctx context.Context, downloadID int64, verification string, detail string) error {
+	_, err := r.db.Exec(ctx, `UPDATE downloads SET verification = $1, verification_detail = $2 WHERE id = $3`, verification, detail, downloadID)
+	if err != nil {
+		return fmt.Errorf("could not set verification of download request %d: %v", downloadID, err)
+	}
+
+	return nil
+}
+
+func (r *repository) SetContentHash(ctx context.Context, downloadID int64, hash string) error {
+	_, err := r.db.Exec(ctx, `UPDATE downloads SET content_hash = $1 WHERE id = $2`, hash, downloadID)
+	if err != nil {
+		return fmt.Errorf("could not set content hash of download request %d: %v", downloadID, err)
+	}
+
+	return nil
+}
+
+// AddContentRef registers one more reference to the content and returns its reference count.
+func (r *repository) AddContentRef(ctx context.Context, hash string, size int64) (int64, error) {
+	var refCount int64
+	query := `INSERT INTO contents (hash, size, ref_count) VALUES ($1, $2, 1)
+		ON CONFLICT (hash) DO UPDATE SET ref_count = contents.ref_count + 1 RETURNING ref_count`
+	err := r.db.QueryRow(ctx, query, hash, size).Scan(&refCount)
+	if err != nil {
+		return 0, fmt.Errorf("could not add reference to content %s: %v", hash, err)
+	}
+
+	return refCount, nil
+}
+
+// ReleaseContentRef drops one reference to the content and returns the remaining count.
+// The content row is removed once nothing references it.
+func (r *repository) ReleaseContentRef(ctx context.Context, hash string) (int64, error) {
+	var refCount int64
+	err := r.db.QueryRow(ctx, `UPDATE contents SET ref_count = ref_count - 1 WHERE hash = $1 RETURNING ref_count`, hash).Scan(&refCount)
+	if err != nil {
+		return 0, fmt.Errorf("could not release reference to content %s: %v", hash, err)
+	}
+
+	if refCount <= 0 {
+		_, err = r.db.Exec(ctx, `DELETE FROM contents WHERE hash = $1 AND ref_count <= 0`, hash)
+		if err != nil {
+			return 0, fmt.Errorf("could not delete content %s: %v", hash, err)
+		}
+	}
+
+	return refCount, nil
+}
+
+func (r *repository) CreateUser(ctx context.Context, username string, hashedPassword string, email string) (int64, error) {
+	var userID int64
+	query := `INSERT INTO users (username, password, email) VALUES ($1, $2, NULLIF($3, '')) RETURNING id`
+	err := r.db.QueryRow(ctx, query, username, hashedPassword, email).Scan(&userID)
+	if isEmailTaken(err) {
+		return 0, EmailTakenErr
+	}
+	if isUniqueViolation(err) {
+		return 0, ErrDuplicateUser
+	}
+	if err != nil {
+		return 0, fmt.Errorf("could not insert new user %s: %v", username, err)
+	}
+
+	return userID, nil
+}
+
+func (r *repository) SetUserEmail(ctx context.Context, userID int64, email string) error {
+	query := `UPDATE users SET email = $2, email_verified_at = CASE WHEN LOWER(email) = LOWER($2) THEN email_verified_at END WHERE id = $1`
+	_, err := r.db.Exec(ctx, query, userID, email)
+	if isEmailTaken(err) {
+		return EmailTakenErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not set email of user %d: %v", userID, err)
+	}
+
+	return nil
+}
+
+// isEmailTaken reports whether err is a violation of the unique index of the emails.
+func isEmailTaken(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "idx_users_email"
+}
+
+func (r *repository) GetUserByEmail(ctx context.Context, email string) (User, bool, error) {
+	var user User
+	err := scanUser(r.db.QueryRow(ctx, `SELECT `+userColumns+` FROM users WHERE LOWER(email) = LOWER($1)`, email), &user)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return user, false, nil
+		}
+		return user, false, fmt.Errorf("could not retrieve user by email: %v", err)
+	}
+
+	return user, true, nil
+}
+
+func (r *repository) VerifyEmail(ctx context.Context, userID int64, email string) (bool, error) {
+	query := `UPDATE users SET email_verified_at = COALESCE(email_verified_at, NOW()) WHERE id = $1 AND LOWER(email) = LOWER($2)`
+	tag, err := r.db.Exec(ctx, query, userID, email)
+	if err != nil {
+		return false, fmt.Errorf("could not verify email of user %d: %v", userID, err)
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+// emailVerification is what an email verification token stands for.
+type emailVerification struct {
+	UserID int64  `json:"user_id"`
+	Email  string `json:"email"`
+}
+
+func (r *repository) SaveEmailVerificationToken(ctx context.Context, tokenHash string, userID int64, email string, ttl time.Duration) error {
+	data, err := json.Marshal(emailVerification{UserID: userID, Email: email})
+	if err != nil {
+		return err
+	}
+	if err := r.rdb.Set(ctx, EmailVerificationKeyPrefix+tokenHash, data, ttl).Err(); err != nil {
+		return fmt.Errorf("could not save email verification token of user %d: %v", userID, err)
+	}
+
+	return nil
+}
+
+func (r *repository) TakeEmailVerificationToken(ctx context.Context, tokenHash string) (int64, string, bool, error) {
+	data, err := r.rdb.GetDel(ctx, EmailVerificationKeyPrefix+tokenHash).Bytes()
+	if err == redis.Nil {
+		return 0, "", false, nil
+	}
+	if err != nil {
+		return 0, "", false, fmt.Errorf("could not retrieve email verification token: %v", err)
+	}
+	var verification emailVerification
+	if err := json.Unmarshal(data, &verification); err != nil {
+		return 0, "", false, fmt.Errorf("invalid email verification token: %v", err)
+	}
+
+	return verification.UserID, verification.Email, true, nil
+}
+
+func (r *repository) AuthUser(ctx context.Context, username string, password string) (int64, error) {
+	var retrievedUserID sql.NullInt64
+	var retrievedHashedPassword sql.NullString
+	err := r.db.QueryRow(ctx, `SELECT id, password FROM users WHERE username = $1`, username).Scan(&retrievedUserID, &retrievedHashedPassword)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && !retrievedHashedPassword.Valid) {
+		return 0, nil // answered like a wrong password
+	}
+	if err != nil {
+		return 0, fmt.Errorf("could not authenticate user %s: %v", username, err)
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(retrievedHashedPassword.String), []byte(password))
+	if err != nil {
+		return 0, nil
+	}
+
+	return retrievedUserID.Int64, nil
+}
+
+func (r *repository) FindUser(ctx context.Context, username string) (int64, bool, error) {
+	var userID int64
+	err := r.db.QueryRow(ctx, `SELECT id FROM users WHERE username = $1`, username).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("could not find user %s: %v", username, err)
+	}
+
+	return userID, true, nil
+}
+
+func (r *repository) IsAdmin(ctx context.Context, userID int64) (bool, error) {
+	var isAdmin bool
+	err := r.db.QueryRow(ctx, `SELECT is_admin FROM users WHERE id = $1`, userID).Scan(&isAdmin)
+	if err != nil {
+		return false, fmt.Errorf("could not retrieve role of user %d: %v", userID, err)
+	}
+
+	return isAdmin, nil
+}
+
+func (r *repository) GetUserAuth(ctx context.Context, userID int64) (UserAuth, bool, error) {
+	var auth UserAuth
+	query := `SELECT token_version, disabled_at IS NOT NULL, password_reset_required FROM users WHERE id = $1`
+	err := r.db.QueryRow(ctx, query, userID).Scan(&auth.TokenVersion, &auth.Disabled, &auth.PasswordResetRequired)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return auth, false, nil
+		}
+		return auth, false, fmt.Errorf("could not retrieve account state of user %d: %v", userID, err)
+	}
+
+	return auth, true, nil
+}
+
+const userColumns = `id, username, is_admin, plan, stored_bytes, disabled_at, password_reset_required, retention_seconds, deleted_at, email, email_verified_at`
+
+func scanUser(row pgx.Row, user *User) error {
+	return row.Scan(&user.ID, &user.Username, &user.IsAdmin, &user.Plan, &user.StoredBytes, &user.DisabledAt, &user.PasswordResetRequired, &user.RetentionSeconds, &user.DeletedAt, &user.Email, &user.EmailVerifiedAt)
+}
+
+func (r *repository) GetUser(ctx context.Context, userID int64) (User, bool, error) {
+	var user User
+	err := scanUser(r.db.QueryRow(ctx, `SELECT `+userColumns+` FROM users WHERE id = $1`, userID), &user)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return user, false, nil
+		}
+		return user, false, fmt.Errorf("could not retrieve user %d: %v", userID, err)
+	}
+
+	return user, true, nil
+}
+
+func (r *repository) SearchUsers(ctx context.Context, query string, page int64, limit int64) ([]User, error) {
+	users := []User{}
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query) + "%"
+	rows, err := r.db.Query(ctx, `SELECT `+userColumns+` FROM users WHERE username ILIKE $1 ORDER BY id OFFSET $2 LIMIT $3`, pattern, page*limit, limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not search users: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user User
+		if err := scanUser(rows, &user); err != nil {
+			return nil, fmt.Errorf("could not scan user: %v", err)
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+func (r *repository) SetUserRetention(ctx context.Context, userID int64, retention *time.Duration) (bool, error) {
+	var seconds *int64
+	if retention != nil {
+		value := int64(*retention / time.Second)
+		seconds = &value
+	}
+	tag, err := r.db.Exec(ctx, `UPDATE users SET retention_seconds = $1 WHERE id = $2`, seconds, userID)
+	if err != nil {
+		return false, fmt.Errorf("could not set retention of user %d: %v", userID, err)
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+func (r *repository) SetUserDisabled(ctx context.Context, userID int64, disabled bool) (bool, error) {
+	query := `UPDATE users SET disabled_at = NULL WHERE id = $1 AND deleted_at IS NULL`
+	if disabled {
+		query = `UPDATE users SET disabled_at = COALESCE(disabled_at, NOW()), token_version = token_version + 1 WHERE id = $1`
+	}
+	tag, err := r.db.Exec(ctx, query, userID)
+	if err != nil {
+		return false, fmt.Errorf("could not update account state of user %d: %v", userID, err)
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+func (r *repository) RequirePasswordReset(ctx context.Context, userID int64) (bool, error) {
+	query := `UPDATE users SET password_reset_required = TRUE, token_version = token_version + 1 WHERE id = $1`
+	tag, err := r.db.Exec(ctx, query, userID)
+	if err != nil {
+		return false, fmt.Errorf("could not require password reset of user %d: %v", userID, err)
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+func (r *repository) ResetPassword(ctx context.Context, userID int64, hashedPassword string) error {
+	query := `UPDATE users SET password = $2, password_reset_required = FALSE, token_version = token_version + 1 WHERE id = $1`
+	if _, err := r.db.Exec(ctx, query, userID, hashedPassword); err != nil {
+		return fmt.Errorf("could not reset password of user %d: %v", userID, err)
+	}
+
+	return nil
+}
+
+func (r *repository) DeleteAccount(ctx context.Context, userID int64) (bool, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("could not delete account of user %d: %v", userID, err)
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, `UPDATE users SET deleted_at = NOW(), disabled_at = COALESCE(disabled_at, NOW()), token_version = token_version + 1
+		WHERE id = $1 AND deleted_at IS NULL`, userID)
+	if err != nil {
+		return false, fmt.Errorf("could not delete account of user %d: %v", userID, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return false, nil
+	}
+	// Hooks enqueue downloads without a token.
+	if _, err := tx.Exec(ctx, `DELETE FROM hooks WHERE user_id = $1`, userID); err != nil {
+		return false, fmt.Errorf("could not delete hooks of user %d: %v", userID, err)
+	}
+	_, err = tx.Exec(ctx, `WITH canceled AS (
+			UPDATE downloads SET error = $2, status = 'failed', finished_at = NOW() WHERE user_id = $1 AND status IN ('queued', 'downloading') RETURNING id
+		)
+		INSERT INTO queue_events (download_id, type) SELECT id, 'failed' FROM canceled`, userID, CanceledError)
+	if err != nil {
+		return false, fmt.Errorf("could not cancel download requests of user %d: %v", userID, err)
+	}
+	if _, err := tx.Exec(ctx, `UPDATE downloads SET purge_requested_at = COALESCE(purge_requested_at, NOW()) WHERE user_id = $1`, userID); err != nil {
+		return false, fmt.Errorf("could not request purge of download requests of user %d: %v", userID, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return false, fmt.Errorf("could not delete account of user %d: %v", userID, err)
+	}
+
+	return true, nil
+}
+
+func (r *repository) DeletePurgedAccounts(ctx context.Context) (int64, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("could not delete purged accounts: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `SELECT id FROM users WHERE deleted_at IS NOT NULL
+		AND NOT EXISTS (SELECT 1 FROM downloads WHERE user_id = users.id) FOR UPDATE`)
+	if err != nil {
+		return 0, fmt.Errorf("could not retrieve purged accounts: %v", err)
+	}
+	var userIDs []int64
+	for rows.Next() {
+		var userID int64
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("could not scan purged account: %v", err)
+		}
+		userIDs = append(userIDs, userID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("could not retrieve purged accounts: %v", err)
+	}
+	if len(userIDs) == 0 {
+		return 0, nil
+	}
+
+	// The members of the collections and their downloads cascade, so do the memberships of the
+	// organizations.
+	for _, query := range []string{
+		`DELETE FROM notifications WHERE user_id = ANY($1)`,
+		`DELETE FROM completion_scripts WHERE user_id = ANY($1)`,
+		`DELETE FROM origin_profiles WHERE user_id = ANY($1)`,
+		`DELETE FROM folders WHERE user_id = ANY($1)`,
+		`DELETE FROM collections WHERE user_id = ANY($1)`,
+		`DELETE FROM users WHERE id = ANY($1)`,
+	} {
+		if _, err := tx.Exec(ctx, query, userIDs); err != nil {
+			return 0, fmt.Errorf("could not delete purged accounts: %v", err)
+		}
+	}
+	// The organizations left without an owner get their senior admin, or else member, as one,
+	// those left without members are deleted.
+	for _, query := range []string{
+		`UPDATE organization_members m SET role = 'owner' FROM (
+			SELECT DISTINCT ON (org_id) org_id, user_id FROM organization_members
+			WHERE org_id NOT IN (SELECT org_id FROM organization_members WHERE role = 'owner')
+			ORDER BY org_id, role = 'admin' DESC, created_at
+		) heir WHERE m.org_id = heir.org_id AND m.user_id = heir.user_id`,
+		`DELETE FROM organizations o WHERE NOT EXISTS (SELECT 1 FROM organization_members m WHERE m.org_id = o.id)`,
+	} {
+		if _, err := tx.Exec(ctx, query); err != nil {
+			return 0, fmt.Errorf("could not hand over organizations of purged accounts: %v", err)
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("could not delete purged accounts: %v", err)
+	}
+
+	return int64(len(userIDs)), nil
+}
+
+func (r *repository) GetUserDownloadRequests(ctx context.Context, userID int64) ([]downloadRequest, error) {
+	query := `SELECT id, user_id, link, file_name, completed, error, priority, content_hash, status, expires_at, credentials, headers, labels, byte_range, origin_profile_id, max_speed, manifest_url, verification, verification_detail, folder_id, mirrors, host, tier, cold_key, tuning, proxy, error_code, bytes, deleted_at, org_id, metadata FROM downloads
+		WHERE user_id = $1`
+	return r.queryDownloadRequests(ctx, "download requests of the user", query, userID)
+}
+
+// sessionData is how a Session is stored, with its token version.
+type sessionData struct {
+	TokenVersion int64     `json:"token_version"`
+	IP           string    `json:"ip"`
+	UserAgent    string    `json:"user_agent"`
+	IssuedAt     time.Time `json:"issued_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+func (r *repository) AddSession(ctx context.Context, userID int64, session Session) error {
+	data, err := json.Marshal(sessionData{
+		TokenVersion: session.TokenVersion,
+		IP:           session.IP,
+		UserAgent:    session.UserAgent,
+		IssuedAt:     session.IssuedAt,
+		ExpiresAt:    session.ExpiresAt,
+	})
+	if err != nil {
+		return err
+	}
+	// Tokens all live as long, so the one issued last expires last.
+	key := fmt.Sprint(SessionKeyPrefix, userID)
+	pipe := r.rdb.TxPipeline()
+	pipe.HSet(ctx, key, session.ID, data)
+	pipe.ExpireAt(ctx, key, session.ExpiresAt)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("could not save session of user %d: %v", userID, err)
+	}
+
+	return nil
+}
+
+func parseSession(sessionID string, data string) (Session, error) {
+	var stored sessionData
+	if err := json.Unmarshal([]byte(data), &stored); err != nil {
+		return Session{}, fmt.Errorf("invalid session %s: %v", sessionID, err)
+	}
+	return Session{
+		ID:           sessionID,
+		TokenVersion: stored.TokenVersion,
+		IP:           stored.IP,
+		UserAgent:    stored.UserAgent,
+		IssuedAt:     stored.IssuedAt,
+		ExpiresAt:    stored.ExpiresAt,
+	}, nil
+}
+
+func (r *repository) GetSession(ctx context.Context, userID int64, sessionID string) (Session, bool, error) {
+	data, err := r.rdb.HGet(ctx, fmt.Sprint(SessionKeyPrefix, userID), sessionID).Result()
+	if err == redis.Nil {
+		return Session{}, false, nil
+	}
+	if err != nil {
+		return Session{}, false, fmt.Errorf("could not get session %s of user %d: %v", sessionID, userID, err)
+	}
+	session, err := parseSession(sessionID, data)
+	if err != nil {
+		return Session{}, false, err
+	}
+	if !session.ExpiresAt.After(time.Now()) {
+		return Session{}, false, nil
+	}
+
+	return session, true, nil
+}
+
+func (r *repository) GetSessions(ctx context.Context, userID int64) ([]Session, error) {
+	key := fmt.Sprint(SessionKeyPrefix, userID)
+	values, err := r.rdb.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("could not list sessions of user %d: %v", userID, err)
+	}
+
+	var sessions []Session
+	var expired []string
+	for sessionID, data := range values {
+		session, err := parseSession(sessionID, data)
+		if err != nil {
+			return nil, err
+		}
+		if !session.ExpiresAt.After(time.Now()) {
+			expired = append(expired, sessionID)
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	if len(expired) > 0 {
+		if err := r.rdb.HDel(ctx, key, expired...).Err(); err != nil {
+			return nil, fmt.Errorf("could not delete expired sessions of user %d: %v", userID, err)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].IssuedAt.After(sessions[j].IssuedAt) })
+
+	return sessions, nil
+}
+
+func (r *repository) DeleteSession(ctx context.Context, userID int64, sessionID string) (bool, error) {
+	n, err := r.rdb.HDel(ctx, fmt.Sprint(SessionKeyPrefix, userID), sessionID).Result()
+	if err != nil {
+		return false, fmt.Errorf("could not delete session %s of user %d: %v", sessionID, userID, err)
+	}
+
+	return n > 0, nil
+}
+
+func (r *repository) SavePasswordResetToken(ctx context.Context, tokenHash string, userID int64, ttl time.Duration) error {
+	if err := r.rdb.Set(ctx, PasswordResetKeyPrefix+tokenHash, userID, ttl).Err(); err != nil {
+		return fmt.Errorf("could not save password reset token of user %d: %v", userID, err)
+	}
+
+	return nil
+}
+
+func (r *repository) TakePasswordResetToken(ctx context.Context, tokenHash string) (int64, bool, error) {
+	userID, err := r.rdb.GetDel(ctx, PasswordResetKeyPrefix+tokenHash).Int64()
+	if err == redis.Nil {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("could not retrieve password reset token: %v", err)
+	}
+
+	return userID, true, nil
+}
+
+func (r *repository) GetUserDownloadCounts(ctx context.Context, userID int64) (map[string]int64, error) {
+	rows, err := r.db.Query(ctx, `SELECT status, COUNT(*) FROM downloads WHERE user_id = $1 GROUP BY status`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("could not count downloads of user %d: %v", userID, err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var status string
+		var count int64
+		if err := rows.Scan(&status, &count); err != nil {
+			return nil, fmt.Errorf("could not scan download count: %v", err)
+		}
+		counts[status] = count
+	}
+
+	return counts, rows.Err()
+}
+
+func (r *repository) GetUserPlan(ctx context.Context, userID int64) (string, error) {
+	var plan string
+	err := r.db.QueryRow(ctx, `SELECT plan FROM users WHERE id = $1`, userID).Scan(&plan)
+	if err != nil {
+		return "", fmt.Errorf("could not retrieve plan of user %d: %v", userID, err)
+	}
+
+	return plan, nil
+}
+
+func (r *repository) GetUserUsage(ctx context.Context, userID int64) (int64, error) {
+	var storedBytes int64
+	err := r.db.QueryRow(ctx, `SELECT stored_bytes FROM users WHERE id = $1`, userID).Scan(&storedBytes)
+	if err != nil {
+		return 0, fmt.Errorf("could not retrieve usage of user %d: %v", userID, err)
+	}
+
+	return storedBytes, nil
+}
+
+// AddUserUsage adds bytes (may be negative) to the stored bytes of the user and returns the new total.
+func (r *repository) AddUserUsage(ctx context.Context, userID int64, bytes int64) (int64, error) {
+	var storedBytes int64
+	query := `UPDATE users SET stored_bytes = GREATEST(stored_bytes + $1, 0) WHERE id = $2 RETURNING stored_bytes`
+	err := r.db.QueryRow(ctx, query, bytes, userID).Scan(&storedBytes)
+	if err != nil {
+		return 0, fmt.Errorf("could not update usage of user %d: %v", userID, err)
+	}
+
+	return storedBytes, nil
+}
+
+func (r *repository) PushDownloadRequest(ctx context.Context, downloadID int64) error {
+	var userID int64
+	err := r.db.QueryRow(ctx, `SELECT user_id FROM downloads WHERE id = $1`, downloadID).Scan(&userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil // deleted meanwhile, nothing to download
+	}
+	if err != nil {
+		return fmt.Errorf("could not get user of download request %d: %v", downloadID, err)
+	}
+
+	user := strconv.FormatInt(userID, 10)
+	if err := r.push(ctx, UserQueueKeyPrefix+user, downloadID); err != nil {
+		return err
+	}
+	return r.joinQueueUsers(ctx, user)
+}
+
+// joinQueueUsers gives turns to the user after a request was pushed to their queue.
+func (r *repository) joinQueueUsers(ctx context.Context, user string) error {
+	err := joinQueueUsersScript.Run(ctx, r.rdb, []string{QueueUsersKey, QueueUserVersionsKey, QueueUsersSeqKey}, user).Err()
+	if err != nil {
+		return fmt.Errorf("could not give turns to user %s: %v", user, err)
+	}
+
+	return nil
+}
+
+func (r *repository) PushDownloadRequestToHost(ctx context.Context, downloadID int64, host string) error {
+	alive, err := r.IsInstanceAlive(ctx, host)
+	if err != nil {
+		return err
+	}
+	if !alive {
+		return r.PushDownloadRequest(ctx, downloadID)
+	}
+
+	return r.push(ctx, HostQueueKeyPrefix+host, downloadID)
+}
+
+// push records when the request was first pushed, before pushing it so that a worker can not
+// start it before.
+func (r *repository) push(ctx context.Context, key string, downloadID int64) error {
+	err := r.rdb.ZAddNX(ctx, QueuedAtKey, redis.Z{Score: float64(time.Now().UnixMilli()), Member: downloadID}).Err()
+	if err != nil {
+		return fmt.Errorf("could not record push time of download request %d: %v", downloadID, err)
+	}
+
+	return r.queue.Push(ctx, key, downloadID)
+}
+
+func (r *repository) PopDownloadRequest(ctx context.Context, host string, consumer string) (QueueEntry, error) {
+	if host != "" {
+		entry, found, err := r.queue.Pop(ctx, HostQueueKeyPrefix+host, consumer)
+		if err != nil || found {
+			return entry, err
+		}
+	}
+
+	keys := []string{QueueUsersKey, QueueUserVersionsKey}
+	for {
+		turn, err := takeTurnScript.Run(ctx, r.rdb, keys).StringSlice()
+		if err == redis.Nil {
+			break
+		}
+		if err != nil {
+			return QueueEntry{}, fmt.Errorf("could not take turn between users: %v", err)
+		}
+
+		entry, found, err := r.queue.Pop(ctx, UserQueueKeyPrefix+turn[0], consumer)
+		if err != nil || found {
+			return entry, err
+		}
+		// The entries left are read by other workers: back in turn if one is not acknowledged
+		// (see RestoreQueueUsers), or when a request is pushed.
+		if err := leaveQueueUsersScript.Run(ctx, r.rdb, keys, turn[0], turn[1]).Err(); err != nil {
+			return QueueEntry{}, fmt.Errorf("could not take user %s out of turn: %v", turn[0], err)
+		}
+	}
+
+	// Pushed by older versions.
+	entry, found, err := r.queue.Pop(ctx, DownloadRequestsKey, consumer)
+	if err != nil || found {
+		return entry, err
+	}
+	return QueueEntry{}, NoMoreDownloadRequestErr
+}
+
+func (r *repository) AckDownloadRequest(ctx context.Context, entry QueueEntry) error {
+	return r.queue.Ack(ctx, entry)
+}
+
+// queueKeys lists the shared queue, the queues of the users and the queues of the hosts.
+func (r *repository) queueKeys(ctx context.Context) ([]string, error) {
+	userKeys, err := r.queue.UserKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	hostKeys, err := r.queue.HostKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]string{DownloadRequestsKey}, userKeys...), hostKeys...), nil
+}
+
+func (r *repository) RequeueDeadHosts(ctx context.Context) ([]int64, error) {
+	keys, err := r.queue.HostKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var downloadIDs []int64
+	for _, key := range keys {
+		host := strings.TrimPrefix(key, HostQueueKeyPrefix)
+		alive, err := r.IsInstanceAlive(ctx, host)
+		if err != nil {
+			return downloadIDs, err
+		}
+		if alive {
+			continue
+		}
+
+		// Read and unacknowledged entries too: the consumers of a dead host are dead.
+		entries, err := r.queue.Entries(ctx, key)
+		if err != nil {
+			return downloadIDs, err
+		}
+		for _, entry := range entries {
+			if err := r.PushDownloadRequest(ctx, entry.DownloadID); err != nil {
+				return downloadIDs, err
+			}
+			downloadIDs = append(downloadIDs, entry.DownloadID)
+		}
+		if err := r.queue.Delete(ctx, key); err != nil {
+			return downloadIDs, fmt.Errorf("could not delete queue of host %s: %v", host, err)
+		}
+	}
+	return downloadIDs, nil
+}
+
+// RestoreQueueUsers drops the empty queues of the users out of turn only: a request pushed
+// meanwhile is lost with the queue, and requeued by the reconciliation like any lost push.
+func (r *repository) RestoreQueueUsers(ctx context.Context) error {
+	keys, err := r.queue.UserKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		user := strings.TrimPrefix(key, UserQueueKeyPrefix)
+		queued, _, err := r.queue.Len(ctx, key)
+		if err != nil {
+			return err
+		}
+		if queued > 0 {
+			if err := r.joinQueueUsers(ctx, user); err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = r.rdb.ZScore(ctx, QueueUsersKey, user).Err()
+		if err == nil {
+			continue // in turn, a request was just pushed
+		}
+		if err != redis.Nil {
+			return fmt.Errorf("could not get turns of user %s: %v", user, err)
+		}
+		if err := r.queue.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *repository) SetInstanceHeartbeat(ctx context.Context, instanceID string, ttl time.Duration) error {
+	err := r.rdb.Set(ctx, InstanceKeyPrefix+instanceID, time.Now().Unix(), ttl).Err()
+	if err != nil {
+		return fmt.Errorf("could not set heartbeat of instance %s: %v", instanceID, err)
+	}
+
+	return nil
+}
+
+// IsInstanceAlive reports whether the process with the instance ID sent a heartbeat lately.
+// A process is declared dead once its heartbeat expired, and the empty ID is never alive.
+func (r *repository) IsInstanceAlive(ctx context.Context, instanceID string) (bool, error) {
+	if instanceID == "" {
+		return false, nil
+	}
+	n, err := r.rdb.Exists(ctx, InstanceKeyPrefix+instanceID).Result()
+	if err != nil {
+		return false, fmt.Errorf("could not check heartbeat of instance %s: %v", instanceID, err)
+	}
+
+	return n > 0, nil
+}
+
+// GetQueuedDownloadRequests returns the requests waiting in the shared queue and in the queues
+// of the users and of the hosts, including the ones read by a worker that did not acknowledge them yet.
+func (r *repository) GetQueuedDownloadRequests(ctx context.Context) ([]int64, error) {
+	keys, err := r.queueKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var downloadIDs []int64
+	for _, key := range keys {
+		entries, err := r.queue.Entries(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			downloadIDs = append(downloadIDs, entry.DownloadID)
+		}
+	}
+
+	// Waiting in the outbox to be pushed, or spilled there.
+	rows, err := r.db.Query(ctx, `SELECT download_id FROM outbox WHERE sent_at IS NULL`)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve outbox: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var downloadID int64
+		if err := rows.Scan(&downloadID); err != nil {
+			return nil, fmt.Errorf("could not scan outbox entry: %v", err)
+		}
+		downloadIDs = append(downloadIDs, downloadID)
+	}
+	return downloadIDs, nil
+}
+
+// GetLockedDownloadRequests reports which of the download requests are currently locked by a worker.
+func (r *repository) GetLockedDownloadRequests(ctx context.Context, downloadIDs []int64) (map[int64]bool, error) {
+	pipe := r.rdb.Pipeline()
+	cmds := make(map[int64]*redis.IntCmd, len(downloadIDs))
+	for _, downloadID := range downloadIDs {
+		cmds[downloadID] = pipe.Exists(ctx, fmt.Sprint(downloadID))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("could not check locks: %v", err)
+	}
+
+	locked := make(map[int64]bool, len(downloadIDs))
+	for downloadID, cmd := range cmds {
+		locked[downloadID] = cmd.Val() > 0
+	}
+	return locked, nil
+}
+
+func (r *repository) SetProgress(ctx context.Context, downloadID int64, progress Progress) error {
+	key := fmt.Sprint(ProgressKeyPrefix, downloadID)
+	pipe := r.rdb.TxPipeline()
+	pipe.HSet(ctx, key, progress)
+	pipe.Expire(ctx, key, ProgressExpTime)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("could not set progress of download request %d: %v", downloadID, err)
+	}
+
+	return nil
+}
+
+func (r *repository) GetProgress(ctx context.Context, downloadID int64) (Progress, bool, error) {
+	var progress Progress
+	cmd := r.rdb.HGetAll(ctx, fmt.Sprint(ProgressKeyPrefix, downloadID))
+	if err := cmd.Err(); err != nil {
+		return progress, false, fmt.Errorf("could not get progress of download request %d: %v", downloadID, err)
+	}
+	if len(cmd.Val()) == 0 {
+		return progress, false, nil
+	}
+	if err := cmd.Scan(&progress); err != nil {
+		return progress, false, fmt.Errorf("could not scan progress of download request %d: %v", downloadID, err)
+	}
+
+	return progress, true, nil
+}
+
+func (r *repository) GetProgresses(ctx context.Context, downloadIDs []int64) (map[int64]Progress, error) {
+	pipe := r.rdb.Pipeline()
+	cmds := make(map[int64]*redis.MapStringStringCmd, len(downloadIDs))
+	for _, downloadID := range downloadIDs {
+		cmds[downloadID] = pipe.HGetAll(ctx, fmt.Sprint(ProgressKeyPrefix, downloadID))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("could not get progress: %v", err)
+	}
+
+	progresses := make(map[int64]Progress, len(downloadIDs))
+	for downloadID, cmd := range cmds {
+		if len(cmd.Val()) == 0 {
+			continue
+		}
+		var progress Progress
+		if err := cmd.Scan(&progress); err != nil {
+			return nil, fmt.Errorf("could not scan progress of download request %d: %v", downloadID, err)
+		}
+		progresses[downloadID] = progress
+	}
+	return progresses, nil
+}
+
+// GetQueueTimeline counts the queue events between from and to in buckets of the given
+// size, aligned to the unix epoch. Buckets without events are included.
+func (r *repository) GetQueueTimeline(ctx context.Context, from time.Time, to time.Time, bucket time.Duration) ([]TimelineBucket, error) {
+	from = time.UnixMilli(from.UnixMilli() / bucket.Milliseconds() * bucket.Milliseconds())
+	var buckets []TimelineBucket
+	for start := from; start.Before(to); start = start.Add(bucket) {
+		buckets = append(buckets, TimelineBucket{Start: start.UTC()})
+	}
+
+	query := `SELECT FLOOR(EXTRACT(EPOCH FROM created_at) * 1000 / $3)::BIGINT, type, COUNT(*) FROM queue_events
+		WHERE created_at >= $1 AND created_at < $2 GROUP BY 1, 2`
+	rows, err := r.db.Query(ctx, query, from, to, bucket.Milliseconds())
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve queue timeline: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var index, count int64
+		var eventType string
+		if err := rows.Scan(&index, &eventType, &count); err != nil {
+			return nil, fmt.Errorf("could not scan queue timeline: %v", err)
+		}
+
+		i := index - from.UnixMilli()/bucket.Milliseconds()
+		if i < 0 || i >= int64(len(buckets)) {
+			continue
+		}
+		switch eventType {
+		case QueueEventEnqueued:
+			buckets[i].Enqueued = count
+		case QueueEventClaimed:
+			buckets[i].Claimed = count
+		case QueueEventCompleted:
+			buckets[i].Completed = count
+		case QueueEventFailed:
+			buckets[i].Failed = count
+		case QueueEventExpired:
+			buckets[i].Expired = count
+		}
+	}
+
+	return buckets, rows.Err()
+}
+
+func (r *repository) PurgeQueueEvents(ctx context.Context, olderThan time.Duration) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM queue_events WHERE created_at < NOW() - $1::BIGINT * INTERVAL '1 millisecond'`, olderThan.Milliseconds())
+	if err != nil {
+		return fmt.Errorf("could not purge queue events: %v", err)
+	}
+
+	return nil
+}
+
+func (r *repository) GetQueueStats(ctx context.Context) (QueueStats, error) {
+	var stats QueueStats
+	keys, err := r.queueKeys(ctx)
+	if err != nil {
+		return stats, err
+	}
+	for _, key := range keys {
+		queued, unacked, err := r.queue.Len(ctx, key)
+		if err != nil {
+			return stats, err
+		}
+		stats.Queued += queued
+		stats.Unacked += unacked
+	}
+
+	query := `SELECT
+		COUNT(*) FILTER (WHERE status IN ('queued', 'downloading')),
+		COUNT(*) FILTER (WHERE status = 'completed'),
+		COUNT(*) FILTER (WHERE status = 'failed'),
+		COUNT(*) FILTER (WHERE status = 'expired')
+		FROM downloads`
+	err = r.db.QueryRow(ctx, query).Scan(&stats.Pending, &stats.Completed, &stats.Failed, &stats.Expired)
+	if err != nil {
+		return stats, fmt.Errorf("could not count downloads: %v", err)
+	}
+
+	return stats, nil
+}
+
+func (r *repository) QueueDepth(ctx context.Context) (int64, error) {
+	keys, err := r.queueKeys(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var depth int64
+	for _, key := range keys {
+		queued, _, err := r.queue.Len(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		depth += queued
+	}
+	return depth, nil
+}
+
+func (r *repository) OldestQueuedAge(ctx context.Context) (time.Duration, error) {
+	oldest, err := r.rdb.ZRangeWithScores(ctx, QueuedAtKey, 0, 0).Result()
+	if err != nil {
+		return 0, fmt.Errorf("could not get oldest queued download request: %v", err)
+	}
+	if len(oldest) == 0 {
+		return 0, nil
+	}
+
+	return time.Since(time.UnixMilli(int64(oldest[0].Score))), nil
+}
+
+// PruneQueuedAt only looks at the requests pushed before the queues are listed, the others
+// may not be listed yet.
+func (r *repository) PruneQueuedAt(ctx context.Context) error {
+	listedAt := time.Now().UnixMilli()
+	queuedIDs, err := r.GetQueuedDownloadRequests(ctx)
+	if err != nil {
+		return err
+	}
+	queued := make(map[string]bool, len(queuedIDs))
+	for _, downloadID := range queuedIDs {
+		queued[strconv.FormatInt(downloadID, 10)] = true
+	}
+
+	members, err := r.rdb.ZRangeByScore(ctx, QueuedAtKey, &redis.ZRangeBy{Min: "-inf", Max: strconv.FormatInt(listedAt, 10)}).Result()
+	if err != nil {
+		return fmt.Errorf("could not list push times of download requests: %v", err)
+	}
+	var stale []any
+	for _, member := range members {
+		if !queued[member] {
+			stale = append(stale, member)
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	if err := r.rdb.ZRem(ctx, QueuedAtKey, stale...).Err(); err != nil {
+		return fmt.Errorf("could not forget push times of download requests: %v", err)
+	}
+	return nil
+}
+
+func (r *repository) SetWorkerHeartbeats(ctx context.Context, heartbeats []WorkerHeartbeat, ttl time.Duration) error {
+	pipe := r.rdb.Pipeline()
+	for _, heartbeat := range heartbeats {
+		data, err := json.Marshal(heartbeat)
+		if err != nil {
+			return fmt.Errorf("could not encode heartbeat of worker %s: %v", heartbeat.Worker, err)
+		}
+		pipe.Set(ctx, WorkerHeartbeatKeyPrefix+heartbeat.Worker, data, ttl)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("could not set worker heartbeats: %v", err)
+	}
+
+	return nil
+}
+
+// GetWorkerHeartbeats returns the heartbeats of the workers of all the processes, by worker.
+func (r *repository) GetWorkerHeartbeats(ctx context.Context) ([]WorkerHeartbeat, error) {
+	var keys []string
+	iter := r.rdb.Scan(ctx, 0, WorkerHeartbeatKeyPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("could not list worker heartbeats: %v", err)
+	}
+
+	heartbeats := []WorkerHeartbeat{}
+	if len(keys) == 0 {
+		return heartbeats, nil
+	}
+	values, err := r.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("could not get worker heartbeats: %v", err)
+	}
+	for _, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue // expired since the scan
+		}
+		var heartbeat WorkerHeartbeat
+		if err := json.Unmarshal([]byte(data), &heartbeat); err != nil {
+			return nil, fmt.Errorf("could not decode worker heartbeat: %v", err)
+		}
+		heartbeats = append(heartbeats, heartbeat)
+	}
+
+	sort.Slice(heartbeats, func(i, j int) bool { return heartbeats[i].Worker < heartbeats[j].Worker })
+	return heartbeats, nil
+}
+
+// IsWorkerAlive reports whether the worker sent a heartbeat lately.
+func (r *repository) IsWorkerAlive(ctx context.Context, worker string) (bool, error) {
+	n, err := r.rdb.Exists(ctx, WorkerHeartbeatKeyPrefix+worker).Result()
+	if err != nil {
+		return false, fmt.Errorf("could not check heartbeat of worker %s: %v", worker, err)
+	}
+
+	return n > 0, nil
+}
+
+func (r *repository) SetDownloadOwner(ctx context.Context, downloadID int64, owner DownloadOwner) error {
+	data, err := json.Marshal(owner)
+	if err != nil {
+		return fmt.Errorf("could not encode owner of download request %d: %v", downloadID, err)
+	}
+	if err := r.rdb.HSet(ctx, DownloadOwnersKey, fmt.Sprint(downloadID), data).Err(); err != nil {
+		return fmt.Errorf("could not set owner of download request %d: %v", downloadID, err)
+	}
+
+	return nil
+}
+
+func (r *repository) ClearDownloadOwner(ctx context.Context, downloadID int64, token string) error {
+	err := clearOwnerScript.Run(ctx, r.rdb, []string{DownloadOwnersKey}, downloadID, token).Err()
+	if err != nil {
+		return fmt.Errorf("could not clear owner of download request %d: %v", downloadID, err)
+	}
+
+	return nil
+}
+
+func (r *repository) GetDownloadOwners(ctx context.Context) (map[int64]DownloadOwner, error) {
+	values, err := r.rdb.HGetAll(ctx, DownloadOwnersKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("could not get owners of download requests: %v", err)
+	}
+
+	owners := make(map[int64]DownloadOwner, len(values))
+	for field, data := range values {
+		downloadID, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			continue
+		}
+		var owner DownloadOwner
+		if err := json.Unmarshal([]byte(data), &owner); err != nil {
+			return nil, fmt.Errorf("could not decode owner of download request %d: %v", downloadID, err)
+		}
+		owners[downloadID] = owner
+	}
+	return owners, nil
+}
+
+func (r *repository) ReapDownloadOwner(ctx context.Context, downloadID int64, token string) (bool, error) {
+	reaped, err := reapOwnerScript.Run(ctx, r.rdb, []string{DownloadOwnersKey, fmt.Sprint(downloadID)}, downloadID, token).Bool()
+	if err != nil {
+		return false, fmt.Errorf("could not reap owner of download request %d: %v", downloadID, err)
+	}
+
+	return reaped, nil
+}
+
+func (r *repository) SetProcessHeartbeat(ctx context.Context, heartbeat ProcessHeartbeat, ttl time.Duration) error {
+	data, err := json.Marshal(heartbeat)
+	if err != nil {
+		return fmt.Errorf("could not encode heartbeat of process %s: %v", heartbeat.InstanceID, err)
+	}
+	if err := r.rdb.Set(ctx, ProcessHeartbeatKeyPrefix+heartbeat.InstanceID, data, ttl).Err(); err != nil {
+		return fmt.Errorf("could not set heartbeat of process %s: %v", heartbeat.InstanceID, err)
+	}
+
+	return nil
+}
+
+func (r *repository) GetProcessHeartbeats(ctx context.Context) ([]ProcessHeartbeat, error) {
+	var keys []string
+	iter := r.rdb.Scan(ctx, 0, ProcessHeartbeatKeyPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("could not list process heartbeats: %v", err)
+	}
+
+	heartbeats := []ProcessHeartbeat{}
+	if len(keys) == 0 {
+		return heartbeats, nil
+	}
+	values, err := r.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("could not get process heartbeats: %v", err)
+	}
+	for _, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue // expired since the scan
+		}
+		var heartbeat ProcessHeartbeat
+		if err := json.Unmarshal([]byte(data), &heartbeat); err != nil {
+			return nil, fmt.Errorf("could not decode process heartbeat: %v", err)
+		}
+		heartbeats = append(heartbeats, heartbeat)
+	}
+
+	sort.Slice(heartbeats, func(i, j int) bool { return heartbeats[i].InstanceID < heartbeats[j].InstanceID })
+	return heartbeats, nil
+}
+
+func (r *repository) SetVolumes(ctx context.Context, hostname string, volumes []Volume, ttl time.Duration) error {
+	for i := range volumes {
+		volumes[i].Host = hostname
+	}
+	data, err := json.Marshal(volumes)
+	if err != nil {
+		return fmt.Errorf("could not encode volumes of host %s: %v", hostname, err)
+	}
+	if err := r.rdb.Set(ctx, VolumesKeyPrefix+hostname, data, ttl).Err(); err != nil {
+		return fmt.Errorf("could not set volumes of host %s: %v", hostname, err)
+	}
+
+	return nil
+}
+
+func (r *repository) GetVolumes(ctx context.Context) ([]Volume, error) {
+	var keys []string
+	iter := r.rdb.Scan(ctx, 0, VolumesKeyPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("could not list volumes: %v", err)
+	}
+
+	volumes := []Volume{}
+	if len(keys) == 0 {
+		return volumes, nil
+	}
+	values, err := r.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("could not get volumes: %v", err)
+	}
+	for _, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue // expired since the scan
+		}
+		var hostVolumes []Volume
+		if err := json.Unmarshal([]byte(data), &hostVolumes); err != nil {
+			return nil, fmt.Errorf("could not decode volumes: %v", err)
+		}
+		volumes = append(volumes, hostVolumes...)
+	}
+
+	sort.Slice(volumes, func(i, j int) bool {
+		if volumes[i].Host != volumes[j].Host {
+			return volumes[i].Host < volumes[j].Host
+		}
+		return volumes[i].Name < volumes[j].Name
+	})
+	return volumes, nil
+}
+
+const downloadSummaryColumns = `d.id, d.user_id, d.link, d.status, d.error, d.started_at, d.finished_at,
+	(SELECT COUNT(*) FROM attempts a WHERE a.download_id = d.id)`
+
+func scanDownloadSummaries(rows pgx.Rows) ([]DownloadSummary, error) {
+	summaries := []DownloadSummary{}
+	for rows.Next() {
+		var summary DownloadSummary
+		err := rows.Scan(&summary.ID, &summary.UserID, &summary.Link, &summary.Status, &summary.Error, &summary.StartedAt, &summary.FinishedAt, &summary.Attempts)
+		if err != nil {
+			return nil, fmt.Errorf("could not scan download summary: %v", err)
+		}
+		summary.Retries = max(summary.Attempts-1, 0)
+		summaries = append(summaries, summary)
+	}
+
+	return summaries, nil
+}
+
+func (r *repository) GetDownloadSummaries(ctx context.Context, downloadIDs []int64) ([]DownloadSummary, error) {
+	query := `SELECT ` + downloadSummaryColumns + ` FROM downloads d WHERE d.id = ANY($1) ORDER BY d.id`
+	rows, err := r.db.Query(ctx, query, downloadIDs)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve download summaries: %v", err)
+	}
+	defer rows.Close()
+
+	return scanDownloadSummaries(rows)
+}
+
+// GetRecentFailures returns the last failed downloads, the latest first.
+func (r *repository) GetRecentFailures(ctx context.Context, limit int64) ([]DownloadSummary, error) {
+	query := `SELECT ` + downloadSummaryColumns + ` FROM downloads d WHERE d.status = 'failed' ORDER BY d.finished_at DESC NULLS LAST LIMIT $1`
+	rows, err := r.db.Query(ctx, query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve recent failures: %v", err)
+	}
+	defer rows.Close()
+
+	return scanDownloadSummaries(rows)
+}
+
+func (r *repository) PingDB(ctx context.Context) error {
+	if err := r.db.Ping(ctx); err != nil {
+		return fmt.Errorf("could not ping postgres: %v", err)
+	}
+	return nil
+}
+
+func (r *repository) PingRedis(ctx context.Context) error {
+	if err := r.rdb.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("could not ping redis: %v", err)
+	}
+	return nil
+}
+
+func (r *repository) PingQueue(ctx context.Context) error {
+	return r.queue.Ping(ctx)
+}
+
+func (r *repository) GetSchemaVersion(ctx context.Context) (int64, error) {
+	var version int64
+	err := r.db.QueryRow(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "42P01" { // undefined_table
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("could not get schema version: %v", err)
+	}
+
+	return version, nil
+}
+
+func (r *repository) AcquireLock(ctx context.Context, downloadID int64, token string, expiration time.Duration) (bool, error) {
+	succeeded, err := acquireLockScript.Run(ctx, r.rdb, []string{fmt.Sprint(downloadID)}, token, expiration.Milliseconds()).Bool()
+	if err != nil {
+		return false, fmt.Errorf("Error acquiring lock: %v", err)
+	}
+	return succeeded, nil
+}
+
+func (r *repository) ExtendLock(ctx context.Context, downloadID int64, token string, expiration time.Duration) (bool, error) {
+	succeeded, err := extendLockScript.Run(ctx, r.rdb, []string{fmt.Sprint(downloadID)}, token, expiration.Milliseconds()).Bool()
+	if err != nil {
+		return false, fmt.Errorf("Error extending lock: %v", err)
+	}
+	return succeeded, nil
+}
+
+func (r *repository) ReleaseLock(ctx context.Context, downloadID int64, token string) error {
+	_, err := releaseLockScript.Run(ctx, r.rdb, []string{fmt.Sprint(downloadID)}, token).Result()
 	if err != nil {
 		return fmt.Errorf("Error releasing lock: %v", err)
 	}
@@ -193,9 +3586,1285 @@ func (r *repository) ReleaseLock(ctx context.Context, downloadID int64) error {
 	return nil
 }
 
-func New(db *pgx.Conn, rdb *redis.Client) Repository {
+func (r *repository) AcquireUserSlot(ctx context.Context, userID int64, downloadID int64, limit int64, ttl time.Duration) (bool, bool, error) {
+	result, err := acquireSlotScript.Run(ctx, r.rdb, []string{fmt.Sprint(UserSlotsKeyPrefix, userID)}, time.Now().UnixMilli(), downloadID, limit, ttl.Milliseconds()).Int64()
+	if err != nil {
+		return false, false, fmt.Errorf("could not acquire slot of user %d for download request %d: %v", userID, downloadID, err)
+	}
+	return result > 0, result == 2, nil
+}
+
+func (r *repository) ReleaseUserSlot(ctx context.Context, userID int64, downloadID int64) error {
+	if err := r.rdb.ZRem(ctx, fmt.Sprint(UserSlotsKeyPrefix, userID), downloadID).Err(); err != nil {
+		return fmt.Errorf("could not release slot of user %d for download request %d: %v", userID, downloadID, err)
+	}
+	return nil
+}
+
+func (r *repository) AcquireConnectionSlots(ctx context.Context, downloadID int64, want int64, limit int64, ttl time.Duration) (int64, bool, error) {
+	values, err := acquireConnectionsScript.Run(ctx, r.rdb, []string{ConnectionSlotsKey}, time.Now().UnixMilli(), downloadID, limit, ttl.Milliseconds(), want).Int64Slice()
+	if err != nil {
+		return 0, false, fmt.Errorf("could not acquire connection slots for download request %d: %v", downloadID, err)
+	}
+	return values[0], values[1] == 1, nil
+}
+
+func (r *repository) ReleaseConnectionSlots(ctx context.Context, downloadID int64, slots int64) error {
+	if slots <= 0 {
+		return nil
+	}
+	members := make([]any, slots)
+	for i := range members {
+		members[i] = fmt.Sprintf("%d:%d", downloadID, i)
+	}
+	if err := r.rdb.ZRem(ctx, ConnectionSlotsKey, members...).Err(); err != nil {
+		return fmt.Errorf("could not release connection slots of download request %d: %v", downloadID, err)
+	}
+	return nil
+}
+
+func (r *repository) TakeFleetBandwidth(ctx context.Context, process string, want int64, budget int64, slice time.Duration) (int64, error) {
+	index := time.Now().UnixMilli() / slice.Milliseconds()
+	keys := []string{
+		fmt.Sprint(FleetBandwidthKeyPrefix, index),
+		fmt.Sprint(FleetBandwidthKeyPrefix, index, ":wants"),
+		fmt.Sprint(FleetBandwidthKeyPrefix, index-1, ":wants"),
+	}
+	taken, err := takeBandwidthScript.Run(ctx, r.rdb, keys, want, budget, process, 2*slice.Milliseconds()).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("could not take fleet bandwidth: %v", err)
+	}
+	return taken, nil
+}
+
+func (r *repository) RateLimit(ctx context.Context, key string, limit int64, window time.Duration, hits int64) (RateLimitResult, error) {
+	now := time.Now()
+	member := fmt.Sprintf("%d-%d", now.UnixNano(), rand.Int63())
+	values, err := rateLimitScript.Run(ctx, r.rdb, []string{RateLimitKeyPrefix + key}, now.UnixMilli(), window.Milliseconds(), limit, member, hits).Int64Slice()
+	if err != nil {
+		return RateLimitResult{}, fmt.Errorf("could not check rate limit %s: %v", key, err)
+	}
+
+	return RateLimitResult{
+		Allowed:   values[0] == 1,
+		Remaining: max(limit-values[1], 0),
+		Reset:     time.Duration(values[2]) * time.Millisecond,
+	}, nil
+}
+
+func (r *repository) ReserveIdempotencyKey(ctx context.Context, key string, fingerprint string, ttl time.Duration) (IdempotentResponse, bool, error) {
+	data, err := json.Marshal(IdempotentResponse{Fingerprint: fingerprint})
+	if err != nil {
+		return IdempotentResponse{}, false, err
+	}
+
+	// Twice, in case the stored response expires between SETNX and GET.
+	for i := 0; i < 2; i++ {
+		reserved, err := r.rdb.SetNX(ctx, IdempotencyKeyPrefix+key, data, ttl).Result()
+		if err != nil {
+			return IdempotentResponse{}, false, fmt.Errorf("could not reserve idempotency key %s: %v", key, err)
+		}
+		if reserved {
+			return IdempotentResponse{}, true, nil
+		}
+
+		stored, err := r.rdb.Get(ctx, IdempotencyKeyPrefix+key).Bytes()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return IdempotentResponse{}, false, fmt.Errorf("could not get idempotent response %s: %v", key, err)
+		}
+		var response IdempotentResponse
+		if err := json.Unmarshal(stored, &response); err != nil {
+			return IdempotentResponse{}, false, fmt.Errorf("invalid idempotent response %s: %v", key, err)
+		}
+		return response, false, nil
+	}
+	return IdempotentResponse{}, false, fmt.Errorf("could not reserve idempotency key %s", key)
+}
+
+func (r *repository) SaveIdempotentResponse(ctx context.Context, key string, response IdempotentResponse, ttl time.Duration) error {
+	data, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	if err := r.rdb.Set(ctx, IdempotencyKeyPrefix+key, data, ttl).Err(); err != nil {
+		return fmt.Errorf("could not save idempotent response %s: %v", key, err)
+	}
+
+	return nil
+}
+
+func (r *repository) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	if err := r.rdb.Del(ctx, IdempotencyKeyPrefix+key).Err(); err != nil {
+		return fmt.Errorf("could not release idempotency key %s: %v", key, err)
+	}
+
+	return nil
+}
+
+func (r *repository) GetProxyCacheEntry(ctx context.Context, url string) (ProxyCacheEntry, bool, error) {
+	query := `SELECT url, content_hash, content_type, etag, last_modified, size, fetched_at FROM proxy_cache WHERE url = $1`
+
+	var entry ProxyCacheEntry
+	err := r.db.QueryRow(ctx, query, url).Scan(&entry.URL, &entry.ContentHash, &entry.ContentType, &entry.ETag, &entry.LastModified, &entry.Size, &entry.FetchedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return entry, false, nil
+		}
+		return entry, false, fmt.Errorf("could not retrieve proxy cache entry %s: %v", url, err)
+	}
+
+	return entry, true, nil
+}
+
+// SaveProxyCacheEntry inserts or replaces the cache entry of the URL and returns the
+// content hash it previously pointed to (empty if none).
+func (r *repository) SaveProxyCacheEntry(ctx context.Context, entry ProxyCacheEntry) (string, error) {
+	var previousHash string
+	err := r.db.QueryRow(ctx, `SELECT content_hash FROM proxy_cache WHERE url = $1`, entry.URL).Scan(&previousHash)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return "", fmt.Errorf("could not retrieve proxy cache entry %s: %v", entry.URL, err)
+	}
+
+	query := `INSERT INTO proxy_cache (url, content_hash, content_type, etag, last_modified, size, fetched_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NOW())
+		ON CONFLICT (url) DO UPDATE SET content_hash = $2, content_type = $3, etag = $4, last_modified = $5, size = $6, fetched_at = NOW()`
+	_, err = r.db.Exec(ctx, query, entry.URL, entry.ContentHash, entry.ContentType, entry.ETag, entry.LastModified, entry.Size)
+	if err != nil {
+		return "", fmt.Errorf("could not save proxy cache entry %s: %v", entry.URL, err)
+	}
+
+	return previousHash, nil
+}
+
+// TouchProxyCacheEntry marks the cached response as revalidated now.
+func (r *repository) TouchProxyCacheEntry(ctx context.Context, url string) error {
+	_, err := r.db.Exec(ctx, `UPDATE proxy_cache SET fetched_at = NOW() WHERE url = $1`, url)
+	if err != nil {
+		return fmt.Errorf("could not touch proxy cache entry %s: %v", url, err)
+	}
+
+	return nil
+}
+
+func (r *repository) GetCachePolicies(ctx context.Context) ([]CachePolicy, error) {
+	policies := []CachePolicy{}
+	rows, err := r.db.Query(ctx, `SELECT id, url_prefix, max_age_seconds, no_store FROM cache_policies ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve cache policies: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var policy CachePolicy
+		if err := rows.Scan(&policy.ID, &policy.URLPrefix, &policy.MaxAge, &policy.NoStore); err != nil {
+			return nil, fmt.Errorf("could not scan cache policy: %v", err)
+		}
+		policies = append(policies, policy)
+	}
+
+	return policies, nil
+}
+
+func (r *repository) CreateCachePolicy(ctx context.Context, policy CachePolicy) (int64, error) {
+	var policyID int64
+	query := `INSERT INTO cache_policies (url_prefix, max_age_seconds, no_store) VALUES ($1, $2, $3) RETURNING id`
+	err := r.db.QueryRow(ctx, query, policy.URLPrefix, policy.MaxAge, policy.NoStore).Scan(&policyID)
+	if err != nil {
+		return 0, fmt.Errorf("could not create cache policy %s: %v", policy.URLPrefix, err)
+	}
+
+	return policyID, nil
+}
+
+func (r *repository) DeleteCachePolicy(ctx context.Context, policyID int64) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM cache_policies WHERE id = $1`, policyID)
+	if err != nil {
+		return fmt.Errorf("could not delete cache policy %d: %v", policyID, err)
+	}
+
+	return nil
+}
+
+func (r *repository) GetFeatureFlags(ctx context.Context) ([]FeatureFlag, error) {
+	flags := []FeatureFlag{}
+	rows, err := r.db.Query(ctx, `SELECT name, enabled, rollout_percent, user_ids, updated_at FROM feature_flags ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve feature flags: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var flag FeatureFlag
+		if err := rows.Scan(&flag.Name, &flag.Enabled, &flag.RolloutPercent, &flag.UserIDs, &flag.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("could not scan feature flag: %v", err)
+		}
+		flags = append(flags, flag)
+	}
+
+	return flags, nil
+}
+
+// cachedFeatureFlag is the cache entry of a flag. Missing flags are cached too, as most
+// flags keep their default and have no row.
+type cachedFeatureFlag struct {
+	Found bool        `json:"found"`
+	Flag  FeatureFlag `json:"flag"`
+}
+
+func (r *repository) GetFeatureFlag(ctx context.Context, name string) (FeatureFlag, bool, error) {
+	data, err := r.rdb.Get(ctx, FeatureFlagKeyPrefix+name).Bytes()
+	if err == nil {
+		var cached cachedFeatureFlag
+		if err := json.Unmarshal(data, &cached); err == nil {
+			return cached.Flag, cached.Found, nil
+		}
+	}
+
+	var cached cachedFeatureFlag
+	query := `SELECT name, enabled, rollout_percent, user_ids, updated_at FROM feature_flags WHERE name = $1`
+	err = r.db.QueryRow(ctx, query, name).Scan(&cached.Flag.Name, &cached.Flag.Enabled, &cached.Flag.RolloutPercent, &cached.Flag.UserIDs, &cached.Flag.UpdatedAt)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return FeatureFlag{}, false, fmt.Errorf("could not retrieve feature flag %s: %v", name, err)
+	}
+	cached.Found = err == nil
+
+	// A cache failure only costs a query per call.
+	if data, err := json.Marshal(cached); err == nil {
+		r.rdb.Set(ctx, FeatureFlagKeyPrefix+name, data, FeatureFlagCacheTime)
+	}
+	return cached.Flag, cached.Found, nil
+}
+
+func (r *repository) SetFeatureFlag(ctx context.Context, flag FeatureFlag) (FeatureFlag, error) {
+	if flag.UserIDs == nil {
+		flag.UserIDs = []int64{}
+	}
+	query := `INSERT INTO feature_flags (name, enabled, rollout_percent, user_ids, updated_at) VALUES ($1, $2, $3, $4, NOW())
+		ON CONFLICT (name) DO UPDATE SET enabled = $2, rollout_percent = $3, user_ids = $4, updated_at = NOW()
+		RETURNING updated_at`
+	err := r.db.QueryRow(ctx, query, flag.Name, flag.Enabled, flag.RolloutPercent, flag.UserIDs).Scan(&flag.UpdatedAt)
+	if err != nil {
+		return FeatureFlag{}, fmt.Errorf("could not set feature flag %s: %v", flag.Name, err)
+	}
+	if err := r.rdb.Del(ctx, FeatureFlagKeyPrefix+flag.Name).Err(); err != nil {
+		return flag, fmt.Errorf("could not invalidate cached feature flag %s: %v", flag.Name, err)
+	}
+
+	return flag, nil
+}
+
+func (r *repository) DeleteFeatureFlag(ctx context.Context, name string) (bool, error) {
+	tag, err := r.db.Exec(ctx, `DELETE FROM feature_flags WHERE name = $1`, name)
+	if err != nil {
+		return false, fmt.Errorf("could not delete feature flag %s: %v", name, err)
+	}
+	if err := r.rdb.Del(ctx, FeatureFlagKeyPrefix+name).Err(); err != nil {
+		return false, fmt.Errorf("could not invalidate cached feature flag %s: %v", name, err)
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+func (r *repository) GetNotifications(ctx context.Context, userID int64, limit int64) ([]Notification, error) {
+	notifications := []Notification{}
+	query := `SELECT id, download_id, message, created_at FROM notifications WHERE user_id = $1 ORDER BY id DESC LIMIT $2`
+	rows, err := r.db.Query(ctx, query, userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve notifications of user %d: %v", userID, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var n Notification
+		if err := rows.Scan(&n.ID, &n.DownloadID, &n.Message, &n.CreatedAt); err != nil {
+			return nil, fmt.Errorf("could not scan notification: %v", err)
+		}
+		notifications = append(notifications, n)
+	}
+
+	return notifications, nil
+}
+
+func (r *repository) GetHooks(ctx context.Context, userID int64) ([]Hook, error) {
+	hooks := []Hook{}
+	query := `SELECT id, user_id, name, token_hash, rate_limit, allowed_ips, priority FROM hooks WHERE user_id = $1 ORDER BY id`
+	rows, err := r.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve hooks of user %d: %v", userID, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hook Hook
+		if err := rows.Scan(&hook.ID, &hook.UserID, &hook.Name, &hook.TokenHash, &hook.RateLimit, &hook.AllowedIPs, &hook.Priority); err != nil {
+			return nil, fmt.Errorf("could not scan hook: %v", err)
+		}
+		hooks = append(hooks, hook)
+	}
+
+	return hooks, nil
+}
+
+func (r *repository) GetHookByTokenHash(ctx context.Context, tokenHash string) (Hook, bool, error) {
+	var hook Hook
+	query := `SELECT id, user_id, name, token_hash, rate_limit, allowed_ips, priority FROM hooks WHERE token_hash = $1`
+	err := r.db.QueryRow(ctx, query, tokenHash).Scan(&hook.ID, &hook.UserID, &hook.Name, &hook.TokenHash, &hook.RateLimit, &hook.AllowedIPs, &hook.Priority)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return hook, false, nil
+		}
+		return hook, false, fmt.Errorf("could not retrieve hook: %v", err)
+	}
+
+	return hook, true, nil
+}
+
+func (r *repository) CreateHook(ctx context.Context, hook Hook) (int64, error) {
+	var hookID int64
+	query := `INSERT INTO hooks (user_id, name, token_hash, rate_limit, allowed_ips, priority) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
+	err := r.db.QueryRow(ctx, query, hook.UserID, hook.Name, hook.TokenHash, hook.RateLimit, hook.AllowedIPs, hook.Priority).Scan(&hookID)
+	if err != nil {
+		return 0, fmt.Errorf("could not create hook for user %d: %v", hook.UserID, err)
+	}
+
+	return hookID, nil
+}
+
+// DeleteHook deletes a hook of the user and reports whether it existed.
+func (r *repository) DeleteHook(ctx context.Context, userID int64, hookID int64) (bool, error) {
+	tag, err := r.db.Exec(ctx, `DELETE FROM hooks WHERE id = $1 AND user_id = $2`, hookID, userID)
+	if err != nil {
+		return false, fmt.Errorf("could not delete hook %d: %v", hookID, err)
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+func (r *repository) GetCompletionScripts(ctx context.Context, userID int64) ([]CompletionScript, error) {
+	scripts := []CompletionScript{}
+	query := `SELECT id, user_id, name, script, timeout_seconds, created_at FROM completion_scripts WHERE user_id = $1 ORDER BY id`
+	rows, err := r.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve completion scripts of user %d: %v", userID, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var script CompletionScript
+		if err := rows.Scan(&script.ID, &script.UserID, &script.Name, &script.Script, &script.Timeout, &script.CreatedAt); err != nil {
+			return nil, fmt.Errorf("could not scan completion script: %v", err)
+		}
+		scripts = append(scripts, script)
+	}
+
+	return scripts, nil
+}
+
+func (r *repository) CreateCompletionScript(ctx context.Context, script CompletionScript) (int64, error) {
+	var scriptID int64
+	query := `INSERT INTO completion_scripts (user_id, name, script, timeout_seconds) VALUES ($1, $2, $3, $4) RETURNING id`
+	err := r.db.QueryRow(ctx, query, script.UserID, script.Name, script.Script, script.Timeout).Scan(&scriptID)
+	if err != nil {
+		return 0, fmt.Errorf("could not create completion script for user %d: %v", script.UserID, err)
+	}
+
+	return scriptID, nil
+}
+
+// DeleteCompletionScript deletes a completion script of the user and reports whether it existed.
+func (r *repository) DeleteCompletionScript(ctx context.Context, userID int64, scriptID int64) (bool, error) {
+	tag, err := r.db.Exec(ctx, `DELETE FROM completion_scripts WHERE id = $1 AND user_id = $2`, scriptID, userID)
+	if err != nil {
+		return false, fmt.Errorf("could not delete completion script %d: %v", scriptID, err)
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+func (r *repository) AddScriptRun(ctx context.Context, downloadID int64, run ScriptRun) error {
+	detail, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.Exec(ctx, `INSERT INTO queue_events (download_id, type, detail) VALUES ($1, $2, $3)`, downloadID, QueueEventScript, detail)
+	if err != nil {
+		return fmt.Errorf("could not record script run of download request %d: %v", downloadID, err)
+	}
+
+	return nil
+}
+
+func (r *repository) GetScriptRuns(ctx context.Context, downloadID int64) ([]ScriptRun, error) {
+	runs := []ScriptRun{}
+	query := `SELECT detail, created_at FROM queue_events WHERE download_id = $1 AND type = $2 ORDER BY id`
+	rows, err := r.db.Query(ctx, query, downloadID, QueueEventScript)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve script runs of download request %d: %v", downloadID, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var detail []byte
+		var createdAt time.Time
+		if err := rows.Scan(&detail, &createdAt); err != nil {
+			return nil, fmt.Errorf("could not scan script run: %v", err)
+		}
+		var run ScriptRun
+		if err := json.Unmarshal(detail, &run); err != nil {
+			return nil, fmt.Errorf("could not decode script run: %v", err)
+		}
+		run.CreatedAt = createdAt
+		runs = append(runs, run)
+	}
+
+	return runs, nil
+}
+
+func (r *repository) GetOriginProfiles(ctx context.Context, userID int64) ([]OriginProfile, error) {
+	profiles := []OriginProfile{}
+	query := `SELECT id, user_id, name, kind, secret, hosts, created_at FROM origin_profiles WHERE user_id = $1 ORDER BY id`
+	rows, err := r.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve origin profiles of user %d: %v", userID, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var profile OriginProfile
+		if err := rows.Scan(&profile.ID, &profile.UserID, &profile.Name, &profile.Kind, &profile.Secret, &profile.Hosts, &profile.CreatedAt); err != nil {
+			return nil, fmt.Errorf("could not scan origin profile: %v", err)
+		}
+		profiles = append(profiles, profile)
+	}
+
+	return profiles, nil
+}
+
+func (r *repository) GetOriginProfile(ctx context.Context, profileID int64) (OriginProfile, bool, error) {
+	var profile OriginProfile
+	query := `SELECT id, user_id, name, kind, secret, hosts, created_at FROM origin_profiles WHERE id = $1`
+	err := r.db.QueryRow(ctx, query, profileID).Scan(&profile.ID, &profile.UserID, &profile.Name, &profile.Kind, &profile.Secret, &profile.Hosts, &profile.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return profile, false, nil
+		}
+		return profile, false, fmt.Errorf("could not retrieve origin profile %d: %v", profileID, err)
+	}
+
+	return profile, true, nil
+}
+
+func (r *repository) FindOriginProfileForHost(ctx context.Context, userID int64, host string) (OriginProfile, bool, error) {
+	// The patterns matching the host, the most specific first: the host itself and a wildcard
+	// of every parent domain.
+	patterns := []string{host}
+	for rest := host; ; {
+		_, parent, ok := strings.Cut(rest, ".")
+		if !ok || !strings.Contains(parent, ".") {
+			break
+		}
+		patterns = append(patterns, "*."+parent)
+		rest = parent
+	}
+
+	query := `SELECT id, user_id, name, kind, secret, hosts, created_at FROM origin_profiles WHERE user_id = $1 AND hosts && $2 ORDER BY id`
+	rows, err := r.db.Query(ctx, query, userID, patterns)
+	if err != nil {
+		return OriginProfile{}, false, fmt.Errorf("could not find origin profile of user %d for %s: %v", userID, host, err)
+	}
+	defer rows.Close()
+
+	var best OriginProfile
+	bestRank := len(patterns)
+	for rows.Next() {
+		var profile OriginProfile
+		if err := rows.Scan(&profile.ID, &profile.UserID, &profile.Name, &profile.Kind, &profile.Secret, &profile.Hosts, &profile.CreatedAt); err != nil {
+			return OriginProfile{}, false, fmt.Errorf("could not scan origin profile: %v", err)
+		}
+		for rank, pattern := range patterns {
+			if rank < bestRank && slices.Contains(profile.Hosts, pattern) {
+				best, bestRank = profile, rank
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return OriginProfile{}, false, fmt.Errorf("could not find origin profile of user %d for %s: %v", userID, host, err)
+	}
+
+	return best, bestRank < len(patterns), nil
+}
+
+func (r *repository) CreateOriginProfile(ctx context.Context, profile OriginProfile) (int64, error) {
+	var profileID int64
+	hosts := profile.Hosts
+	if hosts == nil {
+		hosts = []string{}
+	}
+	query := `INSERT INTO origin_profiles (user_id, name, kind, secret, hosts) VALUES ($1, $2, $3, $4, $5) RETURNING id`
+	err := r.db.QueryRow(ctx, query, profile.UserID, profile.Name, profile.Kind, profile.Secret, hosts).Scan(&profileID)
+	if err != nil {
+		return 0, fmt.Errorf("could not create origin profile for user %d: %v", profile.UserID, err)
+	}
+
+	return profileID, nil
+}
+
+// DeleteOriginProfile deletes an origin profile of the user and reports whether it existed.
+// Its downloads are left without credentials.
+func (r *repository) DeleteOriginProfile(ctx context.Context, userID int64, profileID int64) (bool, error) {
+	tag, err := r.db.Exec(ctx, `DELETE FROM origin_profiles WHERE id = $1 AND user_id = $2`, profileID, userID)
+	if err != nil {
+		return false, fmt.Errorf("could not delete origin profile %d: %v", profileID, err)
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+func (r *repository) GetCollections(ctx context.Context, userID int64) ([]Collection, error) {
+	collections := []Collection{}
+	query := `SELECT c.id, c.user_id, c.name, c.created_at, (SELECT COUNT(*) FROM collection_downloads cd WHERE cd.collection_id = c.id), COALESCE(m.role, 'owner')
+		FROM collections c LEFT JOIN collection_members m ON m.collection_id = c.id AND m.user_id = $1
+		WHERE c.user_id = $1 OR m.user_id IS NOT NULL ORDER BY c.id`
+	rows, err := r.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve collections of user %d: %v", userID, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var collection Collection
+		if err := rows.Scan(&collection.ID, &collection.UserID, &collection.Name, &collection.CreatedAt, &collection.Downloads, &collection.Role); err != nil {
+			return nil, fmt.Errorf("could not scan collection: %v", err)
+		}
+		collections = append(collections, collection)
+	}
+
+	return collections, nil
+}
+
+func (r *repository) GetCollection(ctx context.Context, collectionID int64) (Collection, bool, error) {
+	var collection Collection
+	query := `SELECT c.id, c.user_id, c.name, c.created_at, (SELECT COUNT(*) FROM collection_downloads cd WHERE cd.collection_id = c.id)
+		FROM collections c WHERE c.id = $1`
+	err := r.db.QueryRow(ctx, query, collectionID).Scan(&collection.ID, &collection.UserID, &collection.Name, &collection.CreatedAt, &collection.Downloads)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return collection, false, nil
+		}
+		return collection, false, fmt.Errorf("could not retrieve collection %d: %v", collectionID, err)
+	}
+
+	return collection, true, nil
+}
+
+func (r *repository) CreateCollection(ctx context.Context, collection Collection) (int64, error) {
+	var collectionID int64
+	query := `INSERT INTO collections (user_id, name) VALUES ($1, $2) RETURNING id`
+	err := r.db.QueryRow(ctx, query, collection.UserID, collection.Name).Scan(&collectionID)
+	if isUniqueViolation(err) {
+		return 0, CollectionExistsErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("could not create collection for user %d: %v", collection.UserID, err)
+	}
+
+	return collectionID, nil
+}
+
+func (r *repository) DeleteCollection(ctx context.Context, userID int64, collectionID int64) (bool, error) {
+	tag, err := r.db.Exec(ctx, `DELETE FROM collections WHERE id = $1 AND user_id = $2`, collectionID, userID)
+	if err != nil {
+		return false, fmt.Errorf("could not delete collection %d: %v", collectionID, err)
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+func (r *repository) AddToCollection(ctx context.Context, userID int64, collectionID int64, downloadIDs []int64) ([]int64, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `SELECT id FROM UNNEST($1::int[]) AS id WHERE id NOT IN (SELECT id FROM downloads WHERE user_id = $2)`, downloadIDs, userID)
+	if err != nil {
+		return nil, fmt.Errorf("could not check downloads of user %d: %v", userID, err)
+	}
+	var missing []int64
+	for rows.Next() {
+		var downloadID int64
+		if err := rows.Scan(&downloadID); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("could not scan download id: %v", err)
+		}
+		missing = append(missing, downloadID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not check downloads of user %d: %v", userID, err)
+	}
+	if len(missing) > 0 {
+		return missing, nil
+	}
+
+	query := `INSERT INTO collection_downloads (collection_id, download_id) SELECT $1, UNNEST($2::int[]) ON CONFLICT DO NOTHING`
+	if _, err := tx.Exec(ctx, query, collectionID, downloadIDs); err != nil {
+		return nil, fmt.Errorf("could not add downloads to collection %d: %v", collectionID, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("could not commit transaction: %v", err)
+	}
+
+	return nil, nil
+}
+
+// RemoveFromCollection removes a download from the collection and reports whether it was in it.
+func (r *repository) RemoveFromCollection(ctx context.Context, collectionID int64, downloadID int64) (bool, error) {
+	tag, err := r.db.Exec(ctx, `DELETE FROM collection_downloads WHERE collection_id = $1 AND download_id = $2`, collectionID, downloadID)
+	if err != nil {
+		return false, fmt.Errorf("could not remove download request %d from collection %d: %v", downloadID, collectionID, err)
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+func (r *repository) GetCollectionStatuses(ctx context.Context, collectionID int64) (map[int64]string, error) {
+	query := `SELECT d.id, d.status FROM downloads d JOIN collection_downloads cd ON cd.download_id = d.id WHERE cd.collection_id = $1`
+	rows, err := r.db.Query(ctx, query, collectionID)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve downloads of collection %d: %v", collectionID, err)
+	}
+	defer rows.Close()
+
+	statuses := make(map[int64]string)
+	for rows.Next() {
+		var downloadID int64
+		var status string
+		if err := rows.Scan(&downloadID, &status); err != nil {
+			return nil, fmt.Errorf("could not scan download of collection: %v", err)
+		}
+		statuses[downloadID] = status
+	}
+
+	return statuses, rows.Err()
+}
+
+func (r *repository) GetCollectionMembers(ctx context.Context, collectionID int64) ([]CollectionMember, error) {
+	members := []CollectionMember{}
+	query := `SELECT m.collection_id, m.user_id, u.username, m.role, m.created_at
+		FROM collection_members m JOIN users u ON u.id = m.user_id WHERE m.collection_id = $1 ORDER BY m.created_at`
+	rows, err := r.db.Query(ctx, query, collectionID)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve members of collection %d: %v", collectionID, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var member CollectionMember
+		if err := rows.Scan(&member.CollectionID, &member.UserID, &member.Username, &member.Role, &member.CreatedAt); err != nil {
+			return nil, fmt.Errorf("could not scan collection member: %v", err)
+		}
+		members = append(members, member)
+	}
+
+	return members, rows.Err()
+}
+
+func (r *repository) GetCollectionMember(ctx context.Context, collectionID int64, userID int64) (CollectionMember, bool, error) {
+	var member CollectionMember
+	query := `SELECT m.collection_id, m.user_id, u.username, m.role, m.created_at
+		FROM collection_members m JOIN users u ON u.id = m.user_id WHERE m.collection_id = $1 AND m.user_id = $2`
+	err := r.db.QueryRow(ctx, query, collectionID, userID).Scan(&member.CollectionID, &member.UserID, &member.Username, &member.Role, &member.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return member, false, nil
+	}
+	if err != nil {
+		return member, false, fmt.Errorf("could not retrieve member %d of collection %d: %v", userID, collectionID, err)
+	}
+
+	return member, true, nil
+}
+
+func (r *repository) SetCollectionMember(ctx context.Context, member CollectionMember) error {
+	query := `INSERT INTO collection_members (collection_id, user_id, role) VALUES ($1, $2, $3)
+		ON CONFLICT (collection_id, user_id) DO UPDATE SET role = EXCLUDED.role`
+	_, err := r.db.Exec(ctx, query, member.CollectionID, member.UserID, member.Role)
+	if err != nil {
+		return fmt.Errorf("could not share collection %d with user %d: %v", member.CollectionID, member.UserID, err)
+	}
+
+	return nil
+}
+
+func (r *repository) RemoveCollectionMember(ctx context.Context, collectionID int64, userID int64) (bool, error) {
+	tag, err := r.db.Exec(ctx, `DELETE FROM collection_members WHERE collection_id = $1 AND user_id = $2`, collectionID, userID)
+	if err != nil {
+		return false, fmt.Errorf("could not remove member %d of collection %d: %v", userID, collectionID, err)
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+func (r *repository) IsDownloadShared(ctx context.Context, userID int64, downloadID int64) (bool, error) {
+	query := `SELECT EXISTS (
+			SELECT 1 FROM collection_downloads cd JOIN collections c ON c.id = cd.collection_id
+			LEFT JOIN collection_members m ON m.collection_id = c.id AND m.user_id = $1
+			WHERE cd.download_id = $2 AND (c.user_id = $1 OR m.user_id IS NOT NULL)
+		) OR EXISTS (
+			SELECT 1 FROM downloads d JOIN organization_members m ON m.org_id = d.org_id AND m.user_id = $1
+			WHERE d.id = $2
+		)`
+	var shared bool
+	if err := r.db.QueryRow(ctx, query, userID, downloadID).Scan(&shared); err != nil {
+		return false, fmt.Errorf("could not check collections and organization of download request %d: %v", downloadID, err)
+	}
+
+	return shared, nil
+}
+
+func (r *repository) GetOrganizations(ctx context.Context, userID int64) ([]Organization, error) {
+	organizations := []Organization{}
+	query := `SELECT o.id, o.name, o.quota_bytes, o.rate_limit, (SELECT COUNT(*) FROM organization_members om WHERE om.org_id = o.id), m.role, o.created_at
+		FROM organizations o JOIN organization_members m ON m.org_id = o.id AND m.user_id = $1 ORDER BY o.name`
+	rows, err := r.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve organizations of user %d: %v", userID, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var organization Organization
+		if err := rows.Scan(&organization.ID, &organization.Name, &organization.QuotaBytes, &organization.RateLimit, &organization.Members, &organization.Role, &organization.CreatedAt); err != nil {
+			return nil, fmt.Errorf("could not scan organization: %v", err)
+		}
+		organizations = append(organizations, organization)
+	}
+
+	return organizations, rows.Err()
+}
+
+func (r *repository) GetOrganization(ctx context.Context, orgID int64) (Organization, bool, error) {
+	var organization Organization
+	query := `SELECT o.id, o.name, o.quota_bytes, o.rate_limit, (SELECT COUNT(*) FROM organization_members om WHERE om.org_id = o.id), o.created_at
+		FROM organizations o WHERE o.id = $1`
+	err := r.db.QueryRow(ctx, query, orgID).Scan(&organization.ID, &organization.Name, &organization.QuotaBytes, &organization.RateLimit, &organization.Members, &organization.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return organization, false, nil
+	}
+	if err != nil {
+		return organization, false, fmt.Errorf("could not retrieve organization %d: %v", orgID, err)
+	}
+
+	return organization, true, nil
+}
+
+func (r *repository) CreateOrganization(ctx context.Context, name string, userID int64) (int64, error) {
+	var orgID int64
+	query := `WITH created AS (
+			INSERT INTO organizations (name) VALUES ($1) RETURNING id
+		), owner AS (
+			INSERT INTO organization_members (org_id, user_id, role) SELECT id, $2, 'owner' FROM created
+		)
+		SELECT id FROM created`
+	err := r.db.QueryRow(ctx, query, name, userID).Scan(&orgID)
+	if isUniqueViolation(err) {
+		return 0, OrganizationExistsErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("could not create organization for user %d: %v", userID, err)
+	}
+
+	return orgID, nil
+}
+
+func (r *repository) DeleteOrganization(ctx context.Context, orgID int64) (bool, error) {
+	tag, err := r.db.Exec(ctx, `DELETE FROM organizations WHERE id = $1`, orgID)
+	if err != nil {
+		return false, fmt.Errorf("could not delete organization %d: %v", orgID, err)
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+func (r *repository) SetOrganizationLimits(ctx context.Context, orgID int64, quotaBytes *int64, rateLimit *int64) (bool, error) {
+	tag, err := r.db.Exec(ctx, `UPDATE organizations SET quota_bytes = $2, rate_limit = $3 WHERE id = $1`, orgID, quotaBytes, rateLimit)
+	if err != nil {
+		return false, fmt.Errorf("could not set limits of organization %d: %v", orgID, err)
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+func (r *repository) GetOrganizationUsage(ctx context.Context, orgID int64) (int64, error) {
+	var storedBytes int64
+	query := `SELECT COALESCE(SUM(bytes), 0) FROM downloads WHERE org_id = $1 AND status = 'completed'`
+	if err := r.db.QueryRow(ctx, query, orgID).Scan(&storedBytes); err != nil {
+		return 0, fmt.Errorf("could not retrieve usage of organization %d: %v", orgID, err)
+	}
+
+	return storedBytes, nil
+}
+
+func (r *repository) GetOrganizationMembers(ctx context.Context, orgID int64) ([]OrganizationMember, error) {
+	members := []OrganizationMember{}
+	query := `SELECT m.org_id, m.user_id, u.username, m.role, m.created_at
+		FROM organization_members m JOIN users u ON u.id = m.user_id WHERE m.org_id = $1 ORDER BY m.created_at`
+	rows, err := r.db.Query(ctx, query, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve members of organization %d: %v", orgID, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var member OrganizationMember
+		if err := rows.Scan(&member.OrgID, &member.UserID, &member.Username, &member.Role, &member.CreatedAt); err != nil {
+			return nil, fmt.Errorf("could not scan organization member: %v", err)
+		}
+		members = append(members, member)
+	}
+
+	return members, rows.Err()
+}
+
+func (r *repository) GetOrganizationMember(ctx context.Context, orgID int64, userID int64) (OrganizationMember, bool, error) {
+	var member OrganizationMember
+	query := `SELECT m.org_id, m.user_id, u.username, m.role, m.created_at
+		FROM organization_members m JOIN users u ON u.id = m.user_id WHERE m.org_id = $1 AND m.user_id = $2`
+	err := r.db.QueryRow(ctx, query, orgID, userID).Scan(&member.OrgID, &member.UserID, &member.Username, &member.Role, &member.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return member, false, nil
+	}
+	if err != nil {
+		return member, false, fmt.Errorf("could not retrieve member %d of organization %d: %v", userID, orgID, err)
+	}
+
+	return member, true, nil
+}
+
+func (r *repository) SetOrganizationMember(ctx context.Context, member OrganizationMember) error {
+	query := `INSERT INTO organization_members (org_id, user_id, role) VALUES ($1, $2, $3)
+		ON CONFLICT (org_id, user_id) DO UPDATE SET role = EXCLUDED.role`
+	_, err := r.db.Exec(ctx, query, member.OrgID, member.UserID, member.Role)
+	if err != nil {
+		return fmt.Errorf("could not add user %d to organization %d: %v", member.UserID, member.OrgID, err)
+	}
+
+	return nil
+}
+
+func (r *repository) RemoveOrganizationMember(ctx context.Context, orgID int64, userID int64) (bool, error) {
+	tag, err := r.db.Exec(ctx, `DELETE FROM organization_members WHERE org_id = $1 AND user_id = $2`, orgID, userID)
+	if err != nil {
+		return false, fmt.Errorf("could not remove member %d of organization %d: %v", userID, orgID, err)
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+func (r *repository) GetPipelineSteps(ctx context.Context, downloadID int64) ([]PipelineStep, error) {
+	steps := []PipelineStep{}
+	query := `SELECT position, name, status, detail, error, started_at, finished_at FROM pipeline_steps WHERE download_id = $1 ORDER BY position`
+	rows, err := r.db.Query(ctx, query, downloadID)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve pipeline of download request %d: %v", downloadID, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var step PipelineStep
+		if err := rows.Scan(&step.Position, &step.Name, &step.Status, &step.Detail, &step.Error, &step.StartedAt, &step.FinishedAt); err != nil {
+			return nil, fmt.Errorf("could not scan pipeline step: %v", err)
+		}
+		steps = append(steps, step)
+	}
+
+	return steps, nil
+}
+
+func (r *repository) StartPipelineStep(ctx context.Context, downloadID int64, position int64) error {
+	query := `UPDATE pipeline_steps SET status = 'running', started_at = NOW() WHERE download_id = $1 AND position = $2`
+	_, err := r.db.Exec(ctx, query, downloadID, position)
+	if err != nil {
+		return fmt.Errorf("could not start pipeline step %d of download request %d: %v", position, downloadID, err)
+	}
+
+	return nil
+}
+
+func (r *repository) FinishPipelineStep(ctx context.Context, downloadID int64, position int64, status string, detail string, errMessage string) error {
+	query := `UPDATE pipeline_steps SET status = $3, detail = $4, error = $5, finished_at = NOW() WHERE download_id = $1 AND position = $2`
+	_, err := r.db.Exec(ctx, query, downloadID, position, status, detail, errMessage)
+	if err != nil {
+		return fmt.Errorf("could not finish pipeline step %d of download request %d: %v", position, downloadID, err)
+	}
+
+	return nil
+}
+
+func (r *repository) SkipPipelineSteps(ctx context.Context, downloadID int64, reason string) error {
+	query := `UPDATE pipeline_steps SET status = 'skipped', detail = $2, finished_at = NOW() WHERE download_id = $1 AND status IN ('pending', 'running')`
+	_, err := r.db.Exec(ctx, query, downloadID, reason)
+	if err != nil {
+		return fmt.Errorf("could not skip pipeline steps of download request %d: %v", downloadID, err)
+	}
+
+	return nil
+}
+
+func (r *repository) GetPendingPipelines(ctx context.Context, host string) ([]downloadRequest, error) {
+	query := `SELECT id, user_id, link, file_name, completed, error, priority, content_hash, status, expires_at, credentials, headers, labels, byte_range, origin_profile_id, max_speed, manifest_url, verification, verification_detail, folder_id, mirrors, host, tier, cold_key, tuning, proxy, error_code, bytes, deleted_at, org_id, metadata FROM downloads
+		WHERE status = 'completed' AND tier = 'hot' AND host = $1
+			AND EXISTS (SELECT 1 FROM pipeline_steps WHERE download_id = downloads.id AND status IN ('pending', 'running'))
+		ORDER BY finished_at`
+	return r.queryDownloadRequests(ctx, "pending pipelines", query, host)
+}
+
+func (r *repository) GetFolders(ctx context.Context, userID int64) ([]Folder, error) {
+	folders := []Folder{}
+	query := `SELECT id, user_id, parent_id, name, created_at FROM folders WHERE user_id = $1 ORDER BY id`
+	rows, err := r.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve folders of user %d: %v", userID, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var folder Folder
+		if err := rows.Scan(&folder.ID, &folder.UserID, &folder.ParentID, &folder.Name, &folder.CreatedAt); err != nil {
+			return nil, fmt.Errorf("could not scan folder: %v", err)
+		}
+		folders = append(folders, folder)
+	}
+
+	return folders, nil
+}
+
+func (r *repository) GetFolder(ctx context.Context, folderID int64) (Folder, bool, error) {
+	var folder Folder
+	query := `SELECT id, user_id, parent_id, name, created_at FROM folders WHERE id = $1`
+	err := r.db.QueryRow(ctx, query, folderID).Scan(&folder.ID, &folder.UserID, &folder.ParentID, &folder.Name, &folder.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return folder, false, nil
+		}
+		return folder, false, fmt.Errorf("could not retrieve folder %d: %v", folderID, err)
+	}
+
+	return folder, true, nil
+}
+
+func (r *repository) CreateFolder(ctx context.Context, folder Folder) (int64, error) {
+	var folderID int64
+	query := `INSERT INTO folders (user_id, parent_id, name) VALUES ($1, $2, $3) RETURNING id`
+	err := r.db.QueryRow(ctx, query, folder.UserID, folder.ParentID, folder.Name).Scan(&folderID)
+	if isUniqueViolation(err) {
+		return 0, FolderExistsErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("could not create folder for user %d: %v", folder.UserID, err)
+	}
+
+	return folderID, nil
+}
+
+func (r *repository) UpdateFolder(ctx context.Context, folder Folder) error {
+	query := `WITH RECURSIVE subtree AS (
+			SELECT id FROM folders WHERE id = $1
+			UNION ALL
+			SELECT folders.id FROM folders JOIN subtree ON folders.parent_id = subtree.id
+		)
+		UPDATE folders SET parent_id = $2, name = $3 WHERE id = $1 AND ($2::int IS NULL OR $2 NOT IN (SELECT id FROM subtree))`
+	tag, err := r.db.Exec(ctx, query, folder.ID, folder.ParentID, folder.Name)
+	if isUniqueViolation(err) {
+		return FolderExistsErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not update folder %d: %v", folder.ID, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return FolderCycleErr
+	}
+
+	return nil
+}
+
+func (r *repository) DeleteFolder(ctx context.Context, userID int64, folderID int64) (bool, error) {
+	tag, err := r.db.Exec(ctx, `DELETE FROM folders WHERE id = $1 AND user_id = $2`, folderID, userID)
+	if err != nil {
+		return false, fmt.Errorf("could not delete folder %d: %v", folderID, err)
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+func (r *repository) GetRetentionCandidates(ctx context.Context, host string, ttl time.Duration, planTTLs map[string]time.Duration, trashRetention time.Duration, limit int64) ([]downloadRequest, error) {
+	plans := make(map[string]int64, len(planTTLs))
+	for plan, planTTL := range planTTLs {
+		plans[plan] = int64(planTTL / time.Second)
+	}
+	query := `SELECT d.id, d.user_id, d.link, d.file_name, d.completed, d.error, d.priority, d.content_hash, d.status, d.expires_at, d.credentials, d.headers, d.labels, d.byte_range, d.origin_profile_id, d.max_speed, d.manifest_url, d.verification, d.verification_detail, d.folder_id, d.mirrors, d.host, d.tier, d.cold_key, d.tuning, d.proxy, d.error_code, d.bytes, d.deleted_at, d.org_id, d.metadata
+		FROM downloads d JOIN users u ON u.id = d.user_id
+		WHERE d.status IN ('completed', 'failed', 'expired') AND (d.tier <> 'hot' OR d.host IS NULL OR d.host IN ('', $1))
+			AND (d.purge_requested_at IS NOT NULL OR d.deleted_at < NOW() - make_interval(secs => $4) OR (
+				COALESCE(u.retention_seconds, ($3::jsonb ->> u.plan)::BIGINT, $2) > 0
+				AND d.finished_at < NOW() - make_interval(secs => COALESCE(u.retention_seconds, ($3::jsonb ->> u.plan)::BIGINT, $2))
+			))
+			AND NOT EXISTS (SELECT 1 FROM pipeline_steps WHERE download_id = d.id AND status IN ('pending', 'running'))
+		ORDER BY d.finished_at LIMIT $5`
+	return r.queryDownloadRequests(ctx, "retention candidates", query, host, int64(ttl/time.Second), plans, int64(trashRetention/time.Second), limit)
+}
+
+func (r *repository) TrashDownloadRequest(ctx context.Context, downloadID int64) (bool, error) {
+	tag, err := r.db.Exec(ctx, `UPDATE downloads SET deleted_at = NOW()
+		WHERE id = $1 AND status IN ('completed', 'failed', 'expired') AND deleted_at IS NULL`, downloadID)
+	if err != nil {
+		return false, fmt.Errorf("could not move download request %d to the trash: %v", downloadID, err)
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+func (r *repository) RestoreFromTrash(ctx context.Context, downloadID int64) (bool, error) {
+	tag, err := r.db.Exec(ctx, `UPDATE downloads SET deleted_at = NULL WHERE id = $1 AND deleted_at IS NOT NULL`, downloadID)
+	if err != nil {
+		return false, fmt.Errorf("could not restore download request %d from the trash: %v", downloadID, err)
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+func (r *repository) RequestPurge(ctx context.Context, downloadID int64) error {
+	_, err := r.db.Exec(ctx, `UPDATE downloads SET purge_requested_at = NOW() WHERE id = $1`, downloadID)
+	if err != nil {
+		return fmt.Errorf("could not request purge of download request %d: %v", downloadID, err)
+	}
+
+	return nil
+}
+
+func (r *repository) DeleteDownloadRequest(ctx context.Context, downloadID int64) (bool, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("could not delete download request %d: %v", downloadID, err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Attempts and the outbox have no cascading foreign key.
+	if _, err := tx.Exec(ctx, `DELETE FROM attempts WHERE download_id = $1`, downloadID); err != nil {
+		return false, fmt.Errorf("could not delete attempts of download request %d: %v", downloadID, err)
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM outbox WHERE download_id = $1`, downloadID); err != nil {
+		return false, fmt.Errorf("could not delete outbox entry of download request %d: %v", downloadID, err)
+	}
+	tag, err := tx.Exec(ctx, `DELETE FROM downloads WHERE id = $1 AND status IN ('completed', 'failed', 'expired')`, downloadID)
+	if err != nil {
+		return false, fmt.Errorf("could not delete download request %d: %v", downloadID, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return false, fmt.Errorf("could not delete download request %d: %v", downloadID, err)
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+func (r *repository) SetDownloadFolder(ctx context.Context, downloadID int64, folderID *int64) error {
+	_, err := r.db.Exec(ctx, `UPDATE downloads SET folder_id = $1 WHERE id = $2`, folderID, downloadID)
+	if err != nil {
+		return fmt.Errorf("could not set folder of download request %d: %v", downloadID, err)
+	}
+
+	return nil
+}
+
+func (r *repository) GetLocks(ctx context.Context) ([]Lock, error) {
+	var locks []Lock
+	// Locks are keyed by the bare id of the download request.
+	iter := r.rdb.Scan(ctx, 0, "[0-9]*", 1000).Iterator()
+	for iter.Next(ctx) {
+		downloadID, err := strconv.ParseInt(iter.Val(), 10, 64)
+		if err != nil {
+			continue
+		}
+		token, err := r.rdb.Get(ctx, iter.Val()).Result()
+		if err == redis.Nil {
+			continue // released meanwhile
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not get lock of download request %d: %v", downloadID, err)
+		}
+		ttl, err := r.rdb.PTTL(ctx, iter.Val()).Result()
+		if err != nil {
+			return nil, fmt.Errorf("could not get lock of download request %d: %v", downloadID, err)
+		}
+		if ttl < 0 && ttl != -1 {
+			continue // expired meanwhile
+		}
+		locks = append(locks, Lock{DownloadID: downloadID, Token: token, TTL: ttl})
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("could not list locks: %v", err)
+	}
+
+	return locks, nil
+}
+
+func (r *repository) GetRequeueCandidates(ctx context.Context, filter RequeueFilter) ([]downloadRequest, error) {
+	query := `SELECT id, user_id, link, file_name, completed, error, priority, content_hash, status, expires_at, credentials, headers, labels, byte_range, origin_profile_id, max_speed, manifest_url, verification, verification_detail, folder_id, mirrors, host, tier, cold_key, tuning, proxy, error_code, bytes, deleted_at, org_id, metadata FROM downloads
+		WHERE status = $1 AND ($2 = 0 OR user_id = $2) AND ($3 = '' OR host = $3)
+			AND (error_code = $4 OR $4 = '' AND error_code <> $5)
+			AND ($6::TIMESTAMPTZ IS NULL OR created_at >= $6) AND ($7::TIMESTAMPTZ IS NULL OR created_at < $7)
+		ORDER BY created_at LIMIT $8`
+	var since, until *time.Time
+	if !filter.Since.IsZero() {
+		since = &filter.Since
+	}
+	if !filter.Until.IsZero() {
+		until = &filter.Until
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = math.MaxInt64
+	}
+	return r.queryDownloadRequests(ctx, "requeue candidates", query, filter.Status, filter.UserID, filter.Host, filter.ErrorCode, ErrorCodeMalware, since, until, limit)
+}
+
+func (r *repository) RetryDownloadRequest(ctx context.Context, downloadID int64, restart bool) (int64, error) {
+	// The file is resumed where it stopped, on the disk of its host while it is alive.
+	query := `WITH retried AS (
+			UPDATE downloads SET status = 'queued', completed = false, error = '', error_code = '', finished_at = NULL,
+				expires_at = NULL, expected_bytes = NULL, eof_resumes = 0, manual_retries = manual_retries + 1, restart = $2
+			WHERE id = $1 AND status = 'failed'
+			RETURNING id, host, manual_retries
+		), events AS (
+			INSERT INTO queue_events (download_id, type) SELECT id, 'enqueued' FROM retried
+		)
+		SELECT COALESCE(host, ''), manual_retries FROM retried`
+	var host string
+	var retries int64
+	err := r.db.QueryRow(ctx, query, downloadID, restart).Scan(&host, &retries)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("could not retry download request %d: %v", downloadID, err)
+	}
+
+	return retries, r.PushDownloadRequestToHost(ctx, downloadID, host)
+}
+
+func (r *repository) TakeRestart(ctx context.Context, downloadID int64) (bool, error) {
+	tag, err := r.db.Exec(ctx, `UPDATE downloads SET restart = false WHERE id = $1 AND restart`, downloadID)
+	if err != nil {
+		return false, fmt.Errorf("could not take restart of download request %d: %v", downloadID, err)
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+func (r *repository) GetHostedDownloads(ctx context.Context, host string) ([]downloadRequest, error) {
+	query := `SELECT id, user_id, link, file_name, completed, error, priority, content_hash, status, expires_at, credentials, headers, labels, byte_range, origin_profile_id, max_speed, manifest_url, verification, verification_detail, folder_id, mirrors, host, tier, cold_key, tuning, proxy, error_code, bytes, deleted_at, org_id, metadata FROM downloads
+		WHERE host = $1 AND tier = 'hot' AND file_purged_at IS NULL`
+	return r.queryDownloadRequests(ctx, "hosted download requests", query, host)
+}
+
+func (r *repository) GetAppliedMigrations(ctx context.Context) (map[int64]bool, error) {
+	applied := make(map[int64]bool)
+	rows, err := r.db.Query(ctx, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve applied migrations: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int64
+		if err := rows.Scan(&version); err != nil {
+			return nil, fmt.Errorf("could not scan migration: %v", err)
+		}
+		applied[version] = true
+	}
+	var pgErr *pgconn.PgError
+	if err := rows.Err(); errors.As(err, &pgErr) && pgErr.Code == "42P01" { // undefined_table
+		return applied, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not retrieve applied migrations: %v", err)
+	}
+
+	return applied, nil
+}
+
+func (r *repository) ApplyMigration(ctx context.Context, version int64, statements string) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("could not apply migration %d: %v", version, err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Without arguments the statements are sent at once over the simple protocol.
+	if _, err := tx.Exec(ctx, statements); err != nil {
+		return fmt.Errorf("could not apply migration %d: %v", version, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("could not apply migration %d: %v", version, err)
+	}
+
+	return nil
+}
+
+func (r *repository) AddAuditEntry(ctx context.Context, entry AuditEntry) error {
+	_, err := r.db.Exec(ctx, `INSERT INTO audit_log (user_id, username, action, resource, ip, status, result) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		entry.UserID, entry.Username, entry.Action, entry.Resource, entry.IP, entry.Status, entry.Result)
+	if err != nil {
+		return fmt.Errorf("could not add audit entry: %v", err)
+	}
+	return nil
+}
+
+func (r *repository) GetAuditEntries(ctx context.Context, filter AuditFilter, page int64, limit int64) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	pattern := containsPattern(filter.Action)
+	var since, until *time.Time
+	if !filter.Since.IsZero() {
+		since = &filter.Since
+	}
+	if !filter.Until.IsZero() {
+		until = &filter.Until
+	}
+	rows, err := r.db.Query(ctx, `SELECT id, user_id, username, action, resource, ip, status, result, created_at FROM audit_log
+		WHERE ($1::int IS NULL OR user_id = $1) AND action LIKE $2 AND ($3 = '' OR result = $3)
+		AND ($4::timestamptz IS NULL OR created_at >= $4) AND ($5::timestamptz IS NULL OR created_at < $5)
+		ORDER BY id DESC OFFSET $6 LIMIT $7`, filter.UserID, pattern, filter.Result, since, until, page*limit, limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve audit entries: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry AuditEntry
+		if err := rows.Scan(&entry.ID, &entry.UserID, &entry.Username, &entry.Action, &entry.Resource, &entry.IP, &entry.Status, &entry.Result, &entry.CreatedAt); err != nil {
+			return nil, fmt.Errorf("could not scan audit entry: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// isUniqueViolation reports whether err is a violation of a unique constraint.
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+// New returns the repository over Postgres and Redis, whose download requests go through
+// the queue.
+func New(db *pgxpool.Pool, rdb *redis.Client, queue Queue) Repository {
 	return &repository{
-		db:  db,
-		rdb: rdb,
+		db:    db,
+		rdb:   rdb,
+		queue: queue,
 	}
 }
@@ -0,0 +1,1337 @@
+package repositorytest
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/internal/repository"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/context"
+)
+
+// Fake is a repository.Repository keeping in memory what the handlers and the consumer share:
+// the users and their sessions, the downloads with their folders, pipelines and progress, the
+// queue, the locks and the rate limits. It answers like the real repository, e.g.
+// CancelDownloadRequest reports false for a finished download, except that the downloads are
+// pushed to the queue when they are created instead of through the outbox, to a single queue
+// whatever their user and host. The other methods are those of the embedded Mock, and setting
+// the Func field of a method the Fake implements overrides it too. Use NewFake.
+type Fake struct {
+	Mock
+
+	// Now is the clock of the times recorded and of the expirations, time.Now by default.
+	Now func() time.Time
+
+	mu         sync.Mutex
+	nextID     int64 // of every kind of record, so that the ids are unique across them
+	users      map[int64]*fakeUser
+	sessions   map[int64]map[string]repository.Session
+	downloads  map[int64]*fakeDownload
+	folders    map[int64]repository.Folder
+	queue      []int64                       // downloads pushed and not popped yet, in order
+	popped     map[string]int64              // downloads popped and not acknowledged, by entry
+	locks      map[int64]fakeLock            // by download
+	progresses map[int64]repository.Progress // by download
+	rateLimits map[string][]time.Time        // hits in the window, by key
+	_          struct{}
+}
+
+type fakeUser struct {
+	user         repository.User
+	password     string // hashed with bcrypt
+	tokenVersion int64
+}
+
+type fakeDownload struct {
+	req           repository.DownloadRequest
+	createdAt     time.Time
+	startedAt     *time.Time
+	finishedAt    *time.Time
+	restart       bool
+	manualRetries int64
+	steps         []repository.PipelineStep
+}
+
+type fakeLock struct {
+	token     string
+	expiresAt time.Time // zero if it never expires
+}
+
+// NewFake returns an empty Fake.
+func NewFake() *Fake {
+	return &Fake{
+		Now:        time.Now,
+		users:      map[int64]*fakeUser{},
+		sessions:   map[int64]map[string]repository.Session{},
+		downloads:  map[int64]*fakeDownload{},
+		folders:    map[int64]repository.Folder{},
+		popped:     map[string]int64{},
+		locks:      map[int64]fakeLock{},
+		progresses: map[int64]repository.Progress{},
+		rateLimits: map[string][]time.Time{},
+	}
+}
+
+var _ repository.Repository = (*Fake)(nil)
+
+// AddUser adds a user with the password, hashed as the handlers hash it, and returns its id.
+// The ID of the user is ignored, and its plan is "default" if it is empty.
+func (f *Fake) AddUser(user repository.User, password string) (int64, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		return 0, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	user.ID = f.nextID
+	if user.Plan == "" {
+		user.Plan = "default"
+	}
+	f.users[user.ID] = &fakeUser{user: user, password: string(hashed)}
+	return user.ID, nil
+}
+
+// AddDownload adds the download as it is, in any status, and returns its id. The ID of the
+// download is ignored.
+func (f *Fake) AddDownload(download repository.DownloadRequest) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	download.ID = f.nextID
+	if download.Status == "" {
+		download.Status = repository.StatusQueued
+	}
+	if download.Tier == "" {
+		download.Tier = repository.TierHot
+	}
+	f.downloads[download.ID] = &fakeDownload{req: download, createdAt: f.Now()}
+	return download.ID
+}
+
+// Queued returns the ids of the downloads in the queue, next first.
+func (f *Fake) Queued() []int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.queue)
+}
+
+// download returns a copy of the download, which the caller can change without changing the
+// Fake.
+func (d *fakeDownload) download() repository.DownloadRequest {
+	req := d.req
+	req.Labels = maps.Clone(req.Labels)
+	req.Mirrors = slices.Clone(req.Mirrors)
+	return req
+}
+
+func (f *Fake) finish(d *fakeDownload) {
+	now := f.Now()
+	d.finishedAt = &now
+}
+
+func (f *Fake) GetDownloadRequest(ctx context.Context, downloadID int64) (repository.DownloadRequest, error) {
+	if f.GetDownloadRequestFunc != nil {
+		return f.Mock.GetDownloadRequest(ctx, downloadID)
+	}
+	f.record("GetDownloadRequest", []any{ctx, downloadID})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, ok := f.downloads[downloadID]
+	if !ok {
+		return repository.DownloadRequest{}, fmt.Errorf("could not retrieve download request %d: %w", downloadID, repository.DownloadRequestNotFoundErr)
+	}
+	return d.download(), nil
+}
+
+func (f *Fake) GetDownloadRequestForUser(ctx context.Context, userID int64, downloadID int64) (repository.DownloadRequest, error) {
+	if f.GetDownloadRequestForUserFunc != nil {
+		return f.Mock.GetDownloadRequestForUser(ctx, userID, downloadID)
+	}
+	f.record("GetDownloadRequestForUser", []any{ctx, userID, downloadID})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, ok := f.downloads[downloadID]
+	if !ok || d.req.UserID != userID {
+		return repository.DownloadRequest{}, fmt.Errorf("could not retrieve download request %d: %w", downloadID, repository.DownloadRequestNotFoundErr)
+	}
+	return d.download(), nil
+}
+
+// GetDownloadRequests filters and sorts the downloads as the real query does, except that the
+// downloads of a collection are not tracked: a CollectionID matches none.
+func (f *Fake) GetDownloadRequests(ctx context.Context, userID int64, page int64, limit int64, filter repository.DownloadFilter) ([]repository.DownloadRequest, *repository.DownloadCursor, error) {
+	if f.GetDownloadRequestsFunc != nil {
+		return f.Mock.GetDownloadRequests(ctx, userID, page, limit, filter)
+	}
+	f.record("GetDownloadRequests", []any{ctx, userID, page, limit, filter})
+
+	sortBy := filter.Sort
+	if sortBy == "" {
+		sortBy = "id"
+	}
+	if !slices.Contains(repository.DownloadSorts, sortBy) {
+		return nil, nil, fmt.Errorf("could not retrieve download requests: unknown sort %q", sortBy)
+	}
+	if cursor := filter.After; cursor != nil && (cursor.Sort != sortBy || cursor.Descending != filter.Descending) {
+		return nil, nil, fmt.Errorf("could not retrieve download requests: the cursor is of another sort order")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// Unset values last in both orders, then by id in the order.
+	compare := func(aValue any, aID int64, bValue any, bID int64) int {
+		c := 0
+		switch {
+		case aValue == nil && bValue != nil:
+			return 1
+		case aValue != nil && bValue == nil:
+			return -1
+		case aValue != nil:
+			c = compareValues(aValue, bValue)
+		}
+		if c == 0 {
+			c = cmp.Compare(aID, bID)
+		}
+		if filter.Descending {
+			c = -c
+		}
+		return c
+	}
+
+	var matches []*fakeDownload
+	for _, d := range f.downloads {
+		if f.matches(d, userID, filter) && (filter.After == nil || compare(sortValue(d, sortBy), d.req.ID, filter.After.Value, filter.After.ID) > 0) {
+			matches = append(matches, d)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return compare(sortValue(matches[i], sortBy), matches[i].req.ID, sortValue(matches[j], sortBy), matches[j].req.ID) < 0
+	})
+
+	offset := min(page*limit, int64(len(matches)))
+	matches = matches[offset:min(offset+limit, int64(len(matches)))]
+	var downloads []repository.DownloadRequest
+	var next *repository.DownloadCursor
+	for _, d := range matches {
+		downloads = append(downloads, d.download())
+		next = &repository.DownloadCursor{Sort: sortBy, Descending: filter.Descending, Value: sortValue(d, sortBy), ID: d.req.ID}
+	}
+	if int64(len(downloads)) < limit {
+		next = nil
+	}
+	return downloads, next, nil
+}
+
+func (f *Fake) matches(d *fakeDownload, userID int64, filter repository.DownloadFilter) bool {
+	req := d.req
+	switch {
+	case filter.CollectionID != nil:
+		return false
+	case filter.OrgID != nil:
+		if req.OrgID == nil || *req.OrgID != *filter.OrgID {
+			return false
+		}
+	case req.UserID != userID:
+		return false
+	}
+	for key, value := range filter.Labels {
+		if v, ok := req.Labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	switch {
+	case filter.FolderID == nil:
+	case *filter.FolderID == 0:
+		if req.FolderID != nil {
+			return false
+		}
+	default:
+		if !f.inFolder(req.FolderID, *filter.FolderID, filter.Recursive) {
+			return false
+		}
+	}
+	if filter.Trashed != (req.DeletedAt != nil) {
+		return false
+	}
+	if len(filter.Statuses) > 0 && !slices.Contains(filter.Statuses, req.Status) {
+		return false
+	}
+	if !filter.Since.IsZero() && d.createdAt.Before(filter.Since) || !filter.Until.IsZero() && !d.createdAt.Before(filter.Until) {
+		return false
+	}
+	if filter.Query != "" && !strings.Contains(strings.ToLower(req.Link), strings.ToLower(filter.Query)) {
+		return false
+	}
+	if filter.Domain != "" {
+		domain := strings.ToLower(strings.TrimSuffix(filter.Domain, "."))
+		host := strings.ToLower(linkHost(req.Link))
+		if host != domain && !strings.HasSuffix(host, "."+domain) {
+			return false
+		}
+	}
+	if filter.MinBytes != nil && (req.Bytes == nil || *req.Bytes < *filter.MinBytes) {
+		return false
+	}
+	if filter.MaxBytes != nil && (req.Bytes == nil || *req.Bytes > *filter.MaxBytes) {
+		return false
+	}
+	return true
+}
+
+// inFolder reports whether the folder is folderID, or one of its subfolders if recursive.
+func (f *Fake) inFolder(folder *int64, folderID int64, recursive bool) bool {
+	for folder != nil {
+		if *folder == folderID {
+			return true
+		}
+		if !recursive {
+			return false
+		}
+		folder = f.folders[*folder].ParentID
+	}
+	return false
+}
+
+// linkHost returns the host of the link, as the link_host column extracts it.
+func linkHost(link string) string {
+	_, rest, ok := strings.Cut(link, "://")
+	if !ok {
+		return ""
+	}
+	if i := strings.IndexAny(rest, "/?#"); i >= 0 {
+		rest = rest[:i]
+	}
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		rest = rest[i+1:]
+	}
+	if i := strings.LastIndex(rest, ":"); i >= 0 && !strings.HasSuffix(rest, "]") {
+		rest = rest[:i]
+	}
+	return rest
+}
+
+// sortValue returns the value of the download in the sort column, as the cursors hold it.
+func sortValue(d *fakeDownload, sortBy string) any {
+	switch sortBy {
+	case "created_at":
+		return d.createdAt
+	case "finished_at":
+		if d.finishedAt != nil {
+			return *d.finishedAt
+		}
+	case "bytes":
+		if d.req.Bytes != nil {
+			return *d.req.Bytes
+		}
+	case "link":
+		return d.req.Link
+	case "status":
+		return d.req.Status
+	case "priority":
+		return d.req.Priority
+	default:
+		return d.req.ID
+	}
+	return nil
+}
+
+func compareValues(a any, b any) int {
+	switch a := a.(type) {
+	case int64:
+		b, _ := b.(int64)
+		return cmp.Compare(a, b)
+	case string:
+		b, _ := b.(string)
+		return strings.Compare(a, b)
+	case time.Time:
+		b, _ := b.(time.Time)
+		return a.Compare(b)
+	}
+	return 0
+}
+
+// GetCachedDownloadRequests does not cache, it is GetDownloadRequests.
+func (f *Fake) GetCachedDownloadRequests(ctx context.Context, userID int64, page int64, limit int64, filter repository.DownloadFilter, ttl time.Duration) ([]repository.DownloadRequest, *repository.DownloadCursor, error) {
+	if f.GetCachedDownloadRequestsFunc != nil {
+		return f.Mock.GetCachedDownloadRequests(ctx, userID, page, limit, filter, ttl)
+	}
+	return f.GetDownloadRequests(ctx, userID, page, limit, filter)
+}
+
+func (f *Fake) GetUserDownloadRequests(ctx context.Context, userID int64) ([]repository.DownloadRequest, error) {
+	if f.GetUserDownloadRequestsFunc != nil {
+		return f.Mock.GetUserDownloadRequests(ctx, userID)
+	}
+	f.record("GetUserDownloadRequests", []any{ctx, userID})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var downloads []repository.DownloadRequest
+	for _, d := range f.downloads {
+		if d.req.UserID == userID {
+			downloads = append(downloads, d.download())
+		}
+	}
+	sort.Slice(downloads, func(i, j int) bool { return downloads[i].ID < downloads[j].ID })
+	return downloads, nil
+}
+
+func (f *Fake) GetUserDownloadCounts(ctx context.Context, userID int64) (map[string]int64, error) {
+	if f.GetUserDownloadCountsFunc != nil {
+		return f.Mock.GetUserDownloadCounts(ctx, userID)
+	}
+	f.record("GetUserDownloadCounts", []any{ctx, userID})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	counts := make(map[string]int64)
+	for _, d := range f.downloads {
+		if d.req.UserID == userID {
+			counts[d.req.Status]++
+		}
+	}
+	return counts, nil
+}
+
+func (f *Fake) FindDownloadRequest(ctx context.Context, userID int64, link string, byteRange string) (repository.DownloadRequest, bool, error) {
+	if f.FindDownloadRequestFunc != nil {
+		return f.Mock.FindDownloadRequest(ctx, userID, link, byteRange)
+	}
+	f.record("FindDownloadRequest", []any{ctx, userID, link, byteRange})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d := f.find(userID, link, byteRange)
+	if d == nil {
+		return repository.DownloadRequest{}, false, nil
+	}
+	return d.download(), true, nil
+}
+
+func (f *Fake) find(userID int64, link string, byteRange string) *fakeDownload {
+	for _, d := range f.downloads {
+		if d.req.UserID == userID && d.req.Link == link && d.req.Range == byteRange {
+			return d
+		}
+	}
+	return nil
+}
+
+func (f *Fake) FileNameExists(ctx context.Context, fileName string) (bool, error) {
+	if f.FileNameExistsFunc != nil {
+		return f.Mock.FileNameExists(ctx, fileName)
+	}
+	f.record("FileNameExists", []any{ctx, fileName})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, d := range f.downloads {
+		if d.req.FileName == fileName {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// CreateDownloadRequest creates the download with its pipeline and pushes it to the queue.
+func (f *Fake) CreateDownloadRequest(ctx context.Context, download repository.NewDownload) (int64, error) {
+	if f.CreateDownloadRequestFunc != nil {
+		return f.Mock.CreateDownloadRequest(ctx, download)
+	}
+	f.record("CreateDownloadRequest", []any{ctx, download})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	downloadID := f.create(download)
+	if downloadID == 0 {
+		return 0, fmt.Errorf("could not create download request: user_id: %d, link: %s: requested concurrently: %w", download.UserID, download.Link, repository.ErrDuplicateLink)
+	}
+	return downloadID, nil
+}
+
+// CreateDownloadRequests creates the downloads, their id is 0 for the links already requested.
+func (f *Fake) CreateDownloadRequests(ctx context.Context, downloads []repository.NewDownload) ([]int64, error) {
+	if f.CreateDownloadRequestsFunc != nil {
+		return f.Mock.CreateDownloadRequests(ctx, downloads)
+	}
+	f.record("CreateDownloadRequests", []any{ctx, downloads})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	downloadIDs := make([]int64, 0, len(downloads))
+	for _, download := range downloads {
+		downloadIDs = append(downloadIDs, f.create(download))
+	}
+	return downloadIDs, nil
+}
+
+// create creates the download and returns its id, or 0 if the link is already requested.
+func (f *Fake) create(download repository.NewDownload) int64 {
+	if f.find(download.UserID, download.Link, download.Range) != nil {
+		return 0
+	}
+	labels := maps.Clone(download.Labels)
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	mirrors := slices.Clone(download.Mirrors)
+	if mirrors == nil {
+		mirrors = []string{}
+	}
+
+	f.nextID++
+	d := &fakeDownload{
+		req: repository.DownloadRequest{
+			ID:              f.nextID,
+			UserID:          download.UserID,
+			Link:            download.Link,
+			FileName:        download.FileName,
+			Priority:        download.Priority,
+			Status:          repository.StatusQueued,
+			ExpiresAt:       download.ExpiresAt,
+			Credentials:     download.Credentials,
+			Headers:         download.Headers,
+			Labels:          labels,
+			Range:           download.Range,
+			OriginProfileID: download.OriginProfileID,
+			MaxSpeed:        download.MaxSpeed,
+			ManifestURL:     download.ManifestURL,
+			FolderID:        download.FolderID,
+			Mirrors:         mirrors,
+			Tier:            repository.TierHot,
+			Tuning:          download.Tuning,
+			Proxy:           download.Proxy,
+			OrgID:           download.OrgID,
+		},
+		createdAt: f.Now(),
+	}
+	for i, name := range download.Pipeline {
+		d.steps = append(d.steps, repository.PipelineStep{Position: int64(i + 1), Name: name, Status: repository.PipelineStepPending})
+	}
+	f.downloads[d.req.ID] = d
+	f.queue = append(f.queue, d.req.ID)
+	return d.req.ID
+}
+
+func (f *Fake) StartDownloadRequest(ctx context.Context, downloadID int64, host string) (bool, error) {
+	if f.StartDownloadRequestFunc != nil {
+		return f.Mock.StartDownloadRequest(ctx, downloadID, host)
+	}
+	f.record("StartDownloadRequest", []any{ctx, downloadID, host})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, ok := f.downloads[downloadID]
+	if !ok || d.req.Status != repository.StatusQueued && d.req.Status != repository.StatusDownloading {
+		return false, nil
+	}
+	if d.startedAt == nil && d.req.ExpiresAt != nil && !d.req.ExpiresAt.After(f.Now()) {
+		return false, nil
+	}
+	if d.startedAt == nil {
+		now := f.Now()
+		d.startedAt = &now
+	}
+	d.req.Status, d.req.Host = repository.StatusDownloading, host
+	return true, nil
+}
+
+func (f *Fake) CompleteDownloadRequest(ctx context.Context, downloadID int64, size int64) (bool, error) {
+	if f.CompleteDownloadRequestFunc != nil {
+		return f.Mock.CompleteDownloadRequest(ctx, downloadID, size)
+	}
+	f.record("CompleteDownloadRequest", []any{ctx, downloadID, size})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, ok := f.downloads[downloadID]
+	if !ok || d.req.Status != repository.StatusDownloading {
+		return false, nil
+	}
+	d.req.Completed, d.req.Status, d.req.Bytes = true, repository.StatusCompleted, &size
+	f.finish(d)
+	return true, nil
+}
+
+func (f *Fake) MarkError(ctx context.Context, downloadID int64, err string) error {
+	if f.MarkErrorFunc != nil {
+		return f.Mock.MarkError(ctx, downloadID, err)
+	}
+	return f.MarkErrorCode(ctx, downloadID, "", err)
+}
+
+func (f *Fake) MarkErrorCode(ctx context.Context, downloadID int64, code string, err string) error {
+	if f.MarkErrorCodeFunc != nil {
+		return f.Mock.MarkErrorCode(ctx, downloadID, code, err)
+	}
+	f.record("MarkErrorCode", []any{ctx, downloadID, code, err})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if d, ok := f.downloads[downloadID]; ok && d.req.Status != repository.StatusFailed {
+		d.req.Error, d.req.ErrorCode, d.req.Status = err, code, repository.StatusFailed
+		f.finish(d)
+	}
+	return nil
+}
+
+func (f *Fake) CancelDownloadRequest(ctx context.Context, downloadID int64) (bool, error) {
+	if f.CancelDownloadRequestFunc != nil {
+		return f.Mock.CancelDownloadRequest(ctx, downloadID)
+	}
+	f.record("CancelDownloadRequest", []any{ctx, downloadID})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, ok := f.downloads[downloadID]
+	if !ok || d.req.Status != repository.StatusQueued && d.req.Status != repository.StatusDownloading {
+		return false, nil
+	}
+	d.req.Error, d.req.Status = repository.CanceledError, repository.StatusFailed
+	f.finish(d)
+	return true, nil
+}
+
+// RetryDownloadRequest queues the failed download again, pushed to the queue.
+func (f *Fake) RetryDownloadRequest(ctx context.Context, downloadID int64, restart bool) (int64, error) {
+	if f.RetryDownloadRequestFunc != nil {
+		return f.Mock.RetryDownloadRequest(ctx, downloadID, restart)
+	}
+	f.record("RetryDownloadRequest", []any{ctx, downloadID, restart})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, ok := f.downloads[downloadID]
+	if !ok || d.req.Status != repository.StatusFailed {
+		return 0, nil
+	}
+	d.req.Status, d.req.Completed, d.req.Error, d.req.ErrorCode, d.req.ExpiresAt = repository.StatusQueued, false, "", "", nil
+	d.finishedAt, d.restart = nil, restart
+	d.manualRetries++
+	f.queue = append(f.queue, downloadID)
+	return d.manualRetries, nil
+}
+
+func (f *Fake) TakeRestart(ctx context.Context, downloadID int64) (bool, error) {
+	if f.TakeRestartFunc != nil {
+		return f.Mock.TakeRestart(ctx, downloadID)
+	}
+	f.record("TakeRestart", []any{ctx, downloadID})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, ok := f.downloads[downloadID]
+	if !ok || !d.restart {
+		return false, nil
+	}
+	d.restart = false
+	return true, nil
+}
+
+// finished reports whether the download can be trashed or deleted.
+func finished(d *fakeDownload) bool {
+	return d.req.Status == repository.StatusCompleted || d.req.Status == repository.StatusFailed || d.req.Status == repository.StatusExpired
+}
+
+func (f *Fake) TrashDownloadRequest(ctx context.Context, downloadID int64) (bool, error) {
+	if f.TrashDownloadRequestFunc != nil {
+		return f.Mock.TrashDownloadRequest(ctx, downloadID)
+	}
+	f.record("TrashDownloadRequest", []any{ctx, downloadID})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, ok := f.downloads[downloadID]
+	if !ok || !finished(d) || d.req.DeletedAt != nil {
+		return false, nil
+	}
+	now := f.Now()
+	d.req.DeletedAt = &now
+	return true, nil
+}
+
+func (f *Fake) RestoreFromTrash(ctx context.Context, downloadID int64) (bool, error) {
+	if f.RestoreFromTrashFunc != nil {
+		return f.Mock.RestoreFromTrash(ctx, downloadID)
+	}
+	f.record("RestoreFromTrash", []any{ctx, downloadID})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, ok := f.downloads[downloadID]
+	if !ok || d.req.DeletedAt == nil {
+		return false, nil
+	}
+	d.req.DeletedAt = nil
+	return true, nil
+}
+
+func (f *Fake) DeleteDownloadRequest(ctx context.Context, downloadID int64) (bool, error) {
+	if f.DeleteDownloadRequestFunc != nil {
+		return f.Mock.DeleteDownloadRequest(ctx, downloadID)
+	}
+	f.record("DeleteDownloadRequest", []any{ctx, downloadID})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, ok := f.downloads[downloadID]
+	if !ok || !finished(d) {
+		return false, nil
+	}
+	delete(f.downloads, downloadID)
+	return true, nil
+}
+
+// update applies change to the download, if it exists.
+func (f *Fake) update(downloadID int64, change func(req *repository.DownloadRequest)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if d, ok := f.downloads[downloadID]; ok {
+		change(&d.req)
+	}
+}
+
+func (f *Fake) SetMetadata(ctx context.Context, downloadID int64, metadata repository.Metadata) error {
+	if f.SetMetadataFunc != nil {
+		return f.Mock.SetMetadata(ctx, downloadID, metadata)
+	}
+	f.record("SetMetadata", []any{ctx, downloadID, metadata})
+	f.update(downloadID, func(req *repository.DownloadRequest) { req.Metadata = &metadata })
+	return nil
+}
+
+func (f *Fake) SetMaxSpeed(ctx context.Context, downloadID int64, maxSpeed int64) error {
+	if f.SetMaxSpeedFunc != nil {
+		return f.Mock.SetMaxSpeed(ctx, downloadID, maxSpeed)
+	}
+	f.record("SetMaxSpeed", []any{ctx, downloadID, maxSpeed})
+	f.update(downloadID, func(req *repository.DownloadRequest) { req.MaxSpeed = maxSpeed })
+	return nil
+}
+
+func (f *Fake) SetContentHash(ctx context.Context, downloadID int64, hash string) error {
+	if f.SetContentHashFunc != nil {
+		return f.Mock.SetContentHash(ctx, downloadID, hash)
+	}
+	f.record("SetContentHash", []any{ctx, downloadID, hash})
+	f.update(downloadID, func(req *repository.DownloadRequest) { req.ContentHash = hash })
+	return nil
+}
+
+func (f *Fake) SetVerification(ctx context.Context, downloadID int64, verification string, detail string) error {
+	if f.SetVerificationFunc != nil {
+		return f.Mock.SetVerification(ctx, downloadID, verification, detail)
+	}
+	f.record("SetVerification", []any{ctx, downloadID, verification, detail})
+	f.update(downloadID, func(req *repository.DownloadRequest) {
+		req.Verification, req.VerificationDetail = verification, detail
+	})
+	return nil
+}
+
+func (f *Fake) SetDownloadFolder(ctx context.Context, downloadID int64, folderID *int64) error {
+	if f.SetDownloadFolderFunc != nil {
+		return f.Mock.SetDownloadFolder(ctx, downloadID, folderID)
+	}
+	f.record("SetDownloadFolder", []any{ctx, downloadID, folderID})
+	f.update(downloadID, func(req *repository.DownloadRequest) { req.FolderID = folderID })
+	return nil
+}
+
+func (f *Fake) GetPipelineSteps(ctx context.Context, downloadID int64) ([]repository.PipelineStep, error) {
+	if f.GetPipelineStepsFunc != nil {
+		return f.Mock.GetPipelineSteps(ctx, downloadID)
+	}
+	f.record("GetPipelineSteps", []any{ctx, downloadID})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	steps := []repository.PipelineStep{}
+	if d, ok := f.downloads[downloadID]; ok {
+		steps = append(steps, d.steps...)
+	}
+	return steps, nil
+}
+
+// updateSteps applies change to the steps of the download.
+func (f *Fake) updateSteps(downloadID int64, change func(step *repository.PipelineStep, now time.Time)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if d, ok := f.downloads[downloadID]; ok {
+		now := f.Now()
+		for i := range d.steps {
+			change(&d.steps[i], now)
+		}
+	}
+}
+
+func (f *Fake) StartPipelineStep(ctx context.Context, downloadID int64, position int64) error {
+	if f.StartPipelineStepFunc != nil {
+		return f.Mock.StartPipelineStep(ctx, downloadID, position)
+	}
+	f.record("StartPipelineStep", []any{ctx, downloadID, position})
+	f.updateSteps(downloadID, func(step *repository.PipelineStep, now time.Time) {
+		if step.Position == position {
+			step.Status, step.StartedAt = repository.PipelineStepRunning, &now
+		}
+	})
+	return nil
+}
+
+func (f *Fake) FinishPipelineStep(ctx context.Context, downloadID int64, position int64, status string, detail string, errMessage string) error {
+	if f.FinishPipelineStepFunc != nil {
+		return f.Mock.FinishPipelineStep(ctx, downloadID, position, status, detail, errMessage)
+	}
+	f.record("FinishPipelineStep", []any{ctx, downloadID, position, status, detail, errMessage})
+	f.updateSteps(downloadID, func(step *repository.PipelineStep, now time.Time) {
+		if step.Position == position {
+			step.Status, step.Detail, step.Error, step.FinishedAt = status, detail, errMessage, &now
+		}
+	})
+	return nil
+}
+
+func (f *Fake) SkipPipelineSteps(ctx context.Context, downloadID int64, reason string) error {
+	if f.SkipPipelineStepsFunc != nil {
+		return f.Mock.SkipPipelineSteps(ctx, downloadID, reason)
+	}
+	f.record("SkipPipelineSteps", []any{ctx, downloadID, reason})
+	f.updateSteps(downloadID, func(step *repository.PipelineStep, now time.Time) {
+		if step.Status == repository.PipelineStepPending || step.Status == repository.PipelineStepRunning {
+			step.Status, step.Detail, step.FinishedAt = repository.PipelineStepSkipped, reason, &now
+		}
+	})
+	return nil
+}
+
+func (f *Fake) GetFolders(ctx context.Context, userID int64) ([]repository.Folder, error) {
+	if f.GetFoldersFunc != nil {
+		return f.Mock.GetFolders(ctx, userID)
+	}
+	f.record("GetFolders", []any{ctx, userID})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	folders := []repository.Folder{}
+	for _, folder := range f.folders {
+		if folder.UserID == userID {
+			folders = append(folders, folder)
+		}
+	}
+	sort.Slice(folders, func(i, j int) bool { return folders[i].ID < folders[j].ID })
+	return folders, nil
+}
+
+func (f *Fake) GetFolder(ctx context.Context, folderID int64) (repository.Folder, bool, error) {
+	if f.GetFolderFunc != nil {
+		return f.Mock.GetFolder(ctx, folderID)
+	}
+	f.record("GetFolder", []any{ctx, folderID})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	folder, ok := f.folders[folderID]
+	return folder, ok, nil
+}
+
+func (f *Fake) CreateFolder(ctx context.Context, folder repository.Folder) (int64, error) {
+	if f.CreateFolderFunc != nil {
+		return f.Mock.CreateFolder(ctx, folder)
+	}
+	f.record("CreateFolder", []any{ctx, folder})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, other := range f.folders {
+		if other.UserID == folder.UserID && other.Name == folder.Name && (other.ParentID == nil) == (folder.ParentID == nil) && (other.ParentID == nil || *other.ParentID == *folder.ParentID) {
+			return 0, repository.FolderExistsErr
+		}
+	}
+	f.nextID++
+	folder.ID, folder.CreatedAt = f.nextID, f.Now()
+	f.folders[folder.ID] = folder
+	return folder.ID, nil
+}
+
+// DeleteFolder deletes the folder and its subfolders, taking their downloads out of any folder.
+func (f *Fake) DeleteFolder(ctx context.Context, userID int64, folderID int64) (bool, error) {
+	if f.DeleteFolderFunc != nil {
+		return f.Mock.DeleteFolder(ctx, userID, folderID)
+	}
+	f.record("DeleteFolder", []any{ctx, userID, folderID})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if folder, ok := f.folders[folderID]; !ok || folder.UserID != userID {
+		return false, nil
+	}
+	var deleted []int64
+	for id := range f.folders {
+		if f.inFolder(&id, folderID, true) {
+			deleted = append(deleted, id)
+		}
+	}
+	for _, d := range f.downloads {
+		if d.req.FolderID != nil && slices.Contains(deleted, *d.req.FolderID) {
+			d.req.FolderID = nil
+		}
+	}
+	for _, id := range deleted {
+		delete(f.folders, id)
+	}
+	return true, nil
+}
+
+// PushDownloadRequest pushes the download to the end of the queue, unless it was deleted.
+func (f *Fake) PushDownloadRequest(ctx context.Context, downloadID int64) error {
+	if f.PushDownloadRequestFunc != nil {
+		return f.Mock.PushDownloadRequest(ctx, downloadID)
+	}
+	f.record("PushDownloadRequest", []any{ctx, downloadID})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.downloads[downloadID]; ok {
+		f.queue = append(f.queue, downloadID)
+	}
+	return nil
+}
+
+// PushDownloadRequestToHost is PushDownloadRequest, there is a single queue.
+func (f *Fake) PushDownloadRequestToHost(ctx context.Context, downloadID int64, host string) error {
+	if f.PushDownloadRequestToHostFunc != nil {
+		return f.Mock.PushDownloadRequestToHost(ctx, downloadID, host)
+	}
+	return f.PushDownloadRequest(ctx, downloadID)
+}
+
+func (f *Fake) PopDownloadRequest(ctx context.Context, host string, consumer string) (repository.QueueEntry, error) {
+	if f.PopDownloadRequestFunc != nil {
+		return f.Mock.PopDownloadRequest(ctx, host, consumer)
+	}
+	f.record("PopDownloadRequest", []any{ctx, host, consumer})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.queue) == 0 {
+		return repository.QueueEntry{}, repository.NoMoreDownloadRequestErr
+	}
+	f.nextID++
+	entry := repository.QueueEntry{Stream: repository.DownloadRequestsKey, ID: strconv.FormatInt(f.nextID, 10), DownloadID: f.queue[0]}
+	f.queue = f.queue[1:]
+	f.popped[entry.ID] = entry.DownloadID
+	return entry, nil
+}
+
+func (f *Fake) AckDownloadRequest(ctx context.Context, entry repository.QueueEntry) error {
+	if f.AckDownloadRequestFunc != nil {
+		return f.Mock.AckDownloadRequest(ctx, entry)
+	}
+	f.record("AckDownloadRequest", []any{ctx, entry})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.popped, entry.ID)
+	return nil
+}
+
+func (f *Fake) QueueDepth(ctx context.Context) (int64, error) {
+	if f.QueueDepthFunc != nil {
+		return f.Mock.QueueDepth(ctx)
+	}
+	f.record("QueueDepth", []any{ctx})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return int64(len(f.queue)), nil
+}
+
+func (f *Fake) SetProgress(ctx context.Context, downloadID int64, progress repository.Progress) error {
+	if f.SetProgressFunc != nil {
+		return f.Mock.SetProgress(ctx, downloadID, progress)
+	}
+	f.record("SetProgress", []any{ctx, downloadID, progress})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.progresses[downloadID] = progress
+	return nil
+}
+
+func (f *Fake) GetProgress(ctx context.Context, downloadID int64) (repository.Progress, bool, error) {
+	if f.GetProgressFunc != nil {
+		return f.Mock.GetProgress(ctx, downloadID)
+	}
+	f.record("GetProgress", []any{ctx, downloadID})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	progress, ok := f.progresses[downloadID]
+	return progress, ok, nil
+}
+
+func (f *Fake) GetProgresses(ctx context.Context, downloadIDs []int64) (map[int64]repository.Progress, error) {
+	if f.GetProgressesFunc != nil {
+		return f.Mock.GetProgresses(ctx, downloadIDs)
+	}
+	f.record("GetProgresses", []any{ctx, downloadIDs})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	progresses := make(map[int64]repository.Progress, len(downloadIDs))
+	for _, downloadID := range downloadIDs {
+		if progress, ok := f.progresses[downloadID]; ok {
+			progresses[downloadID] = progress
+		}
+	}
+	return progresses, nil
+}
+
+// lock returns the lock of the download, unless it expired.
+func (f *Fake) lock(downloadID int64) (fakeLock, bool) {
+	lock, ok := f.locks[downloadID]
+	if ok && !lock.expiresAt.IsZero() && !lock.expiresAt.After(f.Now()) {
+		delete(f.locks, downloadID)
+		return fakeLock{}, false
+	}
+	return lock, ok
+}
+
+// lockExpiry returns when a lock taken for expiration expires, never if it is not positive.
+func (f *Fake) lockExpiry(expiration time.Duration) time.Time {
+	if expiration <= 0 {
+		return time.Time{}
+	}
+	return f.Now().Add(expiration)
+}
+
+func (f *Fake) AcquireLock(ctx context.Context, downloadID int64, token string, expiration time.Duration) (bool, error) {
+	if f.AcquireLockFunc != nil {
+		return f.Mock.AcquireLock(ctx, downloadID, token, expiration)
+	}
+	f.record("AcquireLock", []any{ctx, downloadID, token, expiration})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if lock, ok := f.lock(downloadID); ok && lock.token != token {
+		return false, nil
+	}
+	f.locks[downloadID] = fakeLock{token: token, expiresAt: f.lockExpiry(expiration)}
+	return true, nil
+}
+
+func (f *Fake) ExtendLock(ctx context.Context, downloadID int64, token string, expiration time.Duration) (bool, error) {
+	if f.ExtendLockFunc != nil {
+		return f.Mock.ExtendLock(ctx, downloadID, token, expiration)
+	}
+	f.record("ExtendLock", []any{ctx, downloadID, token, expiration})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if lock, ok := f.lock(downloadID); !ok || lock.token != token {
+		return false, nil
+	}
+	f.locks[downloadID] = fakeLock{token: token, expiresAt: f.lockExpiry(expiration)}
+	return true, nil
+}
+
+func (f *Fake) ReleaseLock(ctx context.Context, downloadID int64, token string) error {
+	if f.ReleaseLockFunc != nil {
+		return f.Mock.ReleaseLock(ctx, downloadID, token)
+	}
+	f.record("ReleaseLock", []any{ctx, downloadID, token})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if lock, ok := f.lock(downloadID); ok && lock.token == token {
+		delete(f.locks, downloadID)
+	}
+	return nil
+}
+
+// RateLimit counts the hits of the key in a sliding window, as the real one does.
+func (f *Fake) RateLimit(ctx context.Context, key string, limit int64, window time.Duration, hits int64) (repository.RateLimitResult, error) {
+	if f.RateLimitFunc != nil {
+		return f.Mock.RateLimit(ctx, key, limit, window, hits)
+	}
+	f.record("RateLimit", []any{ctx, key, limit, window, hits})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := f.Now()
+	recent := slices.DeleteFunc(f.rateLimits[key], func(t time.Time) bool { return !t.After(now.Add(-window)) })
+	allowed := int64(len(recent))+hits <= limit
+	if allowed {
+		for i := int64(0); i < hits; i++ {
+			recent = append(recent, now)
+		}
+	}
+	f.rateLimits[key] = recent
+
+	var reset time.Duration
+	if len(recent) > 0 {
+		reset = recent[0].Add(window).Sub(now)
+	}
+	return repository.RateLimitResult{Allowed: allowed, Remaining: max(limit-int64(len(recent)), 0), Reset: reset}, nil
+}
+
+func (f *Fake) CreateUser(ctx context.Context, username string, hashedPassword string, email string) (int64, error) {
+	if f.CreateUserFunc != nil {
+		return f.Mock.CreateUser(ctx, username, hashedPassword, email)
+	}
+	f.record("CreateUser", []any{ctx, username, hashedPassword, email})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, u := range f.users {
+		if email != "" && u.user.Email != nil && strings.EqualFold(*u.user.Email, email) {
+			return 0, repository.EmailTakenErr
+		}
+		if u.user.Username == username {
+			return 0, repository.ErrDuplicateUser
+		}
+	}
+	f.nextID++
+	user := repository.User{ID: f.nextID, Username: username, Plan: "default"}
+	if email != "" {
+		user.Email = &email
+	}
+	f.users[user.ID] = &fakeUser{user: user, password: hashedPassword}
+	return user.ID, nil
+}
+
+// findUser returns the user with the username, nil if there is none.
+func (f *Fake) findUser(username string) *fakeUser {
+	for _, u := range f.users {
+		if u.user.Username == username {
+			return u
+		}
+	}
+	return nil
+}
+
+func (f *Fake) AuthUser(ctx context.Context, username string, password string) (int64, error) {
+	if f.AuthUserFunc != nil {
+		return f.Mock.AuthUser(ctx, username, password)
+	}
+	f.record("AuthUser", []any{ctx, username, password})
+
+	f.mu.Lock()
+	u := f.findUser(username)
+	f.mu.Unlock()
+	if u == nil || u.password == "" || bcrypt.CompareHashAndPassword([]byte(u.password), []byte(password)) != nil {
+		return 0, nil
+	}
+	return u.user.ID, nil
+}
+
+func (f *Fake) FindUser(ctx context.Context, username string) (int64, bool, error) {
+	if f.FindUserFunc != nil {
+		return f.Mock.FindUser(ctx, username)
+	}
+	f.record("FindUser", []any{ctx, username})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if u := f.findUser(username); u != nil {
+		return u.user.ID, true, nil
+	}
+	return 0, false, nil
+}
+
+// user returns the user, or the error of the real repository if there is none.
+func (f *Fake) user(userID int64, what string) (*fakeUser, error) {
+	u, ok := f.users[userID]
+	if !ok {
+		return nil, fmt.Errorf("could not retrieve %s of user %d: %w", what, userID, repository.ErrNotFound)
+	}
+	return u, nil
+}
+
+func (f *Fake) GetUser(ctx context.Context, userID int64) (repository.User, bool, error) {
+	if f.GetUserFunc != nil {
+		return f.Mock.GetUser(ctx, userID)
+	}
+	f.record("GetUser", []any{ctx, userID})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u, ok := f.users[userID]
+	if !ok {
+		return repository.User{}, false, nil
+	}
+	return u.user, true, nil
+}
+
+func (f *Fake) GetUserByEmail(ctx context.Context, email string) (repository.User, bool, error) {
+	if f.GetUserByEmailFunc != nil {
+		return f.Mock.GetUserByEmail(ctx, email)
+	}
+	f.record("GetUserByEmail", []any{ctx, email})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, u := range f.users {
+		if u.user.Email != nil && strings.EqualFold(*u.user.Email, email) {
+			return u.user, true, nil
+		}
+	}
+	return repository.User{}, false, nil
+}
+
+func (f *Fake) IsAdmin(ctx context.Context, userID int64) (bool, error) {
+	if f.IsAdminFunc != nil {
+		return f.Mock.IsAdmin(ctx, userID)
+	}
+	f.record("IsAdmin", []any{ctx, userID})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u, err := f.user(userID, "role")
+	if err != nil {
+		return false, err
+	}
+	return u.user.IsAdmin, nil
+}
+
+func (f *Fake) GetUserAuth(ctx context.Context, userID int64) (repository.UserAuth, bool, error) {
+	if f.GetUserAuthFunc != nil {
+		return f.Mock.GetUserAuth(ctx, userID)
+	}
+	f.record("GetUserAuth", []any{ctx, userID})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u, ok := f.users[userID]
+	if !ok {
+		return repository.UserAuth{}, false, nil
+	}
+	return repository.UserAuth{
+		TokenVersion:          u.tokenVersion,
+		Disabled:              u.user.DisabledAt != nil,
+		PasswordResetRequired: u.user.PasswordResetRequired,
+	}, true, nil
+}
+
+func (f *Fake) GetUserPlan(ctx context.Context, userID int64) (string, error) {
+	if f.GetUserPlanFunc != nil {
+		return f.Mock.GetUserPlan(ctx, userID)
+	}
+	f.record("GetUserPlan", []any{ctx, userID})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u, err := f.user(userID, "plan")
+	if err != nil {
+		return "", err
+	}
+	return u.user.Plan, nil
+}
+
+func (f *Fake) GetUserUsage(ctx context.Context, userID int64) (int64, error) {
+	if f.GetUserUsageFunc != nil {
+		return f.Mock.GetUserUsage(ctx, userID)
+	}
+	f.record("GetUserUsage", []any{ctx, userID})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u, err := f.user(userID, "usage")
+	if err != nil {
+		return 0, err
+	}
+	return u.user.StoredBytes, nil
+}
+
+func (f *Fake) AddUserUsage(ctx context.Context, userID int64, bytes int64) (int64, error) {
+	if f.AddUserUsageFunc != nil {
+		return f.Mock.AddUserUsage(ctx, userID, bytes)
+	}
+	f.record("AddUserUsage", []any{ctx, userID, bytes})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u, err := f.user(userID, "usage")
+	if err != nil {
+		return 0, err
+	}
+	u.user.StoredBytes = max(u.user.StoredBytes+bytes, 0)
+	return u.user.StoredBytes, nil
+}
+
+func (f *Fake) AddSession(ctx context.Context, userID int64, session repository.Session) error {
+	if f.AddSessionFunc != nil {
+		return f.Mock.AddSession(ctx, userID, session)
+	}
+	f.record("AddSession", []any{ctx, userID, session})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.sessions[userID] == nil {
+		f.sessions[userID] = map[string]repository.Session{}
+	}
+	f.sessions[userID][session.ID] = session
+	return nil
+}
+
+func (f *Fake) GetSession(ctx context.Context, userID int64, sessionID string) (repository.Session, bool, error) {
+	if f.GetSessionFunc != nil {
+		return f.Mock.GetSession(ctx, userID, sessionID)
+	}
+	f.record("GetSession", []any{ctx, userID, sessionID})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	session, ok := f.sessions[userID][sessionID]
+	if !ok || !session.ExpiresAt.After(f.Now()) {
+		return repository.Session{}, false, nil
+	}
+	return session, true, nil
+}
+
+// GetSessions returns the sessions of the user that did not expire, the latest first.
+func (f *Fake) GetSessions(ctx context.Context, userID int64) ([]repository.Session, error) {
+	if f.GetSessionsFunc != nil {
+		return f.Mock.GetSessions(ctx, userID)
+	}
+	f.record("GetSessions", []any{ctx, userID})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var sessions []repository.Session
+	for sessionID, session := range f.sessions[userID] {
+		if !session.ExpiresAt.After(f.Now()) {
+			delete(f.sessions[userID], sessionID)
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].IssuedAt.After(sessions[j].IssuedAt) })
+	return sessions, nil
+}
+
+func (f *Fake) DeleteSession(ctx context.Context, userID int64, sessionID string) (bool, error) {
+	if f.DeleteSessionFunc != nil {
+		return f.Mock.DeleteSession(ctx, userID, sessionID)
+	}
+	f.record("DeleteSession", []any{ctx, userID, sessionID})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.sessions[userID][sessionID]; !ok {
+		return false, nil
+	}
+	delete(f.sessions[userID], sessionID)
+	return true, nil
+}
@@ -0,0 +1,309 @@
+// Command gen generates the Mock of package repositorytest from the Repository interface of
+// package repository: a field per method holding the function the method calls, so that a
+// test sets only the methods it expects.
+//
+//	go generate ./internal/repository/repositorytest
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// predeclared are the types that are not qualified with the package of the interface.
+var predeclared = map[string]bool{
+	"any": true, "bool": true, "byte": true, "error": true, "float32": true, "float64": true,
+	"int": true, "int8": true, "int16": true, "int32": true, "int64": true, "rune": true,
+	"string": true, "uint": true, "uint8": true, "uint16": true, "uint32": true, "uint64": true,
+}
+
+// aliases are the unexported types of the interface and their exported aliases.
+var aliases = map[string]string{
+	"downloadRequest": "DownloadRequest",
+}
+
+func main() {
+	srcFile := flag.String("src", "../repository.go", "Go file declaring the interface")
+	iface := flag.String("interface", "Repository", "interface to mock")
+	pkgPath := flag.String("pkg", "example.com/internal/repository", "import path of the package of the interface")
+	outFile := flag.String("out", "mock.gen.go", "generated Go file")
+	flag.Parse()
+
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, *srcFile, nil, parser.SkipObjectResolution)
+	if err != nil {
+		log.Fatal(err)
+	}
+	typ := findInterface(file, *iface)
+	if typ == nil {
+		log.Fatalf("no interface %s in %s", *iface, *srcFile)
+	}
+
+	g := generator{
+		pkgName: file.Name.Name,
+		imports: map[string]string{},
+		used:    map[string]bool{},
+	}
+	for _, spec := range file.Imports {
+		importPath, _ := strconv.Unquote(spec.Path.Value)
+		name := importPath[strings.LastIndex(importPath, "/")+1:]
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+		g.imports[name] = importPath
+	}
+	g.generate(*srcFile, *pkgPath, *iface, typ)
+
+	src, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		os.Stderr.Write(g.buf.Bytes())
+		log.Fatalf("invalid generated code: %v", err)
+	}
+	if err := os.WriteFile(*outFile, src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func findInterface(file *ast.File, name string) *ast.InterfaceType {
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			if spec := spec.(*ast.TypeSpec); spec.Name.Name == name {
+				typ, _ := spec.Type.(*ast.InterfaceType)
+				return typ
+			}
+		}
+	}
+	return nil
+}
+
+type generator struct {
+	pkgName string
+	imports map[string]string // import paths of the file of the interface, by package name
+	used    map[string]bool   // import paths the generated code needs
+	buf     bytes.Buffer
+	_       struct{}
+}
+
+// param is a parameter or a result of a method.
+type param struct {
+	name     string
+	typ      string
+	variadic bool
+}
+
+type method struct {
+	name    string
+	params  []param
+	results []param
+}
+
+func (g *generator) generate(srcFile string, pkgPath string, iface string, typ *ast.InterfaceType) {
+	g.used[pkgPath] = true
+	g.used["sync"] = true
+
+	var methods []method
+	for _, field := range typ.Methods.List {
+		fn, ok := field.Type.(*ast.FuncType)
+		if !ok || len(field.Names) == 0 {
+			log.Fatalf("%s embeds %s, which is not supported", iface, g.expr(field.Type))
+		}
+		m := method{name: field.Names[0].Name, params: g.fields(fn.Params, "arg")}
+		if fn.Results != nil {
+			m.results = g.fields(fn.Results, "r")
+		}
+		methods = append(methods, m)
+	}
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "// Mock is a %s.%s whose methods call the function of the field named after\n", g.pkgName, iface)
+	fmt.Fprintf(&body, "// them with a Func suffix, or return zero values if it is nil. It records the calls, and is\n")
+	fmt.Fprintf(&body, "// safe for concurrent use as long as the fields are set before.\n")
+	fmt.Fprintf(&body, "type Mock struct {\n")
+	for _, m := range methods {
+		fmt.Fprintf(&body, "\t%sFunc func(%s) %s\n", m.name, signature(m.params, false), results(m.results))
+	}
+	fmt.Fprintf(&body, "\n\tcallsMu sync.Mutex\n\tcalls   []Call\n}\n\n")
+	fmt.Fprintf(&body, "var _ %s.%s = (*Mock)(nil)\n\n", g.pkgName, iface)
+
+	for _, m := range methods {
+		var args []string
+		for _, p := range m.params {
+			if p.variadic {
+				args = append(args, p.name+"...")
+			} else {
+				args = append(args, p.name)
+			}
+		}
+		var names []string
+		for _, p := range m.params {
+			names = append(names, p.name)
+		}
+
+		fmt.Fprintf(&body, "func (m *Mock) %s(%s) %s {\n", m.name, signature(m.params, true), results(m.results))
+		fmt.Fprintf(&body, "\tm.record(%q, []any{%s})\n", m.name, strings.Join(names, ", "))
+		fmt.Fprintf(&body, "\tif m.%sFunc != nil {\n", m.name)
+		if len(m.results) > 0 {
+			fmt.Fprintf(&body, "\t\treturn m.%sFunc(%s)\n\t}\n", m.name, strings.Join(args, ", "))
+		} else {
+			fmt.Fprintf(&body, "\t\tm.%sFunc(%s)\n\t}\n", m.name, strings.Join(args, ", "))
+		}
+		var zeros []string
+		for i, r := range m.results {
+			if r.typ == "error" {
+				zeros = append(zeros, "nil")
+				continue
+			}
+			name := fmt.Sprintf("r%d", i)
+			fmt.Fprintf(&body, "\tvar %s %s\n", name, r.typ)
+			zeros = append(zeros, name)
+		}
+		if len(zeros) > 0 {
+			fmt.Fprintf(&body, "\treturn %s\n", strings.Join(zeros, ", "))
+		}
+		fmt.Fprintf(&body, "}\n\n")
+	}
+
+	// The file is named from the root of the module, like the package of the interface.
+	src := path.Join(pkgPath[strings.Index(pkgPath, "/")+1:], filepath.Base(srcFile))
+	g.printf("// Code generated by internal/repository/repositorytest/gen from %s. DO NOT EDIT.\n\n", src)
+	g.printf("package repositorytest\n\nimport (\n")
+	paths := make([]string, 0, len(g.used))
+	for importPath := range g.used {
+		paths = append(paths, importPath)
+	}
+	// The standard library first, as goimports groups them.
+	sort.Slice(paths, func(i, j int) bool {
+		iStd, jStd := !strings.Contains(paths[i], "."), !strings.Contains(paths[j], ".")
+		if iStd != jStd {
+			return iStd
+		}
+		return paths[i] < paths[j]
+	})
+	for i, importPath := range paths {
+		if i > 0 && !strings.Contains(paths[i-1], ".") && strings.Contains(importPath, ".") {
+			g.printf("\n")
+		}
+		g.printf("\t%q\n", importPath)
+	}
+	g.printf(")\n\n")
+	g.buf.Write(body.Bytes())
+}
+
+func (g *generator) printf(format string, args ...any) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+// fields returns the parameters or the results of a method, the unnamed ones named after
+// prefix and their position.
+func (g *generator) fields(list *ast.FieldList, prefix string) []param {
+	var params []param
+	for _, field := range list.List {
+		p := param{typ: g.expr(field.Type)}
+		if ellipsis, ok := field.Type.(*ast.Ellipsis); ok {
+			p.typ, p.variadic = "..."+g.expr(ellipsis.Elt), true
+		}
+		if len(field.Names) == 0 {
+			p.name = fmt.Sprintf("%s%d", prefix, len(params))
+			params = append(params, p)
+			continue
+		}
+		for _, name := range field.Names {
+			p.name = name.Name
+			if p.name == "_" || p.name == "m" {
+				p.name = fmt.Sprintf("%s%d", prefix, len(params))
+			}
+			params = append(params, p)
+		}
+	}
+	return params
+}
+
+// expr returns the type as written in package repositorytest.
+func (g *generator) expr(e ast.Expr) string {
+	switch e := e.(type) {
+	case *ast.Ident:
+		if predeclared[e.Name] {
+			return e.Name
+		}
+		name := e.Name
+		if alias, ok := aliases[name]; ok {
+			name = alias
+		} else if !ast.IsExported(name) {
+			log.Fatalf("unexported type %s has no alias", name)
+		}
+		return g.pkgName + "." + name
+	case *ast.SelectorExpr:
+		pkg := e.X.(*ast.Ident).Name
+		importPath, ok := g.imports[pkg]
+		if !ok {
+			log.Fatalf("unknown package %s", pkg)
+		}
+		g.used[importPath] = true
+		return pkg + "." + e.Sel.Name
+	case *ast.StarExpr:
+		return "*" + g.expr(e.X)
+	case *ast.ArrayType:
+		if e.Len != nil {
+			return "[" + e.Len.(*ast.BasicLit).Value + "]" + g.expr(e.Elt)
+		}
+		return "[]" + g.expr(e.Elt)
+	case *ast.MapType:
+		return "map[" + g.expr(e.Key) + "]" + g.expr(e.Value)
+	case *ast.Ellipsis:
+		return "[]" + g.expr(e.Elt)
+	case *ast.InterfaceType:
+		if len(e.Methods.List) == 0 {
+			return "any"
+		}
+	case *ast.ChanType:
+		switch e.Dir {
+		case ast.SEND:
+			return "chan<- " + g.expr(e.Value)
+		case ast.RECV:
+			return "<-chan " + g.expr(e.Value)
+		}
+		return "chan " + g.expr(e.Value)
+	}
+	log.Fatalf("unsupported type %T", e)
+	return ""
+}
+
+// signature returns the parameter list of a method, with the names of the parameters or only
+// their types.
+func signature(params []param, named bool) string {
+	list := make([]string, len(params))
+	for i, p := range params {
+		if named {
+			list[i] = p.name + " " + p.typ
+		} else {
+			list[i] = p.typ
+		}
+	}
+	return strings.Join(list, ", ")
+}
+
+func results(params []param) string {
+	switch len(params) {
+	case 0:
+		return ""
+	case 1:
+		return params[0].typ
+	}
+	return "(" + signature(params, false) + ")"
+}
@@ -0,0 +1,42 @@
+// Package repositorytest implements repository.Repository without Postgres or Redis, for the
+// tests of the handlers and the consumer: Mock, generated from the interface, answers every
+// method with the function a test sets, and Fake keeps the users, the downloads, their queue
+// and their progress in memory.
+package repositorytest
+
+//go:generate go run ./gen -src ../repository.go -out mock.gen.go
+
+// Call is a call of a method of a Mock, or of a Fake.
+type Call struct {
+	Method string
+	Args   []any // without the context
+}
+
+func (m *Mock) record(method string, args []any) {
+	if len(args) > 0 {
+		args = args[1:] // every method takes a context first
+	}
+	m.callsMu.Lock()
+	m.calls = append(m.calls, Call{Method: method, Args: args})
+	m.callsMu.Unlock()
+}
+
+// Calls returns the calls made so far, in order.
+func (m *Mock) Calls() []Call {
+	m.callsMu.Lock()
+	defer m.callsMu.Unlock()
+	return append([]Call(nil), m.calls...)
+}
+
+// Called returns how many times the method was called.
+func (m *Mock) Called(method string) int {
+	m.callsMu.Lock()
+	defer m.callsMu.Unlock()
+	n := 0
+	for _, call := range m.calls {
+		if call.Method == method {
+			n++
+		}
+	}
+	return n
+}
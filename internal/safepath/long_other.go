@@ -0,0 +1,8 @@
+//go:build !windows
+
+package safepath
+
+// Long returns path as it is, only Windows limits the length of paths.
+func Long(path string) string {
+	return path
+}
@@ -0,0 +1,28 @@
+//go:build windows
+
+package safepath
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// maxPath is the longest path the Windows API accepts without the \\?\ prefix, less the 12
+// characters left for an 8.3 file name in the directories created.
+const maxPath = 260 - 12
+
+// Long returns path in the form Windows accepts past MAX_PATH (260 characters): absolute with
+// the \\?\ prefix, \\?\UNC\ for shares. Shorter paths are returned as they are.
+func Long(path string) string {
+	if len(path) < maxPath || strings.HasPrefix(path, `\\?\`) {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
@@ -0,0 +1,89 @@
+// Package safepath makes the names of the files kept on the disk valid on every OS: the files of
+// the downloads, the entries of extracted archives and what is moved to the quarantine and
+// archive directories. Names are sanitized the same on all of them, so a file gets the same
+// name on Linux as on Windows.
+package safepath
+
+import (
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxNameBytes is the longest name of a file most file systems accept.
+const MaxNameBytes = 255
+
+// reservedChars are not allowed in Windows file names, nor are control characters.
+const reservedChars = `<>:"/\|?*`
+
+// reservedNames are the Windows device names, reserved with any extension (e.g. nul.txt).
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true, "CONIN$": true, "CONOUT$": true,
+	"COM0": true, "COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT0": true, "LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// Name returns name as a valid file name: reserved and control characters are replaced with
+// an underscore, trailing dots and spaces (which Windows drops) are removed, device names are
+// prefixed with an underscore and names longer than MaxNameBytes are cut, keeping their
+// extension. Names left empty, "." and ".." become "_".
+func Name(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(reservedChars, r) || r == utf8.RuneError {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimRight(name, ". ")
+	if name == "" {
+		return "_"
+	}
+
+	base, _, _ := strings.Cut(name, ".")
+	if reservedNames[strings.ToUpper(strings.TrimRight(base, " "))] {
+		name = "_" + name
+	}
+
+	if len(name) > MaxNameBytes {
+		ext := filepath.Ext(name)
+		if len(ext) > MaxNameBytes/2 {
+			ext = ""
+		}
+		name = truncate(name[:len(name)-len(ext)], MaxNameBytes-len(ext)) + ext
+	}
+	return name
+}
+
+// truncate cuts s to at most n bytes without splitting a character.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// Join returns the path of name in dir, with every element of name sanitized by Name. Both
+// slashes and backslashes separate the elements, as archives made on Windows use either. It
+// is false for the names that are absolute or escape dir, and those naming dir itself.
+func Join(dir string, name string) (string, bool) {
+	if strings.HasPrefix(name, "/") || strings.HasPrefix(name, `\`) || filepath.VolumeName(name) != "" {
+		return "", false
+	}
+	elems := []string{dir}
+	for _, elem := range strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' }) {
+		switch elem {
+		case ".":
+			continue
+		case "..":
+			return "", false
+		}
+		elems = append(elems, Name(elem))
+	}
+	if len(elems) == 1 {
+		return "", false
+	}
+	return filepath.Join(elems...), true
+}
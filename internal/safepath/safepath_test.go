@@ -0,0 +1,112 @@
+package safepath_test
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"example.com/internal/safepath"
+)
+
+func TestName(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "plain", in: "ubuntu-22.04.iso", want: "ubuntu-22.04.iso"},
+		{name: "unicode", in: "café 日本.pdf", want: "café 日本.pdf"},
+		{name: "dot file", in: ".bashrc", want: ".bashrc"},
+
+		{name: "device", in: "CON", want: "_CON"},
+		{name: "device lower case", in: "nul", want: "_nul"},
+		{name: "device with extension", in: "NUL.txt", want: "_NUL.txt"},
+		{name: "device with extensions", in: "com1.tar.gz", want: "_com1.tar.gz"},
+		{name: "device with trailing space", in: "AUX .log", want: "_AUX .log"},
+		{name: "device console", in: "CONOUT$", want: "_CONOUT$"},
+		{name: "device printer", in: "lpt9.doc", want: "_lpt9.doc"},
+		{name: "device prefix", in: "CONSOLE.txt", want: "CONSOLE.txt"},
+		{name: "device number", in: "COM10", want: "COM10"},
+		{name: "device in extension", in: "file.con", want: "file.con"},
+
+		{name: "reserved characters", in: `a<b>c:d"e/f\g|h?i*j`, want: "a_b_c_d_e_f_g_h_i_j"},
+		{name: "control characters", in: "a\x00b\tc\nd\x1fe\x7f", want: "a_b_c_d_e_"},
+		{name: "invalid utf-8", in: "\xffname\xfe.txt", want: "_name_.txt"},
+
+		{name: "trailing dots", in: "report...", want: "report"},
+		{name: "trailing spaces", in: "report.pdf  ", want: "report.pdf"},
+		{name: "trailing dots and spaces", in: "report. . .", want: "report"},
+		{name: "leading spaces", in: "  report", want: "  report"},
+
+		{name: "empty", in: "", want: "_"},
+		{name: "dot", in: ".", want: "_"},
+		{name: "dot dot", in: "..", want: "_"},
+		{name: "dots", in: "...", want: "_"},
+		{name: "spaces", in: "   ", want: "_"},
+
+		{name: "longest", in: strings.Repeat("a", 251) + ".txt", want: strings.Repeat("a", 251) + ".txt"},
+		{name: "too long", in: strings.Repeat("a", 300) + ".txt", want: strings.Repeat("a", 251) + ".txt"},
+		{name: "too long with extensions", in: strings.Repeat("a", 300) + ".tar.gz", want: strings.Repeat("a", 252) + ".gz"},
+		{name: "too long two byte runes", in: strings.Repeat("é", 200) + ".txt", want: strings.Repeat("é", 125) + ".txt"},
+		{name: "too long four byte runes", in: strings.Repeat("😀", 100), want: strings.Repeat("😀", 63)},
+		{name: "too long three byte runes", in: strings.Repeat("日", 100) + ".mp4", want: strings.Repeat("日", 83) + ".mp4"},
+		{name: "too long extension", in: strings.Repeat("a", 100) + "." + strings.Repeat("b", 200), want: strings.Repeat("a", 100) + "." + strings.Repeat("b", 154)},
+		{name: "too long after sanitizing", in: "CON." + strings.Repeat("a", 251), want: "_CON." + strings.Repeat("a", 250)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := safepath.Name(tt.in)
+			if got != tt.want {
+				t.Errorf("Name(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+			if len(got) > safepath.MaxNameBytes {
+				t.Errorf("Name(%q) is %d bytes long", tt.in, len(got))
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("Name(%q) = %q is not valid UTF-8", tt.in, got)
+			}
+			if again := safepath.Name(got); again != got {
+				t.Errorf("Name(%q) = %q, want it unchanged", got, again)
+			}
+		})
+	}
+}
+
+func TestJoin(t *testing.T) {
+	dir := filepath.Join("downloads", "user")
+	tests := []struct {
+		name   string
+		in     string
+		want   string
+		wantOK bool
+	}{
+		{name: "file", in: "file.txt", want: filepath.Join(dir, "file.txt"), wantOK: true},
+		{name: "nested", in: "a/b/file.txt", want: filepath.Join(dir, "a", "b", "file.txt"), wantOK: true},
+		{name: "backslashes", in: `a\b\file.txt`, want: filepath.Join(dir, "a", "b", "file.txt"), wantOK: true},
+		{name: "current directory", in: "./a/./file.txt", want: filepath.Join(dir, "a", "file.txt"), wantOK: true},
+		{name: "repeated slashes", in: "a//file.txt/", want: filepath.Join(dir, "a", "file.txt"), wantOK: true},
+		{name: "elements sanitized", in: "CON/b. /c:d/nul.txt", want: filepath.Join(dir, "_CON", "b", "c_d", "_nul.txt"), wantOK: true},
+		{name: "dots element", in: "a/.../file.txt", want: filepath.Join(dir, "a", "_", "file.txt"), wantOK: true},
+		{name: "long element", in: "a/" + strings.Repeat("日", 100) + ".mp4", want: filepath.Join(dir, "a", strings.Repeat("日", 83)+".mp4"), wantOK: true},
+
+		{name: "parent", in: "..", wantOK: false},
+		{name: "traversal", in: "../etc/passwd", wantOK: false},
+		{name: "traversal backslashes", in: `..\..\windows\system32`, wantOK: false},
+		{name: "traversal inside", in: "a/../../etc/passwd", wantOK: false},
+		{name: "traversal staying inside", in: "a/b/../c", wantOK: false},
+		{name: "absolute", in: "/etc/passwd", wantOK: false},
+		{name: "absolute backslash", in: `\windows\system32`, wantOK: false},
+		{name: "empty", in: "", wantOK: false},
+		{name: "dir itself", in: ".", wantOK: false},
+		{name: "dir itself with slashes", in: "./", wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := safepath.Join(dir, tt.in)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("Join(%q, %q) = %q, %t, want %q, %t", dir, tt.in, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
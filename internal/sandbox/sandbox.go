@@ -0,0 +1,63 @@
+// Package sandbox runs user scripts confined to a file: without network, with a read-only
+// view of the system binaries and libraries, the file and a scratch directory, and a time limit.
+package sandbox
+
+import (
+	"bytes"
+	"errors"
+	"time"
+)
+
+// MaxOutputBytes bounds the output kept of a script, the rest is dropped.
+const MaxOutputBytes = 64 << 10 // 64KB
+
+// WorkDir is where the file is found inside the sandbox. The script may write next to it,
+// what it writes is discarded.
+const WorkDir = "/work"
+
+// Shell runs the scripts, with the path of the file as $1.
+const Shell = "/bin/sh"
+
+// Limits of a script run.
+type Limits struct {
+	Timeout        time.Duration // the script is killed with everything it started after it
+	MaxProcesses   int64         // processes of the script at once
+	MaxMemoryBytes int64         // address space of every process of the script
+}
+
+var ErrUnsupported = errors.New("sandboxed scripts are not supported on this platform")
+
+// Result of a script run. ExitCode is -1 when the script was killed.
+type Result struct {
+	ExitCode int    `json:"exit_code"`
+	TimedOut bool   `json:"timed_out"`
+	Output   string `json:"output"` // stdout and stderr, interleaved
+	Duration int64  `json:"duration_ms"`
+}
+
+// limitedBuffer keeps the first MaxOutputBytes written to it.
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if left := MaxOutputBytes - b.buf.Len(); len(p) > left {
+		b.buf.Write(p[:left])
+		b.truncated = true
+	} else {
+		b.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	if b.truncated {
+		return b.buf.String() + "\n[output truncated]"
+	}
+	return b.buf.String()
+}
+
+func elapsed(start time.Time) int64 {
+	return time.Since(start).Milliseconds()
+}
@@ -0,0 +1,258 @@
+//go:build linux
+
+package sandbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// initArg is the name Run starts the executable with, for Init to set up the sandbox.
+const initArg = "sandbox-init"
+
+// readOnlyDirs are bound read-only into the sandbox when they exist, or copied when they are
+// symbolic links (e.g. /bin to usr/bin).
+var readOnlyDirs = []string{"/bin", "/sbin", "/usr", "/lib", "/lib32", "/lib64"}
+
+// Constants of prctl(2) and capset(2) missing from package syscall.
+const (
+	prCapBSetDrop           = 24
+	prSetNoNewPrivs         = 38
+	rlimitNproc             = 6 // 8 on MIPS, which is not supported
+	linuxCapabilityVersion3 = 0x20080522
+)
+
+var devices = []string{"/dev/null", "/dev/zero", "/dev/random", "/dev/urandom"}
+
+// Run runs the script with Shell and the path of the file as $1, in new user, mount, network,
+// PID, IPC and UTS namespaces: it sees the system binaries and libraries and the file read-only,
+// has no network but loopback, and is killed with everything it started after limits.Timeout.
+// Its processes and their memory are limited with rlimits. An error means that the script could
+// not be started.
+func Run(ctx context.Context, script string, file string, limits Limits) (Result, error) {
+	file, err := filepath.Abs(file)
+	if err != nil {
+		return Result{}, err
+	}
+	root, err := os.MkdirTemp("", "sandbox-")
+	if err != nil {
+		return Result{}, fmt.Errorf("could not create sandbox root: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	ctx, cancel := context.WithTimeout(ctx, limits.Timeout)
+	defer cancel()
+
+	var output limitedBuffer
+	cmd := exec.CommandContext(ctx, "/proc/self/exe")
+	cmd.Args = []string{initArg, root, file, script, strconv.FormatInt(limits.MaxProcesses, 10), strconv.FormatInt(limits.MaxMemoryBytes, 10)}
+	cmd.Env = []string{"PATH=/usr/local/bin:/usr/bin:/bin:/usr/sbin:/sbin", "HOME=" + WorkDir, "TMPDIR=" + WorkDir}
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.WaitDelay = time.Second
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWNET | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+		Pdeathsig:   syscall.SIGKILL,
+	}
+
+	start := time.Now()
+	err = cmd.Run()
+	result := Result{
+		ExitCode: -1,
+		TimedOut: errors.Is(ctx.Err(), context.DeadlineExceeded),
+		Output:   output.String(),
+		Duration: elapsed(start),
+	}
+	if cmd.ProcessState != nil {
+		result.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return result, fmt.Errorf("could not run script: %v", err)
+	}
+	return result, nil
+}
+
+// Init turns the process into the sandbox of Run when it was started by Run, and returns at
+// once otherwise. It must be called first thing in main.
+func Init() {
+	if len(os.Args) != 6 || os.Args[0] != initArg {
+		return
+	}
+	root, file, script := os.Args[1], os.Args[2], os.Args[3]
+	maxProcesses, _ := strconv.ParseUint(os.Args[4], 10, 64)
+	maxMemoryBytes, _ := strconv.ParseUint(os.Args[5], 10, 64)
+
+	// Capabilities are per thread, the shell is executed from the one that dropped them.
+	runtime.LockOSThread()
+	if err := setup(root, file); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+		os.Exit(125)
+	}
+	if err := dropCapabilities(); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: could not drop capabilities: %v\n", err)
+		os.Exit(125)
+	}
+	// Set without CAP_SYS_RESOURCE, so the script cannot raise them again. The processes are
+	// counted in the user namespace of the sandbox (Linux 5.14 and later).
+	if err := setLimit(rlimitNproc, maxProcesses); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: could not limit processes: %v\n", err)
+		os.Exit(125)
+	}
+	if err := setLimit(syscall.RLIMIT_AS, maxMemoryBytes); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: could not limit memory: %v\n", err)
+		os.Exit(125)
+	}
+	err := syscall.Exec(Shell, []string{"sh", "-c", script, "sh", path.Join(WorkDir, filepath.Base(file))}, os.Environ())
+	fmt.Fprintf(os.Stderr, "sandbox: could not start %s: %v\n", Shell, err)
+	os.Exit(127)
+}
+
+// setup builds the file system of the sandbox on a tmpfs mounted at root, then makes it the
+// root of the mount namespace.
+func setup(root string, file string) error {
+	if err := syscall.Mount("", "/", "", syscall.MS_PRIVATE|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("could not make the mounts private: %v", err)
+	}
+	if err := syscall.Mount("tmpfs", root, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "size=64m,mode=0755"); err != nil {
+		return fmt.Errorf("could not mount the root: %v", err)
+	}
+
+	for _, dir := range readOnlyDirs {
+		info, err := os.Lstat(dir)
+		if err != nil {
+			continue
+		}
+		target := filepath.Join(root, dir)
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err := os.Readlink(dir)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.Mkdir(target, 0755); err != nil {
+			return err
+		}
+		if err := bind(dir, target, true); err != nil {
+			return err
+		}
+	}
+
+	for _, dir := range []string{"/dev", "/proc", "/tmp", WorkDir} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0777); err != nil {
+			return err
+		}
+	}
+	for _, device := range devices {
+		if err := bindFile(device, filepath.Join(root, device), false); err != nil {
+			return err
+		}
+	}
+	// Refused where the /proc of the host has masked entries, as in most containers; the
+	// scripts rarely need it.
+	syscall.Mount("proc", filepath.Join(root, "/proc"), "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+	if err := bindFile(file, filepath.Join(root, WorkDir, filepath.Base(file)), true); err != nil {
+		return err
+	}
+
+	old := filepath.Join(root, ".old")
+	if err := os.Mkdir(old, 0700); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(root, old); err != nil {
+		return fmt.Errorf("could not change the root: %v", err)
+	}
+	if err := syscall.Unmount("/.old", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("could not unmount the old root: %v", err)
+	}
+	if err := os.Remove("/.old"); err != nil {
+		return err
+	}
+	return os.Chdir(WorkDir)
+}
+
+// dropCapabilities leaves the script the rights of an unprivileged user: the user namespace
+// maps it to the user of the process, as root of the namespace, whose capabilities would let
+// it undo the mounts, e.g. remount the system directories writable.
+func dropCapabilities() error {
+	for capability := uintptr(0); ; capability++ {
+		_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapBSetDrop, capability, 0)
+		if errno == syscall.EINVAL {
+			break // past the last capability of the kernel
+		}
+		if errno != 0 {
+			return errno
+		}
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return errno
+	}
+
+	header := struct {
+		version uint32
+		pid     int32
+	}{version: linuxCapabilityVersion3}
+	var data [2]struct {
+		effective   uint32
+		permitted   uint32
+		inheritable uint32
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setLimit sets the soft and hard limit of the resource, 0 leaves it unlimited.
+func setLimit(resource int, limit uint64) error {
+	if limit == 0 {
+		return nil
+	}
+	return syscall.Setrlimit(resource, &syscall.Rlimit{Cur: limit, Max: limit})
+}
+
+func bindFile(source string, target string, readOnly bool) error {
+	f, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return bind(source, target, readOnly)
+}
+
+// bind mounts source at target. A read-only bind is remounted with the flags of the mount of
+// source that a user namespace cannot clear, e.g. nosuid, or the kernel refuses the remount.
+func bind(source string, target string, readOnly bool) error {
+	if err := syscall.Mount(source, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("could not bind %s: %v", source, err)
+	}
+	if !readOnly {
+		return nil
+	}
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(target, &stat); err != nil {
+		return err
+	}
+	locked := uintptr(stat.Flags) & (syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC | syscall.MS_NOATIME | syscall.MS_NODIRATIME | syscall.MS_RELATIME)
+	if err := syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|locked, ""); err != nil {
+		return fmt.Errorf("could not make %s read-only: %v", source, err)
+	}
+	return nil
+}
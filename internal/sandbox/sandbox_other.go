@@ -0,0 +1,15 @@
+//go:build !linux
+
+package sandbox
+
+import (
+	"context"
+)
+
+// Run fails with ErrUnsupported, the sandbox needs the namespaces of Linux.
+func Run(ctx context.Context, script string, file string, limits Limits) (Result, error) {
+	return Result{}, ErrUnsupported
+}
+
+// Init does nothing.
+func Init() {}
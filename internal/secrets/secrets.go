@@ -0,0 +1,80 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+const KeySize = 32 // AES-256
+
+var ErrNoKey = errors.New("no encryption key is configured")
+
+type box struct {
+	aead cipher.AEAD // nil without a key
+	_    struct{}
+}
+
+// Box encrypts secrets (e.g. credentials of remote origins) before they are stored.
+type Box interface {
+	// Seal encrypts plaintext into a printable string
+	Seal(plaintext []byte) (string, error)
+	// Open decrypts a string produced by Seal
+	Open(sealed string) ([]byte, error)
+}
+
+func (b *box) Seal(plaintext []byte) (string, error) {
+	if b.aead == nil {
+		return "", ErrNoKey
+	}
+
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b.aead.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+func (b *box) Open(sealed string) ([]byte, error) {
+	if b.aead == nil {
+		return nil, ErrNoKey
+	}
+
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sealed secret: %v", err)
+	}
+	if len(data) < b.aead.NonceSize() {
+		return nil, fmt.Errorf("invalid sealed secret: too short")
+	}
+	nonce, ciphertext := data[:b.aead.NonceSize()], data[b.aead.NonceSize():]
+	plaintext, err := b.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt secret: %v", err)
+	}
+	return plaintext, nil
+}
+
+// New returns a box using AES-GCM with the key, which must be KeySize bytes long.
+// Without a key every operation fails with ErrNoKey.
+func New(key []byte) (Box, error) {
+	if len(key) == 0 {
+		return &box{}, nil
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, got %d", KeySize, len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &box{aead: aead}, nil
+}
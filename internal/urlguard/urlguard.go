@@ -0,0 +1,149 @@
+package urlguard
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// Schemes are the schemes links may use.
+var Schemes = []string{"http", "https", "ftp", "sftp", "magnet", "oci", "maven", "npm"}
+
+// reservedPrefixes are not public but not covered by the netip.Addr predicates either.
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // "this network", 0.x.x.x reaches the host itself on Linux
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("64:ff9b::/96"),  // NAT64, embeds any IPv4 address
+}
+
+type guard struct {
+	allowedDomains []string
+	blockedDomains []string
+	allowPrivate   bool
+	resolver       *net.Resolver
+	_              struct{}
+}
+
+type Guard interface {
+	// ValidateLink checks the scheme and domain of the link and that its host resolves to public addresses only.
+	ValidateLink(ctx context.Context, link string) error
+	// ValidateURL checks the scheme and domain of an already parsed URL, e.g. a redirect target,
+	// and that its host is not a non-public IP address. Host names are not resolved.
+	ValidateURL(u *url.URL) error
+	// Control can be used as net.Dialer.Control to refuse connecting to non-public addresses,
+	// which also covers redirects and DNS rebinding between validation and download.
+	Control(network string, address string, _ syscall.RawConn) error
+}
+
+func (g *guard) ValidateLink(ctx context.Context, link string) error {
+	u, err := url.Parse(link)
+	if err != nil {
+		return fmt.Errorf("invalid link: %v", err)
+	}
+	if err := g.ValidateURL(u); err != nil {
+		return err
+	}
+	if u.Scheme == "magnet" {
+		return nil // peers are found through the swarm, the engine refuses non-public ones itself
+	}
+
+	addrs, err := g.resolver.LookupNetIP(ctx, "ip", u.Hostname())
+	if err != nil {
+		return fmt.Errorf("could not resolve host %s", u.Hostname())
+	}
+	for _, addr := range addrs {
+		if err := g.checkAddr(addr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (g *guard) ValidateURL(u *url.URL) error {
+	if !slices.Contains(Schemes, u.Scheme) {
+		return fmt.Errorf("unsupported scheme %q, only %s are allowed", u.Scheme, strings.Join(Schemes, ", "))
+	}
+	if u.Scheme == "magnet" {
+		// A magnet link has no host, so it cannot be checked against the domain lists.
+		if len(g.allowedDomains) > 0 {
+			return fmt.Errorf("magnet links are not allowed when only some domains are")
+		}
+		if !strings.HasPrefix(u.Query().Get("xt"), "urn:btih:") {
+			return fmt.Errorf("magnet link has no info hash")
+		}
+		return nil
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "" {
+		return fmt.Errorf("link has no host")
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if err := g.checkAddr(addr); err != nil {
+			return err
+		}
+	}
+	if matchDomain(g.blockedDomains, host) {
+		return fmt.Errorf("domain %s is blocked", host)
+	}
+	if len(g.allowedDomains) > 0 && !matchDomain(g.allowedDomains, host) {
+		return fmt.Errorf("domain %s is not allowed", host)
+	}
+
+	return nil
+}
+
+func (g *guard) Control(network string, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid address %s: %v", address, err)
+	}
+	return g.checkAddr(addrPort.Addr())
+}
+
+func (g *guard) checkAddr(addr netip.Addr) error {
+	if g.allowPrivate {
+		return nil
+	}
+
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() {
+		return fmt.Errorf("address %s is not public", addr)
+	}
+	for _, prefix := range reservedPrefixes {
+		if prefix.Contains(addr) {
+			return fmt.Errorf("address %s is not public", addr)
+		}
+	}
+
+	return nil
+}
+
+// matchDomain reports whether host is one of the domains or a subdomain of one of them.
+func matchDomain(domains []string, host string) bool {
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func New(allowedDomains []string, blockedDomains []string, allowPrivate bool) Guard {
+	return &guard{
+		allowedDomains: allowedDomains,
+		blockedDomains: blockedDomains,
+		allowPrivate:   allowPrivate,
+		resolver:       net.DefaultResolver,
+	}
+}
@@ -0,0 +1,31 @@
+package version
+
+import (
+	"runtime/debug"
+	"time"
+)
+
+// Version and Commit are set at build time:
+//
+//	go build -ldflags "-X example.com/internal/version.Version=1.2.0 -X example.com/internal/version.Commit=$(git rev-parse HEAD)"
+var Version = "dev"
+var Commit = ""
+
+// StartedAt is when the process started.
+var StartedAt = time.Now()
+
+// Revision returns Commit, or else the VCS revision go build embeds when building from a
+// checkout.
+func Revision() string {
+	if Commit != "" {
+		return Commit
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+	return "unknown"
+}
@@ -2,88 +2,401 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 
+	"example.com/internal/coldstore"
+	"example.com/internal/config"
 	"example.com/internal/consumer"
+	"example.com/internal/flags"
 	"example.com/internal/handler"
+	"example.com/internal/httpclient"
+	"example.com/internal/jwtkeys"
+	"example.com/internal/mailer"
+	"example.com/internal/metrics"
+	"example.com/internal/openapi"
+	"example.com/internal/outbox"
+	"example.com/internal/pipeline"
+	"example.com/internal/proxy"
 	"example.com/internal/repository"
+	"example.com/internal/sandbox"
+	"example.com/internal/secrets"
+	"example.com/internal/urlguard"
 	"github.com/gofiber/fiber/v3"
-	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/redis/go-redis/v9"
 )
 
 type Server struct {
 	rdb *redis.Client
-	db  *pgx.Conn
+	db  *pgxpool.Pool
 	_   struct{}
 }
 
-func NewServer() *Server {
+// NewServer connects to Redis and Postgres, and exits unless both answer before
+// cfg.StartupTimeout or the cancellation of ctx.
+func NewServer(ctx context.Context, cfg *config.Config) *Server {
+	ctx, cancel := context.WithTimeout(ctx, cfg.StartupTimeout)
+	defer cancel()
+
 	redisDB, err := strconv.Atoi(os.Getenv("REDIS_DB"))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Invalid redis db: %v\n", err)
 		os.Exit(1)
 	}
 
-	rdb := redis.NewClient(&redis.Options{
+	redisOptions := &redis.Options{
 		Addr:     os.Getenv("REDIS_HOST"),
 		Password: os.Getenv("REDIS_PASS"),
 		DB:       redisDB,
-	})
+	}
+	// The client adds the block time of blocking commands to their read timeout.
+	if cfg.QueryTimeout > 0 {
+		redisOptions.ReadTimeout = cfg.QueryTimeout
+		redisOptions.WriteTimeout = cfg.QueryTimeout
+	}
+	rdb := redis.NewClient(redisOptions)
 
-	// TODO ctx deadline
-	_, err = rdb.Ping(context.Background()).Result()
+	_, err = rdb.Ping(ctx).Result()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Unable to connect to cache: %v\n", err)
 		os.Exit(1)
 	}
 	log.Println("Cache connected.")
 
-	// TODO ctx deadline
-	conn, err := pgx.Connect(context.Background(), os.Getenv("DATABASE_URL"))
+	poolConfig, err := pgxpool.ParseConfig(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid database url: %v\n", err)
+		os.Exit(1)
+	}
+	// connect_timeout and statement_timeout in the url take precedence.
+	if poolConfig.ConnConfig.ConnectTimeout == 0 {
+		poolConfig.ConnConfig.ConnectTimeout = cfg.StartupTimeout
+	}
+	if _, ok := poolConfig.ConnConfig.RuntimeParams["statement_timeout"]; !ok && cfg.QueryTimeout > 0 {
+		poolConfig.ConnConfig.RuntimeParams["statement_timeout"] = strconv.FormatInt(cfg.QueryTimeout.Milliseconds(), 10)
+	}
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Unable to connect to database: %v\n", err)
 		os.Exit(1)
 	}
+	// The pool connects lazily, fail early like the cache does.
+	if err := pool.Ping(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect to database: %v\n", err)
+		os.Exit(1)
+	}
 	log.Println("Database connected.")
 
 	return &Server{
 		rdb: rdb,
-		db:  conn,
+		db:  pool,
 	}
 }
 
 func main() {
+	sandbox.Init()
+
 	secretKey := os.Getenv("SECRET_KEY")
 	if secretKey == "" {
 		fmt.Fprintf(os.Stderr, "Invalid secret key\n")
 	}
 
-	server := NewServer()
-	// TODO ctx deadline
-	ctx := context.Background()
-	defer server.db.Close(ctx)
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config: %v\n", err)
+		os.Exit(1)
+	}
+	// --mode takes precedence over MODE, so one image can run every kind of process.
+	mode := flag.String("mode", cfg.Mode, "what the process runs: api, worker or all")
+	flag.Parse()
+	if cfg.Mode, err = config.ParseMode(*mode); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid mode: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	server := NewServer(ctx, cfg)
+	defer server.db.Close()
 	defer server.rdb.Close()
 
-	repo := repository.New(server.db, server.rdb)
-	h := handler.New(repo)
-	app := fiber.New()
+	queue := repository.NewRedisQueue(server.rdb)
+	if cfg.QueueBackend == config.QueueBackendNATS {
+		connectCtx, cancel := context.WithTimeout(ctx, cfg.StartupTimeout)
+		queue, err = repository.NewNATSQueue(connectCtx, cfg.NATSURL, cfg.NATSStream, cfg.NATSMaxDeliver)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to connect to queue: %v\n", err)
+			os.Exit(1)
+		}
+		log.Println("Queue connected.")
+	}
+	repo := repository.New(server.db, server.rdb, queue)
+	guard := urlguard.New(cfg.AllowedDomains, cfg.BlockedDomains, cfg.AllowPrivateNetworks)
+	client, err := httpclient.New(cfg, guard)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid http client config: %v\n", err)
+		os.Exit(1)
+	}
+	box, err := secrets.New(cfg.CredentialsKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid credentials key: %v\n", err)
+		os.Exit(1)
+	}
+	cold, err := coldstore.New(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid cold storage config: %v\n", err)
+		os.Exit(1)
+	}
+	steps, err := pipeline.New(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid pipeline config: %v\n", err)
+		os.Exit(1)
+	}
+	mail, err := mailer.New(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid mail config: %v\n", err)
+		os.Exit(1)
+	}
+	keys, err := jwtkeys.New(secretKey, cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid secret key: %v\n", err)
+		os.Exit(1)
+	}
+	gates := flags.New(repo)
+	var c consumer.Consumer // nil in the API processes, their downloads are run by the worker processes
+	if cfg.Mode != config.ModeAPI {
+		c = consumer.Start(ctx, repo, cfg, client, httpclient.NewDialer(cfg, guard), box, cold, gates, steps, int(cfg.NumWorkers))
+	}
+	pressure := outbox.NewPressure(repo, cfg.RedisMaxMemoryBytes, cfg.QueueMaxLength)
+	go pressure.Watch(ctx, cfg.QueuePressureInterval)
+	h := handler.New(repo, cfg, guard, proxy.New(repo, cfg, client), c, box, cold, gates, pressure, steps, mail)
+	app := fiber.New(fiber.Config{ErrorHandler: handler.ErrorHandler})
 
 	authMiddleware := func(c fiber.Ctx) error {
-		return handler.AuthMiddleware(c, secretKey)
+		return handler.AuthMiddleware(c, keys, repo)
 	}
 
-	app.Get("/downloads/", h.GetDownloadRequests, authMiddleware)
-	app.Post("/downloads/", h.CreateDownloadRequest, authMiddleware)
-	app.Post("/register/", h.Register)
-	app.Post("/login/", func(c fiber.Ctx) error { return h.Login(c, secretKey) })
+	adminMiddleware := func(c fiber.Ctx) error {
+		return handler.AdminMiddleware(c, repo)
+	}
+	registerRateLimit := func(c fiber.Ctx) error {
+		return handler.RateLimitMiddleware(c, repo, handler.IPRateLimitKey(c, "register"), cfg.AuthRateLimit, cfg.RateLimitWindow)
+	}
+	loginRateLimit := func(c fiber.Ctx) error {
+		return handler.RateLimitMiddleware(c, repo, handler.IPRateLimitKey(c, "login"), cfg.AuthRateLimit, cfg.RateLimitWindow)
+	}
+	passwordResetRateLimit := func(c fiber.Ctx) error {
+		return handler.RateLimitMiddleware(c, repo, handler.IPRateLimitKey(c, "password-reset"), cfg.AuthRateLimit, cfg.RateLimitWindow)
+	}
+	verifyEmailRateLimit := func(c fiber.Ctx) error {
+		return handler.RateLimitMiddleware(c, repo, handler.IPRateLimitKey(c, "verify-email"), cfg.AuthRateLimit, cfg.RateLimitWindow)
+	}
+	hookMiddleware := func(c fiber.Ctx) error {
+		return handler.HookMiddleware(c, repo)
+	}
+	hookRateLimit := func(c fiber.Ctx) error {
+		limit := c.Locals("hook").(repository.Hook).RateLimit
+		return handler.RateLimitMiddleware(c, repo, handler.HookRateLimitKey(c), limit, cfg.RateLimitWindow)
+	}
+	idempotency := func(c fiber.Ctx) error {
+		return handler.IdempotencyMiddleware(c, repo, cfg.IdempotencyKeyTTL)
+	}
+	downloadsRateLimit := func(c fiber.Ctx) error {
+		return handler.RateLimitMiddleware(c, repo, handler.UserRateLimitKey(c, "downloads"), cfg.DownloadsRateLimit, cfg.RateLimitWindow)
+	}
 
-	consumer.Start(ctx, repo, 3)
+	// The worker processes serve only the probes, the version and the metrics.
+	app.Get("/healthz", h.Healthz)
+	app.Get("/readyz", h.Readyz)
+	app.Get("/version", h.Version)
+	app.Get("/metrics", metrics.Handler, authMiddleware, adminMiddleware)
+	if cfg.Mode != config.ModeWorker {
+		app.Use(func(c fiber.Ctx) error {
+			return handler.AuditMiddleware(c, repo)
+		})
+		app.Get("/downloads/", h.GetDownloadRequests, authMiddleware, downloadsRateLimit)
+		app.Post("/downloads/", h.CreateDownloadRequest, authMiddleware, downloadsRateLimit, idempotency)
+		app.Post("/downloads/batch", h.CreateDownloadRequests, authMiddleware, idempotency) // rate limited per link
+		app.Get("/downloads/export", h.ExportDownloadRequests, authMiddleware, downloadsRateLimit)
+		app.Get("/downloads/:id/events", h.WatchDownload, authMiddleware, downloadsRateLimit)
+		app.Get("/downloads/:id/debug", h.GetDownloadDebug, authMiddleware, downloadsRateLimit)
+		app.Get("/downloads/:id/pipeline", h.GetDownloadPipeline, authMiddleware, downloadsRateLimit)
+		app.Patch("/downloads/:id", h.UpdateDownloadRequest, authMiddleware, downloadsRateLimit)
+		app.Post("/downloads/:id/cancel", h.CancelDownloadRequest, authMiddleware, downloadsRateLimit)
+		app.Post("/downloads/:id/retry", h.RetryDownloadRequest, authMiddleware, downloadsRateLimit)
+		app.Get("/downloads/:id/file", h.GetDownloadFile, authMiddleware, downloadsRateLimit)
+		app.Get("/downloads/:id/thumbnail", h.GetDownloadThumbnail, authMiddleware, downloadsRateLimit)
+		app.Post("/downloads/:id/restore", h.RestoreDownloadFile, authMiddleware, downloadsRateLimit)
+		app.Delete("/downloads/:id", h.DeleteDownloadRequest, authMiddleware, downloadsRateLimit)
+		app.Get("/account/usage", h.GetUsage, authMiddleware)
+		app.Patch("/account/password", func(c fiber.Ctx) error { return h.ChangePassword(c, keys) }, authMiddleware)
+		app.Delete("/account", h.DeleteAccount, authMiddleware)
+		app.Put("/account/email", h.SetEmail, authMiddleware)
+		app.Get("/account/sessions", h.GetSessions, authMiddleware)
+		app.Delete("/account/sessions/:id", h.DeleteSession, authMiddleware)
+		app.Get("/notifications", h.GetNotifications, authMiddleware)
+		app.Get("/proxy", h.Proxy, authMiddleware)
+		app.Get("/fetch", h.Fetch, authMiddleware)
+		app.Get("/admin/cache-policies", h.GetCachePolicies, authMiddleware, adminMiddleware)
+		app.Post("/admin/cache-policies", h.CreateCachePolicy, authMiddleware, adminMiddleware)
+		app.Delete("/admin/cache-policies/:id", h.DeleteCachePolicy, authMiddleware, adminMiddleware)
+		app.Get("/admin/flags", h.GetFeatureFlags, authMiddleware, adminMiddleware)
+		app.Put("/admin/flags/:name", h.SetFeatureFlag, authMiddleware, adminMiddleware)
+		app.Delete("/admin/flags/:name", h.DeleteFeatureFlag, authMiddleware, adminMiddleware)
+		app.Get("/admin/workers", h.GetWorkers, authMiddleware, adminMiddleware)
+		app.Put("/admin/workers", h.ScaleWorkers, authMiddleware, adminMiddleware)
+		app.Get("/admin/workers/live", h.GetLiveWorkers, authMiddleware, adminMiddleware)
+		app.Get("/admin/volumes", h.GetVolumes, authMiddleware, adminMiddleware)
+		app.Get("/admin/processes", h.GetProcesses, authMiddleware, adminMiddleware)
+		app.Get("/admin/users", h.GetUsers, authMiddleware, adminMiddleware)
+		app.Get("/admin/users/:id", h.GetUser, authMiddleware, adminMiddleware)
+		app.Post("/admin/users/:id/disable", h.DisableUser, authMiddleware, adminMiddleware)
+		app.Post("/admin/users/:id/enable", h.EnableUser, authMiddleware, adminMiddleware)
+		app.Post("/admin/users/:id/password-reset", h.RequirePasswordReset, authMiddleware, adminMiddleware)
+		app.Put("/admin/users/:id/retention", h.SetUserRetention, authMiddleware, adminMiddleware)
+		app.Put("/admin/organizations/:id/limits", h.SetOrganizationLimits, authMiddleware, adminMiddleware)
+		app.Get("/admin/queue/timeline", h.GetQueueTimeline, authMiddleware, adminMiddleware)
+		app.Get("/admin/dashboard", h.GetDashboard, authMiddleware, adminMiddleware)
+		app.Get("/admin/failures", h.GetFailures, authMiddleware, adminMiddleware)
+		app.Get("/admin/audit", h.GetAuditLog, authMiddleware, adminMiddleware)
+		app.Get("/hooks", h.GetHooks, authMiddleware)
+		app.Post("/hooks", h.CreateHook, authMiddleware)
+		app.Delete("/hooks/:id", h.DeleteHook, authMiddleware)
+		app.Post("/hooks/:token", h.TriggerHook, hookMiddleware, hookRateLimit)
+		app.Get("/scripts", h.GetCompletionScripts, authMiddleware)
+		app.Post("/scripts", h.CreateCompletionScript, authMiddleware)
+		app.Delete("/scripts/:id", h.DeleteCompletionScript, authMiddleware)
+		app.Get("/origin-profiles", h.GetOriginProfiles, authMiddleware)
+		app.Post("/origin-profiles", h.CreateOriginProfile, authMiddleware)
+		app.Delete("/origin-profiles/:id", h.DeleteOriginProfile, authMiddleware)
+		app.Get("/folders", h.GetFolders, authMiddleware)
+		app.Post("/folders", h.CreateFolder, authMiddleware)
+		app.Patch("/folders/:id", h.UpdateFolder, authMiddleware)
+		app.Delete("/folders/:id", h.DeleteFolder, authMiddleware)
+		app.Get("/collections", h.GetCollections, authMiddleware)
+		app.Post("/collections", h.CreateCollection, authMiddleware)
+		app.Delete("/collections/:id", h.DeleteCollection, authMiddleware)
+		app.Post("/collections/:id/downloads", h.AddToCollection, authMiddleware)
+		app.Delete("/collections/:id/downloads/:download_id", h.RemoveFromCollection, authMiddleware)
+		app.Get("/collections/:id/progress", h.GetCollectionProgress, authMiddleware)
+		app.Get("/collections/:id/members", h.GetCollectionMembers, authMiddleware)
+		app.Put("/collections/:id/members", h.SetCollectionMember, authMiddleware)
+		app.Delete("/collections/:id/members/:user_id", h.RemoveCollectionMember, authMiddleware)
+		app.Get("/organizations", h.GetOrganizations, authMiddleware)
+		app.Post("/organizations", h.CreateOrganization, authMiddleware)
+		app.Get("/organizations/:id", h.GetOrganization, authMiddleware)
+		app.Delete("/organizations/:id", h.DeleteOrganization, authMiddleware)
+		app.Get("/organizations/:id/usage", h.GetOrganizationUsage, authMiddleware)
+		app.Get("/organizations/:id/members", h.GetOrganizationMembers, authMiddleware)
+		app.Put("/organizations/:id/members", h.SetOrganizationMember, authMiddleware)
+		app.Delete("/organizations/:id/members/:user_id", h.RemoveOrganizationMember, authMiddleware)
+		app.Post("/graphql", h.GraphQL, authMiddleware, downloadsRateLimit)
+		app.Post("/register/", h.Register, registerRateLimit)
+		app.Post("/login/", func(c fiber.Ctx) error { return h.Login(c, keys) }, loginRateLimit)
+		app.Post("/password-reset", h.ResetPassword, passwordResetRateLimit)
+		app.Post("/password-reset/request", h.ForgotPassword, passwordResetRateLimit)
+		app.Post("/verify-email", h.VerifyEmail, verifyEmailRateLimit)
+		app.Post("/verify-email/resend", h.ResendVerificationEmail, verifyEmailRateLimit)
+		app.Get("/openapi.json", openapi.Handler)
+		app.Get("/docs", openapi.SwaggerUI("/openapi.json"))
+
+		if err := openapi.Check(app.GetRoutes(true), "/openapi.json", "/docs"); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid OpenAPI document: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if cfg.OutboxInterval > 0 {
+		go outbox.Relay(ctx, repo, cfg.OutboxInterval, pressure)
+	}
+	if cfg.StatsDAddr != "" && cfg.MetricsInterval > 0 {
+		go func() {
+			if err := metrics.PushStatsD(ctx, cfg.StatsDAddr, cfg.StatsDPrefix, cfg.MetricsInterval); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+	if cfg.RemoteWriteURL != "" && cfg.MetricsInterval > 0 {
+		go func() {
+			rw := metrics.RemoteWrite{
+				URL:         cfg.RemoteWriteURL,
+				Username:    cfg.RemoteWriteUsername,
+				Password:    cfg.RemoteWritePassword,
+				BearerToken: cfg.RemoteWriteBearerToken,
+			}
+			if err := metrics.PushRemoteWrite(ctx, rw, cfg.MetricsInterval); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+	if cfg.WorkerHeartbeatInterval > 0 {
+		go consumer.SendProcessHeartbeats(ctx, repo, cfg, c, cfg.WorkerHeartbeatInterval)
+	}
+	if cfg.WatchDir != "" && cfg.Mode != config.ModeWorker {
+		go h.WatchFolder(ctx)
+	}
+	if cfg.MetricsAddr != "" {
+		metricsApp := fiber.New()
+		metricsApp.Get("/metrics", metrics.Handler)
+		go func() {
+			<-ctx.Done()
+			if err := metricsApp.Shutdown(); err != nil {
+				log.Println(err)
+			}
+		}()
+		go func() {
+			if err := metricsApp.Listen(cfg.MetricsAddr); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+	if cfg.GRPCAddr != "" && cfg.Mode != config.ModeWorker {
+		grpcServer := h.GRPC(keys)
+		go func() {
+			<-ctx.Done()
+			// not GracefulStop, progress streams last until their downloads finish
+			grpcServer.Stop()
+		}()
+		go func() {
+			listener, err := net.Listen("tcp", cfg.GRPCAddr)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			log.Printf("Serving gRPC on %s ...\n", cfg.GRPCAddr)
+			if err := grpcServer.Serve(listener); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
 	// repo.PushDownloadRequest(ctx, 12)
 
-	log.Println("Serving ...")
-	app.Listen(":8080")
+	go func() {
+		<-ctx.Done()
+		log.Println("Shutting down ...")
+		if err := app.Shutdown(); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	log.Printf("Serving %s ...\n", cfg.Mode)
+	if err := app.Listen(cfg.HTTPAddr); err != nil {
+		log.Println(err)
+	}
+
+	stop()
+	if c == nil {
+		return
+	}
+	if err := c.Wait(); err != nil {
+		log.Println(err)
+	}
 }
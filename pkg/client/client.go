@@ -0,0 +1,491 @@
+// Package client is a Go SDK for the downloader REST API.
+//
+//	c := client.New("http://127.0.0.1:8080", client.Options{})
+//	if err := c.Login(ctx, "amiramir", "mypassword"); err != nil { ... }
+//	created, err := c.CreateDownload(ctx, client.CreateDownloadRequest{Link: "https://example.com/file.zip"})
+//	err = c.WatchDownload(ctx, created.DownloadID, func(p client.Progress) error {
+//		log.Printf("%s: %d/%d", p.Status, p.Bytes, p.TotalBytes)
+//		return nil
+//	})
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxRetries = 3
+	DefaultMinBackoff = 500 * time.Millisecond
+	DefaultMaxBackoff = 10 * time.Second
+)
+
+const (
+	StatusQueued      = "queued"
+	StatusDownloading = "downloading"
+	StatusCompleted   = "completed"
+	StatusFailed      = "failed"
+	StatusExpired     = "expired"
+)
+
+type Options struct {
+	HTTPClient *http.Client // defaults to a client with a 30s timeout, only used for non streaming calls
+	Token      string       // token of a previous Login, if any
+	MaxRetries int          // retries of failed calls, 0 means DefaultMaxRetries, -1 disables retries
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// APIError is returned for responses with an error status code.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("downloader: %d: %s", e.StatusCode, e.Message)
+}
+
+type CreateDownloadRequest struct {
+	Link     string            `json:"link"`
+	Priority int64             `json:"priority,omitempty"` // 1-10, 0 means the server default
+	Labels   map[string]string `json:"labels,omitempty"`
+	Range    string            `json:"range,omitempty"` // bytes "<first>-<last>" or "<first>-" only
+	// origin profile whose credentials authenticate the download, see POST /origin-profiles
+	OriginProfileID int64 `json:"origin_profile_id,omitempty"`
+	MaxSpeed        int64 `json:"max_speed_bytes_per_sec,omitempty"` // bytes per second, 0 means unlimited
+	// SHA256SUMS, checksum JSON or SLSA provenance listing the file, to verify it against
+	ManifestURL string `json:"manifest_url,omitempty"`
+	FolderID    int64  `json:"folder_id,omitempty"` // see POST /folders, 0 means none
+	// http(s) links of the same file to fail over to, in order, when Link fails or is slow
+	Mirrors []string `json:"mirrors,omitempty"`
+	// sent as the Idempotency-Key header, a random one is generated if empty so that the
+	// retries of the call do not create the download twice
+	IdempotencyKey string `json:"-"`
+}
+
+type CreateDownloadResponse struct {
+	DownloadID int64  `json:"download_id"`
+	Message    string `json:"message"`
+	Status     string `json:"status,omitempty"` // set when the link was already requested
+	Created    bool   `json:"-"`                // false when the link was already requested
+}
+
+// BatchResult is the outcome of a link of CreateDownloads.
+type BatchResult struct {
+	Link       string `json:"link"`
+	Result     string `json:"result"`                // created, exists or invalid
+	DownloadID int64  `json:"download_id,omitempty"` // unless invalid
+	Status     string `json:"status,omitempty"`      // of the download, unless invalid
+	Error      string `json:"error,omitempty"`       // why the link is invalid
+}
+
+type Download struct {
+	ID              int64             `json:"ID"`
+	UserID          int64             `json:"UserID"`
+	Link            string            `json:"Link"`
+	FileName        string            `json:"FileName"`
+	Completed       bool              `json:"Completed"`
+	Error           string            `json:"Error"`
+	Priority        int64             `json:"Priority"`
+	ContentHash     string            `json:"ContentHash"`
+	Status          string            `json:"Status"`
+	ExpiresAt       *time.Time        `json:"ExpiresAt"`
+	Labels          map[string]string `json:"Labels"`
+	Range           string            `json:"Range"`
+	OriginProfileID *int64            `json:"OriginProfileID"`
+	MaxSpeed        int64             `json:"MaxSpeed"`
+	ManifestURL     string            `json:"ManifestURL"`
+	// "verified", "mismatch" (the download failed), "unverified" or empty if not verified yet
+	Verification       string   `json:"Verification"`
+	VerificationDetail string   `json:"VerificationDetail"`
+	FolderID           *int64   `json:"FolderID"`
+	Mirrors            []string `json:"Mirrors"`
+	Tier               string   `json:"Tier"` // "hot", "cold" (in cold storage) or "restoring"
+}
+
+type Progress struct {
+	DownloadID int64  `json:"download_id"`
+	Status     string `json:"status"`
+	Bytes      int64  `json:"bytes"`
+	TotalBytes int64  `json:"total_bytes"` // -1 if unknown
+	Error      string `json:"error,omitempty"`
+	// torrents only
+	Pieces          int64   `json:"pieces,omitempty"`
+	PiecesCompleted int64   `json:"pieces_completed,omitempty"`
+	SeedRatio       float64 `json:"seed_ratio,omitempty"`
+	// HLS/DASH only
+	Segments          int64 `json:"segments,omitempty"`
+	SegmentsCompleted int64 `json:"segments_completed,omitempty"`
+}
+
+type client struct {
+	baseURL    string
+	httpClient *http.Client
+	stream     *http.Client // without timeout, for server-sent events
+	maxRetries int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	mu    sync.Mutex
+	token string
+	_     struct{}
+}
+
+type Client interface {
+	// Register creates a user and returns its id
+	Register(ctx context.Context, username string, password string) (int64, error)
+	// Login authenticates the following calls
+	Login(ctx context.Context, username string, password string) error
+	// Token returns the current token, e.g. to persist it
+	Token() string
+	CreateDownload(ctx context.Context, req CreateDownloadRequest) (CreateDownloadResponse, error)
+	// CreateDownloads creates the downloads of many links in one call and returns a result per
+	// link. The valid links are all queued or none is.
+	CreateDownloads(ctx context.Context, reqs []CreateDownloadRequest) ([]BatchResult, error)
+	// ListDownloads returns a page of the downloads of the user, pages start at 0
+	ListDownloads(ctx context.Context, page int, limit int) ([]Download, error)
+	// CancelDownload stops a queued or running download, an *APIError with status 409 if it
+	// has already finished
+	CancelDownload(ctx context.Context, downloadID int64) error
+	// SetMaxSpeed changes the speed limit of a download in bytes per second, 0 for unlimited;
+	// a running download applies it within 30s
+	SetMaxSpeed(ctx context.Context, downloadID int64, maxSpeed int64) (Download, error)
+	// GetFile streams the file of a completed download; files in cold storage are slower to read
+	GetFile(ctx context.Context, downloadID int64) (io.ReadCloser, error)
+	// RestoreFile asks for the file of a download in cold storage to be copied back to a disk,
+	// an *APIError with status 409 if it is not in cold storage
+	RestoreFile(ctx context.Context, downloadID int64) error
+	// WatchDownload calls fn on every progress change of the download until it is finished
+	// (completed, failed or expired), fn returns an error, or ctx is done.
+	WatchDownload(ctx context.Context, downloadID int64, fn func(Progress) error) error
+}
+
+func (c *client) Register(ctx context.Context, username string, password string) (int64, error) {
+	var resp struct {
+		UserID int64 `json:"user_id"`
+	}
+	payload := map[string]string{"username": username, "password": password}
+	if _, err := c.do(ctx, http.MethodPost, "/register/", payload, &resp); err != nil {
+		return 0, err
+	}
+	return resp.UserID, nil
+}
+
+func (c *client) Login(ctx context.Context, username string, password string) error {
+	var resp struct {
+		Token string `json:"token"`
+	}
+	payload := map[string]string{"username": username, "password": password}
+	if _, err := c.do(ctx, http.MethodPost, "/login/", payload, &resp); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.token = resp.Token
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *client) Token() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token
+}
+
+func (c *client) CreateDownload(ctx context.Context, req CreateDownloadRequest) (CreateDownloadResponse, error) {
+	var resp CreateDownloadResponse
+	if req.IdempotencyKey == "" {
+		req.IdempotencyKey = fmt.Sprintf("%016x%016x", rand.Uint64(), rand.Uint64())
+	}
+	header := http.Header{"Idempotency-Key": []string{req.IdempotencyKey}}
+	statusCode, err := c.doWithHeader(ctx, http.MethodPost, "/downloads/", header, req, &resp)
+	if err != nil {
+		return resp, err
+	}
+	resp.Created = statusCode == http.StatusCreated
+	return resp, nil
+}
+
+func (c *client) CreateDownloads(ctx context.Context, reqs []CreateDownloadRequest) ([]BatchResult, error) {
+	var resp struct {
+		Results []BatchResult `json:"results"`
+	}
+	header := http.Header{"Idempotency-Key": []string{fmt.Sprintf("%016x%016x", rand.Uint64(), rand.Uint64())}}
+	payload := map[string]any{"downloads": reqs}
+	if _, err := c.doWithHeader(ctx, http.MethodPost, "/downloads/batch", header, payload, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Results, nil
+}
+
+func (c *client) ListDownloads(ctx context.Context, page int, limit int) ([]Download, error) {
+	var resp struct {
+		Downloads []Download `json:"downloads"`
+	}
+	query := url.Values{}
+	query.Set("page", strconv.Itoa(page))
+	query.Set("limit", strconv.Itoa(limit))
+	if _, err := c.do(ctx, http.MethodGet, "/downloads/?"+query.Encode(), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Downloads, nil
+}
+
+func (c *client) CancelDownload(ctx context.Context, downloadID int64) error {
+	_, err := c.do(ctx, http.MethodPost, fmt.Sprintf("/downloads/%d/cancel", downloadID), nil, nil)
+	return err
+}
+
+func (c *client) SetMaxSpeed(ctx context.Context, downloadID int64, maxSpeed int64) (Download, error) {
+	var resp Download
+	payload := map[string]int64{"max_speed_bytes_per_sec": maxSpeed}
+	_, err := c.do(ctx, http.MethodPatch, fmt.Sprintf("/downloads/%d", downloadID), payload, &resp)
+	return resp, err
+}
+
+func (c *client) GetFile(ctx context.Context, downloadID int64) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/downloads/%d/file", c.baseURL, downloadID), nil)
+	if err != nil {
+		return nil, err
+	}
+	c.authorize(req)
+
+	resp, err := c.stream.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, readError(resp)
+	}
+	return resp.Body, nil
+}
+
+func (c *client) RestoreFile(ctx context.Context, downloadID int64) error {
+	_, err := c.do(ctx, http.MethodPost, fmt.Sprintf("/downloads/%d/restore", downloadID), nil, nil)
+	return err
+}
+
+func (c *client) WatchDownload(ctx context.Context, downloadID int64, fn func(Progress) error) error {
+	path := fmt.Sprintf("/downloads/%d/events", downloadID)
+
+	// Reconnect when the stream breaks before the download finished.
+	for attempt := 0; ; attempt++ {
+		finished, err := c.watchOnce(ctx, path, fn)
+		if finished || err == nil {
+			return err
+		}
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && !retryableStatus(apiErr.StatusCode) {
+			return err
+		}
+		if c.maxRetries >= 0 && attempt >= c.maxRetries {
+			return err
+		}
+		if err := c.sleep(ctx, attempt, 0); err != nil {
+			return err
+		}
+	}
+}
+
+// watchOnce reads one event stream. It reports whether the download finished or fn stopped it.
+func (c *client) watchOnce(ctx context.Context, path string, fn func(Progress) error) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+path, nil)
+	if err != nil {
+		return true, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	c.authorize(req)
+
+	resp, err := c.stream.Do(req)
+	if err != nil {
+		return ctx.Err() != nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, readError(resp)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	var event, data string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		case line == "":
+			if event == "progress" && data != "" {
+				var progress Progress
+				if err := json.Unmarshal([]byte(data), &progress); err != nil {
+					return true, fmt.Errorf("downloader: invalid progress event: %v", err)
+				}
+				if err := fn(progress); err != nil {
+					return true, err
+				}
+				switch progress.Status {
+				case StatusCompleted, StatusFailed, StatusExpired:
+					return true, nil
+				}
+			}
+			event, data = "", ""
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return ctx.Err() != nil, err
+	}
+	return false, io.ErrUnexpectedEOF
+}
+
+// do sends a JSON request, retrying network errors, 429 and 5xx (except 500) responses with
+// exponential backoff, and decodes the response into out. It returns the status code.
+func (c *client) do(ctx context.Context, method string, path string, payload any, out any) (int, error) {
+	return c.doWithHeader(ctx, method, path, nil, payload, out)
+}
+
+// doWithHeader is do with extra request headers. With an Idempotency-Key, a 409 (the first
+// attempt is still in progress on the server) is retried too.
+func (c *client) doWithHeader(ctx context.Context, method string, path string, header http.Header, payload any, out any) (int, error) {
+	var body []byte
+	if payload != nil {
+		var err error
+		body, err = json.Marshal(payload)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(body))
+		if err != nil {
+			return 0, err
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		if payload != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		c.authorize(req)
+
+		resp, err := c.httpClient.Do(req)
+		var retryAfter time.Duration
+		if err == nil {
+			if resp.StatusCode < 300 {
+				defer resp.Body.Close()
+				if out == nil {
+					return resp.StatusCode, nil
+				}
+				return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+			}
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+			err = readError(resp)
+			resp.Body.Close()
+			inProgress := resp.StatusCode == http.StatusConflict && header.Get("Idempotency-Key") != ""
+			if !retryableStatus(resp.StatusCode) && !inProgress {
+				return resp.StatusCode, err
+			}
+		}
+		if ctx.Err() != nil || (c.maxRetries >= 0 && attempt >= c.maxRetries) {
+			return 0, err
+		}
+		if err := c.sleep(ctx, attempt, retryAfter); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *client) authorize(req *http.Request) {
+	if token := c.Token(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// sleep waits for the backoff of the attempt (with jitter), or retryAfter if the server asked for longer.
+func (c *client) sleep(ctx context.Context, attempt int, retryAfter time.Duration) error {
+	backoff := c.minBackoff << attempt
+	if backoff <= 0 || backoff > c.maxBackoff {
+		backoff = c.maxBackoff
+	}
+	backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	if retryAfter > backoff {
+		backoff = retryAfter
+	}
+
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func retryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode == http.StatusBadGateway ||
+		statusCode == http.StatusServiceUnavailable || statusCode == http.StatusGatewayTimeout
+}
+
+func parseRetryAfter(value string) time.Duration {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func readError(resp *http.Response) error {
+	var body struct {
+		Error string `json:"error"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err := json.Unmarshal(data, &body); err != nil || body.Error == "" {
+		body.Error = strings.TrimSpace(string(data))
+	}
+	if body.Error == "" {
+		body.Error = http.StatusText(resp.StatusCode)
+	}
+	return &APIError{StatusCode: resp.StatusCode, Message: body.Error}
+}
+
+func New(baseURL string, options Options) Client {
+	c := &client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: options.HTTPClient,
+		stream:     &http.Client{},
+		maxRetries: options.MaxRetries,
+		minBackoff: options.MinBackoff,
+		maxBackoff: options.MaxBackoff,
+		token:      options.Token,
+	}
+	if c.httpClient == nil {
+		c.httpClient = &http.Client{Timeout: 30 * time.Second}
+	} else {
+		c.stream = &http.Client{Transport: c.httpClient.Transport, Jar: c.httpClient.Jar}
+	}
+	if c.maxRetries == 0 {
+		c.maxRetries = DefaultMaxRetries
+	}
+	if c.minBackoff <= 0 {
+		c.minBackoff = DefaultMinBackoff
+	}
+	if c.maxBackoff <= 0 {
+		c.maxBackoff = DefaultMaxBackoff
+	}
+	return c
+}
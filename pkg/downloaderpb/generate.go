@@ -0,0 +1,5 @@
+// Package downloaderpb holds the messages and the gRPC client and server of the
+// downloader.v1.Downloader service, generated from proto/downloader.proto.
+package downloaderpb
+
+//go:generate protoc -I ../../proto --go_out=../.. --go_opt=module=example.com --go-grpc_out=../.. --go-grpc_opt=module=example.com downloader.proto
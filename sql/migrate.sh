@@ -0,0 +1,14 @@
+#!/bin/sh
+# Applies the migrations of sql/migrations not applied yet, in order, each in a transaction.
+# Usage: DATABASE_URL=postgres://... sh sql/migrate.sh
+set -e
+
+applied=$(psql "$DATABASE_URL" -tAc "SELECT version FROM schema_migrations" 2>/dev/null || true)
+for file in "$(dirname "$0")"/migrations/*.sql; do
+    version=$(basename "$file" | sed 's/_.*//; s/^0*//')
+    if echo "$applied" | grep -qx "$version"; then
+        continue
+    fi
+    echo "Applying $(basename "$file")"
+    psql "$DATABASE_URL" -v ON_ERROR_STOP=1 --single-transaction -q -f "$file"
+done
@@ -17,9 +17,18 @@ CREATE TABLE downloads (
     error VARCHAR DEFAULT '',
     UNIQUE (user_id, link),
     CONSTRAINT fk_user
-        FOREIGN KEY(user_id) 
+        FOREIGN KEY(user_id)
         REFERENCES users(id)
 );
 
 CREATE INDEX idx_downloads_id ON downloads(id);
 CREATE INDEX idx_downloads_user_id ON downloads(user_id);
+
+-- Every migration inserts its version, sql/migrate.sh skips the applied ones and GET /version
+-- reports the latest.
+CREATE TABLE schema_migrations (
+    version INT PRIMARY KEY,
+    applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+INSERT INTO schema_migrations (version) VALUES (1);
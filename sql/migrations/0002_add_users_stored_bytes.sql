@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN stored_bytes BIGINT NOT NULL DEFAULT 0;
+
+INSERT INTO schema_migrations (version) VALUES (2);
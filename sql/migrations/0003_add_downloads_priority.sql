@@ -0,0 +1,3 @@
+ALTER TABLE downloads ADD COLUMN priority SMALLINT NOT NULL DEFAULT 1;
+
+INSERT INTO schema_migrations (version) VALUES (3);
@@ -0,0 +1,9 @@
+ALTER TABLE downloads ADD COLUMN content_hash VARCHAR(64) NOT NULL DEFAULT '';
+
+CREATE TABLE contents (
+    hash VARCHAR(64) PRIMARY KEY,
+    size BIGINT NOT NULL,
+    ref_count INT NOT NULL DEFAULT 0
+);
+
+INSERT INTO schema_migrations (version) VALUES (4);
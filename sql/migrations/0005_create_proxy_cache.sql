@@ -0,0 +1,20 @@
+ALTER TABLE users ADD COLUMN is_admin BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE proxy_cache (
+    url VARCHAR(4096) PRIMARY KEY,
+    content_hash VARCHAR(64) NOT NULL,
+    content_type VARCHAR(256) NOT NULL DEFAULT '',
+    etag VARCHAR(256) NOT NULL DEFAULT '',
+    last_modified VARCHAR(64) NOT NULL DEFAULT '',
+    size BIGINT NOT NULL,
+    fetched_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE cache_policies (
+    id SERIAL PRIMARY KEY,
+    url_prefix VARCHAR(4096) NOT NULL,
+    max_age_seconds BIGINT NOT NULL,
+    no_store BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+INSERT INTO schema_migrations (version) VALUES (5);
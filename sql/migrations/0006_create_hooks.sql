@@ -0,0 +1,17 @@
+CREATE TABLE hooks (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL,
+    name VARCHAR(256) NOT NULL DEFAULT '',
+    token_hash VARCHAR(64) NOT NULL,
+    rate_limit INT NOT NULL DEFAULT 60,
+    allowed_ips TEXT[] NOT NULL DEFAULT '{}',
+    priority SMALLINT NOT NULL DEFAULT 1,
+    UNIQUE (token_hash),
+    CONSTRAINT fk_user
+        FOREIGN KEY(user_id)
+        REFERENCES users(id)
+);
+
+CREATE INDEX idx_hooks_user_id ON hooks(user_id);
+
+INSERT INTO schema_migrations (version) VALUES (6);
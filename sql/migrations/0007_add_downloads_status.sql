@@ -0,0 +1,27 @@
+ALTER TABLE users ADD COLUMN plan VARCHAR(32) NOT NULL DEFAULT 'default';
+
+ALTER TABLE downloads
+    ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'queued',
+    ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    ADD COLUMN started_at TIMESTAMPTZ,
+    ADD COLUMN expires_at TIMESTAMPTZ;
+
+-- Before the status, a download was finished once it completed or recorded an error.
+UPDATE downloads SET status = CASE WHEN completed THEN 'completed' WHEN error <> '' THEN 'failed' ELSE 'queued' END;
+
+CREATE INDEX idx_downloads_queued_expires_at ON downloads(expires_at) WHERE status = 'queued';
+
+CREATE TABLE notifications (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL,
+    download_id INT NOT NULL,
+    message VARCHAR NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CONSTRAINT fk_user
+        FOREIGN KEY(user_id)
+        REFERENCES users(id)
+);
+
+CREATE INDEX idx_notifications_user_id ON notifications(user_id);
+
+INSERT INTO schema_migrations (version) VALUES (7);
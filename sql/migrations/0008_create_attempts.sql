@@ -0,0 +1,22 @@
+CREATE TABLE attempts (
+    id SERIAL PRIMARY KEY,
+    download_id INT NOT NULL,
+    worker VARCHAR(256) NOT NULL,
+    source VARCHAR(4096) NOT NULL,
+    started_at TIMESTAMPTZ NOT NULL,
+    finished_at TIMESTAMPTZ,
+    offset_start BIGINT NOT NULL,
+    offset_end BIGINT NOT NULL,
+    bytes BIGINT NOT NULL DEFAULT 0,
+    status_code INT NOT NULL DEFAULT 0,
+    protocol VARCHAR(16) NOT NULL DEFAULT '',
+    response_headers JSONB,
+    error VARCHAR NOT NULL DEFAULT '',
+    CONSTRAINT fk_download
+        FOREIGN KEY(download_id)
+        REFERENCES downloads(id)
+);
+
+CREATE INDEX idx_attempts_download_id ON attempts(download_id);
+
+INSERT INTO schema_migrations (version) VALUES (8);
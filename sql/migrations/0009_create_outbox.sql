@@ -0,0 +1,10 @@
+CREATE TABLE outbox (
+    id BIGSERIAL PRIMARY KEY,
+    download_id INT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    sent_at TIMESTAMPTZ
+);
+
+CREATE INDEX idx_outbox_unsent ON outbox(id) WHERE sent_at IS NULL;
+
+INSERT INTO schema_migrations (version) VALUES (9);
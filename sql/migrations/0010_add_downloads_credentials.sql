@@ -0,0 +1,3 @@
+ALTER TABLE downloads ADD COLUMN credentials VARCHAR NOT NULL DEFAULT '';
+
+INSERT INTO schema_migrations (version) VALUES (10);
@@ -0,0 +1,10 @@
+CREATE TABLE queue_events (
+    id BIGSERIAL PRIMARY KEY,
+    download_id INT NOT NULL,
+    type VARCHAR(16) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_queue_events_created_at ON queue_events(created_at);
+
+INSERT INTO schema_migrations (version) VALUES (11);
@@ -0,0 +1,7 @@
+ALTER TABLE downloads
+    ADD COLUMN finished_at TIMESTAMPTZ,
+    ADD COLUMN file_purged_at TIMESTAMPTZ;
+
+CREATE INDEX idx_downloads_failed_finished_at ON downloads(finished_at) WHERE status = 'failed' AND file_purged_at IS NULL;
+
+INSERT INTO schema_migrations (version) VALUES (12);
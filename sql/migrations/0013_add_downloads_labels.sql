@@ -0,0 +1,5 @@
+ALTER TABLE downloads ADD COLUMN labels JSONB NOT NULL DEFAULT '{}';
+
+CREATE INDEX idx_downloads_labels ON downloads USING GIN (labels);
+
+INSERT INTO schema_migrations (version) VALUES (13);
@@ -0,0 +1,6 @@
+-- A link may be downloaded once as a whole and once per range.
+ALTER TABLE downloads ADD COLUMN byte_range VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE downloads DROP CONSTRAINT downloads_user_id_link_key;
+ALTER TABLE downloads ADD UNIQUE (user_id, link, byte_range);
+
+INSERT INTO schema_migrations (version) VALUES (14);
@@ -0,0 +1,16 @@
+CREATE TABLE origin_profiles (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL,
+    name VARCHAR(256) NOT NULL,
+    kind VARCHAR(16) NOT NULL,
+    secret VARCHAR NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (user_id, name),
+    CONSTRAINT fk_user
+        FOREIGN KEY(user_id)
+        REFERENCES users(id)
+);
+
+ALTER TABLE downloads ADD COLUMN origin_profile_id INT REFERENCES origin_profiles(id) ON DELETE SET NULL;
+
+INSERT INTO schema_migrations (version) VALUES (15);
@@ -0,0 +1,3 @@
+CREATE INDEX idx_downloads_recent_failures ON downloads(finished_at DESC) WHERE status = 'failed';
+
+INSERT INTO schema_migrations (version) VALUES (16);
@@ -0,0 +1,3 @@
+ALTER TABLE downloads ADD COLUMN max_speed BIGINT NOT NULL DEFAULT 0; -- bytes per second, 0 means unlimited
+
+INSERT INTO schema_migrations (version) VALUES (17);
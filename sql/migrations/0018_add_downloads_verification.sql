@@ -0,0 +1,6 @@
+ALTER TABLE downloads
+    ADD COLUMN manifest_url VARCHAR(4096) NOT NULL DEFAULT '',
+    ADD COLUMN verification VARCHAR(16) NOT NULL DEFAULT '', -- verified, mismatch or unverified
+    ADD COLUMN verification_detail VARCHAR NOT NULL DEFAULT '';
+
+INSERT INTO schema_migrations (version) VALUES (18);
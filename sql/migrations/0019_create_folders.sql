@@ -0,0 +1,17 @@
+CREATE TABLE folders (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL,
+    parent_id INT REFERENCES folders(id) ON DELETE CASCADE, -- NULL at the top level
+    name VARCHAR(256) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CONSTRAINT fk_user
+        FOREIGN KEY(user_id)
+        REFERENCES users(id)
+);
+
+-- Names are unique among siblings, including at the top level where parent_id is NULL.
+CREATE UNIQUE INDEX idx_folders_name ON folders (user_id, COALESCE(parent_id, 0), name);
+
+ALTER TABLE downloads ADD COLUMN folder_id INT REFERENCES folders(id) ON DELETE SET NULL;
+
+INSERT INTO schema_migrations (version) VALUES (19);
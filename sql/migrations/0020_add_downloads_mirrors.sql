@@ -0,0 +1,3 @@
+ALTER TABLE downloads ADD COLUMN mirrors TEXT[] NOT NULL DEFAULT '{}'; -- links of the same file to fail over to, in order
+
+INSERT INTO schema_migrations (version) VALUES (20);
@@ -0,0 +1,3 @@
+ALTER TABLE downloads ADD COLUMN host VARCHAR(256) NOT NULL DEFAULT ''; -- instance ID of the process whose disk holds the file
+
+INSERT INTO schema_migrations (version) VALUES (21);
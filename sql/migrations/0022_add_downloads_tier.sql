@@ -0,0 +1,8 @@
+ALTER TABLE downloads
+    ADD COLUMN tier VARCHAR(16) NOT NULL DEFAULT 'hot', -- hot, cold or restoring
+    ADD COLUMN cold_key VARCHAR(1024) NOT NULL DEFAULT '', -- key of the file in cold storage
+    ADD COLUMN tiered_at TIMESTAMPTZ;
+
+CREATE INDEX idx_downloads_hot_completed ON downloads(host, finished_at) WHERE status = 'completed' AND tier = 'hot';
+
+INSERT INTO schema_migrations (version) VALUES (22);
@@ -0,0 +1,10 @@
+-- Gates of new behaviors, see internal/flags. A flag without row keeps its default.
+CREATE TABLE feature_flags (
+    name VARCHAR(64) PRIMARY KEY,
+    enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    rollout_percent SMALLINT NOT NULL DEFAULT 0,
+    user_ids INT[] NOT NULL DEFAULT '{}',
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+INSERT INTO schema_migrations (version) VALUES (23);
@@ -0,0 +1,21 @@
+-- Scripts run in a sandbox on the file of every completed download of the user.
+CREATE TABLE completion_scripts (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL,
+    name VARCHAR(256) NOT NULL DEFAULT '',
+    script TEXT NOT NULL,
+    timeout_seconds INT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CONSTRAINT fk_user
+        FOREIGN KEY(user_id)
+        REFERENCES users(id)
+);
+
+CREATE INDEX idx_completion_scripts_user_id ON completion_scripts(user_id);
+
+-- The outcome of a script run, on its 'script' event.
+ALTER TABLE queue_events ADD COLUMN detail JSONB;
+
+CREATE INDEX idx_queue_events_scripts ON queue_events(download_id) WHERE type = 'script';
+
+INSERT INTO schema_migrations (version) VALUES (24);
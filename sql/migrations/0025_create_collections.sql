@@ -0,0 +1,21 @@
+-- Named groups of downloads, e.g. the episodes of a season. Unlike folders, a download may be
+-- in several collections.
+CREATE TABLE collections (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL,
+    name VARCHAR(256) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (user_id, name),
+    CONSTRAINT fk_user
+        FOREIGN KEY(user_id)
+        REFERENCES users(id)
+);
+
+CREATE TABLE collection_downloads (
+    collection_id INT NOT NULL REFERENCES collections(id) ON DELETE CASCADE,
+    download_id INT NOT NULL REFERENCES downloads(id) ON DELETE CASCADE,
+    added_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (collection_id, download_id)
+);
+
+INSERT INTO schema_migrations (version) VALUES (25);
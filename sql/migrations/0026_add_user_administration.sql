@@ -0,0 +1,6 @@
+-- Account administration. Tokens carry the token_version of their user, bumping it revokes them.
+ALTER TABLE users ADD COLUMN disabled_at TIMESTAMPTZ;
+ALTER TABLE users ADD COLUMN token_version INT NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN password_reset_required BOOLEAN NOT NULL DEFAULT FALSE;
+
+INSERT INTO schema_migrations (version) VALUES (26);
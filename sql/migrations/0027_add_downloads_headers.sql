@@ -0,0 +1,4 @@
+-- Request headers and cookies of HTTP downloads, sealed like the credentials.
+ALTER TABLE downloads ADD COLUMN headers VARCHAR NOT NULL DEFAULT '';
+
+INSERT INTO schema_migrations (version) VALUES (27);
@@ -0,0 +1,3 @@
+ALTER TABLE origin_profiles ADD COLUMN hosts TEXT[] NOT NULL DEFAULT '{}'; -- hosts whose downloads use the profile without naming it
+
+INSERT INTO schema_migrations (version) VALUES (28);
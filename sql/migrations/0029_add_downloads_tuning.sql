@@ -0,0 +1,4 @@
+-- Transfer overrides of a download (read timeout, chunk size, flush threshold, TCP congestion control).
+ALTER TABLE downloads ADD COLUMN tuning JSONB NOT NULL DEFAULT '{}';
+
+INSERT INTO schema_migrations (version) VALUES (29);
@@ -0,0 +1,4 @@
+-- Proxy of a download overriding DOWNLOAD_PROXY, sealed like the credentials since it may carry some.
+ALTER TABLE downloads ADD COLUMN proxy VARCHAR NOT NULL DEFAULT '';
+
+INSERT INTO schema_migrations (version) VALUES (30);
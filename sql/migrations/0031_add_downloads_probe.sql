@@ -0,0 +1,5 @@
+-- Health of the links of queued downloads: probes in a row finding the link dead, and when it is probed next.
+ALTER TABLE downloads ADD COLUMN probe_failures INT NOT NULL DEFAULT 0;
+ALTER TABLE downloads ADD COLUMN probe_at TIMESTAMPTZ;
+
+INSERT INTO schema_migrations (version) VALUES (31);
@@ -0,0 +1,13 @@
+-- Users a collection is shared with besides its owner: viewers see its downloads and progress,
+-- contributors also add their own downloads to it.
+CREATE TABLE collection_members (
+    collection_id INT NOT NULL REFERENCES collections(id) ON DELETE CASCADE,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role VARCHAR(16) NOT NULL CHECK (role IN ('viewer', 'contributor')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (collection_id, user_id)
+);
+
+CREATE INDEX idx_collection_members_user_id ON collection_members(user_id);
+
+INSERT INTO schema_migrations (version) VALUES (32);
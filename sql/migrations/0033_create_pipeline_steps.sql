@@ -0,0 +1,17 @@
+-- Steps run on the file of a download once it completes (checksum, virus scan, extraction, ...),
+-- in position order, each with its own status so users see which one failed.
+CREATE TABLE pipeline_steps (
+    download_id INT NOT NULL REFERENCES downloads(id) ON DELETE CASCADE,
+    position INT NOT NULL,
+    name VARCHAR(64) NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'running', 'succeeded', 'failed', 'skipped')),
+    detail TEXT NOT NULL DEFAULT '',
+    error TEXT NOT NULL DEFAULT '',
+    started_at TIMESTAMPTZ,
+    finished_at TIMESTAMPTZ,
+    PRIMARY KEY (download_id, position)
+);
+
+CREATE INDEX idx_pipeline_steps_unfinished ON pipeline_steps(download_id) WHERE status IN ('pending', 'running');
+
+INSERT INTO schema_migrations (version) VALUES (33);
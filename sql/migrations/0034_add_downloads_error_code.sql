@@ -0,0 +1,5 @@
+-- Machine readable class of the error of a failed download, e.g. html_error_page, empty when
+-- the error is not classified.
+ALTER TABLE downloads ADD COLUMN error_code VARCHAR(32) NOT NULL DEFAULT '';
+
+INSERT INTO schema_migrations (version) VALUES (34);
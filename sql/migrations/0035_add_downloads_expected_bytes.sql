@@ -0,0 +1,7 @@
+-- Size of the file announced by the origin for the current attempt (NULL if unknown), the size
+-- the download completed with, and how often it was resumed after the origin cut the transfer.
+ALTER TABLE downloads ADD COLUMN expected_bytes BIGINT;
+ALTER TABLE downloads ADD COLUMN bytes BIGINT;
+ALTER TABLE downloads ADD COLUMN eof_resumes INT NOT NULL DEFAULT 0;
+
+INSERT INTO schema_migrations (version) VALUES (35);
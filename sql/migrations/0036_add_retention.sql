@@ -0,0 +1,10 @@
+-- Retention: a per-user override of how long finished downloads are kept (NULL for the one of
+-- the plan or RETENTION_TTL), and the downloads their owner asked to purge on the disk of
+-- another process.
+ALTER TABLE users ADD COLUMN retention_seconds BIGINT;
+ALTER TABLE downloads ADD COLUMN purge_requested_at TIMESTAMPTZ;
+
+CREATE INDEX idx_downloads_finished_at ON downloads(finished_at) WHERE status IN ('completed', 'failed', 'expired');
+CREATE INDEX idx_downloads_purge_requested_at ON downloads(purge_requested_at) WHERE purge_requested_at IS NOT NULL;
+
+INSERT INTO schema_migrations (version) VALUES (36);
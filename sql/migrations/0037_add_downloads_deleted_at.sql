@@ -0,0 +1,7 @@
+-- Trash: downloads their owner deleted are kept with their file for TRASH_RETENTION, and can
+-- be restored meanwhile, before they are purged.
+ALTER TABLE downloads ADD COLUMN deleted_at TIMESTAMPTZ;
+
+CREATE INDEX idx_downloads_deleted_at ON downloads(deleted_at) WHERE deleted_at IS NOT NULL;
+
+INSERT INTO schema_migrations (version) VALUES (37);
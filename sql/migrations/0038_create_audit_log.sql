@@ -0,0 +1,28 @@
+-- Audit trail of the actions of users and admins: who did what to which resource, from where
+-- and how it went. It is append-only: its rows cannot be updated or deleted. user_id is not a
+-- foreign key so the trail of deleted users is kept.
+CREATE TABLE audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INT,
+    username VARCHAR(256) NOT NULL DEFAULT '',
+    action VARCHAR(256) NOT NULL,
+    resource VARCHAR(4096) NOT NULL,
+    ip VARCHAR(64) NOT NULL DEFAULT '',
+    status VARCHAR(32) NOT NULL,
+    result VARCHAR(16) NOT NULL CHECK (result IN ('success', 'failure')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_audit_log_created_at ON audit_log(created_at);
+CREATE INDEX idx_audit_log_user_id ON audit_log(user_id, created_at);
+
+CREATE FUNCTION audit_log_append_only() RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_log
+    FOR EACH STATEMENT EXECUTE FUNCTION audit_log_append_only();
+
+INSERT INTO schema_migrations (version) VALUES (38);
@@ -0,0 +1,7 @@
+-- Accounts their owner deleted: disabled at once, and removed with what they own once the
+-- files of their downloads are purged.
+ALTER TABLE users ADD COLUMN deleted_at TIMESTAMPTZ;
+
+CREATE INDEX idx_users_deleted_at ON users(deleted_at) WHERE deleted_at IS NOT NULL;
+
+INSERT INTO schema_migrations (version) VALUES (39);
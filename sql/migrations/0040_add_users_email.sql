@@ -0,0 +1,8 @@
+-- Email of the users, for the verification of their registration and to reset a forgotten
+-- password. An address belongs to one account at most, whatever its case.
+ALTER TABLE users ADD COLUMN email VARCHAR(320);
+ALTER TABLE users ADD COLUMN email_verified_at TIMESTAMPTZ;
+
+CREATE UNIQUE INDEX idx_users_email ON users(LOWER(email));
+
+INSERT INTO schema_migrations (version) VALUES (40);
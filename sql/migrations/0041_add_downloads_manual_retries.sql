@@ -0,0 +1,6 @@
+-- Failed downloads retried by their owner or an operator: how many times, and whether the
+-- next worker starts over instead of resuming the partial file.
+ALTER TABLE downloads ADD COLUMN manual_retries INT NOT NULL DEFAULT 0;
+ALTER TABLE downloads ADD COLUMN restart BOOLEAN NOT NULL DEFAULT false;
+
+INSERT INTO schema_migrations (version) VALUES (41);
@@ -0,0 +1,5 @@
+-- What the origin told of the file of an http(s) download in answer to the HEAD request sent
+-- before fetching it: size, type, validators and whether it serves byte ranges.
+ALTER TABLE downloads ADD COLUMN preflight JSONB;
+
+INSERT INTO schema_migrations (version) VALUES (42);
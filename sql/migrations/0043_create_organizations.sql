@@ -0,0 +1,26 @@
+-- Organizations group users: the downloads they request for an organization are seen by all of
+-- its members, and count against the storage quota and the rate limit of the organization.
+CREATE TABLE organizations (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(256) NOT NULL UNIQUE,
+    quota_bytes BIGINT, -- NULL for ORG_QUOTA_BYTES
+    rate_limit BIGINT, -- downloads per rate limit window, NULL for RATE_LIMIT_ORG_DOWNLOADS
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE organization_members (
+    org_id INT NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role VARCHAR(16) NOT NULL CHECK (role IN ('owner', 'admin', 'member')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (org_id, user_id)
+);
+
+CREATE INDEX idx_organization_members_user_id ON organization_members(user_id);
+
+-- The downloads of a deleted organization stay with the members who requested them.
+ALTER TABLE downloads ADD COLUMN org_id INT REFERENCES organizations(id) ON DELETE SET NULL;
+
+CREATE INDEX idx_downloads_org_id ON downloads(org_id) WHERE org_id IS NOT NULL;
+
+INSERT INTO schema_migrations (version) VALUES (43);
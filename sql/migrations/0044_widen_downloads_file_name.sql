@@ -0,0 +1,8 @@
+-- DOWNLOAD_DIR and DOWNLOAD_PATH_TEMPLATE make the file names of the downloads paths, longer
+-- than the hashes they were. New downloads check whether their path is taken, unless the
+-- template has the hash of the download.
+ALTER TABLE downloads ALTER COLUMN file_name TYPE TEXT;
+
+CREATE INDEX idx_downloads_file_name ON downloads(file_name);
+
+INSERT INTO schema_migrations (version) VALUES (44);
@@ -0,0 +1,5 @@
+-- What was found in the completed file of a download: its type sniffed from its contents, the
+-- dimensions of images and videos, the duration of audio and videos, the pages of PDFs.
+ALTER TABLE downloads ADD COLUMN metadata JSONB;
+
+INSERT INTO schema_migrations (version) VALUES (45);
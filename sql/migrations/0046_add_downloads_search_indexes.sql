@@ -0,0 +1,15 @@
+-- Filters and sort orders of GET /downloads/: the host of the link (lowercased, without the
+-- user info and the port, NULL for links without one such as magnets), trigrams of the link for
+-- the searches of a part of it, and the columns of the user's downloads filtered or sorted by.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+ALTER TABLE downloads ADD COLUMN link_host TEXT
+    GENERATED ALWAYS AS (lower(substring(link from '^[a-zA-Z][a-zA-Z0-9+.-]*://(?:[^/?#@]*@)?([^/:?#]+)'))) STORED;
+
+CREATE INDEX idx_downloads_user_link_host ON downloads(user_id, link_host);
+CREATE INDEX idx_downloads_link_trgm ON downloads USING GIN (link gin_trgm_ops);
+CREATE INDEX idx_downloads_user_created_at ON downloads(user_id, created_at);
+CREATE INDEX idx_downloads_user_status ON downloads(user_id, status);
+CREATE INDEX idx_downloads_user_bytes ON downloads(user_id, bytes);
+
+INSERT INTO schema_migrations (version) VALUES (46);
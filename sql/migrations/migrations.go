@@ -0,0 +1,8 @@
+// Package migrations holds the changes of the database schema, applied in order by
+// sql/migrate.sh or by dlctl migrate, which embeds them.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var Files embed.FS